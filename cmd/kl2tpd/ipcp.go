@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+// pppd reports IPCP coming up and going down by running the ip-up and
+// ip-down scripts generated for the session, which write the event along
+// with the interface name and the addresses pppd passes them in their
+// environment to a FIFO read by kl2tpd.
+// Ref: pppd(8) section SCRIPTS.
+
+// The scripts generated for a session, named for the pppd options setting
+// them and the event each writes to the FIFO
+var ipcpScripts = []struct {
+	option, event string
+}{
+	{"ip-up-script", "up"},
+	{"ip-down-script", "down"},
+}
+
+// ipcpScriptPath returns the path of the script generated for a session to
+// report an IPCP event.
+func (app *application) ipcpScriptPath(tunnelName, sessionName, event string) string {
+	return filepath.Join(app.runDir, fmt.Sprintf("%s.%s.ip-%s", tunnelName, sessionName, event))
+}
+
+// ipcpFIFOPath returns the path of the FIFO the scripts of a session write
+// to.
+func (app *application) ipcpFIFOPath(tunnelName, sessionName string) string {
+	return filepath.Join(app.runDir, fmt.Sprintf("%s.%s.ipcp", tunnelName, sessionName))
+}
+
+// quoteShellWord quotes a word of a shell script.
+func quoteShellWord(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// writeIPCPScript generates the script reporting an IPCP event for a
+// session, returning the path of the script.
+func (app *application) writeIPCPScript(tunnelName, sessionName, event string) (string, error) {
+	script := fmt.Sprintf("#!/bin/sh\n"+
+		"# Generated by kl2tpd for session %s of tunnel %s\n"+
+		"echo \"%s $IFNAME $IPLOCAL $IPREMOTE $DNS1 $DNS2\" > %s\n",
+		sessionName, tunnelName, event,
+		quoteShellWord(app.ipcpFIFOPath(tunnelName, sessionName)))
+
+	path := app.ipcpScriptPath(tunnelName, sessionName, event)
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// parseIPCPNotification parses a line written by the ip-up or ip-down
+// script, returning whether IPCP came up.  pppd sets DNS1 and DNS2 only if
+// the peer gave DNS server addresses, so the addresses following the local
+// and remote addresses are those of the DNS servers.
+func parseIPCPNotification(line string) (up bool, info l2tp.IPCPInfo, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || len(fields) > 6 {
+		return false, info, fmt.Errorf("malformed IPCP notification %q", line)
+	}
+	switch fields[0] {
+	case "up":
+		up = true
+	case "down":
+	default:
+		return false, info, fmt.Errorf("unrecognised IPCP event %q", fields[0])
+	}
+	info.InterfaceName = fields[1]
+	addrs := make([]net.IP, len(fields)-2)
+	for i, field := range fields[2:] {
+		if addrs[i] = net.ParseIP(field).To4(); addrs[i] == nil {
+			return false, info, fmt.Errorf("malformed address %q in IPCP notification", field)
+		}
+	}
+	info.LocalAddr, info.PeerAddr = addrs[0], addrs[1]
+	if len(addrs) > 2 {
+		info.DNS = addrs[2:]
+	}
+	return up, info, nil
+}
+
+// openIPCPFIFO creates the FIFO the scripts of a session write to, and
+// starts reporting the notifications written to it to the session until the
+// returned file is closed.
+func (app *application) openIPCPFIFO(ev *l2tp.SessionUpEvent) (*os.File, error) {
+	path := app.ipcpFIFOPath(ev.TunnelName, ev.SessionName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := unix.Mkfifo(path, 0600); err != nil {
+		return nil, fmt.Errorf("mkfifo(%v): %v", path, err)
+	}
+	// Opening the FIFO for writing as well as reading means that it
+	// isn't at end of file between the scripts' writes
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			up, info, err := parseIPCPNotification(scanner.Text())
+			if err != nil {
+				level.Error(app.logger).Log(
+					"message", "failed to parse IPCP notification",
+					"tunnel_name", ev.TunnelName,
+					"session_name", ev.SessionName,
+					"error", err)
+				continue
+			}
+			if up {
+				ev.Session.ReportIPCPUp(info)
+			} else {
+				ev.Session.ReportIPCPDown(info)
+			}
+		}
+	}()
+	return file, nil
+}
@@ -1,10 +1,16 @@
 /*
-The kl2tpd command is a daemon for creating dynamic L2TPv2 tunnels and sessions.
+The kl2tpd command is a daemon for creating dynamic L2TP tunnels and PPP sessions.
 
-Package l2tp is used for the L2TPv2 control protocol and Linux kernel dataplane
+Package l2tp is used for the L2TP control protocol and Linux kernel dataplane
 operations.  For established sessions, kl2tpd spawns pppd(8) instances to run the
 PPP protocol and bring up a network interface.
 
+On systems without the pppol2tp kernel module, the -userspace flag selects the
+userspace data plane of package l2tp.  pppd is then run on a pty rather than using
+the pppol2tp plugin, and kl2tpd relays the PPP frames of each session between the
+data plane and the pty, using the asynchronous HDLC-like framing pppd expects of a
+serial line as implemented by package ppp.
+
 kl2tpd is driven by a configuration file which describes the tunnel and session
 instances to create.  For more information on the configuration file format please
 refer to package config's documentation.
@@ -20,6 +26,138 @@ either be whitespace or newline delimited, and should call out pppd command line
 as described in the pppd manpage.  kl2tpd augments the arguments from the command file
 with arguments specific to the establishment of the PPPoL2TP session using the pppd
 pppol2tp plugin.
+
+kl2tpd generates a pppd options file for each session, which is passed to pppd
+ahead of the arguments from the command file so that they may override it.  The
+files are written to the directory named by the -rundir flag, /run/kl2tpd by default,
+and are removed when the session closes.  The options file sets the session MTU as
+pppd's mtu and mru options, and may also set pppd's authentication credentials, ACCM
+and unit number from parameters of the tunnel or session configuration tables.
+Session parameters override those of the tunnel:
+
+	[tunnel.t1]
+	pppd_user = "bob"
+	pppd_password = "secret"
+
+	[tunnel.t1.session.s1]
+	pppd_accm = 0x000a0000
+	pppd_unit = 3
+
+So that passwords needn't be kept in the configuration file, pppd_password_file or
+pppd_password_env may instead read the password from a file or an environment
+variable, as the secret_file and secret_env tunnel parameters of package config do
+for tunnel secrets.  Like the parameters of package config, kl2tpd's parameters may be
+set in tunnel and session profiles for tunnels and sessions to share.
+
+Sessions with a bundle_id have pppd enable Multilink PPP, identifying the bundle to
+the peer with a locally assigned endpoint discriminator holding the bundle ID, so
+that pppd joins sessions sharing a bundle ID into one bundle.
+
+A tunnel may have kl2tpd allocate subscriber addresses to its sessions from an
+address pool, as an LNS would.  The pppd_ipv4_pool parameter gives the prefix from
+which each session is allocated an IPv4 address, which pppd assigns to the peer using
+IPCP.  The first address of the prefix is used for pppd's end of the links.  The
+pppd_ipv6_pd_pool parameter gives a prefix from which each session is allocated a
+prefix for delegation, /56 by default or as set by pppd_ipv6_pd_len, which is passed to
+pppd's scripts in the PD_PREFIX environment variable:
+
+	[tunnel.t1]
+	pppd_ipv4_pool = "10.0.0.0/24"
+	pppd_ipv6_pd_pool = "2001:db8::/48"
+	pppd_ipv6_pd_len = 56
+
+A session keeps its addresses when it closes unless they are needed for another
+session.  The leases are saved in the runtime directory, so sessions keep their
+addresses across restarts of kl2tpd.
+
+The options file also has pppd request DNS server addresses from the peer, and run
+ip-up and ip-down scripts generated alongside it when IPCP comes up and goes down.
+The scripts report the interface name and negotiated addresses to kl2tpd, which logs
+them and passes them to the session using l2tp.Session.ReportIPCPUp and
+l2tp.Session.ReportIPCPDown.
+
+The session interface_name is passed to pppd as its ifname option.  Since pppd
+requires a literal name, kl2tpd expands an interface name template such as
+"ppp-l2tp%d" to the lowest numbered name not already in use.
+
+When pppd exits, kl2tpd closes its session by default.  The peer is informed of
+pppd's exit status by the CDN message closing the session, and the status is logged
+along with the session being brought down.
+
+Alternatively kl2tpd may restart pppd, keeping the session up, according to a
+restart policy set in the session configuration table:
+
+	[tunnel.t1.session.s1]
+	pppd_restart = "on-failure"
+	pppd_restart_backoff = 2000
+	pppd_max_restarts = 5
+
+kl2tpd uses pppd's exit status to distinguish authentication failures, where either
+peer failed to authenticate, from link failures, where PPP negotiation failed or the
+link was lost, e.g. because the peer stopped answering LCP echo requests.  The
+pppd_restart parameter may be "never", the default, "on-failure", which restarts pppd
+after link failures only, or "always", which also restarts pppd after authentication
+failures and after pppd exits normally.  pppd is never restarted after errors such as
+invalid pppd arguments, which restarting it won't resolve.
+
+The pppd_restart_backoff parameter sets the delay in milliseconds before pppd is
+restarted, which defaults to 1000ms.  The delay is doubled for each consecutive restart,
+up to a limit of one minute, and the pppd_max_restarts parameter may limit the number of
+consecutive restarts, after which the session is closed.  pppd staying up for a minute
+or more resets the count of consecutive restarts.
+
+kl2tpd can also act as a LAC for PPPoE hosts on an access network, relaying
+their PPPoE sessions into L2TP sessions using package pppoe.  This is enabled
+for a tunnel by naming the access interface in the tunnel configuration table:
+
+	[tunnel.t1]
+	peer = "lns.example.com:1701"
+	version = "l2tpv2"
+	pppoe_interface = "eth1"
+	pppoe_ac_name = "lac1"
+	pppoe_proxy_lcp = true
+
+A session is created in the tunnel for each PPPoE session a host requests, so
+PPPoE tunnels may not have sessions in the configuration file.  The PPP frames
+of the sessions are relayed by kl2tpd itself rather than by pppd, using the
+userspace data plane.  The optional pppoe_ac_name parameter sets the access
+concentrator name offered to hosts, which defaults to the host name.  Setting the
+optional pppoe_proxy_lcp parameter has kl2tpd negotiate LCP with hosts and collect
+their responses to authentication itself, passing the results to the LNS in the
+Proxy LCP and Proxy Authentication AVPs of the ICCN so that the LNS needn't
+renegotiate LCP.  Setting the optional pppoe_multilink parameter tags the sessions
+of each host with a Multilink PPP bundle ID derived from the host's MAC address, so
+that hosts may bundle several PPPoE sessions, and has the LCP proxy negotiate
+Multilink accordingly.
+
+Sending kl2tpd SIGHUP has it reload the configuration file, bringing the running
+tunnels and sessions into line with it.  Tunnels and sessions removed from the file
+are closed, those added to it are created, and those whose configuration has changed
+are closed and recreated, while those whose configuration is unchanged are left
+undisturbed.  Changes to pppd's parameters take effect the next time pppd is started
+for a session.  If the file can't be loaded, kl2tpd logs the error and keeps running
+with its current configuration.
+
+Running kl2tpd with the -check-config flag checks the configuration file using
+config.Config.Validate and kl2tpd's own checks, printing any problems found, and exits
+without creating any tunnels.  The exit status is non-zero if the file has problems.
+
+Configuration files written for an earlier version of the configuration format are
+migrated as they're loaded, and kl2tpd logs a warning for each deprecated parameter,
+which -check-config also prints.
+
+kl2tpd logs to stderr at the info level by default, or at the debug level if run with
+the -verbose flag.  The -log-level flag sets the level of logging, and may set the levels
+of particular subsystems as described by package logging, e.g. "info,transport=debug"
+to debug the control protocol transport, or "warn,session=info" to report little other
+than the sessions coming up and going down.
+
+Running kl2tpd with the -dump-config flag prints the effective configuration as JSON
+and exits, as described by config.Config.DumpJSON: the parameters of each tunnel and
+session are listed once merged with their profiles and the tunnel defaults, with secrets
+and passwords redacted.  Sending kl2tpd SIGUSR1 writes the effective configuration it's
+running with to config.json in the runtime directory in the same way, which is useful
+for checking the outcome of a reload or when reporting problems.
 */
 package main
 
@@ -27,60 +165,129 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	stdlog "log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/katalix/go-l2tp/config"
 	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/katalix/go-l2tp/logging"
+	"github.com/katalix/go-l2tp/pppoe"
 	"golang.org/x/sys/unix"
 )
 
+// appConfig holds the configuration of kl2tpd, including the parameters
+// kl2tpd adds to the tunnel and session configuration tables.
+type appConfig struct {
+	config *config.Config
+	// sessionPPPdArgs[tunnel_name][session_name]
+	sessionPPPdArgs map[string]map[string][]string
+	// sessionPPPdRestart[tunnel_name][session_name]
+	sessionPPPdRestart map[string]map[string]*pppdRestartPolicy
+	// tunnelPPPdOptions[tunnel_name]
+	tunnelPPPdOptions map[string]pppdOptions
+	// sessionPPPdOptions[tunnel_name][session_name]
+	sessionPPPdOptions map[string]map[string]*pppdOptions
+	// tunnelPools[tunnel_name]
+	tunnelPools map[string]*tunnelPool
+	// tunnelPPPoE[tunnel_name]
+	tunnelPPPoE map[string]*pppoe.Config
+}
+
 type application struct {
-	config  *config.Config
-	logger  log.Logger
-	l2tpCtx *l2tp.Context
+	// appConfig is replaced when the configuration is reloaded, so is
+	// protected by lock
+	*appConfig
+	configPath string
+	logger     log.Logger
+	// ctxLogger is the logger of the L2TP contexts
+	ctxLogger log.Logger
+	l2tpCtx   *l2tp.Context
 	// sessionPPPoL2TP[tunnel_name][session_name]
 	sessionPPPoL2TP map[string]map[string]*pppol2tp
-	// sessionPPPdArgs[tunnel_name][session_name]
-	sessionPPPdArgs map[string]map[string][]string
+	// tunnels[tunnel_name] and relays[tunnel_name] are the running
+	// tunnels and PPPoE relays, which are modified by run and reload only
+	tunnels map[string]l2tp.Tunnel
+	relays  map[string]*pppoe.Relay
+	// runDir is the directory of the generated pppd options files
+	runDir string
+	// ptyPPP is set if pppd runs on a pty rather than a pppox socket,
+	// because sessions use the userspace data plane
+	ptyPPP bool
+	// pppoeCtx runs the tunnels of PPPoE relays, whose sessions use
+	// the userspace data plane
+	pppoeCtx        *l2tp.Context
 	sigChan         chan os.Signal
+	hupChan         chan os.Signal
+	usr1Chan        chan os.Signal
 	pppCompleteChan chan *pppol2tp
+	pppRestartChan  chan *pppol2tp
 	closeChan       chan interface{}
 	wg              sync.WaitGroup
+	// lock protects sessionPPPoL2TP and appConfig, which are accessed
+	// both by the event handler and the main loop
+	lock sync.Mutex
 }
 
-func newApplication(configPath string, verbose, nullDataplane bool) (app *application, err error) {
+func newApplication(configPath, runDir string, levels logging.Levels, nullDataplane, userspaceDataplane bool) (app *application, err error) {
+	if nullDataplane && userspaceDataplane {
+		return nil, fmt.Errorf("the null and userspace data planes are mutually exclusive")
+	}
 
 	app = &application{
+		configPath:      configPath,
 		sigChan:         make(chan os.Signal, 1),
+		hupChan:         make(chan os.Signal, 1),
+		usr1Chan:        make(chan os.Signal, 1),
 		sessionPPPoL2TP: make(map[string]map[string]*pppol2tp),
-		sessionPPPdArgs: make(map[string]map[string][]string),
+		tunnels:         make(map[string]l2tp.Tunnel),
+		relays:          make(map[string]*pppoe.Relay),
+		runDir:          runDir,
 		pppCompleteChan: make(chan *pppol2tp),
+		pppRestartChan:  make(chan *pppol2tp),
 		closeChan:       make(chan interface{}),
 	}
 
 	signal.Notify(app.sigChan, unix.SIGINT, unix.SIGTERM)
+	signal.Notify(app.hupChan, unix.SIGHUP)
+	signal.Notify(app.usr1Chan, unix.SIGUSR1)
 
-	app.config, err = config.LoadFileWithCustomParser(configPath, app)
+	app.appConfig, err = loadAppConfig(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load configuration: %v", err)
+		return nil, err
 	}
 
-	logger := log.NewLogfmtLogger(os.Stderr)
-	if verbose {
-		app.logger = level.NewFilter(logger, level.AllowDebug())
-	} else {
-		app.logger = level.NewFilter(logger, level.AllowInfo())
+	if err = os.MkdirAll(runDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create runtime directory: %v", err)
+	}
+
+	logger := logging.NewFilter(logging.NewLogfmtLogger(os.Stderr), levels)
+	app.ctxLogger = logger
+	app.logger = logger
+
+	app.logWarnings(app.appConfig)
+
+	if err = app.newPools(app.appConfig, nil); err != nil {
+		return nil, err
 	}
 
 	dataplane := l2tp.LinuxNetlinkDataPlane
 	if nullDataplane {
 		dataplane = nil
+	} else if userspaceDataplane {
+		dataplane, err = l2tp.NewUserspaceDataPlane(l2tp.OpenFramePort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create userspace data plane: %v", err)
+		}
+		app.ptyPPP = true
 	}
 
 	app.l2tpCtx, err = l2tp.NewContext(dataplane, logger)
@@ -88,9 +295,87 @@ func newApplication(configPath string, verbose, nullDataplane bool) (app *applic
 		return nil, fmt.Errorf("failed to create L2TP context: %v", err)
 	}
 
+	if len(app.tunnelPPPoE) > 0 {
+		if err = app.newPPPoEContext(); err != nil {
+			return nil, err
+		}
+	}
+
 	return app, nil
 }
 
+// newPPPoEContext creates the L2TP context for the tunnels of PPPoE relays.
+func (app *application) newPPPoEContext() error {
+	dataplane, err := l2tp.NewUserspaceDataPlane(l2tp.OpenFramePort)
+	if err != nil {
+		return fmt.Errorf("failed to create userspace data plane: %v", err)
+	}
+	app.pppoeCtx, err = l2tp.NewContext(dataplane, app.ctxLogger)
+	if err != nil {
+		return fmt.Errorf("failed to create L2TP context for PPPoE: %v", err)
+	}
+	return nil
+}
+
+// loadAppConfig loads and checks the configuration file.
+func loadAppConfig(path string) (cfg *appConfig, err error) {
+	cfg = &appConfig{
+		sessionPPPdArgs:    make(map[string]map[string][]string),
+		sessionPPPdRestart: make(map[string]map[string]*pppdRestartPolicy),
+		tunnelPPPdOptions:  make(map[string]pppdOptions),
+		sessionPPPdOptions: make(map[string]map[string]*pppdOptions),
+		tunnelPools:        make(map[string]*tunnelPool),
+		tunnelPPPoE:        make(map[string]*pppoe.Config),
+	}
+	cfg.config, err = config.LoadFileWithCustomParser(path, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %v", err)
+	}
+	for i := range cfg.config.Tunnels {
+		if err = cfg.checkTunnel(&cfg.config.Tunnels[i]); err != nil {
+			return nil, fmt.Errorf("bad configuration for tunnel %s: %v", cfg.config.Tunnels[i].Name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// logWarnings logs the deprecated parameters of a configuration written for
+// an earlier schema version.
+func (app *application) logWarnings(cfg *appConfig) {
+	for _, w := range cfg.config.Warnings {
+		level.Warn(app.logger).Log(
+			"message", "deprecated configuration parameter",
+			"warning", w)
+	}
+}
+
+// checkTunnel checks that kl2tpd supports the configuration of a tunnel and
+// its sessions, defaulting the sessions to the PPP pseudowire.
+func (cfg *appConfig) checkTunnel(tcfg *config.NamedTunnel) error {
+	// Only support ppp, over l2tpv2 or l2tpv3
+	if tcfg.Config.Version != l2tp.ProtocolVersion2 && tcfg.Config.Version != l2tp.ProtocolVersion3 {
+		return fmt.Errorf("unsupported tunnel protocol version %v", tcfg.Config.Version)
+	}
+	if rcfg, ok := cfg.tunnelPPPoE[tcfg.Name]; ok {
+		if rcfg.Interface == "" {
+			return fmt.Errorf("pppoe_interface must be set for PPPoE tunnels")
+		}
+		if len(tcfg.Sessions) > 0 {
+			return fmt.Errorf("sessions of PPPoE tunnels are created by the relay, so may not be configured")
+		}
+	}
+	for _, scfg := range tcfg.Sessions {
+		if scfg.Config.Pseudowire == 0 {
+			scfg.Config.Pseudowire = l2tp.PseudowireTypePPP
+		}
+		// Only PPP is supported, so there's nothing to fall back to
+		if scfg.Config.Pseudowire != l2tp.PseudowireTypePPP || len(scfg.Config.PseudowireFallback) > 0 {
+			return fmt.Errorf("unsupported pseudowire type %v for session %s", scfg.Config.Pseudowire, scfg.Name)
+		}
+	}
+	return nil
+}
+
 func readPPPdArgsFile(path string) ([]string, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -106,15 +391,70 @@ func readPPPdArgsFile(path string) ([]string, error) {
 	return args, nil
 }
 
-func (app *application) ParseParameter(key string, value interface{}) error {
+func (cfg *appConfig) ParseParameter(key string, value interface{}) error {
 	return fmt.Errorf("unrecognised parameter %v", key)
 }
 
-func (app *application) ParseTunnelParameter(tunnel *config.NamedTunnel, key string, value interface{}) error {
+func (cfg *appConfig) ParseTunnelParameter(tunnel *config.NamedTunnel, key string, value interface{}) error {
+	opts := cfg.tunnelPPPdOptions[tunnel.Name]
+	if ok, err := opts.parseParameter(key, value); ok {
+		cfg.tunnelPPPdOptions[tunnel.Name] = opts
+		return err
+	}
+	if ok, err := cfg.parsePoolParameter(tunnel.Name, key, value); ok {
+		return err
+	}
+
+	switch key {
+	case "pppoe_interface", "pppoe_ac_name":
+		name, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("failed to parse %v parameter for tunnel %s as a string", key, tunnel.Name)
+		}
+		rcfg, ok := cfg.tunnelPPPoE[tunnel.Name]
+		if !ok {
+			rcfg = &pppoe.Config{}
+			cfg.tunnelPPPoE[tunnel.Name] = rcfg
+		}
+		if key == "pppoe_interface" {
+			rcfg.Interface = name
+		} else {
+			rcfg.ACName = name
+		}
+		return nil
+	case "pppoe_proxy_lcp", "pppoe_multilink":
+		enable, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("failed to parse %v parameter for tunnel %s as a boolean", key, tunnel.Name)
+		}
+		rcfg, ok := cfg.tunnelPPPoE[tunnel.Name]
+		if !ok {
+			rcfg = &pppoe.Config{}
+			cfg.tunnelPPPoE[tunnel.Name] = rcfg
+		}
+		if key == "pppoe_proxy_lcp" {
+			rcfg.ProxyLCP = enable
+		} else {
+			rcfg.Multilink = enable
+		}
+		return nil
+	}
 	return fmt.Errorf("unrecognised parameter %v", key)
 }
 
-func (app *application) ParseSessionParameter(tunnel *config.NamedTunnel, session *config.NamedSession, key string, value interface{}) error {
+func (cfg *appConfig) ParseSessionParameter(tunnel *config.NamedTunnel, session *config.NamedSession, key string, value interface{}) error {
+	if _, ok := cfg.sessionPPPdOptions[tunnel.Name]; !ok {
+		cfg.sessionPPPdOptions[tunnel.Name] = make(map[string]*pppdOptions)
+	}
+	opts, ok := cfg.sessionPPPdOptions[tunnel.Name][session.Name]
+	if !ok {
+		opts = &pppdOptions{}
+	}
+	if ok, err := opts.parseParameter(key, value); ok {
+		cfg.sessionPPPdOptions[tunnel.Name][session.Name] = opts
+		return err
+	}
+
 	switch key {
 	case "pppd_args":
 		path, ok := value.(string)
@@ -125,15 +465,32 @@ func (app *application) ParseSessionParameter(tunnel *config.NamedTunnel, sessio
 		if err != nil {
 			return err
 		}
-		if _, ok := app.sessionPPPdArgs[tunnel.Name]; !ok {
-			app.sessionPPPdArgs[tunnel.Name] = make(map[string][]string)
+		if _, ok := cfg.sessionPPPdArgs[tunnel.Name]; !ok {
+			cfg.sessionPPPdArgs[tunnel.Name] = make(map[string][]string)
 		}
-		app.sessionPPPdArgs[tunnel.Name][session.Name] = args
+		cfg.sessionPPPdArgs[tunnel.Name][session.Name] = args
 		return nil
+	case "pppd_restart", "pppd_restart_backoff", "pppd_max_restarts":
+		if _, ok := cfg.sessionPPPdRestart[tunnel.Name]; !ok {
+			cfg.sessionPPPdRestart[tunnel.Name] = make(map[string]*pppdRestartPolicy)
+		}
+		policy, ok := cfg.sessionPPPdRestart[tunnel.Name][session.Name]
+		if !ok {
+			policy = newPPPdRestartPolicy()
+			cfg.sessionPPPdRestart[tunnel.Name][session.Name] = policy
+		}
+		return policy.parseParameter(key, value)
 	}
 	return fmt.Errorf("unrecognised parameter %v", key)
 }
 
+func (app *application) getSessionPPPdRestartPolicy(tunnelName, sessionName string) *pppdRestartPolicy {
+	if policy, ok := app.sessionPPPdRestart[tunnelName][sessionName]; ok {
+		return policy
+	}
+	return newPPPdRestartPolicy()
+}
+
 func (app *application) getSessionPPPdArgs(tunnelName, sessionName string) (args []string) {
 	_, ok := app.sessionPPPdArgs[tunnelName]
 	if !ok {
@@ -155,12 +512,30 @@ fail:
 func (app *application) HandleEvent(event interface{}) {
 	switch ev := event.(type) {
 	case *l2tp.TunnelUpEvent:
+		level.Info(app.logger).Log(
+			"message", "tunnel up",
+			"tunnel_name", ev.TunnelName,
+			"peer_host_name", ev.PeerHostName)
+		app.lock.Lock()
 		if _, ok := app.sessionPPPoL2TP[ev.TunnelName]; !ok {
 			app.sessionPPPoL2TP[ev.TunnelName] = make(map[string]*pppol2tp)
 		}
+		app.lock.Unlock()
 
 	case *l2tp.TunnelDownEvent:
+		level.Info(app.logger).Log(
+			"message", "tunnel down",
+			"tunnel_name", ev.TunnelName,
+			"result", ev.Result)
+		app.lock.Lock()
 		delete(app.sessionPPPoL2TP, ev.TunnelName)
+		app.lock.Unlock()
+
+	case *l2tp.TunnelEstablishFailedEvent:
+		level.Error(app.logger).Log(
+			"message", "tunnel failed to establish",
+			"tunnel_name", ev.TunnelName,
+			"result", ev.Result)
 
 	case *l2tp.SessionUpEvent:
 
@@ -173,53 +548,20 @@ func (app *application) HandleEvent(event interface{}) {
 			"peer_tunnel_id", ev.TunnelConfig.PeerTunnelID,
 			"peer_session_id", ev.SessionConfig.PeerSessionID)
 
-		pppol2tp, err := newPPPoL2TP(ev.Session,
-			ev.TunnelConfig.TunnelID,
-			ev.SessionConfig.SessionID,
-			ev.TunnelConfig.PeerTunnelID,
-			ev.SessionConfig.PeerSessionID)
-		if err != nil {
-			level.Error(app.logger).Log(
-				"message", "failed to create pppol2tp instance",
-				"error", err)
-			app.closeSession(ev.Session)
-			break
-		}
-
-		pppdArgs := app.getSessionPPPdArgs(ev.TunnelName, ev.SessionName)
-		pppol2tp.pppd.Args = append(pppol2tp.pppd.Args, pppdArgs...)
-
-		err = pppol2tp.pppd.Start()
+		app.lock.Lock()
+		err := app.startPPPd(ev, "", 0)
+		app.lock.Unlock()
 		if err != nil {
-			level.Error(app.logger).Log(
-				"message", "pppd failed to start",
-				"error", err,
-				"error_message", pppdExitCodeString(err),
-				"stderr", pppol2tp.stderrBuf.String())
-			app.closeSession(ev.Session)
-			break
+			app.closeSession(ev.Session, l2tp.CDNResultGeneralError, err.Error())
 		}
 
-		app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName] = pppol2tp
-
-		app.wg.Add(1)
-		go func() {
-			defer app.wg.Done()
-			err = pppol2tp.pppd.Wait()
-			if err != nil {
-				level.Error(app.logger).Log(
-					"message", "pppd exited with an error code",
-					"error", err,
-					"error_message", pppdExitCodeString(err))
-			}
-			app.pppCompleteChan <- pppol2tp
-		}()
-
 	case *l2tp.SessionDownEvent:
 
 		level.Info(app.logger).Log(
 			"message", "session down",
 			"result", ev.Result,
+			"error_message", ev.ErrorMessage,
+			"closed_by_peer", ev.ClosedByPeer,
 			"tunnel_name", ev.TunnelName,
 			"session_name", ev.SessionName,
 			"tunnel_id", ev.TunnelConfig.TunnelID,
@@ -227,20 +569,222 @@ func (app *application) HandleEvent(event interface{}) {
 			"peer_tunnel_id", ev.TunnelConfig.PeerTunnelID,
 			"peer_session_id", ev.SessionConfig.PeerSessionID)
 
-		level.Info(app.logger).Log("message", "killing pppd")
-		app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName].pppd.Process.Signal(os.Interrupt)
+		// pppd isn't running if it failed to start, and may be
+		// awaiting a restart
+		app.lock.Lock()
+		if pppol2tp, ok := app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName]; ok {
+			if pppol2tp.restartTimer != nil {
+				pppol2tp.restartTimer.Stop()
+			} else {
+				level.Info(app.logger).Log("message", "killing pppd")
+				pppol2tp.pppd.Process.Signal(os.Interrupt)
+			}
+			delete(app.sessionPPPoL2TP[ev.TunnelName], ev.SessionName)
+		}
+		app.releaseAddrs(ev.TunnelName, ev.SessionName)
+		app.lock.Unlock()
+		app.removePPPdOptions(ev.TunnelName, ev.SessionName)
+	}
+}
+
+// startPPPd spawns pppd for an established session, restarts being the
+// number of times in a row pppd has been restarted for the session.  If
+// ifName is set it is used for the PPP interface rather than expanding the
+// session's interface name.  The returned error describes the failure to
+// the peer.  app.lock must be held.
+func (app *application) startPPPd(ev *l2tp.SessionUpEvent, ifName string, restarts int) error {
+	if _, ok := app.sessionPPPoL2TP[ev.TunnelName]; !ok {
+		app.sessionPPPoL2TP[ev.TunnelName] = make(map[string]*pppol2tp)
+	}
+
+	var pppol2tp *pppol2tp
+	var err error
+	if app.ptyPPP {
+		pppol2tp, err = newPPPoPTY(ev.Session)
+	} else {
+		pppol2tp, err = newPPPoL2TP(ev.Session,
+			ev.TunnelConfig.Version,
+			ev.TunnelConfig.TunnelID,
+			ev.SessionConfig.SessionID,
+			ev.TunnelConfig.PeerTunnelID,
+			ev.SessionConfig.PeerSessionID)
+	}
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to create pppol2tp instance",
+			"error", err)
+		return fmt.Errorf("failed to create pppol2tp instance")
+	}
+	pppol2tp.event = ev
+	pppol2tp.restarts = restarts
+
+	if ifName != "" {
+		pppol2tp.ifName = ifName
+	} else if name := ev.SessionConfig.InterfaceName; name != "" {
+		pppol2tp.ifName = app.pppInterfaceName(name)
+	}
+
+	// Generate the session's options file, allowing the arguments from
+	// the configuration to override it
+	path, err := app.writePPPdOptions(ev, pppol2tp.ifName)
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to write pppd options file",
+			"error", err)
+		pppol2tp.close()
+		return fmt.Errorf("failed to write pppd options file")
+	}
+	pppol2tp.pppd.Args = append(pppol2tp.pppd.Args, "file", path)
+
+	ipcpFIFO, err := app.openIPCPFIFO(ev)
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to create IPCP notification FIFO",
+			"error", err)
+		pppol2tp.close()
+		return fmt.Errorf("failed to create IPCP notification FIFO")
+	}
+
+	pppdArgs := app.getSessionPPPdArgs(ev.TunnelName, ev.SessionName)
+	pppol2tp.pppd.Args = append(pppol2tp.pppd.Args, pppdArgs...)
+
+	err = pppol2tp.pppd.Start()
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "pppd failed to start",
+			"error", err,
+			"error_message", pppdExitCodeString(err),
+			"stderr", pppol2tp.stderrBuf.String())
+		pppol2tp.close()
+		ipcpFIFO.Close()
+		return fmt.Errorf("pppd failed to start")
+	}
+	pppol2tp.started = time.Now()
+
+	app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName] = pppol2tp
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		err := pppol2tp.pppd.Wait()
+		if err != nil {
+			level.Error(app.logger).Log(
+				"message", "pppd exited with an error code",
+				"error", err,
+				"error_message", pppdExitCodeString(err))
+		}
+		// The session can't be connected to a new pppox socket while
+		// this one is open
+		pppol2tp.close()
+		ipcpFIFO.Close()
+		pppol2tp.exitErr = err
+		app.pppCompleteChan <- pppol2tp
+	}()
+	return nil
+}
+
+// pppdExited applies the session's restart policy once its pppd has exited,
+// either scheduling a restart or closing the session.
+func (app *application) pppdExited(p *pppol2tp) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+
+	// Nothing is to be done if the session has already gone down
+	ev := p.event
+	if app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName] != p {
+		return
+	}
+
+	// A pppd which stayed up for a while isn't failing repeatedly, so
+	// the backoff starts afresh
+	restarts := p.restarts
+	if time.Since(p.started) >= maxPPPdRestartBackoff {
+		restarts = 0
+	}
+
+	reason := pppdExitReasonOf(p.exitErr)
+	policy := app.getSessionPPPdRestartPolicy(ev.TunnelName, ev.SessionName)
+	delay, ok := policy.restartDelay(reason, restarts)
+	if !ok {
+		delete(app.sessionPPPoL2TP[ev.TunnelName], ev.SessionName)
+		result, message := pppdExitResult(p.exitErr)
+		app.closeSession(p.session, result, message)
+		return
+	}
+
+	level.Info(app.logger).Log(
+		"message", "restarting pppd",
+		"tunnel_name", ev.TunnelName,
+		"session_name", ev.SessionName,
+		"exit_reason", reason,
+		"restarts", restarts,
+		"delay", delay)
+	p.restarts = restarts
+	p.restartTimer = time.AfterFunc(delay, func() {
+		select {
+		case app.pppRestartChan <- p:
+		case <-app.closeChan:
+		}
+	})
+}
+
+// restartPPPd restarts pppd for a session once the restart delay expires.
+func (app *application) restartPPPd(p *pppol2tp) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+
+	ev := p.event
+	if app.sessionPPPoL2TP[ev.TunnelName][ev.SessionName] != p {
+		return
+	}
+	if err := app.startPPPd(ev, p.ifName, p.restarts+1); err != nil {
 		delete(app.sessionPPPoL2TP[ev.TunnelName], ev.SessionName)
+		app.closeSession(p.session, l2tp.CDNResultGeneralError, err.Error())
+	}
+}
+
+// pppInterfaceName expands an interface name template to the lowest
+// numbered name which is neither in use nor claimed by another of our
+// pppd instances.  Names which aren't templates are returned unchanged.
+func (app *application) pppInterfaceName(name string) string {
+	if !strings.Contains(name, "%d") {
+		return name
+	}
+	claimed := make(map[string]bool)
+	for _, sessions := range app.sessionPPPoL2TP {
+		for _, p := range sessions {
+			claimed[p.ifName] = true
+		}
+	}
+	for i := 0; ; i++ {
+		candidate := fmt.Sprintf(name, i)
+		if claimed[candidate] {
+			continue
+		}
+		if _, err := net.InterfaceByName(candidate); err != nil {
+			return candidate
+		}
 	}
 }
 
-func (app *application) closeSession(s l2tp.Session) {
+// closeSession closes a session, informing the peer of the reason.
+func (app *application) closeSession(s l2tp.Session, result l2tp.ResultCode, message string) {
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
-		s.Close()
+		s.CloseWithResult(result, l2tp.ErrorCodeNoError, message)
 	}()
 }
 
+// pppdExitResult describes why pppd exited, for the CDN closing its
+// session.
+func pppdExitResult(err error) (l2tp.ResultCode, string) {
+	if err == nil {
+		return l2tp.CDNResultAdminDisconnect, "pppd exited"
+	}
+	return l2tp.CDNResultGeneralError, fmt.Sprintf("pppd exited: %s", pppdExitCodeString(err))
+}
+
 func (app *application) run() int {
 
 	// Listen for L2TP events
@@ -248,36 +792,17 @@ func (app *application) run() int {
 
 	// Instantiate tunnels and sessions from the config file
 	for _, tcfg := range app.config.Tunnels {
-
-		// Only support l2tpv2/ppp
-		if tcfg.Config.Version != l2tp.ProtocolVersion2 {
+		if err := app.newTunnel(tcfg); err != nil {
 			level.Error(app.logger).Log(
-				"message", "unsupported tunnel protocol version",
-				"version", tcfg.Config.Version)
-			return 1
-		}
-
-		tunl, err := app.l2tpCtx.NewDynamicTunnel(tcfg.Name, tcfg.Config)
-		if err != nil {
-			level.Error(app.logger).Log(
-				"message", "failed to create tunnel",
+				"message", "failed to instantiate tunnel",
 				"tunnel_name", tcfg.Name,
 				"error", err)
 			return 1
 		}
-
-		for _, scfg := range tcfg.Sessions {
-			_, err := tunl.NewSession(scfg.Name, scfg.Config)
-			if err != nil {
-				level.Error(app.logger).Log(
-					"message", "failed to create session",
-					"session_name", scfg.Name,
-					"error", err)
-				return 1
-			}
-		}
 	}
 
+	// reloading is closed when a reload of the configuration completes
+	var reloading chan interface{}
 	var shutdown bool
 	for {
 		select {
@@ -285,22 +810,55 @@ func (app *application) run() int {
 			if !shutdown {
 				level.Info(app.logger).Log("message", "received signal, shutting down")
 				shutdown = true
-				go func() {
+				go func(reloading chan interface{}) {
+					if reloading != nil {
+						<-reloading
+					}
+					// Terminate the PPPoE sessions before their tunnels
+					for _, relay := range app.relays {
+						relay.Close()
+					}
+					// Let our peers know why the tunnels are going away
+					for _, tunl := range app.tunnels {
+						tunl.CloseWithResult(l2tp.StopCCNResultShuttingDown, l2tp.ErrorCodeNoError, "")
+					}
 					app.l2tpCtx.Close()
+					if app.pppoeCtx != nil {
+						app.pppoeCtx.Close()
+					}
 					app.wg.Wait()
 					level.Info(app.logger).Log("message", "graceful shutdown complete")
 					close(app.closeChan)
-				}()
+				}(reloading)
 			} else {
 				level.Info(app.logger).Log("message", "pending graceful shutdown")
 			}
+		case <-app.hupChan:
+			if shutdown || reloading != nil {
+				level.Info(app.logger).Log("message", "ignoring SIGHUP, shutdown or reload in progress")
+				continue
+			}
+			level.Info(app.logger).Log("message", "received SIGHUP, reloading configuration")
+			reloading = make(chan interface{})
+			go func(done chan interface{}) {
+				app.reload()
+				close(done)
+			}(reloading)
+		case <-app.usr1Chan:
+			app.dumpConfig()
+		case <-reloading:
+			reloading = nil
 		case pppol2tp, ok := <-app.pppCompleteChan:
 			if !ok {
 				close(app.closeChan)
 			}
 			level.Info(app.logger).Log("message", "pppd terminated")
 			if !shutdown {
-				app.closeSession(pppol2tp.session)
+				app.pppdExited(pppol2tp)
+			}
+		case pppol2tp := <-app.pppRestartChan:
+			if !shutdown {
+				app.restartPPPd(pppol2tp)
 			}
 		case <-app.closeChan:
 			return 0
@@ -308,13 +866,140 @@ func (app *application) run() int {
 	}
 }
 
+// dumpConfig writes the effective configuration kl2tpd is running with to
+// the runtime directory.
+func (app *application) dumpConfig() {
+	app.lock.Lock()
+	cfg := app.config
+	app.lock.Unlock()
+
+	path := filepath.Join(app.runDir, "config.json")
+	b, err := cfg.DumpJSON()
+	if err == nil {
+		err = ioutil.WriteFile(path, b, 0600)
+	}
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to dump configuration",
+			"error", err)
+		return
+	}
+	level.Info(app.logger).Log(
+		"message", "dumped configuration",
+		"path", path)
+}
+
+// newTunnel creates a tunnel and its sessions, or a PPPoE relay and its
+// tunnel.
+func (app *application) newTunnel(tcfg config.NamedTunnel) error {
+	if rcfg, ok := app.tunnelPPPoE[tcfg.Name]; ok {
+		relay, err := app.newPPPoERelay(tcfg, rcfg)
+		if err != nil {
+			return fmt.Errorf("failed to create PPPoE relay: %v", err)
+		}
+		app.relays[tcfg.Name] = relay
+		app.tunnels[tcfg.Name] = rcfg.Tunnel
+		return nil
+	}
+
+	tunl, err := app.l2tpCtx.NewDynamicTunnel(tcfg.Name, tcfg.Config)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel: %v", err)
+	}
+	app.tunnels[tcfg.Name] = tunl
+
+	for _, scfg := range tcfg.Sessions {
+		if _, err := tunl.NewSession(scfg.Name, scfg.Config); err != nil {
+			return fmt.Errorf("failed to create session %s: %v", scfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// newPPPoERelay creates the tunnel of a PPPoE relay, and the relay
+// creating sessions in the tunnel.
+func (app *application) newPPPoERelay(tcfg config.NamedTunnel, rcfg *pppoe.Config) (*pppoe.Relay, error) {
+	if _, err := net.InterfaceByName(rcfg.Interface); err != nil {
+		return nil, fmt.Errorf("failed to find access interface %q: %v", rcfg.Interface, err)
+	}
+
+	tunl, err := app.pppoeCtx.NewDynamicTunnel(tcfg.Name, tcfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel: %v", err)
+	}
+	rcfg.Tunnel = tunl
+	rcfg.Logger = app.logger
+	relay, err := pppoe.NewRelay(rcfg)
+	if err != nil {
+		tunl.Close()
+		return nil, err
+	}
+	return relay, nil
+}
+
+// checkConfig checks a configuration file without acting on it, returning
+// the exit status.
+func checkConfig(path string) int {
+	cfg, err := loadAppConfig(path)
+	if err == nil {
+		err = cfg.config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, w := range cfg.config.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	fmt.Printf("configuration file %s is valid\n", path)
+	return 0
+}
+
+// printConfig prints the effective configuration of a configuration file,
+// returning the exit status.
+func printConfig(path string) int {
+	cfg, err := loadAppConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := cfg.config.DumpJSON()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(b)
+	return 0
+}
+
 func main() {
 	cfgPathPtr := flag.String("config", "/etc/kl2tpd/kl2tpd.toml", "specify configuration file path")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
+	logLevelPtr := flag.String("log-level", "", "set log levels, optionally per subsystem, e.g. \"info,transport=debug\"")
 	nullDataPlanePtr := flag.Bool("null", false, "toggle null data plane")
+	userspaceDataPlanePtr := flag.Bool("userspace", false, "toggle userspace data plane, running pppd on a pty")
+	runDirPtr := flag.String("rundir", "/run/kl2tpd", "specify directory for generated pppd options files")
+	checkConfigPtr := flag.Bool("check-config", false, "check the configuration file and exit")
+	dumpConfigPtr := flag.Bool("dump-config", false, "print the effective configuration as JSON and exit")
 	flag.Parse()
 
-	app, err := newApplication(*cfgPathPtr, *verbosePtr, *nullDataPlanePtr)
+	if *checkConfigPtr {
+		os.Exit(checkConfig(*cfgPathPtr))
+	}
+	if *dumpConfigPtr {
+		os.Exit(printConfig(*cfgPathPtr))
+	}
+
+	logLevels := *logLevelPtr
+	if *verbosePtr {
+		logLevels = "debug," + logLevels
+	}
+	levels, err := logging.ParseLevels(logLevels)
+	if err != nil {
+		stdlog.Fatalf("failed to parse log levels: %v", err)
+	}
+
+	app, err := newApplication(*cfgPathPtr, *runDirPtr, levels, *nullDataPlanePtr, *userspaceDataPlanePtr)
 	if err != nil {
 		stdlog.Fatalf("failed to instantiate application: %v", err)
 	}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+
+	"github.com/katalix/go-l2tp/ippool"
+)
+
+// tunnelPool holds the address pool of a tunnel, along with the address
+// pppd uses for the local end of the PPP links of the tunnel's sessions.
+type tunnelPool struct {
+	cfg   ippool.Config
+	local net.IP
+	pool  *ippool.Pool
+}
+
+// parsePoolParameter applies an address pool setting from a tunnel
+// configuration table, returning false if the key isn't a pool setting.
+func (cfg *appConfig) parsePoolParameter(tunnelName, key string, value interface{}) (bool, error) {
+	tp, ok := cfg.tunnelPools[tunnelName]
+	if !ok {
+		tp = &tunnelPool{}
+	}
+	switch key {
+	case "pppd_ipv4_pool", "pppd_ipv6_pd_pool":
+		s, ok := value.(string)
+		if !ok {
+			return true, fmt.Errorf("failed to parse %v parameter as a string", key)
+		}
+		if key == "pppd_ipv4_pool" {
+			// The first address of the pool is used by pppd itself
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil || ipnet.IP.To4() == nil {
+				return true, fmt.Errorf("failed to parse %v parameter as an IPv4 prefix", key)
+			}
+			if ones, _ := ipnet.Mask.Size(); ones > 30 {
+				return true, fmt.Errorf("%v parameter %v is too small", key, ipnet)
+			}
+			tp.local = append(net.IP(nil), ipnet.IP.To4()...)
+			tp.local[3]++
+			tp.cfg.IPv4Prefix = s
+			tp.cfg.Exclude = []string{tp.local.String()}
+		} else {
+			tp.cfg.IPv6Prefix = s
+		}
+	case "pppd_ipv6_pd_len":
+		n, ok := value.(int64)
+		if !ok || n <= 0 || n > 128 {
+			return true, fmt.Errorf("failed to parse %v parameter as a prefix length", key)
+		}
+		tp.cfg.IPv6PrefixLen = int(n)
+	default:
+		return false, nil
+	}
+	cfg.tunnelPools[tunnelName] = tp
+	return true, nil
+}
+
+// newPools creates the address pools configured for tunnels.  Leases are
+// kept in the runtime directory, so that sessions keep their addresses if
+// kl2tpd restarts.  When reloading the configuration, old is the previous
+// configuration, whose pools are kept for tunnels whose pool configuration
+// is unchanged.
+func (app *application) newPools(cfg, old *appConfig) (err error) {
+	for tunnelName, tp := range cfg.tunnelPools {
+		if old != nil && !old.poolChanged(cfg, tunnelName) {
+			tp.pool = old.tunnelPools[tunnelName].pool
+			continue
+		}
+		tp.cfg.LeaseFile = filepath.Join(app.runDir, fmt.Sprintf("%s.leases", tunnelName))
+		tp.cfg.Logger = app.logger
+		if tp.pool, err = ippool.New(&tp.cfg); err != nil {
+			return fmt.Errorf("failed to create address pool for tunnel %s: %v", tunnelName, err)
+		}
+	}
+	return nil
+}
+
+// poolChanged returns true if the address pool configuration of a tunnel
+// differs in the configuration to.
+func (cfg *appConfig) poolChanged(to *appConfig, tunnelName string) bool {
+	a, aok := cfg.tunnelPools[tunnelName]
+	b, bok := to.tunnelPools[tunnelName]
+	if !aok || !bok {
+		return aok != bok
+	}
+	// The lease file and logger are set when the pool is created
+	return a.cfg.IPv4Prefix != b.cfg.IPv4Prefix ||
+		!reflect.DeepEqual(a.cfg.Exclude, b.cfg.Exclude) ||
+		a.cfg.IPv6Prefix != b.cfg.IPv6Prefix ||
+		a.cfg.IPv6PrefixLen != b.cfg.IPv6PrefixLen
+}
+
+// poolOptions allocates addresses for a session from its tunnel's pool,
+// returning the pppd options assigning them.  pppd assigns the IPv4
+// address to the peer with IPCP, and passes the delegated prefix to its
+// scripts in the PD_PREFIX environment variable.
+func (app *application) poolOptions(tunnelName, sessionName string) (string, error) {
+	tp, ok := app.tunnelPools[tunnelName]
+	if !ok {
+		return "", nil
+	}
+	lease, err := tp.pool.Allocate(sessionName)
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate addresses: %v", err)
+	}
+	var opts string
+	if lease.IPv4 != nil {
+		opts += fmt.Sprintf("%v:%v\n", tp.local, lease.IPv4)
+	}
+	if lease.IPv6Prefix != nil {
+		opts += fmt.Sprintf("set PD_PREFIX=%v\n", lease.IPv6Prefix)
+	}
+	return opts, nil
+}
+
+// releaseAddrs releases the addresses allocated to a session, which are
+// kept for it unless the pool needs them for another session.
+func (app *application) releaseAddrs(tunnelName, sessionName string) {
+	if tp, ok := app.tunnelPools[tunnelName]; ok {
+		tp.pool.Release(sessionName)
+	}
+}
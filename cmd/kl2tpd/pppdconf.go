@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/config"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// pppdOptions are the pppd settings which may be given in the tunnel or
+// session configuration tables.  Settings in the session table override
+// those in the tunnel table.
+type pppdOptions struct {
+	user, password string
+	// passwordKey is the parameter the password was set by
+	passwordKey string
+	accm        *uint32
+	unit        *uint32
+}
+
+// parseParameter applies a pppd setting from the configuration, returning
+// false if the key isn't a pppd setting.
+func (o *pppdOptions) parseParameter(key string, value interface{}) (bool, error) {
+	switch key {
+	case "pppd_user", "pppd_password", "pppd_password_file", "pppd_password_env":
+		s, ok := value.(string)
+		if !ok {
+			return true, fmt.Errorf("failed to parse %v parameter as a string", key)
+		}
+		if key == "pppd_user" {
+			o.user = s
+			break
+		}
+		if o.passwordKey != "" {
+			return true, fmt.Errorf("%v may not be set along with %v", key, o.passwordKey)
+		}
+		o.passwordKey = key
+		var err error
+		switch key {
+		case "pppd_password_file":
+			s, err = config.ReadSecretFile(s)
+		case "pppd_password_env":
+			s, err = config.ReadSecretEnv(s)
+		}
+		if err != nil {
+			return true, err
+		}
+		o.password = s
+	case "pppd_accm", "pppd_unit":
+		n, ok := value.(int64)
+		if !ok || n < 0 || n > 0xffffffff {
+			return true, fmt.Errorf("failed to parse %v parameter as a 32 bit unsigned integer", key)
+		}
+		v := uint32(n)
+		if key == "pppd_accm" {
+			o.accm = &v
+		} else {
+			o.unit = &v
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// merge returns the settings of o, overridden by those set in session.
+func (o pppdOptions) merge(session *pppdOptions) pppdOptions {
+	if session == nil {
+		return o
+	}
+	if session.user != "" {
+		o.user = session.user
+	}
+	if session.password != "" {
+		o.password = session.password
+	}
+	if session.accm != nil {
+		o.accm = session.accm
+	}
+	if session.unit != nil {
+		o.unit = session.unit
+	}
+	return o
+}
+
+// quotePPPdWord quotes a word of a pppd options file.
+// Ref: pppd(8) section OPTIONS FILES.
+func quotePPPdWord(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// pppdOptionsPath returns the path of the options file generated for a
+// session.
+func (app *application) pppdOptionsPath(tunnelName, sessionName string) string {
+	return filepath.Join(app.runDir, fmt.Sprintf("%s.%s.options", tunnelName, sessionName))
+}
+
+// writePPPdOptions generates the pppd options file for a session from its
+// configuration, returning the path of the file.  The file may contain a
+// password, so is readable by its owner only.
+func (app *application) writePPPdOptions(ev *l2tp.SessionUpEvent, ifName string) (string, error) {
+	opts := app.tunnelPPPdOptions[ev.TunnelName].merge(app.sessionPPPdOptions[ev.TunnelName][ev.SessionName])
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by kl2tpd for session %s of tunnel %s\n", ev.SessionName, ev.TunnelName)
+	fmt.Fprintf(&b, "ipparam %s\n", quotePPPdWord(ev.TunnelName+"/"+ev.SessionName))
+
+	// Size the PPP interface to suit the tunnel
+	if mtu := ev.SessionConfig.MTU; mtu != 0 {
+		fmt.Fprintf(&b, "mtu %v\nmru %v\n", mtu, mtu)
+	}
+	// pppd creates the PPP interface, so is responsible for naming it
+	if opts.unit != nil {
+		fmt.Fprintf(&b, "unit %v\n", *opts.unit)
+	}
+	if ifName != "" {
+		fmt.Fprintf(&b, "ifname %s\n", quotePPPdWord(ifName))
+	}
+	// The peer joins links to a bundle by their endpoint discriminator
+	if id := ev.SessionConfig.BundleID; id != "" {
+		fmt.Fprintf(&b, "multilink\nendpoint local:%x\n", id)
+	}
+	if opts.accm != nil {
+		fmt.Fprintf(&b, "asyncmap %08x\n", *opts.accm)
+	}
+	if opts.user != "" {
+		fmt.Fprintf(&b, "user %s\n", quotePPPdWord(opts.user))
+	}
+	if opts.password != "" {
+		fmt.Fprintf(&b, "password %s\n", quotePPPdWord(opts.password))
+	}
+	// Assign the session addresses from the tunnel's pool
+	addrs, err := app.poolOptions(ev.TunnelName, ev.SessionName)
+	if err != nil {
+		return "", err
+	}
+	b.WriteString(addrs)
+
+	// Ask the peer for DNS servers, and have pppd report the negotiated
+	// addresses to kl2tpd as IPCP comes up and goes down
+	fmt.Fprintf(&b, "usepeerdns\n")
+	for _, s := range ipcpScripts {
+		script, err := app.writeIPCPScript(ev.TunnelName, ev.SessionName, s.event)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %s\n", s.option, quotePPPdWord(script))
+	}
+
+	path := app.pppdOptionsPath(ev.TunnelName, ev.SessionName)
+	if err := writePrivateFile(path, b.Bytes()); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writePrivateFile writes a file readable by its owner only.  Any existing
+// file is removed first, since writing to it would leave its mode as it is.
+func writePrivateFile(path string, data []byte) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removePPPdOptions removes the files generated for a session.
+func (app *application) removePPPdOptions(tunnelName, sessionName string) {
+	paths := []string{
+		app.pppdOptionsPath(tunnelName, sessionName),
+		app.ipcpFIFOPath(tunnelName, sessionName),
+	}
+	for _, s := range ipcpScripts {
+		paths = append(paths, app.ipcpScriptPath(tunnelName, sessionName, s.event))
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			level.Error(app.logger).Log(
+				"message", "failed to remove pppd file",
+				"path", path,
+				"error", err)
+		}
+	}
+}
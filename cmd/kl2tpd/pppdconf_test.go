@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+func u32(v uint32) *uint32 {
+	return &v
+}
+
+func TestPPPdOptionsParseParameter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kl2tpd")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	os.Setenv("KL2TPD_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("KL2TPD_TEST_PASSWORD")
+
+	cases := []struct {
+		keys   []string
+		values []interface{}
+		want   pppdOptions
+	}{
+		{
+			keys:   []string{"pppd_user", "pppd_password"},
+			values: []interface{}{"bob", "secret"},
+			want:   pppdOptions{user: "bob", password: "secret", passwordKey: "pppd_password"},
+		},
+		{
+			keys:   []string{"pppd_password_file"},
+			values: []interface{}{passwordFile},
+			want:   pppdOptions{password: "from-file", passwordKey: "pppd_password_file"},
+		},
+		{
+			keys:   []string{"pppd_password_env"},
+			values: []interface{}{"KL2TPD_TEST_PASSWORD"},
+			want:   pppdOptions{password: "from-env", passwordKey: "pppd_password_env"},
+		},
+		{
+			keys:   []string{"pppd_accm", "pppd_unit"},
+			values: []interface{}{int64(0x000a0000), int64(0xffffffff)},
+			want:   pppdOptions{accm: u32(0x000a0000), unit: u32(0xffffffff)},
+		},
+		{
+			keys:   []string{"pppd_unit"},
+			values: []interface{}{int64(0)},
+			want:   pppdOptions{unit: u32(0)},
+		},
+	}
+	for _, c := range cases {
+		var got pppdOptions
+		for i, key := range c.keys {
+			ok, err := got.parseParameter(key, c.values[i])
+			if !ok || err != nil {
+				t.Fatalf("parseParameter(%v, %v): got %v, %v", key, c.values[i], ok, err)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseParameter(%v): got %+v, want %+v", c.keys, got, c.want)
+		}
+	}
+
+	if ok, err := (&pppdOptions{}).parseParameter("pppd_args", "/etc/args"); ok || err != nil {
+		t.Errorf("parseParameter(pppd_args): got %v, %v, want false, nil", ok, err)
+	}
+
+	bad := []struct {
+		keys   []string
+		values []interface{}
+	}{
+		{[]string{"pppd_user"}, []interface{}{int64(1)}},
+		{[]string{"pppd_password", "pppd_password_env"}, []interface{}{"secret", "KL2TPD_TEST_PASSWORD"}},
+		{[]string{"pppd_password_file", "pppd_password"}, []interface{}{passwordFile, "secret"}},
+		{[]string{"pppd_password_env", "pppd_password_file"}, []interface{}{"KL2TPD_TEST_PASSWORD", passwordFile}},
+		{[]string{"pppd_password_file"}, []interface{}{filepath.Join(dir, "missing")}},
+		{[]string{"pppd_password_env"}, []interface{}{"KL2TPD_TEST_UNSET"}},
+		{[]string{"pppd_accm"}, []interface{}{int64(-1)}},
+		{[]string{"pppd_accm"}, []interface{}{int64(0x100000000)}},
+		{[]string{"pppd_unit"}, []interface{}{"3"}},
+	}
+	for _, c := range bad {
+		var o pppdOptions
+		var err error
+		for i, key := range c.keys {
+			if _, err = o.parseParameter(key, c.values[i]); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("parseParameter(%v, %v) succeeded when we expected an error", c.keys, c.values)
+		}
+	}
+}
+
+func TestPPPdOptionsMerge(t *testing.T) {
+	tunnel := pppdOptions{user: "bob", password: "secret", accm: u32(0)}
+	cases := []struct {
+		session *pppdOptions
+		want    pppdOptions
+	}{
+		{
+			session: nil,
+			want:    tunnel,
+		},
+		{
+			session: &pppdOptions{},
+			want:    tunnel,
+		},
+		{
+			session: &pppdOptions{user: "alice", unit: u32(3)},
+			want:    pppdOptions{user: "alice", password: "secret", accm: u32(0), unit: u32(3)},
+		},
+		{
+			session: &pppdOptions{password: "other", accm: u32(0xa0000)},
+			want:    pppdOptions{user: "bob", password: "other", accm: u32(0xa0000)},
+		},
+	}
+	for _, c := range cases {
+		if got := tunnel.merge(c.session); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("merge(%+v): got %+v, want %+v", c.session, got, c.want)
+		}
+	}
+	if tunnel.user != "bob" || tunnel.unit != nil {
+		t.Errorf("merge() modified the tunnel options: %+v", tunnel)
+	}
+}
+
+func TestQuotePPPdWord(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", `""`},
+		{"ppp0", `"ppp0"`},
+		{"two words", `"two words"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+	}
+	for _, c := range cases {
+		if got := quotePPPdWord(c.in); got != c.want {
+			t.Errorf("quotePPPdWord(%q): got %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestWritePPPdOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kl2tpd")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := &application{
+		appConfig: &appConfig{
+			tunnelPPPdOptions: map[string]pppdOptions{
+				"t1": {user: "bob", password: `pa"ss`, accm: u32(0x000a0000)},
+			},
+			sessionPPPdOptions: map[string]map[string]*pppdOptions{
+				"t1": {"s1": {unit: u32(3)}},
+			},
+		},
+		logger: log.NewNopLogger(),
+		runDir: dir,
+	}
+	ev := &l2tp.SessionUpEvent{
+		TunnelName:    "t1",
+		SessionName:   "s1",
+		SessionConfig: &l2tp.SessionConfig{MTU: 1400, BundleID: "b1"},
+	}
+
+	// An existing file has its mode tightened
+	path := app.pppdOptionsPath("t1", "s1")
+	if err = ioutil.WriteFile(path, []byte("stale\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+
+	got, err := app.writePPPdOptions(ev, "ppp-l2tp0")
+	if err != nil {
+		t.Fatalf("writePPPdOptions(): %v", err)
+	}
+	if got != path {
+		t.Errorf("writePPPdOptions(): got path %v, want %v", got, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(): %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("options file has mode %v, want %v", mode, os.FileMode(0600))
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	want := strings.Join([]string{
+		"# Generated by kl2tpd for session s1 of tunnel t1",
+		`ipparam "t1/s1"`,
+		"mtu 1400",
+		"mru 1400",
+		"unit 3",
+		`ifname "ppp-l2tp0"`,
+		"multilink",
+		"endpoint local:6231",
+		"asyncmap 000a0000",
+		`user "bob"`,
+		`password "pa\"ss"`,
+		"usepeerdns",
+		`ip-up-script "` + app.ipcpScriptPath("t1", "s1", "up") + `"`,
+		`ip-down-script "` + app.ipcpScriptPath("t1", "s1", "down") + `"`,
+	}, "\n") + "\n"
+	if string(b) != want {
+		t.Errorf("options file:\n%s\nwant:\n%s", b, want)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"time"
 	"unsafe"
 
 	"github.com/katalix/go-l2tp/l2tp"
@@ -21,6 +22,21 @@ type pppol2tp struct {
 	pppd      *exec.Cmd
 	stdoutBuf *bytes.Buffer
 	stderrBuf *bytes.Buffer
+	ifName    string
+	// exitErr is the error returned by pppd on exit
+	exitErr error
+	// event is the event of the session coming up, from which pppd is
+	// restarted
+	event *l2tp.SessionUpEvent
+	// started is when pppd was started, and restarts the number of
+	// times in a row it has been restarted for the session
+	started  time.Time
+	restarts int
+	// restartTimer is set while a restart of pppd is pending
+	restartTimer *time.Timer
+	// tty is the slave side of the pty pppd runs on, if pppd isn't
+	// using a pppox socket
+	tty *os.File
 }
 
 /*
@@ -100,8 +116,75 @@ func newSockaddrPPPoL2TP4(tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.
 	return (*C.struct_sockaddr)(unsafe.Pointer(&sa)), C.sizeof_struct_sockaddr_pppol2tp, nil
 }
 
-func newPPPoL2TP(session l2tp.Session, tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.ControlConnID) (*pppol2tp, error) {
-	addr, addrLen, err := newSockaddrPPPoL2TP4(tunnelID, sessionID, peerTunnelID, peerSessionID)
+/*
+L2TPv3 uses 32 bit IDs, and hence struct sockaddr_pppol2tpv3, which is
+likewise packed.
+
+struct pppol2tpv3_addr {
+	__kernel_pid_t	pid;
+	int	fd;
+	struct sockaddr_in addr;
+	__u32 s_tunnel, s_session;
+	__u32 d_tunnel, d_session;
+};
+
+struct sockaddr_pppol2tpv3 {
+	__kernel_sa_family_t sa_family;
+	unsigned int    sa_protocol;
+	struct pppol2tpv3_addr pppol2tp;
+} __attribute__((packed));
+*/
+func newSockaddrPPPoL2TPv3(tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.ControlConnID) (
+	addr *C.struct_sockaddr,
+	addrLen C.socklen_t,
+	err error) {
+	for _, id := range []l2tp.ControlConnID{tunnelID, sessionID, peerTunnelID, peerSessionID} {
+		if id == 0 {
+			return nil, 0, fmt.Errorf("invalid zero ID")
+		}
+	}
+
+	var sa C.struct_sockaddr_pppol2tpv3
+	buf := (*[C.sizeof_struct_sockaddr_pppol2tpv3]byte)(unsafe.Pointer(&sa))
+	idx := 0
+
+	// struct sockaddr_pppol2tpv3 -> sa_family
+	*(*C.ushort)(unsafe.Pointer(&buf[idx])) = C.AF_PPPOX
+	idx += C.sizeof_ushort
+
+	// struct sockaddr_pppol2tpv3 -> sa_protocol
+	*(*C.uint)(unsafe.Pointer(&buf[idx])) = C.PX_PROTO_OL2TP
+	idx += C.sizeof_uint
+
+	// struct pppol2tpv3_addr -> pid
+	*(*C.int)(unsafe.Pointer(&buf[idx])) = C.int(0)
+	idx += C.sizeof_int
+
+	// struct pppol2tpv3_addr -> fd
+	*(*C.int)(unsafe.Pointer(&buf[idx])) = C.int(-1)
+	idx += C.sizeof_int
+
+	// struct pppol2tpv3_addr -> addr
+	idx += C.sizeof_struct_sockaddr_in
+
+	// struct pppol2tpv3_addr -> s_tunnel, s_session, d_tunnel, d_session
+	for _, id := range []l2tp.ControlConnID{tunnelID, sessionID, peerTunnelID, peerSessionID} {
+		*(*C.__u32)(unsafe.Pointer(&buf[idx])) = C.__u32(id)
+		idx += C.sizeof___u32
+	}
+
+	return (*C.struct_sockaddr)(unsafe.Pointer(&sa)), C.sizeof_struct_sockaddr_pppol2tpv3, nil
+}
+
+func newPPPoL2TP(session l2tp.Session, version l2tp.ProtocolVersion, tunnelID, sessionID, peerTunnelID, peerSessionID l2tp.ControlConnID) (*pppol2tp, error) {
+	var addr *C.struct_sockaddr
+	var addrLen C.socklen_t
+	var err error
+	if version == l2tp.ProtocolVersion3 {
+		addr, addrLen, err = newSockaddrPPPoL2TPv3(tunnelID, sessionID, peerTunnelID, peerSessionID)
+	} else {
+		addr, addrLen, err = newSockaddrPPPoL2TP4(tunnelID, sessionID, peerTunnelID, peerSessionID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to build struct sockaddr_pppol2tp: %v", err)
 	}
@@ -139,6 +222,14 @@ func newPPPoL2TP(session l2tp.Session, tunnelID, sessionID, peerTunnelID, peerSe
 	}, nil
 }
 
+// close closes the pppox socket or pty connecting pppd to the session.
+func (p *pppol2tp) close() {
+	p.file.Close()
+	if p.tty != nil {
+		p.tty.Close()
+	}
+}
+
 func pppdExitCodeString(err error) string {
 	// ref: pppd(8) section EXIT STATUS
 	switch err.Error() {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/katalix/go-l2tp/ppp"
+	"golang.org/x/sys/unix"
+)
+
+// The HDLC address and control fields, which L2TP peers expect PPP frames
+// to carry whether or not pppd has negotiated their compression.
+// Ref: RFC2661 section 5.4.
+var hdlcHeader = []byte{0xff, 0x03}
+
+// The largest PPP frame relayed between a session and pppd
+const maxPPPFrameLen = 65536
+
+// openPTY opens a pty, returning its master and slave sides.  The slave is
+// put into raw mode so that frames written to the master before pppd sets
+// up the pty aren't echoed or otherwise processed.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Calling master.Fd() would put the file into blocking mode, which
+	// prevents Close from interrupting a blocked Read
+	rc, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var ptn int
+	cerr := rc.Control(func(fd uintptr) {
+		if err = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); err != nil {
+			return
+		}
+		ptn, err = unix.IoctlGetInt(int(fd), unix.TIOCGPTN)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %v", err)
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptn), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	rc, err = slave.SyscallConn()
+	if err == nil {
+		cerr = rc.Control(func(fd uintptr) {
+			var t *unix.Termios
+			if t, err = unix.IoctlGetTermios(int(fd), unix.TCGETS); err != nil {
+				return
+			}
+			// As per cfmakeraw(3)
+			t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+			t.Oflag &^= unix.OPOST
+			t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+			t.Cflag &^= unix.CSIZE | unix.PARENB
+			t.Cflag |= unix.CS8
+			err = unix.IoctlSetTermios(int(fd), unix.TCSETS, t)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, fmt.Errorf("failed to set pty to raw mode: %v", err)
+	}
+	return master, slave, nil
+}
+
+// newPPPoPTY runs pppd for a session on a pty rather than a pppox socket,
+// for use with the userspace data plane.  pppd uses the asynchronous
+// HDLC-like framing of a serial line on the pty, so the PPP frames of the
+// session are framed and unframed by kl2tpd as they are relayed between
+// the session and the master side of the pty.
+func newPPPoPTY(session l2tp.Session) (*pppol2tp, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pty: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	pppd := exec.Command(
+		"/usr/sbin/pppd",
+		slave.Name(),
+		"local",
+		"nodetach")
+	pppd.Stdout = &stdout
+	pppd.Stderr = &stderr
+
+	// Relay frames until the pty is closed when pppd exits, or the
+	// session's data plane is torn down
+	conn := ppp.NewAsyncConn(master, 0xffffffff)
+	go func() {
+		b := make([]byte, maxPPPFrameLen)
+		for {
+			n, err := session.ReadFrame(b)
+			if err != nil {
+				return
+			}
+			if _, err = conn.WriteFrame(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		b := make([]byte, len(hdlcHeader)+maxPPPFrameLen)
+		for {
+			n, err := conn.ReadFrame(b[len(hdlcHeader):])
+			if err == io.ErrShortBuffer {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			frame := b[len(hdlcHeader) : len(hdlcHeader)+n]
+			if !bytes.HasPrefix(frame, hdlcHeader) {
+				frame = b[:len(hdlcHeader)+n]
+				copy(frame, hdlcHeader)
+			}
+			// Frames pppd sends once the session's data plane is
+			// torn down are lost
+			session.WriteFrame(frame)
+		}
+	}()
+
+	return &pppol2tp{
+		session:   session,
+		fd:        -1,
+		file:      master,
+		tty:       slave,
+		pppd:      pppd,
+		stdoutBuf: &stdout,
+		stderrBuf: &stderr,
+	}, nil
+}
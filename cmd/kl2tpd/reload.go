@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/config"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// reload re-reads the configuration file, bringing the running tunnels and
+// sessions into line with it.  Tunnels and sessions whose configuration is
+// unchanged are left alone, while those whose configuration has changed are
+// closed and recreated.  Changes to pppd's parameters take effect the next
+// time pppd is started for a session.  If the new configuration can't be
+// loaded, the running configuration is kept.
+func (app *application) reload() {
+	cfg, err := loadAppConfig(app.configPath)
+	if err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to reload configuration",
+			"error", err)
+		return
+	}
+	app.logWarnings(cfg)
+
+	// The configuration is only replaced here, so may be read without
+	// holding the lock
+	old := app.appConfig
+	diff := config.Compare(old.config, cfg.config)
+
+	// Tunnels must also be recreated if their PPPoE relay or address
+	// pool configuration has changed
+	recreate := diff.ChangedTunnels
+	changed := make(map[string]bool)
+	for _, tcfg := range diff.ChangedTunnels {
+		changed[tcfg.Name] = true
+	}
+	for _, tcfg := range diff.AddedTunnels {
+		changed[tcfg.Name] = true
+	}
+	for _, tcfg := range cfg.config.Tunnels {
+		if !changed[tcfg.Name] && (old.pppoeChanged(cfg, tcfg.Name) || old.poolChanged(cfg, tcfg.Name)) {
+			recreate = append(recreate, tcfg)
+			delete(diff.Sessions, tcfg.Name)
+		}
+	}
+
+	if len(cfg.tunnelPPPoE) > 0 && app.pppoeCtx == nil {
+		if err = app.newPPPoEContext(); err != nil {
+			level.Error(app.logger).Log(
+				"message", "failed to reload configuration",
+				"error", err)
+			return
+		}
+	}
+	if err = app.newPools(cfg, old); err != nil {
+		level.Error(app.logger).Log(
+			"message", "failed to reload configuration",
+			"error", err)
+		return
+	}
+
+	for _, tcfg := range append(diff.RemovedTunnels, recreate...) {
+		app.closeTunnel(tcfg.Name)
+	}
+	for tunnelName, sd := range diff.Sessions {
+		tunl, ok := app.tunnels[tunnelName]
+		if !ok {
+			continue
+		}
+		sessions := tunl.Sessions()
+		for _, scfg := range append(sd.Removed, sd.Changed...) {
+			if s, ok := sessions[scfg.Name]; ok {
+				level.Info(app.logger).Log(
+					"message", "closing session after configuration change",
+					"tunnel_name", tunnelName,
+					"session_name", scfg.Name)
+				s.CloseWithResult(l2tp.CDNResultAdminDisconnect, l2tp.ErrorCodeNoError, "configuration changed")
+			}
+		}
+	}
+
+	app.lock.Lock()
+	app.appConfig = cfg
+	app.lock.Unlock()
+
+	for _, tcfg := range append(diff.AddedTunnels, recreate...) {
+		if err := app.newTunnel(tcfg); err != nil {
+			level.Error(app.logger).Log(
+				"message", "failed to instantiate tunnel",
+				"tunnel_name", tcfg.Name,
+				"error", err)
+		}
+	}
+	for tunnelName, sd := range diff.Sessions {
+		tunl, ok := app.tunnels[tunnelName]
+		if !ok {
+			continue
+		}
+		for _, scfg := range append(sd.Added, sd.Changed...) {
+			if _, err := tunl.NewSession(scfg.Name, scfg.Config); err != nil {
+				level.Error(app.logger).Log(
+					"message", "failed to create session",
+					"tunnel_name", tunnelName,
+					"session_name", scfg.Name,
+					"error", err)
+			}
+		}
+	}
+
+	level.Info(app.logger).Log(
+		"message", "configuration reloaded",
+		"tunnels_added", len(diff.AddedTunnels),
+		"tunnels_removed", len(diff.RemovedTunnels),
+		"tunnels_recreated", len(recreate),
+		"tunnels_with_session_changes", len(diff.Sessions))
+}
+
+// closeTunnel closes a running tunnel, along with its PPPoE relay if it
+// has one.  The tunnel's sessions are closed by the tunnel.
+func (app *application) closeTunnel(tunnelName string) {
+	level.Info(app.logger).Log(
+		"message", "closing tunnel after configuration change",
+		"tunnel_name", tunnelName)
+	if relay, ok := app.relays[tunnelName]; ok {
+		relay.Close()
+		delete(app.relays, tunnelName)
+	}
+	if tunl, ok := app.tunnels[tunnelName]; ok {
+		tunl.CloseWithResult(l2tp.StopCCNResultClearConnection, l2tp.ErrorCodeNoError, "")
+		delete(app.tunnels, tunnelName)
+	}
+}
+
+// pppoeChanged returns true if the PPPoE relay configuration of a tunnel
+// differs in the configuration to.
+func (cfg *appConfig) pppoeChanged(to *appConfig, tunnelName string) bool {
+	a, aok := cfg.tunnelPPPoE[tunnelName]
+	b, bok := to.tunnelPPPoE[tunnelName]
+	if !aok || !bok {
+		return aok != bok
+	}
+	// The tunnel and logger are set when the relay is created
+	x, y := *a, *b
+	x.Tunnel, x.Logger = nil, nil
+	y.Tunnel, y.Logger = nil, nil
+	return !reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// pppdExitReason classifies the ways in which pppd may exit, for the
+// purposes of deciding whether to restart it.
+type pppdExitReason int
+
+const (
+	// pppdExitNormal covers pppd exiting at the request of the peer or
+	// the user, or due to a configured limit being reached.
+	pppdExitNormal pppdExitReason = iota
+	// pppdExitAuthFailure covers either peer failing to authenticate.
+	pppdExitAuthFailure
+	// pppdExitLinkFailure covers PPP negotiation failing, or the link
+	// being lost once established.
+	pppdExitLinkFailure
+	// pppdExitFatal covers errors in pppd's configuration or environment,
+	// which restarting pppd won't resolve.
+	pppdExitFatal
+)
+
+func (r pppdExitReason) String() string {
+	switch r {
+	case pppdExitNormal:
+		return "normal"
+	case pppdExitAuthFailure:
+		return "authentication failure"
+	case pppdExitLinkFailure:
+		return "link failure"
+	case pppdExitFatal:
+		return "fatal error"
+	}
+	return "unknown"
+}
+
+// pppdExitReasonOf classifies the error returned by pppd on exit, using
+// the exit status values documented by pppd(8).  pppd being killed by a
+// signal we didn't send is treated as a link failure.
+func pppdExitReasonOf(err error) pppdExitReason {
+	if err == nil {
+		return pppdExitNormal
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return pppdExitFatal
+	}
+	switch exitErr.ExitCode() {
+	case 5, 12, 13, 14:
+		return pppdExitNormal
+	case 11, 19:
+		return pppdExitAuthFailure
+	case 1, 2, 3, 4, 6, 7, 8, 9, 18:
+		return pppdExitFatal
+	}
+	return pppdExitLinkFailure
+}
+
+// pppdRestartMode selects the exits of pppd after which it is restarted.
+type pppdRestartMode int
+
+const (
+	// pppdRestartNever closes the session whenever pppd exits.
+	pppdRestartNever pppdRestartMode = iota
+	// pppdRestartOnFailure restarts pppd after link failures.
+	pppdRestartOnFailure
+	// pppdRestartAlways restarts pppd after any exit other than a fatal
+	// error.
+	pppdRestartAlways
+)
+
+// The default initial delay before restarting pppd, and the limit to
+// which the delay grows
+const (
+	defaultPPPdRestartBackoff = 1000 * time.Millisecond
+	maxPPPdRestartBackoff     = time.Minute
+)
+
+// pppdRestartPolicy describes how a session's pppd is supervised.
+type pppdRestartPolicy struct {
+	mode pppdRestartMode
+	// backoff is the initial delay before restarting pppd, which is
+	// doubled for each consecutive restart
+	backoff time.Duration
+	// maxRestarts limits the number of consecutive restarts, or is zero
+	// for no limit
+	maxRestarts int
+}
+
+func newPPPdRestartPolicy() *pppdRestartPolicy {
+	return &pppdRestartPolicy{backoff: defaultPPPdRestartBackoff}
+}
+
+// parseParameter applies a session parameter of the restart policy.
+func (p *pppdRestartPolicy) parseParameter(key string, value interface{}) error {
+	switch key {
+	case "pppd_restart":
+		mode, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("failed to parse %v parameter as a string", key)
+		}
+		switch mode {
+		case "never":
+			p.mode = pppdRestartNever
+		case "on-failure":
+			p.mode = pppdRestartOnFailure
+		case "always":
+			p.mode = pppdRestartAlways
+		default:
+			return fmt.Errorf("expect 'never', 'on-failure' or 'always' for %v parameter", key)
+		}
+	case "pppd_restart_backoff":
+		ms, ok := value.(int64)
+		if !ok || ms <= 0 {
+			return fmt.Errorf("failed to parse %v parameter as a positive number of milliseconds", key)
+		}
+		p.backoff = time.Duration(ms) * time.Millisecond
+	case "pppd_max_restarts":
+		n, ok := value.(int64)
+		if !ok || n < 0 {
+			return fmt.Errorf("failed to parse %v parameter as a non-negative integer", key)
+		}
+		p.maxRestarts = int(n)
+	default:
+		return fmt.Errorf("unrecognised parameter %v", key)
+	}
+	return nil
+}
+
+// restartDelay decides whether to restart pppd after it exited for the
+// given reason, having been restarted the given number of times in a row.
+// If so, it returns the delay before restarting it.
+func (p *pppdRestartPolicy) restartDelay(reason pppdExitReason, restarts int) (time.Duration, bool) {
+	switch {
+	case reason == pppdExitFatal:
+		return 0, false
+	case p.mode == pppdRestartNever:
+		return 0, false
+	case p.mode == pppdRestartOnFailure && reason != pppdExitLinkFailure:
+		return 0, false
+	case p.maxRestarts > 0 && restarts >= p.maxRestarts:
+		return 0, false
+	}
+	delay := p.backoff
+	for i := 0; i < restarts && delay < maxPPPdRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPPPdRestartBackoff {
+		delay = maxPPPdRestartBackoff
+	}
+	return delay, true
+}
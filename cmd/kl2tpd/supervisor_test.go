@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// exitError runs a shell exiting with the given status, returning the
+// resulting *exec.ExitError.
+func exitError(t *testing.T, status int) error {
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", status)).Run()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("expected an exit error for status %d, got %v", status, err)
+	}
+	return err
+}
+
+func TestPPPdExitReasonOf(t *testing.T) {
+	cases := []struct {
+		status int
+		want   pppdExitReason
+	}{
+		{1, pppdExitFatal},
+		{2, pppdExitFatal},
+		{4, pppdExitFatal},
+		{5, pppdExitNormal},
+		{9, pppdExitFatal},
+		{10, pppdExitLinkFailure},
+		{11, pppdExitAuthFailure},
+		{12, pppdExitNormal},
+		{13, pppdExitNormal},
+		{14, pppdExitNormal},
+		{15, pppdExitLinkFailure},
+		{16, pppdExitLinkFailure},
+		{18, pppdExitFatal},
+		{19, pppdExitAuthFailure},
+	}
+	for _, c := range cases {
+		if got := pppdExitReasonOf(exitError(t, c.status)); got != c.want {
+			t.Errorf("pppdExitReasonOf(exit %d): got %v, want %v", c.status, got, c.want)
+		}
+	}
+
+	if got := pppdExitReasonOf(nil); got != pppdExitNormal {
+		t.Errorf("pppdExitReasonOf(nil): got %v, want %v", got, pppdExitNormal)
+	}
+	if got := pppdExitReasonOf(errors.New("failed to start")); got != pppdExitFatal {
+		t.Errorf("pppdExitReasonOf(non-exit error): got %v, want %v", got, pppdExitFatal)
+	}
+}
+
+func TestPPPdRestartPolicyParseParameter(t *testing.T) {
+	cases := []struct {
+		params map[string]interface{}
+		want   pppdRestartPolicy
+	}{
+		{
+			params: map[string]interface{}{},
+			want:   pppdRestartPolicy{backoff: defaultPPPdRestartBackoff},
+		},
+		{
+			params: map[string]interface{}{
+				"pppd_restart":         "on-failure",
+				"pppd_restart_backoff": int64(250),
+				"pppd_max_restarts":    int64(3),
+			},
+			want: pppdRestartPolicy{
+				mode:        pppdRestartOnFailure,
+				backoff:     250 * time.Millisecond,
+				maxRestarts: 3,
+			},
+		},
+		{
+			params: map[string]interface{}{
+				"pppd_restart":      "always",
+				"pppd_max_restarts": int64(0),
+			},
+			want: pppdRestartPolicy{
+				mode:    pppdRestartAlways,
+				backoff: defaultPPPdRestartBackoff,
+			},
+		},
+		{
+			params: map[string]interface{}{"pppd_restart": "never"},
+			want:   pppdRestartPolicy{backoff: defaultPPPdRestartBackoff},
+		},
+	}
+	for _, c := range cases {
+		p := newPPPdRestartPolicy()
+		for k, v := range c.params {
+			if err := p.parseParameter(k, v); err != nil {
+				t.Fatalf("parseParameter(%v, %v): %v", k, v, err)
+			}
+		}
+		if *p != c.want {
+			t.Errorf("parseParameter(%v): got %+v, want %+v", c.params, *p, c.want)
+		}
+	}
+
+	bad := []struct {
+		key   string
+		value interface{}
+	}{
+		{"pppd_restart", "sometimes"},
+		{"pppd_restart", int64(1)},
+		{"pppd_restart_backoff", int64(0)},
+		{"pppd_restart_backoff", int64(-5)},
+		{"pppd_restart_backoff", "1000"},
+		{"pppd_max_restarts", int64(-1)},
+		{"pppd_max_restarts", 1.5},
+		{"pppd_restarts", int64(1)},
+	}
+	for _, c := range bad {
+		if err := newPPPdRestartPolicy().parseParameter(c.key, c.value); err == nil {
+			t.Errorf("parseParameter(%v, %v) succeeded when we expected an error", c.key, c.value)
+		}
+	}
+}
+
+func TestPPPdRestartDelay(t *testing.T) {
+	never := pppdRestartPolicy{mode: pppdRestartNever, backoff: time.Second}
+	onFailure := pppdRestartPolicy{mode: pppdRestartOnFailure, backoff: time.Second}
+	always := pppdRestartPolicy{mode: pppdRestartAlways, backoff: time.Second}
+	limited := pppdRestartPolicy{mode: pppdRestartAlways, backoff: time.Second, maxRestarts: 2}
+
+	cases := []struct {
+		policy   pppdRestartPolicy
+		reason   pppdExitReason
+		restarts int
+		delay    time.Duration
+		restart  bool
+	}{
+		{never, pppdExitLinkFailure, 0, 0, false},
+		{never, pppdExitNormal, 0, 0, false},
+		{onFailure, pppdExitLinkFailure, 0, time.Second, true},
+		{onFailure, pppdExitAuthFailure, 0, 0, false},
+		{onFailure, pppdExitNormal, 0, 0, false},
+		{onFailure, pppdExitFatal, 0, 0, false},
+		{always, pppdExitNormal, 0, time.Second, true},
+		{always, pppdExitAuthFailure, 0, time.Second, true},
+		{always, pppdExitFatal, 0, 0, false},
+		// The delay doubles for each consecutive restart, up to a limit
+		{always, pppdExitLinkFailure, 1, 2 * time.Second, true},
+		{always, pppdExitLinkFailure, 3, 8 * time.Second, true},
+		{always, pppdExitLinkFailure, 5, 32 * time.Second, true},
+		{always, pppdExitLinkFailure, 6, maxPPPdRestartBackoff, true},
+		{always, pppdExitLinkFailure, 100, maxPPPdRestartBackoff, true},
+		// Restarts stop once the limit is reached
+		{limited, pppdExitLinkFailure, 1, 2 * time.Second, true},
+		{limited, pppdExitLinkFailure, 2, 0, false},
+	}
+	for _, c := range cases {
+		delay, restart := c.policy.restartDelay(c.reason, c.restarts)
+		if delay != c.delay || restart != c.restart {
+			t.Errorf("%+v restartDelay(%v, %d): got %v %v, want %v %v",
+				c.policy, c.reason, c.restarts, delay, restart, c.delay, c.restart)
+		}
+	}
+}
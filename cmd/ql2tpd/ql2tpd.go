@@ -18,19 +18,46 @@ a minimal control plane transport is set up to send and acknowledge keep-alive
 (HELLO) messages.  This mode of operation extends static mode by allowing tunnel
 failure to be detected.  If a given tunnel is determined to have failed (HELLO message
 transmission fails) then the sessions in that tunnel are automatically torn down.
+
+When run with the -userspace argument ql2tpd uses the userspace data plane in place
+of the Linux kernel L2TP subsystem.  A TAP interface is created for each Ethernet
+pseudowire session, named by the session's interface_name and configured with its
+hardware_addr and mtu, and frames are bridged between the TAP interface and the
+tunnel socket.  Likewise a TUN interface is created for each IP pseudowire session.
+The userspace data plane supports UDP encapsulation only.
+
+When run with the -fallback argument ql2tpd uses the Linux kernel L2TP subsystem
+where it can, and falls back to the userspace data plane for tunnels the kernel
+fails to instantiate, or for all tunnels if the kernel L2TP subsystem is
+unavailable.  The data plane used by each tunnel and session is logged.
+
+When run with the -check-config argument ql2tpd checks the configuration file using
+config.Config.Validate, printing any problems found, and exits without creating any
+tunnels.  The exit status is non-zero if the file has problems.  Deprecated
+parameters of files written for an earlier version of the configuration format are
+printed as warnings.
+
+When run with the -log-level argument ql2tpd sets the level of logging, which is
+info by default or debug with the -verbose argument.  The levels of particular
+subsystems may be set as described by package logging, e.g. "info,dataplane=debug".
+
+When run with the -dump-config argument ql2tpd prints the effective configuration
+as JSON using config.Config.DumpJSON, and exits without creating any tunnels.
 */
 package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	stdlog "log"
 	"os"
 	"os/signal"
 
-	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/katalix/go-l2tp/config"
 	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/katalix/go-l2tp/logging"
 	"golang.org/x/sys/unix"
 )
 
@@ -42,6 +69,11 @@ func main() {
 
 	cfgPathPtr := flag.String("config", "/etc/ql2tpd/ql2tpd.toml", "specify configuration file path")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
+	logLevelPtr := flag.String("log-level", "", "set log levels, optionally per subsystem, e.g. \"info,transport=debug\"")
+	userspacePtr := flag.Bool("userspace", false, "use the userspace data plane with TAP and TUN interfaces")
+	fallbackPtr := flag.Bool("fallback", false, "fall back to the userspace data plane if the kernel data plane fails")
+	checkConfigPtr := flag.Bool("check-config", false, "check the configuration file and exit")
+	dumpConfigPtr := flag.Bool("dump-config", false, "print the effective configuration as JSON and exit")
 	flag.Parse()
 
 	config, err := config.LoadFile(*cfgPathPtr)
@@ -49,21 +81,69 @@ func main() {
 		stdlog.Fatalf("failed to load l2tp configuration: %v", err)
 	}
 
-	logger := log.NewLogfmtLogger(os.Stderr)
+	if *checkConfigPtr {
+		if err = config.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, w := range config.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+		fmt.Printf("configuration file %s is valid\n", *cfgPathPtr)
+		os.Exit(0)
+	}
+
+	if *dumpConfigPtr {
+		b, err := config.DumpJSON()
+		if err != nil {
+			stdlog.Fatalf("failed to dump l2tp configuration: %v", err)
+		}
+		os.Stdout.Write(b)
+		os.Exit(0)
+	}
+
+	logLevels := *logLevelPtr
 	if *verbosePtr {
-		logger = level.NewFilter(logger, level.AllowInfo(), level.AllowDebug())
-	} else {
-		logger = level.NewFilter(logger, level.AllowInfo())
+		logLevels = "debug," + logLevels
 	}
+	levels, err := logging.ParseLevels(logLevels)
+	if err != nil {
+		stdlog.Fatalf("failed to parse log levels: %v", err)
+	}
+	logger := logging.NewFilter(logging.NewLogfmtLogger(os.Stderr), levels)
 
-	l2tpCtx, err := l2tp.NewContext(l2tp.LinuxNetlinkDataPlane, logger)
+	for _, w := range config.Warnings {
+		level.Warn(logger).Log(
+			"message", "deprecated configuration parameter",
+			"warning", w)
+	}
+
+	dataplane := l2tp.LinuxNetlinkDataPlane
+	if *userspacePtr {
+		dataplane, err = l2tp.NewUserspaceDataPlane(openSessionPort)
+		if err != nil {
+			stdlog.Fatalf("failed to create userspace data plane: %v", err)
+		}
+	} else if *fallbackPtr {
+		dataplane, err = l2tp.NewFallbackDataPlane(openSessionPort, logger)
+		if err != nil {
+			stdlog.Fatalf("failed to create fallback data plane: %v", err)
+		}
+	}
+
+	l2tpCtx, err := l2tp.NewContext(dataplane, logger)
 	if err != nil {
 		stdlog.Fatalf("failed to load l2tp configuration: %v", err)
 	}
 	defer l2tpCtx.Close()
 
 	for _, tcfg := range config.Tunnels {
-		tunl, err := l2tpCtx.NewQuiescentTunnel(tcfg.Name, tcfg.Config)
+		var tunl l2tp.Tunnel
+		if tcfg.Config.HelloTimeout > 0 {
+			tunl, err = l2tpCtx.NewQuiescentTunnel(tcfg.Name, tcfg.Config)
+		} else {
+			tunl, err = l2tpCtx.NewStaticTunnel(tcfg.Name, tcfg.Config)
+		}
 		if err != nil {
 			stdlog.Fatalf("failed to instantiate tunnel %v: %v", tcfg.Name, err)
 		}
@@ -77,3 +157,12 @@ func main() {
 
 	<-sigs
 }
+
+// openSessionPort opens a TUN interface for IP pseudowire sessions of the
+// userspace data plane, and a TAP interface for other sessions.
+func openSessionPort(tunnelID l2tp.ControlConnID, cfg *l2tp.SessionConfig) (io.ReadWriteCloser, string, error) {
+	if cfg.Pseudowire == l2tp.PseudowireTypeIP {
+		return l2tp.OpenTUNPort(tunnelID, cfg)
+	}
+	return l2tp.OpenTAPPort(tunnelID, cfg)
+}
@@ -19,11 +19,25 @@ configuration parameters for that instance as key:value pairs.
 	# connect its socket to
 	peer = "127.0.0.1:5001"
 
+	# Addresses are specified as host:port.  IPv6 addresses must be
+	# enclosed in square brackets, and may include a zone,
+	# e.g. "[fe80::1%eth0]:1701".  A UDP tunnel with a local address of
+	# "[::]:port" may connect to either IPv4 or IPv6 peers.
+
 	# version specifies the version of the L2TP specification the
 	# tunnel should use.
 	# Currently supported values are "l2tpv2" and "l2tpv3"
+	# Dynamic tunnels may leave version unset, in which case the version
+	# is negotiated with the peer according to version_policy.
 	version = "l2tpv3"
 
+	# version_policy specifies which protocol version a dynamic tunnel
+	# with no version set should attempt first.  If the peer rejects it
+	# as unsupported, the tunnel falls back to the other version.
+	# Currently supported values are "prefer-l2tpv3" and "prefer-l2tpv2".
+	# By default L2TPv3 is preferred.
+	version_policy = "prefer-l2tpv3"
+
 	# encap specifies the encapsulation to be used for the tunnel.
 	# Currently supported values are "udp" and "ip".
 	# L2TPv2 tunnels are UDP only.
@@ -50,6 +64,12 @@ configuration parameters for that instance as key:value pairs.
 	# this from the default value of 4.
 	window_size = 10 # control messages
 
+	# reorder_queue_size specifies the maximum number of out-of-order
+	# control messages to buffer pending receipt of earlier messages from
+	# the peer.  This avoids retransmissions when control messages are
+	# reordered in the network.  The default value is 4.
+	reorder_queue_size = 8 # control messages
+
 	# hello_timeout if set enables L2TP keep-alive (HELLO) messages.
 	# A hello message is sent N milliseconds after the last control
 	# message was sent or received.  It allows for early detection of
@@ -63,6 +83,29 @@ configuration parameters for that instance as key:value pairs.
 	# By default a starting retry timeout of 1000ms is used.
 	retry_timeout = 1500 # milliseconds
 
+	# sccrp_timeout if set bounds the time a dynamic tunnel waits for
+	# the peer to reply to its SCCRQ, and scccn_timeout the time a tunnel
+	# accepted by a listener waits for the peer to reply to its SCCRP.
+	# If the timeout expires the tunnel is closed.
+	# By default the tunnel waits for as long as the reliable transport
+	# continues to retry the message.
+	sccrp_timeout = 5000 # milliseconds
+	scccn_timeout = 5000 # milliseconds
+
+	# session_reply_timeout if set bounds the time each dynamic session
+	# in the tunnel waits for the peer to reply to its ICRQ.
+	# If the timeout expires the session is closed.
+	# By default the session waits for as long as the reliable transport
+	# continues to retry the ICRQ.
+	session_reply_timeout = 5000 # milliseconds
+
+	# stopccn_timeout if set specifies the time to wait on receipt of a
+	# StopCCN message to allow retransmissions to be acknowledged, which
+	# also bounds the time spent waiting for the peer to acknowledge a
+	# StopCCN we send.
+	# The default is 31000ms per RFC2661 section 5.7.
+	stopccn_timeout = 10000 # milliseconds
+
 	# max_retries sets how many times a given control message may be
 	# retried before the transport considers the message transmission to
 	# have failed.
@@ -77,11 +120,203 @@ configuration parameters for that instance as key:value pairs.
 	# If unset the host's name will be queried and the returned value used.
 	host_name "basilbrush.local"
 
+	# secret, if set, is the shared secret used to authenticate the peer
+	# of a dynamic tunnel.  An L2TPv2 tunnel challenges the peer per
+	# RFC2661 section 5.1.1, and is not established unless the peer
+	# responds correctly.  An L2TPv3 tunnel authenticates each control
+	# message using the Message Digest AVP per RFC3931 section 4.3.
+	# If unset the peer is not authenticated, and the tunnel is not
+	# established if the peer authenticates itself to us.
+	secret = "hunter2"
+
+	# alternate_secret, if set, is a second shared secret the peer may
+	# authenticate itself with, allowing the secret to be rotated without
+	# tearing down tunnels.  To rotate the secret, first set
+	# alternate_secret to the new secret on each host, then swap secret
+	# and alternate_secret on each host, and finally remove the old secret.
+	alternate_secret = "correct horse battery staple"
+
+	# secret_file and alternate_secret_file read the secrets from files,
+	# and secret_env and alternate_secret_env read them from environment
+	# variables, so that secrets needn't be kept in the configuration
+	# file.  Trailing newlines are removed from the contents of a file.
+	# Each secret may be set by one of these parameters only.
+	# secret_file = "/run/secrets/lns"
+	# alternate_secret_env = "LNS_OLD_SECRET"
+
+	# challenge_length sets the length in bytes of the random challenge
+	# (L2TPv2) or nonce (L2TPv3) sent to the peer of a tunnel with a
+	# secret, in the range 16-64.
+	# The default is 16 bytes.
+	challenge_length = 32
+
 	# framing_caps sets the framing capabilites the tunnel will advertise
 	# in the Framing Capabilites AVP per RFC2661.
 	# The default is to advertise both sync and async framing.
 	framing_caps = ["sync","async"]
 
+	# router_id sets the Router ID an L2TPv3 tunnel advertises in the
+	# Router ID AVP per RFC3931.  It may be specified either as an
+	# integer or as an IPv4 address.
+	router_id = "10.0.0.1"
+
+	# pseudowire_caps lists the pseudowire types an L2TPv3 tunnel
+	# advertises in the Pseudowire Capabilities List AVP per RFC3931.
+	# Currently supported values are "ppp", "eth", "eth_vlan" and "ip".
+	# The default is to advertise "ppp", "eth" and "eth_vlan".
+	pseudowire_caps = ["eth"]
+
+	# control_udp_checksum, if set, enables (true) or disables (false) UDP
+	# checksums for control messages.
+	# For IPv6 tunnels, disabling checksums causes zero checksums to be
+	# transmitted and accepted as permitted by RFC6936.
+	# By default the system default is used.
+	control_udp_checksum = true
+
+	# data_udp_checksum, if set, enables (true) or disables (false) UDP
+	# checksums for data packets.
+	# Tunnels which run the control protocol share a single socket between
+	# control and data packets, so for these tunnels control_udp_checksum
+	# and data_udp_checksum must agree if both are set.
+	# By default the system default is used.
+	data_udp_checksum = true
+
+	# control_dscp, if set, specifies the DSCP to mark control messages
+	# with.  This allows control traffic to be prioritised through
+	# provider networks.
+	# It may be specified as a number in the range 0-63, or as a class
+	# name: "cs0" to "cs7", "af11" to "af43", or "ef".
+	# By default the system default is used.
+	control_dscp = "cs6"
+
+	# data_dscp, if set, specifies the DSCP to mark data packets with.
+	# It may be specified as for control_dscp.
+	# By default the system default is used.
+	data_dscp = 10
+
+	# inherit_data_dscp, if set, marks each data packet carrying an IPv4 or
+	# IPv6 packet with the DSCP of that packet, so that QoS treatment
+	# survives tunneling.  Data packets which don't carry an IP packet are
+	# marked with data_dscp.  Only the userspace data plane supports this.
+	inherit_data_dscp = true
+
+	# data_dscp_map, if set, translates the DSCPs inherited by data packets.
+	# Keys and values may be specified as for control_dscp, with numeric
+	# keys quoted.  DSCPs missing from the map are inherited unchanged.
+	data_dscp_map = { "ef" = "af41", "10" = 0 }
+
+	# recv_buffer_size and send_buffer_size, if set, specify the size
+	# in bytes of the tunnel socket receive and send buffers.
+	# Larger buffers avoid packet drops when many tunnels share a host.
+	# By default the system default is used.
+	recv_buffer_size = 1048576
+	send_buffer_size = 1048576
+
+	# bind_device, if set, specifies a network interface to bind the
+	# tunnel socket to.  The tunnel will then only send and receive
+	# packets using that interface.
+	bind_device = "eth0"
+
+	# packet_info, if set, enables the use of IP_PKTINFO on the tunnel
+	# socket.  When the local address is a wildcard address, control
+	# messages are then sent using the local address the peer's
+	# messages arrived on.  This is necessary on multihomed hosts.
+	# By default it is disabled.
+	packet_info = true
+
+	# shared_socket, if set, shares the tunnel socket with the other
+	# tunnels which have the same local address and also set
+	# shared_socket.  Received control messages are passed to the right
+	# tunnel using the tunnel ID in the message header, allowing many
+	# tunnels to use a single local port.  The socket options of the
+	# first tunnel to use the socket apply to all the tunnels sharing it.
+	# Only UDP encapsulation is supported, and the Linux kernel data
+	# plane supports one tunnel per socket.
+	# By default it is disabled.
+	shared_socket = true
+
+	# netns, if set, is the path of the network namespace in which the
+	# tunnel socket is created, e.g. a namespace created by "ip netns add".
+	# The Linux kernel data plane instantiates the tunnel, and the network
+	# interfaces of its sessions, in the same namespace.
+	# By default the namespace of the process is used.
+	netns = "/run/netns/provider"
+
+	# max_sessions, if set, limits the number of sessions the tunnel may
+	# run, including sessions requested by the peer.  Once the limit is
+	# reached incoming calls are rejected.
+	# By default any number of sessions is allowed.
+	max_sessions = 4000
+
+	# sccrq_rate_limit and peer_sccrq_rate_limit, if set, limit the rate
+	# at which a listener processes SCCRQ messages from all peers and
+	# from each peer address respectively.  SCCRQs exceeding either limit
+	# are discarded.
+	# By default any rate is allowed.
+	# This applies to listeners only.
+	sccrq_rate_limit = 100 # messages per second
+	peer_sccrq_rate_limit = 2 # messages per second
+
+	# max_pending_tunnels, if set, limits the number of tunnels accepted
+	# by a listener which may be awaiting establishment of the control
+	# connection.  Once the limit is reached further SCCRQs are discarded.
+	# By default any number of pending tunnels is allowed.
+	# This applies to listeners only.
+	max_pending_tunnels = 50
+
+	# defer_tunnel_creation, if set, causes a listener to reply to L2TPv3
+	# SCCRQs itself, creating a tunnel only once the peer replies to the
+	# SCCRP with an SCCCN.  This avoids allocating tunnels for SCCRQs from
+	# spoofed addresses.  Peers with a secret are accepted as usual.
+	# By default a tunnel is created for each SCCRQ.
+	# This applies to listeners only.
+	defer_tunnel_creation = true
+
+	# allowed_peers, if set, lists the addresses or prefixes of the peers
+	# a listener accepts tunnels from, and allowed_peer_host_names the host
+	# names the peers may advertise in the Host Name AVP.  SCCRQs from other
+	# peers are silently discarded, unless reject_unauthorized_peers is set
+	# in which case they are rejected with a StopCCN.
+	# By default tunnels are accepted from any peer.
+	# This applies to listeners only.
+	allowed_peers = ["192.168.0.0/24", "2001:db8::1"]
+	allowed_peer_host_names = ["lac1.example.com"]
+	reject_unauthorized_peers = true
+
+	# max_messages_per_datagram, max_avps_per_message and max_avp_len, if
+	# set, limit the work done parsing a datagram received from the peer:
+	# the number of control messages in the datagram, the number of AVPs
+	# in each message, and the size of each AVP's payload.  Datagrams
+	# exceeding a limit are discarded.
+	# The defaults are 32 messages per datagram and 256 AVPs per message,
+	# with the AVP payload size limited only by the AVP header encoding.
+	max_messages_per_datagram = 4
+	max_avps_per_message = 64
+	max_avp_len = 256 # bytes
+
+	# duplicate_avp_policy sets how control messages from the peer which
+	# include the same AVP more than once are handled: "first" uses the
+	# first occurrence of the AVP, "last" uses the last occurrence, and
+	# "reject" discards the message.
+	# The default is "first".
+	duplicate_avp_policy = "reject"
+
+	# extra_avp, if set, specifies an AVP to append to outgoing control
+	# messages.  This allows simple vendor requirements to be met without
+	# modifying the control protocol implementation.
+	# It may be specified multiple times to add multiple AVPs.
+	# Tunnel AVPs may be appended to "sccrq" messages only.
+	# Supported value types are "uint16", "uint32", "uint64", "string",
+	# and "bytes".  If no value is set an empty AVP is sent.
+	# This applies to dynamic tunnels only.
+	[[tunnel.t1.extra_avp]]
+	vendor_id = 9
+	type = 1
+	mandatory = false
+	value_type = "string"
+	value = "hello from basilbrush"
+	messages = ["sccrq"]
+
 	# This is a session instance called "s1" within parent tunnel "t1".
 	# Session instances are always created inside a parent tunnel.
 	[tunnel.t1.session.s1]
@@ -99,16 +334,32 @@ configuration parameters for that instance as key:value pairs.
 	psid = 1234
 
 	# pseudowire specifies the type of layer 2 frames carried by the session.
-	# Currently supported values are "ppp" and "eth".
+	# Currently supported values are "ppp", "eth", "eth_vlan" and "ip".
+	# "eth_vlan" is an Ethernet pseudowire in tagged mode per RFC4448,
+	# whose frames carry a service-delimiting VLAN tag, and "ip" is an IP
+	# pseudowire, which requires the userspace data plane.
 	# L2TPv2 tunnels support PPP pseudowires only.
 	pseudowire = "eth"
 
+	# pseudowire_fallback lists the pseudowire types, in order of preference,
+	# which an L2TPv3 session falls back to if the peer doesn't support
+	# pseudowire.  This applies to sessions created locally only.
+	# Currently supported values are "ppp", "eth", "eth_vlan" and "ip".
+	# By default the session fails to establish if the peer doesn't support
+	# pseudowire.
+	pseudowire_fallback = ["ppp"]
+
 	# seqnum, if set, enables the transmission of sequence numbers with
 	# L2TP data messages.  Use of sequence numbers enables the data plane
 	# to reorder data packets to ensure they are delivered in sequence.
 	# By default sequence numbers are not used.
 	seqnum = false
 
+	# reorder_timeout, if set, specifies the length of time in milliseconds
+	# to queue out of sequence data packets before discarding them.
+	# By default out of sequence data packets are discarded immediately.
+	reorder_timeout = 0
+
 	# cookie, if set, specifies the local L2TPv3 cookie for the session.
 	# Cookies are a data verification mechanism intended to allow misdirected
 	# data packets to be detected and rejected.
@@ -130,19 +381,242 @@ configuration parameters for that instance as key:value pairs.
 	# the pseudowire type, e.g. "l2tpeth0", "ppp0".
 	# Setting the interface name can be useful when you need to be certain
 	# of the interface name a given session will use.
+	# The name may instead be a template containing a single "%d", e.g.
+	# "l2tp-%d", which is replaced by the lowest number giving an unused
+	# name.
 	# By default the kernel autogenerates an interface name.
 	interface_name = "l2tpeth42"
 
+	# hardware_addr, if set, specifies the MAC address of the network
+	# interface of an Ethernet pseudowire session.  It is applied to the
+	# TAP interfaces of sessions using the userspace data plane only.
+	# By default the interface is assigned a random MAC address.
+	hardware_addr = "02:00:5e:10:20:30"
+
 	# l2spec_type specifies the L2TPv3 Layer 2 specific sublayer field to
 	# be used in data packet headers as per RFC3931 section 3.2.2.
 	# Currently supported values are "none" and "default".
 	# By default no Layer 2 specific sublayer is used.
 	l2spec_type = "default"
+
+	# mtu, if set, specifies the MTU of the session's network interface.
+	# The MTU must be at least 68 bytes.
+	# By default sessions in dynamic tunnels derive the MTU from the path
+	# MTU to the peer.  Otherwise the data plane picks an MTU suited to the
+	# tunnel's encapsulation.
+	mtu = 1400
+
+	# interface_addrs lists addresses in CIDR notation to be assigned to
+	# the network interface of an Ethernet pseudowire session once it has
+	# been created.
+	# By default no addresses are assigned.
+	interface_addrs = [ "192.0.2.1/24", "2001:db8::1/64" ]
+
+	# interface_up, if set, causes the network interface of an Ethernet
+	# pseudowire session to be brought up once it has been created.
+	# By default the interface is left down.
+	interface_up = true
+
+	# bridge, if set, names a Linux bridge to which the network interface
+	# of an Ethernet pseudowire session is attached once it has been
+	# created.  The bridge must already exist.
+	# By default the interface isn't attached to a bridge.
+	bridge = "br0"
+
+	# vlans lists 802.1Q VLAN IDs for which VLAN sub-interfaces, e.g.
+	# "l2tpeth0.100", are created on the network interface of an Ethernet
+	# pseudowire session once it has been created.  The sub-interfaces are
+	# brought up along with the session interface if interface_up is set.
+	# By default no sub-interfaces are created.
+	vlans = [ 100, 200 ]
+
+	# interface_netns, if set, is the path of a network namespace to which
+	# the network interface of an Ethernet pseudowire session is moved once
+	# it has been created.  The interface is then configured as requested
+	# by the other interface options within that namespace.
+	# By default the interface stays in the namespace of its tunnel.
+	interface_netns = "/run/netns/tenant1"
+
+	# tx_connect_speed and rx_connect_speed, if set, specify the transmit
+	# and receive speeds of the session's circuit in bits per second, which
+	# dynamic sessions report to the peer.
+	# By default a transmit speed of zero is reported, and the receive
+	# speed is not reported.
+	tx_connect_speed = 100000000
+	rx_connect_speed = 20000000
+
+	# bundle_id, if set, tags a PPP session as a member of the Multilink
+	# PPP bundle of that name.  Sessions sharing a bundle ID are expected
+	# to be joined into one bundle by the PPP implementation.  The ID may
+	# be up to 20 bytes long.
+	# By default sessions are not members of a bundle.
+	bundle_id = "subscriber1"
+
+	# persist, if set, causes a dynamic session to be re-established if the
+	# peer closes it while the tunnel remains up.  This applies to sessions
+	# created locally only.
+	# By default sessions are not re-established.
+	persist = true
+
+	# persist_backoff, if set, specifies the initial delay in milliseconds
+	# before re-establishing a persistent session.  The delay is doubled for
+	# each consecutive attempt which fails to establish the session, up to
+	# a limit of one minute.
+	# By default a delay of 1000ms is used.
+	persist_backoff = 5000
+
+	# on_demand, if set, causes a dynamic session to wait for the
+	# application to trigger it before it is established, e.g. on the
+	# arrival of traffic on the session's attachment circuit.  If the
+	# peer closes the session it waits for the next trigger.  This applies
+	# to sessions created locally only, and may not be combined with
+	# persist.
+	# By default sessions are established as soon as the tunnel is up.
+	on_demand = false
+
+	# idle_timeout, if set, specifies how long in milliseconds an on-demand
+	# session may pass no data traffic before it is disconnected.
+	# By default on-demand sessions are not disconnected when idle.
+	idle_timeout = 300000
+
+	# static, if set, causes a session in a dynamic tunnel to be created
+	# without an incoming call exchange with the peer, for peers which
+	# provision sessions out of band.  The sid and psid must be set.
+	# By default sessions in dynamic tunnels are signalled to the peer.
+	static = false
+
+	# extra_avp, if set, specifies an AVP to append to outgoing control
+	# messages as for tunnel instances.
+	# Session AVPs may be appended to "icrq" and "iccn" messages.
+	[[tunnel.t1.session.s1.extra_avp]]
+	vendor_id = 9
+	type = 2
+	value_type = "uint32"
+	value = 42
+	messages = ["icrq", "iccn"]
+
+Tunnels and sessions may take their parameters from named profiles, so that large
+deployments needn't repeat the same parameters for each instance.  Tunnel profiles
+are called out using [tunnel_profile.name] tables and session profiles using
+[session_profile.name] tables, which hold the same parameters as tunnel and session
+tables respectively, including those handled by an application's ConfigParser, but
+may not hold sessions.  A tunnel or session references a profile using the profile
+parameter, and any parameters it sets itself override those of the profile.  A
+tunnel or tunnel profile may also set session_profile, naming the profile of those
+of the tunnel's sessions which don't reference one themselves.
+
+	[tunnel_profile.lns]
+	peer = "lns.example.com:1701"
+	version = "l2tpv2"
+	secret_file = "/run/secrets/lns"
+	session_profile = "subscriber"
+
+	[session_profile.subscriber]
+	pseudowire = "ppp"
+	mtu = 1450
+
+	[tunnel.t1]
+	profile = "lns"
+	local = "192.0.2.1:1701"
+
+	[tunnel.t1.session.s1]
+
+	[tunnel.t1.session.s2]
+	mtu = 1400
+
+Transport and socket parameters which suit the network rather than the peer may
+be set for all tunnels in a [tunnel_defaults] table.  Each tunnel uses the defaults
+for parameters set neither by the tunnel itself nor by its profile.  The defaults
+may set window_size, reorder_queue_size, retry_timeout, max_retries, hello_timeout,
+stopccn_timeout, sccrp_timeout, scccn_timeout, session_reply_timeout,
+recv_buffer_size, send_buffer_size, bind_device, packet_info, control_dscp,
+data_dscp, inherit_data_dscp, data_dscp_map, control_udp_checksum and
+data_udp_checksum.
+
+	[tunnel_defaults]
+	retry_timeout = 1000
+	hello_timeout = 60000
+
+	# This peer is reached over a satellite link
+	[tunnel.t2]
+	peer = "203.0.113.1:1701"
+	retry_timeout = 4000
+	max_retries = 8
+	window_size = 16
+
+Listeners, which accept tunnels from any peer rather than each peer being
+configured individually, are called out using [listener.name] tables.  A listener
+table holds tunnel parameters, which may be supplied by a tunnel profile, and which
+form the configuration of each tunnel the listener accepts.  The local address must
+be set, while the peer address and tunnel IDs may not be, and allowed_peers and
+allowed_peer_host_names may restrict the peers tunnels are accepted from.
+
+Tunnels accepted from particular peers may be configured differently using
+[listener.name.peer."prefix"] tables, named by the address or prefix in CIDR
+notation of the peers they apply to.  A peer table's parameters, and those of any
+profile it references, override the listener's parameters, except for those which
+apply to the listener as a whole: local, encap, shared_socket, netns, the rate and
+pending tunnel limits and the peer restrictions.  A peer table may also set
+peer_host_name, restricting it to peers advertising that host name.  A tunnel uses
+the table with the longest prefix matching its peer, preferring those which set
+peer_host_name.
+
+	[listener.lns]
+	local = "0.0.0.0:1701"
+	profile = "lns"
+	allowed_peers = ["192.0.2.0/24"]
+
+	[listener.lns.peer."192.0.2.9"]
+	profile = "satellite"
+	secret_file = "/run/secrets/branch9"
+
+The format of the configuration is versioned, so that it may evolve without
+configuration files needing to be rewritten as the applications using them are
+upgraded.  The top-level config_version parameter declares the version a file was
+written for, and defaults to 1 if unset.  Files written for an earlier version are
+migrated to the current format as they're loaded, with each deprecated parameter
+reported in Config.Warnings.  Deprecated parameters aren't accepted by files
+declaring the current version, which is 1: no parameters have been renamed yet.
+
+	config_version = 1
+
+Loading a configuration checks only that each parameter is well formed.
+Config.Validate goes further, checking for conflicts between instances such as
+duplicate tunnel or session IDs, and for parameters unsupported by an instance's
+protocol version or pseudowire type, reporting each problem along with its location
+in the configuration file.
+
+Configuration may alternatively be encoded as JSON, which is recognised by the
+configuration beginning with a brace.  The JSON object has the same structure as
+the TOML tables, each table being an object, so that the tunnel above might be:
+
+	{
+		"tunnel": {
+			"t1": {
+				"local": "127.0.0.1:5000",
+				"peer": "127.0.0.1:5001",
+				"session": {
+					"s1": { "pseudowire": "eth" }
+				}
+			}
+		}
+	}
+
+Since JSON doesn't record the location of parameters, problems found by
+Config.Validate in a JSON encoded configuration are reported without one.
+
+Config.DumpJSON encodes the effective configuration as JSON, listing the parameters
+of each instance once profiles and tunnel defaults have been applied and the
+configuration migrated to the current version, with secrets redacted.
 */
 package config
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/katalix/go-l2tp/l2tp"
@@ -156,8 +630,25 @@ type Config struct {
 	Map map[string]interface{}
 	// All the tunnels defined in the configuration.
 	Tunnels []NamedTunnel
+	// All the listeners defined in the configuration.
+	Listeners []NamedListener
 	// Custom parser interface for caller to handle unrecognised key/value pairs.
 	customParser ConfigParser
+	// The parsed TOML tree, which locates parameters for Validate.
+	tree *toml.Tree
+	// The path of the configuration file, if loaded from a file.
+	path string
+	// The profiles supplying defaults for tunnels and sessions.
+	tunnelProfiles, sessionProfiles profiles
+	// The transport parameters applying to tunnels which don't set them.
+	tunnelDefaults map[string]interface{}
+	// The effective parameters of each instance, for DumpJSON.
+	effective map[string]interface{}
+	// The schema version the configuration was written for.
+	Version int
+	// Warnings describes the deprecated parameters renamed when migrating
+	// a configuration written for an earlier schema version.
+	Warnings []string
 }
 
 // NamedTunnel contains L2TP configuration for a tunnel instance,
@@ -252,6 +743,23 @@ func toUint16(v interface{}) (uint16, error) {
 	return 0, fmt.Errorf("unexpected %T value %v", v, v)
 }
 
+func toUint16s(v interface{}) ([]uint16, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array value")
+	}
+
+	var out []uint16
+	for _, val := range vals {
+		u, err := toUint16(val)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
 func toUint32(v interface{}) (uint32, error) {
 	if b, ok := v.(int64); ok {
 		if b < 0x0 || b > 0xffffffff {
@@ -267,6 +775,18 @@ func toUint32(v interface{}) (uint32, error) {
 	return 0, fmt.Errorf("unexpected %T value %v", v, v)
 }
 
+func toUint64(v interface{}) (uint64, error) {
+	if b, ok := v.(int64); ok {
+		if b < 0x0 {
+			return 0, fmt.Errorf("value %x out of range", b)
+		}
+		return uint64(b), nil
+	} else if b, ok := v.(uint64); ok {
+		return b, nil
+	}
+	return 0, fmt.Errorf("unexpected %T value %v", v, v)
+}
+
 func toString(v interface{}) (string, error) {
 	if s, ok := v.(string); ok {
 		return s, nil
@@ -274,6 +794,49 @@ func toString(v interface{}) (string, error) {
 	return "", fmt.Errorf("supplied value could not be parsed as a string")
 }
 
+func toStrings(v interface{}) ([]string, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array value")
+	}
+
+	var out []string
+	for _, val := range vals {
+		s, err := toString(val)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func toAddress(v interface{}) (string, error) {
+	s, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err = net.SplitHostPort(s); err != nil {
+		return "", fmt.Errorf("expect host:port, with IPv6 addresses in square brackets: %v", err)
+	}
+	return s, nil
+}
+
+func toHardwareAddr(v interface{}) (net.HardwareAddr, error) {
+	s, err := toString(v)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(addr) != 6 {
+		return nil, fmt.Errorf("expect an Ethernet MAC address")
+	}
+	return addr, nil
+}
+
 func toDurationMs(v interface{}) (time.Duration, error) {
 	u, err := toUint32(v)
 	return time.Duration(u) * time.Millisecond, err
@@ -293,6 +856,36 @@ func toVersion(v interface{}) (l2tp.ProtocolVersion, error) {
 	return 0, err
 }
 
+func toVersionPolicy(v interface{}) (l2tp.VersionPolicy, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "prefer-l2tpv3":
+			return l2tp.VersionPolicyPreferV3, nil
+		case "prefer-l2tpv2":
+			return l2tp.VersionPolicyPreferV2, nil
+		}
+		return 0, fmt.Errorf("expect 'prefer-l2tpv3' or 'prefer-l2tpv2'")
+	}
+	return 0, err
+}
+
+func toDuplicateAVPPolicy(v interface{}) (l2tp.DuplicateAVPPolicy, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "first":
+			return l2tp.DuplicateAVPFirst, nil
+		case "last":
+			return l2tp.DuplicateAVPLast, nil
+		case "reject":
+			return l2tp.DuplicateAVPReject, nil
+		}
+		return 0, fmt.Errorf("expect 'first', 'last' or 'reject'")
+	}
+	return 0, err
+}
+
 func toFramingCaps(v interface{}) (l2tp.FramingCapability, error) {
 	var fc l2tp.FramingCapability
 
@@ -321,6 +914,34 @@ func toFramingCaps(v interface{}) (l2tp.FramingCapability, error) {
 	return fc, nil
 }
 
+func toPseudowireCaps(v interface{}) ([]l2tp.PseudowireType, error) {
+	caps, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array value")
+	}
+
+	var out []l2tp.PseudowireType
+	for _, c := range caps {
+		pw, err := toPseudowireType(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pw)
+	}
+	return out, nil
+}
+
+func toRouterID(v interface{}) (uint32, error) {
+	if s, ok := v.(string); ok {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return 0, fmt.Errorf("expect integer or IPv4 address")
+		}
+		return binary.BigEndian.Uint32(ip), nil
+	}
+	return toUint32(v)
+}
+
 func toEncapType(v interface{}) (l2tp.EncapType, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -343,8 +964,12 @@ func toPseudowireType(v interface{}) (l2tp.PseudowireType, error) {
 			return l2tp.PseudowireTypePPP, nil
 		case "eth":
 			return l2tp.PseudowireTypeEth, nil
+		case "eth_vlan":
+			return l2tp.PseudowireTypeEthVLAN, nil
+		case "ip":
+			return l2tp.PseudowireTypeIP, nil
 		}
-		return 0, fmt.Errorf("expect 'ppp' or 'eth'")
+		return 0, fmt.Errorf("expect 'ppp', 'eth', 'eth_vlan' or 'ip'")
 	}
 	return 0, err
 }
@@ -363,6 +988,184 @@ func toL2SpecType(v interface{}) (l2tp.L2SpecType, error) {
 	return l2tp.L2SpecTypeNone, err
 }
 
+func toUDPChecksumMode(v interface{}) (l2tp.UDPChecksumMode, error) {
+	b, err := toBool(v)
+	if err != nil {
+		return l2tp.UDPChecksumDefault, err
+	}
+	if b {
+		return l2tp.UDPChecksumEnabled, nil
+	}
+	return l2tp.UDPChecksumDisabled, nil
+}
+
+// DSCP class selector and assured/expedited forwarding names
+// per RFC2474, RFC2597 and RFC3246.
+var dscpNames = map[string]uint8{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+func toDSCP(v interface{}) (uint8, error) {
+	if s, ok := v.(string); ok {
+		if d, ok := dscpNames[s]; ok {
+			return d, nil
+		}
+		return 0, fmt.Errorf("unrecognised DSCP name %q", s)
+	}
+	u, err := toUint32(v)
+	if err != nil {
+		return 0, err
+	}
+	if u > 63 {
+		return 0, fmt.Errorf("value %v out of range (max 63)", u)
+	}
+	return uint8(u), nil
+}
+
+// toDSCPMap parses a table mapping DSCPs to DSCPs.  Since table keys are
+// strings, a key is either a DSCP name or a decimal number.
+func toDSCPMap(v interface{}) (map[uint8]uint8, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected table value")
+	}
+
+	out := make(map[uint8]uint8)
+	for k, v := range m {
+		var key interface{} = k
+		if n, err := strconv.ParseInt(k, 10, 64); err == nil {
+			key = n
+		}
+		inner, err := toDSCP(key)
+		if err != nil {
+			return nil, err
+		}
+		if out[inner], err = toDSCP(v); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func toMessageTypes(v interface{}) ([]l2tp.MessageType, error) {
+	var out []l2tp.MessageType
+
+	types, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array value")
+	}
+
+	for _, t := range types {
+		ts, err := toString(t)
+		if err != nil {
+			return nil, err
+		}
+		switch ts {
+		case "sccrq":
+			out = append(out, l2tp.MessageTypeSCCRQ)
+		case "icrq":
+			out = append(out, l2tp.MessageTypeICRQ)
+		case "iccn":
+			out = append(out, l2tp.MessageTypeICCN)
+		default:
+			return nil, fmt.Errorf("expect 'sccrq', 'icrq', or 'iccn'")
+		}
+	}
+	return out, nil
+}
+
+func toAVPValue(valueType string, v interface{}) (interface{}, error) {
+	switch valueType {
+	case "uint16":
+		return toUint16(v)
+	case "uint32":
+		return toUint32(v)
+	case "uint64":
+		return toUint64(v)
+	case "string":
+		return toString(v)
+	case "bytes":
+		return toBytes(v)
+	}
+	return nil, fmt.Errorf("expect 'uint16', 'uint32', 'uint64', 'string', or 'bytes'")
+}
+
+func toExtraAVP(v interface{}) (avp l2tp.ExtraAVP, err error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return avp, fmt.Errorf("expected table value")
+	}
+
+	var valueType string
+	var value interface{}
+	for k, v := range m {
+		switch k {
+		case "vendor_id":
+			avp.VendorID, err = toUint16(v)
+		case "type":
+			avp.Type, err = toUint16(v)
+		case "mandatory":
+			avp.Mandatory, err = toBool(v)
+		case "messages":
+			avp.Messages, err = toMessageTypes(v)
+		case "value_type":
+			valueType, err = toString(v)
+		case "value":
+			value = v
+		default:
+			err = fmt.Errorf("unrecognised parameter")
+		}
+		if err != nil {
+			return avp, fmt.Errorf("%v: %v", k, err)
+		}
+	}
+
+	if value != nil {
+		if valueType == "" {
+			return avp, fmt.Errorf("value_type must be specified with value")
+		}
+		avp.Value, err = toAVPValue(valueType, value)
+		if err != nil {
+			return avp, fmt.Errorf("value: %v", err)
+		}
+	} else if valueType != "" {
+		return avp, fmt.Errorf("value must be specified with value_type")
+	}
+	return avp, nil
+}
+
+func toExtraAVPs(v interface{}) ([]l2tp.ExtraAVP, error) {
+	var out []l2tp.ExtraAVP
+
+	// Arrays of tables are represented as []map[string]interface{},
+	// while arrays of inline tables are represented as []interface{}
+	var avps []interface{}
+	switch t := v.(type) {
+	case []interface{}:
+		avps = t
+	case []map[string]interface{}:
+		for _, m := range t {
+			avps = append(avps, m)
+		}
+	default:
+		return nil, fmt.Errorf("expected array of tables")
+	}
+
+	for _, a := range avps {
+		avp, err := toExtraAVP(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, avp)
+	}
+	return out, nil
+}
+
 func toCCID(v interface{}) (l2tp.ControlConnID, error) {
 	u, err := toUint32(v)
 	return l2tp.ControlConnID(u), err
@@ -403,6 +1206,8 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 			ns.Config.PeerSessionID, err = toCCID(v)
 		case "pseudowire":
 			ns.Config.Pseudowire, err = toPseudowireType(v)
+		case "pseudowire_fallback":
+			ns.Config.PseudowireFallback, err = toPseudowireCaps(v)
 		case "seqnum":
 			ns.Config.SeqNum, err = toBool(v)
 		case "reorder_timeout":
@@ -413,8 +1218,40 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 			ns.Config.PeerCookie, err = toBytes(v)
 		case "interface_name":
 			ns.Config.InterfaceName, err = toString(v)
+		case "hardware_addr":
+			ns.Config.HardwareAddr, err = toHardwareAddr(v)
 		case "l2spec_type":
 			ns.Config.L2SpecType, err = toL2SpecType(v)
+		case "mtu":
+			ns.Config.MTU, err = toUint16(v)
+		case "interface_addrs":
+			ns.Config.InterfaceAddrs, err = toStrings(v)
+		case "interface_up":
+			ns.Config.InterfaceUp, err = toBool(v)
+		case "bridge":
+			ns.Config.Bridge, err = toString(v)
+		case "vlans":
+			ns.Config.VLANs, err = toUint16s(v)
+		case "interface_netns":
+			ns.Config.InterfaceNetNS, err = toString(v)
+		case "tx_connect_speed":
+			ns.Config.TxConnectSpeed, err = toUint64(v)
+		case "rx_connect_speed":
+			ns.Config.RxConnectSpeed, err = toUint64(v)
+		case "bundle_id":
+			ns.Config.BundleID, err = toString(v)
+		case "extra_avp":
+			ns.Config.ExtraAVPs, err = toExtraAVPs(v)
+		case "persist":
+			ns.Config.Persist, err = toBool(v)
+		case "persist_backoff":
+			ns.Config.PersistBackoff, err = toDurationMs(v)
+		case "on_demand":
+			ns.Config.OnDemand, err = toBool(v)
+		case "idle_timeout":
+			ns.Config.IdleTimeout, err = toDurationMs(v)
+		case "static":
+			ns.Config.Static, err = toBool(v)
 		default:
 			err = cfg.customParser.ParseSessionParameter(tunnel, ns, k, v)
 		}
@@ -425,7 +1262,7 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 	return ns, nil
 }
 
-func (cfg *Config) loadSessions(tunnel *NamedTunnel, v interface{}) ([]NamedSession, error) {
+func (cfg *Config) loadSessions(tunnel *NamedTunnel, v interface{}, defaultProfile interface{}) ([]NamedSession, error) {
 	var out []NamedSession
 	sessions, ok := v.(map[string]interface{})
 	if !ok {
@@ -436,55 +1273,176 @@ func (cfg *Config) loadSessions(tunnel *NamedTunnel, v interface{}) ([]NamedSess
 		if !ok {
 			return nil, fmt.Errorf("session instances must be named, e.g. '[tunnel.mytunnel.session.mysession]'")
 		}
+		profile, ok := smap["profile"]
+		if !ok {
+			profile = defaultProfile
+		}
+		smap, err := cfg.sessionProfiles.apply("session_profile", profile, smap)
+		if err != nil {
+			return nil, fmt.Errorf("session %v: %v", name, err)
+		}
 		scfg, err := cfg.newSessionConfig(tunnel, name, smap)
 		if err != nil {
 			return nil, fmt.Errorf("session %v: %v", name, err)
 		}
+		cfg.record(smap, "tunnel", tunnel.Name, "session", name)
 		out = append(out, *scfg)
 	}
 	return out, nil
 }
 
 func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*NamedTunnel, error) {
+	tcfg, err := cfg.tunnelProfiles.apply("tunnel_profile", tcfg["profile"], tcfg)
+	if err != nil {
+		return nil, err
+	}
+	tcfg = applyDefaults(cfg.tunnelDefaults, tcfg)
+	nt, err := cfg.parseTunnel(name, tcfg, cfg.customParser)
+	if err != nil {
+		return nil, err
+	}
+	cfg.record(tcfg, "tunnel", name)
+	return nt, nil
+}
+
+// parseTunnel parses the parameters of a tunnel, or of a listener, once
+// merged with those of any profile and the tunnel defaults.  Unrecognised
+// parameters are passed to the parser.
+func (cfg *Config) parseTunnel(name string, tcfg map[string]interface{}, parser ConfigParser) (*NamedTunnel, error) {
 	nt := &NamedTunnel{
 		Name: name,
 		Config: &l2tp.TunnelConfig{
 			FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
 		},
 	}
+	sources := make(secretSources)
 	for k, v := range tcfg {
 		var err error
 		switch k {
 		case "local":
-			nt.Config.Local, err = toString(v)
+			nt.Config.Local, err = toAddress(v)
 		case "peer":
-			nt.Config.Peer, err = toString(v)
+			nt.Config.Peer, err = toAddress(v)
 		case "encap":
 			nt.Config.Encap, err = toEncapType(v)
 		case "version":
 			nt.Config.Version, err = toVersion(v)
+		case "version_policy":
+			nt.Config.VersionPolicy, err = toVersionPolicy(v)
 		case "tid":
 			nt.Config.TunnelID, err = toCCID(v)
 		case "ptid":
 			nt.Config.PeerTunnelID, err = toCCID(v)
 		case "window_size":
 			nt.Config.WindowSize, err = toUint16(v)
+		case "reorder_queue_size":
+			nt.Config.ReorderQueueSize, err = toUint16(v)
 		case "hello_timeout":
 			nt.Config.HelloTimeout, err = toDurationMs(v)
 		case "retry_timeout":
 			nt.Config.RetryTimeout, err = toDurationMs(v)
+		case "sccrp_timeout":
+			nt.Config.SccrpTimeout, err = toDurationMs(v)
+		case "scccn_timeout":
+			nt.Config.ScccnTimeout, err = toDurationMs(v)
+		case "session_reply_timeout":
+			nt.Config.SessionReplyTimeout, err = toDurationMs(v)
 		case "max_retries":
-			if u, err := toUint16(v); err == nil {
-				nt.Config.MaxRetries = uint(u)
-			}
+			var retries uint16
+			retries, err = toUint16(v)
+			nt.Config.MaxRetries = uint(retries)
+		case "stopccn_timeout":
+			nt.Config.StopCCNTimeout, err = toDurationMs(v)
 		case "host_name":
 			nt.Config.HostName, err = toString(v)
+		case "secret", "secret_file", "secret_env":
+			if err = sources.set(k); err == nil {
+				nt.Config.Secret, err = toSecret(k, v)
+			}
+		case "alternate_secret", "alternate_secret_file", "alternate_secret_env":
+			if err = sources.set(k); err == nil {
+				nt.Config.AlternateSecret, err = toSecret(k, v)
+			}
+		case "challenge_length":
+			var length uint16
+			length, err = toUint16(v)
+			nt.Config.ChallengeLength = int(length)
 		case "framing_caps":
 			nt.Config.FramingCaps, err = toFramingCaps(v)
+		case "router_id":
+			nt.Config.RouterID, err = toRouterID(v)
+		case "pseudowire_caps":
+			nt.Config.PseudowireCaps, err = toPseudowireCaps(v)
+		case "control_udp_checksum":
+			nt.Config.ControlChecksum, err = toUDPChecksumMode(v)
+		case "data_udp_checksum":
+			nt.Config.DataChecksum, err = toUDPChecksumMode(v)
+		case "control_dscp":
+			nt.Config.ControlDSCP, err = toDSCP(v)
+		case "data_dscp":
+			nt.Config.DataDSCP, err = toDSCP(v)
+		case "inherit_data_dscp":
+			nt.Config.InheritDataDSCP, err = toBool(v)
+		case "data_dscp_map":
+			nt.Config.DataDSCPMap, err = toDSCPMap(v)
+		case "recv_buffer_size":
+			nt.Config.RecvBufferSize, err = toUint32(v)
+		case "send_buffer_size":
+			nt.Config.SendBufferSize, err = toUint32(v)
+		case "bind_device":
+			nt.Config.BindDevice, err = toString(v)
+		case "packet_info":
+			nt.Config.PacketInfo, err = toBool(v)
+		case "shared_socket":
+			nt.Config.SharedSocket, err = toBool(v)
+		case "netns":
+			nt.Config.NetNS, err = toString(v)
+		case "max_sessions":
+			var max uint32
+			max, err = toUint32(v)
+			nt.Config.MaxSessions = int(max)
+		case "sccrq_rate_limit":
+			var rate uint32
+			rate, err = toUint32(v)
+			nt.Config.SccrqRateLimit = int(rate)
+		case "peer_sccrq_rate_limit":
+			var rate uint32
+			rate, err = toUint32(v)
+			nt.Config.PeerSccrqRateLimit = int(rate)
+		case "max_pending_tunnels":
+			var max uint32
+			max, err = toUint32(v)
+			nt.Config.MaxPendingTunnels = int(max)
+		case "defer_tunnel_creation":
+			nt.Config.DeferTunnelCreation, err = toBool(v)
+		case "allowed_peers":
+			nt.Config.AllowedPeers, err = toStrings(v)
+		case "allowed_peer_host_names":
+			nt.Config.AllowedPeerHostNames, err = toStrings(v)
+		case "reject_unauthorized_peers":
+			nt.Config.RejectUnauthorizedPeers, err = toBool(v)
+		case "max_messages_per_datagram":
+			var max uint16
+			max, err = toUint16(v)
+			nt.Config.MaxMessagesPerDatagram = int(max)
+		case "max_avps_per_message":
+			var max uint16
+			max, err = toUint16(v)
+			nt.Config.MaxAVPsPerMessage = int(max)
+		case "max_avp_len":
+			var max uint16
+			max, err = toUint16(v)
+			nt.Config.MaxAVPLen = int(max)
+		case "duplicate_avp_policy":
+			nt.Config.DuplicateAVPs, err = toDuplicateAVPPolicy(v)
+		case "extra_avp":
+			nt.Config.ExtraAVPs, err = toExtraAVPs(v)
 		case "session":
-			nt.Sessions, err = cfg.loadSessions(nt, v)
+			nt.Sessions, err = cfg.loadSessions(nt, v, tcfg["session_profile"])
+		case "session_profile":
+			// Applied to the sessions as they're loaded
 		default:
-			err = cfg.customParser.ParseTunnelParameter(nt, k, v)
+			err = parser.ParseTunnelParameter(nt, k, v)
 		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to process %v: %v", k, err)
@@ -510,15 +1468,40 @@ func (cfg *Config) loadTunnels(tunnels map[string]interface{}) ([]NamedTunnel, e
 	return out, nil
 }
 
-func newConfig(tree *toml.Tree, customParser ConfigParser) (*Config, error) {
+func newConfig(m map[string]interface{}, tree *toml.Tree, customParser ConfigParser) (*Config, error) {
 	cfg := &Config{
-		Map:          tree.ToMap(),
+		Map:          m,
 		customParser: customParser,
+		tree:         tree,
+	}
+
+	if err := cfg.migrate(SchemaVersion, migrations); err != nil {
+		return nil, err
+	}
+
+	// Profiles must be loaded before the tunnels and sessions using them
+	var err error
+	if v, ok := cfg.Map["tunnel_profile"]; ok {
+		if cfg.tunnelProfiles, err = toProfiles("tunnel_profile", v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := cfg.Map["session_profile"]; ok {
+		if cfg.sessionProfiles, err = toProfiles("session_profile", v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := cfg.Map["tunnel_defaults"]; ok {
+		if cfg.tunnelDefaults, err = toTunnelDefaults(v); err != nil {
+			return nil, err
+		}
 	}
 
 	// Walk the parameters, directly parse tunnel tables, defer everything else the custom parser
 	for k, v := range cfg.Map {
-		if k == "tunnel" {
+		if k == "config_version" || k == "tunnel_defaults" || k == "tunnel_profile" || k == "session_profile" {
+			continue
+		} else if k == "tunnel" {
 			tunnels, ok := v.(map[string]interface{})
 			if !ok || len(tunnels) == 0 {
 				return nil, fmt.Errorf("tunnel instances must be named, e.g. '[tunnel.mytunnel]'")
@@ -528,6 +1511,16 @@ func newConfig(tree *toml.Tree, customParser ConfigParser) (*Config, error) {
 				return nil, fmt.Errorf("failed to parse tunnels: %v", err)
 			}
 			cfg.Tunnels = append(cfg.Tunnels, parsedTunnels...)
+		} else if k == "listener" {
+			listeners, ok := v.(map[string]interface{})
+			if !ok || len(listeners) == 0 {
+				return nil, fmt.Errorf("listener instances must be named, e.g. '[listener.mylistener]'")
+			}
+			parsedListeners, err := cfg.loadListeners(listeners)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse listeners: %v", err)
+			}
+			cfg.Listeners = append(cfg.Listeners, parsedListeners...)
 		} else {
 			err := cfg.customParser.ParseParameter(k, v)
 			if err != nil {
@@ -539,20 +1532,43 @@ func newConfig(tree *toml.Tree, customParser ConfigParser) (*Config, error) {
 	return cfg, nil
 }
 
+// load parses a configuration encoded as either TOML or JSON.  The TOML
+// tree is returned for locating parameters, and is nil for JSON.
+func load(content []byte) (map[string]interface{}, *toml.Tree, error) {
+	if isJSON(content) {
+		m, err := loadJSON(content)
+		return m, nil, err
+	}
+	tree, err := toml.LoadBytes(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree.ToMap(), tree, nil
+}
+
 func newConfigFromFile(path string, customParser ConfigParser) (*Config, error) {
-	tree, err := toml.LoadFile(path)
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config file: %v", err)
 	}
-	return newConfig(tree, customParser)
+	m, tree, err := load(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: %v", err)
+	}
+	cfg, err := newConfig(m, tree, customParser)
+	if err != nil {
+		return nil, err
+	}
+	cfg.path = path
+	return cfg, nil
 }
 
 func newConfigFromString(content string, customParser ConfigParser) (*Config, error) {
-	tree, err := toml.Load(content)
+	m, tree, err := load([]byte(content))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config string: %v", err)
 	}
-	return newConfig(tree, customParser)
+	return newConfig(m, tree, customParser)
 }
 
 // LoadFile loads configuration from the specified file.
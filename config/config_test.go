@@ -2,7 +2,9 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -24,16 +26,51 @@ func TestGetTunnels(t *testing.T) {
 				 ptid = 8192
 				 framing_caps = ["sync"]
 				 host_name = "blackhole.local"
+				 router_id = "10.0.0.1"
+				 pseudowire_caps = ["eth", "ppp", "eth_vlan", "ip"]
 
 				 [tunnel.t2]
 				 encap = "udp"
 				 version = "l2tpv2"
+				 version_policy = "prefer-l2tpv2"
+				 local = "[::]:1701"
 				 peer = "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543"
 				 hello_timeout = 250
 				 window_size = 10
+				 reorder_queue_size = 8
 				 retry_timeout = 250
 				 max_retries = 2
+				 sccrp_timeout = 3000
+				 scccn_timeout = 2000
+				 session_reply_timeout = 1000
+				 secret = "hunter2"
+				 alternate_secret = "hunter3"
+				 challenge_length = 32
 				 framing_caps = ["sync","async"]
+				 control_udp_checksum = false
+				 data_udp_checksum = false
+				 control_dscp = "cs6"
+				 data_dscp = 10
+				 inherit_data_dscp = true
+				 data_dscp_map = { "ef" = "af41", "10" = 0 }
+				 recv_buffer_size = 1048576
+				 send_buffer_size = 262144
+				 bind_device = "eth0"
+				 packet_info = true
+				 shared_socket = true
+				 netns = "/run/netns/provider"
+				 max_sessions = 4000
+				 sccrq_rate_limit = 100
+				 peer_sccrq_rate_limit = 2
+				 max_pending_tunnels = 50
+				 defer_tunnel_creation = true
+				 allowed_peers = ["192.168.0.0/24", "2001:db8::1"]
+				 allowed_peer_host_names = ["lac1.example.com"]
+				 reject_unauthorized_peers = true
+				 max_messages_per_datagram = 4
+				 max_avps_per_message = 64
+				 max_avp_len = 256
+				 duplicate_avp_policy = "last"
 				 `,
 			want: []NamedTunnel{
 				{
@@ -46,19 +83,59 @@ func TestGetTunnels(t *testing.T) {
 						PeerTunnelID: 8192,
 						FramingCaps:  l2tp.FramingCapSync,
 						HostName:     "blackhole.local",
+						RouterID:     0x0a000001,
+						PseudowireCaps: []l2tp.PseudowireType{
+							l2tp.PseudowireTypeEth,
+							l2tp.PseudowireTypePPP,
+							l2tp.PseudowireTypeEthVLAN,
+							l2tp.PseudowireTypeIP,
+						},
 					},
 				},
 				{
 					Name: "t2",
 					Config: &l2tp.TunnelConfig{
-						Encap:        l2tp.EncapTypeUDP,
-						Version:      l2tp.ProtocolVersion2,
-						Peer:         "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
-						HelloTimeout: 250 * time.Millisecond,
-						WindowSize:   10,
-						RetryTimeout: 250 * time.Millisecond,
-						MaxRetries:   2,
-						FramingCaps:  l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						Encap:                   l2tp.EncapTypeUDP,
+						Version:                 l2tp.ProtocolVersion2,
+						VersionPolicy:           l2tp.VersionPolicyPreferV2,
+						Local:                   "[::]:1701",
+						Peer:                    "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+						HelloTimeout:            250 * time.Millisecond,
+						WindowSize:              10,
+						ReorderQueueSize:        8,
+						RetryTimeout:            250 * time.Millisecond,
+						MaxRetries:              2,
+						SccrpTimeout:            3 * time.Second,
+						ScccnTimeout:            2 * time.Second,
+						SessionReplyTimeout:     time.Second,
+						Secret:                  "hunter2",
+						AlternateSecret:         "hunter3",
+						ChallengeLength:         32,
+						FramingCaps:             l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						ControlChecksum:         l2tp.UDPChecksumDisabled,
+						DataChecksum:            l2tp.UDPChecksumDisabled,
+						ControlDSCP:             48,
+						DataDSCP:                10,
+						InheritDataDSCP:         true,
+						DataDSCPMap:             map[uint8]uint8{46: 34, 10: 0},
+						RecvBufferSize:          1048576,
+						SendBufferSize:          262144,
+						BindDevice:              "eth0",
+						PacketInfo:              true,
+						SharedSocket:            true,
+						NetNS:                   "/run/netns/provider",
+						MaxSessions:             4000,
+						SccrqRateLimit:          100,
+						PeerSccrqRateLimit:      2,
+						MaxPendingTunnels:       50,
+						DeferTunnelCreation:     true,
+						AllowedPeers:            []string{"192.168.0.0/24", "2001:db8::1"},
+						AllowedPeerHostNames:    []string{"lac1.example.com"},
+						RejectUnauthorizedPeers: true,
+						MaxMessagesPerDatagram:  4,
+						MaxAVPsPerMessage:       64,
+						MaxAVPLen:               256,
+						DuplicateAVPs:           l2tp.DuplicateAVPLast,
 					},
 				},
 			},
@@ -71,11 +148,15 @@ func TestGetTunnels(t *testing.T) {
 
 				 [tunnel.t1.session.s1]
 				 pseudowire = "eth"
+				 pseudowire_fallback = [ "ppp" ]
 				 cookie = [ 0x34, 0x04, 0xa9, 0xbe ]
 				 peer_cookie = [ 0x80, 0x12, 0xff, 0x5b ]
 				 seqnum = true
 				 reorder_timeout = 1500
 				 l2spec_type = "none"
+				 hardware_addr = "02:00:5e:10:20:30"
+				 on_demand = true
+				 idle_timeout = 30000
 
 				 [tunnel.t1.session.s2]
 				 pseudowire = "ppp"
@@ -83,6 +164,23 @@ func TestGetTunnels(t *testing.T) {
 				 psid = 1237812
 				 interface_name = "becky"
 				 l2spec_type = "default"
+				 persist = true
+				 persist_backoff = 250
+				 mtu = 1400
+				 tx_connect_speed = 100000000
+				 rx_connect_speed = 20000000
+				 bundle_id = "subscriber1"
+
+				 [tunnel.t1.session.s3]
+				 pseudowire = "eth_vlan"
+				 sid = 100
+				 psid = 200
+				 static = true
+				 interface_addrs = [ "192.0.2.1/24" ]
+				 interface_up = true
+				 bridge = "br0"
+				 vlans = [ 100, 200 ]
+				 interface_netns = "/run/netns/tenant1"
 				`,
 			want: []NamedTunnel{
 				{
@@ -97,22 +195,116 @@ func TestGetTunnels(t *testing.T) {
 						{
 							Name: "s1",
 							Config: &l2tp.SessionConfig{
-								Pseudowire:     l2tp.PseudowireTypeEth,
-								Cookie:         []byte{0x34, 0x04, 0xa9, 0xbe},
-								PeerCookie:     []byte{0x80, 0x12, 0xff, 0x5b},
-								SeqNum:         true,
-								ReorderTimeout: time.Millisecond * 1500,
-								L2SpecType:     l2tp.L2SpecTypeNone,
+								Pseudowire:         l2tp.PseudowireTypeEth,
+								PseudowireFallback: []l2tp.PseudowireType{l2tp.PseudowireTypePPP},
+								Cookie:             []byte{0x34, 0x04, 0xa9, 0xbe},
+								PeerCookie:         []byte{0x80, 0x12, 0xff, 0x5b},
+								SeqNum:             true,
+								ReorderTimeout:     time.Millisecond * 1500,
+								L2SpecType:         l2tp.L2SpecTypeNone,
+								HardwareAddr:       net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x20, 0x30},
+								OnDemand:           true,
+								IdleTimeout:        30 * time.Second,
 							},
 						},
 						{
 							Name: "s2",
 							Config: &l2tp.SessionConfig{
-								Pseudowire:    l2tp.PseudowireTypePPP,
-								SessionID:     90210,
-								PeerSessionID: 1237812,
-								InterfaceName: "becky",
-								L2SpecType:    l2tp.L2SpecTypeDefault,
+								Pseudowire:     l2tp.PseudowireTypePPP,
+								SessionID:      90210,
+								PeerSessionID:  1237812,
+								InterfaceName:  "becky",
+								L2SpecType:     l2tp.L2SpecTypeDefault,
+								Persist:        true,
+								PersistBackoff: 250 * time.Millisecond,
+								MTU:            1400,
+								TxConnectSpeed: 100000000,
+								RxConnectSpeed: 20000000,
+								BundleID:       "subscriber1",
+							},
+						},
+						{
+							Name: "s3",
+							Config: &l2tp.SessionConfig{
+								Pseudowire:     l2tp.PseudowireTypeEthVLAN,
+								SessionID:      100,
+								PeerSessionID:  200,
+								Static:         true,
+								InterfaceAddrs: []string{"192.0.2.1/24"},
+								InterfaceUp:    true,
+								Bridge:         "br0",
+								VLANs:          []uint16{100, 200},
+								InterfaceNetNS: "/run/netns/tenant1",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 peer = "127.0.0.1:5001"
+
+				 [[tunnel.t1.extra_avp]]
+				 vendor_id = 9
+				 type = 1
+				 value_type = "string"
+				 value = "hello"
+				 messages = ["sccrq"]
+
+				 [[tunnel.t1.extra_avp]]
+				 vendor_id = 9
+				 type = 2
+				 mandatory = true
+				 messages = ["sccrq"]
+
+				 [tunnel.t1.session.s1]
+				 extra_avp = [
+					{ vendor_id = 9, type = 3, value_type = "uint64", value = 1099511627776, messages = ["icrq"] },
+					{ vendor_id = 9, type = 4, value_type = "bytes", value = [ 0x01, 0x02 ], messages = ["icrq", "iccn"] },
+				 ]
+				`,
+			want: []NamedTunnel{
+				{
+					Name: "t1",
+					Config: &l2tp.TunnelConfig{
+						Version:     l2tp.ProtocolVersion2,
+						Peer:        "127.0.0.1:5001",
+						FramingCaps: l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						ExtraAVPs: []l2tp.ExtraAVP{
+							{
+								VendorID: 9,
+								Type:     1,
+								Value:    "hello",
+								Messages: []l2tp.MessageType{l2tp.MessageTypeSCCRQ},
+							},
+							{
+								VendorID:  9,
+								Type:      2,
+								Mandatory: true,
+								Messages:  []l2tp.MessageType{l2tp.MessageTypeSCCRQ},
+							},
+						},
+					},
+					Sessions: []NamedSession{
+						{
+							Name: "s1",
+							Config: &l2tp.SessionConfig{
+								ExtraAVPs: []l2tp.ExtraAVP{
+									{
+										VendorID: 9,
+										Type:     3,
+										Value:    uint64(1099511627776),
+										Messages: []l2tp.MessageType{l2tp.MessageTypeICRQ},
+									},
+									{
+										VendorID: 9,
+										Type:     4,
+										Value:    []byte{0x01, 0x02},
+										Messages: []l2tp.MessageType{l2tp.MessageTypeICRQ, l2tp.MessageTypeICCN},
+									},
+								},
 							},
 						},
 					},
@@ -130,6 +322,10 @@ func TestGetTunnels(t *testing.T) {
 			if err != nil {
 				t.Fatalf("missing tunnel: %v", err)
 			}
+			// Session order isn't defined, so compare sorted by name
+			sort.Slice(got.Sessions, func(i, j int) bool {
+				return got.Sessions[i].Name < got.Sessions[j].Name
+			})
 			if !reflect.DeepEqual(got, &want) {
 				t.Fatalf("got %v, want %v", got, want)
 			}
@@ -182,6 +378,18 @@ func TestBadConfig(t *testing.T) {
 				 encap = "sausage"`,
 			estr: "expect 'udp' or 'ip'",
 		},
+		{
+			name: "Bad value (unbracketed IPv6 address)",
+			in: `[tunnel.t1]
+				 peer = "2001:db8::1:1701"`,
+			estr: "IPv6 addresses in square brackets",
+		},
+		{
+			name: "Bad value (missing port)",
+			in: `[tunnel.t1]
+				 local = "127.0.0.1"`,
+			estr: "expect host:port",
+		},
 		{
 			name: "Bad value (unrecognised version)",
 			in: `[tunnel.t1]
@@ -193,7 +401,7 @@ func TestBadConfig(t *testing.T) {
 			in: `[tunnel.t1]
 				 [tunnel.t1.session.s1]
 				 pseudowire = "monkey"`,
-			estr: "expect 'ppp' or 'eth'",
+			estr: "expect 'ppp', 'eth', 'eth_vlan' or 'ip'",
 		},
 		{
 			name: "Bad value (unrecognised L2SpecType)",
@@ -208,12 +416,24 @@ func TestBadConfig(t *testing.T) {
 				 framing_caps = [ "bizzle" ]`,
 			estr: "expect 'sync' or 'async'",
 		},
+		{
+			name: "Bad type (string not bool)",
+			in: `[tunnel.t1]
+				 data_udp_checksum = "off"`,
+			estr: "could not be parsed as a bool",
+		},
 		{
 			name: "Bad value (range exceeded)",
 			in: `[tunnel.t1]
 				 tid = 4294967297`,
 			estr: "out of range",
 		},
+		{
+			name: "Bad value (negative timeout)",
+			in: `[tunnel.t1]
+				 sccrp_timeout = -1`,
+			estr: "out of range",
+		},
 		{
 			name: "Bad value (range exceeded)",
 			in: `[tunnel.t1]
@@ -221,6 +441,146 @@ func TestBadConfig(t *testing.T) {
 				 cookie = [ 0x1e, 0xf0, 0x1fe, 0x24 ]`,
 			estr: "out of range",
 		},
+		{
+			name: "Bad value (unrecognised extra AVP message)",
+			in: `[[tunnel.t1.extra_avp]]
+				 messages = ["scccn"]`,
+			estr: "expect 'sccrq', 'icrq', or 'iccn'",
+		},
+		{
+			name: "Bad value (extra AVP value without type)",
+			in: `[[tunnel.t1.extra_avp]]
+				 value = 42
+				 messages = ["sccrq"]`,
+			estr: "value_type must be specified",
+		},
+		{
+			name: "Bad value (extra AVP value range exceeded)",
+			in: `[[tunnel.t1.extra_avp]]
+				 value_type = "uint16"
+				 value = 65536
+				 messages = ["sccrq"]`,
+			estr: "out of range",
+		},
+		{
+			name: "Malformed (bad extra AVP parameter)",
+			in: `[[tunnel.t1.extra_avp]]
+				 colour = "blue"`,
+			estr: "unrecognised parameter",
+		},
+		{
+			name: "Bad value (unrecognised DSCP name)",
+			in: `[tunnel.t1]
+				 control_dscp = "cs8"`,
+			estr: "unrecognised DSCP name",
+		},
+		{
+			name: "Bad value (unrecognised version policy)",
+			in: `[tunnel.t1]
+				 version_policy = "l2tpv3"`,
+			estr: "expect 'prefer-l2tpv3' or 'prefer-l2tpv2'",
+		},
+		{
+			name: "Bad value (unrecognised duplicate AVP policy)",
+			in: `[tunnel.t1]
+				 duplicate_avp_policy = "both"`,
+			estr: "expect 'first', 'last' or 'reject'",
+		},
+		{
+			name: "Bad value (packet_info not a bool)",
+			in: `[tunnel.t1]
+				 packet_info = "yes"`,
+			estr: "failed to process packet_info",
+		},
+		{
+			name: "Bad value (secret not a string)",
+			in: `[tunnel.t1]
+				 secret = 42`,
+			estr: "failed to process secret",
+		},
+		{
+			name: "Bad value (max_sessions negative)",
+			in: `[tunnel.t1]
+				 max_sessions = -1`,
+			estr: "failed to process max_sessions",
+		},
+		{
+			name: "Bad value (router_id not an IPv4 address)",
+			in: `[tunnel.t1]
+				 router_id = "::1"`,
+			estr: "failed to process router_id",
+		},
+		{
+			name: "Bad value (pseudowire_caps unknown type)",
+			in: `[tunnel.t1]
+				 pseudowire_caps = ["eth", "atm"]`,
+			estr: "failed to process pseudowire_caps",
+		},
+		{
+			name: "Bad value (tx_connect_speed negative)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 tx_connect_speed = -1`,
+			estr: "failed to process tx_connect_speed",
+		},
+		{
+			name: "Bad value (hardware_addr not an Ethernet address)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 hardware_addr = "02:00:5e:10"`,
+			estr: "failed to process hardware_addr",
+		},
+		{
+			name: "Bad value (interface_addrs not an array)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 interface_addrs = "192.0.2.1/24"`,
+			estr: "failed to process interface_addrs",
+		},
+		{
+			name: "Bad value (bridge not a string)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 bridge = 42`,
+			estr: "failed to process bridge",
+		},
+		{
+			name: "Bad value (vlans out of range)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 vlans = [ 100, 65536 ]`,
+			estr: "failed to process vlans",
+		},
+		{
+			name: "Bad value (shared_socket not a bool)",
+			in: `[tunnel.t1]
+				 shared_socket = 1`,
+			estr: "failed to process shared_socket",
+		},
+		{
+			name: "Bad value (netns not a string)",
+			in: `[tunnel.t1]
+				 netns = 1`,
+			estr: "failed to process netns",
+		},
+		{
+			name: "Bad value (DSCP out of range)",
+			in: `[tunnel.t1]
+				 data_dscp = 64`,
+			estr: "out of range",
+		},
+		{
+			name: "Bad value (DSCP map key not a DSCP)",
+			in: `[tunnel.t1]
+				 data_dscp_map = { "best" = 0 }`,
+			estr: "unrecognised DSCP name",
+		},
+		{
+			name: "Bad value (DSCP map value out of range)",
+			in: `[tunnel.t1]
+				 data_dscp_map = { "ef" = 64 }`,
+			estr: "out of range",
+		},
 		{
 			name: "Malformed (no tunnel name)",
 			in:   `[tunnel]`,
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+)
+
+// tunnelDefaultKeys lists the parameters which may be set in the
+// tunnel_defaults table: those tuning a tunnel's reliable transport and
+// socket, which typically depend on the network rather than the peer.
+var tunnelDefaultKeys = map[string]bool{
+	"window_size":           true,
+	"reorder_queue_size":    true,
+	"retry_timeout":         true,
+	"max_retries":           true,
+	"hello_timeout":         true,
+	"stopccn_timeout":       true,
+	"sccrp_timeout":         true,
+	"scccn_timeout":         true,
+	"session_reply_timeout": true,
+	"recv_buffer_size":      true,
+	"send_buffer_size":      true,
+	"bind_device":           true,
+	"packet_info":           true,
+	"control_dscp":          true,
+	"data_dscp":             true,
+	"inherit_data_dscp":     true,
+	"data_dscp_map":         true,
+	"control_udp_checksum":  true,
+	"data_udp_checksum":     true,
+}
+
+func toTunnelDefaults(v interface{}) (map[string]interface{}, error) {
+	table, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tunnel_defaults must be a table, e.g. '[tunnel_defaults]'")
+	}
+	for key := range table {
+		if !tunnelDefaultKeys[key] {
+			return nil, fmt.Errorf("tunnel_defaults may not set %v", key)
+		}
+	}
+	return table, nil
+}
+
+// applyDefaults returns the parameters of a tunnel table merged with the
+// tunnel defaults, with the table's parameters taking precedence.
+func applyDefaults(defaults, table map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return table
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(table))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range table {
+		merged[k] = v
+	}
+	return merged
+}
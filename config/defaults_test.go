@@ -0,0 +1,88 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelDefaults(t *testing.T) {
+	cfg, err := LoadString(`
+		[tunnel_defaults]
+		retry_timeout = 1000
+		max_retries = 5
+		hello_timeout = 60000
+		stopccn_timeout = 10000
+
+		[tunnel_profile.satellite]
+		retry_timeout = 4000
+
+		[tunnel.lan]
+		peer = "192.0.2.1:1701"
+
+		[tunnel.sat]
+		peer = "203.0.113.1:1701"
+		profile = "satellite"
+		max_retries = 8
+		window_size = 16
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+
+	lan, err := cfg.findTunnelByName("lan")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if lan.Config.RetryTimeout != time.Second || lan.Config.MaxRetries != 5 ||
+		lan.Config.HelloTimeout != time.Minute || lan.Config.StopCCNTimeout != 10*time.Second {
+		t.Errorf("tunnel lan: got %+v, want the defaults", lan.Config)
+	}
+
+	sat, err := cfg.findTunnelByName("sat")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if sat.Config.RetryTimeout != 4*time.Second || sat.Config.MaxRetries != 8 ||
+		sat.Config.WindowSize != 16 || sat.Config.HelloTimeout != time.Minute {
+		t.Errorf("tunnel sat: got %+v, want the defaults overridden", sat.Config)
+	}
+}
+
+func TestBadTunnelDefaults(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		estr string
+	}{
+		{
+			name: "Not a table",
+			in:   `tunnel_defaults = 42`,
+			estr: "must be a table",
+		},
+		{
+			name: "Peer parameter",
+			in: `[tunnel_defaults]
+				 peer = "192.0.2.1:1701"`,
+			estr: "may not set peer",
+		},
+		{
+			name: "Bad value",
+			in: `[tunnel_defaults]
+				 max_retries = -1
+				 [tunnel.t1]`,
+			estr: "failed to process max_retries",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadString(tt.in)
+			if err == nil {
+				t.Fatalf("LoadString(%v) succeeded when we expected an error", tt.in)
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("LoadString(%v): error %q doesn't contain expected substring %q", tt.in, err, tt.estr)
+			}
+		})
+	}
+}
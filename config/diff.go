@@ -0,0 +1,108 @@
+package config
+
+import (
+	"reflect"
+)
+
+// Diff describes the differences between two configurations, so that an
+// application reloading its configuration may bring its tunnels and sessions
+// into line with the new configuration without disturbing those whose
+// configuration is unchanged.
+//
+// Parameters handled by a custom ConfigParser aren't part of the tunnel and
+// session configuration, so aren't compared: the application must compare
+// them itself.
+type Diff struct {
+	// AddedTunnels lists the tunnels present only in the new
+	// configuration.
+	AddedTunnels []NamedTunnel
+	// RemovedTunnels lists the tunnels present only in the old
+	// configuration.
+	RemovedTunnels []NamedTunnel
+	// ChangedTunnels lists the tunnels whose configuration differs, as
+	// described by the new configuration.  The configuration of a running
+	// tunnel can't be changed, so these tunnels must be recreated along
+	// with their sessions.
+	ChangedTunnels []NamedTunnel
+	// Sessions describes the differences in the sessions of the tunnels
+	// whose configuration is unchanged, keyed by tunnel name.  Tunnels
+	// whose sessions are unchanged are omitted.
+	Sessions map[string]*SessionDiff
+}
+
+// SessionDiff describes the differences between the sessions of a tunnel in
+// two configurations.
+type SessionDiff struct {
+	// Added lists the sessions present only in the new configuration.
+	Added []NamedSession
+	// Removed lists the sessions present only in the old configuration.
+	Removed []NamedSession
+	// Changed lists the sessions whose configuration differs, as
+	// described by the new configuration.  These sessions must be
+	// recreated.
+	Changed []NamedSession
+}
+
+// Compare returns the differences between the configuration from and the
+// configuration to.
+func Compare(from, to *Config) *Diff {
+	diff := &Diff{Sessions: make(map[string]*SessionDiff)}
+
+	old := make(map[string]*NamedTunnel, len(from.Tunnels))
+	for i := range from.Tunnels {
+		old[from.Tunnels[i].Name] = &from.Tunnels[i]
+	}
+	for _, t := range to.Tunnels {
+		o, ok := old[t.Name]
+		if !ok {
+			diff.AddedTunnels = append(diff.AddedTunnels, t)
+			continue
+		}
+		delete(old, t.Name)
+		if !reflect.DeepEqual(o.Config, t.Config) {
+			diff.ChangedTunnels = append(diff.ChangedTunnels, t)
+			continue
+		}
+		if sd := compareSessions(o.Sessions, t.Sessions); sd != nil {
+			diff.Sessions[t.Name] = sd
+		}
+	}
+	for _, t := range from.Tunnels {
+		if _, ok := old[t.Name]; ok {
+			diff.RemovedTunnels = append(diff.RemovedTunnels, t)
+		}
+	}
+	return diff
+}
+
+// compareSessions returns the differences between the sessions of a tunnel,
+// or nil if there are none.
+func compareSessions(from, to []NamedSession) *SessionDiff {
+	var sd SessionDiff
+
+	old := make(map[string]*NamedSession, len(from))
+	for i := range from {
+		old[from[i].Name] = &from[i]
+	}
+	for _, s := range to {
+		o, ok := old[s.Name]
+		if !ok {
+			sd.Added = append(sd.Added, s)
+			continue
+		}
+		delete(old, s.Name)
+		if !reflect.DeepEqual(o.Config, s.Config) {
+			sd.Changed = append(sd.Changed, s)
+		}
+	}
+	for _, s := range from {
+		if _, ok := old[s.Name]; ok {
+			sd.Removed = append(sd.Removed, s)
+		}
+	}
+
+	if len(sd.Added) == 0 && len(sd.Removed) == 0 && len(sd.Changed) == 0 {
+		return nil
+	}
+	return &sd
+}
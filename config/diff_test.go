@@ -0,0 +1,94 @@
+package config
+
+import (
+	"testing"
+)
+
+func names(tunnels []NamedTunnel) (n []string) {
+	for _, t := range tunnels {
+		n = append(n, t.Name)
+	}
+	return
+}
+
+func sessionNames(sessions []NamedSession) (n []string) {
+	for _, s := range sessions {
+		n = append(n, s.Name)
+	}
+	return
+}
+
+func TestCompare(t *testing.T) {
+	from, err := LoadString(`
+		[tunnel.t1]
+		peer = "127.0.0.1:5000"
+		version = "l2tpv3"
+		[tunnel.t1.session.s1]
+		pseudowire = "eth"
+		[tunnel.t1.session.s2]
+		pseudowire = "eth"
+		[tunnel.t1.session.s3]
+		pseudowire = "eth"
+
+		[tunnel.t2]
+		peer = "127.0.0.1:5001"
+		[tunnel.t2.session.s1]
+
+		[tunnel.t3]
+		peer = "127.0.0.1:5002"
+		[tunnel.t3.session.s1]
+
+		[tunnel.t4]
+		peer = "127.0.0.1:5003"
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(from): %v", err)
+	}
+	to, err := LoadString(`
+		[tunnel.t1]
+		peer = "127.0.0.1:5000"
+		version = "l2tpv3"
+		[tunnel.t1.session.s1]
+		pseudowire = "eth"
+		[tunnel.t1.session.s2]
+		pseudowire = "eth"
+		cookie = [ 0x12, 0x34 ]
+		[tunnel.t1.session.s4]
+		pseudowire = "eth"
+
+		[tunnel.t2]
+		peer = "127.0.0.1:5011"
+		[tunnel.t2.session.s1]
+
+		[tunnel.t3]
+		peer = "127.0.0.1:5002"
+		[tunnel.t3.session.s1]
+
+		[tunnel.t5]
+		peer = "127.0.0.1:5004"
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(to): %v", err)
+	}
+
+	diff := Compare(from, to)
+	check := func(what string, got []string, want string) {
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("Compare(): %v: got %v, want [%v]", what, got, want)
+		}
+	}
+	check("added tunnels", names(diff.AddedTunnels), "t5")
+	check("removed tunnels", names(diff.RemovedTunnels), "t4")
+	check("changed tunnels", names(diff.ChangedTunnels), "t2")
+	if len(diff.Sessions) != 1 || diff.Sessions["t1"] == nil {
+		t.Fatalf("Compare(): sessions: got %+v, want t1 only", diff.Sessions)
+	}
+	check("added sessions", sessionNames(diff.Sessions["t1"].Added), "s4")
+	check("removed sessions", sessionNames(diff.Sessions["t1"].Removed), "s3")
+	check("changed sessions", sessionNames(diff.Sessions["t1"].Changed), "s2")
+
+	diff = Compare(to, to)
+	if len(diff.AddedTunnels)+len(diff.RemovedTunnels)+len(diff.ChangedTunnels)+len(diff.Sessions) != 0 {
+		t.Errorf("Compare() of identical configs: got %+v, want no differences", diff)
+	}
+}
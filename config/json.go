@@ -0,0 +1,157 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// isJSON returns true if the configuration is encoded as JSON rather than
+// TOML.  A TOML document can't begin with a brace, whereas a JSON encoded
+// configuration is an object.
+func isJSON(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("{"))
+}
+
+// loadJSON parses a JSON encoded configuration into a map with the same
+// structure as go-toml produces for the equivalent TOML, so that it may be
+// loaded in the same way.
+func loadJSON(content []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data following the configuration object")
+	}
+	if _, err := fromJSON(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fromJSON converts JSON numbers to the types go-toml uses for numbers.
+func fromJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			var err error
+			if v[k], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	}
+	return v, nil
+}
+
+// DumpJSON returns the effective configuration encoded as JSON, for
+// auditing or troubleshooting.  The parameters of each tunnel, session and
+// listener are listed once merged with those of their profiles and the
+// tunnel defaults, and those of a configuration written for an earlier
+// schema version are migrated.  Parameters which aren't set take the
+// defaults of package l2tp, and aren't listed.
+//
+// The values of parameters whose names end in "secret" or "password" are
+// redacted, so the dump may be shared safely, while parameters naming the
+// files or environment variables secrets are read from are listed.
+//
+// Since the dump has the same structure as the configuration, it may be
+// loaded once any redacted parameters have been restored.
+func (cfg *Config) DumpJSON() ([]byte, error) {
+	out := map[string]interface{}{
+		"config_version": SchemaVersion,
+	}
+	for k, v := range cfg.Map {
+		switch k {
+		case "config_version", "tunnel_defaults", "tunnel_profile", "session_profile", "tunnel", "listener":
+		default:
+			out[k] = v
+		}
+	}
+	for k, v := range cfg.effective {
+		out[k] = v
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(redact(out)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// record records the effective parameters of an instance for DumpJSON,
+// at the path of the instance's table.
+func (cfg *Config) record(params map[string]interface{}, path ...string) {
+	if cfg.effective == nil {
+		cfg.effective = make(map[string]interface{})
+	}
+	m := cfg.effective
+	for _, p := range path {
+		next, ok := m[p].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[p] = next
+		}
+		m = next
+	}
+	for k, v := range params {
+		switch k {
+		case "profile", "session_profile", "session":
+			// Merged into the instances they apply to
+		default:
+			m[k] = v
+		}
+	}
+}
+
+// redact returns a copy of a parameter tree with the values of secrets
+// replaced.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if strings.HasSuffix(k, "secret") || strings.HasSuffix(k, "password") {
+				out[k] = "<redacted>"
+			} else {
+				out[k] = redact(e)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redact(e)
+		}
+		return out
+	case []map[string]interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redact(e)
+		}
+		return out
+	}
+	return v
+}
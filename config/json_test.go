@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jsonTestTOML = `
+	[tunnel_defaults]
+	hello_timeout = 60000
+
+	[tunnel_profile.lns]
+	version = "l2tpv3"
+	secret = "hunter2"
+
+	[session_profile.eth]
+	pseudowire = "eth"
+
+	[tunnel.t1]
+	profile = "lns"
+	peer = "192.0.2.1:1701"
+	session_profile = "eth"
+	[tunnel.t1.session.s1]
+	cookie = [ 0x12, 0x34, 0x56, 0x78 ]
+	[[tunnel.t1.session.s1.extra_avp]]
+	vendor_id = 9
+	type = 2
+	value_type = "uint32"
+	value = 42
+	messages = ["icrq"]
+
+	[listener.lns]
+	local = "0.0.0.0:1701"
+	[listener.lns.peer."192.0.2.0/24"]
+	secret = "branch"
+	`
+
+const jsonTestJSON = `{
+	"tunnel_defaults": { "hello_timeout": 60000 },
+	"tunnel_profile": { "lns": { "version": "l2tpv3", "secret": "hunter2" } },
+	"session_profile": { "eth": { "pseudowire": "eth" } },
+	"tunnel": {
+		"t1": {
+			"profile": "lns",
+			"peer": "192.0.2.1:1701",
+			"session_profile": "eth",
+			"session": {
+				"s1": {
+					"cookie": [ 18, 52, 86, 120 ],
+					"extra_avp": [
+						{ "vendor_id": 9, "type": 2, "value_type": "uint32", "value": 42, "messages": ["icrq"] }
+					]
+				}
+			}
+		}
+	},
+	"listener": {
+		"lns": {
+			"local": "0.0.0.0:1701",
+			"peer": { "192.0.2.0/24": { "secret": "branch" } }
+		}
+	}
+}`
+
+func TestLoadJSON(t *testing.T) {
+	want, err := LoadString(jsonTestTOML)
+	if err != nil {
+		t.Fatalf("LoadString(TOML): %v", err)
+	}
+	got, err := LoadString(jsonTestJSON)
+	if err != nil {
+		t.Fatalf("LoadString(JSON): %v", err)
+	}
+	if !reflect.DeepEqual(got.Tunnels, want.Tunnels) {
+		t.Errorf("LoadString(JSON): got tunnels %+v, want %+v", got.Tunnels, want.Tunnels)
+	}
+	if !reflect.DeepEqual(got.Listeners, want.Listeners) {
+		t.Errorf("LoadString(JSON): got listeners %+v, want %+v", got.Listeners, want.Listeners)
+	}
+
+	for _, in := range []string{`{ "tunnel": `, `{} {}`} {
+		if _, err := LoadString(in); err == nil {
+			t.Errorf("LoadString(%v) succeeded when we expected an error", in)
+		}
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	cfg, err := LoadString(jsonTestTOML)
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+	dump, err := cfg.DumpJSON()
+	if err != nil {
+		t.Fatalf("DumpJSON(): %v", err)
+	}
+	if strings.Contains(string(dump), "hunter2") || strings.Contains(string(dump), "branch\"") {
+		t.Errorf("DumpJSON(): secrets weren't redacted:\n%s", dump)
+	}
+
+	var m map[string]interface{}
+	if err = json.Unmarshal(dump, &m); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	for _, key := range []string{"tunnel_defaults", "tunnel_profile", "session_profile"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("DumpJSON(): %v wasn't merged into the instances", key)
+		}
+	}
+	t1 := m["tunnel"].(map[string]interface{})["t1"].(map[string]interface{})
+	if t1["version"] != "l2tpv3" || t1["hello_timeout"] != float64(60000) || t1["secret"] != "<redacted>" {
+		t.Errorf("DumpJSON(): got tunnel %v", t1)
+	}
+
+	// The dump loads to the same configuration once the secrets are
+	// restored: keys are sorted, so the listener's is first
+	restored := strings.Replace(string(dump), `"secret": "<redacted>"`, `"secret": "branch"`, 1)
+	restored = strings.Replace(restored, `"secret": "<redacted>"`, `"secret": "hunter2"`, 1)
+	reloaded, err := LoadString(restored)
+	if err != nil {
+		t.Fatalf("LoadString(%s): %v", restored, err)
+	}
+	if !reflect.DeepEqual(reloaded.Tunnels, cfg.Tunnels) {
+		t.Errorf("LoadString(dump): got tunnels %+v, want %+v", reloaded.Tunnels, cfg.Tunnels)
+	}
+	if !reflect.DeepEqual(reloaded.Listeners, cfg.Listeners) {
+		t.Errorf("LoadString(dump): got listeners %+v, want %+v", reloaded.Listeners, cfg.Listeners)
+	}
+}
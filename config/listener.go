@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// NamedListener contains L2TP configuration for a listener instance.
+type NamedListener struct {
+	// The listener's name as specified in the config file.
+	Name string
+	// The listener L2TP configuration, which lists the configurations
+	// of tunnels accepted from particular peers in Config.PeerConfigs.
+	Config *l2tp.TunnelConfig
+}
+
+// listenerOnlyKeys lists the parameters which apply to a listener as
+// a whole, and so may not be set for particular peers.
+var listenerOnlyKeys = []string{
+	"local",
+	"encap",
+	"shared_socket",
+	"netns",
+	"sccrq_rate_limit",
+	"peer_sccrq_rate_limit",
+	"max_pending_tunnels",
+	"defer_tunnel_creation",
+	"allowed_peers",
+	"allowed_peer_host_names",
+	"reject_unauthorized_peers",
+}
+
+// peerTable is a per-peer table of a listener.
+type peerTable struct {
+	peer     string
+	prefix   *net.IPNet
+	hostName string
+	params   map[string]interface{}
+}
+
+func (cfg *Config) newListenerConfig(name string, lcfg map[string]interface{}) (*NamedListener, error) {
+	if _, ok := lcfg["session"]; ok {
+		return nil, fmt.Errorf("listeners may not set session")
+	}
+	params, err := cfg.tunnelProfiles.apply("tunnel_profile", lcfg["profile"], lcfg)
+	if err != nil {
+		return nil, err
+	}
+	params = applyDefaults(cfg.tunnelDefaults, params)
+
+	peers, err := loadPeerTables(params["peer"])
+	if err != nil {
+		return nil, err
+	}
+	delete(params, "peer")
+
+	nt, err := cfg.parseTunnel(name, params, &nilCustomParser{})
+	if err != nil {
+		return nil, err
+	}
+	nl := &NamedListener{Name: name, Config: nt.Config}
+	cfg.record(params, "listener", name)
+
+	for _, pt := range peers {
+		for _, key := range listenerOnlyKeys {
+			if _, ok := pt.params[key]; ok {
+				return nil, fmt.Errorf("peer %v: %v applies to the listener as a whole, so may not be set for a peer", pt.peer, key)
+			}
+		}
+		overrides, err := cfg.tunnelProfiles.apply("tunnel_profile", pt.params["profile"], pt.params)
+		if err != nil {
+			return nil, fmt.Errorf("peer %v: %v", pt.peer, err)
+		}
+		merged := make(map[string]interface{}, len(params)+len(overrides))
+		for k, v := range params {
+			merged[k] = v
+		}
+		for k, v := range overrides {
+			if k != "peer_host_name" {
+				merged[k] = v
+			}
+		}
+		pnt, err := cfg.parseTunnel(name, merged, &nilCustomParser{})
+		if err != nil {
+			return nil, fmt.Errorf("peer %v: %v", pt.peer, err)
+		}
+		cfg.record(overrides, "listener", name, "peer", pt.peer)
+		nl.Config.PeerConfigs = append(nl.Config.PeerConfigs, l2tp.PeerConfig{
+			Peer:     pt.peer,
+			HostName: pt.hostName,
+			Config:   pnt.Config,
+		})
+	}
+	return nl, nil
+}
+
+// loadPeerTables parses the per-peer tables of a listener, which are named
+// by the address or prefix of the peers they apply to.  The tables are
+// sorted so that the most specific match a peer first.
+func loadPeerTables(v interface{}) ([]peerTable, error) {
+	if v == nil {
+		return nil, nil
+	}
+	named, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("peer instances must be named by address or prefix, e.g. '[listener.mylistener.peer.\"192.0.2.0/24\"]'")
+	}
+	var out []peerTable
+	for peer, got := range named {
+		params, ok := got.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("peer instances must be named by address or prefix, e.g. '[listener.mylistener.peer.\"192.0.2.0/24\"]'")
+		}
+		var err error
+		pt := peerTable{peer: peer, params: params}
+		if ip := net.ParseIP(peer); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			pt.prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, pt.prefix, err = net.ParseCIDR(peer); err != nil {
+			return nil, fmt.Errorf("peer %v: expected an address or prefix", peer)
+		}
+		if v, ok := params["peer_host_name"]; ok {
+			if pt.hostName, err = toString(v); err != nil {
+				return nil, fmt.Errorf("peer %v: failed to process peer_host_name: %v", peer, err)
+			}
+		}
+		out = append(out, pt)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ones, _ := out[i].prefix.Mask.Size()
+		otherOnes, _ := out[j].prefix.Mask.Size()
+		if ones != otherOnes {
+			return ones > otherOnes
+		}
+		if (out[i].hostName != "") != (out[j].hostName != "") {
+			return out[i].hostName != ""
+		}
+		return out[i].peer < out[j].peer
+	})
+	return out, nil
+}
+
+func (cfg *Config) loadListeners(listeners map[string]interface{}) ([]NamedListener, error) {
+	var out []NamedListener
+
+	for name, got := range listeners {
+		lmap, ok := got.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("listener instances must be named, e.g. '[listener.mylistener]'")
+		}
+		lcfg, err := cfg.newListenerConfig(name, lmap)
+		if err != nil {
+			return nil, fmt.Errorf("listener %v: %v", name, err)
+		}
+		out = append(out, *lcfg)
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+func TestListeners(t *testing.T) {
+	cfg, err := LoadString(`
+		[tunnel_profile.lns]
+		secret = "default"
+		hello_timeout = 60000
+
+		[tunnel_profile.satellite]
+		retry_timeout = 4000
+
+		[listener.lns]
+		local = "0.0.0.0:1701"
+		profile = "lns"
+		allowed_peers = ["192.0.2.0/24", "198.51.100.7"]
+
+		[listener.lns.peer."192.0.2.0/24"]
+		secret = "branch"
+
+		[listener.lns.peer."192.0.2.9"]
+		profile = "satellite"
+
+		[listener.lns.peer."198.51.100.7"]
+		peer_host_name = "hq.example.com"
+		secret = "hq"
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+	if len(cfg.Listeners) != 1 {
+		t.Fatalf("LoadString(): got %v listeners, want 1", len(cfg.Listeners))
+	}
+	l := cfg.Listeners[0]
+	if l.Name != "lns" || l.Config.Local != "0.0.0.0:1701" || l.Config.Secret != "default" || len(l.Config.AllowedPeers) != 2 {
+		t.Errorf("listener: got %+v", l.Config)
+	}
+
+	want := []struct {
+		peer, hostName, secret string
+		retryTimeout           time.Duration
+	}{
+		{"198.51.100.7", "hq.example.com", "hq", 0},
+		{"192.0.2.9", "", "default", 4 * time.Second},
+		{"192.0.2.0/24", "", "branch", 0},
+	}
+	if len(l.Config.PeerConfigs) != len(want) {
+		t.Fatalf("listener: got %v peer configs, want %v", len(l.Config.PeerConfigs), len(want))
+	}
+	for i, w := range want {
+		pc := l.Config.PeerConfigs[i]
+		if pc.Peer != w.peer || pc.HostName != w.hostName || pc.Config.Secret != w.secret ||
+			pc.Config.RetryTimeout != w.retryTimeout || pc.Config.HelloTimeout != time.Minute {
+			t.Errorf("peer config %v: got %v %v %+v, want %+v", i, pc.Peer, pc.HostName, pc.Config, w)
+		}
+		if pc.Config.FramingCaps != l2tp.FramingCapSync|l2tp.FramingCapAsync {
+			t.Errorf("peer config %v: got framing caps %v", i, pc.Config.FramingCaps)
+		}
+	}
+}
+
+func TestBadListeners(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		estr string
+	}{
+		{
+			name: "Unnamed listener",
+			in:   `listener = 42`,
+			estr: "listener instances must be named",
+		},
+		{
+			name: "Listener with sessions",
+			in: `[listener.lns]
+				 [listener.lns.session.s1]`,
+			estr: "listeners may not set session",
+		},
+		{
+			name: "Bad peer",
+			in: `[listener.lns]
+				 [listener.lns.peer.banana]`,
+			estr: "expected an address or prefix",
+		},
+		{
+			name: "Listener parameter for peer",
+			in: `[listener.lns]
+				 [listener.lns.peer."192.0.2.1"]
+				 local = "0.0.0.0:1701"`,
+			estr: "applies to the listener as a whole",
+		},
+		{
+			name: "Unrecognised parameter",
+			in: `[listener.lns]
+				 monkey = "banana"`,
+			estr: "unrecognised parameter",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadString(tt.in)
+			if err == nil {
+				t.Fatalf("LoadString(%v) succeeded when we expected an error", tt.in)
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("LoadString(%v): error %q doesn't contain expected substring %q", tt.in, err, tt.estr)
+			}
+		})
+	}
+}
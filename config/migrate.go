@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SchemaVersion is the version of the configuration format implemented by
+// package config.  A configuration declares the version it was written for
+// using the top-level config_version parameter, and a configuration written
+// for an earlier version is migrated to the current format as it is loaded.
+const SchemaVersion = 1
+
+// migration describes the changes made to the configuration format by
+// a schema version, in terms of the tunnel and session parameters the
+// version renamed.
+type migration struct {
+	version                 int
+	tunnelKeys, sessionKeys map[string]string
+}
+
+// migrations lists the changes made by each schema version after the
+// first, in version order.
+var migrations []migration
+
+// migrate brings the parsed configuration map into line with the latest
+// schema version by applying the migrations for the versions after the one
+// the configuration was written for, recording a warning for each deprecated
+// parameter renamed.  Configurations without config_version are taken to have
+// been written for version 1.
+func (cfg *Config) migrate(latest int, migrations []migration) error {
+	cfg.Version = 1
+	if v, ok := cfg.Map["config_version"]; ok {
+		version, err := toUint16(v)
+		if err != nil {
+			return fmt.Errorf("failed to process config_version: %v", err)
+		}
+		if version < 1 || int(version) > latest {
+			return fmt.Errorf("config_version %v is not supported: the latest version is %v", version, latest)
+		}
+		cfg.Version = int(version)
+	}
+
+	for _, m := range migrations {
+		if m.version <= cfg.Version {
+			continue
+		}
+		for _, kind := range []string{"tunnel_profile", "session_profile"} {
+			keys := m.tunnelKeys
+			if kind == "session_profile" {
+				keys = m.sessionKeys
+			}
+			for name, table := range tables(cfg.Map[kind]) {
+				if err := cfg.rename(m.version, kind+" "+name, table, keys); err != nil {
+					return err
+				}
+			}
+		}
+		for lname, listener := range tables(cfg.Map["listener"]) {
+			if err := cfg.rename(m.version, "listener "+lname, listener, m.tunnelKeys); err != nil {
+				return err
+			}
+			for peer, table := range tables(listener["peer"]) {
+				where := "listener " + lname + " peer " + peer
+				if err := cfg.rename(m.version, where, table, m.tunnelKeys); err != nil {
+					return err
+				}
+			}
+		}
+		for tname, tunnel := range tables(cfg.Map["tunnel"]) {
+			if err := cfg.rename(m.version, "tunnel "+tname, tunnel, m.tunnelKeys); err != nil {
+				return err
+			}
+			for sname, session := range tables(tunnel["session"]) {
+				where := "tunnel " + tname + " session " + sname
+				if err := cfg.rename(m.version, where, session, m.sessionKeys); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	sort.Strings(cfg.Warnings)
+	return nil
+}
+
+// rename renames the deprecated parameters of a tunnel or session table.
+func (cfg *Config) rename(version int, where string, table map[string]interface{}, keys map[string]string) error {
+	for old, key := range keys {
+		v, ok := table[old]
+		if !ok {
+			continue
+		}
+		if _, ok := table[key]; ok {
+			return fmt.Errorf("%v: %v may not be set along with %v", where, old, key)
+		}
+		table[key] = v
+		delete(table, old)
+		cfg.Warnings = append(cfg.Warnings,
+			fmt.Sprintf("%v: %v is deprecated by config_version %v, use %v instead", where, old, version, key))
+	}
+	return nil
+}
+
+// tables returns the named tables of a parameter, ignoring anything else:
+// malformed tables are reported as the configuration is loaded.
+func tables(v interface{}) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	if named, ok := v.(map[string]interface{}); ok {
+		for name, got := range named {
+			if table, ok := got.(map[string]interface{}); ok {
+				out[name] = table
+			}
+		}
+	}
+	return out
+}
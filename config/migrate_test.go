@@ -0,0 +1,158 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+// testMigrations stands in for a future schema version renaming a tunnel
+// and a session parameter.
+var testMigrations = []migration{
+	{
+		version:     2,
+		tunnelKeys:  map[string]string{"hello": "hello_timeout"},
+		sessionKeys: map[string]string{"sequencing": "seqnum"},
+	},
+}
+
+func migrateString(t *testing.T, in string) (*Config, error) {
+	tree, err := toml.Load(in)
+	if err != nil {
+		t.Fatalf("toml.Load(): %v", err)
+	}
+	cfg := &Config{Map: tree.ToMap()}
+	return cfg, cfg.migrate(2, testMigrations)
+}
+
+func TestMigrate(t *testing.T) {
+	cfg, err := migrateString(t, `
+		[tunnel_profile.tp]
+		hello = 30
+		[session_profile.sp]
+		sequencing = true
+
+		[listener.l1]
+		hello = 10
+		[listener.l1.peer.p1]
+		hello = 20
+
+		[tunnel.t1]
+		hello = 40
+		[tunnel.t1.session.s1]
+		sequencing = true
+		[tunnel.t1.session.s2]
+		seqnum = false
+		`)
+	if err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+	if cfg.Version != 1 {
+		t.Errorf("migrate(): got version %v, want 1", cfg.Version)
+	}
+
+	tunnel := tables(cfg.Map["tunnel"])["t1"]
+	got := []interface{}{
+		tables(cfg.Map["tunnel_profile"])["tp"]["hello_timeout"],
+		tables(cfg.Map["session_profile"])["sp"]["seqnum"],
+		tables(cfg.Map["listener"])["l1"]["hello_timeout"],
+		tables(tables(cfg.Map["listener"])["l1"]["peer"])["p1"]["hello_timeout"],
+		tunnel["hello_timeout"],
+		tables(tunnel["session"])["s1"]["seqnum"],
+		tables(tunnel["session"])["s2"]["seqnum"],
+	}
+	want := []interface{}{int64(30), true, int64(10), int64(20), int64(40), true, false}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("migrate(): got parameters %v, want %v", got, want)
+			break
+		}
+	}
+
+	warnings := []string{
+		"listener l1 peer p1: hello is deprecated by config_version 2, use hello_timeout instead",
+		"listener l1: hello is deprecated by config_version 2, use hello_timeout instead",
+		"session_profile sp: sequencing is deprecated by config_version 2, use seqnum instead",
+		"tunnel t1 session s1: sequencing is deprecated by config_version 2, use seqnum instead",
+		"tunnel t1: hello is deprecated by config_version 2, use hello_timeout instead",
+		"tunnel_profile tp: hello is deprecated by config_version 2, use hello_timeout instead",
+	}
+	if strings.Join(cfg.Warnings, "\n") != strings.Join(warnings, "\n") {
+		t.Errorf("migrate(): got warnings %q, want %q", cfg.Warnings, warnings)
+	}
+
+	// Files declaring the latest version aren't migrated
+	cfg, err = migrateString(t, `
+		config_version = 2
+		[tunnel.t1]
+		[tunnel.t1.session.s1]
+		sequencing = true
+		`)
+	if err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+	session := tables(tables(cfg.Map["tunnel"])["t1"]["session"])["s1"]
+	if cfg.Version != 2 || len(cfg.Warnings) != 0 || session["sequencing"] != true {
+		t.Errorf("migrate(): got version %v, warnings %q, session %v", cfg.Version, cfg.Warnings, session)
+	}
+}
+
+func TestBadMigrate(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		estr string
+	}{
+		{
+			name: "Future version",
+			in:   `config_version = 3`,
+			estr: "not supported",
+		},
+		{
+			name: "Bad version",
+			in:   `config_version = "two"`,
+			estr: "failed to process config_version",
+		},
+		{
+			name: "Deprecated and current parameters",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 sequencing = true
+				 seqnum = false`,
+			estr: "may not be set along with",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := migrateString(t, tt.in)
+			if err == nil {
+				t.Fatalf("migrate(%v) succeeded when we expected an error", tt.in)
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("migrate(%v): error %q doesn't contain expected substring %q", tt.in, err, tt.estr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigVersion(t *testing.T) {
+	cfg, err := LoadString(`
+		config_version = 1
+		[tunnel.t1]
+		[tunnel.t1.session.s1]
+		seqnum = true
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+	if cfg.Version != SchemaVersion || len(cfg.Warnings) != 0 || !cfg.Tunnels[0].Sessions[0].Config.SeqNum {
+		t.Errorf("LoadString(): got version %v, warnings %q, session %+v",
+			cfg.Version, cfg.Warnings, cfg.Tunnels[0].Sessions[0].Config)
+	}
+
+	_, err = LoadString(`config_version = 2`)
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("LoadString(): got error %v, want config_version 2 to be unsupported", err)
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+)
+
+// profiles maps profile names to the parameters of each profile, which
+// supply defaults for the tunnels or sessions referencing the profile.
+type profiles map[string]map[string]interface{}
+
+func toProfiles(kind string, v interface{}) (profiles, error) {
+	tables, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v instances must be named, e.g. '[%v.myprofile]'", kind, kind)
+	}
+	out := make(profiles)
+	for name, got := range tables {
+		table, ok := got.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v instances must be named, e.g. '[%v.myprofile]'", kind, kind)
+		}
+		for _, key := range []string{"profile", "session"} {
+			if _, ok := table[key]; ok {
+				return nil, fmt.Errorf("%v %v: profiles may not set %v", kind, name, key)
+			}
+		}
+		out[name] = table
+	}
+	return out, nil
+}
+
+// apply returns the parameters of a tunnel or session table merged with
+// those of the named profile, with the table's parameters taking
+// precedence.  The table is returned unchanged if name is nil.
+func (p profiles) apply(kind string, name interface{}, table map[string]interface{}) (map[string]interface{}, error) {
+	if name == nil {
+		return table, nil
+	}
+	s, err := toString(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process profile: %v", err)
+	}
+	profile, ok := p[s]
+	if !ok {
+		return nil, fmt.Errorf("no %v named %q", kind, s)
+	}
+	merged := make(map[string]interface{}, len(profile)+len(table))
+	for k, v := range profile {
+		merged[k] = v
+	}
+	for k, v := range table {
+		if k != "profile" {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+func TestProfiles(t *testing.T) {
+	cfg, err := LoadString(`
+		[tunnel_profile.lns]
+		peer = "127.0.0.1:1701"
+		version = "l2tpv3"
+		hello_timeout = 500
+		session_profile = "eth"
+
+		[session_profile.eth]
+		pseudowire = "eth"
+		mtu = 1450
+
+		[session_profile.ppp]
+		pseudowire = "ppp"
+
+		[tunnel.t1]
+		profile = "lns"
+		hello_timeout = 1000
+		[tunnel.t1.session.s1]
+		[tunnel.t1.session.s2]
+		mtu = 1400
+		[tunnel.t1.session.s3]
+		profile = "ppp"
+
+		[tunnel.t2]
+		peer = "127.0.0.1:1702"
+		[tunnel.t2.session.s1]
+		profile = "ppp"
+		`)
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+
+	t1, err := cfg.findTunnelByName("t1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if t1.Config.Peer != "127.0.0.1:1701" || t1.Config.Version != l2tp.ProtocolVersion3 || t1.Config.HelloTimeout != time.Second {
+		t.Errorf("tunnel t1: got %+v, want profile with hello_timeout overridden", t1.Config)
+	}
+	want := map[string]struct {
+		pw  l2tp.PseudowireType
+		mtu uint16
+	}{
+		"s1": {l2tp.PseudowireTypeEth, 1450},
+		"s2": {l2tp.PseudowireTypeEth, 1400},
+		"s3": {l2tp.PseudowireTypePPP, 0},
+	}
+	for _, s := range t1.Sessions {
+		w := want[s.Name]
+		if s.Config.Pseudowire != w.pw || s.Config.MTU != w.mtu {
+			t.Errorf("session %v: got pseudowire %v mtu %v, want %v %v", s.Name, s.Config.Pseudowire, s.Config.MTU, w.pw, w.mtu)
+		}
+	}
+
+	t2, err := cfg.findTunnelByName("t2")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if t2.Config.Version != 0 || t2.Sessions[0].Config.Pseudowire != l2tp.PseudowireTypePPP {
+		t.Errorf("tunnel t2: got %+v, %+v", t2.Config, t2.Sessions[0].Config)
+	}
+}
+
+func TestBadProfiles(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		estr string
+	}{
+		{
+			name: "Missing profile",
+			in: `[tunnel.t1]
+				 profile = "lns"`,
+			estr: `no tunnel_profile named "lns"`,
+		},
+		{
+			name: "Missing session profile",
+			in: `[tunnel.t1]
+				 session_profile = "subscriber"
+				 [tunnel.t1.session.s1]`,
+			estr: `no session_profile named "subscriber"`,
+		},
+		{
+			name: "Nested profile",
+			in: `[tunnel_profile.a]
+				 profile = "b"`,
+			estr: "profiles may not set profile",
+		},
+		{
+			name: "Profile with sessions",
+			in: `[tunnel_profile.a]
+				 [tunnel_profile.a.session.s1]`,
+			estr: "profiles may not set session",
+		},
+		{
+			name: "Bad profile parameter",
+			in: `[session_profile.a]
+				 monkey = "banana"
+				 [tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 profile = "a"`,
+			estr: "unrecognised parameter",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadString(tt.in)
+			if err == nil {
+				t.Fatalf("LoadString(%v) succeeded when we expected an error", tt.in)
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("LoadString(%v): error %q doesn't contain expected substring %q", tt.in, err, tt.estr)
+			}
+		})
+	}
+}
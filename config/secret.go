@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile reads a secret from the file at path, such as a
+// credential provided by a container runtime or service manager, so that
+// the secret needn't be kept in the configuration file.  Trailing newlines
+// are removed from the file contents.
+func ReadSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %v is empty", path)
+	}
+	return secret, nil
+}
+
+// ReadSecretEnv reads a secret from the environment variable name, so that
+// the secret needn't be kept in the configuration file.
+func ReadSecretEnv(name string) (string, error) {
+	secret := os.Getenv(name)
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %v is unset or empty", name)
+	}
+	return secret, nil
+}
+
+// toSecret parses a secret set by a parameter, which is read from a file
+// for parameters named with a _file suffix, or from an environment variable
+// for parameters named with an _env suffix.
+func toSecret(key string, v interface{}) (string, error) {
+	s, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(key, "_file"):
+		return ReadSecretFile(s)
+	case strings.HasSuffix(key, "_env"):
+		return ReadSecretEnv(s)
+	}
+	return s, nil
+}
+
+// secretSources records the parameters secrets are set by, so that each
+// secret is set by one parameter only.
+type secretSources map[string]string
+
+func (ss secretSources) set(key string) error {
+	secret := strings.TrimSuffix(strings.TrimSuffix(key, "_file"), "_env")
+	if other, ok := ss[secret]; ok {
+		return fmt.Errorf("%v may not be set along with %v", key, other)
+	}
+	ss[secret] = key
+	return nil
+}
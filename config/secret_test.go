@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lns")
+	if err = ioutil.WriteFile(path, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err = ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	os.Setenv("GO_L2TP_TEST_SECRET", "correct horse battery staple")
+	defer os.Unsetenv("GO_L2TP_TEST_SECRET")
+
+	cfg, err := LoadString(fmt.Sprintf(`[tunnel.t1]
+		secret_file = %q
+		alternate_secret_env = "GO_L2TP_TEST_SECRET"`, path))
+	if err != nil {
+		t.Fatalf("LoadString(): %v", err)
+	}
+	tcfg := cfg.Tunnels[0].Config
+	if tcfg.Secret != "hunter2" || tcfg.AlternateSecret != "correct horse battery staple" {
+		t.Errorf("LoadString(): got secrets %q and %q", tcfg.Secret, tcfg.AlternateSecret)
+	}
+
+	cases := []struct {
+		name string
+		in   string
+		estr string
+	}{
+		{
+			name: "Missing file",
+			in:   fmt.Sprintf(`secret_file = %q`, filepath.Join(dir, "missing")),
+			estr: "failed to read secret file",
+		},
+		{
+			name: "Empty file",
+			in:   fmt.Sprintf(`secret_file = %q`, empty),
+			estr: "is empty",
+		},
+		{
+			name: "Unset environment variable",
+			in:   `secret_env = "GO_L2TP_TEST_UNSET"`,
+			estr: "unset or empty",
+		},
+		{
+			name: "Conflicting sources",
+			in: `secret = "hunter2"
+				 secret_env = "GO_L2TP_TEST_SECRET"`,
+			estr: "may not be set along with",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadString("[tunnel.t1]\n" + tt.in)
+			if err == nil {
+				t.Fatalf("LoadString(%v) succeeded when we expected an error", tt.in)
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("LoadString(%v): error %q doesn't contain expected substring %q", tt.in, err, tt.estr)
+			}
+		})
+	}
+}
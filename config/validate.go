@@ -0,0 +1,260 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// ValidationError describes a problem with a tunnel or session
+// configuration found by Validate.
+type ValidationError struct {
+	// File is the path of the configuration file, if it was loaded from
+	// a file.
+	File string
+	// Line and Column locate the parameter, or else the table, at fault
+	// in the configuration.  They are zero if the location is unknown.
+	Line, Column int
+	// Tunnel names the tunnel at fault.
+	Tunnel string
+	// Session names the session at fault, or is empty for problems with
+	// the tunnel configuration.
+	Session string
+	// Key names the parameter at fault, or is empty for problems which
+	// don't lie with a single parameter.
+	Key string
+	// Message describes the problem.
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	var where []string
+	switch {
+	case e.File != "" && e.Line != 0:
+		where = append(where, fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column))
+	case e.File != "":
+		where = append(where, e.File)
+	case e.Line != 0:
+		where = append(where, fmt.Sprintf("line %d, column %d", e.Line, e.Column))
+	}
+	where = append(where, fmt.Sprintf("tunnel %v", e.Tunnel))
+	if e.Session != "" {
+		where = append(where, fmt.Sprintf("session %v", e.Session))
+	}
+	if e.Key != "" {
+		where = append(where, e.Key)
+	}
+	return fmt.Sprintf("%s: %s", strings.Join(where, ": "), e.Message)
+}
+
+// ValidationErrors is the error returned by Validate, listing each problem
+// found in the configuration.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the tunnel and session configurations for problems which
+// would prevent the instances from being created, or would have them
+// conflict with one another once created: duplicate tunnel or session IDs
+// and interface names, pseudowire types and parameters unsupported by the
+// tunnel's protocol version, and parameters which require a secret when
+// none is set.
+//
+// Validate checks only what may be determined from the configuration
+// itself, so isn't a guarantee that creating the instances will succeed.
+// Problems are reported as ValidationErrors, in which each error locates
+// the problem in the configuration file.
+func (cfg *Config) Validate() error {
+	v := validator{cfg: cfg}
+
+	tids := make(map[l2tp.ControlConnID]string)
+	// L2TPv3 session IDs are shared by all tunnels, while L2TPv2 session
+	// IDs are scoped by their tunnel
+	v3sids := make(map[l2tp.ControlConnID]string)
+	ifnames := make(map[string]string)
+
+	// Tunnels and sessions are checked in order of name, so that the
+	// same configuration always reports the same conflicts
+	tunnels := append([]NamedTunnel(nil), cfg.Tunnels...)
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+
+	for _, t := range tunnels {
+		v.checkTunnel(&t)
+
+		if id := t.Config.TunnelID; id != 0 {
+			if other, ok := tids[id]; ok {
+				v.fail(&t, nil, "tid", "tunnel ID %v is also used by tunnel %v", id, other)
+			} else {
+				tids[id] = t.Name
+			}
+		}
+
+		sessions := append([]NamedSession(nil), t.Sessions...)
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+
+		v2sids := make(map[l2tp.ControlConnID]string)
+		for _, s := range sessions {
+			v.checkSession(&t, &s)
+
+			if id := s.Config.SessionID; id != 0 {
+				sids, owner := v2sids, s.Name
+				if t.Config.Version == l2tp.ProtocolVersion3 {
+					sids, owner = v3sids, fmt.Sprintf("%v in tunnel %v", s.Name, t.Name)
+				}
+				if other, ok := sids[id]; ok {
+					v.fail(&t, &s, "sid", "session ID %v is also used by session %v", id, other)
+				} else {
+					sids[id] = owner
+				}
+			}
+
+			// Templated interface names are expanded when the session
+			// is created, so can't conflict
+			if name := s.Config.InterfaceName; name != "" && !strings.Contains(name, "%") {
+				owner := fmt.Sprintf("%v in tunnel %v", s.Name, t.Name)
+				if other, ok := ifnames[name]; ok {
+					v.fail(&t, &s, "interface_name", "interface name %q is also used by session %v", name, other)
+				} else {
+					ifnames[name] = owner
+				}
+			}
+		}
+	}
+
+	if len(v.errs) > 0 {
+		sort.SliceStable(v.errs, func(i, j int) bool {
+			a, b := v.errs[i], v.errs[j]
+			return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+		})
+		return v.errs
+	}
+	return nil
+}
+
+// validator accumulates the errors found by Validate.
+type validator struct {
+	cfg  *Config
+	errs ValidationErrors
+}
+
+// fail records a problem with a tunnel, or with a session if s is set.
+func (v *validator) fail(t *NamedTunnel, s *NamedSession, key, format string, args ...interface{}) {
+	err := &ValidationError{
+		File:    v.cfg.path,
+		Tunnel:  t.Name,
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	}
+	path := []string{"tunnel", t.Name}
+	if s != nil {
+		err.Session = s.Name
+		path = append(path, "session", s.Name)
+	}
+	if v.cfg.tree != nil {
+		pos := v.cfg.tree.GetPositionPath(path)
+		if key != "" {
+			if kpos := v.cfg.tree.GetPositionPath(append(path, key)); !kpos.Invalid() {
+				pos = kpos
+			}
+		}
+		if !pos.Invalid() {
+			err.Line, err.Column = pos.Line, pos.Col
+		}
+	}
+	v.errs = append(v.errs, err)
+}
+
+func (v *validator) checkTunnel(t *NamedTunnel) {
+	cfg := t.Config
+	if cfg.Encap == l2tp.EncapTypeIP && cfg.Version == l2tp.ProtocolVersion2 {
+		v.fail(t, nil, "encap", "IP encapsulation is supported for L2TPv3 tunnels only")
+	}
+	if cfg.Version == l2tp.ProtocolVersion2 {
+		if cfg.TunnelID > 65535 {
+			v.fail(t, nil, "tid", "L2TPv2 tunnel ID %v out of range", cfg.TunnelID)
+		}
+		if cfg.PeerTunnelID > 65535 {
+			v.fail(t, nil, "ptid", "L2TPv2 peer tunnel ID %v out of range", cfg.PeerTunnelID)
+		}
+	}
+	if cfg.Secret == "" {
+		if cfg.AlternateSecret != "" {
+			v.fail(t, nil, "alternate_secret", "alternate secret requires a secret")
+		}
+		if cfg.ChallengeLength != 0 {
+			v.fail(t, nil, "challenge_length", "challenge length requires a secret")
+		}
+	}
+}
+
+func (v *validator) checkSession(t *NamedTunnel, s *NamedSession) {
+	tcfg, cfg := t.Config, s.Config
+
+	pw := cfg.Pseudowire
+	if pw == 0 {
+		pw = l2tp.PseudowireTypePPP
+	}
+	switch tcfg.Version {
+	case l2tp.ProtocolVersion2:
+		if pw != l2tp.PseudowireTypePPP {
+			v.fail(t, s, "pseudowire", "L2TPv2 supports PPP pseudowires only, not %v", pw)
+		}
+		if len(cfg.PseudowireFallback) > 0 {
+			v.fail(t, s, "pseudowire_fallback", "pseudowire fallback is supported for L2TPv3 sessions only")
+		}
+		if len(cfg.Cookie) > 0 {
+			v.fail(t, s, "cookie", "cookies are supported for L2TPv3 sessions only")
+		}
+		if len(cfg.PeerCookie) > 0 {
+			v.fail(t, s, "peer_cookie", "cookies are supported for L2TPv3 sessions only")
+		}
+		if cfg.L2SpecType != l2tp.L2SpecTypeNone {
+			v.fail(t, s, "l2spec_type", "layer 2 specific sublayer is supported for L2TPv3 sessions only")
+		}
+		if cfg.SessionID > 65535 {
+			v.fail(t, s, "sid", "L2TPv2 session ID %v out of range", cfg.SessionID)
+		}
+		if cfg.PeerSessionID > 65535 {
+			v.fail(t, s, "psid", "L2TPv2 peer session ID %v out of range", cfg.PeerSessionID)
+		}
+	}
+	if tcfg.Version == l2tp.ProtocolVersion3 && len(tcfg.PseudowireCaps) > 0 {
+		for _, p := range append([]l2tp.PseudowireType{pw}, cfg.PseudowireFallback...) {
+			if !hasPseudowire(tcfg.PseudowireCaps, p) {
+				v.fail(t, s, "pseudowire", "pseudowire type %v is not among the tunnel's pseudowire_caps", p)
+			}
+		}
+	}
+	if cfg.BundleID != "" && pw != l2tp.PseudowireTypePPP {
+		v.fail(t, s, "bundle_id", "bundle ID is supported for PPP pseudowires only")
+	}
+	if len(cfg.HardwareAddr) > 0 && pw != l2tp.PseudowireTypeEth && pw != l2tp.PseudowireTypeEthVLAN {
+		v.fail(t, s, "hardware_addr", "hardware address is supported for Ethernet pseudowires only")
+	}
+	if l := len(cfg.Cookie); l != 0 && l != 4 && l != 8 {
+		v.fail(t, s, "cookie", "cookie length must be 4 or 8 bytes, not %v", l)
+	}
+	if l := len(cfg.PeerCookie); l != 0 && l != 4 && l != 8 {
+		v.fail(t, s, "peer_cookie", "cookie length must be 4 or 8 bytes, not %v", l)
+	}
+	if cfg.Static && (cfg.SessionID == 0 || cfg.PeerSessionID == 0) {
+		v.fail(t, s, "static", "static sessions require sid and psid to be set")
+	}
+}
+
+func hasPseudowire(caps []l2tp.PseudowireType, pw l2tp.PseudowireType) bool {
+	for _, p := range caps {
+		if p == pw {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		// want lists the expected errors as "line:key"
+		want []string
+	}{
+		{
+			name: "Valid",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 tid = 1
+				 secret = "s3cret"
+				 challenge_length = 16
+				 [tunnel.t1.session.s1]
+				 sid = 1
+				 pseudowire = "eth"
+				 interface_name = "l2tpeth0"
+				 [tunnel.t1.session.s2]
+				 sid = 2
+				 pseudowire = "eth"
+				 interface_name = "l2tpeth%d"
+				 [tunnel.t2]
+				 version = "l2tpv2"
+				 tid = 2
+				 [tunnel.t2.session.s1]
+				 sid = 1
+				 interface_name = "l2tpeth%d"`,
+		},
+		{
+			name: "Duplicate IDs",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 tid = 1
+				 [tunnel.t1.session.s1]
+				 sid = 7
+				 pseudowire = "eth"
+				 [tunnel.t2]
+				 version = "l2tpv3"
+				 tid = 1
+				 [tunnel.t2.session.s1]
+				 sid = 7
+				 pseudowire = "eth"`,
+			want: []string{"9:tid", "11:sid"},
+		},
+		{
+			name: "Duplicate interface names",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 pseudowire = "eth"
+				 interface_name = "l2tpeth0"
+				 [tunnel.t1.session.s2]
+				 pseudowire = "eth"
+				 interface_name = "l2tpeth0"`,
+			want: []string{"8:interface_name"},
+		},
+		{
+			name: "Pseudowire unsupported by version",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 [tunnel.t1.session.s1]
+				 pseudowire = "eth"
+				 cookie = [ 0x12, 0x34, 0x56, 0x78 ]`,
+			want: []string{"4:pseudowire", "5:cookie"},
+		},
+		{
+			name: "Pseudowire not advertised",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 pseudowire_caps = [ "ppp" ]
+				 [tunnel.t1.session.s1]
+				 pseudowire = "eth"`,
+			want: []string{"5:pseudowire"},
+		},
+		{
+			name: "IP pseudowire hardware address",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 pseudowire = "ip"
+				 hardware_addr = "02:00:5e:10:20:30"`,
+			want: []string{"5:hardware_addr"},
+		},
+		{
+			name: "Missing secret",
+			in: `[tunnel.t1]
+				 version = "l2tpv2"
+				 alternate_secret = "old"
+				 challenge_length = 16`,
+			want: []string{"3:alternate_secret", "4:challenge_length"},
+		},
+		{
+			name: "Static session without IDs",
+			in: `[tunnel.t1]
+				 version = "l2tpv3"
+				 [tunnel.t1.session.s1]
+				 pseudowire = "eth"
+				 static = true`,
+			want: []string{"5:static"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadString(tt.in)
+			if err != nil {
+				t.Fatalf("LoadString(%v): %v", tt.in, err)
+			}
+			err = cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate(): %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ValidationErrors)
+			if !ok {
+				t.Fatalf("Validate(): got %v, want ValidationErrors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, fmt.Sprintf("%d:%s", e.Line, e.Key))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Validate(): got %v, want %v\n%v", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "validate*.toml")
+	if err != nil {
+		t.Fatalf("TempFile(): %v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("[tunnel.t1]\nversion = \"l2tpv2\"\ntid = 70000\n")
+	file.Close()
+	if err != nil {
+		t.Fatalf("WriteString(): %v", err)
+	}
+
+	cfg, err := LoadFile(file.Name())
+	if err != nil {
+		t.Fatalf("LoadFile(): %v", err)
+	}
+	err = cfg.Validate()
+	want := file.Name() + ":3:1: tunnel t1: tid: L2TPv2 tunnel ID 70000 out of range"
+	if err == nil || err.Error() != want {
+		t.Errorf("Validate(): got %v, want %v", err, want)
+	}
+}
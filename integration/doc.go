@@ -0,0 +1,17 @@
+/*
+Package integration contains end-to-end tests which run go-l2tp against the
+Linux kernel L2TP data plane.
+
+Each test creates a pair of network namespaces joined by a veth link, brings
+up an L2TP endpoint in each namespace, and pushes traffic through the
+resulting sessions, checking the kernel's packet counters afterwards.
+
+The tests require root permissions, iproute2, and the kernel L2TP modules
+(l2tp_netlink, l2tp_ip, l2tp_ip6, l2tp_eth and l2tp_ppp).  They are built
+only when the integration build tag is set:
+
+	go test -exec sudo -tags integration -v ./integration
+
+This package contains no code other than the tests.
+*/
+package integration
@@ -0,0 +1,357 @@
+// +build integration
+
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+// pxProtoOL2TP is the PPPoX protocol for PPP over L2TP sockets
+const pxProtoOL2TP = 1
+
+// endpoint is one end of an L2TP connection, running in a network namespace.
+type endpoint struct {
+	ctx     *l2tp.Context
+	tunl    l2tp.Tunnel
+	ifnames chan string
+}
+
+func (ep *endpoint) HandleEvent(event interface{}) {
+	if ev, ok := event.(*l2tp.SessionUpEvent); ok {
+		ep.ifnames <- ev.InterfaceName
+	}
+}
+
+// newEndpoint creates a tunnel and session in the namespace of endpoint i
+// of the test network.  The tunnel is quiescent if the configuration sets
+// a hello timeout, and static otherwise.
+func newEndpoint(n *testNetwork, i int, tcfg *l2tp.TunnelConfig, scfg *l2tp.SessionConfig) (ep *endpoint, err error) {
+	ep = &endpoint{
+		ifnames: make(chan string, 1),
+	}
+	err = n.do(i, func() error {
+		logger := level.NewFilter(
+			log.With(log.NewLogfmtLogger(os.Stderr), "namespace", n.ns[i]),
+			level.AllowDebug(), level.AllowInfo())
+
+		ep.ctx, err = l2tp.NewContext(l2tp.LinuxNetlinkDataPlane, logger)
+		if err != nil {
+			return fmt.Errorf("NewContext(): %v", err)
+		}
+		ep.ctx.RegisterEventHandler(ep)
+
+		if tcfg.HelloTimeout > 0 {
+			ep.tunl, err = ep.ctx.NewQuiescentTunnel("t1", tcfg)
+		} else {
+			ep.tunl, err = ep.ctx.NewStaticTunnel("t1", tcfg)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel %v: %v", tcfg, err)
+		}
+
+		_, err = ep.tunl.NewSession("s1", scfg)
+		if err != nil {
+			return fmt.Errorf("NewSession(%v): %v", scfg, err)
+		}
+		return nil
+	})
+	if err != nil && ep.ctx != nil {
+		ep.ctx.Close()
+	}
+	return ep, err
+}
+
+func (ep *endpoint) interfaceName(t *testing.T) string {
+	select {
+	case ifname := <-ep.ifnames:
+		return ifname
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for session up event")
+	}
+	return ""
+}
+
+func (ep *endpoint) close() {
+	ep.ctx.Close()
+}
+
+// newEndpointConfigs returns tunnel and session configuration for both ends
+// of a connection across the test network.  The session cookies configured
+// are those of endpoint 0, and are swapped for endpoint 1.
+func newEndpointConfigs(n *testNetwork, tcfg l2tp.TunnelConfig, scfg l2tp.SessionConfig) (
+	tcfgs [2]*l2tp.TunnelConfig, scfgs [2]*l2tp.SessionConfig) {
+	for i := range tcfgs {
+		tc, sc := tcfg, scfg
+		tc.Local = n.hostPort(i, 1701)
+		tc.Peer = n.hostPort(1-i, 1701)
+		tc.TunnelID = l2tp.ControlConnID(100 + i)
+		tc.PeerTunnelID = l2tp.ControlConnID(100 + 1 - i)
+		sc.SessionID = l2tp.ControlConnID(200 + i)
+		sc.PeerSessionID = l2tp.ControlConnID(200 + 1 - i)
+		if i == 1 {
+			sc.Cookie, sc.PeerCookie = scfg.PeerCookie, scfg.Cookie
+		}
+		tcfgs[i], scfgs[i] = &tc, &sc
+	}
+	return
+}
+
+func requireRoot(t *testing.T) {
+	user, err := user.Current()
+	if err != nil {
+		t.Fatalf("Unable to obtain current user: %q", err)
+	}
+	if user.Uid != "0" {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+}
+
+func TestL2TPv3Ethernet(t *testing.T) {
+	requireRoot(t)
+
+	cases := []struct {
+		name string
+		ipv6 bool
+		tcfg l2tp.TunnelConfig
+		scfg l2tp.SessionConfig
+	}{
+		{
+			name: "UDP AF_INET",
+			tcfg: l2tp.TunnelConfig{
+				Encap:        l2tp.EncapTypeUDP,
+				HelloTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			name: "UDP AF_INET6",
+			ipv6: true,
+			tcfg: l2tp.TunnelConfig{
+				Encap:        l2tp.EncapTypeUDP,
+				HelloTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			name: "IP AF_INET",
+			tcfg: l2tp.TunnelConfig{
+				Encap:        l2tp.EncapTypeIP,
+				HelloTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			name: "IP AF_INET6",
+			ipv6: true,
+			tcfg: l2tp.TunnelConfig{
+				Encap:        l2tp.EncapTypeIP,
+				HelloTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			name: "UDP AF_INET (static, cookies)",
+			tcfg: l2tp.TunnelConfig{
+				Encap: l2tp.EncapTypeUDP,
+			},
+			scfg: l2tp.SessionConfig{
+				Cookie:     []byte{0x12, 0xe9, 0x54, 0x0f},
+				PeerCookie: []byte{0x74, 0x2e, 0x28, 0xa8, 0x61, 0x07, 0xc3, 0x19},
+			},
+		},
+		{
+			name: "IP AF_INET6 (static, cookies)",
+			ipv6: true,
+			tcfg: l2tp.TunnelConfig{
+				Encap: l2tp.EncapTypeIP,
+			},
+			scfg: l2tp.SessionConfig{
+				Cookie:     []byte{0x12, 0xe9, 0x54, 0x0f, 0xe2, 0x68, 0x72, 0xbc},
+				PeerCookie: []byte{0x74, 0x2e, 0x28, 0xa8},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := newTestNetwork(t, c.ipv6)
+			defer n.close()
+
+			c.tcfg.Version = l2tp.ProtocolVersion3
+			c.scfg.Pseudowire = l2tp.PseudowireTypeEth
+			tcfgs, scfgs := newEndpointConfigs(n, c.tcfg, c.scfg)
+
+			var ifnames [2]string
+			for i := range n.ns {
+				ep, err := newEndpoint(n, i, tcfgs[i], scfgs[i])
+				if err != nil {
+					t.Fatalf("failed to create endpoint in %v: %v", n.ns[i], err)
+				}
+				defer ep.close()
+
+				ifnames[i] = ep.interfaceName(t)
+				runIP(t, "-n", n.ns[i], "addr", "add", fmt.Sprintf("10.88.0.%d/24", i+1), "dev", ifnames[i])
+				runIP(t, "-n", n.ns[i], "link", "set", ifnames[i], "up")
+			}
+
+			n.exec(t, 0, "ping", "-c", "5", "-i", "0.2", "-W", "2", "10.88.0.2")
+
+			for i := range n.ns {
+				for _, counter := range []string{"tx_packets", "rx_packets"} {
+					v := n.linkCounter(t, i, ifnames[i], counter)
+					if v < 5 {
+						t.Errorf("%v %v %v: got %v, want at least 5", n.ns[i], ifnames[i], counter, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+// pppol2tpStats mirrors the kernel's struct pppol2tp_ioc_stats
+type pppol2tpStats struct {
+	tunnelID, sessionID          uint16
+	usingIPSec                   uint32
+	txPackets, txBytes, txErrors uint64
+	rxPackets, rxBytes           uint64
+	rxSeqDiscards, rxOOSPackets  uint64
+	rxErrors                     uint64
+}
+
+// newPPPoL2TP opens a PPPoL2TP socket for the session described by the
+// configuration.  The socket isn't attached to a PPP channel, so PPP frames
+// for the session are read and written using the socket directly.
+//
+// It must be called from the namespace the session was created in.
+func newPPPoL2TP(tcfg *l2tp.TunnelConfig, scfg *l2tp.SessionConfig) (int, error) {
+	fd, err := unix.Socket(unix.AF_PPPOX, unix.SOCK_DGRAM, pxProtoOL2TP)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open pppox socket: %v", err)
+	}
+
+	// struct sockaddr_pppol2tp is packed, so build it by hand:
+	// sa_family, sa_protocol, then struct pppol2tp_addr of pid, fd,
+	// struct sockaddr_in addr and the four 16 bit tunnel and session IDs.
+	var sa [38]byte
+	*(*uint16)(unsafe.Pointer(&sa[0])) = unix.AF_PPPOX
+	*(*uint32)(unsafe.Pointer(&sa[2])) = pxProtoOL2TP
+	*(*int32)(unsafe.Pointer(&sa[10])) = -1
+	*(*uint16)(unsafe.Pointer(&sa[30])) = uint16(tcfg.TunnelID)
+	*(*uint16)(unsafe.Pointer(&sa[32])) = uint16(scfg.SessionID)
+	*(*uint16)(unsafe.Pointer(&sa[34])) = uint16(tcfg.PeerTunnelID)
+	*(*uint16)(unsafe.Pointer(&sa[36])) = uint16(scfg.PeerSessionID)
+
+	_, _, errno := unix.Syscall(unix.SYS_CONNECT,
+		uintptr(fd), uintptr(unsafe.Pointer(&sa[0])), uintptr(len(sa)))
+	if errno != 0 {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to connect pppox socket: %v", errno)
+	}
+
+	tv := unix.NsecToTimeval(int64(2 * time.Second))
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func getPPPoL2TPStats(fd int) (*pppol2tpStats, error) {
+	var stats pppol2tpStats
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL,
+		uintptr(fd), uintptr(unix.PPPIOCGL2TPSTATS), uintptr(unsafe.Pointer(&stats)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &stats, nil
+}
+
+func TestL2TPv2PPP(t *testing.T) {
+	requireRoot(t)
+
+	cases := []struct {
+		name string
+		ipv6 bool
+	}{
+		{
+			name: "UDP AF_INET",
+		},
+		{
+			name: "UDP AF_INET6",
+			ipv6: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := newTestNetwork(t, c.ipv6)
+			defer n.close()
+
+			tcfgs, scfgs := newEndpointConfigs(n,
+				l2tp.TunnelConfig{
+					Version:      l2tp.ProtocolVersion2,
+					Encap:        l2tp.EncapTypeUDP,
+					HelloTimeout: 250 * time.Millisecond,
+				},
+				l2tp.SessionConfig{
+					Pseudowire: l2tp.PseudowireTypePPP,
+				})
+
+			var fds [2]int
+			for i := range n.ns {
+				ep, err := newEndpoint(n, i, tcfgs[i], scfgs[i])
+				if err != nil {
+					t.Fatalf("failed to create endpoint in %v: %v", n.ns[i], err)
+				}
+				defer ep.close()
+
+				err = n.do(i, func() (err error) {
+					fds[i], err = newPPPoL2TP(tcfgs[i], scfgs[i])
+					return
+				})
+				if err != nil {
+					t.Fatalf("newPPPoL2TP in %v: %v", n.ns[i], err)
+				}
+				defer unix.Close(fds[i])
+			}
+
+			// LCP echo request frames, sent in each direction
+			const count = 5
+			for i := 0; i < count; i++ {
+				for j := range fds {
+					frame := []byte{0xc0, 0x21, 0x09, byte(i), 0x00, 0x08, 0x00, 0x00, 0x00, byte(j)}
+					_, err := unix.Write(fds[j], frame)
+					if err != nil {
+						t.Fatalf("write to %v: %v", n.ns[j], err)
+					}
+
+					b := make([]byte, 1500)
+					nb, err := unix.Read(fds[1-j], b)
+					if err != nil {
+						t.Fatalf("read from %v: %v", n.ns[1-j], err)
+					}
+					if !bytes.Equal(b[:nb], frame) {
+						t.Fatalf("read from %v: got %x, want %x", n.ns[1-j], b[:nb], frame)
+					}
+				}
+			}
+
+			for i, fd := range fds {
+				stats, err := getPPPoL2TPStats(fd)
+				if err != nil {
+					t.Fatalf("failed to read session statistics in %v: %v", n.ns[i], err)
+				}
+				if stats.txPackets < count || stats.rxPackets < count {
+					t.Errorf("%v session statistics: got tx %v rx %v, want at least %v",
+						n.ns[i], stats.txPackets, stats.rxPackets, count)
+				}
+			}
+		})
+	}
+}
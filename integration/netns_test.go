@@ -0,0 +1,125 @@
+// +build integration
+
+package integration
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testNetwork is a pair of network namespaces joined by a veth link.
+type testNetwork struct {
+	ns   [2]string
+	addr [2]string
+}
+
+// newTestNetwork creates the namespaces for a test network.
+// If ipv6 is set the veth link is addressed using IPv6, otherwise IPv4.
+func newTestNetwork(t *testing.T, ipv6 bool) *testNetwork {
+	n := &testNetwork{
+		ns:   [2]string{"l2tp-it-a", "l2tp-it-b"},
+		addr: [2]string{"10.87.0.1", "10.87.0.2"},
+	}
+	prefix := "/24"
+	if ipv6 {
+		n.addr = [2]string{"fd87::1", "fd87::2"}
+		prefix = "/64"
+	}
+
+	// Clean up anything left over from an earlier failed run
+	n.close()
+
+	for _, ns := range n.ns {
+		runIP(t, "netns", "add", ns)
+		runIP(t, "-n", ns, "link", "set", "lo", "up")
+	}
+	runIP(t, "link", "add", "veth0", "netns", n.ns[0],
+		"type", "veth", "peer", "name", "veth0", "netns", n.ns[1])
+	for i, ns := range n.ns {
+		args := []string{"-n", ns, "addr", "add", n.addr[i] + prefix, "dev", "veth0"}
+		if ipv6 {
+			args = append(args, "nodad")
+		}
+		runIP(t, args...)
+		runIP(t, "-n", ns, "link", "set", "veth0", "up")
+	}
+	return n
+}
+
+// close removes the namespaces, along with any interfaces in them.
+func (n *testNetwork) close() {
+	for _, ns := range n.ns {
+		_ = exec.Command("ip", "netns", "del", ns).Run()
+	}
+}
+
+// hostPort returns the address of endpoint i with the specified port.
+func (n *testNetwork) hostPort(i int, port int) string {
+	if strings.Contains(n.addr[i], ":") {
+		return fmt.Sprintf("[%s]:%d", n.addr[i], port)
+	}
+	return fmt.Sprintf("%s:%d", n.addr[i], port)
+}
+
+// do calls fn from a thread running in the namespace of endpoint i.
+//
+// Sockets are bound to the namespace they are created in, so L2TP
+// contexts, tunnels and sessions created by fn remain in the namespace
+// after fn returns.
+func (n *testNetwork) do(i int, fn func() error) error {
+	errChan := make(chan error)
+	go func() {
+		// The thread isn't unlocked, so it is discarded when the
+		// goroutine exits rather than being reused in the wrong namespace.
+		runtime.LockOSThread()
+		errChan <- func() error {
+			f, err := os.Open(filepath.Join("/var/run/netns", n.ns[i]))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			err = unix.Setns(int(f.Fd()), unix.CLONE_NEWNET)
+			if err != nil {
+				return fmt.Errorf("failed to enter namespace %v: %v", n.ns[i], err)
+			}
+			return fn()
+		}()
+	}()
+	return <-errChan
+}
+
+// exec runs a command in the namespace of endpoint i.
+func (n *testNetwork) exec(t *testing.T, i int, name string, args ...string) string {
+	return run(t, "ip", append([]string{"netns", "exec", n.ns[i], name}, args...)...)
+}
+
+// linkCounter reads a statistics counter for a network interface
+// in the namespace of endpoint i.
+func (n *testNetwork) linkCounter(t *testing.T, i int, ifname, counter string) uint64 {
+	out := n.exec(t, i, "cat", filepath.Join("/sys/class/net", ifname, "statistics", counter))
+	v, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		t.Fatalf("failed to parse %v %v counter %q: %v", ifname, counter, out, err)
+	}
+	return v
+}
+
+func runIP(t *testing.T, args ...string) string {
+	return run(t, "ip", args...)
+}
+
+func run(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v %v: %v: %s", name, strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
@@ -10,13 +10,13 @@ const (
 	CmdMax = -1
 	// AttrMax as defined in nll2tp/l2tp.h:135
 	AttrMax = -1
-	// AttrStatsMax as defined in nll2tp/l2tp.h:152
+	// AttrStatsMax as defined in nll2tp/l2tp.h:154
 	AttrStatsMax = -1
-	// GenlName as defined in nll2tp/l2tp.h:198
+	// GenlName as defined in nll2tp/l2tp.h:200
 	GenlName = "l2tp"
-	// GenlVersion as defined in nll2tp/l2tp.h:199
+	// GenlVersion as defined in nll2tp/l2tp.h:201
 	GenlVersion = 0x1
-	// GenlMcgroup as defined in nll2tp/l2tp.h:200
+	// GenlMcgroup as defined in nll2tp/l2tp.h:202
 	GenlMcgroup = "l2tp"
 )
 
@@ -137,12 +137,16 @@ const (
 	AttrRxErrors = 8
 	// AttrStatsPad as declared in nll2tp/l2tp.h:148
 	AttrStatsPad = 9
+	// AttrRxCookieDiscards as declared in nll2tp/l2tp.h:149
+	AttrRxCookieDiscards = 10
+	// AttrRxInvalid as declared in nll2tp/l2tp.h:150
+	AttrRxInvalid = 11
 )
 
-// L2tpPwtype as declared in nll2tp/l2tp.h:154
+// L2tpPwtype as declared in nll2tp/l2tp.h:156
 type L2tpPwtype int32
 
-// L2tpPwtype enumeration from nll2tp/l2tp.h:154
+// L2tpPwtype enumeration from nll2tp/l2tp.h:156
 const (
 	PwtypeNone    = 0x0000
 	PwtypeEthVlan = 0x0004
@@ -152,38 +156,38 @@ const (
 	PwtypeIp      = 0x000b
 )
 
-// L2tpL2specType as declared in nll2tp/l2tp.h:164
+// L2tpL2specType as declared in nll2tp/l2tp.h:166
 type L2tpL2specType int32
 
-// L2tpL2specType enumeration from nll2tp/l2tp.h:164
+// L2tpL2specType enumeration from nll2tp/l2tp.h:166
 const (
 	L2spectypeNone    = iota
 	L2spectypeDefault = 1
 )
 
-// L2tpEncapType as declared in nll2tp/l2tp.h:169
+// L2tpEncapType as declared in nll2tp/l2tp.h:171
 type L2tpEncapType int32
 
-// L2tpEncapType enumeration from nll2tp/l2tp.h:169
+// L2tpEncapType enumeration from nll2tp/l2tp.h:171
 const (
 	EncaptypeUdp = iota
 	EncaptypeIp  = 1
 )
 
-// L2tpSeqmode as declared in nll2tp/l2tp.h:174
+// L2tpSeqmode as declared in nll2tp/l2tp.h:176
 type L2tpSeqmode int32
 
-// L2tpSeqmode enumeration from nll2tp/l2tp.h:174
+// L2tpSeqmode enumeration from nll2tp/l2tp.h:176
 const (
 	SeqNone = iota
 	SeqIp   = 1
 	SeqAll  = 2
 )
 
-// L2tpDebugFlags as declared in nll2tp/l2tp.h:188
+// L2tpDebugFlags as declared in nll2tp/l2tp.h:190
 type L2tpDebugFlags uint32
 
-// L2tpDebugFlags enumeration from nll2tp/l2tp.h:188
+// L2tpDebugFlags enumeration from nll2tp/l2tp.h:190
 const (
 	MsgDebug   = (1 << 0)
 	MsgControl = (1 << 1)
@@ -46,6 +46,15 @@ type TunnelConfig struct {
 	Encap L2tpEncapType
 	// DebugFlags specifies the kernel debugging flags to use for the tunnel instance.
 	DebugFlags L2tpDebugFlags
+	// UDPChecksum enables UDP checksums for IPv4 UDP tunnels whose socket is
+	// created by the kernel.
+	UDPChecksum bool
+	// UDPZeroChecksum6Tx enables transmission of zero UDP checksums for IPv6
+	// UDP tunnels whose socket is created by the kernel.
+	UDPZeroChecksum6Tx bool
+	// UDPZeroChecksum6Rx enables acceptance of zero UDP checksums for IPv6
+	// UDP tunnels whose socket is created by the kernel.
+	UDPZeroChecksum6Rx bool
 }
 
 // SessionConfig encapsulates genetlink parameters for L2TP session commands.
@@ -69,9 +78,7 @@ type SessionConfig struct {
 	// IsLNS if unset allows the LNS to enable data packet sequence numbers per RFC2661 section 5.4
 	IsLNS bool
 	// ReorderTimeout sets the maximum amount of time to hold a data packet in the reorder
-	// queue when sequence numbers are enabled.  This number is defined in jiffies for the
-	// running kernel (ref: man 7 time: sysconf(_SC_CLK_TCK))
-	// TODO: make this use something a bit more sane...
+	// queue when sequence numbers are enabled.  This number is defined in milliseconds.
 	ReorderTimeout uint64
 	// LocalCookie sets the RFC3931 cookie for the session.
 	// Transmitted data packets will include the cookie.
@@ -87,10 +94,39 @@ type SessionConfig struct {
 	// L2SpecType specifies the Layer 2 specific sublayer field to be used in data packets
 	// as per RFC3931 section 3.2.2
 	L2SpecType L2tpL2specType
+	// MTU, if non-zero, specifies the MTU of the session's network interface.
+	MTU uint16
 	// DebugFlags specifies the kernel debugging flags to use for the session instance.
 	DebugFlags L2tpDebugFlags
 }
 
+// TunnelInfo encapsulates dataplane tunnel information provided by the kernel.
+type TunnelInfo struct {
+	// Tid is the host's L2TP ID for the tunnel.
+	Tid L2tpTunnelID
+	// Ptid is the peer's L2TP ID for the tunnel.
+	Ptid L2tpTunnelID
+	// Version is the tunnel protocol version (L2TPv2 or L2TPv3).
+	Version L2tpProtocolVersion
+	// Encap is the tunnel encapsulation type.
+	Encap L2tpEncapType
+	// LocalAddr and PeerAddr are the IPv4 or IPv6 addresses of the tunnel
+	// socket, if reported by the kernel.
+	LocalAddr, PeerAddr []byte
+	// LocalPort and PeerPort are the UDP ports of the tunnel socket, if
+	// reported by the kernel.
+	LocalPort, PeerPort uint16
+	// UDPChecksum is true if UDP checksums are enabled for an IPv4 UDP
+	// tunnel.
+	UDPChecksum bool
+	// UDPZeroChecksum6Tx and UDPZeroChecksum6Rx are true if zero UDP
+	// checksums are transmitted and accepted by an IPv6 UDP tunnel.
+	UDPZeroChecksum6Tx, UDPZeroChecksum6Rx bool
+	// Statistics is the current dataplane tx/rx stats, which the kernel
+	// accumulates for all the sessions in the tunnel.
+	Statistics SessionStatistics
+}
+
 // SessionStatistics includes statistics on dataplane receive and transmit.
 type SessionStatistics struct {
 	// TxPacketCount is the number of data packets the session has transmitted.
@@ -112,6 +148,12 @@ type SessionStatistics struct {
 	// RxOOSCount is the number of packets the session has received out of sequence if data packet
 	// reordering is enabled.
 	RxOOSCount uint64
+	// RxCookieDiscardCount is the number of packets the session has discarded because
+	// they didn't carry the peer cookie.  Kernels prior to Linux 5.7 don't report it.
+	RxCookieDiscardCount uint64
+	// RxInvalidCount is the number of packets the session has discarded as invalid.
+	// Kernels prior to Linux 5.7 don't report it.
+	RxInvalidCount uint64
 }
 
 // SessionInfo encapsulates dataplane session information provided by the kernel.
@@ -124,6 +166,10 @@ type SessionInfo struct {
 	Sid L2tpSessionID
 	// Psid is the peer's L2TP ID for the session.
 	Psid L2tpSessionID
+	// PseudowireType is the type of traffic carried by the session.
+	PseudowireType L2tpPwtype
+	// L2SpecType is the Layer 2 specific sublayer type used in data packets.
+	L2SpecType L2tpL2specType
 	// IfName is the assigned interface name for this session.
 	IfName string
 	// LocalCookie is the RFC3931 cookie for the session.
@@ -392,6 +438,10 @@ func (stats *SessionStatistics) decode(ad *netlink.AttributeDecoder) error {
 			stats.RxSeqDiscardCount = ad.Uint64()
 		case AttrRxOosPackets:
 			stats.RxOOSCount = ad.Uint64()
+		case AttrRxCookieDiscards:
+			stats.RxCookieDiscardCount = ad.Uint64()
+		case AttrRxInvalid:
+			stats.RxInvalidCount = ad.Uint64()
 		}
 	}
 	return nil
@@ -415,6 +465,10 @@ func sessionInfo_decode(data []byte) (*SessionInfo, error) {
 			info.Sid = L2tpSessionID(ad.Uint32())
 		case AttrPeerSessionId:
 			info.Psid = L2tpSessionID(ad.Uint32())
+		case AttrPwType:
+			info.PseudowireType = L2tpPwtype(ad.Uint16())
+		case AttrL2specType:
+			info.L2SpecType = L2tpL2specType(ad.Uint8())
 		case AttrIfname:
 			info.IfName = ad.String()
 		case AttrCookie:
@@ -476,25 +530,151 @@ func (c *Conn) GetSessionInfo(config *SessionConfig) (*SessionInfo, error) {
 		return nil, err
 	}
 
-	info := SessionInfo{}
 	for _, rsp := range msgs {
-		if rsp.Header.Command != CmdSessionGet {
-			continue
+		if rsp.Header.Command == CmdSessionGet {
+			return sessionInfo_decode(rsp.Data)
 		}
+	}
+	return nil, errors.New("no session information in kernel response")
+}
 
-		attributes, err := netlink.UnmarshalAttributes(rsp.Data)
-		if err != nil {
-			return nil, err
-		}
+// DumpSessions retrieves dataplane information for all the sessions
+// in the kernel.
+func (c *Conn) DumpSessions() ([]SessionInfo, error) {
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdSessionGet,
+			Version: c.genlFamily.Version,
+		},
+	}
 
-		for _, a := range attributes {
-			switch a.Type {
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionInfo
+	for _, rsp := range msgs {
+		if rsp.Header.Command == CmdSessionGet {
+			info, err := sessionInfo_decode(rsp.Data)
+			if err != nil {
+				return nil, err
 			}
+			sessions = append(sessions, *info)
 		}
 	}
+	return sessions, nil
+}
+
+func tunnelInfo_decode(data []byte) (*TunnelInfo, error) {
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attribute decoder: %v", err)
+	}
+
+	var info TunnelInfo
+	for ad.Next() {
+		switch ad.Type() {
+		case AttrConnId:
+			info.Tid = L2tpTunnelID(ad.Uint32())
+		case AttrPeerConnId:
+			info.Ptid = L2tpTunnelID(ad.Uint32())
+		case AttrProtoVersion:
+			info.Version = L2tpProtocolVersion(ad.Uint8())
+		case AttrEncapType:
+			info.Encap = L2tpEncapType(ad.Uint16())
+		case AttrIpSaddr, AttrIp6Saddr:
+			info.LocalAddr = ad.Bytes()
+		case AttrIpDaddr, AttrIp6Daddr:
+			info.PeerAddr = ad.Bytes()
+		case AttrUdpSport:
+			info.LocalPort = ad.Uint16()
+		case AttrUdpDport:
+			info.PeerPort = ad.Uint16()
+		case AttrUdpCsum:
+			info.UDPChecksum = ad.Uint8() != 0
+		case AttrUdpZeroCsum6Tx:
+			info.UDPZeroChecksum6Tx = true
+		case AttrUdpZeroCsum6Rx:
+			info.UDPZeroChecksum6Rx = true
+		case AttrStats:
+			ad.Nested(info.Statistics.decode)
+		}
+	}
+
+	if err = ad.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode attributes: %v", err)
+	}
+
 	return &info, nil
 }
 
+// GetTunnelInfo retrieves dataplane tunnel information from the kernel.
+func (c *Conn) GetTunnelInfo(config *TunnelConfig) (*TunnelInfo, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil tunnel config")
+	}
+
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelGet,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rsp := range msgs {
+		if rsp.Header.Command == CmdTunnelGet {
+			return tunnelInfo_decode(rsp.Data)
+		}
+	}
+	return nil, errors.New("no tunnel information in kernel response")
+}
+
+// DumpTunnels retrieves dataplane information for all the tunnels in
+// the kernel.
+func (c *Conn) DumpTunnels() ([]TunnelInfo, error) {
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelGet,
+			Version: c.genlFamily.Version,
+		},
+	}
+
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnels []TunnelInfo
+	for _, rsp := range msgs {
+		if rsp.Header.Command == CmdTunnelGet {
+			info, err := tunnelInfo_decode(rsp.Data)
+			if err != nil {
+				return nil, err
+			}
+			tunnels = append(tunnels, *info)
+		}
+	}
+	return tunnels, nil
+}
+
 func (c *Conn) createTunnel(attr []netlink.Attribute) error {
 	b, err := netlink.MarshalAttributes(attr)
 	if err != nil {
@@ -560,7 +740,7 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 		}
 	}
 
-	return []netlink.Attribute{
+	attr := []netlink.Attribute{
 		{
 			Type: AttrConnId,
 			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
@@ -581,7 +761,29 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 			Type: AttrDebug,
 			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
 		},
-	}, nil
+	}
+
+	if config.UDPChecksum {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrUdpCsum,
+			Data: nlenc.Uint8Bytes(1),
+		})
+	}
+
+	// The zero checksum attributes are flags: presence indicates true
+	if config.UDPZeroChecksum6Tx {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrUdpZeroCsum6Tx,
+		})
+	}
+
+	if config.UDPZeroChecksum6Rx {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrUdpZeroCsum6Rx,
+		})
+	}
+
+	return attr, nil
 }
 
 func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
@@ -607,7 +809,7 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 	}
 	if len(config.LocalCookie) > 0 {
 		if len(config.LocalCookie) != 4 && len(config.LocalCookie) != 8 {
-			return nil, fmt.Errorf("session config has peer cookie of %d bytes: valid lengths are 4 or 8 bytes",
+			return nil, fmt.Errorf("session config has cookie of %d bytes: valid lengths are 4 or 8 bytes",
 				len(config.LocalCookie))
 		}
 	}
@@ -687,7 +889,7 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 
 	if len(config.PeerCookie) > 0 {
 		attr = append(attr, netlink.Attribute{
-			Type: AttrCookie,
+			Type: AttrPeerCookie,
 			Data: config.PeerCookie,
 		})
 	}
@@ -699,6 +901,13 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 		})
 	}
 
+	if config.MTU != 0 {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrMtu,
+			Data: nlenc.Uint16Bytes(config.MTU),
+		})
+	}
+
 	attr = append(attr, netlink.Attribute{
 		Type: AttrL2specType,
 		Data: nlenc.Uint8Bytes(uint8(config.L2SpecType)),
@@ -0,0 +1,513 @@
+/*
+Package ippool allocates subscriber addresses to the PPP sessions of an L2TP
+network server (LNS), so that a standalone LNS needn't rely on an external
+address management system.
+
+A Pool hands out an IPv4 address, and optionally an IPv6 prefix for
+delegation, to each subscriber.  Subscribers are identified by a key chosen
+by the application, such as the PPP user name or the name of the session.
+The addresses are then passed to the PPP implementation running the
+session: pppd, for example, assigns the IPv4 address to the peer using IPCP
+if it is given as the remote address of its local:remote option.
+
+Leases are sticky.  A subscriber whose lease has been released is given the
+same addresses the next time it allocates, unless they have been reclaimed
+for another subscriber in the meantime, which only happens once the pool has
+no unused addresses left.  Released leases are reclaimed in the order in
+which they were released.
+
+If a lease file is configured, the leases are saved to it whenever they
+change, and loaded from it by New so that subscribers keep their addresses
+across restarts of the application.  The sessions holding leases don't
+survive a restart, so the loaded leases are treated as released.  Leases
+which don't fit the pool's configuration are discarded.
+
+Usage
+
+	import (
+		"fmt"
+
+		"github.com/katalix/go-l2tp/ippool"
+	)
+
+	# Note we're ignoring errors for brevity.
+
+	pool, _ := ippool.New(&ippool.Config{
+		IPv4Prefix:    "10.0.0.0/24",
+		Exclude:       []string{"10.0.0.1"},
+		IPv6Prefix:    "2001:db8::/48",
+		IPv6PrefixLen: 56,
+		LeaseFile:     "/var/lib/lns/leases.json",
+	})
+
+	lease, _ := pool.Allocate("alice")
+	defer pool.Release("alice")
+
+	pppdArgs := []string{fmt.Sprintf("10.0.0.1:%v", lease.IPv4)}
+*/
+package ippool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Config describes a Pool.
+type Config struct {
+	// IPv4Prefix is the prefix from which IPv4 addresses are allocated,
+	// in CIDR notation, e.g. "10.0.0.0/24".  The network and broadcast
+	// addresses of prefixes shorter than /31 aren't allocated.
+	// By default no IPv4 addresses are allocated.
+	IPv4Prefix string
+	// Exclude lists addresses within IPv4Prefix which are never
+	// allocated, such as the LNS's own address on the PPP links.
+	Exclude []string
+	// IPv6Prefix is the prefix from which prefixes are allocated for
+	// delegation to subscribers, in CIDR notation, e.g. "2001:db8::/48".
+	// By default no prefixes are delegated.
+	IPv6Prefix string
+	// IPv6PrefixLen is the length of the delegated prefixes, which must
+	// be longer than IPv6Prefix by at most 32 bits.
+	// By default /56 prefixes are delegated.
+	IPv6PrefixLen int
+	// LeaseFile, if set, is the path of the file the leases are saved to.
+	// By default leases are held in memory only.
+	LeaseFile string
+	// Logger receives log messages about the pool.  If nil, logging is
+	// disabled.
+	Logger log.Logger
+}
+
+// Lease holds the addresses allocated to a subscriber.
+type Lease struct {
+	// Key identifies the subscriber.
+	Key string
+	// IPv4 is the subscriber's IPv4 address, or nil if the pool doesn't
+	// allocate IPv4 addresses.
+	IPv4 net.IP
+	// IPv6Prefix is the prefix delegated to the subscriber, or nil if
+	// the pool doesn't delegate prefixes.
+	IPv6Prefix *net.IPNet
+}
+
+// ErrExhausted is returned by Pool.Allocate when the pool has no addresses
+// left to allocate.
+var ErrExhausted = errors.New("address pool exhausted")
+
+// The default length of delegated prefixes
+const defaultIPv6PrefixLen = 56
+
+// Pool allocates subscriber addresses.  It is safe for concurrent use.
+type Pool struct {
+	cfg    Config
+	logger log.Logger
+
+	// IPv4 addresses are indexed by their offset from the start of
+	// the prefix, and delegated prefixes by their offset in units of
+	// the delegated prefix length
+	v4Net      *net.IPNet
+	v4Base     uint32
+	v4Min      uint32
+	v4Max      uint32
+	v4Exclude  map[uint32]bool
+	v6Net      *net.IPNet
+	v6Count    uint64
+	v6Shift    uint
+	lock       sync.Mutex
+	leases     map[string]*lease
+	v4Used     map[uint32]*lease
+	v6Used     map[uint64]*lease
+	v4Next     uint32
+	v6Next     uint64
+	releaseSeq uint64
+}
+
+// lease tracks a Lease along with the indices of its addresses.  Leases
+// are ordered for reclamation by the time they were released, and within
+// the life of the pool by the sequence number of their release.
+type lease struct {
+	key      string
+	v4       *uint32
+	v6       *uint64
+	released time.Time
+	seq      uint64
+}
+
+// leaseRecord is the representation of a lease in the lease file.
+type leaseRecord struct {
+	Key        string    `json:"key"`
+	IPv4       string    `json:"ipv4,omitempty"`
+	IPv6Prefix string    `json:"ipv6_prefix,omitempty"`
+	Released   time.Time `json:"released"`
+}
+
+// New creates a pool, loading its leases from the lease file if one is
+// configured.  It's not an error for the lease file not to exist.
+func New(cfg *Config) (*Pool, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+	if cfg.IPv4Prefix == "" && cfg.IPv6Prefix == "" {
+		return nil, fmt.Errorf("no IPv4 or IPv6 prefix configured")
+	}
+
+	p := &Pool{
+		cfg:       *cfg,
+		logger:    cfg.Logger,
+		v4Exclude: make(map[uint32]bool),
+		leases:    make(map[string]*lease),
+		v4Used:    make(map[uint32]*lease),
+		v6Used:    make(map[uint64]*lease),
+	}
+	if p.logger == nil {
+		p.logger = log.NewNopLogger()
+	}
+
+	if cfg.IPv4Prefix != "" {
+		_, ipnet, err := net.ParseCIDR(cfg.IPv4Prefix)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 prefix %q", cfg.IPv4Prefix)
+		}
+		ones, _ := ipnet.Mask.Size()
+		p.v4Net = ipnet
+		p.v4Base = binary.BigEndian.Uint32(ipnet.IP.To4())
+		p.v4Max = uint32(uint64(1)<<uint(32-ones) - 1)
+		if ones < 31 {
+			p.v4Min, p.v4Max = 1, p.v4Max-1
+		}
+		for _, s := range cfg.Exclude {
+			ip := net.ParseIP(s).To4()
+			if ip == nil || !ipnet.Contains(ip) {
+				return nil, fmt.Errorf("excluded address %q is not within %v", s, ipnet)
+			}
+			p.v4Exclude[binary.BigEndian.Uint32(ip)-p.v4Base] = true
+		}
+		p.v4Next = p.v4Min
+	} else if len(cfg.Exclude) > 0 {
+		return nil, fmt.Errorf("excluded addresses require an IPv4 prefix")
+	}
+
+	if cfg.IPv6Prefix != "" {
+		_, ipnet, err := net.ParseCIDR(cfg.IPv6Prefix)
+		if err != nil || ipnet.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 prefix %q", cfg.IPv6Prefix)
+		}
+		if p.cfg.IPv6PrefixLen == 0 {
+			p.cfg.IPv6PrefixLen = defaultIPv6PrefixLen
+		}
+		ones, _ := ipnet.Mask.Size()
+		if p.cfg.IPv6PrefixLen <= ones || p.cfg.IPv6PrefixLen > 128 || p.cfg.IPv6PrefixLen-ones > 32 {
+			return nil, fmt.Errorf("invalid delegated prefix length %v for IPv6 prefix %v",
+				p.cfg.IPv6PrefixLen, ipnet)
+		}
+		p.v6Net = ipnet
+		p.v6Count = uint64(1) << uint(p.cfg.IPv6PrefixLen-ones)
+		p.v6Shift = uint(128 - p.cfg.IPv6PrefixLen)
+	}
+
+	if cfg.LeaseFile != "" {
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Allocate returns the lease of a subscriber, allocating addresses if the
+// subscriber doesn't already hold a lease.  A released lease is renewed if
+// its addresses haven't been reclaimed.  Allocate returns ErrExhausted if
+// there are no addresses left to allocate.
+func (p *Pool) Allocate(key string) (*Lease, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if l, ok := p.leases[key]; ok {
+		if !l.released.IsZero() {
+			l.released = time.Time{}
+			p.save()
+		}
+		return p.toLease(l), nil
+	}
+
+	l := &lease{key: key}
+	for !p.assign(l) {
+		if !p.reclaim() {
+			level.Error(p.logger).Log(
+				"message", "address pool exhausted",
+				"key", key)
+			return nil, ErrExhausted
+		}
+	}
+	p.link(l)
+	p.save()
+
+	lease := p.toLease(l)
+	level.Info(p.logger).Log(
+		"message", "allocated lease",
+		"key", key,
+		"ipv4", lease.IPv4,
+		"ipv6_prefix", lease.IPv6Prefix)
+	return lease, nil
+}
+
+// Release releases the lease of a subscriber.  The subscriber keeps its
+// addresses unless they are reclaimed for another subscriber.
+func (p *Pool) Release(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	l, ok := p.leases[key]
+	if !ok || !l.released.IsZero() {
+		return
+	}
+	p.releaseSeq++
+	l.released, l.seq = time.Now(), p.releaseSeq
+	p.save()
+	level.Debug(p.logger).Log(
+		"message", "released lease",
+		"key", key)
+}
+
+// Leases returns the leases currently held, sorted by key.
+func (p *Pool) Leases() []Lease {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var leases []Lease
+	for _, l := range p.leases {
+		if l.released.IsZero() {
+			leases = append(leases, *p.toLease(l))
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Key < leases[j].Key
+	})
+	return leases
+}
+
+// assign finds unused addresses for each of the pool's address families
+// which the lease lacks, returning false if any family has none left.  The
+// addresses aren't marked as used until the lease is linked.
+func (p *Pool) assign(l *lease) bool {
+	if p.v4Net != nil && l.v4 == nil {
+		for i := uint64(0); i <= uint64(p.v4Max-p.v4Min); i++ {
+			idx := p.v4Next
+			if p.v4Next++; p.v4Next > p.v4Max {
+				p.v4Next = p.v4Min
+			}
+			if p.v4Used[idx] == nil && !p.v4Exclude[idx] {
+				l.v4 = &idx
+				break
+			}
+		}
+		if l.v4 == nil {
+			return false
+		}
+	}
+	if p.v6Net != nil && l.v6 == nil {
+		for i := uint64(0); i < p.v6Count; i++ {
+			idx := p.v6Next
+			p.v6Next = (p.v6Next + 1) % p.v6Count
+			if p.v6Used[idx] == nil {
+				l.v6 = &idx
+				break
+			}
+		}
+		if l.v6 == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// reclaim discards the released lease which was released first, returning
+// false if there are no released leases.
+func (p *Pool) reclaim() bool {
+	var oldest *lease
+	for _, l := range p.leases {
+		if l.released.IsZero() {
+			continue
+		}
+		if oldest == nil || l.released.Before(oldest.released) ||
+			(l.released.Equal(oldest.released) && l.seq < oldest.seq) {
+			oldest = l
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	level.Info(p.logger).Log(
+		"message", "reclaimed released lease",
+		"key", oldest.key)
+	p.unlink(oldest)
+	return true
+}
+
+func (p *Pool) link(l *lease) {
+	p.leases[l.key] = l
+	if l.v4 != nil {
+		p.v4Used[*l.v4] = l
+	}
+	if l.v6 != nil {
+		p.v6Used[*l.v6] = l
+	}
+}
+
+func (p *Pool) unlink(l *lease) {
+	delete(p.leases, l.key)
+	if l.v4 != nil {
+		delete(p.v4Used, *l.v4)
+	}
+	if l.v6 != nil {
+		delete(p.v6Used, *l.v6)
+	}
+}
+
+func (p *Pool) toLease(l *lease) *Lease {
+	lease := &Lease{Key: l.key}
+	if l.v4 != nil {
+		lease.IPv4 = make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(lease.IPv4, p.v4Base+*l.v4)
+	}
+	if l.v6 != nil {
+		n := new(big.Int).SetBytes(p.v6Net.IP)
+		n.Add(n, new(big.Int).Lsh(new(big.Int).SetUint64(*l.v6), p.v6Shift))
+		ip := make(net.IP, net.IPv6len)
+		b := n.Bytes()
+		copy(ip[net.IPv6len-len(b):], b)
+		lease.IPv6Prefix = &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(p.cfg.IPv6PrefixLen, 8*net.IPv6len),
+		}
+	}
+	return lease
+}
+
+// fromRecord restores a lease from the lease file, returning an error if
+// it doesn't fit the pool's configuration.
+func (p *Pool) fromRecord(r *leaseRecord) (*lease, error) {
+	l := &lease{key: r.Key, released: r.Released}
+	if p.v4Net != nil {
+		ip := net.ParseIP(r.IPv4).To4()
+		if ip == nil || !p.v4Net.Contains(ip) {
+			return nil, fmt.Errorf("IPv4 address %q is not within %v", r.IPv4, p.v4Net)
+		}
+		idx := binary.BigEndian.Uint32(ip) - p.v4Base
+		if idx < p.v4Min || idx > p.v4Max || p.v4Exclude[idx] {
+			return nil, fmt.Errorf("IPv4 address %v may not be allocated", ip)
+		}
+		if p.v4Used[idx] != nil {
+			return nil, fmt.Errorf("IPv4 address %v is already leased", ip)
+		}
+		l.v4 = &idx
+	}
+	if p.v6Net != nil {
+		_, ipnet, err := net.ParseCIDR(r.IPv6Prefix)
+		if err != nil || ipnet.IP.To4() != nil || !p.v6Net.Contains(ipnet.IP) {
+			return nil, fmt.Errorf("IPv6 prefix %q is not within %v", r.IPv6Prefix, p.v6Net)
+		}
+		if ones, _ := ipnet.Mask.Size(); ones != p.cfg.IPv6PrefixLen {
+			return nil, fmt.Errorf("IPv6 prefix %v is not a /%v", ipnet, p.cfg.IPv6PrefixLen)
+		}
+		offset := new(big.Int).Sub(new(big.Int).SetBytes(ipnet.IP), new(big.Int).SetBytes(p.v6Net.IP))
+		idx := offset.Rsh(offset, p.v6Shift).Uint64()
+		if p.v6Used[idx] != nil {
+			return nil, fmt.Errorf("IPv6 prefix %v is already leased", ipnet)
+		}
+		l.v6 = &idx
+	}
+	return l, nil
+}
+
+// load restores the leases saved in the lease file.
+func (p *Pool) load() error {
+	b, err := ioutil.ReadFile(p.cfg.LeaseFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lease file: %v", err)
+	}
+	var records []leaseRecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("failed to parse lease file %q: %v", p.cfg.LeaseFile, err)
+	}
+
+	now := time.Now()
+	for i := range records {
+		r := &records[i]
+		if _, ok := p.leases[r.Key]; ok {
+			level.Warn(p.logger).Log(
+				"message", "discarded duplicate lease",
+				"key", r.Key)
+			continue
+		}
+		l, err := p.fromRecord(r)
+		if err != nil {
+			level.Warn(p.logger).Log(
+				"message", "discarded lease",
+				"key", r.Key,
+				"error", err)
+			continue
+		}
+		if l.released.IsZero() {
+			l.released = now
+		}
+		p.link(l)
+	}
+	level.Info(p.logger).Log(
+		"message", "loaded leases",
+		"path", p.cfg.LeaseFile,
+		"count", len(p.leases))
+	return nil
+}
+
+// save writes the leases to the lease file, if one is configured.  The
+// file is replaced atomically, so that a crash doesn't lose the leases.
+// Failures are logged rather than failing the change to the leases.
+func (p *Pool) save() {
+	if p.cfg.LeaseFile == "" {
+		return
+	}
+	records := make([]leaseRecord, 0, len(p.leases))
+	for _, l := range p.leases {
+		lease := p.toLease(l)
+		r := leaseRecord{Key: l.key, Released: l.released}
+		if lease.IPv4 != nil {
+			r.IPv4 = lease.IPv4.String()
+		}
+		if lease.IPv6Prefix != nil {
+			r.IPv6Prefix = lease.IPv6Prefix.String()
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Key < records[j].Key
+	})
+
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err == nil {
+		tmp := p.cfg.LeaseFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, p.cfg.LeaseFile)
+		}
+	}
+	if err != nil {
+		level.Error(p.logger).Log(
+			"message", "failed to save leases",
+			"path", p.cfg.LeaseFile,
+			"error", err)
+	}
+}
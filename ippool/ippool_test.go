@@ -0,0 +1,183 @@
+package ippool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPool(t *testing.T) {
+	cases := []struct {
+		name       string
+		cfg        Config
+		expectFail bool
+	}{
+		{
+			name: "IPv4",
+			cfg:  Config{IPv4Prefix: "10.0.0.0/24", Exclude: []string{"10.0.0.1"}},
+		},
+		{
+			name: "IPv6 prefix delegation",
+			cfg:  Config{IPv6Prefix: "2001:db8::/48"},
+		},
+		{
+			name:       "No prefixes",
+			expectFail: true,
+		},
+		{
+			name:       "Bad IPv4 prefix",
+			cfg:        Config{IPv4Prefix: "2001:db8::/64"},
+			expectFail: true,
+		},
+		{
+			name:       "Excluded address outside prefix",
+			cfg:        Config{IPv4Prefix: "10.0.0.0/24", Exclude: []string{"10.0.1.1"}},
+			expectFail: true,
+		},
+		{
+			name:       "Bad IPv6 prefix",
+			cfg:        Config{IPv6Prefix: "10.0.0.0/8"},
+			expectFail: true,
+		},
+		{
+			name:       "Delegated prefix too short",
+			cfg:        Config{IPv6Prefix: "2001:db8::/56", IPv6PrefixLen: 48},
+			expectFail: true,
+		},
+		{
+			name:       "Too many delegated prefixes",
+			cfg:        Config{IPv6Prefix: "2001:db8::/32", IPv6PrefixLen: 80},
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := New(&c.cfg)
+			if c.expectFail && err == nil {
+				t.Errorf("New(%+v): expected error", c.cfg)
+			} else if !c.expectFail && err != nil {
+				t.Errorf("New(%+v): %v", c.cfg, err)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	pool, err := New(&Config{
+		IPv4Prefix:    "10.0.0.0/29",
+		Exclude:       []string{"10.0.0.1"},
+		IPv6Prefix:    "2001:db8::/62",
+		IPv6PrefixLen: 64,
+	})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	alice, err := pool.Allocate("alice")
+	if err != nil {
+		t.Fatalf("Allocate(alice): %v", err)
+	}
+	if alice.IPv4.String() != "10.0.0.2" || alice.IPv6Prefix.String() != "2001:db8::/64" {
+		t.Errorf("Allocate(alice): got %v %v", alice.IPv4, alice.IPv6Prefix)
+	}
+	if again, err := pool.Allocate("alice"); err != nil || !again.IPv4.Equal(alice.IPv4) {
+		t.Errorf("Allocate(alice) again: got %+v, %v, want %+v", again, err, alice)
+	}
+
+	// The remaining prefixes are allocated in turn
+	for i, key := range []string{"bob", "carol", "dave"} {
+		if _, err := pool.Allocate(key); err != nil {
+			t.Fatalf("Allocate(%v): %v", key, err)
+		}
+		if n := len(pool.Leases()); n != i+2 {
+			t.Errorf("Leases(): got %v leases, want %v", n, i+2)
+		}
+	}
+	if _, err = pool.Allocate("eve"); err != ErrExhausted {
+		t.Errorf("Allocate(eve) from exhausted pool: got %v, want %v", err, ErrExhausted)
+	}
+
+	// Released leases are kept for their subscribers until reclaimed
+	pool.Release("bob")
+	pool.Release("alice")
+	if again, err := pool.Allocate("alice"); err != nil || !again.IPv4.Equal(alice.IPv4) {
+		t.Errorf("Allocate(alice) after release: got %+v, %v, want %+v", again, err, alice)
+	}
+	eve, err := pool.Allocate("eve")
+	if err != nil {
+		t.Fatalf("Allocate(eve) after release: %v", err)
+	}
+	leases := pool.Leases()
+	if len(leases) != 4 || leases[0].Key != "alice" || leases[1].Key != "carol" || leases[3].Key != "eve" {
+		t.Errorf("Leases(): got %+v, want alice, carol, dave and eve", leases)
+	}
+	if bob, err := pool.Allocate("bob"); err != ErrExhausted {
+		t.Errorf("Allocate(bob) after reclamation: got %+v, %v, want %v", bob, err, ErrExhausted)
+	}
+	if eve.IPv4.Equal(alice.IPv4) {
+		t.Errorf("Allocate(eve): got alice's address %v", eve.IPv4)
+	}
+}
+
+func TestLeaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ippool")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		IPv4Prefix: "192.0.2.0/24",
+		IPv6Prefix: "2001:db8::/48",
+		LeaseFile:  filepath.Join(dir, "leases.json"),
+	}
+	pool, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	var want []Lease
+	for _, key := range []string{"alice", "bob"} {
+		lease, err := pool.Allocate(key)
+		if err != nil {
+			t.Fatalf("Allocate(%v): %v", key, err)
+		}
+		want = append(want, *lease)
+	}
+	pool.Release("bob")
+
+	// Subscribers get their addresses back after a restart, with the
+	// restored leases treated as released
+	pool, err = New(&cfg)
+	if err != nil {
+		t.Fatalf("New() with lease file: %v", err)
+	}
+	if leases := pool.Leases(); len(leases) != 0 {
+		t.Errorf("Leases() after restart: got %+v, want none", leases)
+	}
+	if _, err = pool.Allocate("carol"); err != nil {
+		t.Fatalf("Allocate(carol): %v", err)
+	}
+	for _, w := range want {
+		got, err := pool.Allocate(w.Key)
+		if err != nil || !got.IPv4.Equal(w.IPv4) || got.IPv6Prefix.String() != w.IPv6Prefix.String() {
+			t.Errorf("Allocate(%v) after restart: got %+v, %v, want %+v", w.Key, got, err, w)
+		}
+	}
+
+	// Leases which don't fit a new configuration are discarded
+	cfg.IPv4Prefix = "198.51.100.0/24"
+	if pool, err = New(&cfg); err != nil {
+		t.Fatalf("New() with changed prefix: %v", err)
+	}
+	if lease, err := pool.Allocate("alice"); err != nil || lease.IPv4.String() != "198.51.100.1" {
+		t.Errorf("Allocate(alice) with changed prefix: got %+v, %v", lease, err)
+	}
+
+	if err = ioutil.WriteFile(cfg.LeaseFile, []byte("not json"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if _, err = New(&cfg); err == nil {
+		t.Errorf("New() with corrupt lease file: expected error")
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Package ipsec protects L2TP tunnels using IPsec on Linux systems.
+
+L2TP offers no confidentiality of its own, and is commonly deployed over
+IPsec transport mode as described by RFC3193.  Package ipsec installs the
+Linux kernel xfrm policies which require the packets of an L2TP tunnel to
+be protected by ESP.  The IPsec security associations themselves are
+negotiated by an IKE daemon such as strongSwan or Libreswan: the kernel
+asks the daemon to negotiate them when the first packet matching a policy
+is sent.
+
+The policies for a tunnel should be installed before the tunnel is created,
+so that the tunnel's first control message is protected, and removed once
+the tunnel has closed.
+
+Usage
+
+	import (
+		"github.com/katalix/go-l2tp/ipsec"
+		"github.com/katalix/go-l2tp/l2tp"
+	)
+
+	# Note we're ignoring errors for brevity.
+
+	xfrm, _ := ipsec.Dial()
+	defer xfrm.Close()
+
+	policy, _ := ipsec.PolicyForTunnel(tcfg)
+	_ = xfrm.AddPolicy(policy)
+	defer xfrm.DeletePolicy(policy)
+
+	tunl, _ := l2tpctx.NewDynamicTunnel("t1", tcfg)
+
+Using package ipsec requires the CAP_NET_ADMIN capability.
+*/
+package ipsec
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Policy describes the IPsec protection of an L2TP tunnel's packets.
+type Policy struct {
+	// Local and Peer are the addresses of the tunnel in the host:port
+	// form used by l2tp.TunnelConfig.  An unspecified host or a zero
+	// port matches any address or port, which allows a listener to
+	// require protection of tunnels from any peer.  The port is ignored
+	// for IP encapsulation.
+	Local, Peer string
+
+	// Encap is the tunnel's encapsulation type.
+	Encap l2tp.EncapType
+
+	// ReqID, if set, restricts the policy to security associations
+	// with the same request ID, which should match that configured for
+	// the connection in the IKE daemon.
+	// By default any security association may be used.
+	ReqID uint32
+
+	// Priority is the priority of the policy relative to other xfrm
+	// policies, where lower values take precedence.
+	// By default the highest priority is used.
+	Priority uint32
+}
+
+// PolicyForTunnel returns the policy protecting the tunnel described by
+// the tunnel configuration.
+func PolicyForTunnel(cfg *l2tp.TunnelConfig) (*Policy, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+	return &Policy{
+		Local: cfg.Local,
+		Peer:  cfg.Peer,
+		Encap: cfg.Encap,
+	}, nil
+}
+
+// Conn is a netlink connection to the kernel's xfrm framework.
+type Conn struct {
+	c *netlink.Conn
+}
+
+// Dial creates a new netlink xfrm connection to the kernel.
+func Dial() (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_XFRM, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+// Close closes the connection, releasing associated resources.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// AddPolicy installs the inbound and outbound xfrm policies requiring ESP
+// protection of the tunnel's packets.  Existing policies for the tunnel
+// are replaced.
+func (c *Conn) AddPolicy(p *Policy) error {
+	policies, err := p.directions()
+	if err != nil {
+		return err
+	}
+	for _, d := range policies {
+		b, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: xfrmaTmpl, Data: encodeTemplate(d.sel.family, p.ReqID)},
+		})
+		if err != nil {
+			return err
+		}
+		err = c.execute(xfrmMsgUpdPolicy, append(encodePolicyInfo(d.sel, d.dir, p.Priority), b...))
+		if err != nil {
+			return fmt.Errorf("failed to install %v policy: %v", d.name, err)
+		}
+	}
+	return nil
+}
+
+// DeletePolicy removes the inbound and outbound xfrm policies installed
+// by AddPolicy.
+func (c *Conn) DeletePolicy(p *Policy) error {
+	policies, err := p.directions()
+	if err != nil {
+		return err
+	}
+
+	// Attempt to remove both policies even if one is missing
+	var firstErr error
+	for _, d := range policies {
+		err = c.execute(xfrmMsgDelPolicy, encodePolicyID(d.sel, d.dir))
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove %v policy: %v", d.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (c *Conn) execute(msgType netlink.HeaderType, data []byte) error {
+	_, err := c.c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  msgType,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	})
+	return err
+}
+
+// directedSelector is the selector of a policy in one direction.
+type directedSelector struct {
+	sel  *selector
+	dir  uint8
+	name string
+}
+
+// directions returns the selectors of the outbound and inbound policies
+// protecting the tunnel.
+func (p *Policy) directions() ([]directedSelector, error) {
+	out, err := p.selector()
+	if err != nil {
+		return nil, err
+	}
+	return []directedSelector{
+		{sel: out, dir: xfrmPolicyOut, name: "outbound"},
+		{sel: out.reverse(), dir: xfrmPolicyIn, name: "inbound"},
+	}, nil
+}
+
+// selector returns the selector matching the tunnel's outbound packets.
+func (p *Policy) selector() (*selector, error) {
+	local, lport, err := parseEndpoint(p.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %v", p.Local, err)
+	}
+	peer, pport, err := parseEndpoint(p.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %v", p.Peer, err)
+	}
+
+	// The address families must agree, with an unspecified address
+	// taking the family of the other
+	local4, peer4 := local.To4() != nil, peer.To4() != nil
+	if local4 != peer4 {
+		switch {
+		case local.IsUnspecified():
+			local = unspecifiedLike(peer)
+		case peer.IsUnspecified():
+			peer = unspecifiedLike(local)
+		default:
+			return nil, fmt.Errorf("local address %v and peer address %v have different address families", local, peer)
+		}
+	}
+
+	sel := &selector{
+		saddr: local,
+		daddr: peer,
+		proto: unix.IPPROTO_UDP,
+		sport: lport,
+		dport: pport,
+	}
+	switch p.Encap {
+	case l2tp.EncapTypeUDP:
+	case l2tp.EncapTypeIP:
+		sel.proto = unix.IPPROTO_L2TP
+		sel.sport, sel.dport = 0, 0
+	default:
+		return nil, fmt.Errorf("unrecognised encapsulation type %v", p.Encap)
+	}
+
+	sel.family = unix.AF_INET6
+	if sel.saddr.To4() != nil {
+		sel.family = unix.AF_INET
+	}
+	return sel, nil
+}
+
+// parseEndpoint parses a host:port address.  Hostnames are resolved, and
+// an empty address or host is treated as the unspecified IPv4 address.
+func parseEndpoint(addr string) (ip net.IP, port uint16, err error) {
+	if addr == "" {
+		return net.IPv4zero, 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if portStr != "" {
+		p, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid port %q", portStr)
+		}
+		port = uint16(p)
+	}
+	if host == "" {
+		return net.IPv4zero, port, nil
+	}
+	ip = net.ParseIP(host)
+	if ip == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+		ip = ipAddr.IP
+	}
+	return ip, port, nil
+}
+
+func unspecifiedLike(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6unspecified
+}
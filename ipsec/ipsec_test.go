@@ -0,0 +1,197 @@
+package ipsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+func TestPolicySelector(t *testing.T) {
+	cases := []struct {
+		name       string
+		policy     Policy
+		want       selector
+		expectFail bool
+	}{
+		{
+			name: "UDP/IPv4",
+			policy: Policy{
+				Local: "192.168.0.1:1701",
+				Peer:  "192.168.0.2:1702",
+				Encap: l2tp.EncapTypeUDP,
+			},
+			want: selector{
+				saddr:  net.ParseIP("192.168.0.1"),
+				daddr:  net.ParseIP("192.168.0.2"),
+				sport:  1701,
+				dport:  1702,
+				family: unix.AF_INET,
+				proto:  unix.IPPROTO_UDP,
+			},
+		},
+		{
+			name: "IP/IPv6 ignores ports",
+			policy: Policy{
+				Local: "[2001:db8::1]:0",
+				Peer:  "[2001:db8::2]:5000",
+				Encap: l2tp.EncapTypeIP,
+			},
+			want: selector{
+				saddr:  net.ParseIP("2001:db8::1"),
+				daddr:  net.ParseIP("2001:db8::2"),
+				family: unix.AF_INET6,
+				proto:  unix.IPPROTO_L2TP,
+			},
+		},
+		{
+			name: "Any IPv6 peer",
+			policy: Policy{
+				Local: "[2001:db8::1]:1701",
+				Encap: l2tp.EncapTypeUDP,
+			},
+			want: selector{
+				saddr:  net.ParseIP("2001:db8::1"),
+				daddr:  net.IPv6unspecified,
+				sport:  1701,
+				family: unix.AF_INET6,
+				proto:  unix.IPPROTO_UDP,
+			},
+		},
+		{
+			name: "Mixed address families",
+			policy: Policy{
+				Local: "192.168.0.1:1701",
+				Peer:  "[2001:db8::2]:1701",
+				Encap: l2tp.EncapTypeUDP,
+			},
+			expectFail: true,
+		},
+		{
+			name: "Bad port",
+			policy: Policy{
+				Local: "192.168.0.1:70000",
+				Encap: l2tp.EncapTypeUDP,
+			},
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sel, err := c.policy.selector()
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("selector(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selector(): %v", err)
+			}
+			if !sel.saddr.Equal(c.want.saddr) || !sel.daddr.Equal(c.want.daddr) ||
+				sel.sport != c.want.sport || sel.dport != c.want.dport ||
+				sel.family != c.want.family || sel.proto != c.want.proto {
+				t.Errorf("selector(): got %+v, want %+v", sel, c.want)
+			}
+		})
+	}
+}
+
+func TestEncodePolicyInfo(t *testing.T) {
+	sel := &selector{
+		saddr:  net.ParseIP("192.168.0.1"),
+		daddr:  net.IPv4zero,
+		sport:  1701,
+		family: unix.AF_INET,
+		proto:  unix.IPPROTO_UDP,
+	}
+	b := encodePolicyInfo(sel, xfrmPolicyOut, 10)
+	if len(b) != sizeofXfrmUserpolicyInfo {
+		t.Fatalf("encodePolicyInfo(): length %v, want %v", len(b), sizeofXfrmUserpolicyInfo)
+	}
+
+	// struct xfrm_selector
+	if !bytes.Equal(b[0:16], make([]byte, 16)) {
+		t.Errorf("daddr %x, want zero", b[0:16])
+	}
+	if !bytes.Equal(b[16:20], []byte{192, 168, 0, 1}) {
+		t.Errorf("saddr %x, want c0a80001", b[16:20])
+	}
+	if dport, mask := binary.BigEndian.Uint16(b[32:]), binary.BigEndian.Uint16(b[34:]); dport != 0 || mask != 0 {
+		t.Errorf("dport %v mask %x, want 0 mask 0", dport, mask)
+	}
+	if sport, mask := binary.BigEndian.Uint16(b[36:]), binary.BigEndian.Uint16(b[38:]); sport != 1701 || mask != 0xffff {
+		t.Errorf("sport %v mask %x, want 1701 mask ffff", sport, mask)
+	}
+	if family := nlenc.Uint16(b[40:42]); family != unix.AF_INET {
+		t.Errorf("family %v, want %v", family, unix.AF_INET)
+	}
+	if b[42] != 0 || b[43] != 32 || b[44] != unix.IPPROTO_UDP {
+		t.Errorf("prefixlen_d %v prefixlen_s %v proto %v, want 0 32 %v", b[42], b[43], b[44], unix.IPPROTO_UDP)
+	}
+
+	// struct xfrm_lifetime_cfg byte and packet limits
+	for i := 0; i < 4; i++ {
+		off := sizeofXfrmSelector + i*8
+		if v := nlenc.Uint64(b[off : off+8]); v != xfrmInf {
+			t.Errorf("lifetime limit %v: %x, want XFRM_INF", i, v)
+		}
+	}
+
+	if priority := nlenc.Uint32(b[152:156]); priority != 10 {
+		t.Errorf("priority %v, want 10", priority)
+	}
+	if b[160] != xfrmPolicyOut || b[161] != xfrmPolicyAllow {
+		t.Errorf("dir %v action %v, want %v %v", b[160], b[161], xfrmPolicyOut, xfrmPolicyAllow)
+	}
+}
+
+func TestEncodeTemplate(t *testing.T) {
+	b := encodeTemplate(unix.AF_INET6, 42)
+	if len(b) != sizeofXfrmUserTmpl {
+		t.Fatalf("encodeTemplate(): length %v, want %v", len(b), sizeofXfrmUserTmpl)
+	}
+	if b[20] != unix.IPPROTO_ESP {
+		t.Errorf("proto %v, want %v", b[20], unix.IPPROTO_ESP)
+	}
+	if family := nlenc.Uint16(b[24:26]); family != unix.AF_INET6 {
+		t.Errorf("family %v, want %v", family, unix.AF_INET6)
+	}
+	if reqID := nlenc.Uint32(b[44:48]); reqID != 42 {
+		t.Errorf("reqid %v, want 42", reqID)
+	}
+	if b[48] != xfrmModeTransport {
+		t.Errorf("mode %v, want transport", b[48])
+	}
+	for _, off := range []int{52, 56, 60} {
+		if v := nlenc.Uint32(b[off : off+4]); v != ^uint32(0) {
+			t.Errorf("algorithms at offset %v: %x, want all", off, v)
+		}
+	}
+}
+
+func TestEncodePolicyID(t *testing.T) {
+	sel := &selector{
+		saddr:  net.ParseIP("2001:db8::1"),
+		daddr:  net.ParseIP("2001:db8::2"),
+		family: unix.AF_INET6,
+		proto:  unix.IPPROTO_L2TP,
+	}
+	b := encodePolicyID(sel.reverse(), xfrmPolicyIn)
+	if len(b) != sizeofXfrmUserpolicyID {
+		t.Fatalf("encodePolicyID(): length %v, want %v", len(b), sizeofXfrmUserpolicyID)
+	}
+	if !bytes.Equal(b[0:16], sel.saddr.To16()) || !bytes.Equal(b[16:32], sel.daddr.To16()) {
+		t.Errorf("reversed addresses daddr %x saddr %x", b[0:16], b[16:32])
+	}
+	if b[42] != 128 || b[43] != 128 {
+		t.Errorf("prefixlen_d %v prefixlen_s %v, want 128 128", b[42], b[43])
+	}
+	if b[sizeofXfrmSelector+4] != xfrmPolicyIn {
+		t.Errorf("dir %v, want %v", b[sizeofXfrmSelector+4], xfrmPolicyIn)
+	}
+}
@@ -0,0 +1,139 @@
+package ipsec
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// xfrm netlink message types, as declared in linux/xfrm.h
+const (
+	xfrmMsgDelPolicy netlink.HeaderType = 0x14
+	xfrmMsgUpdPolicy netlink.HeaderType = 0x19
+)
+
+// xfrm netlink attribute types, as declared in linux/xfrm.h
+const (
+	xfrmaTmpl = 5
+)
+
+// Policy directions and actions, as declared in linux/xfrm.h
+const (
+	xfrmPolicyIn    = 0
+	xfrmPolicyOut   = 1
+	xfrmPolicyAllow = 0
+)
+
+// XFRM_MODE_TRANSPORT, as declared in linux/xfrm.h
+const xfrmModeTransport = 0
+
+// XFRM_INF, which disables a lifetime limit
+const xfrmInf = ^uint64(0)
+
+// Sizes of the xfrm structures, as laid out by the kernel
+const (
+	sizeofXfrmSelector       = 56
+	sizeofXfrmLifetimeCfg    = 64
+	sizeofXfrmLifetimeCur    = 32
+	sizeofXfrmUserpolicyInfo = 168
+	sizeofXfrmUserpolicyID   = 64
+	sizeofXfrmUserTmpl       = 64
+)
+
+// selector describes the packets an xfrm policy applies to.
+type selector struct {
+	saddr, daddr net.IP
+	sport, dport uint16
+	family       uint16
+	proto        uint8
+}
+
+// reverse returns the selector matching packets in the opposite direction.
+func (s *selector) reverse() *selector {
+	return &selector{
+		saddr:  s.daddr,
+		daddr:  s.saddr,
+		sport:  s.dport,
+		dport:  s.sport,
+		family: s.family,
+		proto:  s.proto,
+	}
+}
+
+// putAddress encodes an xfrm_address_t, returning the prefix length
+// which matches the address, or zero if the address is unspecified.
+func putAddress(b []byte, ip net.IP, family uint16) (prefixLen uint8) {
+	if ip.IsUnspecified() {
+		return 0
+	}
+	if family == unix.AF_INET {
+		copy(b, ip.To4())
+		return 32
+	}
+	copy(b, ip.To16())
+	return 128
+}
+
+// putPort encodes a port and its mask, which is zero if the port is
+// unspecified.
+func putPort(b []byte, port uint16) {
+	binary.BigEndian.PutUint16(b[0:], port)
+	if port != 0 {
+		binary.BigEndian.PutUint16(b[2:], 0xffff)
+	}
+}
+
+// encodeSelector encodes a struct xfrm_selector.
+func encodeSelector(b []byte, s *selector) {
+	b[42] = putAddress(b[0:16], s.daddr, s.family)
+	b[43] = putAddress(b[16:32], s.saddr, s.family)
+	putPort(b[32:36], s.dport)
+	putPort(b[36:40], s.sport)
+	nlenc.PutUint16(b[40:42], s.family)
+	b[44] = s.proto
+}
+
+// encodePolicyInfo encodes a struct xfrm_userpolicy_info describing a
+// policy which allows packets matching the selector.
+func encodePolicyInfo(s *selector, dir uint8, priority uint32) []byte {
+	b := make([]byte, sizeofXfrmUserpolicyInfo)
+	encodeSelector(b, s)
+
+	// Byte and packet limits of the lifetime configuration
+	lft := b[sizeofXfrmSelector:]
+	for i := 0; i < 4; i++ {
+		nlenc.PutUint64(lft[i*8:i*8+8], xfrmInf)
+	}
+
+	off := sizeofXfrmSelector + sizeofXfrmLifetimeCfg + sizeofXfrmLifetimeCur
+	nlenc.PutUint32(b[off:off+4], priority)
+	b[off+8] = dir
+	b[off+9] = xfrmPolicyAllow
+	return b
+}
+
+// encodePolicyID encodes a struct xfrm_userpolicy_id identifying a policy
+// by its selector.
+func encodePolicyID(s *selector, dir uint8) []byte {
+	b := make([]byte, sizeofXfrmUserpolicyID)
+	encodeSelector(b, s)
+	b[sizeofXfrmSelector+4] = dir
+	return b
+}
+
+// encodeTemplate encodes a struct xfrm_user_tmpl requiring ESP transport
+// mode, using any algorithms.
+func encodeTemplate(family uint16, reqID uint32) []byte {
+	b := make([]byte, sizeofXfrmUserTmpl)
+	b[20] = unix.IPPROTO_ESP
+	nlenc.PutUint16(b[24:26], family)
+	nlenc.PutUint32(b[44:48], reqID)
+	b[48] = xfrmModeTransport
+	for _, off := range []int{52, 56, 60} {
+		nlenc.PutUint32(b[off:off+4], ^uint32(0))
+	}
+	return b
+}
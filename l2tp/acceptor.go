@@ -0,0 +1,173 @@
+package l2tp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// IncomingCall describes a session requested by the peer of a dynamic
+// tunnel, as conveyed by the Incoming-Call-Request (ICRQ) message.
+//
+// The optional fields are zero if the peer didn't include the
+// corresponding AVP in the ICRQ.
+type IncomingCall struct {
+	TunnelName string
+	Tunnel     Tunnel
+	// PeerSessionID is the session ID assigned by the peer.
+	PeerSessionID ControlConnID
+	// Pseudowire is the pseudowire type requested by the peer, which
+	// is always PseudowireTypePPP for L2TPv2.
+	Pseudowire PseudowireType
+	// RemoteEndID identifies the local circuit the peer wants the
+	// session connected to (L2TPv3 only).
+	RemoteEndID []byte
+	// CallSerialNumber is the identifier assigned to the call by the peer.
+	CallSerialNumber uint32
+	// BearerType is the bearer type of the call (optional).
+	BearerType uint32
+	// PhysicalChannelID is the peer's physical channel ID for the
+	// call (optional).
+	PhysicalChannelID uint32
+	// CallingNumber is the calling number of the call (optional).
+	CallingNumber string
+	// CalledNumber is the called number of the call (optional).
+	CalledNumber string
+	// SubAddress is the sub-address of the call (optional).
+	SubAddress string
+}
+
+// CallDecision is a SessionAcceptor's response to an IncomingCall.
+type CallDecision struct {
+	// Accept is set to accept the call, creating a session in the tunnel.
+	Accept bool
+
+	// SessionName is the name of the accepted session, which must be
+	// unique in the tunnel.  If unset the session is named using the
+	// tunnel name and the session ID.
+	SessionName string
+
+	// SessionConfig is the configuration of the accepted session.  The
+	// peer session ID is taken from the call, and a session ID allocated
+	// if the configuration doesn't specify one.  For L2TPv3 the pseudowire
+	// type is taken from the call if the configuration doesn't specify
+	// one, and must match the call's pseudowire type otherwise.
+	// If nil, a PPP session is created using the default configuration.
+	SessionConfig *SessionConfig
+
+	// Result, ErrorCode and Message are sent to the peer in the
+	// Call-Disconnect-Notify (CDN) message if the call is rejected.
+	// If Result is unset CDNResultGeneralError is sent.
+	Result    ResultCode
+	ErrorCode ErrorCode
+	Message   string
+}
+
+// SessionAcceptor decides whether to accept sessions requested by the
+// peers of dynamic tunnels.
+type SessionAcceptor interface {
+	// AcceptSession is called on receipt of each ICRQ from the peer.
+	// Returning nil rejects the call with CDNResultGeneralError.
+	//
+	// AcceptSession is called from the goroutine of the tunnel
+	// receiving the ICRQ, so should not block.
+	AcceptSession(call *IncomingCall) *CallDecision
+}
+
+// rejectAllSessions is the default SessionAcceptor, which rejects all
+// incoming calls.
+type rejectAllSessions struct{}
+
+func (rejectAllSessions) AcceptSession(call *IncomingCall) *CallDecision {
+	return &CallDecision{
+		Result:  CDNResultNotAvailable,
+		Message: "incoming calls not accepted",
+	}
+}
+
+// EndIDMatcher is a SessionAcceptor which pairs incoming L2TPv3 calls with
+// locally configured circuits using the Remote End ID the peer sends in the
+// ICRQ.  Calls for a known circuit are accepted using the circuit's session
+// configuration, while calls for an unknown circuit are rejected with
+// CDNResultInvalidDestination.
+//
+// Calls without a Remote End ID, which includes all L2TPv2 calls, are
+// passed to the Fallback acceptor if it is set, and rejected otherwise.
+type EndIDMatcher struct {
+	// Fallback decides whether to accept calls which don't identify a
+	// circuit.  It must be set before the matcher is used.
+	Fallback SessionAcceptor
+
+	lock     sync.Mutex
+	circuits map[string]endIDCircuit
+}
+
+type endIDCircuit struct {
+	sessionName string
+	cfg         *SessionConfig
+}
+
+// NewEndIDMatcher creates a new EndIDMatcher with no circuits.
+func NewEndIDMatcher() *EndIDMatcher {
+	return &EndIDMatcher{
+		circuits: make(map[string]endIDCircuit),
+	}
+}
+
+// AddCircuit registers the circuit identified by endID with the matcher.
+// Sessions accepted for the circuit are named sessionName, which may be
+// empty for the default name, and use a copy of cfg, which may be nil for
+// the default configuration.
+func (m *EndIDMatcher) AddCircuit(endID []byte, sessionName string, cfg *SessionConfig) error {
+	if len(endID) == 0 {
+		return errors.New("circuit end ID may not be empty")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.circuits[string(endID)]; ok {
+		return fmt.Errorf("already have circuit %q", endID)
+	}
+	m.circuits[string(endID)] = endIDCircuit{sessionName: sessionName, cfg: cfg}
+	return nil
+}
+
+// RemoveCircuit removes the circuit identified by endID from the matcher.
+// Sessions already accepted for the circuit are unaffected.
+func (m *EndIDMatcher) RemoveCircuit(endID []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.circuits, string(endID))
+}
+
+// AcceptSession implements SessionAcceptor.
+func (m *EndIDMatcher) AcceptSession(call *IncomingCall) *CallDecision {
+	if len(call.RemoteEndID) == 0 {
+		if m.Fallback != nil {
+			return m.Fallback.AcceptSession(call)
+		}
+		return &CallDecision{
+			Result:  CDNResultInvalidDestination,
+			Message: "no remote end ID",
+		}
+	}
+
+	m.lock.Lock()
+	circuit, ok := m.circuits[string(call.RemoteEndID)]
+	m.lock.Unlock()
+	if !ok {
+		return &CallDecision{
+			Result:  CDNResultInvalidDestination,
+			Message: fmt.Sprintf("unknown remote end ID %q", call.RemoteEndID),
+		}
+	}
+
+	scfg := &SessionConfig{}
+	if circuit.cfg != nil {
+		*scfg = *circuit.cfg
+	}
+	return &CallDecision{
+		Accept:        true,
+		SessionName:   circuit.sessionName,
+		SessionConfig: scfg,
+	}
+}
@@ -0,0 +1,52 @@
+package l2tp
+
+import (
+	"testing"
+)
+
+func TestEndIDMatcher(t *testing.T) {
+	m := NewEndIDMatcher()
+	cfg := &SessionConfig{Pseudowire: PseudowireTypeEth, MTU: 1400}
+	if err := m.AddCircuit([]byte("circuit1"), "c1", cfg); err != nil {
+		t.Fatalf("AddCircuit(): %v", err)
+	}
+	if err := m.AddCircuit([]byte("circuit2"), "", nil); err != nil {
+		t.Fatalf("AddCircuit(): %v", err)
+	}
+	if err := m.AddCircuit([]byte("circuit1"), "c1", cfg); err == nil {
+		t.Errorf("AddCircuit() succeeded for duplicate circuit")
+	}
+	if err := m.AddCircuit(nil, "c3", cfg); err == nil {
+		t.Errorf("AddCircuit() succeeded for empty end ID")
+	}
+
+	d := m.AcceptSession(&IncomingCall{RemoteEndID: []byte("circuit1")})
+	if !d.Accept || d.SessionName != "c1" || d.SessionConfig.MTU != cfg.MTU {
+		t.Errorf("circuit1: unexpected decision %+v", d)
+	}
+	if d.SessionConfig == cfg {
+		t.Errorf("circuit1: decision shares the circuit's configuration")
+	}
+	d = m.AcceptSession(&IncomingCall{RemoteEndID: []byte("circuit2")})
+	if !d.Accept || d.SessionName != "" || d.SessionConfig == nil {
+		t.Errorf("circuit2: unexpected decision %+v", d)
+	}
+
+	m.RemoveCircuit([]byte("circuit2"))
+	for _, id := range []string{"circuit2", "unknown", ""} {
+		d = m.AcceptSession(&IncomingCall{RemoteEndID: []byte(id)})
+		if d.Accept || d.Result != CDNResultInvalidDestination {
+			t.Errorf("%q: unexpected decision %+v", id, d)
+		}
+	}
+
+	// Calls without an end ID are passed to the fallback acceptor
+	m.Fallback = &testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 1),
+		decision: &CallDecision{Accept: true, SessionName: "fallback"},
+	}
+	d = m.AcceptSession(&IncomingCall{Pseudowire: PseudowireTypePPP})
+	if !d.Accept || d.SessionName != "fallback" {
+		t.Errorf("fallback: unexpected decision %+v", d)
+	}
+}
@@ -0,0 +1,278 @@
+package l2tp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// The default length of the random Challenge or Control Message
+// Authentication Nonce we send to the peer, and the range of lengths
+// TunnelConfig.ChallengeLength may specify.
+const (
+	defaultChallengeLen = 16
+	minChallengeLen     = 16
+	maxChallengeLen     = 64
+)
+
+// newChallenge generates a random Challenge or Control Message
+// Authentication Nonce of the specified length.
+func newChallenge(length int) ([]byte, error) {
+	challenge := make([]byte, length)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// checkChallengeLength validates TunnelConfig.ChallengeLength.
+func checkChallengeLength(length int) error {
+	if length != 0 && (length < minChallengeLen || length > maxChallengeLen) {
+		return fmt.Errorf("challenge length %v out of range %v-%v", length, minChallengeLen, maxChallengeLen)
+	}
+	return nil
+}
+
+// zeroize overwrites key material once it is no longer needed, so that
+// it doesn't linger in memory.
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// tunnelSecrets returns the secrets the tunnel configuration accepts from
+// the peer, in order of preference.
+func tunnelSecrets(cfg *TunnelConfig) []string {
+	var secrets []string
+	for _, secret := range []string{cfg.Secret, cfg.AlternateSecret} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// challengeResponse computes the Challenge Response for a challenge, to
+// be sent in a message of the specified type.
+// Ref: RFC2661 section 4.4.3.
+func challengeResponse(msgType avpMsgType, secret string, challenge []byte) []byte {
+	key := []byte(secret)
+	defer zeroize(key)
+
+	h := md5.New()
+	h.Write([]byte{byte(msgType)})
+	h.Write(key)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// Digest types for the Message Digest AVP.
+// Ref: RFC3931 section 5.4.1.
+const (
+	digestTypeHMACMD5  = byte(0)
+	digestTypeHMACSHA1 = byte(1)
+)
+
+// digestHash returns the hash function for a Message Digest AVP digest type.
+func digestHash(digestType byte) (func() hash.Hash, error) {
+	switch digestType {
+	case digestTypeHMACMD5:
+		return md5.New, nil
+	case digestTypeHMACSHA1:
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("unsupported digest type %v", digestType)
+}
+
+// v3Auth authenticates L2TPv3 control messages using the Control Message
+// Authentication Nonce and Message Digest AVPs.
+// Ref: RFC3931 section 4.3.
+//
+// The transport signs and verifies messages from its sender and receiver
+// goroutines respectively, so access to the peer's nonce and the keys in
+// use is locked.
+//
+// Messages from the peer are verified using the keys derived from each of
+// the secrets, which allows the secret to be rotated.  Messages are signed
+// using the keys of the secret the peer was last seen using, or the first
+// secret until the peer has been verified.
+//
+// Only the keys derived from the shared secrets are retained, and these
+// are zeroized by destroy once the tunnel has closed.
+type v3Auth struct {
+	keys       []map[byte][]byte
+	localNonce []byte
+	lock       sync.Mutex
+	peerNonce  []byte
+	active     int
+}
+
+func newV3Auth(secrets []string, nonceLen int) (*v3Auth, error) {
+	nonce, err := newChallenge(nonceLen)
+	if err != nil {
+		return nil, err
+	}
+	a := &v3Auth{localNonce: nonce}
+	for _, secret := range secrets {
+		keys := make(map[byte][]byte)
+		for _, digestType := range []byte{digestTypeHMACMD5, digestTypeHMACSHA1} {
+			newHash, _ := digestHash(digestType)
+			keys[digestType] = deriveKey(newHash, secret)
+		}
+		a.keys = append(a.keys, keys)
+	}
+	return a, nil
+}
+
+// destroy zeroizes the keys and nonces.  It must not be called while
+// messages may still be signed or verified.
+func (a *v3Auth) destroy() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, keys := range a.keys {
+		for _, key := range keys {
+			zeroize(key)
+		}
+	}
+	zeroize(a.localNonce)
+	zeroize(a.peerNonce)
+}
+
+// signingKey returns the hash function and key for signing a message
+// with a Message Digest AVP digest type.
+func (a *v3Auth) signingKey(digestType byte) (func() hash.Hash, []byte, error) {
+	newHash, err := digestHash(digestType)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return newHash, a.keys[a.active][digestType], nil
+}
+
+func (a *v3Auth) getPeerNonce() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.peerNonce
+}
+
+func (a *v3Auth) setPeerNonce(nonce []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.peerNonce = nonce
+}
+
+// deriveKey derives the key used to compute message digests from the
+// shared secret, in order that the secret isn't used directly.
+func deriveKey(newHash func() hash.Hash, secret string) []byte {
+	s := []byte(secret)
+	defer zeroize(s)
+
+	kh := hmac.New(newHash, s)
+	kh.Write([]byte{2})
+	return kh.Sum(nil)
+}
+
+// messageDigest computes the digest of an encoded control message, whose
+// Message Digest AVP value is zeroed.  The sender's nonce is followed by
+// the receiver's nonce, neither of which are known when the SCCRQ is sent.
+func messageDigest(newHash func() hash.Hash, key []byte, msgType avpMsgType, senderNonce, receiverNonce, b []byte) []byte {
+	h := hmac.New(newHash, key)
+	if msgType != avpMsgTypeSccrq {
+		h.Write(senderNonce)
+		h.Write(receiverNonce)
+	}
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// encodeForDigest encodes a message for computing its digest.  The Message
+// Digest AVP must immediately follow the Message Type AVP.
+func encodeForDigest(msg *v3ControlMessage) (b []byte, digestType byte, err error) {
+	avps := msg.getAvps()
+	if len(avps) < 2 || avps[1].getType() != avpTypeMessageDigest || len(avps[1].payload.data) < 1 {
+		return nil, 0, errors.New("no Message Digest AVP following the Message Type AVP")
+	}
+	b, err = msg.toBytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	digestType = avps[1].payload.data[0]
+	start := v3HeaderLen + avps[0].totalLen() + avpHeaderLen + 1
+	end := v3HeaderLen + avps[0].totalLen() + avps[1].totalLen()
+	for i := start; i < end; i++ {
+		b[i] = 0
+	}
+	return b, digestType, nil
+}
+
+// sign adds a Message Digest AVP to a message, or updates the one already
+// present if the message is being retransmitted.
+func (a *v3Auth) sign(msg *v3ControlMessage) error {
+	avps := msg.getAvps()
+	if len(avps) < 2 || avps[1].getType() != avpTypeMessageDigest {
+		value := make([]byte, 1+md5.Size)
+		value[0] = digestTypeHMACMD5
+		digest, err := newAvp(vendorIDIetf, avpTypeMessageDigest, value)
+		if err != nil {
+			return err
+		}
+		msg.avps = append(avps[:1], append([]avp{*digest}, avps[1:]...)...)
+		msg.header.Common.Len += uint16(digest.totalLen())
+	}
+
+	b, digestType, err := encodeForDigest(msg)
+	if err != nil {
+		return err
+	}
+	newHash, key, err := a.signingKey(digestType)
+	if err != nil {
+		return err
+	}
+	copy(msg.avps[1].payload.data[1:],
+		messageDigest(newHash, key, msg.getType(), a.localNonce, a.getPeerNonce(), b))
+	return nil
+}
+
+// verify checks the Message Digest AVP of a message received from the peer.
+// The peer's nonce is learnt from its SCCRQ or SCCRP.
+func (a *v3Auth) verify(msg *v3ControlMessage) error {
+	peerNonce := a.getPeerNonce()
+	isScc := msg.getType() == avpMsgTypeSccrq || msg.getType() == avpMsgTypeSccrp
+	if isScc {
+		nonce, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeControlAuthNonce)
+		if err != nil {
+			return fmt.Errorf("no Control Message Authentication Nonce AVP in %v", msg.getType())
+		}
+		peerNonce = append([]byte{}, nonce...)
+	}
+
+	b, digestType, err := encodeForDigest(msg)
+	if err != nil {
+		return err
+	}
+	newHash, err := digestHash(digestType)
+	if err != nil {
+		return err
+	}
+	for i, keys := range a.keys {
+		want := messageDigest(newHash, keys[digestType], msg.getType(), peerNonce, a.localNonce, b)
+		if hmac.Equal(msg.getAvps()[1].payload.data[1:], want) {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			a.active = i
+			if isScc {
+				a.peerNonce = peerNonce
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("incorrect Message Digest in %v", msg.getType())
+}
@@ -0,0 +1,233 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestChallengeResponse(t *testing.T) {
+	challenge := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	cases := []struct {
+		msgType avpMsgType
+		want    string
+	}{
+		{avpMsgTypeSccrp, "dd4186e2196f00124a9d588f02701259"},
+		{avpMsgTypeScccn, "8f3c2fa6fcfea72215ae83ea89ec2b77"},
+	}
+	for _, c := range cases {
+		t.Run(c.msgType.String(), func(t *testing.T) {
+			want, _ := hex.DecodeString(c.want)
+			got := challengeResponse(c.msgType, "secret", challenge)
+			if !bytes.Equal(got, want) {
+				t.Errorf("challengeResponse(%v): got %x, want %x", c.msgType, got, want)
+			}
+		})
+	}
+}
+
+func TestNewChallenge(t *testing.T) {
+	for _, length := range []int{minChallengeLen, maxChallengeLen} {
+		a, err := newChallenge(length)
+		if err != nil {
+			t.Fatalf("newChallenge(%v): %v", length, err)
+		}
+		b, err := newChallenge(length)
+		if err != nil {
+			t.Fatalf("newChallenge(%v): %v", length, err)
+		}
+		if len(a) != length || bytes.Equal(a, b) {
+			t.Errorf("newChallenge(%v): got %x then %x", length, a, b)
+		}
+	}
+}
+
+func TestCheckChallengeLength(t *testing.T) {
+	cases := []struct {
+		length  int
+		wantErr bool
+	}{
+		{0, false},
+		{minChallengeLen, false},
+		{maxChallengeLen, false},
+		{minChallengeLen - 1, true},
+		{maxChallengeLen + 1, true},
+	}
+	for _, c := range cases {
+		err := checkChallengeLength(c.length)
+		if (err != nil) != c.wantErr {
+			t.Errorf("checkChallengeLength(%v): got %v, want error %v", c.length, err, c.wantErr)
+		}
+	}
+}
+
+func TestV3AuthDestroy(t *testing.T) {
+	a, err := newV3Auth([]string{"secret", "alternate"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	a.setPeerNonce([]byte{1, 2, 3, 4})
+	a.destroy()
+
+	zero := func(b []byte) bool {
+		for _, v := range b {
+			if v != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, keys := range a.keys {
+		for digestType, key := range keys {
+			if len(key) == 0 || !zero(key) {
+				t.Errorf("destroy(): key for digest type %v not zeroized: %x", digestType, key)
+			}
+		}
+	}
+	if !zero(a.localNonce) || !zero(a.peerNonce) {
+		t.Errorf("destroy(): nonces not zeroized: %x %x", a.localNonce, a.peerNonce)
+	}
+}
+
+func TestV3Auth(t *testing.T) {
+	lac, err := newV3Auth([]string{"secret"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	lns, err := newV3Auth([]string{"secret"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	intruder, err := newV3Auth([]string{"wrong"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	cfg := &TunnelConfig{HostName: "lac", TunnelID: 42, PeerTunnelID: 90210}
+
+	// Messages are received in encoded form, so each signed message is
+	// encoded and parsed before it is verified
+	roundTrip := func(msg *v3ControlMessage) *v3ControlMessage {
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("toBytes(): %v", err)
+		}
+		parsed, err := bytesToV3CtlMsg(b, nil)
+		if err != nil {
+			t.Fatalf("bytesToV3CtlMsg(): %v", err)
+		}
+		return parsed
+	}
+
+	sccrq, err := newV3Sccrq(cfg, nil, lac.localNonce)
+	if err != nil {
+		t.Fatalf("newV3Sccrq(): %v", err)
+	}
+	if err = lac.sign(sccrq); err != nil {
+		t.Fatalf("sign(SCCRQ): %v", err)
+	}
+	if err = sccrq.validate(); err != nil {
+		t.Fatalf("validate(SCCRQ): %v", err)
+	}
+	if err = intruder.verify(roundTrip(sccrq)); err == nil {
+		t.Errorf("verify(SCCRQ) succeeded with the wrong secret")
+	}
+	if err = lns.verify(roundTrip(sccrq)); err != nil {
+		t.Fatalf("verify(SCCRQ): %v", err)
+	}
+
+	sccrp, err := newV3Sccrp(cfg, lns.localNonce)
+	if err != nil {
+		t.Fatalf("newV3Sccrp(): %v", err)
+	}
+	if err = lns.sign(sccrp); err != nil {
+		t.Fatalf("sign(SCCRP): %v", err)
+	}
+	if err = lac.verify(roundTrip(sccrp)); err != nil {
+		t.Fatalf("verify(SCCRP): %v", err)
+	}
+
+	// Retransmission with updated sequence numbers signs the message afresh
+	scccn, err := newV3Scccn(cfg)
+	if err != nil {
+		t.Fatalf("newV3Scccn(): %v", err)
+	}
+	if err = lac.sign(scccn); err != nil {
+		t.Fatalf("sign(SCCCN): %v", err)
+	}
+	scccn.setTransportSeqNum(1, 1)
+	if err = lac.sign(scccn); err != nil {
+		t.Fatalf("sign(SCCCN): %v", err)
+	}
+	if n := len(scccn.getAvps()); n != 2 {
+		t.Errorf("signed SCCCN has %v AVPs, want 2", n)
+	}
+	if err = lns.verify(roundTrip(scccn)); err != nil {
+		t.Fatalf("verify(SCCCN): %v", err)
+	}
+
+	// Tampering with the message invalidates the digest
+	tampered := roundTrip(scccn)
+	tampered.setTransportSeqNum(2, 1)
+	if err = lns.verify(tampered); err == nil {
+		t.Errorf("verify() succeeded for tampered message")
+	}
+
+	// A message without a digest fails
+	unsigned, err := newV3Scccn(cfg)
+	if err != nil {
+		t.Fatalf("newV3Scccn(): %v", err)
+	}
+	if err = lns.verify(roundTrip(unsigned)); err == nil {
+		t.Errorf("verify() succeeded for message without a digest")
+	}
+}
+
+func TestV3AuthAlternateSecret(t *testing.T) {
+	// The LAC hasn't rotated its secret, while the LNS accepts either
+	lac, err := newV3Auth([]string{"old"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	lns, err := newV3Auth([]string{"new", "old"}, defaultChallengeLen)
+	if err != nil {
+		t.Fatalf("newV3Auth(): %v", err)
+	}
+	cfg := &TunnelConfig{HostName: "lac", TunnelID: 42, PeerTunnelID: 90210}
+
+	roundTrip := func(msg *v3ControlMessage) *v3ControlMessage {
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("toBytes(): %v", err)
+		}
+		parsed, err := bytesToV3CtlMsg(b, nil)
+		if err != nil {
+			t.Fatalf("bytesToV3CtlMsg(): %v", err)
+		}
+		return parsed
+	}
+
+	sccrq, err := newV3Sccrq(cfg, nil, lac.localNonce)
+	if err != nil {
+		t.Fatalf("newV3Sccrq(): %v", err)
+	}
+	if err = lac.sign(sccrq); err != nil {
+		t.Fatalf("sign(SCCRQ): %v", err)
+	}
+	if err = lns.verify(roundTrip(sccrq)); err != nil {
+		t.Fatalf("verify(SCCRQ): %v", err)
+	}
+
+	// Having verified the LAC using the alternate secret, the LNS signs
+	// its messages using the same secret
+	sccrp, err := newV3Sccrp(cfg, lns.localNonce)
+	if err != nil {
+		t.Fatalf("newV3Sccrp(): %v", err)
+	}
+	if err = lns.sign(sccrp); err != nil {
+		t.Fatalf("sign(SCCRP): %v", err)
+	}
+	if err = lac.verify(roundTrip(sccrp)); err != nil {
+		t.Fatalf("verify(SCCRP): %v", err)
+	}
+}
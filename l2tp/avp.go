@@ -48,6 +48,10 @@ type avpPayload struct {
 type avp struct {
 	header  avpHeader
 	payload avpPayload
+	// superseded is set for a duplicate AVP which is ignored according
+	// to the DuplicateAVPPolicy.  It remains in the message so that the
+	// message encodes as it was received.
+	superseded bool
 }
 
 // avpResultCode represents an RFC2661/RFC3931 result code
@@ -87,6 +91,8 @@ const (
 	avpDataTypeResultCode avpDataType = iota
 	// avpDataTypeMsgID represents an AVP carrying the message type identifier
 	avpDataTypeMsgID avpDataType = iota
+	// avpDataTypeUint16Array represents an AVP carrying a list of uint16 values
+	avpDataTypeUint16Array avpDataType = iota
 	// avpDataTypeUnimplemented represents an AVP carrying a currently unimplemented data type
 	avpDataTypeUnimplemented avpDataType = iota
 	// avpDataTypeIllegal represents an AVP carrying an illegal data type.
@@ -160,7 +166,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeMessageDigest, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRouterID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedConnID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
-	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented},
+	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint16Array},
 	{avpType: avpTypeLocalSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeRemoteSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedCookie, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
@@ -317,6 +323,7 @@ const (
 	avpCDNResultCodeNoDialTone                            avpResultCode = 9
 	avpCDNResultCodeTimeout                               avpResultCode = 10
 	avpCDNResultCodeBadTransport                          avpResultCode = 11
+	avpCDNResultCodeUnsupportedPseudowire                 avpResultCode = 14
 )
 
 // AVP error codes as per RFC2661 and RFC3931
@@ -605,6 +612,8 @@ func (t avpDataType) String() string {
 		return "result code"
 	case avpDataTypeMsgID:
 		return "message ID"
+	case avpDataTypeUint16Array:
+		return "uint16 array"
 	case avpDataTypeUnimplemented:
 		return "unimplemented AVP data type"
 	case avpDataTypeIllegal:
@@ -655,6 +664,9 @@ func (p avpPayload) String() string {
 		str.WriteString(s)
 	case avpDataTypeBytes:
 		str.WriteString(fmt.Sprintf("%s", p.data))
+	case avpDataTypeUint16Array:
+		v, _ := p.toUint16Array()
+		str.WriteString(fmt.Sprintf("%v", v))
 	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal:
 		str.WriteString("")
 	}
@@ -738,9 +750,24 @@ func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
 	return nil, errors.New("unrecognised AVP type")
 }
 
+// avpKey identifies an AVP type for the detection of duplicate AVPs.
+type avpKey struct {
+	vendorID avpVendorID
+	typ      avpType
+}
+
 // parseAVPBuffer takes a byte slice of encoded AVP data and parses it
 // into an array of AVP instances.
-func parseAVPBuffer(b []byte) (avps []avp, err error) {
+// If opts is nil the default parser options apply.
+func parseAVPBuffer(b []byte, opts *parserOptions) (avps []avp, err error) {
+	var haveRandomVector bool
+	var n int
+	seen := make(map[avpKey]int)
+
+	if opts == nil {
+		opts = &defaultParserOptions
+	}
+
 	r := bytes.NewReader(b)
 	for r.Len() >= avpHeaderLen {
 		var h avpHeader
@@ -752,6 +779,32 @@ func parseAVPBuffer(b []byte) (avps []avp, err error) {
 			return nil, err
 		}
 
+		// Bounds check the AVP
+		if h.totalLen() < avpHeaderLen {
+			return nil, fmt.Errorf("malformed AVP buffer: AVP length %d is shorter than the AVP header", h.totalLen())
+		}
+		if h.dataLen() > r.Len() {
+			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
+		}
+
+		// Unrecognised AVPs count towards the limits, since they must
+		// still be parsed
+		if n++; n > opts.maxAVPs {
+			return nil, &ParserLimitError{Limit: "AVPs per message", Max: opts.maxAVPs}
+		}
+		if h.dataLen() > opts.maxAVPLen {
+			return nil, &ParserLimitError{Limit: "bytes of AVP payload", Max: opts.maxAVPLen}
+		}
+
+		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
+			return nil, errors.New("malformed AVP buffer: unable to determine offset of current AVP")
+		}
+
+		// Step on to the next AVP in the buffer
+		if _, err := r.Seek(int64(h.dataLen()), io.SeekCurrent); err != nil {
+			return nil, errors.New("malformed AVP buffer: invalid length for current AVP")
+		}
+
 		// Look up the AVP
 		info, err := getAVPInfo(h.AvpType, h.VendorID)
 		if err != nil {
@@ -763,27 +816,53 @@ func parseAVPBuffer(b []byte) (avps []avp, err error) {
 			continue
 		}
 
-		// Bounds check the AVP
-		if h.dataLen() > r.Len() {
-			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
+		// RFC2661 section 4.3: the Random Vector AVP must precede
+		// the first hidden AVP in a message, and neither the Message Type
+		// nor the Random Vector AVPs may themselves be hidden.
+		if h.VendorID == vendorIDIetf {
+			switch h.AvpType {
+			case avpTypeMessage, avpTypeRandomVector:
+				if h.isHidden() {
+					return nil, fmt.Errorf("malformed AVP buffer: %v must not be hidden", h.AvpType)
+				}
+				if h.AvpType == avpTypeRandomVector {
+					haveRandomVector = true
+				}
+			}
 		}
-
-		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed AVP buffer: unable to determine offset of current AVP")
+		if h.isHidden() && !haveRandomVector {
+			return nil, fmt.Errorf("malformed AVP buffer: hidden %v not preceded by Random Vector AVP", h.AvpType)
 		}
 
-		avps = append(avps, avp{
+		newAvp := avp{
 			header: h,
 			payload: avpPayload{
 				dataType: info.dataType,
 				data:     b[cursor : cursor+int64(h.dataLen())],
 			},
-		})
+		}
 
-		// Step on to the next AVP in the buffer
-		if _, err := r.Seek(int64(h.dataLen()), io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed AVP buffer: invalid length for current AVP")
+		// Apply the duplicate AVP policy.  The Random Vector AVP may
+		// occur before each hidden AVP, and the first Message Type AVP
+		// always identifies the message.
+		key := avpKey{vendorID: h.VendorID, typ: h.AvpType}
+		prev, dup := seen[key]
+		if dup && !(h.VendorID == vendorIDIetf && h.AvpType == avpTypeRandomVector) {
+			switch {
+			case h.VendorID == vendorIDIetf && h.AvpType == avpTypeMessage:
+				newAvp.superseded = true
+			case opts.duplicates == DuplicateAVPReject:
+				return nil, fmt.Errorf("malformed AVP buffer: duplicate %v", h.AvpType)
+			case opts.duplicates == DuplicateAVPLast:
+				avps[prev].superseded = true
+				seen[key] = len(avps)
+			default:
+				newAvp.superseded = true
+			}
+		} else {
+			seen[key] = len(avps)
 		}
+		avps = append(avps, newAvp)
 	}
 
 	// We must have parsed at least one AVP
@@ -818,6 +897,10 @@ func encodePayload(info *avpInfo, value interface{}) ([]byte, error) {
 
 	switch info.dataType {
 	case avpDataTypeEmpty:
+		if value != nil {
+			return nil, fmt.Errorf("wrong data type %T passed for %v", value, info.avpType)
+		}
+		return []byte{}, nil
 	case avpDataTypeUint16:
 		_, ok = value.(uint16)
 	case avpDataTypeUint32:
@@ -832,6 +915,8 @@ func encodePayload(info *avpInfo, value interface{}) ([]byte, error) {
 		_, ok = value.([]byte)
 	case avpDataTypeMsgID:
 		_, ok = value.(avpMsgType)
+	case avpDataTypeUint16Array:
+		_, ok = value.([]uint16)
 	case avpDataTypeResultCode:
 		var rc resultCode
 		rc, ok = value.(resultCode)
@@ -882,6 +967,75 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 	}, nil
 }
 
+// newExtraAvp builds an AVP from an application-supplied description.
+// Since the AVP may be vendor-specific it is encoded without reference to
+// the AVP info table.
+func newExtraAvp(e *ExtraAVP) (a *avp, err error) {
+
+	if e.VendorID == vendorIDIetf && avpType(e.Type) == avpTypeMessage {
+		return nil, fmt.Errorf("Message Type AVP may not be supplied by the application")
+	}
+
+	var buf []byte
+	switch v := e.Value.(type) {
+	case nil:
+		buf = []byte{}
+	case uint16, uint32, uint64:
+		encBuf := new(bytes.Buffer)
+		err = binary.Write(encBuf, binary.BigEndian, v)
+		if err != nil {
+			return nil, err
+		}
+		buf = encBuf.Bytes()
+	case string:
+		buf = []byte(v)
+	case []byte:
+		buf = v
+	default:
+		return nil, fmt.Errorf("unsupported data type %T for AVP value", e.Value)
+	}
+
+	if len(buf)+avpHeaderLen > 0x3ff {
+		return nil, fmt.Errorf("AVP value length %v exceeds maximum", len(buf))
+	}
+
+	return &avp{
+		header: *newAvpHeader(e.Mandatory, false, uint(len(buf)), avpVendorID(e.VendorID), avpType(e.Type)),
+		payload: avpPayload{
+			dataType: avpDataTypeBytes,
+			data:     buf,
+		},
+	}, nil
+}
+
+// validateExtraAVPs checks that a list of application-supplied AVPs
+// can be encoded, and that they are to be appended to allowed message
+// types only.
+func validateExtraAVPs(extra []ExtraAVP, allowed ...MessageType) error {
+	for i := range extra {
+		if len(extra[i].Messages) == 0 {
+			return fmt.Errorf("extra AVP %v:%v has no message types", extra[i].VendorID, extra[i].Type)
+		}
+		for _, mt := range extra[i].Messages {
+			ok := false
+			for _, a := range allowed {
+				if mt == a {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return fmt.Errorf("extra AVP %v:%v cannot be added to %v messages",
+					extra[i].VendorID, extra[i].Type, mt)
+			}
+		}
+		if _, err := newExtraAvp(&extra[i]); err != nil {
+			return fmt.Errorf("extra AVP %v:%v: %v", extra[i].VendorID, extra[i].Type, err)
+		}
+	}
+	return nil
+}
+
 // rawData returns the data type for the AVP, along with the raw byte
 // slice for the data carried by the AVP.
 func (avp *avp) rawData() (dataType avpDataType, buffer []byte) {
@@ -926,6 +1080,18 @@ func (p *avpPayload) toUint64() (out uint64, err error) {
 	return out, err
 }
 
+func (p *avpPayload) toUint16Array() (out []uint16, err error) {
+	if len(p.data)%2 != 0 {
+		return nil, fmt.Errorf("AVP payload length %v is not a multiple of 2", len(p.data))
+	}
+	out = make([]uint16, len(p.data)/2)
+	r := bytes.NewReader(p.data)
+	if err = binary.Read(r, binary.BigEndian, out); err != nil {
+		return nil, err
+	}
+	return out, err
+}
+
 func (p *avpPayload) toString() (out string, err error) {
 	return string(p.data), nil
 }
@@ -978,6 +1144,8 @@ func (avp *avp) decode() (interface{}, error) {
 			return nil, err
 		}
 		return avpMsgType(v), nil
+	case avpDataTypeUint16Array:
+		return avp.payload.toUint16Array()
 	}
 	return nil, fmt.Errorf("unhandled AVP data type")
 }
@@ -992,6 +1160,16 @@ func (avp *avp) decodeUint16Data() (value uint16, err error) {
 	return avp.payload.toUint16()
 }
 
+// decodeUint16ArrayData decodes an AVP holding a list of uint16 values.
+// It is an error to call this function on an AVP which doesn't
+// contain a uint16 array payload.
+func (avp *avp) decodeUint16ArrayData() (value []uint16, err error) {
+	if !avp.isDataType(avpDataTypeUint16Array) {
+		return nil, errors.New("AVP data is not of type uint16 array, cannot decode")
+	}
+	return avp.payload.toUint16Array()
+}
+
 // decodeUint32Data decodes an AVP holding a uint32 value.
 // It is an error to call this function on an AVP which doesn't
 // contain a uint32 payload.
@@ -1054,9 +1232,10 @@ func avpsLengthBytes(avps []avp) int {
 
 // findAvp looks up a specific AVP in a slice of AVPs
 // An error will be returned if the requested AVP isn't present in the slice.
+// AVPs superseded by a duplicate are ignored.
 func findAvp(avps []avp, vendorID avpVendorID, typ avpType) (*avp, error) {
 	for _, a := range avps {
-		if a.vendorID() == vendorID && a.getType() == typ {
+		if a.vendorID() == vendorID && a.getType() == typ && !a.superseded {
 			return &a, nil
 		}
 	}
@@ -1077,6 +1256,20 @@ func findUint16Avp(avps []avp, vendorID avpVendorID, typ avpType) (uint16, error
 	return val, nil
 }
 
+// findUint16ArrayAvp looks up a specific AVP in a slice of AVPs and decodes as a uint16 slice.
+// An error will be returned if the AVP isn't present or is of the wrong type.
+func findUint16ArrayAvp(avps []avp, vendorID avpVendorID, typ avpType) ([]uint16, error) {
+	avp, err := findAvp(avps, vendorID, typ)
+	if err != nil {
+		return nil, err
+	}
+	val, err := avp.decodeUint16ArrayData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", typ, err)
+	}
+	return val, nil
+}
+
 // findUint32Avp looks up a specific AVP in a slice of AVPs and decodes as uint32.
 // An error will be returned if the AVP isn't present or is of the wrong type.
 func findUint32Avp(avps []avp, vendorID avpVendorID, typ avpType) (uint32, error) {
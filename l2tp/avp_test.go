@@ -82,7 +82,7 @@ func TestParseAVPBufferGood(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if !reflect.DeepEqual(got, c.want) {
 				t.Errorf("parseAVPBuffer() == %q; want %q", got, c.want)
@@ -108,7 +108,7 @@ func TestParseAVPBufferBad(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		avps, err := parseAVPBuffer(c.in)
+		avps, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			t.Errorf("parseAVPBuffer(%q): expected error, but did not get one", c.in)
 		}
@@ -149,7 +149,7 @@ func TestAVPMetadata(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			for i, gi := range got {
 				dtyp, buf := gi.rawData()
@@ -189,7 +189,7 @@ func TestAVPDecodeUint16(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -228,7 +228,7 @@ func TestAVPDecodeUint32(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -257,7 +257,7 @@ func TestAVPDecodeUint64(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -296,7 +296,7 @@ func TestAVPDecodeString(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -342,7 +342,7 @@ func TestAVPDecodeResultCode(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -381,7 +381,7 @@ func TestAVPDecodeMsgID(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseAVPBuffer(c.in)
+		got, err := parseAVPBuffer(c.in, nil)
 		if err == nil {
 			if c.wantType != got[0].getType() {
 				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
@@ -452,6 +452,39 @@ func TestEncodeUint32(t *testing.T) {
 	}
 }
 
+func TestEncodeUint16Array(t *testing.T) {
+	cases := []struct {
+		vendorID avpVendorID
+		avpType  avpType
+		value    []uint16
+	}{
+		{vendorID: vendorIDIetf, avpType: avpTypePseudowireCaps, value: []uint16{0x0005, 0x0007}},
+		{vendorID: vendorIDIetf, avpType: avpTypePseudowireCaps, value: []uint16{}},
+	}
+	for _, c := range cases {
+		if avp, err := newAvp(c.vendorID, c.avpType, c.value); err == nil {
+			if !avp.isDataType(avpDataTypeUint16Array) {
+				t.Errorf("Data type check failed")
+			}
+			if val, err := avp.decodeUint16ArrayData(); err == nil {
+				if !reflect.DeepEqual(val, c.value) {
+					t.Errorf("encode/decode failed: expected %v, got %v", c.value, val)
+				}
+			} else {
+				t.Errorf("DecodeUint16ArrayData() failed: %q", err)
+			}
+		} else {
+			t.Errorf("newAvp(%v, %v, %v) failed: %q", c.vendorID, c.avpType, c.value, err)
+		}
+	}
+
+	// A list must contain whole uint16 values
+	p := avpPayload{dataType: avpDataTypeUint16Array, data: []byte{0x00, 0x05, 0x00}}
+	if _, err := p.toUint16Array(); err == nil {
+		t.Errorf("toUint16Array() accepted odd length payload")
+	}
+}
+
 func TestEncodeUint64(t *testing.T) {
 	cases := []struct {
 		vendorID avpVendorID
@@ -529,6 +562,24 @@ func TestEncodeBytes(t *testing.T) {
 	}
 }
 
+func TestEncodeEmpty(t *testing.T) {
+	avp, err := newAvp(vendorIDIetf, avpTypeSequencingRequired, nil)
+	if err != nil {
+		t.Fatalf("newAvp(%v, %v, nil) failed: %q", vendorIDIetf, avpTypeSequencingRequired, err)
+	}
+	if !avp.isDataType(avpDataTypeEmpty) {
+		t.Errorf("Data type check failed")
+	}
+	if avp.totalLen() != avpHeaderLen {
+		t.Errorf("expected empty AVP of length %v, got %v", avpHeaderLen, avp.totalLen())
+	}
+
+	_, err = newAvp(vendorIDIetf, avpTypeSequencingRequired, uint16(1))
+	if err == nil {
+		t.Errorf("newAvp(%v, %v, 1) succeeded, expected failure", vendorIDIetf, avpTypeSequencingRequired)
+	}
+}
+
 func TestEncodeResultCode(t *testing.T) {
 	cases := []struct {
 		vendorID avpVendorID
@@ -638,7 +689,7 @@ func TestFind(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		avps, err := parseAVPBuffer(c.in)
+		avps, err := parseAVPBuffer(c.in, nil)
 		if err != nil {
 			t.Fatalf("parseAVPBuffer(%q): %v", c.in, err)
 		}
@@ -657,6 +708,56 @@ func TestFind(t *testing.T) {
 	}
 }
 
+func TestDuplicateAVPPolicy(t *testing.T) {
+	in := []byte{
+		0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // message type (SCCRQ)
+		0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // message type (SCCRP)
+		0x80, 0x08, 0x00, 0x00, 0x00, 0x09, 0x00, 0x01, // assigned tunnel id
+		0x80, 0x08, 0x00, 0x00, 0x00, 0x09, 0x00, 0x02, // assigned tunnel id
+	}
+	cases := []struct {
+		policy DuplicateAVPPolicy
+		tid    ControlConnID
+		reject bool
+	}{
+		{policy: DuplicateAVPFirst, tid: 1},
+		{policy: DuplicateAVPLast, tid: 2},
+		{policy: DuplicateAVPReject, reject: true},
+	}
+	for _, c := range cases {
+		t.Run(c.policy.String(), func(t *testing.T) {
+			avps, err := parseAVPBuffer(in, newParserOptions(&TunnelConfig{DuplicateAVPs: c.policy}))
+			if c.reject {
+				if err == nil {
+					t.Fatalf("parseAVPBuffer(): expected error, but did not get one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAVPBuffer(): %v", err)
+			}
+			// Duplicates remain in the message so it encodes as received
+			if len(avps) != 4 {
+				t.Fatalf("parseAVPBuffer(): got %v AVPs, want 4", len(avps))
+			}
+			msgType, err := avps[0].decodeMsgType()
+			if err != nil || avps[0].superseded {
+				t.Fatalf("first message type AVP not used: %v", err)
+			}
+			if msgType != avpMsgTypeSccrq {
+				t.Errorf("message type: got %v, want %v", msgType, avpMsgTypeSccrq)
+			}
+			tid, err := findUint16Avp(avps, vendorIDIetf, avpTypeTunnelID)
+			if err != nil {
+				t.Fatalf("findUint16Avp(): %v", err)
+			}
+			if ControlConnID(tid) != c.tid {
+				t.Errorf("assigned tunnel id: got %v, want %v", tid, c.tid)
+			}
+		})
+	}
+}
+
 func TestAvpTypeStringer(t *testing.T) {
 	for i := avpTypeMessage; i < avpTypeMax; i++ {
 		s := i.String()
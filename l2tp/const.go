@@ -1,7 +1,9 @@
 package l2tp
 
 import (
+	"fmt"
 	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"net"
 	"time"
 )
 
@@ -31,7 +33,12 @@ type EncapType int
 const (
 	// EncapTypeUDP is used for RFC2661 and RFC3931 tunnels using UDP encapsulation
 	EncapTypeUDP = nll2tp.EncaptypeUdp
-	// EncapTypeIP is used for RFC3931 tunnels using IP encapsulation
+	// EncapTypeIP is used for RFC3931 tunnels using IP encapsulation.
+	// If the kernel doesn't support L2TP/IP sockets the control plane
+	// falls back to using a raw socket for IP protocol 115.  No data
+	// plane can carry data packets received on a raw socket, so tunnels
+	// using the fallback carry control messages only, and reject sessions
+	// unless the context has no data plane.
 	EncapTypeIP = nll2tp.EncaptypeIp
 )
 
@@ -58,6 +65,13 @@ const (
 
 // PseudowireType is the session type for a given session.
 // RFC2661 is PPP-only; whereas RFC3931 supports multiple types.
+// Sessions support the PPP, Ethernet and IP pseudowire types.  The Linux
+// kernel data plane terminates PPP pseudowires on a PPPoL2TP socket and
+// Ethernet pseudowires on an l2tpeth interface, and has no support for IP
+// pseudowires.  The userspace data plane terminates Ethernet pseudowires
+// on a TAP interface using OpenTAPPort and IP pseudowires on a TUN
+// interface using OpenTUNPort, and passes the frames of any type to the
+// application using OpenFramePort.
 type PseudowireType int
 
 const (
@@ -65,6 +79,15 @@ const (
 	PseudowireTypePPP = nll2tp.PwtypePpp
 	// PseudowireTypeEth specifies an Ethernet pseudowire
 	PseudowireTypeEth = nll2tp.PwtypeEth
+	// PseudowireTypeEthVLAN specifies an Ethernet pseudowire in tagged
+	// mode per RFC4448, in which each frame carries a service-delimiting
+	// 802.1Q VLAN tag.  The kernel data plane terminates it in the same
+	// way as an Ethernet pseudowire.
+	PseudowireTypeEthVLAN = nll2tp.PwtypeEthVlan
+	// PseudowireTypeIP specifies an IP pseudowire, which carries IPv4
+	// and IPv6 packets without a layer 2 header for routed attachment
+	// circuits.  Only the userspace data plane supports it.
+	PseudowireTypeIP = nll2tp.PwtypeIp
 )
 
 // DebugFlags is used for kernel-space tunnel and session logging control.
@@ -92,6 +115,301 @@ const (
 	L2SpecTypeDefault = nll2tp.L2spectypeDefault
 )
 
+// UDPChecksumMode controls the generation and validation of UDP checksums
+// for tunnels using UDP encapsulation.
+type UDPChecksumMode int
+
+const (
+	// UDPChecksumDefault leaves UDP checksum behaviour at the system default.
+	UDPChecksumDefault UDPChecksumMode = iota
+	// UDPChecksumEnabled enables the transmission of UDP checksums.
+	UDPChecksumEnabled
+	// UDPChecksumDisabled disables UDP checksums.  For IPv4 tunnels packets
+	// are transmitted without a checksum.  For IPv6 tunnels zero checksums
+	// are transmitted and accepted on receipt as permitted for tunnel
+	// protocols by RFC6936.
+	UDPChecksumDisabled
+)
+
+func (m UDPChecksumMode) String() string {
+	switch m {
+	case UDPChecksumDefault:
+		return "default"
+	case UDPChecksumEnabled:
+		return "enabled"
+	case UDPChecksumDisabled:
+		return "disabled"
+	}
+	panic("unhandled UDP checksum mode")
+}
+
+// MessageType identifies an L2TP control message type.
+// Values are as per RFC2661 and RFC3931.
+type MessageType uint16
+
+const (
+	// MessageTypeSCCRQ is the Start-Control-Connection-Request message
+	MessageTypeSCCRQ MessageType = 1
+	// MessageTypeSCCRP is the Start-Control-Connection-Reply message
+	MessageTypeSCCRP MessageType = 2
+	// MessageTypeICRQ is the Incoming-Call-Request message
+	MessageTypeICRQ MessageType = 10
+	// MessageTypeICCN is the Incoming-Call-Connected message
+	MessageTypeICCN MessageType = 12
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageTypeSCCRQ:
+		return "SCCRQ"
+	case MessageTypeSCCRP:
+		return "SCCRP"
+	case MessageTypeICRQ:
+		return "ICRQ"
+	case MessageTypeICCN:
+		return "ICCN"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint16(t))
+}
+
+// ResultCode is the general result code sent in a Result Code AVP to
+// indicate the reason a tunnel or session is being closed.
+// Values are as per RFC2661 section 4.4.2.
+type ResultCode uint16
+
+const (
+	// StopCCNResultClearConnection is a general request to clear the
+	// control connection.
+	StopCCNResultClearConnection ResultCode = 1
+	// StopCCNResultGeneralError indicates a general error, described
+	// by the error code.
+	StopCCNResultGeneralError ResultCode = 2
+	// StopCCNResultChannelExists indicates the control channel already
+	// exists.
+	StopCCNResultChannelExists ResultCode = 3
+	// StopCCNResultNotAuthorized indicates the requester is not
+	// authorized to establish a control channel.
+	StopCCNResultNotAuthorized ResultCode = 4
+	// StopCCNResultProtocolVersionUnsupported indicates the protocol
+	// version of the requester is not supported.
+	StopCCNResultProtocolVersionUnsupported ResultCode = 5
+	// StopCCNResultShuttingDown indicates the requester is being shut down.
+	StopCCNResultShuttingDown ResultCode = 6
+	// StopCCNResultFSMError indicates a finite state machine error.
+	StopCCNResultFSMError ResultCode = 7
+)
+
+// Result codes sent in the CDN message to indicate why a session is
+// being closed.
+const (
+	// CDNResultLostCarrier indicates the call was disconnected due to
+	// loss of carrier.
+	CDNResultLostCarrier ResultCode = 1
+	// CDNResultGeneralError indicates a general error, described by the
+	// error code.
+	CDNResultGeneralError ResultCode = 2
+	// CDNResultAdminDisconnect indicates the call was disconnected for
+	// administrative reasons.
+	CDNResultAdminDisconnect ResultCode = 3
+	// CDNResultNoResources indicates the call failed due to a temporary
+	// lack of appropriate facilities.
+	CDNResultNoResources ResultCode = 4
+	// CDNResultNotAvailable indicates the call failed due to a permanent
+	// lack of appropriate facilities.
+	CDNResultNotAvailable ResultCode = 5
+	// CDNResultInvalidDestination indicates the call destination is
+	// invalid.
+	CDNResultInvalidDestination ResultCode = 6
+	// CDNResultNoCarrier indicates the call failed due to no carrier
+	// being detected.
+	CDNResultNoCarrier ResultCode = 7
+	// CDNResultBusy indicates the call failed due to a busy signal.
+	CDNResultBusy ResultCode = 8
+	// CDNResultNoDialTone indicates the call failed due to lack of a
+	// dial tone.
+	CDNResultNoDialTone ResultCode = 9
+	// CDNResultTimeout indicates the call was not established within the
+	// time allotted.
+	CDNResultTimeout ResultCode = 10
+	// CDNResultNoFraming indicates the call was connected but no
+	// appropriate framing was detected.
+	CDNResultNoFraming ResultCode = 11
+	// CDNResultUnsupportedPseudowire indicates the L2TPv3 session was
+	// not established because the pseudowire type isn't supported.
+	CDNResultUnsupportedPseudowire ResultCode = 14
+)
+
+// ErrorCode is the error code sent in a Result Code AVP to further
+// describe a general error.  Values are as per RFC2661 section 4.4.2.
+type ErrorCode uint16
+
+const (
+	// ErrorCodeNoError indicates no general error.
+	ErrorCodeNoError ErrorCode = 0
+	// ErrorCodeNoControlConnection indicates no control connection
+	// exists yet for the LAC-LNS pair.
+	ErrorCodeNoControlConnection ErrorCode = 1
+	// ErrorCodeBadLength indicates a length error.
+	ErrorCodeBadLength ErrorCode = 2
+	// ErrorCodeBadValue indicates a field was out of range or a
+	// reserved field was non-zero.
+	ErrorCodeBadValue ErrorCode = 3
+	// ErrorCodeNoResource indicates insufficient resources to handle
+	// the operation.
+	ErrorCodeNoResource ErrorCode = 4
+	// ErrorCodeInvalidSessionID indicates the session ID is invalid.
+	ErrorCodeInvalidSessionID ErrorCode = 5
+	// ErrorCodeVendorSpecific indicates a vendor-specific error.
+	ErrorCodeVendorSpecific ErrorCode = 6
+	// ErrorCodeTryAnother indicates the peer should try another LNS.
+	ErrorCodeTryAnother ErrorCode = 7
+)
+
+// ExtraAVP describes an application-supplied AVP to be appended to
+// outgoing control messages.
+// This allows simple vendor-specific requirements to be met without
+// extending the control protocol implementation.
+type ExtraAVP struct {
+	// VendorID is the vendor ID of the AVP.  Vendor-specific AVPs use the
+	// vendor's SMI Network Management Private Enterprise Code, while
+	// standard AVPs use zero.
+	VendorID uint16
+
+	// Type is the attribute type of the AVP.
+	Type uint16
+
+	// Mandatory sets the mandatory bit of the AVP.  A peer which doesn't
+	// recognise a mandatory AVP will tear down the tunnel or session, so
+	// this should be used with care.
+	Mandatory bool
+
+	// Value is the AVP value.  It may be nil for an AVP with no value,
+	// or one of uint16, uint32, uint64, string, or []byte.
+	// Integer values are encoded in network byte order.
+	Value interface{}
+
+	// Messages lists the message types the AVP is to be appended to.
+	Messages []MessageType
+}
+
+// VersionPolicy controls protocol version selection for dynamic tunnels
+// whose configuration doesn't specify the protocol version.
+type VersionPolicy int
+
+const (
+	// VersionPolicyPreferV3 attempts to establish an L2TPv3 control
+	// connection first, falling back to L2TPv2 if the peer reports that
+	// L2TPv3 is not supported.
+	VersionPolicyPreferV3 VersionPolicy = iota
+	// VersionPolicyPreferV2 attempts to establish an L2TPv2 control
+	// connection first, falling back to L2TPv3 if the peer reports that
+	// L2TPv2 is not supported.
+	VersionPolicyPreferV2
+)
+
+func (p VersionPolicy) String() string {
+	switch p {
+	case VersionPolicyPreferV3:
+		return "prefer-l2tpv3"
+	case VersionPolicyPreferV2:
+		return "prefer-l2tpv2"
+	}
+	panic("unhandled version policy")
+}
+
+// DuplicateAVPPolicy determines how the AVPs of a control message
+// received from the peer are interpreted if an AVP occurs more than once.
+// The RFCs don't specify which occurrence applies, and some peers send
+// duplicates.
+//
+// The policy doesn't apply to the Message Type AVP, whose first
+// occurrence always identifies the message, or to the Random Vector AVP,
+// which may legitimately occur more than once.
+type DuplicateAVPPolicy int
+
+const (
+	// DuplicateAVPFirst uses the first occurrence of an AVP, ignoring
+	// any later occurrences.
+	DuplicateAVPFirst DuplicateAVPPolicy = iota
+	// DuplicateAVPLast uses the last occurrence of an AVP, ignoring any
+	// earlier occurrences.
+	DuplicateAVPLast
+	// DuplicateAVPReject discards messages which include an AVP more
+	// than once.
+	DuplicateAVPReject
+)
+
+func (p DuplicateAVPPolicy) String() string {
+	switch p {
+	case DuplicateAVPFirst:
+		return "first"
+	case DuplicateAVPLast:
+		return "last"
+	case DuplicateAVPReject:
+		return "reject"
+	}
+	panic("unhandled duplicate AVP policy")
+}
+
+// TunnelState is the state of the control protocol state machine
+// for a dynamic tunnel.
+type TunnelState string
+
+// The tunnel states correspond to those of RFC2661 section 7.2.1.
+const (
+	// TunnelStateIdle is the initial state of a tunnel, prior to any
+	// control messages being exchanged.
+	TunnelStateIdle TunnelState = "idle"
+	// TunnelStateWaitCtlReply is the state of a tunnel which has sent
+	// a Start-Control-Connection-Request and is awaiting the reply.
+	TunnelStateWaitCtlReply TunnelState = "waitctlreply"
+	// TunnelStateWaitCtlConn is the state of a tunnel which has replied
+	// to a peer's Start-Control-Connection-Request and is awaiting the
+	// Start-Control-Connection-Connected.
+	TunnelStateWaitCtlConn TunnelState = "waitctlconn"
+	// TunnelStateEstablished is the state of a tunnel which has
+	// completed the control connection three-way handshake.
+	TunnelStateEstablished TunnelState = "established"
+	// TunnelStateDead is the state of a tunnel which has been closed,
+	// either locally or by the peer.
+	TunnelStateDead TunnelState = "dead"
+)
+
+// SessionState is the state of the control protocol state machine
+// for a dynamic session.
+type SessionState string
+
+// The session states correspond to those of RFC2661 sections 7.4.1 and 7.4.2.
+const (
+	// SessionStateWaitTunnel is the initial state of a session created
+	// by the application, while waiting for the parent tunnel to be
+	// established.
+	SessionStateWaitTunnel SessionState = "waittunnel"
+	// SessionStateWaitReply is the state of a session which has sent
+	// an Incoming-Call-Request and is awaiting the reply.
+	SessionStateWaitReply SessionState = "waitreply"
+	// SessionStateIdle is the initial state of a session requested by
+	// the peer, prior to replying to the Incoming-Call-Request.
+	SessionStateIdle SessionState = "idle"
+	// SessionStateWaitConnect is the state of a session which has replied
+	// to a peer's Incoming-Call-Request and is awaiting the
+	// Incoming-Call-Connected.
+	SessionStateWaitConnect SessionState = "waitconnect"
+	// SessionStateEstablished is the state of a session which has
+	// completed the incoming call three-way handshake.
+	SessionStateEstablished SessionState = "established"
+	// SessionStateWaitRetry is the state of a persistent session which
+	// has been closed by the peer, while waiting to send a new
+	// Incoming-Call-Request.
+	SessionStateWaitRetry SessionState = "waitretry"
+	// SessionStateWaitTrigger is the state of an on-demand session which
+	// is waiting for the application to trigger its establishment.
+	SessionStateWaitTrigger SessionState = "waittrigger"
+	// SessionStateDead is the state of a session which has been closed,
+	// either locally or by the peer.
+	SessionStateDead SessionState = "dead"
+)
+
 // TunnelType define the runtime behaviour of a tunnel instance.
 type TunnelType int
 
@@ -129,8 +447,17 @@ type TunnelConfig struct {
 	Encap EncapType
 
 	// The version of the L2TP protocol to use for the tunnel.
+	// For dynamic tunnels the version may be left unset, in which case
+	// it is negotiated with the peer according to VersionPolicy.
 	Version ProtocolVersion
 
+	// VersionPolicy controls the order in which protocol versions are
+	// attempted for dynamic tunnels which don't specify Version.
+	// If a version has previously been successfully negotiated with the
+	// peer that version is attempted first.
+	// By default L2TPv3 is preferred.
+	VersionPolicy VersionPolicy
+
 	// The local tunnel ID for the tunnel instance.  Tunnel
 	// IDs must be unique to the host, and must be non-zero.
 	// The tunnel ID must be specified for static and quiescent tunnels.
@@ -151,11 +478,41 @@ type TunnelConfig struct {
 	// this from the default value of 4.
 	WindowSize uint16
 
+	// The maximum number of out-of-order control messages to buffer
+	// pending receipt of earlier messages from the peer.  Buffering
+	// out-of-order messages avoids the need for the peer to retransmit
+	// them when control messages are reordered in the network.
+	// Further out-of-order messages are discarded.
+	// The default is 4, which is the peer's default window size.
+	ReorderQueueSize uint16
+
 	// The amount of time to wait on receipt of a StopCCN message to allow
-	// and retransmissions to be acknowledged.
+	// and retransmissions to be acknowledged.  This also bounds the time
+	// spent waiting for the peer to acknowledge a StopCCN we send.
 	// The default is 31s per RFC2661 section 5.7.
 	StopCCNTimeout time.Duration
 
+	// SccrpTimeout bounds the time a dynamic tunnel waits for the peer
+	// to reply to the SCCRQ it sends.  If the timeout expires the tunnel
+	// sends a StopCCN to the peer and closes.
+	// By default the tunnel waits for as long as the reliable transport
+	// continues to retry the SCCRQ.
+	SccrpTimeout time.Duration
+
+	// ScccnTimeout bounds the time a tunnel accepted by a listener waits
+	// for the peer to reply to the SCCRP it sends.  If the timeout expires
+	// the tunnel sends a StopCCN to the peer and closes.
+	// By default the tunnel waits for as long as the reliable transport
+	// continues to retry the SCCRP.
+	ScccnTimeout time.Duration
+
+	// SessionReplyTimeout bounds the time each dynamic session in the
+	// tunnel waits for the peer to reply to the ICRQ it sends.  If the
+	// timeout expires the session sends a CDN to the peer and closes.
+	// By default sessions wait for as long as the reliable transport
+	// continues to retry the ICRQ.
+	SessionReplyTimeout time.Duration
+
 	// The hello timeout, if set, enables transmission of L2TP keep-alive
 	// (HELLO) messages.
 	// A hello message is sent N milliseconds after the last control
@@ -184,10 +541,282 @@ type TunnelConfig struct {
 	// If unset the host's name will be queried and the returned value used.
 	HostName string
 
+	// Secret, if set, is the shared secret used to authenticate the peer
+	// of a dynamic tunnel.
+	// L2TPv2 tunnels use the Challenge and Challenge Response AVPs per
+	// RFC2661 section 5.1.1.  The tunnel challenges the peer, and is not
+	// established unless the peer responds correctly.
+	// L2TPv3 tunnels exchange Control Message Authentication Nonce AVPs in
+	// the SCCRQ and SCCRP, and include a Message Digest AVP in each control
+	// message per RFC3931 section 4.3.  Messages from the peer which fail
+	// the digest check are discarded.
+	// If unset the peer is not authenticated, and the tunnel is not
+	// established if the peer authenticates itself to us.
+	// Control messages are not encrypted whether or not a secret is set.
+	// Where confidentiality is required the tunnel should be protected
+	// using IPsec, for example by installing policies with package ipsec.
+	Secret string
+
+	// AlternateSecret, if set, is a second shared secret which the peer
+	// may authenticate itself with, allowing the secret to be rotated
+	// without tearing down tunnels.  The tunnel authenticates itself to
+	// the peer using the secret the peer was seen to use, or Secret if
+	// the peer hasn't authenticated itself yet: an L2TPv2 tunnel
+	// responding to an SCCRQ always answers the peer's challenge using
+	// Secret.
+	// To rotate the secret, first set AlternateSecret to the new secret
+	// on each host, and then swap Secret and AlternateSecret on each
+	// host, before finally removing the old secret.
+	// AlternateSecret requires Secret to be set.
+	AlternateSecret string
+
+	// ChallengeLength sets the length in bytes of the random Challenge
+	// (L2TPv2) or Control Message Authentication Nonce (L2TPv3) sent to
+	// the peer of a dynamic tunnel with a Secret, in the range 16-64.
+	// The default is 16 bytes.
+	ChallengeLength int
+
 	// FramingCaps sets the framing capabilites the tunnel will advertise
 	// in the Framing Capabilites AVP per RFC2661.
 	// The default is to advertise both sync and async framing.
 	FramingCaps FramingCapability
+
+	// RouterID sets the Router ID an L2TPv3 tunnel advertises in the
+	// Router ID AVP per RFC3931.  The Router ID identifies the host to
+	// the peer, and is commonly one of the host's IPv4 addresses.
+	// The default is the tunnel's local address if that is an IPv4
+	// address.
+	RouterID uint32
+
+	// PseudowireCaps lists the pseudowire types an L2TPv3 tunnel
+	// advertises in the Pseudowire Capabilities List AVP per RFC3931.
+	// The peer may only request sessions of the advertised types.
+	// The default is to advertise PPP, Ethernet and tagged mode Ethernet
+	// pseudowires.  IP pseudowires are advertised only if listed, since
+	// only the userspace data plane supports them.
+	PseudowireCaps []PseudowireType
+
+	// ControlChecksum controls UDP checksums for control messages sent
+	// and received by the tunnel socket.
+	// It has no effect for static tunnels, which send no control messages,
+	// or for tunnels using IP encapsulation.
+	// By default the system default is used.
+	ControlChecksum UDPChecksumMode
+
+	// DataChecksum controls UDP checksums for data packets sent and
+	// received by the tunnel data plane.
+	// Quiescent and dynamic tunnels share a single socket between the
+	// control protocol and the data plane, so if both ControlChecksum and
+	// DataChecksum are set for these tunnel types they must agree.
+	// By default the system default is used.
+	DataChecksum UDPChecksumMode
+
+	// ControlDSCP sets the Differentiated Services Code Point (RFC2474)
+	// for control messages sent by the tunnel.  This allows control
+	// traffic to be prioritised, e.g. using CS6 (48).
+	// It has no effect for static tunnels, which send no control messages.
+	// By default the system default is used.
+	ControlDSCP uint8
+
+	// DataDSCP sets the Differentiated Services Code Point (RFC2474)
+	// for data packets sent by the tunnel data plane.
+	// The Linux kernel data plane doesn't support this option for
+	// static tunnels.
+	// By default the system default is used.
+	DataDSCP uint8
+
+	// InheritDataDSCP, if set, marks each data packet carrying an IPv4 or
+	// IPv6 packet with the DSCP of the encapsulated packet, so that its
+	// QoS treatment survives tunneling.  The DSCP is read from IP
+	// pseudowire packets, from Ethernet frames with the IPv4 or IPv6
+	// EtherType, including frames with 802.1Q or 802.1ad tags, and from
+	// PPP frames with the IPv4 or IPv6 protocol.  Data packets which
+	// don't carry an IP packet are marked with DataDSCP.
+	// Only the userspace data plane supports this option: the Linux
+	// kernel data plane marks every data packet with DataDSCP.
+	InheritDataDSCP bool
+
+	// DataDSCPMap, if set, maps the DSCP of encapsulated packets to the
+	// DSCP inherited by the data packets carrying them, for tunnels with
+	// InheritDataDSCP set.  DSCPs missing from the map are inherited
+	// unchanged.
+	DataDSCPMap map[uint8]uint8
+
+	// RecvBufferSize sets the size in bytes of the tunnel socket receive
+	// buffer (SO_RCVBUF).  Increasing the buffer size avoids packet drops
+	// when many tunnels share a host.  If the process has the
+	// CAP_NET_ADMIN capability the system limit (net.core.rmem_max) is
+	// overridden.
+	// The Linux kernel data plane doesn't support this option for
+	// static tunnels.
+	// By default the system default is used.
+	RecvBufferSize uint32
+
+	// SendBufferSize sets the size in bytes of the tunnel socket send
+	// buffer (SO_SNDBUF), and is otherwise as for RecvBufferSize.
+	SendBufferSize uint32
+
+	// BindDevice, if set, binds the tunnel socket to the named network
+	// interface (SO_BINDTODEVICE), such that the tunnel only sends and
+	// receives packets using that interface.
+	// The Linux kernel data plane doesn't support this option for
+	// static tunnels.
+	BindDevice string
+
+	// PacketInfo enables the use of IP_PKTINFO (IPV6_PKTINFO for IPv6
+	// tunnels) on the tunnel socket.  When the local address is a
+	// wildcard address, this ensures control messages sent to the peer
+	// use the local address the peer's messages arrived on as their
+	// source address, which is necessary on multihomed hosts.
+	// It has no effect for static tunnels, which send no control messages.
+	PacketInfo bool
+
+	// SharedSocket, if set, shares the tunnel socket with the other
+	// tunnels in the context which have the same local address and
+	// also set SharedSocket.  Received control messages are passed to
+	// the right tunnel using the tunnel ID (L2TPv2) or control connection
+	// ID (L2TPv3) in the message header, allowing many tunnels to use
+	// a single local port such as 1701.
+	// The socket is created using the configuration of the first tunnel
+	// to use it, whose socket options apply to all the tunnels sharing it.
+	// Only UDP encapsulation is supported.  The Linux kernel data plane
+	// supports a single tunnel per socket, so shared sockets are most
+	// useful with the null data plane or an application data plane.
+	SharedSocket bool
+
+	// NetNS, if set, is the path of the network namespace in which the
+	// tunnel socket is created, e.g. "/run/netns/tenant1" for a namespace
+	// created by "ip netns add".  The tunnel then sends and receives
+	// packets using the interfaces and routes of that namespace, while
+	// the control plane runs in the namespace of the application.
+	// The data plane instantiates the tunnel in the same namespace, where
+	// the network interfaces of its sessions are created.  Applications
+	// terminating PPP sessions must create their PPPoL2TP sockets in the
+	// namespace too.
+	// By default the namespace of the application is used.
+	NetNS string
+
+	// MaxSessions limits the number of sessions the tunnel may run,
+	// including sessions requested by the peer of a dynamic tunnel.
+	// Once the limit is reached creation of further sessions fails with
+	// ErrSessionLimit, and the peer's incoming calls are rejected with
+	// CDNResultNoResources.
+	// A limit of zero, which is the default, allows any number of sessions.
+	MaxSessions int
+
+	// SccrqRateLimit limits the rate at which a Listener processes SCCRQ
+	// messages from all peers, in messages per second, and
+	// PeerSccrqRateLimit the rate from each peer address.  Up to a
+	// second's worth of messages may be processed in a burst.  SCCRQs
+	// exceeding either limit are discarded before any state is allocated
+	// for them, and are counted in the listener's statistics.
+	// A limit of zero, which is the default, allows any rate.
+	// This applies to listeners only.
+	SccrqRateLimit     int
+	PeerSccrqRateLimit int
+
+	// MaxPendingTunnels limits the number of tunnels accepted by a
+	// Listener which may be awaiting establishment of the control
+	// connection at any one time.  Once the limit is reached further
+	// SCCRQs are discarded until a pending tunnel is established or
+	// closed.  Combined with ScccnTimeout this bounds the resources
+	// consumed by peers which never complete the control connection.
+	// A limit of zero, which is the default, allows any number of
+	// pending tunnels.
+	// This applies to listeners only.
+	MaxPendingTunnels int
+
+	// DeferTunnelCreation causes a Listener to reply to L2TPv3 SCCRQs
+	// itself, deferring creation of the tunnel until the peer's SCCCN
+	// shows that the peer received the SCCRP, in the manner of TCP SYN
+	// cookies.  A flood of SCCRQs from spoofed addresses then creates no
+	// tunnels, and the listener doesn't retransmit the SCCRP: a peer which
+	// doesn't receive it retransmits its SCCRQ instead.  Since the SCCCN
+	// doesn't repeat the peer's control connection ID the listener keeps
+	// a brief record of each SCCRP it sends, which counts towards
+	// MaxPendingTunnels and expires after ScccnTimeout, or 30 seconds by
+	// default.
+	// Tunnels are created on receipt of the SCCRQ as usual for L2TPv2
+	// peers, peers configured with a Secret, whose authentication state
+	// is held by the tunnel, and listeners using IP encapsulation or a
+	// shared socket.
+	// This applies to listeners only.
+	DeferTunnelCreation bool
+
+	// AllowedPeers lists the addresses, or prefixes in CIDR notation,
+	// of the peers a Listener accepts tunnels from, and
+	// AllowedPeerHostNames the host names the peers may advertise in the
+	// Host Name AVP.  Host names are compared without regard to case.
+	// SCCRQs from other peers are discarded, or rejected with
+	// StopCCNResultNotAuthorized if RejectUnauthorizedPeers is set.
+	// A rejected peer's tunnel is signalled using TunnelAcceptEvent
+	// followed by TunnelEstablishFailedEvent.
+	// By default tunnels are accepted from any peer.
+	// This applies to listeners only.
+	AllowedPeers            []string
+	AllowedPeerHostNames    []string
+	RejectUnauthorizedPeers bool
+
+	// PeerConfigs lists configurations for the tunnels a Listener accepts
+	// from particular peers, which are used in place of the listener's
+	// configuration.  A tunnel uses the first PeerConfig matching its
+	// peer, or the listener's configuration if none match.  This allows a
+	// single listener to accept tunnels from any peer, while giving
+	// specific peers their own secret or timers.
+	// By default all accepted tunnels use the listener's configuration.
+	// This applies to listeners only.
+	PeerConfigs []PeerConfig
+
+	// MaxMessagesPerDatagram, MaxAVPsPerMessage and MaxAVPLen limit the
+	// work done parsing a datagram received from the peer: the number of
+	// control messages in the datagram, the number of AVPs in each
+	// message, and the size in bytes of each AVP's payload.  Datagrams
+	// exceeding a limit are discarded, and the parser returns a
+	// ParserLimitError which is reported in the tunnel statistics.
+	// The defaults are 32 messages per datagram and 256 AVPs per message,
+	// with the AVP payload size limited only by the AVP header encoding.
+	// This applies to tunnels which run the control protocol, and to
+	// listeners.
+	MaxMessagesPerDatagram int
+	MaxAVPsPerMessage      int
+	MaxAVPLen              int
+
+	// DuplicateAVPs sets how control messages received from the peer
+	// which include the same AVP more than once are handled.  Messages
+	// rejected by DuplicateAVPReject are discarded as though malformed.
+	// The default is DuplicateAVPFirst.
+	// This applies to tunnels which run the control protocol, and to
+	// listeners.
+	DuplicateAVPs DuplicateAVPPolicy
+
+	// ExtraAVPs lists application-supplied AVPs to append to the control
+	// messages the tunnel sends.  Tunnel AVPs may be added to SCCRQ
+	// messages, or to SCCRP messages for tunnels accepted by a Listener.
+	// This applies to dynamic tunnels only.
+	ExtraAVPs []ExtraAVP
+}
+
+// PeerConfig specifies the configuration of the tunnels a Listener accepts
+// from the peers it matches.
+type PeerConfig struct {
+	// Peer, if set, is the address, or prefix in CIDR notation, of the
+	// peers the configuration applies to.
+	Peer string
+
+	// HostName, if set, restricts the configuration to peers advertising
+	// the host name in the Host Name AVP.  Host names are compared
+	// without regard to case.  At least one of Peer and HostName must be
+	// set.
+	HostName string
+
+	// Config is the configuration of the tunnels accepted from matching
+	// peers.  The parameters which apply to the listener as a whole,
+	// being the local address, encapsulation, shared socket, network
+	// namespace, limits and peer restrictions, are taken from the
+	// listener's configuration, as are the host name and StopCCN timeout
+	// if unset.  The tunnel IDs, peer address and PeerConfigs must not
+	// be set.
+	Config *TunnelConfig
 }
 
 // SessionConfig encapsulates session configuration for a pseudowire
@@ -206,18 +835,50 @@ type SessionConfig struct {
 	PeerSessionID ControlConnID
 
 	// Pseudowire specifies the type of layer 2 frames carried by the session.
-	// L2TPv2 tunnels support PPP pseudowires only.
+	// L2TPv2 tunnels support PPP pseudowires only.  IP pseudowires require
+	// the userspace data plane.
 	Pseudowire PseudowireType
 
+	// PseudowireFallback lists the pseudowire types, in order of
+	// preference, which a dynamic L2TPv3 session created by the application
+	// falls back to if the peer's Pseudowire Capabilities List doesn't
+	// include Pseudowire.  The session uses the first type the peer
+	// supports, and reports it as the Pseudowire in the session
+	// configuration passed with SessionUpEvent.
+	// By default the session fails to establish if the peer doesn't
+	// support Pseudowire.
+	PseudowireFallback []PseudowireType
+
 	// SeqNum, if set, enables the transmission of sequence numbers with
 	// L2TP data messages.  Use of sequence numbers enables the data plane
 	// to reorder data packets to ensure they are delivered in sequence.
 	// By default sequence numbers are not used.
+	//
+	// For dynamic L2TPv2 sessions the use of sequence numbers is negotiated
+	// using the Sequencing Required AVP: a session created locally includes
+	// the AVP in its ICCN message if SeqNum is set, and a session created
+	// by the peer enables sequence numbers if the peer's ICCN message
+	// includes the AVP.
+	// Dynamic L2TPv3 sessions use the Data Sequencing AVP in the same way,
+	// except that either peer may send it in any of the ICRQ, ICRP and ICCN
+	// messages.
+	//
+	// L2TPv3 data packets carry 24 bit sequence numbers in the default
+	// Layer 2 specific sublayer, which is used automatically by sessions
+	// with sequence numbers enabled.  Both the Linux kernel data plane and
+	// the userspace data plane add the sequence numbers to transmitted
+	// packets and check those of received packets, counting the packets
+	// they discard in the RxSeqDiscards statistic and those they receive
+	// out of sequence in the RxOutOfSequence statistic.
 	SeqNum bool
 
 	// ReorderTimeout, if set, specifies the length of time to queue out
-	// of sequence data packets before discarding them.
-	// This parameter is not currently implemented and should not be used.
+	// of sequence data packets waiting for the packets before them.  By
+	// default out of sequence data packets are not queued.
+	// The Linux kernel data plane rounds the timeout down to the nearest
+	// millisecond, and discards queued packets once it expires.  The
+	// userspace data plane instead treats the missing packets as lost and
+	// delivers the queued packets, and queues at most 64 packets.
 	ReorderTimeout time.Duration
 
 	// Cookie, if set, specifies the local L2TPv3 cookie for the session.
@@ -226,25 +887,177 @@ type SessionConfig struct {
 	// Transmitted data packets will include the local cookie in their header.
 	// Cookies may be either 4 or 8 bytes long, and contain aribrary data.
 	// By default no local cookie is set.
+	// Dynamic sessions send the local cookie to the peer in the Assigned
+	// Cookie AVP.
 	Cookie []byte
 
 	// PeerCookie, if set, specifies the L2TPv3 cookie the peer will send in
 	// the header of its data messages.
 	// Messages received without the peer's cookie (or with the wrong cookie)
-	// will be rejected.
+	// will be discarded by the data plane, and counted in the session's
+	// RxCookieDiscards statistic.
 	// By default no peer cookie is set.
+	// Dynamic sessions learn the peer cookie from the peer's Assigned Cookie
+	// AVP, and expect no cookie if the peer doesn't assign one.
 	PeerCookie []byte
 
+	// RemoteEndID, if set, identifies the circuit the session is to be
+	// connected to at the peer.  It is sent in the Remote End ID AVP of the
+	// ICRQ message for dynamic L2TPv3 sessions created locally.
+	// The contents of the identifier are specific to the pseudowire type.
+	RemoteEndID []byte
+
+	// TxConnectSpeed and RxConnectSpeed, if set, specify the transmit and
+	// receive speeds of the session's circuit in bits per second.
+	// Dynamic sessions report the speeds to the peer: L2TPv2 sessions
+	// created locally send them in the ICCN message, limited to 32 bits,
+	// while L2TPv3 sessions send them in each of the ICRQ, ICRP and ICCN
+	// messages they send.
+	// By default a transmit speed of zero is reported, and the receive
+	// speed is not reported.
+	TxConnectSpeed uint64
+	RxConnectSpeed uint64
+
+	// BundleID, if set, tags a PPP pseudowire session as a member of the
+	// Multilink PPP bundle of that name, as described by RFC1990.  L2TP
+	// doesn't signal bundle membership, so it is up to the PPP
+	// implementation to join the links of sessions sharing a bundle ID:
+	// the ID is at most 20 bytes long, so that it may serve as a locally
+	// assigned Endpoint Discriminator.  Context.BundleSessions finds the
+	// members of a bundle.
+	// By default sessions are not members of a bundle.
+	BundleID string
+
 	// InterfaceName, if set, specifies the network interface name to be
 	// used for the session instance.
 	// Setting the interface name can be useful when you need to be certain
 	// of the interface name a given session will use.
+	// The name may instead be a template containing a single "%d" verb,
+	// e.g. "l2tp-%d", in which case the Linux kernel replaces the verb
+	// with the lowest number giving an unused name.  The name the session
+	// was given is reported in SessionUpEvent.
 	// By default the Linux kernel autogenerates an interface name specific to
 	// the pseudowire type, e.g. "l2tpeth0", "ppp0".
+	//
+	// The interfaces of PPP pseudowires are created by the PPP daemon
+	// rather than the data plane, so it is up to the application to
+	// apply the name.
 	InterfaceName string
 
+	// HardwareAddr, if set, specifies the MAC address of the network
+	// interface of an Ethernet pseudowire session.  It is applied by
+	// OpenTAPPort for sessions using the userspace data plane: the Linux
+	// kernel data plane ignores it.
+	// By default the interface is assigned a random MAC address.
+	HardwareAddr net.HardwareAddr
+
 	// L2SpecType specifies the L2TPv3 Layer 2 specific sublayer field to
 	// be used in data packet headers as per RFC3931 section 3.2.2.
-	// By default no Layer 2 specific sublayer is used.
+	// By default no Layer 2 specific sublayer is used, unless the session
+	// uses sequence numbers: these are carried by the default sublayer.
+	// Dynamic sessions advertise the default sublayer to the peer in the
+	// L2-Specific Sublayer AVP, and use it if the peer requires it.
 	L2SpecType L2SpecType
+
+	// MTU, if set, specifies the MTU of the session's network interface.
+	// The MTU must be at least 68 bytes.
+	// By default sessions in dynamic tunnels derive the MTU from the path
+	// MTU to the peer, less the encapsulation overhead of the tunnel and
+	// session, including cookies and the L2-Specific Sublayer.  The MTU of
+	// Ethernet sessions then follows changes in the path MTU, such as
+	// those signalled by ICMP "fragmentation needed" messages, if the data
+	// plane implements MTUSessionDataPlane.  Otherwise the data plane picks
+	// an MTU suited to the tunnel's encapsulation.
+	MTU uint16
+
+	// InterfaceAddrs lists addresses in CIDR notation, e.g. "192.0.2.1/24"
+	// or "2001:db8::1/64", to be assigned to the network interface of an
+	// Ethernet pseudowire session once its data plane has been created.
+	// By default no addresses are assigned.
+	InterfaceAddrs []string
+
+	// InterfaceUp, if set, causes the network interface of an Ethernet
+	// pseudowire session to be brought up once its data plane has been
+	// created and its addresses assigned, so that the session can carry
+	// traffic without further configuration by the application.
+	// By default the interface is left down.
+	InterfaceUp bool
+
+	// Bridge, if set, names a Linux bridge to which the network interface
+	// of an Ethernet pseudowire session is attached once its data plane
+	// has been created.  The interface is detached from the bridge when
+	// the session is torn down.  The bridge must already exist.
+	// By default the interface isn't attached to a bridge.
+	Bridge string
+
+	// VLANs lists 802.1Q VLAN IDs for which VLAN sub-interfaces are
+	// created on the network interface of an Ethernet pseudowire session
+	// once its data plane has been created.  Each sub-interface is named
+	// after the session interface and its VLAN ID, e.g. "l2tpeth0.100",
+	// and is brought up along with the session interface if InterfaceUp
+	// is set.  The sub-interfaces are removed along with the session
+	// interface when the session is torn down.
+	// VLAN sub-interfaces are typically used with PseudowireTypeEthVLAN
+	// sessions, whose frames are tagged with a service-delimiting VLAN ID.
+	// By default no sub-interfaces are created.
+	VLANs []uint16
+
+	// InterfaceNetNS, if set, is the path of a network namespace to which
+	// the network interface of an Ethernet pseudowire session is moved
+	// once its data plane has been created, e.g. "/run/netns/tenant1".
+	// The interface is configured as requested by the other interface
+	// options once it is in the namespace, which must not already have
+	// an interface of the same name.
+	// This allows subscriber interfaces to land in per-tenant namespaces
+	// while the control plane runs in the application's namespace.
+	// By default the interface stays in the namespace of its tunnel.
+	InterfaceNetNS string
+
+	// ExtraAVPs lists application-supplied AVPs to append to the control
+	// messages the session sends.  Session AVPs may be added to ICRQ and
+	// ICCN messages.
+	// This applies to sessions in dynamic tunnels only.
+	ExtraAVPs []ExtraAVP
+
+	// Persist, if set, causes a dynamic session created by the application
+	// to be re-established if the peer closes it by sending a CDN message
+	// while the tunnel remains up.  A new ICRQ is sent once the
+	// PersistBackoff delay expires.  The delay is doubled for each
+	// consecutive attempt which fails to establish the session, up to a
+	// limit of one minute.
+	// SessionDownEvent is signalled each time the peer closes an established
+	// session.  Persist has no effect on sessions requested by the peer.
+	Persist bool
+
+	// PersistBackoff specifies the initial delay before re-establishing a
+	// persistent session.
+	// By default a delay of 1000ms is used.
+	PersistBackoff time.Duration
+
+	// OnDemand, if set, causes a dynamic session created by the application
+	// to wait for the application to call Session.Trigger before sending
+	// an ICRQ, rather than being established as soon as the tunnel is up.
+	// Typically the application triggers the session on the arrival of
+	// traffic on the session's attachment circuit.  If the peer closes the
+	// session, or the session fails to establish, it waits for the next
+	// trigger rather than closing.  OnDemand may not be combined with
+	// Persist, and has no effect on sessions requested by the peer.
+	OnDemand bool
+
+	// IdleTimeout, if set, specifies how long an established on-demand
+	// session may pass no data traffic before it is disconnected.  The
+	// session then waits for the next trigger.
+	// By default on-demand sessions are not disconnected when idle.
+	IdleTimeout time.Duration
+
+	// Static, if set, causes a session created by the application in a
+	// dynamic tunnel to be provisioned without an incoming call exchange
+	// with the peer, for peers which signal the tunnel but provision
+	// sessions out of band.  The session's data plane is created from the
+	// session configuration once the tunnel is established, so SessionID
+	// and PeerSessionID must be set.  Static sessions send no CDN when
+	// closed, and may not be persistent or on-demand.
+	// Static has no effect on sessions requested by the peer, and sessions
+	// in static and quiescent tunnels are always static.
+	Static bool
 }
@@ -1,9 +1,14 @@
 package l2tp
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"sync"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -14,9 +19,99 @@ type controlPlane struct {
 	file          *os.File
 	rc            syscall.RawConn
 	connected     bool
+	// raw is set if the control plane is using a raw IP socket for
+	// L2TPv3 IP encapsulation rather than a kernel L2TP/IP socket.
+	// rawBuf is the buffer raw IP packets are received into, which
+	// is reused for each packet.
+	raw    bool
+	rawBuf []byte
+	// controlOob, if set, is ancillary data sent with each control
+	// message to set its DSCP independently of the socket default.
+	controlOob []byte
+	// pktinfo is set if the socket reports the destination address of
+	// received packets.  The destination address of the most recent packet
+	// received from a peer is used as the source address for messages sent
+	// to the peer on an unconnected socket.  The control planes sharing a
+	// socket each record the address for their own peer.
+	pktinfo bool
+	srcLock sync.Mutex
+	srcPeer string
+	srcOob  []byte
+	// mux is set if the control plane uses a socket shared with other
+	// tunnels, in which case frames for the tunnel are received from
+	// the mux on rxChan.
+	mux    *socketMux
+	muxID  ControlConnID
+	rxChan chan *rawMsg
+	// pending holds frames received on another socket on behalf of
+	// the control plane, which are returned ahead of those received
+	// on the socket.
+	pending []*rawMsg
+	// dataHandler, if set, is passed the data packets received on the
+	// socket, which the kernel data plane would otherwise intercept.
+	dataLock    sync.Mutex
+	dataHandler func(b []byte)
 }
 
+// L2TPv3 IP encapsulated packets are prefixed with a 32 bit session ID,
+// which is zero for control messages (RFC3931 section 4.1.1.2).
+const ipEncapSessionIDLen = 4
+
+// The maximum length of the IPv4 header delivered to raw sockets.
+const ipv4HeaderMaxLen = 60
+
 func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+	if len(cp.pending) > 0 {
+		m := cp.pending[0]
+		cp.pending = cp.pending[1:]
+		return copy(p, m.b), m.sa, nil
+	}
+	if cp.mux != nil {
+		m, ok := <-cp.rxChan
+		if !ok {
+			return 0, nil, errControlPlaneClosed
+		}
+		return copy(p, m.b), m.sa, nil
+	}
+	if cp.raw {
+		return cp.recvFromRaw(p)
+	}
+	for {
+		n, addr, err = cp.recvfrom(p)
+		if err != nil || !cp.handleData(p[:n]) {
+			return n, addr, err
+		}
+	}
+}
+
+// setDataHandler arranges for data packets received on the socket to be
+// passed to the handler rather than returned by recvFrom.
+func (cp *controlPlane) setDataHandler(handler func(b []byte)) {
+	cp.dataLock.Lock()
+	defer cp.dataLock.Unlock()
+	cp.dataHandler = handler
+}
+
+// handleData passes a data packet to the data handler, returning false
+// if the packet is a control message or there is no handler.
+func (cp *controlPlane) handleData(b []byte) bool {
+	if len(b) < 2 || b[0]&0x80 != 0 {
+		return false
+	}
+	cp.dataLock.Lock()
+	handler := cp.dataHandler
+	cp.dataLock.Unlock()
+	if handler == nil {
+		return false
+	}
+	handler(b)
+	return true
+}
+
+func (cp *controlPlane) recvfrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+	if cp.pktinfo {
+		return cp.recvmsg(p)
+	}
 	cerr := cp.rc.Read(func(fd uintptr) bool {
 		n, addr, err = unix.Recvfrom(int(fd), p, unix.MSG_NOSIGNAL)
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
@@ -27,20 +122,206 @@ func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error
 	return n, addr, cerr
 }
 
+func (cp *controlPlane) recvmsg(p []byte) (n int, addr unix.Sockaddr, err error) {
+	var oobn int
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo))
+	cerr := cp.rc.Read(func(fd uintptr) bool {
+		n, oobn, _, addr, err = unix.Recvmsg(int(fd), p, oob, 0)
+		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
+	})
+	if err != nil {
+		return n, addr, err
+	}
+	if cerr == nil {
+		cp.setReplySource(addr, replySource(oob[:oobn]))
+	}
+	return n, addr, cerr
+}
+
+// setReplySource records the source address for sending messages to the
+// peer, as derived by replySource.
+func (cp *controlPlane) setReplySource(peer unix.Sockaddr, src []byte) {
+	if src == nil {
+		return
+	}
+	cp.srcLock.Lock()
+	defer cp.srcLock.Unlock()
+	cp.srcPeer = sockaddrString(peer)
+	cp.srcOob = src
+}
+
+// getReplySource returns the source address for sending messages to the
+// peer, or nil if none has been recorded for the peer.
+func (cp *controlPlane) getReplySource(peer unix.Sockaddr) []byte {
+	cp.srcLock.Lock()
+	defer cp.srcLock.Unlock()
+	if cp.srcOob == nil || cp.srcPeer != sockaddrString(peer) {
+		return nil
+	}
+	return cp.srcOob
+}
+
+// replySource derives the source address for sending messages from the
+// packet info of a received packet, returning the ancillary data setting
+// the address, or nil if there is no packet info.
+func replySource(oob []byte) (src []byte) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_PKTINFO &&
+			len(m.Data) >= unix.SizeofInet4Pktinfo {
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			reply := unix.Inet4Pktinfo{Spec_dst: info.Addr}
+			src = newCmsg(unix.IPPROTO_IP, unix.IP_PKTINFO,
+				(*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&reply))[:])
+		} else if m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_PKTINFO &&
+			len(m.Data) >= unix.SizeofInet6Pktinfo {
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			ip := net.IP(info.Addr[:])
+			// IPv4 peers of a dual-stack socket use the IPv4 routing path,
+			// which doesn't accept IPv6 packet info.
+			if ip.To4() != nil {
+				continue
+			}
+			reply := unix.Inet6Pktinfo{Addr: info.Addr}
+			if ip.IsLinkLocalUnicast() {
+				reply.Ifindex = info.Ifindex
+			}
+			src = newCmsg(unix.IPPROTO_IPV6, unix.IPV6_PKTINFO,
+				(*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&reply))[:])
+		}
+	}
+	return src
+}
+
+// When using a raw socket for IP encapsulation we must perform the
+// demultiplexing that the kernel's L2TP/IP socket would otherwise do for us.
+// Received packets are demultiplexed on session ID first: data packets
+// carry a non-zero session ID, while control packets carry a zero session
+// ID and are accepted only if addressed to our control connection ID.
+func (cp *controlPlane) recvFromRaw(p []byte) (n int, addr unix.Sockaddr, err error) {
+	if len(cp.rawBuf) < len(p)+ipv4HeaderMaxLen+ipEncapSessionIDLen {
+		cp.rawBuf = make([]byte, len(p)+ipv4HeaderMaxLen+ipEncapSessionIDLen)
+	}
+	b := cp.rawBuf
+	_, isIPv4 := cp.local.(*unix.SockaddrL2TPIP)
+	for {
+		n, addr, err = cp.recvfrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		sid, payload, err := parseIPEncapFrame(b[:n], isIPv4)
+		if err != nil {
+			continue
+		}
+
+		// No data plane handles data packets received on a raw
+		// socket, see rawSocketDataPlane
+		if sid != 0 {
+			continue
+		}
+
+		if !cp.isOurControlMessage(payload) {
+			continue
+		}
+
+		return copy(p, payload), rawToL2TPIPSockaddr(addr), nil
+	}
+}
+
+// dataPlane returns the data plane to use for a tunnel using the control
+// plane, which is dp unless the control plane uses a raw socket.
+func (cp *controlPlane) dataPlane(dp DataPlane) DataPlane {
+	if !cp.raw {
+		return dp
+	}
+	// With no data plane there are no data packets to carry
+	if _, ok := dp.(*nullDataPlane); ok {
+		return dp
+	}
+	return &rawSocketDataPlane{}
+}
+
+func (cp *controlPlane) isOurControlMessage(b []byte) bool {
+	var ccid uint32
+	switch sa := cp.local.(type) {
+	case *unix.SockaddrL2TPIP:
+		ccid = sa.ConnId
+	case *unix.SockaddrL2TPIP6:
+		ccid = sa.ConnId
+	}
+	// RFC3931 control message header: flags, length, control connection ID
+	if len(b) < 8 {
+		return false
+	}
+	return ccid == 0 || binary.BigEndian.Uint32(b[4:8]) == ccid
+}
+
+// parseIPEncapFrame splits a packet received from a raw L2TPv3 IP socket
+// into its session ID and L2TP payload.  Raw IPv4 sockets deliver the IP
+// header along with the payload, whereas raw IPv6 sockets do not.
+func parseIPEncapFrame(b []byte, hasIPv4Header bool) (sid uint32, payload []byte, err error) {
+	if hasIPv4Header {
+		if len(b) < 1 {
+			return 0, nil, errors.New("short IPv4 header")
+		}
+		hlen := int(b[0]&0x0f) * 4
+		if hlen < 20 || len(b) < hlen {
+			return 0, nil, fmt.Errorf("bad IPv4 header length %v", hlen)
+		}
+		b = b[hlen:]
+	}
+	if len(b) < ipEncapSessionIDLen {
+		return 0, nil, errors.New("short L2TPv3 IP encapsulation header")
+	}
+	return binary.BigEndian.Uint32(b), b[ipEncapSessionIDLen:], nil
+}
+
 func (cp *controlPlane) write(b []byte) (n int, err error) {
+	if cp.mux != nil {
+		return cp.writeTo(b, cp.remote)
+	}
 	if cp.connected {
+		if cp.controlOob != nil {
+			return len(b), cp.sendto(b, nil)
+		}
+		if cp.raw {
+			n, err = cp.file.Write(append(make([]byte, ipEncapSessionIDLen), b...))
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
 		return cp.file.Write(b)
 	}
 	return cp.writeTo(b, cp.remote)
 }
 
 func (cp *controlPlane) writeTo(p []byte, addr unix.Sockaddr) (n int, err error) {
+	if cp.mux != nil {
+		return len(p), cp.mux.cp.sendmsg(p, addr, cp.sendOob(addr))
+	}
 	return len(p), cp.sendto(p, addr)
 }
 
 func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
+	return cp.sendmsg(p, to, cp.sendOob(to))
+}
+
+func (cp *controlPlane) sendmsg(p []byte, to unix.Sockaddr, oob []byte) (err error) {
+	if cp.raw {
+		p = append(make([]byte, ipEncapSessionIDLen), p...)
+		to = l2tpipToRawSockaddr(to)
+	}
 	cerr := cp.rc.Write(func(fd uintptr) bool {
-		err = unix.Sendto(int(fd), p, unix.MSG_NOSIGNAL, to)
+		if oob != nil {
+			err = unix.Sendmsg(int(fd), p, oob, to, unix.MSG_NOSIGNAL)
+		} else {
+			err = unix.Sendto(int(fd), p, unix.MSG_NOSIGNAL, to)
+		}
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
 	})
 	if err != nil {
@@ -49,7 +330,28 @@ func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
 	return cerr
 }
 
+// sendOob returns the ancillary data to send with a control message to
+// the peer.  A control plane sharing a socket uses the options of the
+// shared socket, along with the source address recorded for its own peer.
+func (cp *controlPlane) sendOob(to unix.Sockaddr) []byte {
+	sock := cp
+	if cp.mux != nil {
+		sock = cp.mux.cp
+	}
+	oob := sock.controlOob
+	if sock.pktinfo && !sock.connected {
+		if src := cp.getReplySource(to); src != nil {
+			oob = append(append([]byte{}, oob...), src...)
+		}
+	}
+	return oob
+}
+
 func (cp *controlPlane) close() (err error) {
+	if cp.mux != nil {
+		cp.mux.release(cp)
+		return nil
+	}
 	if cp.file != nil {
 		err = cp.file.Close()
 		cp.file = nil
@@ -58,27 +360,241 @@ func (cp *controlPlane) close() (err error) {
 }
 
 func (cp *controlPlane) connect() error {
-	err := unix.Connect(cp.fd, cp.remote)
+	// A shared socket can't be connected: instead the control plane
+	// sends to the remote address explicitly.
+	if cp.mux != nil {
+		cp.connected = true
+		return nil
+	}
+	remote := cp.remote
+	if cp.raw {
+		remote = l2tpipToRawSockaddr(remote)
+	}
+	err := unix.Connect(cp.fd, remote)
 	if err == nil {
 		cp.connected = true
 	}
 	return err
 }
 
+// pathMTU returns the path MTU to the peer known to the kernel, which is
+// only available for a connected socket.
+func (cp *controlPlane) pathMTU() (int, error) {
+	if cp.mux != nil || !cp.connected {
+		return 0, fmt.Errorf("socket isn't connected")
+	}
+	level, opt := unix.IPPROTO_IPV6, unix.IPV6_MTU
+	if cp.isIPv4() {
+		level, opt = unix.IPPROTO_IP, unix.IP_MTU
+	}
+	return unix.GetsockoptInt(cp.fd, level, opt)
+}
+
 func (cp *controlPlane) connectTo(sa unix.Sockaddr) error {
 	cp.remote = sa
 	return cp.connect()
 }
 
+// inject queues a frame to be returned by recvFrom.  It must not be called
+// once the control plane is in use.
+func (cp *controlPlane) inject(m *rawMsg) {
+	cp.pending = append(cp.pending, m)
+}
+
+// setReuseAddress allows the socket to be bound to the same local address
+// as other sockets.  It should be called before the socket is bound.
+func (cp *controlPlane) setReuseAddress() error {
+	if cp.mux != nil {
+		return nil
+	}
+	return unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
 func (cp *controlPlane) bind() error {
+	if cp.mux != nil {
+		return nil
+	}
+	if cp.raw {
+		return unix.Bind(cp.fd, l2tpipToRawSockaddr(cp.local))
+	}
 	return unix.Bind(cp.fd, cp.local)
 }
 
-func tunnelSocket(family, protocol int) (fd int, err error) {
+// Raw IP sockets use plain inet addresses rather than the L2TP/IP
+// address types, which carry the control connection ID.
+func l2tpipToRawSockaddr(sa unix.Sockaddr) unix.Sockaddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrL2TPIP:
+		return &unix.SockaddrInet4{Addr: sa.Addr}
+	case *unix.SockaddrL2TPIP6:
+		return &unix.SockaddrInet6{Addr: sa.Addr, ZoneId: sa.ZoneId}
+	}
+	return sa
+}
+
+// For consistency with the kernel L2TP/IP socket, addresses received
+// on a raw socket are represented as L2TP/IP addresses with a zero
+// control connection ID.
+func rawToL2TPIPSockaddr(sa unix.Sockaddr) unix.Sockaddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &unix.SockaddrL2TPIP{Addr: sa.Addr}
+	case *unix.SockaddrInet6:
+		return &unix.SockaddrL2TPIP6{Addr: sa.Addr, ZoneId: sa.ZoneId}
+	}
+	return sa
+}
+
+// UDP_NO_CHECK6_TX and UDP_NO_CHECK6_RX from linux/udp.h, which
+// golang.org/x/sys/unix doesn't currently define.
+const (
+	udpNoCheck6Tx = 101
+	udpNoCheck6Rx = 102
+)
+
+func (cp *controlPlane) setUDPChecksum(mode UDPChecksumMode) (err error) {
+	if mode == UDPChecksumDefault || cp.mux != nil {
+		return nil
+	}
+
+	nocheck := 0
+	if mode == UDPChecksumDisabled {
+		nocheck = 1
+	}
+
+	switch cp.local.(type) {
+	case *unix.SockaddrInet4:
+		err = unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_NO_CHECK, nocheck)
+		if err != nil {
+			return fmt.Errorf("setsockopt(SO_NO_CHECK): %v", err)
+		}
+	case *unix.SockaddrInet6:
+		err = unix.SetsockoptInt(cp.fd, unix.IPPROTO_UDP, udpNoCheck6Tx, nocheck)
+		if err != nil {
+			return fmt.Errorf("setsockopt(UDP_NO_CHECK6_TX): %v", err)
+		}
+		err = unix.SetsockoptInt(cp.fd, unix.IPPROTO_UDP, udpNoCheck6Rx, nocheck)
+		if err != nil {
+			return fmt.Errorf("setsockopt(UDP_NO_CHECK6_RX): %v", err)
+		}
+	}
+	return nil
+}
+
+// The DSCP occupies the upper six bits of the IPv4 TOS and IPv6
+// traffic class fields.
+const maxDSCP = 63
+
+func (cp *controlPlane) isIPv4() bool {
+	switch cp.local.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrL2TPIP:
+		return true
+	}
+	return false
+}
+
+// setDSCP sets the DSCP for packets sent on the tunnel socket.
+// The data DSCP is set as the socket default, which the kernel data
+// plane will use for data packets.  If the control DSCP differs, control
+// messages are marked per-packet using ancillary data.  A DSCP of zero
+// is the system default.
+func (cp *controlPlane) setDSCP(control, data uint8) (err error) {
+	if control > maxDSCP || data > maxDSCP {
+		return fmt.Errorf("DSCP value out of range (max %v)", maxDSCP)
+	}
+	if cp.mux != nil {
+		return nil
+	}
+
+	level, opt, optName := unix.IPPROTO_IPV6, unix.IPV6_TCLASS, "IPV6_TCLASS"
+	if cp.isIPv4() {
+		level, opt, optName = unix.IPPROTO_IP, unix.IP_TOS, "IP_TOS"
+	}
+
+	if data != 0 {
+		err = unix.SetsockoptInt(cp.fd, level, opt, int(data)<<2)
+		if err != nil {
+			return fmt.Errorf("setsockopt(%s): %v", optName, err)
+		}
+	}
+
+	if control != data {
+		cp.controlOob = dscpCmsg(level, opt, control)
+	}
+	return nil
+}
+
+func dscpCmsg(level, opt int, dscp uint8) []byte {
+	tos := int32(dscp) << 2
+	return newCmsg(level, opt, (*[4]byte)(unsafe.Pointer(&tos))[:])
+}
+
+func newCmsg(level, opt int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(opt)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
 
-	fd, err = unix.Socket(family, unix.SOCK_DGRAM, protocol)
+// setSocketOptions applies the socket tuning options from the tunnel
+// configuration.  It should be called before the socket is bound.
+func (cp *controlPlane) setSocketOptions(cfg *TunnelConfig) (err error) {
+	if cp.mux != nil {
+		return nil
+	}
+	if cfg.RecvBufferSize > 0 {
+		err = setBufferSize(cp.fd, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, cfg.RecvBufferSize)
+		if err != nil {
+			return fmt.Errorf("setsockopt(SO_RCVBUF): %v", err)
+		}
+	}
+	if cfg.SendBufferSize > 0 {
+		err = setBufferSize(cp.fd, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, cfg.SendBufferSize)
+		if err != nil {
+			return fmt.Errorf("setsockopt(SO_SNDBUF): %v", err)
+		}
+	}
+	if cfg.BindDevice != "" {
+		err = unix.BindToDevice(cp.fd, cfg.BindDevice)
+		if err != nil {
+			return fmt.Errorf("setsockopt(SO_BINDTODEVICE, %q): %v", cfg.BindDevice, err)
+		}
+	}
+	if cfg.PacketInfo {
+		level, opt, optName := unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, "IPV6_RECVPKTINFO"
+		if cp.isIPv4() {
+			level, opt, optName = unix.IPPROTO_IP, unix.IP_PKTINFO, "IP_PKTINFO"
+		}
+		err = unix.SetsockoptInt(cp.fd, level, opt, 1)
+		if err != nil {
+			return fmt.Errorf("setsockopt(%s): %v", optName, err)
+		}
+		cp.pktinfo = true
+	}
+	return nil
+}
+
+// Privileged processes may exceed the system buffer size limit using
+// the "force" variant of the buffer size options.
+func setBufferSize(fd, forceOpt, opt int, size uint32) error {
+	if int(size) < 0 {
+		return fmt.Errorf("buffer size %v out of range", size)
+	}
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, forceOpt, int(size))
+	if err == unix.EPERM {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, int(size))
+	}
+	return err
+}
+
+func tunnelSocket(family, sotype, protocol int) (fd int, err error) {
+
+	fd, err = unix.Socket(family, sotype, protocol)
 	if err != nil {
-		return -1, fmt.Errorf("socket: %v", err)
+		return -1, fmt.Errorf("socket: %w", err)
 	}
 
 	if err = unix.SetNonblock(fd, true); err != nil {
@@ -122,11 +638,32 @@ func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, er
 		return nil, fmt.Errorf("unexpected address type %T", localAddr)
 	}
 
-	fd, err := tunnelSocket(family, protocol)
+	// If the kernel doesn't support L2TP/IP sockets, fall back to using
+	// a raw IP socket for the control plane.  Note that the Linux kernel
+	// data plane requires an L2TP/IP socket, and the userspace data plane
+	// supports UDP encapsulation only, so tunnels using a raw socket
+	// reject sessions: see rawSocketDataPlane.
+	raw := false
+	fd, err := tunnelSocket(family, unix.SOCK_DGRAM, protocol)
+	if err != nil && protocol == unix.IPPROTO_L2TP && errors.Is(err, unix.EPROTONOSUPPORT) {
+		fd, err = tunnelSocket(family, unix.SOCK_RAW, protocol)
+		raw = true
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// An AF_INET6 UDP socket with an unspecified or IPv4-mapped local
+	// address may be used to communicate with IPv4 peers.  Don't rely on
+	// the system default (net.ipv6.bindv6only) to allow this.
+	if sa, ok := localAddr.(*unix.SockaddrInet6); ok && isV4MappedOrUnspecified(sa) {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+		if err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("setsockopt(IPV6_V6ONLY): %v", err)
+		}
+	}
+
 	file := os.NewFile(uintptr(fd), "l2tp")
 	sc, err := file.SyscallConn()
 	if err != nil {
@@ -141,5 +678,6 @@ func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, er
 		file:      file,
 		rc:        sc,
 		connected: false,
+		raw:       raw,
 	}, nil
 }
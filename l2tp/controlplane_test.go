@@ -0,0 +1,387 @@
+package l2tp
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseIPEncapFrame(t *testing.T) {
+	cases := []struct {
+		name          string
+		in            []byte
+		hasIPv4Header bool
+		sid           uint32
+		payload       []byte
+		expectFail    bool
+	}{
+		{
+			name:    "IPv6 control message",
+			in:      []byte{0x00, 0x00, 0x00, 0x00, 0xc8, 0x03, 0x00, 0x0c},
+			sid:     0,
+			payload: []byte{0xc8, 0x03, 0x00, 0x0c},
+		},
+		{
+			name:    "IPv6 data message",
+			in:      []byte{0x00, 0x01, 0xe2, 0x40, 0xaa, 0xbb},
+			sid:     123456,
+			payload: []byte{0xaa, 0xbb},
+		},
+		{
+			name: "IPv4 control message",
+			in: []byte{
+				0x45, 0x00, 0x00, 0x20, 0x00, 0x00, 0x40, 0x00,
+				0x40, 0x73, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x01,
+				0x7f, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+				0xc8, 0x03, 0x00, 0x0c,
+			},
+			hasIPv4Header: true,
+			sid:           0,
+			payload:       []byte{0xc8, 0x03, 0x00, 0x0c},
+		},
+		{
+			name: "IPv4 data message with options",
+			in: []byte{
+				0x46, 0x00, 0x00, 0x20, 0x00, 0x00, 0x40, 0x00,
+				0x40, 0x73, 0x00, 0x00, 0x7f, 0x00, 0x00, 0x01,
+				0x7f, 0x00, 0x00, 0x01, 0x01, 0x01, 0x01, 0x00,
+				0x00, 0x00, 0x00, 0x2a, 0xde, 0xad,
+			},
+			hasIPv4Header: true,
+			sid:           42,
+			payload:       []byte{0xde, 0xad},
+		},
+		{
+			name:       "truncated session ID",
+			in:         []byte{0x00, 0x00},
+			expectFail: true,
+		},
+		{
+			name: "truncated IPv4 header",
+			in: []byte{
+				0x45, 0x00, 0x00, 0x20, 0x00, 0x00, 0x40, 0x00,
+			},
+			hasIPv4Header: true,
+			expectFail:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sid, payload, err := parseIPEncapFrame(c.in, c.hasIPv4Header)
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("parseIPEncapFrame(%v) succeeded, expected failure", c.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIPEncapFrame(%v): %v", c.in, err)
+			}
+			if sid != c.sid {
+				t.Errorf("session ID: got %v, want %v", sid, c.sid)
+			}
+			if !bytes.Equal(payload, c.payload) {
+				t.Errorf("payload: got %v, want %v", payload, c.payload)
+			}
+		})
+	}
+}
+
+func TestRawControlPlaneDataPlane(t *testing.T) {
+	dp := &userspaceDataPlane{}
+	if got := (&controlPlane{}).dataPlane(dp); got != dp {
+		t.Errorf("dataPlane(): got %T, want the context data plane", got)
+	}
+	ndp := &nullDataPlane{}
+	if got := (&controlPlane{raw: true}).dataPlane(ndp); got != ndp {
+		t.Errorf("raw dataPlane(): got %T, want the null data plane", got)
+	}
+
+	rdp := (&controlPlane{raw: true}).dataPlane(dp)
+	tdp, err := rdp.NewTunnel(&TunnelConfig{Encap: EncapTypeIP}, nil, nil, -1)
+	if err != nil {
+		t.Fatalf("raw NewTunnel(): %v", err)
+	}
+	defer tdp.Down()
+	if _, err = rdp.NewSession(1, 2, &SessionConfig{}); err != errRawSocketSession {
+		t.Errorf("raw NewSession(): got %v, want %v", err, errRawSocketSession)
+	}
+
+	bt := newBaseTunnel(nil, "t1", &Context{dp: dp}, &TunnelConfig{})
+	bt.setDataPlane(tdp)
+	if _, ok := bt.getDP().(*rawSocketDataPlane); !ok {
+		t.Errorf("getDP(): got %T, want *rawSocketDataPlane", bt.getDP())
+	}
+}
+
+func TestControlPlaneDSCP(t *testing.T) {
+	cases := []struct {
+		name           string
+		local, peer    string
+		control, data  uint8
+		wantSocketTOS  int
+		wantControlTOS int
+	}{
+		{
+			name:           "IPv4 control and data",
+			local:          "127.0.0.1:9010",
+			peer:           "127.0.0.1:9011",
+			control:        48,
+			data:           10,
+			wantSocketTOS:  10 << 2,
+			wantControlTOS: 48 << 2,
+		},
+		{
+			name:           "IPv4 data only",
+			local:          "127.0.0.1:9010",
+			peer:           "127.0.0.1:9011",
+			data:           46,
+			wantSocketTOS:  46 << 2,
+			wantControlTOS: 0,
+		},
+		{
+			name:           "IPv6 control only",
+			local:          "[::1]:9010",
+			peer:           "[::1]:9011",
+			control:        48,
+			wantSocketTOS:  0,
+			wantControlTOS: 48 << 2,
+		},
+		{
+			name:           "IPv6 control and data equal",
+			local:          "[::1]:9010",
+			peer:           "[::1]:9011",
+			control:        34,
+			data:           34,
+			wantSocketTOS:  34 << 2,
+			wantControlTOS: 34 << 2,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newUDPAddressPair(c.local, c.peer)
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(): %v", err)
+			}
+
+			// Peer socket reports the TOS/traffic class of received packets
+			family, level, opt, recvOpt := unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, unix.IPV6_RECVTCLASS
+			if _, ok := sap.(*unix.SockaddrInet4); ok {
+				family, level, opt, recvOpt = unix.AF_INET, unix.IPPROTO_IP, unix.IP_TOS, unix.IP_RECVTOS
+			}
+			pfd, err := unix.Socket(family, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+			if err != nil {
+				t.Fatalf("socket: %v", err)
+			}
+			defer unix.Close(pfd)
+			if err = unix.SetsockoptInt(pfd, level, recvOpt, 1); err != nil {
+				t.Fatalf("setsockopt: %v", err)
+			}
+			if err = unix.Bind(pfd, sap); err != nil {
+				t.Fatalf("bind: %v", err)
+			}
+
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Fatalf("newL2tpControlPlane(): %v", err)
+			}
+			defer cp.close()
+			if err = cp.setDSCP(c.control, c.data); err != nil {
+				t.Fatalf("setDSCP(): %v", err)
+			}
+			if err = cp.bind(); err != nil {
+				t.Fatalf("bind(): %v", err)
+			}
+			if err = cp.connect(); err != nil {
+				t.Fatalf("connect(): %v", err)
+			}
+
+			tos, err := unix.GetsockoptInt(cp.fd, level, opt)
+			if err != nil {
+				t.Fatalf("getsockopt: %v", err)
+			}
+			if tos != c.wantSocketTOS {
+				t.Errorf("socket TOS: got %#x, want %#x", tos, c.wantSocketTOS)
+			}
+
+			if _, err = cp.write([]byte{0xc8, 0x03, 0x00, 0x0c}); err != nil {
+				t.Fatalf("write(): %v", err)
+			}
+
+			b := make([]byte, 64)
+			oob := make([]byte, unix.CmsgSpace(4))
+			_, oobn, _, _, err := unix.Recvmsg(pfd, b, oob, 0)
+			if err != nil {
+				t.Fatalf("recvmsg: %v", err)
+			}
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil || len(msgs) != 1 {
+				t.Fatalf("failed to parse control message: %v %v", msgs, err)
+			}
+			// IP_TOS is reported as a byte, IPV6_TCLASS as an int
+			got := int(msgs[0].Data[0])
+			if got != c.wantControlTOS {
+				t.Errorf("control message TOS: got %#x, want %#x", got, c.wantControlTOS)
+			}
+		})
+	}
+}
+
+func TestControlPlaneDSCPRange(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9010", "127.0.0.1:9011")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	defer cp.close()
+	if err = cp.setDSCP(64, 0); err == nil {
+		t.Errorf("setDSCP(64, 0) succeeded, expected failure")
+	}
+}
+
+func TestControlPlaneSocketOptions(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9012", "127.0.0.1:9013")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	defer cp.close()
+
+	cfg := &TunnelConfig{
+		RecvBufferSize: 65536,
+		SendBufferSize: 32768,
+		BindDevice:     "lo",
+	}
+	if err = cp.setSocketOptions(cfg); err != nil {
+		t.Fatalf("setSocketOptions(): %v", err)
+	}
+
+	// The kernel doubles the requested size to allow for overheads
+	for _, c := range []struct {
+		opt  int
+		name string
+		want uint32
+	}{
+		{unix.SO_RCVBUF, "SO_RCVBUF", cfg.RecvBufferSize},
+		{unix.SO_SNDBUF, "SO_SNDBUF", cfg.SendBufferSize},
+	} {
+		got, err := unix.GetsockoptInt(cp.fd, unix.SOL_SOCKET, c.opt)
+		if err != nil {
+			t.Fatalf("getsockopt(%s): %v", c.name, err)
+		}
+		if got < int(c.want) {
+			t.Errorf("%s: got %v, want at least %v", c.name, got, c.want)
+		}
+	}
+
+	dev, err := unix.GetsockoptString(cp.fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	if err != nil {
+		t.Fatalf("getsockopt(SO_BINDTODEVICE): %v", err)
+	}
+	if dev != cfg.BindDevice {
+		t.Errorf("SO_BINDTODEVICE: got %q, want %q", dev, cfg.BindDevice)
+	}
+
+	if err = cp.setSocketOptions(&TunnelConfig{BindDevice: "nosuchdev0"}); err == nil {
+		t.Errorf("setSocketOptions() with bad device succeeded, expected failure")
+	}
+}
+
+func TestControlPlanePacketInfo(t *testing.T) {
+	cases := []struct {
+		name                 string
+		local, peer, dstAddr string
+		pktinfo              bool
+		wantSrc              net.IP
+	}{
+		{
+			name:    "IPv4 with packet info",
+			local:   "0.0.0.0:9014",
+			peer:    "127.0.0.1:9015",
+			dstAddr: "127.0.0.2",
+			pktinfo: true,
+			wantSrc: net.ParseIP("127.0.0.2"),
+		},
+		{
+			name:    "IPv4 without packet info",
+			local:   "0.0.0.0:9014",
+			peer:    "127.0.0.1:9015",
+			dstAddr: "127.0.0.2",
+			wantSrc: net.ParseIP("127.0.0.1"),
+		},
+		{
+			name:    "IPv6 with packet info",
+			local:   "[::]:9014",
+			peer:    "[::1]:9015",
+			dstAddr: "::1",
+			pktinfo: true,
+			wantSrc: net.ParseIP("::1"),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newUDPAddressPair(c.local, c.peer)
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(): %v", err)
+			}
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Fatalf("newL2tpControlPlane(): %v", err)
+			}
+			defer cp.close()
+			if err = cp.setSocketOptions(&TunnelConfig{PacketInfo: c.pktinfo}); err != nil {
+				t.Fatalf("setSocketOptions(): %v", err)
+			}
+			if err = cp.bind(); err != nil {
+				t.Fatalf("bind(): %v", err)
+			}
+
+			peer, err := net.ListenPacket("udp", c.peer)
+			if err != nil {
+				t.Fatalf("net.ListenPacket(): %v", err)
+			}
+			defer peer.Close()
+
+			// The peer contacts us on a specific local address...
+			_, port, _ := net.SplitHostPort(c.local)
+			dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.dstAddr, port))
+			if err != nil {
+				t.Fatalf("net.ResolveUDPAddr(): %v", err)
+			}
+			if _, err = peer.WriteTo([]byte{0xc8, 0x02, 0x00, 0x0c}, dst); err != nil {
+				t.Fatalf("WriteTo(): %v", err)
+			}
+			b := make([]byte, 64)
+			if _, _, err = cp.recvFrom(b); err != nil {
+				t.Fatalf("recvFrom(): %v", err)
+			}
+
+			// ...and our reply should come from that address if packet
+			// info is in use.
+			if _, err = cp.write([]byte{0xc8, 0x02, 0x00, 0x0c}); err != nil {
+				t.Fatalf("write(): %v", err)
+			}
+			err = peer.SetReadDeadline(time.Now().Add(time.Second))
+			if err != nil {
+				t.Fatalf("SetReadDeadline(): %v", err)
+			}
+			_, from, err := peer.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("ReadFrom(): %v", err)
+			}
+			if src := from.(*net.UDPAddr).IP; !src.Equal(c.wantSrc) {
+				t.Errorf("reply source: got %v, want %v", src, c.wantSrc)
+			}
+		})
+	}
+}
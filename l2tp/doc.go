@@ -22,10 +22,13 @@ Currently package l2tp implements:
 
  * support for controlling the Linux L2TP data plane for L2TPv2 and
    L2TPv3 tunnels and sessions,
- * the L2TPv2 control plane for client/LAC mode.
+ * the L2TPv2 control plane for client/LAC mode,
+ * the L2TPv3 control plane with PPP and Ethernet pseudowires,
+ * acceptance of L2TPv2 and L2TPv3 tunnels in server/LNS mode,
+ * L2TPv2 and L2TPv3 tunnel authentication using a shared secret.
 
 In the future we plan to add support for the L2TPv3 control plane, and
-server/LNS mode.
+sessions in server/LNS mode.
 
 Usage
 
@@ -71,15 +74,33 @@ acknowledged using the L2TP reliable transport algorithm.  This slight extension
 allows for detection of tunnel failure in an otherwise static setup.
 
 The final tunnel type is the dynamic tunnel.  This runs the full L2TP control protocol.
+Dynamic tunnels are usually created by the client/LAC, but may also be
+accepted from peers using a Listener, which runs the server/LNS side of the
+control protocol for each tunnel a peer initiates.  Should a peer initiate
+a tunnel while a tunnel to that peer is being opened, the Tie Breaker AVP
+is used to retain just one of the tunnels.
+
+Dynamic L2TPv2 tunnels carry PPP sessions, while dynamic L2TPv3 tunnels carry
+PPP or Ethernet pseudowire sessions.  The Linux data plane presents each Ethernet
+pseudowire session as an l2tpeth interface.
 
 Configuration
 
 Each tunnel and session instance can be configured using the TunnelConfig
 and SessionConfig types respectively.
 
-These types can be generated as required for your use-case.  This partner
-package config in this repository implements a TOML parser for expressing
-L2TP configuration using a configuration file.
+These types can be generated as required for your use-case.  Alternatively
+NewTunnelConfig and NewSessionConfig build configurations from a list of
+options, such as WithPeer and WithPseudowire, which validate the values
+they are given and leave the remaining parameters at their defaults:
+
+	tcfg, err := l2tp.NewTunnelConfig(
+		l2tp.WithPeer("192.0.2.1:1701"),
+		l2tp.WithVersion(l2tp.ProtocolVersion3),
+		l2tp.WithHelloTimeout(5*time.Second))
+
+The partner package config in this repository implements a TOML parser for
+expressing L2TP configuration using a configuration file.
 
 Logging
 
@@ -88,6 +109,15 @@ logger: https://godoc.org/github.com/go-kit/kit/log, and uses go-kit levels
 in order to separate verbose debugging logs from normal informational output:
 https://godoc.org/github.com/go-kit/kit/log/level.
 
+Each line logged for a tunnel carries the tunnel's name and ID and the peer's
+address as context, each line logged for a session carries the session's
+name and ID, and control messages are logged along with their message type.
+
+The partner package logging in this repository defines the logger interface,
+which go-kit loggers implement, along with an adapter for log/slog loggers and
+a filter setting the level of logging of each subsystem, such as the control
+protocol transport or the data plane.
+
 Logging emitted at level.Info should be enabled for normal useful runtime
 information about the lifetime of tunnels and sessions.
 
@@ -0,0 +1,137 @@
+package l2tp
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+var _ DiscoveringDataPlane = (*fallbackDataPlane)(nil)
+
+// NewFallbackDataPlane returns a data plane which uses the Linux kernel
+// L2TP subsystem where it can, and falls back to the userspace data plane
+// returned by NewUserspaceDataPlane where it can't.
+//
+// If the kernel L2TP subsystem is unavailable all tunnels use the
+// userspace data plane.  Otherwise each tunnel falls back to the
+// userspace data plane if the kernel fails to instantiate it, for example
+// because the module for its encapsulation isn't loaded.  Sessions use
+// the data plane of their tunnel, so a session whose tunnel uses the
+// kernel data plane fails if the kernel can't instantiate the session.
+//
+// The data plane used by each tunnel and session is logged using the Info
+// level, and the failures which cause a fallback using the Error level.
+// If a nil logger is passed, logging is disabled.
+func NewFallbackDataPlane(openPort SessionPortFunc, logger log.Logger) (DataPlane, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	logger = log.With(logger, "function", "dataplane")
+
+	udp, err := NewUserspaceDataPlane(openPort)
+	if err != nil {
+		return nil, err
+	}
+
+	dp := &fallbackDataPlane{
+		logger:    logger,
+		userspace: udp.(*userspaceDataPlane),
+	}
+	kdp, err := newNetlinkDataPlane()
+	if err != nil {
+		level.Error(logger).Log(
+			"message", "kernel data plane unavailable, falling back to userspace data plane",
+			"error", err)
+	} else {
+		dp.kernel = kdp
+	}
+	return dp, nil
+}
+
+type fallbackDataPlane struct {
+	logger log.Logger
+	// kernel is nil if the kernel data plane is unavailable
+	kernel    DataPlane
+	userspace *userspaceDataPlane
+}
+
+func (dp *fallbackDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	var kerr error
+	if dp.kernel != nil {
+		tdp, err := dp.kernel.NewTunnel(tcfg, sal, sap, fd)
+		if err == nil {
+			level.Info(dp.logger).Log(
+				"message", "tunnel using kernel data plane",
+				"tunnel_id", tcfg.TunnelID)
+			return tdp, nil
+		}
+		level.Error(dp.logger).Log(
+			"message", "kernel data plane failed, falling back to userspace data plane",
+			"tunnel_id", tcfg.TunnelID,
+			"error", err)
+		kerr = err
+	}
+
+	tdp, err := dp.userspace.NewTunnel(tcfg, sal, sap, fd)
+	if err != nil {
+		if kerr != nil {
+			return nil, fmt.Errorf("%v, and %v", kerr, err)
+		}
+		return nil, err
+	}
+	level.Info(dp.logger).Log(
+		"message", "tunnel using userspace data plane",
+		"tunnel_id", tcfg.TunnelID)
+	return tdp, nil
+}
+
+func (dp *fallbackDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	name, sdp := "kernel", dp.kernel
+	if dp.userspace.hasTunnel(tid) {
+		name, sdp = "userspace", dp.userspace
+	} else if dp.kernel == nil {
+		return nil, fmt.Errorf("no data plane for tunnel %v", tid)
+	}
+
+	s, err := sdp.NewSession(tid, ptid, scfg)
+	if err != nil {
+		return nil, err
+	}
+	level.Info(dp.logger).Log(
+		"message", fmt.Sprintf("session using %s data plane", name),
+		"tunnel_id", tid,
+		"session_id", scfg.SessionID)
+	return s, nil
+}
+
+// Only the kernel data plane has tunnels which outlive the Context.
+
+func (dp *fallbackDataPlane) DiscoverTunnels() ([]DiscoveredTunnel, error) {
+	if ddp, ok := dp.kernel.(DiscoveringDataPlane); ok {
+		return ddp.DiscoverTunnels()
+	}
+	return nil, nil
+}
+
+func (dp *fallbackDataPlane) AdoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error) {
+	if ddp, ok := dp.kernel.(DiscoveringDataPlane); ok {
+		return ddp.AdoptTunnel(tcfg)
+	}
+	return nil, fmt.Errorf("kernel data plane unavailable")
+}
+
+func (dp *fallbackDataPlane) AdoptSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	if ddp, ok := dp.kernel.(DiscoveringDataPlane); ok {
+		return ddp.AdoptSession(tid, ptid, scfg)
+	}
+	return nil, fmt.Errorf("kernel data plane unavailable")
+}
+
+func (dp *fallbackDataPlane) Close() {
+	if dp.kernel != nil {
+		dp.kernel.Close()
+	}
+	dp.userspace.Close()
+}
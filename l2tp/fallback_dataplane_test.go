@@ -0,0 +1,103 @@
+package l2tp
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// brokenDataPlane stands in for a kernel data plane which fails to
+// instantiate tunnels of the listed IDs.
+type brokenDataPlane struct {
+	nullDataPlane
+	fail map[ControlConnID]bool
+}
+
+func (bdp *brokenDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	if bdp.fail[tcfg.TunnelID] {
+		return nil, errors.New("protocol not supported")
+	}
+	return &nullTunnelDataPlane{}, nil
+}
+
+func TestFallbackDataPlane(t *testing.T) {
+	if _, err := NewFallbackDataPlane(nil, nil); err == nil {
+		t.Errorf("NewFallbackDataPlane(nil): expected error")
+	}
+
+	openPort := func(tid ControlConnID, cfg *SessionConfig) (io.ReadWriteCloser, string, error) {
+		return newChanPort(), "", nil
+	}
+	udp, err := NewUserspaceDataPlane(openPort)
+	if err != nil {
+		t.Fatalf("NewUserspaceDataPlane(): %v", err)
+	}
+	dp := &fallbackDataPlane{
+		logger:    log.NewNopLogger(),
+		kernel:    &brokenDataPlane{fail: map[ControlConnID]bool{2: true, 3: true}},
+		userspace: udp.(*userspaceDataPlane),
+	}
+	defer dp.Close()
+
+	cases := []struct {
+		name      string
+		tcfg      *TunnelConfig
+		userspace bool
+		isErr     bool
+	}{
+		{
+			name: "Kernel",
+			tcfg: &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 11},
+		},
+		{
+			name:      "Userspace",
+			tcfg:      &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 2, PeerTunnelID: 12},
+			userspace: true,
+		},
+		{
+			// The userspace data plane doesn't support IP encapsulation
+			name:  "Both fail",
+			tcfg:  &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeIP, TunnelID: 3, PeerTunnelID: 13},
+			isErr: true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal := &unix.SockaddrInet4{Port: 9040 + 2*i, Addr: [4]byte{127, 0, 0, 1}}
+			sap := &unix.SockaddrInet4{Port: 9041 + 2*i, Addr: [4]byte{127, 0, 0, 1}}
+			tdp, err := dp.NewTunnel(c.tcfg, sal, sap, -1)
+			if c.isErr {
+				if err == nil {
+					t.Fatalf("NewTunnel(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTunnel(): %v", err)
+			}
+			defer tdp.Down()
+
+			sdp, err := dp.NewSession(c.tcfg.TunnelID, c.tcfg.PeerTunnelID,
+				&SessionConfig{SessionID: 10, PeerSessionID: 20, Pseudowire: PseudowireTypeEth})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+			defer sdp.Down()
+
+			_, isUserspace := sdp.(*userspaceSessionDataPlane)
+			if isUserspace != c.userspace {
+				t.Errorf("NewSession(): got %T, want userspace %v", sdp, c.userspace)
+			}
+		})
+	}
+
+	// Without the kernel data plane, sessions can't be created in tunnels
+	// the userspace data plane doesn't have
+	dp.kernel = nil
+	if _, err := dp.NewSession(1, 11, &SessionConfig{SessionID: 10, PeerSessionID: 20}); err == nil {
+		t.Errorf("NewSession(): expected error for unknown tunnel")
+	}
+}
@@ -15,6 +15,9 @@ type eventDesc struct {
 type fsm struct {
 	current string
 	table   []eventDesc
+	// onTransition, if set, is called on each change of state
+	// prior to the callback for the event causing the change.
+	onTransition func(from, to string)
 }
 
 func (f *fsm) handleEvent(e string, args ...interface{}) error {
@@ -22,7 +25,7 @@ func (f *fsm) handleEvent(e string, args ...interface{}) error {
 		if f.current == t.from {
 			for _, event := range t.events {
 				if e == event {
-					f.current = t.to
+					f.setState(t.to)
 					if t.cb != nil {
 						t.cb(args)
 					}
@@ -33,3 +36,14 @@ func (f *fsm) handleEvent(e string, args ...interface{}) error {
 	}
 	return fmt.Errorf("no transition defined for event %v in state %v", e, f.current)
 }
+
+// setState moves the fsm to the specified state without handling an event.
+func (f *fsm) setState(s string) {
+	if s != f.current {
+		from := f.current
+		f.current = s
+		if f.onTransition != nil {
+			f.onTransition(from, s)
+		}
+	}
+}
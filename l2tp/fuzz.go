@@ -0,0 +1,24 @@
+// +build gofuzz
+
+package l2tp
+
+// Fuzz is the entry point for fuzzing the control message parser using
+// go-fuzz (https://github.com/dvyukov/go-fuzz).
+//
+// Inputs found to trigger parser bugs should be added to the regression
+// corpus in testdata/parser-corpus, which is run by TestParserCorpus.
+func Fuzz(data []byte) int {
+	msgs, err := parseMessageBuffer(data, nil)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		_ = msg.getType()
+		_ = msg.validate()
+		for _, a := range msg.getAvps() {
+			_, _ = a.decode()
+			_ = a.String()
+		}
+	}
+	return 1
+}
@@ -0,0 +1,238 @@
+package l2tp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// IDAllocator allocates local tunnel and session IDs for tunnels and
+// sessions whose configuration doesn't specify them.
+//
+// For L2TPv2 the IDs allocated must fit in 16 bits, while for L2TPv3
+// the full 32 bit range may be used.  Zero is never a valid ID.
+//
+// The Context checks the IDs returned against the tunnels and sessions
+// it already has, and against the session IDs in quarantine (see
+// Context.SetSessionIDQuarantine), and asks for another ID if one is in
+// use.  An error return aborts creation of the tunnel or session.
+//
+// An IDAllocator may be called concurrently from multiple go routines.
+type IDAllocator interface {
+	// AllocTunnelID returns an ID for a new tunnel (L2TPv2) or control
+	// connection (L2TPv3).
+	AllocTunnelID(version ProtocolVersion) (ControlConnID, error)
+
+	// AllocSessionID returns an ID for a new session in the tunnel
+	// with the specified local tunnel ID.
+	AllocSessionID(tunnelID ControlConnID, version ProtocolVersion) (ControlConnID, error)
+}
+
+// IDReleaser may be implemented by an IDAllocator which needs to know
+// when the session IDs it allocates are no longer in use.
+type IDReleaser interface {
+	// ReleaseSessionID is called when a session in the tunnel with the
+	// specified local tunnel ID is torn down.  It is called for all
+	// sessions, including those whose ID wasn't allocated by the
+	// IDAllocator, and for IDs the Context doesn't use because they
+	// are quarantined.
+	ReleaseSessionID(tunnelID, sessionID ControlConnID, version ProtocolVersion)
+}
+
+// randomIDAllocator is the default IDAllocator, picking IDs at random.
+type randomIDAllocator struct{}
+
+func (randomIDAllocator) AllocTunnelID(version ProtocolVersion) (ControlConnID, error) {
+	return generateControlConnID(version)
+}
+
+func (randomIDAllocator) AllocSessionID(tunnelID ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	return generateControlConnID(version)
+}
+
+// NewRandomIDAllocator returns an IDAllocator which picks IDs at random.
+// This is the allocator a Context uses by default.
+func NewRandomIDAllocator() IDAllocator {
+	return randomIDAllocator{}
+}
+
+// sequentialIDAllocator allocates IDs in ascending order, wrapping at the
+// maximum ID for the protocol version.
+type sequentialIDAllocator struct {
+	lock    sync.Mutex
+	nextTid ControlConnID
+	nextSid ControlConnID
+}
+
+// NewSequentialIDAllocator returns an IDAllocator which allocates tunnel
+// and session IDs in ascending order, starting from one.
+func NewSequentialIDAllocator() IDAllocator {
+	return &sequentialIDAllocator{}
+}
+
+func (a *sequentialIDAllocator) AllocTunnelID(version ProtocolVersion) (ControlConnID, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return nextSequentialID(&a.nextTid, version)
+}
+
+func (a *sequentialIDAllocator) AllocSessionID(tunnelID ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return nextSequentialID(&a.nextSid, version)
+}
+
+// poolIDAllocator allocates session IDs from a fixed pool, reusing the
+// least recently released ID first.
+type poolIDAllocator struct {
+	lock sync.Mutex
+	free []ControlConnID
+	// The pool's IDs, and whether each is free
+	pool map[ControlConnID]bool
+}
+
+// NewPoolIDAllocator returns an IDAllocator which allocates session IDs
+// from the pool provided, and tunnel IDs at random.
+//
+// The pool is shared by all the tunnels in the Context.  IDs are returned
+// to the pool when the sessions using them are torn down, and are reused
+// in the order they were released.  Once all the IDs in the pool are in
+// use creation of further sessions fails.
+//
+// IDs which are zero, or too large for the protocol version of the
+// tunnel, are skipped.
+func NewPoolIDAllocator(sessionIDs []ControlConnID) IDAllocator {
+	a := &poolIDAllocator{
+		pool: make(map[ControlConnID]bool),
+	}
+	for _, id := range sessionIDs {
+		if _, ok := a.pool[id]; !ok && id != 0 {
+			a.pool[id] = true
+			a.free = append(a.free, id)
+		}
+	}
+	return a
+}
+
+func (a *poolIDAllocator) AllocTunnelID(version ProtocolVersion) (ControlConnID, error) {
+	return generateControlConnID(version)
+}
+
+func (a *poolIDAllocator) AllocSessionID(tunnelID ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, id := range a.free {
+		if version == ProtocolVersion2 && id > v2TidSidMax {
+			continue
+		}
+		a.free = append(a.free[:i], a.free[i+1:]...)
+		a.pool[id] = false
+		return id, nil
+	}
+	return 0, fmt.Errorf("session ID pool exhausted")
+}
+
+func (a *poolIDAllocator) ReleaseSessionID(tunnelID, sessionID ControlConnID, version ProtocolVersion) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if free, ok := a.pool[sessionID]; ok && !free {
+		a.pool[sessionID] = true
+		a.free = append(a.free, sessionID)
+	}
+}
+
+// idQuarantine tracks recently released session IDs, which mustn't be
+// reused until the quarantine window has passed.  This avoids data
+// packets for a session which has been torn down being delivered to
+// a new session with the same ID.
+//
+// L2TPv2 session IDs are scoped by tunnel, while L2TPv3 session IDs
+// are unique to the host.
+type idQuarantine struct {
+	lock   sync.Mutex
+	window time.Duration
+	until  map[idQuarantineKey]time.Time
+}
+
+type idQuarantineKey struct {
+	version   ProtocolVersion
+	tunnelID  ControlConnID
+	sessionID ControlConnID
+}
+
+func newIDQuarantine() *idQuarantine {
+	return &idQuarantine{
+		until: make(map[idQuarantineKey]time.Time),
+	}
+}
+
+func quarantineKey(tunnelID, sessionID ControlConnID, version ProtocolVersion) idQuarantineKey {
+	if version != ProtocolVersion2 {
+		tunnelID = 0
+	}
+	return idQuarantineKey{version: version, tunnelID: tunnelID, sessionID: sessionID}
+}
+
+func (q *idQuarantine) setWindow(window time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.window = window
+	if window <= 0 {
+		q.until = make(map[idQuarantineKey]time.Time)
+	}
+}
+
+// add quarantines a session ID which has been released.
+func (q *idQuarantine) add(tunnelID, sessionID ControlConnID, version ProtocolVersion) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.window <= 0 {
+		return
+	}
+	now := time.Now()
+	for key, until := range q.until {
+		if !now.Before(until) {
+			delete(q.until, key)
+		}
+	}
+	q.until[quarantineKey(tunnelID, sessionID, version)] = now.Add(q.window)
+}
+
+// contains returns true if a session ID is quarantined.
+func (q *idQuarantine) contains(tunnelID, sessionID ControlConnID, version ProtocolVersion) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	until, ok := q.until[quarantineKey(tunnelID, sessionID, version)]
+	return ok && time.Now().Before(until)
+}
+
+func nextSequentialID(last *ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	var max ControlConnID
+	switch version {
+	case ProtocolVersion2:
+		max = v2TidSidMax
+	case ProtocolVersion3:
+		max = ControlConnID(^uint32(0))
+	default:
+		return 0, fmt.Errorf("unhandled version %v", version)
+	}
+	if *last >= max {
+		*last = 0
+	}
+	*last++
+	return *last, nil
+}
+
+func generateControlConnID(version ProtocolVersion) (ControlConnID, error) {
+	var id ControlConnID
+	switch version {
+	case ProtocolVersion2:
+		id = ControlConnID(uint16(rand.Uint32()))
+	case ProtocolVersion3:
+		id = ControlConnID(rand.Uint32())
+	default:
+		return 0, fmt.Errorf("unhandled version %v", version)
+	}
+	return id, nil
+}
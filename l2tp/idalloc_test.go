@@ -0,0 +1,175 @@
+package l2tp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSequentialIDAllocator(t *testing.T) {
+	a := NewSequentialIDAllocator().(*sequentialIDAllocator)
+
+	for _, want := range []ControlConnID{1, 2, 3} {
+		got, err := a.AllocTunnelID(ProtocolVersion3)
+		if err != nil {
+			t.Fatalf("AllocTunnelID(): %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocTunnelID(): got %v, want %v", got, want)
+		}
+	}
+
+	// IDs wrap at the maximum for the protocol version, skipping zero
+	a.nextSid = v2TidSidMax - 1
+	for _, want := range []ControlConnID{v2TidSidMax, 1} {
+		got, err := a.AllocSessionID(1, ProtocolVersion2)
+		if err != nil {
+			t.Fatalf("AllocSessionID(): %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocSessionID(): got %v, want %v", got, want)
+		}
+	}
+
+	if _, err := a.AllocTunnelID(ProtocolVersion(1)); err == nil {
+		t.Errorf("AllocTunnelID() with bad version succeeded, expected failure")
+	}
+}
+
+type testFailingIDAllocator struct{}
+
+func (testFailingIDAllocator) AllocTunnelID(version ProtocolVersion) (ControlConnID, error) {
+	return 0, errors.New("pool exhausted")
+}
+
+func (testFailingIDAllocator) AllocSessionID(tunnelID ControlConnID, version ProtocolVersion) (ControlConnID, error) {
+	return 0, errors.New("pool exhausted")
+}
+
+func TestContextIDAllocator(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	ctx.SetIDAllocator(NewSequentialIDAllocator())
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9028",
+		Peer:           "127.0.0.1:9029",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		MaxRetries:     1,
+		RetryTimeout:   50 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+	if tid := tunl.(tunnel).getCfg().TunnelID; tid != 1 {
+		t.Errorf("tunnel ID: got %v, want 1", tid)
+	}
+
+	dt := tunl.(*dynamicTunnel)
+	for _, want := range []ControlConnID{1, 2} {
+		sid, err := dt.allocSid()
+		if err != nil {
+			t.Fatalf("allocSid(): %v", err)
+		}
+		if sid != want {
+			t.Errorf("allocSid(): got %v, want %v", sid, want)
+		}
+	}
+
+	// An allocation failure aborts creation of the tunnel or session
+	ctx.SetIDAllocator(testFailingIDAllocator{})
+	_, err = ctx.NewDynamicTunnel("t2", cfg)
+	if err == nil {
+		t.Errorf("NewDynamicTunnel() with failing allocator succeeded, expected failure")
+	}
+	if _, err = dt.allocSid(); err == nil {
+		t.Errorf("allocSid() with failing allocator succeeded, expected failure")
+	}
+}
+
+func TestPoolIDAllocator(t *testing.T) {
+	a := NewPoolIDAllocator([]ControlConnID{0, 70000, 3, 4, 3})
+
+	// Zero and duplicate IDs are ignored, and IDs too large for L2TPv2
+	// are skipped
+	for _, want := range []ControlConnID{3, 4} {
+		got, err := a.AllocSessionID(1, ProtocolVersion2)
+		if err != nil {
+			t.Fatalf("AllocSessionID(): %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocSessionID(): got %v, want %v", got, want)
+		}
+	}
+	if _, err := a.AllocSessionID(1, ProtocolVersion2); err == nil {
+		t.Errorf("AllocSessionID() from exhausted pool succeeded, expected failure")
+	}
+
+	// Released IDs are reused in the order they were released, and
+	// IDs not from the pool are ignored
+	r := a.(IDReleaser)
+	r.ReleaseSessionID(1, 4, ProtocolVersion3)
+	r.ReleaseSessionID(1, 5, ProtocolVersion3)
+	r.ReleaseSessionID(1, 3, ProtocolVersion3)
+	r.ReleaseSessionID(1, 3, ProtocolVersion3)
+	for _, want := range []ControlConnID{70000, 4, 3} {
+		got, err := a.AllocSessionID(1, ProtocolVersion3)
+		if err != nil {
+			t.Fatalf("AllocSessionID(): %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocSessionID(): got %v, want %v", got, want)
+		}
+	}
+	if _, err := a.AllocSessionID(1, ProtocolVersion3); err == nil {
+		t.Errorf("AllocSessionID() from exhausted pool succeeded, expected failure")
+	}
+}
+
+func TestSessionIDQuarantine(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	ctx.SetIDAllocator(NewPoolIDAllocator([]ControlConnID{5}))
+	ctx.SetSessionIDQuarantine(200 * time.Millisecond)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9057",
+		Peer:           "127.0.0.1:9058",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		MaxRetries:     1,
+		RetryTimeout:   50 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+	dt := tunl.(*dynamicTunnel)
+
+	sid, err := dt.allocSid()
+	if err != nil || sid != 5 {
+		t.Fatalf("allocSid(): got %v %v, want 5", sid, err)
+	}
+
+	// A released ID can't be reused until the quarantine has passed
+	dt.releaseSid(sid)
+	if sid, err = dt.allocSid(); err == nil {
+		t.Errorf("allocSid() during quarantine: got %v, expected failure", sid)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if sid, err = dt.allocSid(); err != nil || sid != 5 {
+		t.Errorf("allocSid() after quarantine: got %v %v, want 5", sid, err)
+	}
+}
@@ -1,10 +1,13 @@
 package l2tp
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,12 +21,26 @@ type Context struct {
 	logger        log.Logger
 	tunnelsByName map[string]tunnel
 	tunnelsByID   map[ControlConnID]tunnel
+	tunnelsByPeer map[string]tunnel
+	peerKeys      map[tunnel]string
+	maxTunnels    int
+	reserved      int
 	tlock         sync.RWMutex
 	dp            DataPlane
 	callSerial    uint32
 	serialLock    sync.Mutex
 	eventHandlers []EventHandler
 	evtLock       sync.RWMutex
+	peerVersions  map[string]ProtocolVersion
+	pvLock        sync.Mutex
+	muxes         map[string]*socketMux
+	muxLock       sync.Mutex
+	listeners     map[string]*listener
+	idAlloc       IDAllocator
+	idAllocLock   sync.RWMutex
+	sidQuarantine *idQuarantine
+	acceptor      SessionAcceptor
+	acceptorLock  sync.RWMutex
 }
 
 // Tunnel is an interface representing an L2TP tunnel.
@@ -33,10 +50,100 @@ type Tunnel interface {
 	// The name provided must be unique in the parent tunnel.
 	NewSession(name string, cfg *SessionConfig) (Session, error)
 
+	// NewSessionAsync adds a session to a tunnel instance as per
+	// NewSession, calling done once the session is established or
+	// fails to establish.
+	//
+	// Static and quiescent sessions are established on creation, so
+	// done is called before NewSessionAsync returns.  For dynamic
+	// sessions done is called from the session's goroutine once the
+	// control protocol exchange with the peer completes.
+	//
+	// done is not called if NewSessionAsync returns an error.
+	NewSessionAsync(name string, cfg *SessionConfig, done EstablishCallback) (Session, error)
+
 	// Close closes the tunnel, releasing allocated resources.
 	//
 	// Any sessions instantiated inside the tunnel are removed.
 	Close()
+
+	// CloseWithResult closes the tunnel as per Close, informing the peer
+	// of the reason for closing the tunnel.
+	//
+	// For dynamic tunnels the sessions in the tunnel are removed, then
+	// the result is sent to the peer in a StopCCN message.  Resources are
+	// released once the peer acknowledges the StopCCN, or the tunnel's
+	// StopCCNTimeout expires.
+	//
+	// Other tunnel types don't inform the peer, so CloseWithResult is
+	// equivalent to Close.
+	CloseWithResult(result ResultCode, errCode ErrorCode, message string)
+
+	// Stats returns a snapshot of the tunnel's state and counters.
+	Stats() TunnelStats
+
+	// TransmitTimelines returns the transmission history of each control
+	// message the tunnel has sent which the peer has yet to acknowledge,
+	// in the order the messages were first sent.  It allows a slow or
+	// unresponsive peer to be diagnosed while retransmission is still in
+	// progress: once the retry limit is reached the timeline is reported
+	// by a TransmitTimeoutError instead.
+	//
+	// Static tunnels send no control messages, so have no timelines.
+	TransmitTimelines() []TransmitTimeline
+
+	// Sessions returns the sessions in the tunnel, keyed by name.
+	Sessions() map[string]Session
+
+	// FindSession looks up a session in the tunnel by name.
+	FindSession(name string) (Session, bool)
+
+	// FindSessionByID looks up a session in the tunnel by its local
+	// session ID.
+	FindSessionByID(sid ControlConnID) (Session, bool)
+
+	// FindSessionByPeerID looks up a session in the tunnel by the
+	// session ID assigned by the peer.
+	//
+	// Dynamic sessions created locally can't be found by peer ID
+	// until the peer has replied to the session's ICRQ.
+	FindSessionByPeerID(psid ControlConnID) (Session, bool)
+}
+
+// TunnelStats describes the state and activity of a tunnel.
+//
+// Static tunnels run no control protocol, and quiescent tunnels run only
+// enough of it to exchange HELLO messages: both are reported as being in
+// TunnelStateEstablished from creation.  The control message counters are
+// always zero for static tunnels.
+type TunnelStats struct {
+	// State is the state of the tunnel's control protocol state machine.
+	State TunnelState
+	// Uptime is how long the tunnel has been established for, or zero
+	// if the tunnel is not established.
+	Uptime time.Duration
+	// Sessions is the number of sessions in the tunnel.
+	Sessions int
+	// ControlTx and ControlRx count the control messages sent to and
+	// received from the peer, including acknowledgements.  ControlTx
+	// includes retransmissions, which are also counted by Retransmits.
+	ControlTx, ControlRx uint64
+	Retransmits          uint64
+	// Replays counts control messages discarded because they repeated
+	// messages already received from the peer, beyond what the peer's
+	// retransmissions account for.
+	Replays uint64
+	// LastError describes the most recent error encountered by the
+	// control protocol transport, or is empty if there has been none.
+	LastError string
+	// HelloRTT is the round trip time of the most recently acknowledged
+	// HELLO message, or zero if no HELLO has been acknowledged.
+	HelloRTT time.Duration
+	// Data holds the data plane counters for the tunnel, which cover the
+	// data packets of all the tunnel's sessions.  The counters are zero if
+	// the tunnel has no data plane instance, or if the data plane doesn't
+	// implement StatisticsTunnelDataPlane.
+	Data SessionDataPlaneStatistics
 }
 
 type tunnel interface {
@@ -53,6 +160,78 @@ type tunnel interface {
 type Session interface {
 	// Close closes the session, releasing allocated resources.
 	Close()
+
+	// CloseWithResult closes the session as per Close, informing the
+	// peer of the reason for closing the session.
+	//
+	// For dynamic sessions the result is sent to the peer in a CDN
+	// message if the session has been signalled to the peer, and is
+	// reported in the SessionDownEvent.  Static and quiescent sessions
+	// don't inform the peer, but report the result in the
+	// SessionDownEvent.
+	CloseWithResult(result ResultCode, errCode ErrorCode, message string)
+
+	// State returns the state of the session's control protocol state
+	// machine.  Static and quiescent sessions run no control protocol,
+	// so are reported as being in SessionStateEstablished from creation.
+	State() SessionState
+
+	// Stats returns a snapshot of the session's state and counters.
+	Stats() SessionStats
+
+	// Trigger requests the establishment of an on-demand session, e.g.
+	// on the arrival of traffic on the session's attachment circuit.
+	// It has no effect if the session is already established or being
+	// established, or if the session isn't an on-demand session.
+	Trigger()
+
+	// ReadFrame reads the next frame received from the peer into b,
+	// blocking until one is available, and WriteFrame sends a frame to
+	// the peer.  This allows the application to process the session's
+	// frames without a network interface, but requires the session's
+	// data plane instance to be the userspace data plane using
+	// OpenFramePort: otherwise, or while the session has no data plane
+	// instance, they return ErrNoFrameAccess.  Calls blocked when the
+	// data plane instance is torn down return io.EOF.
+	ReadFrame(b []byte) (int, error)
+	WriteFrame(b []byte) (int, error)
+
+	// ReportIPCPUp informs the session that the IPCP protocol of the PPP
+	// link it carries has come up, so that registered EventHandler
+	// instances are passed a SessionIPCPUpEvent describing the
+	// negotiated addresses.  ReportIPCPDown likewise generates a
+	// SessionIPCPDownEvent when IPCP goes down.  They are called by the
+	// application running PPP for the session, such as package ppp, and
+	// have no effect unless the session is established: the
+	// SessionDownEvent of a session implies its PPP link is down.
+	ReportIPCPUp(info IPCPInfo)
+	ReportIPCPDown(info IPCPInfo)
+}
+
+// SessionStats describes the state and activity of a session.
+type SessionStats struct {
+	// State is the state of the session's control protocol state machine.
+	State SessionState
+	// Uptime is how long the session has been established for, or zero
+	// if the session is not established.
+	Uptime time.Duration
+	// ControlTx and ControlRx count the control messages sent to and
+	// received from the peer for the session.  They are always zero for
+	// static and quiescent sessions.
+	ControlTx, ControlRx uint64
+	// Data holds the data plane counters for the session.  The counters
+	// are zero if the session has no data plane instance, or if the data
+	// plane is unable to report them.
+	Data SessionDataPlaneStatistics
+	// Result describes why the session was last closed, or is empty if
+	// the session hasn't been closed.  For persistent sessions this
+	// describes the most recent disconnection by the peer.
+	Result string
+	// PeerTxConnectSpeed and PeerRxConnectSpeed are the transmit and
+	// receive speeds of the session's circuit in bits per second, as
+	// reported by the peer of a dynamic session.  They are zero if the
+	// peer didn't report them.
+	PeerTxConnectSpeed, PeerRxConnectSpeed uint64
 }
 
 type session interface {
@@ -92,6 +271,45 @@ type DataPlane interface {
 	Close()
 }
 
+// DiscoveringDataPlane may be implemented by a DataPlane whose tunnel and
+// session instances outlive the Context which created them, such as the
+// Linux kernel data plane.  It allows the instances left behind by a
+// previous Context, e.g. before an application restart, to be discovered
+// and adopted by a new Context.
+//
+// Only static tunnels can be adopted.  The kernel destroys a dynamic
+// tunnel when the application's tunnel socket is closed, and in any case
+// the control protocol state of a dynamic tunnel, such as its sequence
+// numbers and the peer's session negotiation, is held only by the
+// application and can't be recovered from the data plane.  Restarting an
+// application such as kl2tpd therefore still drops its dynamic tunnels,
+// which must be established afresh with their peers.
+type DiscoveringDataPlane interface {
+	DataPlane
+
+	// DiscoverTunnels lists the tunnels present in the data plane,
+	// along with their sessions.
+	DiscoverTunnels() ([]DiscoveredTunnel, error)
+
+	// AdoptTunnel returns a data plane instance for a tunnel which
+	// is already present in the data plane.
+	AdoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error)
+
+	// AdoptSession returns a data plane instance for a session which
+	// is already present in the data plane.
+	AdoptSession(tunnelID, peerTunnelID ControlConnID, scfg *SessionConfig) (SessionDataPlane, error)
+}
+
+// DiscoveredTunnel describes a tunnel found in a data plane.
+//
+// The configurations describe as much of the tunnel and its sessions as
+// the data plane is able to report.  In particular, the tunnel's local
+// and peer addresses are unset if the data plane doesn't report them.
+type DiscoveredTunnel struct {
+	Config   *TunnelConfig
+	Sessions []*SessionConfig
+}
+
 // TunnelDataPlane is an interface representing a tunnel data plane.
 type TunnelDataPlane interface {
 	// Down performs the necessary actions to tear down the data plane.
@@ -99,9 +317,28 @@ type TunnelDataPlane interface {
 	Down() error
 }
 
+// StatisticsTunnelDataPlane may be implemented by a TunnelDataPlane able to
+// report counters for the data packets of all the tunnel's sessions, which
+// are reported by Tunnel.Stats alongside the control protocol counters.
+type StatisticsTunnelDataPlane interface {
+	TunnelDataPlane
+
+	// GetStatistics obtains tunnel statistics.
+	GetStatistics() (*SessionDataPlaneStatistics, error)
+}
+
 // SessionDataPlaneStatistics holds dataplane statistics for receipt and transmission.
 type SessionDataPlaneStatistics struct {
 	TxPackets, TxBytes, TxErrors, RxPackets, RxBytes, RxErrors uint64
+	// RxSeqDiscards counts data packets discarded due to sequence number
+	// errors, and RxOutOfSequence counts data packets received out of
+	// sequence.  Data planes which don't track sequence errors leave
+	// them zero.
+	RxSeqDiscards, RxOutOfSequence uint64
+	// RxCookieDiscards counts L2TPv3 data packets discarded because they
+	// didn't carry the cookie expected from the peer.  Data planes which
+	// don't track cookie mismatches leave it zero.
+	RxCookieDiscards uint64
 }
 
 // SessionDataPlane is an interface representing a session data plane.
@@ -118,6 +355,38 @@ type SessionDataPlane interface {
 	Down() error
 }
 
+// MTUSessionDataPlane may be implemented by a SessionDataPlane able to
+// change the MTU of the session's network interface once created, which
+// allows the interface MTU of sessions in dynamic tunnels to follow changes
+// in the path MTU to the peer.
+type MTUSessionDataPlane interface {
+	SessionDataPlane
+
+	// SetMTU sets the MTU of the session's network interface.
+	SetMTU(mtu uint16) error
+}
+
+// FrameSessionDataPlane may be implemented by a SessionDataPlane which
+// allows the application to exchange the session's frames directly,
+// as Session.ReadFrame and Session.WriteFrame do.
+type FrameSessionDataPlane interface {
+	SessionDataPlane
+
+	// ReadFrame reads the next frame received from the peer.
+	ReadFrame(b []byte) (int, error)
+
+	// WriteFrame sends a frame to the peer.
+	WriteFrame(b []byte) (int, error)
+}
+
+// EstablishCallback is called on completion of asynchronous tunnel or
+// session establishment.  err is nil if the tunnel or session was
+// established, or describes why it failed to establish otherwise.
+//
+// The callback is called from the goroutine of the tunnel or session,
+// so should not block.
+type EstablishCallback func(err error)
+
 // EventHandler is an interface for receiving L2TP-specific events.
 type EventHandler interface {
 	// HandleEvent is called when an event occurs.
@@ -131,16 +400,60 @@ type EventHandler interface {
 	HandleEvent(event interface{})
 }
 
+// Listener is an interface representing an L2TP listener, which accepts
+// dynamic tunnels initiated by peers.
+type Listener interface {
+	// Close closes the listener, such that no further tunnels are
+	// accepted.  Tunnels previously accepted by the listener are
+	// unaffected.
+	Close()
+
+	// Stats returns a snapshot of the listener's counters.
+	Stats() ListenerStats
+}
+
+// ListenerStats describes the activity of a listener.  SCCRQs discarded
+// as retransmissions of SCCRQs already accepted are not counted.
+type ListenerStats struct {
+	// Accepted counts the tunnels created by the listener.
+	Accepted uint64
+	// RateLimited counts the SCCRQs discarded for exceeding the
+	// listener's SccrqRateLimit or PeerSccrqRateLimit.
+	RateLimited uint64
+	// PendingLimited counts the SCCRQs discarded because
+	// MaxPendingTunnels tunnels were awaiting establishment.
+	PendingLimited uint64
+	// Unauthenticated counts the L2TPv3 SCCRQs discarded because they
+	// failed authentication using the listener's Secret.
+	Unauthenticated uint64
+	// Unauthorized counts the SCCRQs from peers not permitted by
+	// AllowedPeers or AllowedPeerHostNames, whether they were discarded
+	// or rejected.
+	Unauthorized uint64
+	// Failed counts the SCCRQs for which a tunnel couldn't be created,
+	// e.g. because the context's tunnel limit was reached.
+	Failed uint64
+	// Deferred counts the L2TPv3 SCCRQs the listener replied to without
+	// creating a tunnel, as set by DeferTunnelCreation, and Expired those
+	// for which the peer never sent an SCCCN.
+	Deferred uint64
+	Expired  uint64
+}
+
 // TunnelUpEvent is passed to registered EventHandler instances when a
 // tunnel comes up.  In the case of static or quiescent tunnels, this occurs
 // immediately on instantiation of the tunnel.  For dynamic tunnels, this
 // occurs on completion of the L2TP control protocol message exchange with
 // the peer.
+//
+// For dynamic tunnels PeerHostName is the host name the peer advertised
+// in the Host Name AVP.
 type TunnelUpEvent struct {
 	TunnelName                string
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	PeerHostName              string
 }
 
 // TunnelDownEvent is passed to registered EventHandler instances when a
@@ -148,11 +461,60 @@ type TunnelUpEvent struct {
 // immediately on closure of the tunnel.  For dynamic tunnels, this
 // occurs on completion of the L2TP control protocol message exchange with
 // the peer.
+//
+// For dynamic tunnels Result describes why the tunnel went down, e.g. the
+// result code of the StopCCN message sent or received, or the reason the
+// control connection failed.
 type TunnelDownEvent struct {
 	TunnelName                string
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	Result                    string
+}
+
+// TunnelEstablishFailedEvent is passed to registered EventHandler instances
+// when a dynamic tunnel closes without establishing the control connection
+// with the peer, either because the peer rejected the tunnel, the control
+// protocol failed, or the tunnel was closed by the application.
+//
+// Result describes why the tunnel failed, as for TunnelDownEvent.
+type TunnelEstablishFailedEvent struct {
+	TunnelName                string
+	Tunnel                    Tunnel
+	Config                    *TunnelConfig
+	LocalAddress, PeerAddress unix.Sockaddr
+	Result                    string
+}
+
+// TunnelAcceptEvent is passed to registered EventHandler instances when a
+// listener creates a dynamic tunnel on receipt of an SCCRQ from a peer.
+// The tunnel runs the control protocol to establish the control connection,
+// which is signalled with TunnelUpEvent.
+//
+// Sessions may be added to the tunnel on receipt of the event, in which case
+// they are started once the tunnel is established.
+//
+// PeerHostName is the host name the peer advertised in the Host Name AVP of
+// its SCCRQ, which may be used to decide whether to keep the tunnel.
+type TunnelAcceptEvent struct {
+	ListenerName              string
+	TunnelName                string
+	Tunnel                    Tunnel
+	Config                    *TunnelConfig
+	LocalAddress, PeerAddress unix.Sockaddr
+	PeerHostName              string
+}
+
+// TunnelStateEvent is passed to registered EventHandler instances when the
+// control protocol state of a dynamic tunnel changes.  A tunnel which
+// comes up successfully moves from TunnelStateIdle to TunnelStateEstablished
+// via. TunnelStateWaitCtlReply, while a tunnel which fails to come up moves
+// directly to TunnelStateDead from the state in which the failure occurred.
+type TunnelStateEvent struct {
+	TunnelName string
+	Tunnel     Tunnel
+	From, To   TunnelState
 }
 
 // SessionUpEvent is passed to registered EventHandler instances when a session
@@ -182,8 +544,94 @@ type SessionDownEvent struct {
 	SessionConfig *SessionConfig
 	InterfaceName string
 	Result        string
+	// ClosedByPeer is set if the peer closed the session by sending a
+	// Call-Disconnect-Notify (CDN) message.
+	ClosedByPeer bool
+	// ResultCode, ErrorCode and ErrorMessage are decoded from the Result
+	// Code AVP of the CDN sent to or received from the peer when the session
+	// closed.  For static and quiescent sessions they are those passed to
+	// Session.CloseWithResult, or zero if the session was closed otherwise.
+	ResultCode   ResultCode
+	ErrorCode    ErrorCode
+	ErrorMessage string
+}
+
+// SessionDataplaneReadyEvent is passed to registered EventHandler instances
+// when the data plane of a session has been created, immediately before
+// SessionUpEvent.  The session's network interface exists at this point.
+type SessionDataplaneReadyEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	SessionName   string
+	Session       Session
+	InterfaceName string
 }
 
+// IPCPInfo describes the IPv4 configuration negotiated by the IPCP protocol
+// of the PPP link carried by a session.
+type IPCPInfo struct {
+	// InterfaceName is the name of the PPP network interface, if any.
+	InterfaceName string
+	// LocalAddr and PeerAddr are the addresses of our end and the peer's
+	// end of the link.  PeerAddr is nil if the peer didn't give one.
+	LocalAddr, PeerAddr net.IP
+	// DNS lists the primary and secondary DNS server addresses given by
+	// the peer, if any, as per RFC1877.
+	DNS []net.IP
+}
+
+// SessionIPCPUpEvent is passed to registered EventHandler instances when
+// the IPCP protocol of the PPP link carried by an established session comes
+// up, as reported by Session.ReportIPCPUp.  This allows the application to
+// install routes or update DNS configuration for the link.  Unlike other
+// events it's generated from the goroutine calling Session.ReportIPCPUp.
+type SessionIPCPUpEvent struct {
+	TunnelName  string
+	Tunnel      Tunnel
+	SessionName string
+	Session     Session
+	IPCP        IPCPInfo
+}
+
+// SessionIPCPDownEvent is passed to registered EventHandler instances when
+// the IPCP protocol of the PPP link carried by an established session goes
+// down, as reported by Session.ReportIPCPDown.  The addresses are those of
+// the link which went down.  Like SessionIPCPUpEvent, it's generated from
+// the goroutine calling Session.ReportIPCPDown.
+type SessionIPCPDownEvent struct {
+	TunnelName  string
+	Tunnel      Tunnel
+	SessionName string
+	Session     Session
+	IPCP        IPCPInfo
+}
+
+// SessionStateEvent is passed to registered EventHandler instances when the
+// control protocol state of a dynamic session changes.  A session created
+// locally moves from SessionStateWaitTunnel to SessionStateEstablished via.
+// SessionStateWaitReply, while a session requested by the peer moves from
+// SessionStateIdle to SessionStateEstablished via. SessionStateWaitConnect.
+// A session which closes or fails to come up moves to SessionStateDead.
+type SessionStateEvent struct {
+	TunnelName  string
+	Tunnel      Tunnel
+	SessionName string
+	Session     Session
+	From, To    SessionState
+}
+
+// ErrTunnelLimit is returned when creating a tunnel would exceed the
+// limit set by Context.SetMaxTunnels.
+var ErrTunnelLimit = errors.New("tunnel limit reached")
+
+// ErrSessionLimit is returned when creating a session would exceed the
+// tunnel's MaxSessions limit.
+var ErrSessionLimit = errors.New("session limit reached")
+
+// ErrNoFrameAccess is returned by Session.ReadFrame and Session.WriteFrame
+// if the session's frames can't be accessed by the application.
+var ErrNoFrameAccess = errors.New("session frames not accessible")
+
 // LinuxNetlinkDataPlane is a special sentinel value used to indicate
 // that the L2TP context should use the internal Linux kernel data plane
 // implementation.
@@ -203,6 +651,11 @@ var LinuxNetlinkDataPlane DataPlane = &nullDataPlane{}
 // implementation is used.  This is useful for experimenting with the
 // control protocol without requiring root permissions.
 //
+// Where the kernel L2TP subsystem is unavailable, the data plane returned
+// by NewUserspaceDataPlane may be used instead.  The data plane returned by
+// NewFallbackDataPlane uses the kernel L2TP subsystem where it can, and the
+// userspace data plane otherwise.
+//
 // Logging is generated using go-kit levels: informational logging
 // uses the Info level, while verbose debugging logging uses the
 // Debug level.  Error conditions may be logged using the Error level
@@ -226,8 +679,16 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 		logger:        logger,
 		tunnelsByName: make(map[string]tunnel),
 		tunnelsByID:   make(map[ControlConnID]tunnel),
+		tunnelsByPeer: make(map[string]tunnel),
+		peerKeys:      make(map[tunnel]string),
 		dp:            dp,
 		callSerial:    rand.Uint32(),
+		peerVersions:  make(map[string]ProtocolVersion),
+		muxes:         make(map[string]*socketMux),
+		listeners:     make(map[string]*listener),
+		idAlloc:       randomIDAllocator{},
+		sidQuarantine: newIDQuarantine(),
+		acceptor:      rejectAllSessions{},
 	}, nil
 }
 
@@ -237,9 +698,28 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 // RFC3931 (L2TPv3) tunnel instance using the control protocol
 // for tunnel instantiation and management.
 //
+// If the configuration doesn't specify the protocol version, the
+// version is negotiated with the peer according to cfg.VersionPolicy.
+//
 // The name provided must be unique in the Context.
 //
+// NewDynamicTunnel returns once the tunnel has started running the
+// control protocol.  Establishment of the tunnel is signalled with
+// TunnelUpEvent or TunnelEstablishFailedEvent.
+//
 func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	return ctx.NewDynamicTunnelAsync(name, cfg, nil)
+}
+
+// NewDynamicTunnelAsync creates a new dynamic L2TP tunnel as per
+// NewDynamicTunnel, calling done once the tunnel is established or
+// fails to establish.
+//
+// This allows an application bringing up many tunnels to track the
+// outcome for each without waiting for events for each tunnel.
+//
+// done is not called if NewDynamicTunnelAsync returns an error.
+func (ctx *Context) NewDynamicTunnelAsync(name string, cfg *TunnelConfig, done EstablishCallback) (tunl Tunnel, err error) {
 
 	var sal, sap unix.Sockaddr
 
@@ -256,6 +736,12 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		return nil, fmt.Errorf("already have tunnel %q", name)
 	}
 
+	// Must not exceed the tunnel limit
+	if err = ctx.reserveTunnel(); err != nil {
+		return nil, err
+	}
+	defer ctx.unreserveTunnel()
+
 	// Generate host name if unset
 	if myCfg.HostName == "" {
 		name, err := os.Hostname()
@@ -265,6 +751,16 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		myCfg.HostName = name
 	}
 
+	// Negotiate the protocol version if unset
+	var fallback []ProtocolVersion
+	if myCfg.Version == 0 {
+		versions := ctx.negotiableVersions(&myCfg)
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("no supported protocol version for tunnel configuration")
+		}
+		myCfg.Version, fallback = versions[0], versions[1:]
+	}
+
 	// Default StopCCN retransmit timeout if unset.
 	// RFC2661 section 5.7 recommends a default of 31s.
 	if myCfg.StopCCNTimeout == 0 {
@@ -286,6 +782,18 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 	if myCfg.Peer == "" {
 		return nil, fmt.Errorf("must specify peer address for dynamic tunnel")
 	}
+	if err = validateExtraAVPs(myCfg.ExtraAVPs, MessageTypeSCCRQ); err != nil {
+		return nil, err
+	}
+	if err = checkChallengeLength(myCfg.ChallengeLength); err != nil {
+		return nil, err
+	}
+	if myCfg.AlternateSecret != "" && myCfg.Secret == "" {
+		return nil, fmt.Errorf("alternate secret requires a secret")
+	}
+	if myCfg.ChallengeLength == 0 {
+		myCfg.ChallengeLength = defaultChallengeLen
+	}
 
 	// If the tunnel ID in the config is unset we must generate one.
 	// If the tunnel ID is set, we must check for collisions.
@@ -298,7 +806,14 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 			return nil, fmt.Errorf("already have tunnel with TID %q", myCfg.TunnelID)
 		}
 	} else {
-		myCfg.TunnelID, err = ctx.allocTid(myCfg.Version)
+		// If we may fall back to L2TPv2 the ID must be valid for L2TPv2
+		tidVersion := myCfg.Version
+		for _, v := range fallback {
+			if v == ProtocolVersion2 {
+				tidVersion = v
+			}
+		}
+		myCfg.TunnelID, err = ctx.allocTid(tidVersion)
 		if err != nil {
 			return nil, fmt.Errorf("failed to allocate a TID: %q", err)
 		}
@@ -318,17 +833,111 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
-	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg)
+	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg, fallback, done)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.linkTunnel(t)
+	// The peer's tunnel ID isn't known until it replies to our SCCRQ
+	ctx.linkTunnel(t, sap, 0)
 	tunl = t
 
 	return
 }
 
+// NewListener creates a new L2TP listener.
+//
+// A listener accepts dynamic L2TPv2 and L2TPv3 tunnels initiated by peers,
+// running the responder side of the control protocol for each.  Tunnels
+// created by the listener are signalled using TunnelAcceptEvent, and are
+// named using the listener name and the tunnel ID.  If the configuration
+// sets the protocol version, only tunnels of that version are accepted.
+//
+// The name provided must be unique in the Context.
+//
+// The listener configuration must include the local address to listen on,
+// and is used as the configuration of each accepted tunnel unless one of its
+// PeerConfigs matches the tunnel's peer.  The peer address and tunnel IDs are
+// determined for each tunnel when it is accepted, so must not be set.
+func (ctx *Context) NewListener(name string, cfg *TunnelConfig) (Listener, error) {
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *cfg
+
+	// Must not have name clashes
+	if _, ok := ctx.findListenerByName(name); ok {
+		return nil, fmt.Errorf("already have listener %q", name)
+	}
+
+	// Generate host name if unset
+	if myCfg.HostName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up host name: %v", err)
+		}
+		myCfg.HostName = name
+	}
+
+	// Default StopCCN retransmit timeout if unset.
+	// RFC2661 section 5.7 recommends a default of 31s.
+	if myCfg.StopCCNTimeout == 0 {
+		myCfg.StopCCNTimeout = 31 * time.Second
+	}
+
+	// Sanity check the configuration
+	if myCfg.Version != 0 && !dynamicTunnelSupportsVersion(myCfg.Version) {
+		return nil, fmt.Errorf("listeners don't support protocol version %v", myCfg.Version)
+	}
+	if myCfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("listeners support UDP encapsulation only")
+	}
+	if myCfg.TunnelID != 0 || myCfg.PeerTunnelID != 0 {
+		return nil, fmt.Errorf("tunnel IDs cannot be specified for listeners")
+	}
+	if myCfg.Local == "" {
+		return nil, fmt.Errorf("must specify local address for listener")
+	}
+	if myCfg.Peer != "" {
+		return nil, fmt.Errorf("peer address cannot be specified for listeners")
+	}
+	if myCfg.SccrqRateLimit < 0 || myCfg.PeerSccrqRateLimit < 0 || myCfg.MaxPendingTunnels < 0 {
+		return nil, fmt.Errorf("listener limits may not be negative")
+	}
+	if _, err := newPeerACL(&myCfg); err != nil {
+		return nil, err
+	}
+	if err := checkChallengeLength(myCfg.ChallengeLength); err != nil {
+		return nil, err
+	}
+	if myCfg.AlternateSecret != "" && myCfg.Secret == "" {
+		return nil, fmt.Errorf("alternate secret requires a secret")
+	}
+	if myCfg.ChallengeLength == 0 {
+		myCfg.ChallengeLength = defaultChallengeLen
+	}
+	if err := validateExtraAVPs(myCfg.ExtraAVPs, MessageTypeSCCRP); err != nil {
+		return nil, err
+	}
+
+	sal, err := newUDPTunnelAddress(myCfg.Local)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise listener address: %v", err)
+	}
+
+	l, err := newListener(name, ctx, sal, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.linkListener(l)
+	return l, nil
+}
+
 // NewQuiescentTunnel creates a new "quiescent" L2TP tunnel.
 //
 // A quiescent tunnel creates a user space socket for the
@@ -359,6 +968,12 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 		return nil, fmt.Errorf("already have tunnel %q", name)
 	}
 
+	// Must not exceed the tunnel limit
+	if err = ctx.reserveTunnel(); err != nil {
+		return nil, err
+	}
+	defer ctx.unreserveTunnel()
+
 	// Sanity check the configuration
 	if myCfg.Version != ProtocolVersion3 && myCfg.Encap == EncapTypeIP {
 		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
@@ -406,7 +1021,7 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 		return nil, err
 	}
 
-	ctx.linkTunnel(t)
+	ctx.linkTunnel(t, sap, myCfg.PeerTunnelID)
 	tunl = t
 
 	return
@@ -428,6 +1043,12 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 // The tunnel configuration must include local and peer addresses
 // and local and peer tunnel IDs.
 func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	return ctx.newStaticTunnel(name, cfg, nil)
+}
+
+// newStaticTunnel creates a static tunnel, adopting the tunnel described
+// by found if it is set.
+func (ctx *Context) newStaticTunnel(name string, cfg *TunnelConfig, found *DiscoveredTunnel) (tunl Tunnel, err error) {
 
 	var sal, sap unix.Sockaddr
 
@@ -444,6 +1065,12 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 		return nil, fmt.Errorf("already have tunnel %q", name)
 	}
 
+	// Must not exceed the tunnel limit
+	if err = ctx.reserveTunnel(); err != nil {
+		return nil, err
+	}
+	defer ctx.unreserveTunnel()
+
 	// Sanity check  the configuration
 	if myCfg.Version != ProtocolVersion3 {
 		return nil, fmt.Errorf("static tunnels can be L2TPv3 only")
@@ -478,17 +1105,149 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
-	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg)
+	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg, found != nil)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.linkTunnel(t)
+	ctx.linkTunnel(t, sap, myCfg.PeerTunnelID)
 	tunl = t
 
+	if found != nil {
+		t.adoptSessions(found.Sessions)
+	}
+
 	return
 }
 
+// DiscoverTunnels lists the tunnels present in the context's data plane
+// which the context isn't running, along with their sessions.  These may
+// have been left behind by a previous instance of the application.
+//
+// The data plane must implement DiscoveringDataPlane, as does the Linux
+// kernel data plane.  The kernel destroys tunnels using a socket managed
+// by the application when the socket is closed, so only static tunnels
+// outlive the application which created them.
+func (ctx *Context) DiscoverTunnels() ([]DiscoveredTunnel, error) {
+	ddp, ok := ctx.dp.(DiscoveringDataPlane)
+	if !ok {
+		return nil, fmt.Errorf("data plane doesn't support tunnel discovery")
+	}
+
+	tunnels, err := ddp.DiscoverTunnels()
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []DiscoveredTunnel
+	for _, t := range tunnels {
+		if _, ok := ctx.findTunnelByID(t.Config.TunnelID); !ok {
+			unknown = append(unknown, t)
+		}
+	}
+	return unknown, nil
+}
+
+// AdoptStaticTunnel creates a static tunnel instance for a tunnel already
+// present in the context's data plane, such as one found by
+// DiscoverTunnels.  The tunnel's sessions are adopted along with it,
+// being named using the tunnel name and session ID, and SessionUpEvent
+// is sent for each.
+//
+// The configuration is as for NewStaticTunnel, and must specify the
+// tunnel ID of a tunnel in the data plane.  Closing the tunnel removes it
+// from the data plane.
+func (ctx *Context) AdoptStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	found, err := ctx.DiscoverTunnels()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range found {
+		if found[i].Config.TunnelID == cfg.TunnelID {
+			return ctx.newStaticTunnel(name, cfg, &found[i])
+		}
+	}
+	return nil, fmt.Errorf("no tunnel with TID %v to adopt", cfg.TunnelID)
+}
+
+// SetMaxTunnels limits the number of tunnels the context may run,
+// including tunnels accepted by listeners.  Once the limit is reached
+// creation of further tunnels fails with ErrTunnelLimit.
+//
+// A limit of zero, which is the default, allows any number of tunnels.
+func (ctx *Context) SetMaxTunnels(max int) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	ctx.maxTunnels = max
+}
+
+// Tunnels returns the tunnels running in the context, keyed by name.
+func (ctx *Context) Tunnels() map[string]Tunnel {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	tunnels := make(map[string]Tunnel, len(ctx.tunnelsByName))
+	for name, tunl := range ctx.tunnelsByName {
+		tunnels[name] = tunl
+	}
+	return tunnels
+}
+
+// FindTunnel looks up a tunnel by name.
+func (ctx *Context) FindTunnel(name string) (Tunnel, bool) {
+	tunl, ok := ctx.findTunnelByName(name)
+	return tunl, ok
+}
+
+// FindTunnelByID looks up a tunnel by its local tunnel ID (L2TPv2)
+// or control connection ID (L2TPv3).
+func (ctx *Context) FindTunnelByID(tid ControlConnID) (Tunnel, bool) {
+	tunl, ok := ctx.findTunnelByID(tid)
+	return tunl, ok
+}
+
+// FindTunnelByPeerID looks up a tunnel by the peer's IP address and
+// the tunnel ID (L2TPv2) or control connection ID (L2TPv3) assigned
+// by the peer.  The peer address must be an IP address literal, and
+// may include a port number which is ignored.
+//
+// Dynamic tunnels opened by the context can't be found by peer ID
+// until the peer has replied to the tunnel's SCCRQ.
+func (ctx *Context) FindTunnelByPeerID(peer string, ptid ControlConnID) (Tunnel, bool) {
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return nil, false
+	}
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	tunl, ok := ctx.tunnelsByPeer[tunnelPeerKey(ip, ptid)]
+	return tunl, ok
+}
+
+// BundleSessions returns the sessions in the context's tunnels which are
+// members of the Multilink PPP bundle with the given ID, as set by
+// SessionConfig.BundleID.
+func (ctx *Context) BundleSessions(bundleID string) (sessions []Session) {
+	if bundleID == "" {
+		return nil
+	}
+	for _, tunl := range ctx.allTunnels() {
+		for _, s := range tunl.Sessions() {
+			if s.(session).getCfg().BundleID == bundleID {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	return sessions
+}
+
 // RegisterEventHandler adds an event handler to the L2TP context.
 //
 // On return, the event handler may be called at any time.
@@ -511,12 +1270,77 @@ func (ctx *Context) UnregisterEventHandler(handler EventHandler) {
 	defer ctx.evtLock.Unlock()
 	for i, hdlr := range ctx.eventHandlers {
 		if hdlr == handler {
-			ctx.eventHandlers = append(ctx.eventHandlers[:], ctx.eventHandlers[i+1:]...)
+			ctx.eventHandlers = append(ctx.eventHandlers[:i], ctx.eventHandlers[i+1:]...)
 			break
 		}
 	}
 }
 
+// SetIDAllocator sets the allocator used to pick local tunnel and session
+// IDs for tunnels and sessions whose configuration doesn't specify them.
+//
+// Passing a nil allocator restores the default, which picks IDs at random.
+//
+// Tunnels and sessions created before the call are unaffected.
+func (ctx *Context) SetIDAllocator(alloc IDAllocator) {
+	if alloc == nil {
+		alloc = randomIDAllocator{}
+	}
+	ctx.idAllocLock.Lock()
+	defer ctx.idAllocLock.Unlock()
+	ctx.idAlloc = alloc
+}
+
+func (ctx *Context) idAllocator() IDAllocator {
+	ctx.idAllocLock.RLock()
+	defer ctx.idAllocLock.RUnlock()
+	return ctx.idAlloc
+}
+
+// SetSessionIDQuarantine prevents the session ID of a session which has
+// been torn down from being allocated to a new session until the
+// quarantine window has passed.  This avoids stale data packets for the
+// old session being delivered to the new one.
+//
+// Quarantine applies to session IDs picked by the IDAllocator: the IDs
+// specified by session configurations are not checked.  L2TPv2 session
+// IDs are quarantined in the scope of their tunnel, while L2TPv3 session
+// IDs are quarantined across all tunnels.
+//
+// A window of zero, which is the default, disables quarantine.
+func (ctx *Context) SetSessionIDQuarantine(window time.Duration) {
+	ctx.sidQuarantine.setWindow(window)
+}
+
+// releaseSid is called when a session is torn down, to quarantine its
+// session ID and inform the IDAllocator.
+func (ctx *Context) releaseSid(tid, sid ControlConnID, version ProtocolVersion) {
+	ctx.sidQuarantine.add(tid, sid, version)
+	if r, ok := ctx.idAllocator().(IDReleaser); ok {
+		r.ReleaseSessionID(tid, sid, version)
+	}
+}
+
+// SetSessionAcceptor sets the acceptor which decides whether to accept
+// sessions requested by the peers of dynamic tunnels.
+//
+// Passing a nil acceptor restores the default, which rejects all sessions
+// requested by peers.
+func (ctx *Context) SetSessionAcceptor(acceptor SessionAcceptor) {
+	if acceptor == nil {
+		acceptor = rejectAllSessions{}
+	}
+	ctx.acceptorLock.Lock()
+	defer ctx.acceptorLock.Unlock()
+	ctx.acceptor = acceptor
+}
+
+func (ctx *Context) sessionAcceptor() SessionAcceptor {
+	ctx.acceptorLock.RLock()
+	defer ctx.acceptorLock.RUnlock()
+	return ctx.acceptor
+}
+
 func (ctx *Context) handleUserEvent(event interface{}) {
 	ctx.evtLock.RLock()
 	defer ctx.evtLock.RUnlock()
@@ -529,12 +1353,26 @@ func (ctx *Context) handleUserEvent(event interface{}) {
 // running inside it.
 func (ctx *Context) Close() {
 	tunnels := []Tunnel{}
+	listeners := []Listener{}
+
+	// Close listeners first so no further tunnels are accepted
+	ctx.tlock.Lock()
+	for name, l := range ctx.listeners {
+		listeners = append(listeners, l)
+		delete(ctx.listeners, name)
+	}
+	ctx.tlock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
 
 	ctx.tlock.Lock()
 	for name, tunl := range ctx.tunnelsByName {
 		tunnels = append(tunnels, tunl)
 		delete(ctx.tunnelsByName, name)
 		delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
+		ctx.setTunnelPeerLocked(tunl, nil, 0)
 	}
 	ctx.tlock.Unlock()
 
@@ -546,12 +1384,61 @@ func (ctx *Context) Close() {
 
 }
 
+// PeerProtocolVersion returns the protocol version most recently used to
+// establish a dynamic tunnel with the specified peer address.
+func (ctx *Context) PeerProtocolVersion(peer string) (version ProtocolVersion, ok bool) {
+	ctx.pvLock.Lock()
+	defer ctx.pvLock.Unlock()
+	version, ok = ctx.peerVersions[peer]
+	return
+}
+
+func (ctx *Context) recordPeerVersion(peer string, version ProtocolVersion) {
+	ctx.pvLock.Lock()
+	defer ctx.pvLock.Unlock()
+	ctx.peerVersions[peer] = version
+}
+
+// versionPreference returns the order in which protocol versions should be
+// attempted for a given policy.  A version known to work with the peer is
+// always attempted first.
+func versionPreference(policy VersionPolicy, known ProtocolVersion) []ProtocolVersion {
+	versions := []ProtocolVersion{ProtocolVersion3, ProtocolVersion2}
+	if policy == VersionPolicyPreferV2 {
+		versions = []ProtocolVersion{ProtocolVersion2, ProtocolVersion3}
+	}
+	if known == versions[1] {
+		versions[0], versions[1] = versions[1], versions[0]
+	}
+	return versions
+}
+
+// negotiableVersions returns the protocol versions which may be used for a
+// dynamic tunnel configuration, in the order they should be attempted.
+func (ctx *Context) negotiableVersions(cfg *TunnelConfig) (versions []ProtocolVersion) {
+	known, _ := ctx.PeerProtocolVersion(cfg.Peer)
+	for _, v := range versionPreference(cfg.VersionPolicy, known) {
+		if !dynamicTunnelSupportsVersion(v) {
+			continue
+		}
+		if v == ProtocolVersion2 && (cfg.Encap != EncapTypeUDP || cfg.TunnelID > v2TidSidMax) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return
+}
+
 func (ctx *Context) allocTid(version ProtocolVersion) (ControlConnID, error) {
+	alloc := ctx.idAllocator()
 	for i := 0; i < 10; i++ {
-		id, err := generateControlConnID(version)
+		id, err := alloc.AllocTunnelID(version)
 		if err != nil {
 			return 0, fmt.Errorf("failed to generate tunnel ID: %v", err)
 		}
+		if id == 0 || (version == ProtocolVersion2 && id > v2TidSidMax) {
+			continue
+		}
 		if _, ok := ctx.findTunnelByID(id); !ok {
 			return id, nil
 		}
@@ -559,11 +1446,83 @@ func (ctx *Context) allocTid(version ProtocolVersion) (ControlConnID, error) {
 	return 0, fmt.Errorf("ID space exhausted")
 }
 
-func (ctx *Context) linkTunnel(tunl tunnel) {
+// reserveTunnel reserves space for a new tunnel within the limit set by
+// SetMaxTunnels.  The reservation is held until unreserveTunnel is called,
+// by which time the new tunnel should have been linked into the context.
+func (ctx *Context) reserveTunnel() error {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	if ctx.maxTunnels > 0 && len(ctx.tunnelsByName)+ctx.reserved >= ctx.maxTunnels {
+		return ErrTunnelLimit
+	}
+	ctx.reserved++
+	return nil
+}
+
+func (ctx *Context) unreserveTunnel() {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	ctx.reserved--
+}
+
+// tunnelPeerKey returns the key used to index tunnels by the peer's
+// address and tunnel ID.
+func tunnelPeerKey(ip net.IP, ptid ControlConnID) string {
+	return fmt.Sprintf("%s/%d", ip, ptid)
+}
+
+func (ctx *Context) linkTunnel(tunl tunnel, sap unix.Sockaddr, ptid ControlConnID) {
 	ctx.tlock.Lock()
 	defer ctx.tlock.Unlock()
 	ctx.tunnelsByName[tunl.getName()] = tunl
 	ctx.tunnelsByID[tunl.getCfg().TunnelID] = tunl
+	if ptid != 0 {
+		ctx.setTunnelPeerLocked(tunl, sap, ptid)
+	}
+}
+
+// setTunnelPeer indexes the tunnel by the peer's address and tunnel ID,
+// once the peer's tunnel ID is known.  A zero tunnel ID removes the tunnel
+// from the index.
+func (ctx *Context) setTunnelPeer(tunl tunnel, sap unix.Sockaddr, ptid ControlConnID) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	ctx.setTunnelPeerLocked(tunl, sap, ptid)
+}
+
+func (ctx *Context) setTunnelPeerLocked(tunl tunnel, sap unix.Sockaddr, ptid ControlConnID) {
+	if key, ok := ctx.peerKeys[tunl]; ok {
+		if ctx.tunnelsByPeer[key] == tunl {
+			delete(ctx.tunnelsByPeer, key)
+		}
+		delete(ctx.peerKeys, tunl)
+	}
+	if ptid != 0 {
+		key := tunnelPeerKey(sockaddrIP(sap), ptid)
+		ctx.tunnelsByPeer[key] = tunl
+		ctx.peerKeys[tunl] = key
+	}
+}
+
+func (ctx *Context) findListenerByName(name string) (*listener, bool) {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	l, ok := ctx.listeners[name]
+	return l, ok
+}
+
+func (ctx *Context) linkListener(l *listener) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	ctx.listeners[l.name] = l
+}
+
+func (ctx *Context) unlinkListener(l *listener) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	if ctx.listeners[l.name] == l {
+		delete(ctx.listeners, l.name)
+	}
 }
 
 func (ctx *Context) unlinkTunnel(tunl tunnel) {
@@ -571,6 +1530,7 @@ func (ctx *Context) unlinkTunnel(tunl tunnel) {
 	defer ctx.tlock.Unlock()
 	delete(ctx.tunnelsByName, tunl.getName())
 	delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
+	ctx.setTunnelPeerLocked(tunl, nil, 0)
 }
 
 func (ctx *Context) findTunnelByName(name string) (tunl tunnel, ok bool) {
@@ -587,6 +1547,15 @@ func (ctx *Context) findTunnelByID(tid ControlConnID) (tunl tunnel, ok bool) {
 	return
 }
 
+func (ctx *Context) allTunnels() (tunnels []tunnel) {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	for _, tunl := range ctx.tunnelsByName {
+		tunnels = append(tunnels, tunl)
+	}
+	return
+}
+
 func (ctx *Context) allocCallSerial() uint32 {
 	ctx.serialLock.Lock()
 	defer ctx.serialLock.Unlock()
@@ -594,6 +1563,22 @@ func (ctx *Context) allocCallSerial() uint32 {
 	return ctx.callSerial
 }
 
+// zoneToIndex converts an IPv6 zone, which may be either an interface
+// name or a numeric interface index, to the index used by the socket API.
+func zoneToIndex(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index), nil
+	}
+	idx, err := strconv.ParseUint(zone, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unrecognised IPv6 zone %q", zone)
+	}
+	return uint32(idx), nil
+}
+
 func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 
 	u, err := net.ResolveUDPAddr("udp", address)
@@ -607,23 +1592,34 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 			Addr: [4]byte{b[0], b[1], b[2], b[3]},
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
-		return &unix.SockaddrInet6{
-			Port: u.Port,
-			Addr: [16]byte{
-				b[0], b[1], b[2], b[3],
-				b[4], b[5], b[6], b[7],
-				b[8], b[9], b[10], b[11],
-				b[12], b[13], b[14], b[15],
-			},
-			// ZoneId
-		}, nil
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
+		sa := &unix.SockaddrInet6{
+			Port:   u.Port,
+			ZoneId: zoneID,
+		}
+		copy(sa.Addr[:], b)
+		return sa, nil
 	}
 
 	return nil, fmt.Errorf("unhandled address family")
 }
 
+// IPv4-mapped IPv6 addresses allow an AF_INET6 socket to communicate
+// with IPv4 peers.
+func toV4MappedSockaddr(sa *unix.SockaddrInet4) *unix.SockaddrInet6 {
+	mapped := &unix.SockaddrInet6{Port: sa.Port}
+	copy(mapped.Addr[:], net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]).To16())
+	return mapped
+}
+
+func isV4MappedOrUnspecified(sa *unix.SockaddrInet6) bool {
+	ip := net.IP(sa.Addr[:])
+	return ip.IsUnspecified() || ip.To4() != nil
+}
+
 func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error) {
 
 	// We expect the peer address to always be set
@@ -650,6 +1646,22 @@ func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error)
 			return nil, nil, fmt.Errorf("unhanded address family")
 		}
 	}
+
+	// An IPv4 peer may be reached from a dual-stack IPv6 local address
+	// by using the peer's IPv4-mapped address.
+	switch l := sal.(type) {
+	case *unix.SockaddrInet4:
+		if _, ok := sap.(*unix.SockaddrInet4); !ok {
+			return nil, nil, fmt.Errorf("local address %q and remote address %q are of different address families", local, remote)
+		}
+	case *unix.SockaddrInet6:
+		if p, ok := sap.(*unix.SockaddrInet4); ok {
+			if !isV4MappedOrUnspecified(l) {
+				return nil, nil, fmt.Errorf("local address %q and remote address %q are of different address families", local, remote)
+			}
+			sap = toV4MappedSockaddr(p)
+		}
+	}
 	return
 }
 
@@ -666,18 +1678,16 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 			ConnId: uint32(ccid),
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
-		return &unix.SockaddrL2TPIP6{
-			Addr: [16]byte{
-				b[0], b[1], b[2], b[3],
-				b[4], b[5], b[6], b[7],
-				b[8], b[9], b[10], b[11],
-				b[12], b[13], b[14], b[15],
-			},
-			// ZoneId
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
+		sa := &unix.SockaddrL2TPIP6{
+			ZoneId: zoneID,
 			ConnId: uint32(ccid),
-		}, nil
+		}
+		copy(sa.Addr[:], b)
+		return sa, nil
 	}
 
 	return nil, fmt.Errorf("unhandled address family")
@@ -708,9 +1718,76 @@ func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid Con
 			return nil, nil, fmt.Errorf("unhanded address family")
 		}
 	}
+
+	// L2TP/IP sockets don't support IPv4-mapped addresses, so the local
+	// and peer addresses must be of the same family.
+	_, localIsV4 := sal.(*unix.SockaddrL2TPIP)
+	_, remoteIsV4 := sap.(*unix.SockaddrL2TPIP)
+	if localIsV4 != remoteIsV4 {
+		return nil, nil, fmt.Errorf("local address %q and remote address %q are of different address families", local, remote)
+	}
 	return
 }
 
+// Quiescent and dynamic tunnels share the tunnel socket between the control
+// protocol and the data plane.  Since UDP checksum behaviour is a property
+// of the socket, the control and data settings must agree for these tunnels.
+func managedSocketChecksum(cfg *TunnelConfig) (UDPChecksumMode, error) {
+	if cfg.ControlChecksum == UDPChecksumDefault {
+		return cfg.DataChecksum, nil
+	}
+	if cfg.DataChecksum != UDPChecksumDefault && cfg.DataChecksum != cfg.ControlChecksum {
+		return UDPChecksumDefault, fmt.Errorf("control UDP checksum mode %v conflicts with data UDP checksum mode %v",
+			cfg.ControlChecksum, cfg.DataChecksum)
+	}
+	return cfg.ControlChecksum, nil
+}
+
+// newTunnelControlPlane creates the control plane for a quiescent or
+// dynamic tunnel.  If the configuration requests a shared socket, the
+// control plane uses the context's socket for the local address, which
+// is created if it doesn't already exist.
+func (ctx *Context) newTunnelControlPlane(sal, sap unix.Sockaddr, cfg *TunnelConfig) (*controlPlane, error) {
+	if !cfg.SharedSocket {
+		return newNetNSControlPlane(cfg.NetNS, sal, sap)
+	}
+
+	ctx.muxLock.Lock()
+	defer ctx.muxLock.Unlock()
+
+	// Sockets are only shared within a network namespace
+	key := sockaddrString(sal)
+	if cfg.NetNS != "" {
+		key += "@" + cfg.NetNS
+	}
+	mux, ok := ctx.muxes[key]
+	if !ok {
+		var err error
+		mux, err = newSocketMux(ctx, key, sal, cfg)
+		if err != nil {
+			return nil, err
+		}
+		ctx.muxes[key] = mux
+	}
+	return mux.newControlPlane(cfg.TunnelID, sap)
+}
+
+// releaseSocketMux removes a shared socket from the context if no tunnels
+// are using it, returning true if the socket was removed.
+func (ctx *Context) releaseSocketMux(mux *socketMux) bool {
+	ctx.muxLock.Lock()
+	defer ctx.muxLock.Unlock()
+
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	if len(mux.endpoints) > 0 || ctx.muxes[mux.key] != mux {
+		return false
+	}
+	delete(ctx.muxes, mux.key)
+	return true
+}
+
 func initDataPlane(dp DataPlane) (DataPlane, error) {
 	if dp == nil {
 		return &nullDataPlane{}, nil
@@ -720,19 +1797,6 @@ func initDataPlane(dp DataPlane) (DataPlane, error) {
 	return dp, nil
 }
 
-func generateControlConnID(version ProtocolVersion) (ControlConnID, error) {
-	var id ControlConnID
-	switch version {
-	case ProtocolVersion2:
-		id = ControlConnID(uint16(rand.Uint32()))
-	case ProtocolVersion3:
-		id = ControlConnID(rand.Uint32())
-	default:
-		return 0, fmt.Errorf("unhandled version %v", version)
-	}
-	return id, nil
-}
-
 // baseTunnel implements base functionality which all tunnel types will need
 type baseTunnel struct {
 	logger         log.Logger
@@ -742,16 +1806,36 @@ type baseTunnel struct {
 	sessionLock    sync.RWMutex
 	sessionsByName map[string]session
 	sessionsByID   map[ControlConnID]session
+	// Sessions indexed by peer session ID, and the peer session ID
+	// each session is indexed by.  Sessions without a peer session ID
+	// aren't indexed.
+	sessionsByPeerID map[ControlConnID]session
+	peerSessionIDs   map[session]ControlConnID
+	// The number of sessions being created, which count towards the
+	// session limit until they're linked into the tunnel.
+	reservedSessions int
+	statsLock        sync.Mutex
+	state            TunnelState
+	upSince          time.Time
+	// The tunnel's data plane instance, if any, from which data plane
+	// statistics are obtained.
+	statsDP TunnelDataPlane
+	// The tunnel's control protocol transport, if any, from which
+	// transmit timelines are obtained.
+	statsXport *transport
 }
 
 func newBaseTunnel(logger log.Logger, name string, parent *Context, config *TunnelConfig) *baseTunnel {
 	return &baseTunnel{
-		logger:         logger,
-		name:           name,
-		parent:         parent,
-		cfg:            config,
-		sessionsByName: make(map[string]session),
-		sessionsByID:   make(map[ControlConnID]session),
+		logger:           logger,
+		name:             name,
+		parent:           parent,
+		cfg:              config,
+		sessionsByName:   make(map[string]session),
+		sessionsByID:     make(map[ControlConnID]session),
+		sessionsByPeerID: make(map[ControlConnID]session),
+		peerSessionIDs:   make(map[session]ControlConnID),
+		state:            TunnelStateIdle,
 	}
 }
 
@@ -764,6 +1848,12 @@ func (bt *baseTunnel) getCfg() *TunnelConfig {
 }
 
 func (bt *baseTunnel) getDP() DataPlane {
+	bt.statsLock.Lock()
+	_, raw := bt.statsDP.(*rawSocketTunnelDataPlane)
+	bt.statsLock.Unlock()
+	if raw {
+		return &rawSocketDataPlane{}
+	}
 	return bt.parent.dp
 }
 
@@ -776,13 +1866,130 @@ func (bt *baseTunnel) linkSession(s session) {
 	defer bt.sessionLock.Unlock()
 	bt.sessionsByName[s.getName()] = s
 	bt.sessionsByID[s.getCfg().SessionID] = s
+	bt.setSessionPeerIDLocked(s, s.getCfg().PeerSessionID)
 }
 
 func (bt *baseTunnel) unlinkSession(s session) {
+	bt.sessionLock.Lock()
+	cur, linked := bt.sessionsByName[s.getName()]
+	linked = linked && cur == s
+	if linked {
+		delete(bt.sessionsByName, s.getName())
+		delete(bt.sessionsByID, s.getCfg().SessionID)
+		bt.setSessionPeerIDLocked(s, 0)
+	}
+	bt.sessionLock.Unlock()
+
+	if linked {
+		bt.releaseSid(s.getCfg().SessionID)
+	}
+}
+
+// releaseSid releases the session ID of a session which has been torn
+// down, or which failed to be created after allocSid picked its ID.
+func (bt *baseTunnel) releaseSid(sid ControlConnID) {
+	bt.parent.releaseSid(bt.cfg.TunnelID, sid, bt.cfg.Version)
+}
+
+// setSessionPeerID indexes a session by the session ID assigned by the
+// peer, which dynamic sessions learn after creation.  A peer session ID
+// of zero removes the session from the index.
+func (bt *baseTunnel) setSessionPeerID(s session, psid ControlConnID) {
 	bt.sessionLock.Lock()
 	defer bt.sessionLock.Unlock()
-	delete(bt.sessionsByName, s.getName())
-	delete(bt.sessionsByID, s.getCfg().SessionID)
+	if cur, ok := bt.sessionsByName[s.getName()]; ok && cur == s {
+		bt.setSessionPeerIDLocked(s, psid)
+	}
+}
+
+func (bt *baseTunnel) setSessionPeerIDLocked(s session, psid ControlConnID) {
+	if old, ok := bt.peerSessionIDs[s]; ok {
+		if bt.sessionsByPeerID[old] == s {
+			delete(bt.sessionsByPeerID, old)
+		}
+		delete(bt.peerSessionIDs, s)
+	}
+	if psid != 0 {
+		bt.sessionsByPeerID[psid] = s
+		bt.peerSessionIDs[s] = psid
+	}
+}
+
+// reserveSession reserves space for a new session within the tunnel's
+// MaxSessions limit.  The reservation is held until unreserveSession is
+// called, by which time the new session should have been linked into
+// the tunnel.
+func (bt *baseTunnel) reserveSession() error {
+	bt.sessionLock.Lock()
+	defer bt.sessionLock.Unlock()
+	if bt.cfg.MaxSessions > 0 && len(bt.sessionsByName)+bt.reservedSessions >= bt.cfg.MaxSessions {
+		return ErrSessionLimit
+	}
+	bt.reservedSessions++
+	return nil
+}
+
+func (bt *baseTunnel) unreserveSession() {
+	bt.sessionLock.Lock()
+	defer bt.sessionLock.Unlock()
+	bt.reservedSessions--
+}
+
+// setState records the tunnel state for reporting in the tunnel statistics.
+func (bt *baseTunnel) setState(state TunnelState) {
+	bt.statsLock.Lock()
+	defer bt.statsLock.Unlock()
+	if state == TunnelStateEstablished && bt.state != state {
+		bt.upSince = time.Now()
+	}
+	bt.state = state
+}
+
+// baseStats returns the tunnel statistics not tracked by the transport.
+func (bt *baseTunnel) baseStats() (ts TunnelStats) {
+	bt.statsLock.Lock()
+	ts.State = bt.state
+	if bt.state == TunnelStateEstablished {
+		ts.Uptime = time.Since(bt.upSince)
+	}
+	dp := bt.statsDP
+	bt.statsLock.Unlock()
+
+	bt.sessionLock.RLock()
+	ts.Sessions = len(bt.sessionsByName)
+	bt.sessionLock.RUnlock()
+
+	// The data plane may be torn down concurrently, in which case
+	// its counters are unavailable
+	if sdp, ok := dp.(StatisticsTunnelDataPlane); ok {
+		if ds, err := sdp.GetStatistics(); err == nil && ds != nil {
+			ts.Data = *ds
+		}
+	}
+	return
+}
+
+// setDataPlane records the data plane instance statistics are read from.
+func (bt *baseTunnel) setDataPlane(dp TunnelDataPlane) {
+	bt.statsLock.Lock()
+	defer bt.statsLock.Unlock()
+	bt.statsDP = dp
+}
+
+func (bt *baseTunnel) setTransport(xport *transport) {
+	bt.statsLock.Lock()
+	defer bt.statsLock.Unlock()
+	bt.statsXport = xport
+}
+
+func (bt *baseTunnel) TransmitTimelines() []TransmitTimeline {
+	bt.statsLock.Lock()
+	xport := bt.statsXport
+	bt.statsLock.Unlock()
+	if xport == nil {
+		return nil
+	}
+	return xport.pendingTimelines()
 }
 
 func (bt *baseTunnel) handleUserEvent(event interface{}) {
@@ -803,6 +2010,33 @@ func (bt *baseTunnel) findSessionByID(id ControlConnID) (s session, ok bool) {
 	return
 }
 
+func (bt *baseTunnel) Sessions() map[string]Session {
+	bt.sessionLock.RLock()
+	defer bt.sessionLock.RUnlock()
+	sessions := make(map[string]Session, len(bt.sessionsByName))
+	for name, s := range bt.sessionsByName {
+		sessions[name] = s
+	}
+	return sessions
+}
+
+func (bt *baseTunnel) FindSession(name string) (Session, bool) {
+	s, ok := bt.findSessionByName(name)
+	return s, ok
+}
+
+func (bt *baseTunnel) FindSessionByID(sid ControlConnID) (Session, bool) {
+	s, ok := bt.findSessionByID(sid)
+	return s, ok
+}
+
+func (bt *baseTunnel) FindSessionByPeerID(psid ControlConnID) (Session, bool) {
+	bt.sessionLock.RLock()
+	defer bt.sessionLock.RUnlock()
+	s, ok := bt.sessionsByPeerID[psid]
+	return s, ok
+}
+
 func (bt *baseTunnel) allSessions() (sessions []session) {
 	bt.sessionLock.RLock()
 	defer bt.sessionLock.RUnlock()
@@ -823,20 +2057,34 @@ func (bt *baseTunnel) closeAllSessions() {
 		sessions = append(sessions, s)
 		delete(bt.sessionsByName, name)
 		delete(bt.sessionsByID, s.getCfg().SessionID)
+		bt.setSessionPeerIDLocked(s, 0)
 	}
 	bt.sessionLock.Unlock()
 
 	for _, s := range sessions {
 		s.kill()
+		bt.releaseSid(s.getCfg().SessionID)
 	}
 }
 
 func (bt *baseTunnel) allocSid() (ControlConnID, error) {
+	alloc := bt.parent.idAllocator()
 	for i := 0; i < 10; i++ {
-		id, err := generateControlConnID(bt.cfg.Version)
+		id, err := alloc.AllocSessionID(bt.cfg.TunnelID, bt.cfg.Version)
 		if err != nil {
 			return 0, fmt.Errorf("failed to generate session ID: %v", err)
 		}
+		if id == 0 || (bt.cfg.Version == ProtocolVersion2 && id > v2TidSidMax) {
+			continue
+		}
+		if bt.parent.sidQuarantine.contains(bt.cfg.TunnelID, id, bt.cfg.Version) {
+			// Hand the ID back so allocators tracking IDs in use
+			// can offer it again once the quarantine has passed
+			if r, ok := alloc.(IDReleaser); ok {
+				r.ReleaseSessionID(bt.cfg.TunnelID, id, bt.cfg.Version)
+			}
+			continue
+		}
 		if _, ok := bt.findSessionByID(id); !ok {
 			return id, nil
 		}
@@ -846,12 +2094,161 @@ func (bt *baseTunnel) allocSid() (ControlConnID, error) {
 
 // baseSession implements base functionality which all session types will need
 type baseSession struct {
-	logger log.Logger
-	name   string
-	parent tunnel
-	cfg    *SessionConfig
+	logger    log.Logger
+	name      string
+	parent    tunnel
+	cfg       *SessionConfig
+	stateLock sync.Mutex
+	state     SessionState
+	upSince   time.Time
+	result    string
+	controlTx uint64
+	controlRx uint64
+	// The circuit speeds reported by the peer
+	peerTxSpeed uint64
+	peerRxSpeed uint64
+	// The session's data plane instance, if any, from which data
+	// plane statistics are obtained and through which frames are
+	// exchanged by ReadFrame and WriteFrame.
+	statsDP SessionDataPlane
 }
 
+// checkSessionConfig validates a session configuration for a tunnel running
+// the specified protocol version using the data plane dp, which is nil if
+// the tunnel isn't known yet.  An unset pseudowire type is defaulted to
+// PPP for L2TPv2, since it's the only type L2TPv2 supports.
+func checkSessionConfig(version ProtocolVersion, dp DataPlane, cfg *SessionConfig) error {
+	switch version {
+	case ProtocolVersion2:
+		if cfg.Pseudowire == 0 {
+			cfg.Pseudowire = PseudowireTypePPP
+		}
+		if cfg.Pseudowire != PseudowireTypePPP {
+			return fmt.Errorf("L2TPv2 supports PPP pseudowires only")
+		}
+		if len(cfg.Cookie) > 0 || len(cfg.PeerCookie) > 0 {
+			return fmt.Errorf("cookies are supported for L2TPv3 sessions only")
+		}
+		if cfg.L2SpecType != L2SpecTypeNone {
+			return fmt.Errorf("layer 2 specific sublayer is supported for L2TPv3 sessions only")
+		}
+		if len(cfg.PseudowireFallback) > 0 {
+			return fmt.Errorf("pseudowire fallback is supported for L2TPv3 sessions only")
+		}
+	case ProtocolVersion3:
+		for _, pw := range append([]PseudowireType{cfg.Pseudowire}, cfg.PseudowireFallback...) {
+			if checkPseudowire(pw) != nil {
+				return fmt.Errorf("unsupported pseudowire type %v", pw)
+			}
+			if pw == PseudowireTypeIP && !dataPlaneSupportsIP(dp) {
+				return fmt.Errorf("IP pseudowires are supported by the userspace data plane only")
+			}
+		}
+		if cfg.L2SpecType != L2SpecTypeNone && cfg.L2SpecType != L2SpecTypeDefault {
+			return fmt.Errorf("unsupported layer 2 specific sublayer type %v", cfg.L2SpecType)
+		}
+		if cfg.SeqNum {
+			useSeqNumSublayer(cfg)
+		}
+	}
+	for _, cookie := range [][]byte{cfg.Cookie, cfg.PeerCookie} {
+		if l := len(cookie); l != 0 && l != 4 && l != 8 {
+			return fmt.Errorf("cookie length must be 4 or 8 bytes, not %v", l)
+		}
+	}
+	if len(cfg.InterfaceName) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name %q is too long", cfg.InterfaceName)
+	}
+	if n := strings.Count(cfg.InterfaceName, "%"); n > 0 {
+		if n != 1 || !strings.Contains(cfg.InterfaceName, "%d") {
+			return fmt.Errorf("interface name template %q must contain a single %%d", cfg.InterfaceName)
+		}
+	}
+	if cfg.BundleID != "" {
+		if cfg.Pseudowire != PseudowireTypePPP {
+			return fmt.Errorf("bundle ID is supported for PPP pseudowires only")
+		}
+		if len(cfg.BundleID) > maxBundleIDLen {
+			return fmt.Errorf("bundle ID %q is longer than %v bytes", cfg.BundleID, maxBundleIDLen)
+		}
+	}
+	if len(cfg.HardwareAddr) > 0 {
+		if !isEthPseudowire(cfg.Pseudowire) {
+			return fmt.Errorf("hardware address is supported for Ethernet pseudowires only")
+		}
+		if len(cfg.HardwareAddr) != 6 {
+			return fmt.Errorf("hardware address %v is not an Ethernet address", cfg.HardwareAddr)
+		}
+	}
+	if cfg.ReorderTimeout < 0 {
+		return fmt.Errorf("reorder timeout may not be negative")
+	}
+	if cfg.MTU != 0 && cfg.MTU < minSessionMTU {
+		return fmt.Errorf("MTU %v is less than the minimum of %v", cfg.MTU, minSessionMTU)
+	}
+	if needsInterfaceConfig(cfg) && !isEthPseudowire(cfg.Pseudowire) {
+		return fmt.Errorf("interface configuration is supported for Ethernet pseudowires only")
+	}
+	if len(cfg.Bridge) >= unix.IFNAMSIZ {
+		return fmt.Errorf("bridge name %q is too long", cfg.Bridge)
+	}
+	for _, addr := range cfg.InterfaceAddrs {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("invalid interface address %q: %v", addr, err)
+		}
+	}
+	for i, vid := range cfg.VLANs {
+		if vid == 0 || vid >= 0xfff {
+			return fmt.Errorf("invalid VLAN ID %v", vid)
+		}
+		for _, other := range cfg.VLANs[:i] {
+			if vid == other {
+				return fmt.Errorf("duplicate VLAN ID %v", vid)
+			}
+		}
+	}
+	return nil
+}
+
+// dataPlaneSupportsIP returns true if sessions using the data plane may
+// carry IP pseudowires.  The fallback data plane supports them only if all
+// its tunnels use the userspace data plane.  A nil data plane, used before
+// the tunnel is known, and the null data plane, which carries no data,
+// accept them too.
+func dataPlaneSupportsIP(dp DataPlane) bool {
+	switch dp := dp.(type) {
+	case nil, *nullDataPlane, *userspaceDataPlane:
+		return true
+	case *fallbackDataPlane:
+		return dp.kernel == nil
+	}
+	return false
+}
+
+// isEthPseudowire returns true if the pseudowire carries Ethernet frames,
+// whether in raw or tagged mode.
+func isEthPseudowire(pw PseudowireType) bool {
+	return pw == PseudowireTypeEth || pw == PseudowireTypeEthVLAN
+}
+
+// useSeqNumSublayer selects the default Layer 2 specific sublayer for an
+// L2TPv3 session using sequence numbers, since L2TPv3 data packets carry
+// sequence numbers in the sublayer rather than the L2TP header.
+func useSeqNumSublayer(cfg *SessionConfig) {
+	if cfg.L2SpecType == L2SpecTypeNone {
+		cfg.L2SpecType = L2SpecTypeDefault
+	}
+}
+
+// The smallest MTU a session may be configured with, being the minimum
+// MTU for IPv4.
+const minSessionMTU = 68
+
+// The longest bundle ID, being the longest locally assigned Endpoint
+// Discriminator.
+// Ref: RFC1990 section 5.1.3.
+const maxBundleIDLen = 20
+
 func newBaseSession(logger log.Logger, name string, parent tunnel, config *SessionConfig) *baseSession {
 	return &baseSession{
 		logger: logger,
@@ -868,3 +2265,117 @@ func (bs *baseSession) getName() string {
 func (bs *baseSession) getCfg() *SessionConfig {
 	return bs.cfg
 }
+
+func (bs *baseSession) State() SessionState {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	return bs.state
+}
+
+func (bs *baseSession) setState(state SessionState) {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	if state == SessionStateEstablished && bs.state != state {
+		bs.upSince = time.Now()
+	}
+	bs.state = state
+}
+
+// setDataPlane records the data plane instance statistics are read from.
+func (bs *baseSession) setDataPlane(dp SessionDataPlane) {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	bs.statsDP = dp
+}
+
+// setCloseResult records why the session was closed.
+func (bs *baseSession) setCloseResult(result string) {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	bs.result = result
+}
+
+// peerConnectSpeed returns the circuit speeds reported by the peer.
+func (bs *baseSession) peerConnectSpeed() (tx, rx uint64) {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	return bs.peerTxSpeed, bs.peerRxSpeed
+}
+
+// setPeerConnectSpeed records the circuit speeds reported by the peer.
+func (bs *baseSession) setPeerConnectSpeed(tx, rx uint64) {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	bs.peerTxSpeed = tx
+	bs.peerRxSpeed = rx
+}
+
+func (bs *baseSession) onControlTx() {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	bs.controlTx++
+}
+
+func (bs *baseSession) onControlRx() {
+	bs.stateLock.Lock()
+	defer bs.stateLock.Unlock()
+	bs.controlRx++
+}
+
+// Trigger has no effect by default: only dynamic sessions may be
+// established on demand.
+func (bs *baseSession) Trigger() {
+}
+
+func (bs *baseSession) Stats() (ss SessionStats) {
+	bs.stateLock.Lock()
+	ss.State = bs.state
+	if bs.state == SessionStateEstablished {
+		ss.Uptime = time.Since(bs.upSince)
+	}
+	ss.ControlTx = bs.controlTx
+	ss.ControlRx = bs.controlRx
+	ss.Result = bs.result
+	ss.PeerTxConnectSpeed = bs.peerTxSpeed
+	ss.PeerRxConnectSpeed = bs.peerRxSpeed
+	dp := bs.statsDP
+	bs.stateLock.Unlock()
+
+	// The data plane may be torn down concurrently, in which case
+	// its counters are unavailable
+	if dp != nil {
+		if ds, err := dp.GetStatistics(); err == nil && ds != nil {
+			ss.Data = *ds
+		}
+	}
+	return
+}
+
+// frameDataPlane returns the session's data plane instance if it allows
+// the session's frames to be accessed.
+func (bs *baseSession) frameDataPlane() (FrameSessionDataPlane, error) {
+	bs.stateLock.Lock()
+	dp := bs.statsDP
+	bs.stateLock.Unlock()
+
+	if fdp, ok := dp.(FrameSessionDataPlane); ok {
+		return fdp, nil
+	}
+	return nil, ErrNoFrameAccess
+}
+
+func (bs *baseSession) ReadFrame(b []byte) (int, error) {
+	fdp, err := bs.frameDataPlane()
+	if err != nil {
+		return 0, err
+	}
+	return fdp.ReadFrame(b)
+}
+
+func (bs *baseSession) WriteFrame(b []byte) (int, error) {
+	fdp, err := bs.frameDataPlane()
+	if err != nil {
+		return 0, err
+	}
+	return fdp.WriteFrame(b)
+}
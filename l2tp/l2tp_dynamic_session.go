@@ -5,6 +5,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"sync"
+	"time"
 )
 
 type dynamicSession struct {
@@ -14,19 +15,64 @@ type dynamicSession struct {
 	callSerial  uint32
 	ifname      string
 	result      string
+	resultCode  *resultCode
+	peerClosed  bool
 	dt          *dynamicTunnel
 	dp          SessionDataPlane
 	wg          sync.WaitGroup
 	msgRxChan   chan controlMessage
 	eventChan   chan string
 	closeChan   chan interface{}
+	closeOnce   sync.Once
+	// The result sent to the peer when the application closes the session
+	closeResult *resultCode
 	killChan    chan interface{}
 	fsm         fsm
+	// Bounds the time spent waiting for the peer to reply to the
+	// ICRQ, if configured.
+	replyTimer *time.Timer
+	// Called once the session is established or fails to establish,
+	// if the application asked to be informed.
+	done EstablishCallback
+	// For sessions requested by the peer, the ICRQ requesting the session
+	icrq controlMessage
+	// For persistent sessions, the delay before re-establishing the
+	// session once the peer has closed it.
+	retryTimer   *time.Timer
+	retryBackoff time.Duration
+	// For on-demand sessions, signals the application's request to
+	// establish the session, and records a request made before the
+	// tunnel is up.
+	triggerChan chan interface{}
+	triggered   bool
+	// For on-demand sessions with an idle timeout, the timer used to
+	// sample the data plane counters, and the packet count at the last
+	// sample.
+	idleTimer   *time.Timer
+	idlePackets uint64
+	// Set if the session's MTU is derived from the tunnel path MTU
+	// rather than being specified by the application.
+	autoMTU     bool
+	pathMTUChan chan interface{}
 }
 
+// The upper bound on the delay before re-establishing a persistent session.
+const maxPersistBackoff = time.Minute
+
 func (ds *dynamicSession) Close() {
+	ds.CloseWithResult(CDNResultAdminDisconnect, ErrorCodeNoError, "")
+}
+
+func (ds *dynamicSession) CloseWithResult(result ResultCode, errCode ErrorCode, message string) {
 	ds.parent.unlinkSession(ds)
-	close(ds.closeChan)
+	ds.closeOnce.Do(func() {
+		ds.closeResult = &resultCode{
+			result:  avpResultCode(result),
+			errCode: avpErrorCode(errCode),
+			errMsg:  message,
+		}
+		close(ds.closeChan)
+	})
 	ds.wg.Wait()
 }
 
@@ -36,6 +82,28 @@ func (ds *dynamicSession) kill() {
 	ds.wg.Wait()
 }
 
+// Trigger requests the establishment of an on-demand session.
+func (ds *dynamicSession) Trigger() {
+	if !ds.cfg.OnDemand {
+		return
+	}
+	// A trigger already pending will establish the session
+	select {
+	case ds.triggerChan <- true:
+	default:
+	}
+}
+
+// onPathMTUChange is called by the tunnel when the path MTU to the
+// peer changes.
+func (ds *dynamicSession) onPathMTUChange() {
+	// A change already pending will update the session
+	select {
+	case ds.pathMTUChan <- true:
+	default:
+	}
+}
+
 func (ds *dynamicSession) onTunnelUp() {
 	ds.eventChan <- "tunnelopen"
 }
@@ -49,10 +117,14 @@ func (ds *dynamicSession) runSession() {
 
 	level.Info(ds.logger).Log(
 		"message", "new dynamic session",
-		"session_id", ds.cfg.SessionID,
 		"peer_session_id", ds.cfg.PeerSessionID,
 		"pseudowire", ds.cfg.Pseudowire)
 
+	if ds.icrq != nil {
+		ds.onControlRx()
+		ds.handleEvent("icrq", ds.icrq)
+	}
+
 	for !ds.isClosed {
 		select {
 		case msg, ok := <-ds.msgRxChan:
@@ -67,18 +139,30 @@ func (ds *dynamicSession) runSession() {
 				return
 			}
 			ds.handleEvent(ev)
+		case <-ds.replyTimeout():
+			ds.onReplyTimeout()
+		case <-ds.retryTimeout():
+			ds.retryTimer = nil
+			ds.handleEvent("retry")
+		case <-ds.triggerChan:
+			ds.handleEvent("trigger")
+		case <-ds.idleTimeout():
+			ds.onIdleTimeout()
+		case <-ds.pathMTUChan:
+			ds.updateMTU()
 		case <-ds.killChan:
 			ds.fsmActClose(nil)
 			return
 		case <-ds.closeChan:
-			ds.handleEvent("close", avpCDNResultCodeAdminDisconnect)
+			rc := ds.closeResult
+			ds.handleEvent("close", rc.result, rc.errCode, rc.errMsg)
 			return
 		}
 	}
 }
 
 func (ds *dynamicSession) handleEvent(ev string, args ...interface{}) {
-	if ev != "" {
+	if ev != "" && !ds.isClosed {
 		level.Debug(ds.logger).Log(
 			"message", "fsm event",
 			"event", ev)
@@ -92,14 +176,94 @@ func (ds *dynamicSession) handleEvent(ev string, args ...interface{}) {
 	}
 }
 
+// onStateChange is called by the fsm when the session changes state.
+func (ds *dynamicSession) onStateChange(from, to string) {
+	level.Debug(ds.logger).Log(
+		"message", "state change",
+		"from", from,
+		"to", to)
+	ds.setState(SessionState(to))
+	if ds.replyTimer != nil {
+		ds.replyTimer.Stop()
+		ds.replyTimer = nil
+	}
+	timeout := ds.dt.getCfg().SessionReplyTimeout
+	if (to == "waitreply" || to == "waitconnect") && timeout > 0 {
+		ds.replyTimer = time.NewTimer(timeout)
+	}
+	if ds.idleTimer != nil {
+		ds.idleTimer.Stop()
+		ds.idleTimer = nil
+	}
+	if to == "established" && ds.cfg.IdleTimeout > 0 {
+		ds.idlePackets = 0
+		ds.idleTimer = time.NewTimer(ds.cfg.IdleTimeout)
+	}
+	ds.parent.handleUserEvent(&SessionStateEvent{
+		TunnelName:  ds.parent.getName(),
+		Tunnel:      ds.parent,
+		SessionName: ds.getName(),
+		Session:     ds,
+		From:        SessionState(from),
+		To:          SessionState(to),
+	})
+}
+
+func (ds *dynamicSession) onReplyTimeout() {
+	ds.replyTimer = nil
+
+	errMsg := "timed out waiting for ICRP"
+	if ds.fsm.current == "waitconnect" {
+		errMsg = "timed out waiting for ICCN"
+	}
+
+	level.Error(ds.logger).Log("message", errMsg)
+	ds.handleEvent("timeout", avpCDNResultCodeTimeout, errMsg)
+}
+
+// replyTimeout returns the channel the reply timer fires on, or nil
+// if the timer isn't running.
+func (ds *dynamicSession) replyTimeout() <-chan time.Time {
+	if ds.replyTimer == nil {
+		return nil
+	}
+	return ds.replyTimer.C
+}
+
+// onIdleTimeout disconnects an on-demand session if it has passed no
+// data traffic since the idle timer was last started.
+func (ds *dynamicSession) onIdleTimeout() {
+	ds.idleTimer = nil
+
+	data := ds.Stats().Data
+	packets := data.RxPackets + data.TxPackets
+	if packets != ds.idlePackets {
+		ds.idlePackets = packets
+		ds.idleTimer = time.NewTimer(ds.cfg.IdleTimeout)
+		return
+	}
+
+	level.Info(ds.logger).Log("message", "on-demand session idle, disconnecting")
+	ds.handleEvent("idle", avpCDNResultCodeAdminDisconnect, "idle timeout")
+}
+
+// idleTimeout returns the channel the idle timer fires on, or nil
+// if the timer isn't running.
+func (ds *dynamicSession) idleTimeout() <-chan time.Time {
+	if ds.idleTimer == nil {
+		return nil
+	}
+	return ds.idleTimer.C
+}
+
 // panics if expected arguments are not passed
-func fsmArgsToV2Msg(args []interface{}) (msg *v2ControlMessage) {
+func fsmArgsToMsg(args []interface{}) (msg controlMessage) {
 	if len(args) != 1 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 1, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	return
 }
@@ -126,7 +290,7 @@ func fsmArgsToCdnResult(args []interface{}) *resultCode {
 }
 
 func cdnResultCodeToString(rc *resultCode) string {
-	var resStr, errStr, errMsg string
+	var resStr string
 
 	switch rc.result {
 	case avpCDNResultCodeReserved:
@@ -153,8 +317,18 @@ func cdnResultCodeToString(rc *resultCode) string {
 		resStr = "establish timeout"
 	case avpCDNResultCodeBadTransport:
 		resStr = "no appropriate framing detected"
+	case avpCDNResultCodeUnsupportedPseudowire:
+		resStr = "unsupported pseudowire type"
 	}
 
+	return formatResultCode(rc, resStr)
+}
+
+// formatResultCode describes a result code, given a description of the
+// result which is specific to the message type the result code was sent in.
+func formatResultCode(rc *resultCode, resStr string) string {
+	var errStr, errMsg string
+
 	switch rc.errCode {
 	case avpErrorCodeNoError:
 		errStr = "no general error"
@@ -202,7 +376,17 @@ func (ds *dynamicSession) handleMsg(msg controlMessage) {
 			ds.fsmActClose(nil)
 			return
 		}
-		ds.handleV2Msg(msg)
+		ds.handleSessionMsg(msg)
+		return
+	case ProtocolVersion3:
+		msg, ok := msg.(*v3ControlMessage)
+		if !ok {
+			level.Error(ds.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			ds.fsmActClose(nil)
+			return
+		}
+		ds.handleSessionMsg(msg)
 		return
 	}
 
@@ -211,19 +395,21 @@ func (ds *dynamicSession) handleMsg(msg controlMessage) {
 		"version", msg.protocolVersion())
 }
 
-func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
+func (ds *dynamicSession) handleSessionMsg(msg controlMessage) {
 
 	// It's possible to have a message mis-delivered on our control
 	// socket.  Ignore these messages: ideally we'd redirect them
 	// but dropping them is a good compromise for now.
-	if msg.Sid() != uint16(ds.cfg.SessionID) {
+	if sid := sessionMsgSid(msg); sid != ds.cfg.SessionID {
 		level.Error(ds.logger).Log(
 			"message", "received control message with the wrong SID",
 			"expected", ds.cfg.SessionID,
-			"got", msg.Sid())
+			"got", sid)
 		return
 	}
 
+	ds.onControlRx()
+
 	// Validate the message.  If validation fails drive shutdown via.
 	// the FSM to allow the error to be communicated to the peer.
 	err := msg.validate()
@@ -236,6 +422,7 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 			avpCDNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -258,16 +445,18 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 	}
 
 	level.Error(ds.logger).Log(
-		"message", "unhandled v2 control message",
+		"message", "unhandled session control message",
 		"message_type", msg.getType())
 
 	ds.handleEvent("close",
 		avpCDNResultCodeGeneralError,
 		avpErrorCodeBadValue,
-		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
+		fmt.Sprintf("unhandled session control message %v", msg.getType()))
 }
 
-func (ds *dynamicSession) sendMessage(msg controlMessage) {
+// sendMessage sends a control message to the peer, closing the session
+// if the message can't be sent.
+func (ds *dynamicSession) sendMessage(msg controlMessage) error {
 	err := ds.dt.sendMessage(msg)
 	if err != nil {
 		level.Error(ds.logger).Log(
@@ -275,10 +464,39 @@ func (ds *dynamicSession) sendMessage(msg controlMessage) {
 			"message_type", msg.getType(),
 			"error", err)
 		ds.fsmActClose(nil)
+		return err
 	}
+	ds.onControlTx()
+	return nil
 }
 
 func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
+	pw, ok := ds.dt.negotiatePseudowire(ds.cfg)
+	if !ok {
+		rc := &resultCode{
+			result: avpCDNResultCodeUnsupportedPseudowire,
+			errMsg: fmt.Sprintf("peer doesn't support pseudowire type %v", ds.cfg.Pseudowire),
+		}
+		if len(ds.cfg.PseudowireFallback) > 0 {
+			rc.errMsg = fmt.Sprintf("peer doesn't support pseudowire type %v or fallbacks %v",
+				ds.cfg.Pseudowire, ds.cfg.PseudowireFallback)
+		}
+		level.Error(ds.logger).Log(
+			"message", "can't establish session",
+			"error", rc.errMsg)
+		ds.setResult(rc, false)
+		ds.fsmActClose(nil)
+		return
+	}
+
+	if pw != ds.cfg.Pseudowire {
+		level.Info(ds.logger).Log(
+			"message", "peer doesn't support preferred pseudowire type, falling back",
+			"preferred", ds.cfg.Pseudowire,
+			"pseudowire", pw)
+		ds.cfg.Pseudowire = pw
+	}
+
 	err := ds.sendIcrq()
 	if err != nil {
 		level.Error(ds.logger).Log(
@@ -289,18 +507,18 @@ func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendIcrq() (err error) {
-	msg, err := newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	tcfg := ds.parent.getCfg()
+	msg, err := newIcrq(tcfg.Version, ds.callSerial, tcfg.PeerTunnelID, ds.cfg)
 	if err != nil {
 		return err
 	}
-	ds.sendMessage(msg)
-	return
+	return ds.sendMessage(msg)
 }
 
 func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
-	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	psid, err := sessionMsgPeerSid(msg)
 	if err != nil {
 		// Shouldn't occur since session ID is mandatory
 		level.Error(ds.logger).Log(
@@ -309,24 +527,45 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		ds.handleEvent("close",
 			avpCDNResultCodeGeneralError,
 			avpErrorCodeBadValue,
-			"no Assigned Session ID AVP in ICRP message")
+			"no session ID AVP in ICRP message")
+		return
+	}
+
+	if !ds.onPeerSessionParams(msg) {
 		return
 	}
 
-	ds.cfg.PeerSessionID = ControlConnID(psid)
+	ds.cfg.PeerSessionID = psid
+	ds.dt.setSessionPeerID(ds, ds.cfg.PeerSessionID)
 
 	err = ds.sendIccn()
 	if err != nil {
 		level.Error(ds.logger).Log(
 			"message", "failed to send ICCN",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			fmt.Sprintf("failed to send ICCN: %v", err))
 		return
 	}
 
+	ds.establish()
+}
+
+// establish brings up the data plane once the session's control
+// protocol exchange with the peer is complete.
+func (ds *dynamicSession) establish() {
+	var err error
+
 	level.Info(ds.logger).Log("message", "control plane established")
 
+	// Size the session's interface for the tunnel path, unless the
+	// application specified the MTU
+	if ds.cfg.MTU == 0 || ds.autoMTU {
+		ds.autoMTU = true
+		ds.cfg.MTU = ds.dt.sessionMTU(ds.cfg)
+	}
+
 	// establish the data plane
 	ds.dp, err = ds.parent.getDP().NewSession(
 		ds.parent.getCfg().TunnelID,
@@ -336,8 +575,10 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		level.Error(ds.logger).Log(
 			"message", "failed to establish data plane",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			fmt.Sprintf("failed to establish data plane: %v", err))
+		return
 	}
 
 	ds.ifname, err = ds.dp.GetInterfaceName()
@@ -345,13 +586,34 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		level.Error(ds.logger).Log(
 			"message", "failed to retrieve session interface name",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			fmt.Sprintf("failed to retrieve session interface name: %v", err))
+		return
+	}
+
+	err = configureInterface(ds.ifname, ds.parent.getCfg(), ds.cfg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to configure session interface",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			fmt.Sprintf("failed to configure session interface: %v", err))
+		return
 	}
 
 	level.Info(ds.logger).Log("message", "data plane established")
+	ds.setDataPlane(ds.dp)
 
 	ds.established = true
+	ds.parent.handleUserEvent(&SessionDataplaneReadyEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		SessionName:   ds.getName(),
+		Session:       ds,
+		InterfaceName: ds.ifname,
+	})
 	ds.parent.handleUserEvent(&SessionUpEvent{
 		TunnelName:    ds.parent.getName(),
 		Tunnel:        ds.parent,
@@ -361,49 +623,368 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		SessionConfig: ds.cfg,
 		InterfaceName: ds.ifname,
 	})
+	ds.establishDone(nil)
+}
+
+// fsmActEstablish brings up a static session's data plane directly from
+// the session configuration.
+func (ds *dynamicSession) fsmActEstablish(args []interface{}) {
+	ds.establish()
+}
+
+// updateMTU resizes the network interface of an established session
+// following a change in the tunnel path MTU.  PPP sessions are left
+// alone, since PPP negotiates the MTU of its interface.
+func (ds *dynamicSession) updateMTU() {
+	if !ds.established || !ds.autoMTU || ds.cfg.Pseudowire == PseudowireTypePPP {
+		return
+	}
+	mdp, ok := ds.dp.(MTUSessionDataPlane)
+	if !ok {
+		return
+	}
+
+	mtu := ds.dt.sessionMTU(ds.cfg)
+	if mtu == 0 || mtu == ds.cfg.MTU {
+		return
+	}
+
+	err := mdp.SetMTU(mtu)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to update session MTU",
+			"mtu", mtu,
+			"error", err)
+		return
+	}
+
+	level.Info(ds.logger).Log(
+		"message", "updated session MTU for tunnel path MTU",
+		"from", ds.cfg.MTU,
+		"to", mtu)
+	ds.cfg.MTU = mtu
+}
+
+func (ds *dynamicSession) fsmActOnIcrq(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	if !ds.onPeerSessionParams(msg) {
+		return
+	}
+
+	err := ds.sendIcrp()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendIcrp() (err error) {
+	tcfg := ds.parent.getCfg()
+	msg, err := newIcrp(tcfg.Version, tcfg.PeerTunnelID, ds.cfg)
+	if err != nil {
+		return err
+	}
+	return ds.sendMessage(msg)
+}
+
+func (ds *dynamicSession) fsmActOnIccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	if !ds.onPeerSessionParams(msg) {
+		return
+	}
+
+	ds.establish()
+}
+
+// onPeerSessionParams applies the session parameters the peer sent in an
+// ICRQ, ICRP or ICCN message.  If the parameters aren't acceptable the
+// session is closed and false is returned.
+func (ds *dynamicSession) onPeerSessionParams(msg controlMessage) bool {
+	avps := msg.getAvps()
+
+	if msg.protocolVersion() == ProtocolVersion2 {
+		// The LAC may require sequence numbers on the data channel.
+		// Ref: RFC2661 section 5.4.
+		if msg.getType() == avpMsgTypeIccn {
+			if _, err := findAvp(avps, vendorIDIetf, avpTypeSequencingRequired); err == nil {
+				level.Info(ds.logger).Log("message", "peer requires data sequence numbers")
+				ds.cfg.SeqNum = true
+			}
+			tx, _ := findUint32Avp(avps, vendorIDIetf, avpTypeConnectSpeed)
+			rx, _ := findUint32Avp(avps, vendorIDIetf, avpTypeRxConnectSpeed)
+			ds.setPeerConnectSpeed(uint64(tx), uint64(rx))
+		}
+		return true
+	}
+
+	// An L2TPv3 peer tells us its cookie, and may require sequence
+	// numbers on the data channel.  A peer which doesn't assign a cookie
+	// in its ICRQ or ICRP won't send one in its data packets, so any peer
+	// cookie left over from configuration or an earlier call is dropped
+	// to avoid the data plane discarding everything the peer sends.
+	if cookie, err := findBytesAvp(avps, vendorIDIetf, avpTypeAssignedCookie); err == nil {
+		if l := len(cookie); l != 4 && l != 8 {
+			errMsg := fmt.Sprintf("bad Assigned Cookie length %v in %v message", l, msg.getType())
+			level.Error(ds.logger).Log("message", errMsg)
+			ds.handleEvent("close",
+				avpCDNResultCodeGeneralError,
+				avpErrorCodeBadValue,
+				errMsg)
+			return false
+		}
+		ds.cfg.PeerCookie = cookie
+	} else if msg.getType() != avpMsgTypeIccn {
+		ds.cfg.PeerCookie = nil
+	}
+
+	if seq, err := findUint16Avp(avps, vendorIDIetf, avpTypeDataSequencing); err == nil && seq != v3DataSequencingNone {
+		level.Info(ds.logger).Log("message", "peer requires data sequence numbers")
+		ds.cfg.SeqNum = true
+		useSeqNumSublayer(ds.cfg)
+	}
+
+	// The peer tells us which L2-Specific Sublayer it requires on the data
+	// packets it receives.  The data plane uses the same sublayer in both
+	// directions, so we adopt the peer's requirement where we're able to.
+	// Ref: RFC3931 section 5.4.3.
+	if l2ss, err := findUint16Avp(avps, vendorIDIetf, avpTypeL2specificSublayer); err == nil {
+		var errMsg string
+		switch l2ss {
+		case v3L2SpecSublayerDefault:
+			ds.cfg.L2SpecType = L2SpecTypeDefault
+		case v3L2SpecSublayerNone:
+			if ds.cfg.L2SpecType != L2SpecTypeNone {
+				errMsg = "peer requires no L2-Specific Sublayer"
+			}
+		default:
+			errMsg = fmt.Sprintf("unsupported L2-Specific Sublayer %v in %v message", l2ss, msg.getType())
+		}
+		if errMsg != "" {
+			level.Error(ds.logger).Log("message", errMsg)
+			ds.handleEvent("close",
+				avpCDNResultCodeGeneralError,
+				avpErrorCodeBadValue,
+				errMsg)
+			return false
+		}
+	}
+
+	// The connect speeds may be updated by each message
+	tx, rx := ds.peerConnectSpeed()
+	if v, err := findUint64Avp(avps, vendorIDIetf, avpTypeTxConnectSpeedBps); err == nil {
+		tx = v
+	}
+	if v, err := findUint64Avp(avps, vendorIDIetf, avpTypeRxConnectSpeedBps); err == nil {
+		rx = v
+	}
+	ds.setPeerConnectSpeed(tx, rx)
+
+	if cs, err := findUint16Avp(avps, vendorIDIetf, avpTypeCircuitStatus); err == nil && cs&v3CircuitStatusActive == 0 {
+		level.Info(ds.logger).Log("message", "peer reports circuit inactive")
+	}
+
+	return true
 }
 
 func (ds *dynamicSession) sendIccn() (err error) {
-	msg, err := newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	tcfg := ds.parent.getCfg()
+	msg, err := newIccn(tcfg.Version, tcfg.PeerTunnelID, ds.cfg)
 	if err != nil {
 		return err
 	}
-	ds.sendMessage(msg)
-	return
+	return ds.sendMessage(msg)
+}
+
+// fsmActOnUnexpectedMsg handles a message which isn't valid in the
+// session's current state by tearing the session down.
+// Ref: RFC2661 sections 7.4.1 and 7.4.2.
+func (ds *dynamicSession) fsmActOnUnexpectedMsg(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	errMsg := fmt.Sprintf("unexpected %v message", msg.getType())
+	level.Error(ds.logger).Log("message", errMsg)
+
+	ds.fsmActSendCdn([]interface{}{avpCDNResultCodeGeneralError, errMsg})
 }
 
 func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
 	rc := fsmArgsToCdnResult(args)
-	if ds.result == "" {
-		ds.result = cdnResultCodeToString(rc)
-	}
+	ds.setResult(rc, false)
 	_ = ds.sendCdn(rc)
 	ds.fsmActClose(args)
 }
 
 func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
-	msg, err := newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	tcfg := ds.parent.getCfg()
+	msg, err := newCdn(tcfg.Version, tcfg.PeerTunnelID, rc, ds.cfg)
 	if err != nil {
 		return err
 	}
-	ds.sendMessage(msg)
-	return
+	return ds.sendMessage(msg)
 }
 
 func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
 	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
-	if err == nil && ds.result == "" {
-		ds.result = cdnResultCodeToString(rc)
+	if err == nil {
+		ds.setResult(rc, true)
 	}
 
 	ds.fsmActClose(args)
 }
 
+// setResult records the result code of the CDN closing the session,
+// unless already known.
+func (ds *dynamicSession) setResult(rc *resultCode, byPeer bool) {
+	if ds.resultCode == nil {
+		ds.result = cdnResultCodeToString(rc)
+		ds.resultCode = rc
+		ds.peerClosed = byPeer
+		ds.setCloseResult(ds.result)
+	}
+}
+
+// fsmActScheduleRetry handles a CDN from the peer for a persistent session
+// by tearing down the session, then scheduling a new ICRQ once the backoff
+// delay expires.
+func (ds *dynamicSession) fsmActScheduleRetry(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err == nil {
+		ds.setResult(rc, true)
+	}
+
+	wasEstablished := ds.established
+	ds.down()
+
+	// Start the backoff afresh if the session had been established,
+	// otherwise back off further from the last attempt
+	if wasEstablished || ds.retryBackoff == 0 {
+		ds.retryBackoff = ds.cfg.PersistBackoff
+	} else {
+		ds.retryBackoff *= 2
+	}
+	if ds.retryBackoff > maxPersistBackoff {
+		ds.retryBackoff = maxPersistBackoff
+	}
+
+	level.Info(ds.logger).Log(
+		"message", "peer closed persistent session, retrying",
+		"result", ds.result,
+		"delay", ds.retryBackoff)
+
+	ds.resetCall()
+	ds.retryTimer = time.NewTimer(ds.retryBackoff)
+}
+
+// resetCall discards the state of the session's last call to the peer
+// ahead of sending a new ICRQ.
+func (ds *dynamicSession) resetCall() {
+	ds.dp = nil
+	ds.result = ""
+	ds.resultCode = nil
+	ds.peerClosed = false
+	ds.cfg.PeerSessionID = 0
+	ds.dt.setSessionPeerID(ds, 0)
+	ds.setPeerConnectSpeed(0, 0)
+	ds.callSerial = ds.dt.parent.allocCallSerial()
+}
+
+// fsmActWaitTrigger handles the tunnel coming up for an on-demand session
+// by sending an ICRQ if the application has already triggered the session.
+func (ds *dynamicSession) fsmActWaitTrigger(args []interface{}) {
+	if ds.triggered {
+		ds.triggered = false
+		ds.fsm.setState("waitreply")
+		ds.fsmActSendIcrq(args)
+	}
+}
+
+// fsmActOnEarlyTrigger records a trigger for an on-demand session
+// received before the tunnel is up.
+func (ds *dynamicSession) fsmActOnEarlyTrigger(args []interface{}) {
+	ds.triggered = true
+}
+
+// fsmActOnDemandCdn handles a CDN from the peer for an on-demand session
+// by tearing down the session, which then waits for the next trigger.
+func (ds *dynamicSession) fsmActOnDemandCdn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err == nil {
+		ds.setResult(rc, true)
+	}
+
+	level.Info(ds.logger).Log(
+		"message", "peer closed on-demand session",
+		"result", ds.result)
+
+	ds.down()
+	ds.resetCall()
+}
+
+// fsmActOnDemandDisconnect sends a CDN to the peer for an on-demand session,
+// then tears down the session, which then waits for the next trigger.
+func (ds *dynamicSession) fsmActOnDemandDisconnect(args []interface{}) {
+	rc := fsmArgsToCdnResult(args)
+	ds.setResult(rc, false)
+	if err := ds.sendCdn(rc); err != nil {
+		return
+	}
+
+	ds.down()
+	ds.resetCall()
+}
+
+// retryTimeout returns the channel the retry timer fires on, or nil
+// if the timer isn't running.
+func (ds *dynamicSession) retryTimeout() <-chan time.Time {
+	if ds.retryTimer == nil {
+		return nil
+	}
+	return ds.retryTimer.C
+}
+
 func (ds *dynamicSession) fsmActClose(args []interface{}) {
+	if ds.isClosed {
+		return
+	}
+
+	ds.fsm.setState("dead")
+
+	if ds.retryTimer != nil {
+		ds.retryTimer.Stop()
+		ds.retryTimer = nil
+	}
+
+	wasEstablished := ds.established
+	ds.down()
+	if !wasEstablished {
+		ds.establishDone(establishError(ds.result))
+	}
+
+	ds.parent.unlinkSession(ds)
+	level.Info(ds.logger).Log("message", "close")
+	ds.isClosed = true
+}
+
+// down tears down the session's data plane, informing the application
+// if the session was established.
+func (ds *dynamicSession) down() {
+	ds.setDataPlane(nil)
 	if ds.dp != nil {
-		err := ds.dp.Down()
+		err := releaseInterface(ds.ifname, ds.parent.getCfg(), ds.cfg)
+		if err != nil {
+			level.Error(ds.logger).Log("message", "failed to release session interface", "error", err)
+		}
+		err = ds.dp.Down()
 		if err != nil {
 			level.Error(ds.logger).Log("message", "dataplane down failed", "error", err)
 		}
@@ -411,7 +992,7 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 
 	if ds.established {
 		ds.established = false
-		ds.parent.handleUserEvent(&SessionDownEvent{
+		ev := &SessionDownEvent{
 			TunnelName:    ds.parent.getName(),
 			Tunnel:        ds.parent,
 			TunnelConfig:  ds.parent.getCfg(),
@@ -420,56 +1001,136 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 			SessionConfig: ds.cfg,
 			InterfaceName: ds.ifname,
 			Result:        ds.result,
-		})
+			ClosedByPeer:  ds.peerClosed,
+		}
+		if ds.resultCode != nil {
+			ev.ResultCode = ResultCode(ds.resultCode.result)
+			ev.ErrorCode = ErrorCode(ds.resultCode.errCode)
+			ev.ErrorMessage = ds.resultCode.errMsg
+		}
+		ds.parent.handleUserEvent(ev)
 	}
+}
 
-	ds.parent.unlinkSession(ds)
-	level.Info(ds.logger).Log("message", "close")
-	ds.isClosed = true
+// establishDone informs the application of the outcome of establishing
+// the session, if it asked to be informed.
+func (ds *dynamicSession) establishDone(err error) {
+	if ds.done != nil {
+		done := ds.done
+		ds.done = nil
+		done(err)
+	}
 }
 
 // Create a new client/LAC mode session instance
-func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
+func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig, done EstablishCallback) (ds *dynamicSession, err error) {
 
-	ds = &dynamicSession{
-		baseSession: newBaseSession(
-			log.With(parent.getLogger(), "session_name", name),
-			name,
-			parent,
-			cfg),
-		callSerial: serial,
-		dt:         parent,
-		msgRxChan:  make(chan controlMessage),
-		eventChan:  make(chan string),
-		closeChan:  make(chan interface{}),
-		killChan:   make(chan interface{}),
+	ds = allocDynamicSession(name, parent, cfg, done)
+	ds.callSerial = serial
+	ds.setState(SessionStateWaitTunnel)
+
+	// Persistent sessions retry the ICRQ if the peer sends a CDN, rather
+	// than closing.  These transitions take precedence over those below.
+	var persist []eventDesc
+	if cfg.Persist {
+		persist = []eventDesc{
+			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActScheduleRetry, to: "waitretry"},
+			{from: "established", events: []string{"cdn"}, cb: ds.fsmActScheduleRetry, to: "waitretry"},
+
+			{from: "waitretry", events: []string{"retry"}, cb: ds.fsmActSendIcrq, to: "waitreply"},
+			{from: "waitretry", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+			// Late messages for the previous call are discarded
+			{from: "waitretry", events: []string{"icrq", "icrp", "iccn", "cdn"}, to: "waitretry"},
+		}
+	}
+
+	// On-demand sessions wait for the application to trigger them before
+	// sending an ICRQ, and return to waiting rather than closing.
+	var onDemand []eventDesc
+	if cfg.OnDemand {
+		onDemand = []eventDesc{
+			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActWaitTrigger, to: "waittrigger"},
+			{from: "waittunnel", events: []string{"trigger"}, cb: ds.fsmActOnEarlyTrigger, to: "waittunnel"},
+
+			{from: "waittrigger", events: []string{"trigger"}, cb: ds.fsmActSendIcrq, to: "waitreply"},
+			{from: "waittrigger", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+			// Late messages for the previous call are discarded
+			{from: "waittrigger", events: []string{"icrq", "icrp", "iccn", "cdn"}, to: "waittrigger"},
+
+			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnDemandCdn, to: "waittrigger"},
+			{from: "waitreply", events: []string{"timeout"}, cb: ds.fsmActOnDemandDisconnect, to: "waittrigger"},
+			{from: "waitreply", events: []string{"trigger"}, to: "waitreply"},
+
+			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnDemandCdn, to: "waittrigger"},
+			{from: "established", events: []string{"idle"}, cb: ds.fsmActOnDemandDisconnect, to: "waittrigger"},
+			{from: "established", events: []string{"trigger"}, to: "established"},
+		}
+	}
+
+	// Static sessions are established as soon as the tunnel is up, and
+	// aren't signalled to the peer at all.
+	if cfg.Static {
+		ds.fsm = fsm{
+			current: "waittunnel",
+			table: []eventDesc{
+				{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActEstablish, to: "established"},
+				{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+				{from: "established", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+				// The peer has no call for the session, so messages are discarded
+				{from: "established", events: []string{"icrq", "icrp", "iccn", "cdn"}, to: "established"},
+			},
+			onTransition: ds.onStateChange,
+		}
+
+		ds.wg.Add(1)
+		go ds.runSession()
+
+		return
 	}
 
 	// Ref: RFC2661 section 7.4.1
 	ds.fsm = fsm{
 		current: "waittunnel",
-		table: []eventDesc{
+		table: append(persist, append(onDemand, append([]eventDesc{
 			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendIcrq, to: "waitreply"},
 			{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
 
 			{from: "waitreply", events: []string{"icrp"}, cb: ds.fsmActOnIcrp, to: "established"},
-			{from: "waitreply", events: []string{"iccn"}, cb: ds.fsmActClose, to: "dead"},
 			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{from: "waitreply", events: []string{"icrq", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
-
-			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{
-				from: "established",
-				events: []string{
-					"icrq",
-					"icrp",
-					"iccn",
-					"close",
-				},
-				cb: ds.fsmActSendCdn,
-				to: "dead",
-			},
-		},
+			{from: "waitreply", events: []string{"icrq", "iccn"}, cb: ds.fsmActOnUnexpectedMsg, to: "dead"},
+			{from: "waitreply", events: []string{"close", "timeout"}, cb: ds.fsmActSendCdn, to: "dead"},
+		}, ds.establishedFsmTable()...)...)...),
+		onTransition: ds.onStateChange,
+	}
+
+	ds.wg.Add(1)
+	go ds.runSession()
+
+	return
+}
+
+// Create a new server/LNS mode session instance in response to an ICRQ
+// received from the peer.
+func newDynamicResponderSession(name string, parent *dynamicTunnel, cfg *SessionConfig, icrq controlMessage) (ds *dynamicSession, err error) {
+
+	ds = allocDynamicSession(name, parent, cfg, nil)
+	ds.icrq = icrq
+	ds.setState(SessionStateIdle)
+
+	// Ref: RFC2661 section 7.4.2
+	ds.fsm = fsm{
+		current: "idle",
+		table: append([]eventDesc{
+			{from: "idle", events: []string{"icrq"}, cb: ds.fsmActOnIcrq, to: "waitconnect"},
+			{from: "idle", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+			{from: "waitconnect", events: []string{"iccn"}, cb: ds.fsmActOnIccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"icrq", "icrp"}, cb: ds.fsmActOnUnexpectedMsg, to: "dead"},
+			{from: "waitconnect", events: []string{"close", "timeout"}, cb: ds.fsmActSendCdn, to: "dead"},
+		}, ds.establishedFsmTable()...),
+		onTransition: ds.onStateChange,
 	}
 
 	ds.wg.Add(1)
@@ -477,3 +1138,31 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 
 	return
 }
+
+func allocDynamicSession(name string, parent *dynamicTunnel, cfg *SessionConfig, done EstablishCallback) *dynamicSession {
+	return &dynamicSession{
+		baseSession: newBaseSession(
+			log.With(parent.getLogger(), "session_name", name, "session_id", cfg.SessionID),
+			name,
+			parent,
+			cfg),
+		dt:          parent,
+		msgRxChan:   make(chan controlMessage),
+		eventChan:   make(chan string),
+		closeChan:   make(chan interface{}),
+		killChan:    make(chan interface{}),
+		triggerChan: make(chan interface{}, 1),
+		pathMTUChan: make(chan interface{}, 1),
+		done:        done,
+	}
+}
+
+// establishedFsmTable returns the fsm transitions for the established
+// state, which are common to the initiator and responder.
+func (ds *dynamicSession) establishedFsmTable() []eventDesc {
+	return []eventDesc{
+		{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+		{from: "established", events: []string{"icrq", "icrp", "iccn"}, cb: ds.fsmActOnUnexpectedMsg, to: "dead"},
+		{from: "established", events: []string{"close"}, cb: ds.fsmActSendCdn, to: "dead"},
+	}
+}
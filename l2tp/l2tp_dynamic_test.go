@@ -8,6 +8,8 @@ package l2tp
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -100,6 +102,14 @@ type testLNS struct {
 	tunnelEstablished  bool
 	sessionEstablished bool
 	isShutdown         bool
+	stopccnResult      *resultCode
+	cdnResult          *resultCode
+	// If set, called on receipt of an SCCRQ.  The SCCRQ is answered
+	// only if onSccrq returns true.
+	onSccrq func() bool
+	// If set, called on receipt of an ICRQ.  The ICRQ is answered
+	// only if onIcrq returns true.
+	onIcrq func() bool
 }
 
 func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*testLNS, error) {
@@ -122,6 +132,7 @@ func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*te
 
 	xcfg := defaulttransportConfig()
 	xcfg.Version = tcfg.Version
+	xcfg.PeerControlConnID = tcfg.PeerTunnelID
 	xport, err := newTransport(myLogger, cp, xcfg)
 	if err != nil {
 		return nil, fmt.Errorf("newTransport(): %v", err)
@@ -153,10 +164,13 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		if err != nil {
 			return fmt.Errorf("no Tunnel ID AVP in SCCRQ")
 		}
+		if lns.onSccrq != nil && !lns.onSccrq() {
+			return nil
+		}
 		lns.xport.config.PeerControlConnID = ControlConnID(ptid)
 		lns.tcfg.PeerTunnelID = ControlConnID(ptid)
 		lns.xport.cp.connectTo(from)
-		rsp, err := newV2Sccrp(lns.tcfg)
+		rsp, err := newV2Sccrp(lns.tcfg, nil, nil)
 		if err != nil {
 			return fmt.Errorf("failed to build SCCRP: %v", err)
 		}
@@ -165,6 +179,7 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		lns.tunnelEstablished = true
 		return nil
 	case avpMsgTypeStopccn:
+		lns.stopccnResult, _ = findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 		// HACK: allow the transport to ack the stopccn.
 		// By closing the transport the transport recvChan will be
 		// closed, which will cause the run() function to return.
@@ -181,6 +196,9 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 			return fmt.Errorf("no Session ID AVP in ICRQ")
 		}
 		lns.scfg.PeerSessionID = ControlConnID(psid)
+		if lns.onIcrq != nil && !lns.onIcrq() {
+			return nil
+		}
 		rsp, err := newV2Icrp(lns.tcfg.PeerTunnelID, lns.scfg)
 		if err != nil {
 			return fmt.Errorf("failed to build ICRP: %v", err)
@@ -190,6 +208,7 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		lns.sessionEstablished = true
 		return nil
 	case avpMsgTypeCdn:
+		lns.cdnResult, _ = findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 		return nil
 	}
 	return fmt.Errorf("message %v not handled", msg.getType())
@@ -263,6 +282,24 @@ func TestDynamicClient(t *testing.T) {
 				StopCCNTimeout: 250 * time.Millisecond,
 			},
 		},
+		{
+			name: "L2TPv2 UDP AF_INET (negotiate version)",
+			localTunnelCfg: &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				VersionPolicy:  VersionPolicyPreferV2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+			peerTunnelCfg: &TunnelConfig{
+				Local:          "localhost:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+		},
 		{
 			name: "L2TPv2 UDP AF_INET (alloc TID, with session)",
 			localTunnelCfg: &TunnelConfig{
@@ -357,6 +394,680 @@ func TestDynamicClient(t *testing.T) {
 			if lns.tunnelEstablished != true {
 				t.Errorf("LNS didn't establish")
 			}
+
+			version, ok := ctx.PeerProtocolVersion(c.localTunnelCfg.Peer)
+			if !ok || version != c.peerTunnelCfg.Version {
+				t.Errorf("PeerProtocolVersion(%q): got %v %v, want %v",
+					c.localTunnelCfg.Peer, version, ok, c.peerTunnelCfg.Version)
+			}
+		})
+	}
+}
+
+type testTunnelStateRecorder struct {
+	testTunnelEventCounterCloser
+	lock   sync.Mutex
+	states []TunnelState
+}
+
+func (tsr *testTunnelStateRecorder) HandleEvent(event interface{}) {
+	tsr.testTunnelEventCounterCloser.HandleEvent(event)
+	if ev, ok := event.(*TunnelStateEvent); ok {
+		tsr.lock.Lock()
+		defer tsr.lock.Unlock()
+		if len(tsr.states) == 0 {
+			tsr.states = append(tsr.states, ev.From)
+		}
+		tsr.states = append(tsr.states, ev.To)
+	}
+}
+
+func TestDynamicClientStates(t *testing.T) {
+	cases := []struct {
+		name         string
+		lnsTunnelID  ControlConnID
+		expectStates []TunnelState
+		expectResult avpResultCode
+	}{
+		{
+			name:        "Established",
+			lnsTunnelID: 4567,
+			expectStates: []TunnelState{
+				TunnelStateIdle,
+				TunnelStateWaitCtlReply,
+				TunnelStateEstablished,
+				TunnelStateDead,
+			},
+			expectResult: avpStopCCNResultCodeClearConnection,
+		},
+		{
+			name:        "SCCRP not acceptable",
+			lnsTunnelID: 0,
+			expectStates: []TunnelState{
+				TunnelStateIdle,
+				TunnelStateWaitCtlReply,
+				TunnelStateDead,
+			},
+			expectResult: avpStopCCNResultCodeGeneralError,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lns, err := newTestLNS(logger, &TunnelConfig{
+				Local:          "localhost:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        ProtocolVersion2,
+				TunnelID:       c.lnsTunnelID,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+
+			var lnsWg sync.WaitGroup
+			lnsWg.Add(1)
+			go func() {
+				lns.run(3 * time.Second)
+				lnsWg.Done()
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			recorder := &testTunnelStateRecorder{}
+			ctx.RegisterEventHandler(recorder)
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "localhost:5000",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			_, err = ctx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+			}
+
+			lnsWg.Wait()
+			ctx.Close()
+			recorder.wait()
+
+			recorder.lock.Lock()
+			defer recorder.lock.Unlock()
+			if !reflect.DeepEqual(recorder.states, c.expectStates) {
+				t.Errorf("tunnel states: got %v, want %v", recorder.states, c.expectStates)
+			}
+			if lns.stopccnResult == nil {
+				t.Fatalf("LNS didn't receive StopCCN")
+			}
+			if lns.stopccnResult.result != c.expectResult {
+				t.Errorf("StopCCN result: got %v, want %v", lns.stopccnResult.result, c.expectResult)
+			}
+		})
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	low := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	high := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	cases := []struct {
+		name        string
+		local, peer []byte
+		want        tieBreakResult
+	}{
+		{name: "No tie breakers", want: tieBreakNone},
+		{name: "Local tie breaker only", local: high, want: tieBreakWon},
+		{name: "Peer tie breaker only", peer: low, want: tieBreakLost},
+		{name: "Local lower", local: low, peer: high, want: tieBreakWon},
+		{name: "Peer lower", local: high, peer: low, want: tieBreakLost},
+		{name: "Equal", local: low, peer: low, want: tieBreakDrawn},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := tieBreak(c.local, c.peer)
+			if got != c.want {
+				t.Errorf("tieBreak(%x, %x): got %v, want %v", c.local, c.peer, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDynamicClientEstablishFailed(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	events := newTestEventCollector()
+	ctx.RegisterEventHandler(events)
+
+	// Nothing is listening on the peer address
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "127.0.0.1:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		MaxRetries:     1,
+		RetryTimeout:   50 * time.Millisecond,
+	}
+	_, err = ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+
+	ev := events.next(t, &TunnelEstablishFailedEvent{}).(*TunnelEstablishFailedEvent)
+	if ev.TunnelName != "t1" {
+		t.Errorf("TunnelEstablishFailedEvent for %v, expected %v", ev.TunnelName, "t1")
+	}
+	if !strings.HasPrefix(ev.Result, "control connection failed") {
+		t.Errorf("TunnelEstablishFailedEvent: got result %q, want control connection failure", ev.Result)
+	}
+}
+
+type testCloseWithResultHandler struct {
+	testEventCounter
+	lock       sync.Mutex
+	events     []string
+	downResult string
+	wg         sync.WaitGroup
+}
+
+func (h *testCloseWithResultHandler) HandleEvent(event interface{}) {
+	h.lock.Lock()
+	h.testEventCounter.HandleEvent(event)
+	switch ev := event.(type) {
+	case *SessionUpEvent:
+		t := ev.Tunnel
+		h.wg.Add(1)
+		go func() {
+			t.CloseWithResult(StopCCNResultShuttingDown, ErrorCodeNoError, "maintenance")
+			h.wg.Done()
+		}()
+	case *SessionDownEvent:
+		h.events = append(h.events, "session down")
+	case *TunnelDownEvent:
+		h.events = append(h.events, "tunnel down")
+		h.downResult = ev.Result
+	}
+	h.lock.Unlock()
+}
+
+func TestDynamicClientCloseWithResult(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "localhost:5000",
+			Peer:           "127.0.0.1:6000",
+			Version:        ProtocolVersion2,
+			TunnelID:       4567,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			Pseudowire: PseudowireTypePPP,
+			SessionID:  5566,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	handler := &testCloseWithResultHandler{}
+	ctx.RegisterEventHandler(handler)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "localhost:5000",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	lnsWg.Wait()
+	ctx.Close()
+	handler.wg.Wait()
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	want := []string{"session down", "tunnel down"}
+	if !reflect.DeepEqual(handler.events, want) {
+		t.Errorf("events: got %v, want %v", handler.events, want)
+	}
+	if !strings.Contains(handler.downResult, "maintenance") {
+		t.Errorf("TunnelDownEvent result: got %q, want message %q", handler.downResult, "maintenance")
+	}
+	if lns.stopccnResult == nil {
+		t.Fatalf("LNS didn't receive StopCCN")
+	}
+	if lns.stopccnResult.result != avpStopCCNResultCodeChannelShuttingDown ||
+		lns.stopccnResult.errMsg != "maintenance" {
+		t.Errorf("StopCCN result: got %v, want %v %q",
+			lns.stopccnResult, avpStopCCNResultCodeChannelShuttingDown, "maintenance")
+	}
+}
+
+func TestDynamicClientSccrpTimeout(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	// The LNS acknowledges the SCCRQ but never replies to it
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:    "127.0.0.1:9034",
+			Peer:     "127.0.0.1:9035",
+			Version:  ProtocolVersion2,
+			TunnelID: 42,
+			Encap:    EncapTypeUDP,
+		}, nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.onSccrq = func() bool { return false }
+	lnsDone := make(chan bool)
+	go func() {
+		lns.run(3 * time.Second)
+		close(lnsDone)
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	events := newTestEventCollector()
+	ctx.RegisterEventHandler(events)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9035",
+		Peer:           "127.0.0.1:9034",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		SccrpTimeout:   100 * time.Millisecond,
+	}
+	_, err = ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+
+	ev := events.next(t, &TunnelEstablishFailedEvent{}).(*TunnelEstablishFailedEvent)
+	if !strings.Contains(ev.Result, "timed out waiting for SCCRP") {
+		t.Errorf("TunnelEstablishFailedEvent: got result %q, want SCCRP timeout", ev.Result)
+	}
+
+	<-lnsDone
+	if lns.stopccnResult == nil || lns.stopccnResult.result != avpStopCCNResultCodeGeneralError {
+		t.Errorf("StopCCN result: got %v, want %v", lns.stopccnResult, avpStopCCNResultCodeGeneralError)
+	}
+}
+
+func TestDynamicSessionReplyTimeout(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	// The LNS establishes the tunnel but never replies to an ICRQ
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "127.0.0.1:9036",
+			Peer:           "127.0.0.1:9037",
+			Version:        ProtocolVersion2,
+			TunnelID:       42,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			SessionID:  90,
+			Pseudowire: PseudowireTypePPP,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	icrqRx := make(chan bool)
+	lns.onIcrq = func() bool {
+		close(icrqRx)
+		return false
+	}
+	lnsDone := make(chan bool)
+	go func() {
+		lns.run(3 * time.Second)
+		close(lnsDone)
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	events := newTestEventCollector()
+	ctx.RegisterEventHandler(events)
+
+	cfg := &TunnelConfig{
+		Local:               "127.0.0.1:9037",
+		Peer:                "127.0.0.1:9036",
+		Version:             ProtocolVersion2,
+		Encap:               EncapTypeUDP,
+		StopCCNTimeout:      250 * time.Millisecond,
+		SessionReplyTimeout: 100 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+	_ = events.next(t, &TunnelUpEvent{})
+
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// The session closes once the timeout expires
+	select {
+	case <-icrqRx:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for ICRQ")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for tunl.Stats().Sessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("session not closed after reply timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx.Close()
+	<-lnsDone
+	if lns.cdnResult == nil || lns.cdnResult.result != avpCDNResultCodeTimeout {
+		t.Errorf("CDN result: got %v, want %v", lns.cdnResult, avpCDNResultCodeTimeout)
+	}
+}
+
+type testSessionStateRecorder struct {
+	lock   sync.Mutex
+	states []SessionState
+}
+
+func (ssr *testSessionStateRecorder) HandleEvent(event interface{}) {
+	if ev, ok := event.(*SessionStateEvent); ok {
+		ssr.lock.Lock()
+		defer ssr.lock.Unlock()
+		if len(ssr.states) == 0 {
+			ssr.states = append(ssr.states, ev.From)
+		}
+		ssr.states = append(ssr.states, ev.To)
+	}
+}
+
+func (ssr *testSessionStateRecorder) get() []SessionState {
+	ssr.lock.Lock()
+	defer ssr.lock.Unlock()
+	return append([]SessionState(nil), ssr.states...)
+}
+
+func TestDynamicSessionUnexpectedMsg(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	// The LNS answers the ICRQ with an ICCN rather than an ICRP
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "127.0.0.1:9044",
+			Peer:           "127.0.0.1:9045",
+			Version:        ProtocolVersion2,
+			TunnelID:       42,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			SessionID:  90,
+			Pseudowire: PseudowireTypePPP,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.onIcrq = func() bool {
+		msg, err := newV2Iccn(lns.tcfg.PeerTunnelID, lns.scfg)
+		if err != nil {
+			t.Errorf("failed to build ICCN: %v", err)
+		} else if err = lns.xport.send(msg); err != nil {
+			t.Errorf("failed to send ICCN: %v", err)
+		}
+		return false
+	}
+	lnsDone := make(chan bool)
+	go func() {
+		lns.run(3 * time.Second)
+		close(lnsDone)
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	events := newTestEventCollector()
+	ctx.RegisterEventHandler(events)
+	states := &testSessionStateRecorder{}
+	ctx.RegisterEventHandler(states)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9045",
+		Peer:           "127.0.0.1:9044",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", cfg, err)
+	}
+	_ = events.next(t, &TunnelUpEvent{})
+
+	doneChan := make(chan error, 1)
+	_, err = tunl.NewSessionAsync("s1", &SessionConfig{Pseudowire: PseudowireTypePPP},
+		func(err error) { doneChan <- err })
+	if err != nil {
+		t.Fatalf("NewSessionAsync(): %v", err)
+	}
+
+	select {
+	case err = <-doneChan:
+		if err == nil {
+			t.Errorf("session established despite unexpected ICCN")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for session to fail")
+	}
+
+	ctx.Close()
+	<-lnsDone
+	if lns.cdnResult == nil || lns.cdnResult.result != avpCDNResultCodeGeneralError {
+		t.Errorf("CDN result: got %v, want %v", lns.cdnResult, avpCDNResultCodeGeneralError)
+	}
+
+	expect := []SessionState{
+		SessionStateWaitTunnel,
+		SessionStateWaitReply,
+		SessionStateDead,
+	}
+	if got := states.get(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("session states: got %v, want %v", got, expect)
+	}
+}
+
+func TestDynamicClientAsync(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lns, err := newTestLNS(logger,
+		&TunnelConfig{
+			Local:          "127.0.0.1:9038",
+			Peer:           "127.0.0.1:9039",
+			Version:        ProtocolVersion2,
+			TunnelID:       42,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		},
+		&SessionConfig{
+			SessionID:  90,
+			Pseudowire: PseudowireTypePPP,
+		})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lnsDone := make(chan bool)
+	go func() {
+		lns.run(3 * time.Second)
+		close(lnsDone)
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	wait := func(what string, done chan error) error {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name    string
+		cfg     *TunnelConfig
+		wantErr bool
+	}{
+		{
+			name: "t1",
+			cfg: &TunnelConfig{
+				Local:          "127.0.0.1:9039",
+				Peer:           "127.0.0.1:9038",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			},
+		},
+		{
+			// Nothing is listening on the peer address
+			name: "t2",
+			cfg: &TunnelConfig{
+				Local:          "127.0.0.1:9040",
+				Peer:           "127.0.0.1:9041",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				MaxRetries:     1,
+				RetryTimeout:   50 * time.Millisecond,
+			},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		tunlDone := make(chan error, 1)
+		tunl, err := ctx.NewDynamicTunnelAsync(c.name, c.cfg, func(err error) { tunlDone <- err })
+		if err != nil {
+			t.Fatalf("NewDynamicTunnelAsync(%q, %v): %v", c.name, c.cfg, err)
+		}
+
+		// Session creation doesn't wait for the tunnel to come up
+		sessDone := make(chan error, 1)
+		sess, err := tunl.NewSessionAsync("s1",
+			&SessionConfig{Pseudowire: PseudowireTypePPP},
+			func(err error) { sessDone <- err })
+		if err != nil {
+			t.Fatalf("NewSessionAsync(): %v", err)
+		}
+
+		err = wait("tunnel", tunlDone)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: tunnel establish: got %v, want error %v", c.name, err, c.wantErr)
+		}
+		err = wait("session", sessDone)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%v: session establish: got %v, want error %v", c.name, err, c.wantErr)
+		}
+		wantState := SessionStateEstablished
+		if c.wantErr {
+			wantState = SessionStateDead
+		}
+		if got := sess.State(); got != wantState {
+			t.Errorf("%v: session state: got %v, want %v", c.name, got, wantState)
+		}
+	}
+
+	ctx.Close()
+	<-lnsDone
+	if !lns.sessionEstablished {
+		t.Errorf("LNS session not established")
+	}
+}
+
+func TestVersionFallback(t *testing.T) {
+	cfg := &TunnelConfig{
+		Version:      ProtocolVersion2,
+		TunnelID:     4567,
+		PeerTunnelID: 7654,
+	}
+	cases := []struct {
+		name     string
+		result   avpResultCode
+		fallback []ProtocolVersion
+		want     bool
+	}{
+		{
+			name:     "version unsupported",
+			result:   avpStopCCNResultCodeChannelProtocolVersionUnsupported,
+			fallback: []ProtocolVersion{ProtocolVersion2},
+			want:     true,
+		},
+		{
+			name:   "version unsupported, no fallback",
+			result: avpStopCCNResultCodeChannelProtocolVersionUnsupported,
+		},
+		{
+			name:     "general error",
+			result:   avpStopCCNResultCodeGeneralError,
+			fallback: []ProtocolVersion{ProtocolVersion2},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := newV2Stopccn(&resultCode{result: c.result}, cfg)
+			if err != nil {
+				t.Fatalf("newV2Stopccn(): %v", err)
+			}
+			dt := &dynamicTunnel{fallbackVersions: c.fallback}
+			if got := dt.isVersionFallback(msg); got != c.want {
+				t.Errorf("isVersionFallback(): got %v, want %v", got, c.want)
+			}
 		})
 	}
 }
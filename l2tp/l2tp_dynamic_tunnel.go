@@ -1,6 +1,11 @@
 package l2tp
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -15,11 +20,6 @@ type sendMsg struct {
 	completeChan chan error
 }
 
-type eventArgs struct {
-	event string
-	args  []interface{}
-}
-
 type dynamicTunnel struct {
 	*baseTunnel
 	isClosing   bool
@@ -30,13 +30,98 @@ type dynamicTunnel struct {
 	dp          TunnelDataPlane
 	closeChan   chan bool
 	sendChan    chan *sendMsg
-	eventChan   chan *eventArgs
 	wg          sync.WaitGroup
 	sessionTxWg sync.WaitGroup
 	fsm         fsm
+	// Protocol versions to fall back to if the peer doesn't support
+	// the version currently being attempted.
+	fallbackVersions []ProtocolVersion
+	// For tunnels accepted by a listener, the name of the listener
+	// and the SCCRQ it received from the peer.  If the listener deferred
+	// creating the tunnel until the peer's SCCCN, it has sent the SCCRP
+	// on the tunnel's behalf and passes on the SCCCN too.
+	listenerName string
+	sccrq        *rawMsg
+	scccn        *rawMsg
+	sccrpSent    bool
+	// The result to send to the peer when the tunnel is closed by
+	// the application.  If nil the tunnel is discarded without
+	// informing the peer.
+	closeResult *resultCode
+	closeOnce   sync.Once
+	// The Tie Breaker value sent in our SCCRQ, used to resolve a
+	// collision with a tunnel the peer is concurrently opening to us.
+	// Cleared once the peer has replied to the SCCRQ.
+	tieBreaker []byte
+	tieLock    sync.Mutex
+	// The Challenge sent to the peer if we have a secret, used to
+	// authenticate the peer's Challenge Response.
+	challenge []byte
+	// For L2TPv2, the secret used to respond to the peer's Challenge.
+	// This is the configured Secret unless the peer's Challenge Response
+	// showed it to be using the AlternateSecret.
+	secret string
+	// For L2TPv3, authenticates the control messages exchanged with
+	// the peer if we have a secret.
+	auth *v3Auth
+	// Why the tunnel closed, reported to the application
+	result string
+	// Control protocol counters, accumulated across each transport
+	// the tunnel creates.
+	stats transportStats
+	// Bounds the time spent waiting for the peer to complete the
+	// control connection handshake, if configured.
+	stateTimer *time.Timer
+	// Called once the tunnel is established or fails to establish,
+	// if the application asked to be informed.
+	done EstablishCallback
+	// Sessions created by the application which the tunnel goroutine
+	// has yet to handle.  Queueing sessions rather than passing them to
+	// the tunnel goroutine directly means session creation doesn't block
+	// while the tunnel goroutine is busy, e.g. waiting for the peer to
+	// acknowledge a message.
+	newSessions     []*dynamicSession
+	newSessionsLock sync.Mutex
+	newSessionChan  chan bool
+	noNewSessions   bool
+	// The Host Name advertised by the peer in its SCCRQ or SCCRP
+	peerHostName string
+	// For L2TPv3, the pseudowire types advertised by the peer in its
+	// SCCRQ or SCCRP
+	peerPwCaps []uint16
+	// The path MTU to the peer, sampled periodically once the tunnel is
+	// established, from which the MTU of sessions is derived.
+	pathMTU      int
+	pathMTULock  sync.Mutex
+	pathMTUTimer *time.Timer
+}
+
+// tieBreakResult is the outcome of comparing Tie Breaker values for
+// colliding SCCRQ messages.
+type tieBreakResult int
+
+const (
+	// Neither SCCRQ has a Tie Breaker, so both tunnels are retained
+	tieBreakNone tieBreakResult = iota
+	// Our tunnel is retained and the peer's discarded
+	tieBreakWon
+	// The peer's tunnel is retained and ours discarded
+	tieBreakLost
+	// The Tie Breaker values are equal, so both tunnels are discarded
+	tieBreakDrawn
+)
+
+// dynamicTunnelSupportsVersion returns true if dynamic tunnels can run
+// the control protocol for the specified protocol version.
+func dynamicTunnelSupportsVersion(version ProtocolVersion) bool {
+	return version == ProtocolVersion2 || version == ProtocolVersion3
 }
 
 func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
+	return dt.NewSessionAsync(name, cfg, nil)
+}
+
+func (dt *dynamicTunnel) NewSessionAsync(name string, cfg *SessionConfig, done EstablishCallback) (sess Session, err error) {
 
 	// Must have configuration
 	if cfg == nil {
@@ -51,6 +136,49 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
 
+	if err = checkSessionConfig(dt.cfg.Version, dt.getDP(), &myCfg); err != nil {
+		return nil, err
+	}
+
+	if err = validateExtraAVPs(myCfg.ExtraAVPs, MessageTypeICRQ, MessageTypeICCN); err != nil {
+		return nil, err
+	}
+
+	// Default persistent session backoff if unset
+	if myCfg.PersistBackoff < 0 {
+		return nil, fmt.Errorf("persist backoff may not be negative")
+	} else if myCfg.PersistBackoff == 0 {
+		myCfg.PersistBackoff = 1000 * time.Millisecond
+	}
+
+	if myCfg.OnDemand && myCfg.Persist {
+		return nil, fmt.Errorf("on-demand sessions may not be persistent")
+	}
+	if myCfg.Static {
+		if myCfg.SessionID == 0 || myCfg.PeerSessionID == 0 {
+			return nil, fmt.Errorf("static sessions must have a non-zero session ID and peer session ID")
+		}
+		if myCfg.Persist || myCfg.OnDemand {
+			return nil, fmt.Errorf("static sessions may not be persistent or on-demand")
+		}
+	}
+	if myCfg.IdleTimeout < 0 {
+		return nil, fmt.Errorf("idle timeout may not be negative")
+	} else if myCfg.IdleTimeout > 0 && !myCfg.OnDemand {
+		return nil, fmt.Errorf("idle timeout applies to on-demand sessions only")
+	}
+
+	// Must not exceed the session limit.  The reservation is released
+	// once the tunnel goroutine links the session into the tunnel.
+	if err = dt.reserveSession(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			dt.unreserveSession()
+		}
+	}()
+
 	// If the session ID in the config is unset, we must generate one.
 	// If the session ID is set, we must check for collisions.
 	// TODO: there is a potential race here if sessions are concurrently
@@ -66,23 +194,89 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 		if err != nil {
 			return nil, fmt.Errorf("failed to allocate a SID: %q", err)
 		}
+		defer func() {
+			if err != nil {
+				dt.releaseSid(myCfg.SessionID)
+			}
+		}()
 	}
 
-	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
+	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg, done)
 	if err != nil {
 		return nil, err
 	}
 
-	dt.injectEvent("newsession", s)
+	err = dt.queueSession(s)
+	if err != nil {
+		s.done = nil
+		s.kill()
+		return nil, err
+	}
 	sess = s
 
 	return
 }
 
+// queueSession passes a new session to the tunnel goroutine.
+func (dt *dynamicTunnel) queueSession(ds *dynamicSession) error {
+	dt.newSessionsLock.Lock()
+	if dt.noNewSessions {
+		dt.newSessionsLock.Unlock()
+		return fmt.Errorf("tunnel is closed")
+	}
+	dt.newSessions = append(dt.newSessions, ds)
+	dt.newSessionsLock.Unlock()
+
+	select {
+	case dt.newSessionChan <- true:
+	default:
+	}
+	return nil
+}
+
+// dequeueSessions returns the sessions queued by queueSession.  If
+// closing is set further sessions are refused.
+func (dt *dynamicTunnel) dequeueSessions(closing bool) []*dynamicSession {
+	dt.newSessionsLock.Lock()
+	defer dt.newSessionsLock.Unlock()
+	sessions := dt.newSessions
+	dt.newSessions = nil
+	if closing {
+		dt.noNewSessions = true
+	}
+	return sessions
+}
+
 func (dt *dynamicTunnel) Close() {
+	dt.CloseWithResult(StopCCNResultClearConnection, ErrorCodeNoError, "")
+}
+
+func (dt *dynamicTunnel) Stats() TunnelStats {
+	ts := dt.baseStats()
+	dt.stats.fill(&ts)
+	return ts
+}
+
+func (dt *dynamicTunnel) CloseWithResult(result ResultCode, errCode ErrorCode, message string) {
+	dt.closeWith(&resultCode{
+		result:  avpResultCode(result),
+		errCode: avpErrorCode(errCode),
+		errMsg:  message,
+	})
+}
+
+// discard closes the tunnel without sending a StopCCN to the peer.
+func (dt *dynamicTunnel) discard() {
+	dt.closeWith(nil)
+}
+
+func (dt *dynamicTunnel) closeWith(rc *resultCode) {
 	if dt != nil {
-		dt.parent.unlinkTunnel(dt)
-		close(dt.closeChan)
+		dt.closeOnce.Do(func() {
+			dt.closeResult = rc
+			dt.parent.unlinkTunnel(dt)
+			close(dt.closeChan)
+		})
 		dt.wg.Wait()
 	}
 }
@@ -133,15 +327,32 @@ func (dt *dynamicTunnel) runTunnel() {
 		"version", dt.cfg.Version,
 		"encap", dt.cfg.Encap,
 		"local", dt.cfg.Local,
-		"peer", dt.cfg.Peer,
-		"tunnel_id", dt.cfg.TunnelID,
 		"peer_tunnel_id", dt.cfg.PeerTunnelID)
 
+	if dt.listenerName != "" {
+		dt.parent.handleUserEvent(&TunnelAcceptEvent{
+			ListenerName: dt.listenerName,
+			TunnelName:   dt.getName(),
+			Tunnel:       dt,
+			Config:       dt.cfg,
+			LocalAddress: dt.sal,
+			PeerAddress:  dt.sap,
+			PeerHostName: dt.peerHostName,
+		})
+	}
+
 	dt.handleEvent("open")
 	for {
 		select {
 		case <-dt.closeChan:
-			dt.handleEvent("close", avpStopCCNResultCodeClearConnection)
+			rc := dt.closeResult
+			if rc == nil {
+				dt.setResult("discarded following collision with a tunnel opened by the peer")
+				dt.fsmActClose(nil)
+				return
+			}
+			dt.setResult(stopccnResultCodeToString(rc))
+			dt.handleEvent("close", rc.result, rc.errCode, rc.errMsg)
 			return
 		case m, ok := <-dt.xport.recvChan:
 			if !ok {
@@ -149,12 +360,14 @@ func (dt *dynamicTunnel) runTunnel() {
 				return
 			}
 			dt.handleMsg(m)
-		case ea, ok := <-dt.eventChan:
-			if !ok {
-				dt.fsmActClose(nil)
-				return
+		case <-dt.stateTimeout():
+			dt.onStateTimeout()
+		case <-dt.pathMTUTimeout():
+			dt.samplePathMTU()
+		case <-dt.newSessionChan:
+			for _, ds := range dt.dequeueSessions(false) {
+				dt.handleEvent("newsession", ds)
 			}
-			dt.handleEvent(ea.event, ea.args...)
 		case sm, ok := <-dt.sendChan:
 			if !ok {
 				dt.fsmActClose(nil)
@@ -186,26 +399,18 @@ func (dt *dynamicTunnel) handleEvent(ev string, args ...interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) injectEvent(ev string, args ...interface{}) {
-	ea := eventArgs{event: ev}
-	for i := 0; i < len(args); i++ {
-		ea.args = append(ea.args, args[i])
-	}
-	dt.eventChan <- &ea
-}
-
 // panics if expected arguments are not passed
-func fsmArgsToV2MsgFrom(args []interface{}) (msg *v2ControlMessage, from unix.Sockaddr) {
+func fsmArgsToMsgFrom(args []interface{}) (msg controlMessage, from unix.Sockaddr) {
 	if len(args) != 2 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 2, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	from, ok = args[1].(unix.Sockaddr)
 	if !ok {
-		panic(fmt.Sprintf("second argument %T not unix.Sockaddr", args[0]))
+		panic(fmt.Sprintf("second argument %T not unix.Sockaddr", args[1]))
 	}
 	return
 }
@@ -243,8 +448,47 @@ func fsmArgsToStopccnResult(args []interface{}) *resultCode {
 	return &rc
 }
 
+func stopccnResultCodeToString(rc *resultCode) string {
+	var resStr string
+
+	switch rc.result {
+	case avpStopCCNResultCodeReserved:
+		resStr = "reserved"
+	case avpStopCCNResultCodeClearConnection:
+		resStr = "general request to clear control connection"
+	case avpStopCCNResultCodeGeneralError:
+		resStr = "general error"
+	case avpStopCCNResultCodeChannelExists:
+		resStr = "control channel already exists"
+	case avpStopCCNResultCodeChannelNotAuthorized:
+		resStr = "requester is not authorized to establish a control channel"
+	case avpStopCCNResultCodeChannelProtocolVersionUnsupported:
+		resStr = "protocol version not supported"
+	case avpStopCCNResultCodeChannelShuttingDown:
+		resStr = "requester is being shut down"
+	case avpStopCCNResultCodeChannelFSMError:
+		resStr = "finite state machine error"
+	}
+
+	return formatResultCode(rc, resStr)
+}
+
+// setResult records why the tunnel is closing, unless already known.
+func (dt *dynamicTunnel) setResult(result string) {
+	if dt.result == "" {
+		dt.result = result
+	}
+}
+
 func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 
+	// A peer which doesn't support the protocol version we're attempting
+	// may reject our SCCRQ using a StopCCN of a different version
+	if dt.isVersionFallback(m.msg) {
+		dt.handleEvent("fallback", m.msg, m.from)
+		return
+	}
+
 	// Initial validation: ignore a message with the wrong protocol version
 	if m.msg.protocolVersion() != dt.cfg.Version {
 		level.Error(dt.logger).Log(
@@ -266,7 +510,17 @@ func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 			dt.fsmActClose(nil)
 			return
 		}
-		dt.handleV2Msg(msg, m.from)
+		dt.handleCtlMsg(msg, m.from)
+		return
+	case ProtocolVersion3:
+		msg, ok := m.msg.(*v3ControlMessage)
+		if !ok {
+			level.Error(dt.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			dt.fsmActClose(nil)
+			return
+		}
+		dt.handleCtlMsg(msg, m.from)
 		return
 	}
 
@@ -280,16 +534,18 @@ func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 		fmt.Sprintf("unhandled protocol version %v", m.msg.protocolVersion()))
 }
 
-func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) {
+func (dt *dynamicTunnel) handleCtlMsg(msg controlMessage, from unix.Sockaddr) {
 
 	// It's possible to have a message mis-delivered on our control
 	// socket.  Ignore these messages: ideally we'd redirect them
 	// but dropping them is a good compromise for now.
-	if msg.Tid() != uint16(dt.cfg.TunnelID) {
+	// An SCCRQ is sent before the peer knows our TID.
+	tid := tunnelMsgTid(msg)
+	if tid != dt.cfg.TunnelID && !(tid == 0 && msg.getType() == avpMsgTypeSccrq) {
 		level.Error(dt.logger).Log(
 			"message", "received control message with the wrong TID",
 			"expected", dt.cfg.TunnelID,
-			"got", msg.Tid())
+			"got", tid)
 		return
 	}
 
@@ -305,6 +561,25 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 			avpStopCCNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	// An SCCRQ, SCCRP or SCCCN may be well-formed, but still not
+	// acceptable to us
+	badSccEvents := map[avpMsgType]string{
+		avpMsgTypeSccrq: "badsccrq",
+		avpMsgTypeSccrp: "badsccrp",
+		avpMsgTypeScccn: "badscccn",
+	}
+	if event, ok := badSccEvents[msg.getType()]; ok {
+		if rc := dt.checkSccMsg(msg); rc != nil {
+			level.Error(dt.logger).Log(
+				"message", "control message not acceptable",
+				"message_type", msg.getType(),
+				"error", rc.errMsg)
+			dt.handleEvent(event, msg, from, rc)
+			return
+		}
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -332,13 +607,292 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 	}
 
 	level.Error(dt.logger).Log(
-		"message", "unhandled v2 control message",
+		"message", "unhandled control message",
+		"version", msg.protocolVersion(),
 		"message_type", msg.getType())
 
 	dt.handleEvent("close",
 		avpStopCCNResultCodeGeneralError,
 		avpErrorCodeBadValue,
-		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
+		fmt.Sprintf("unhandled v%v control message %v", msg.protocolVersion(), msg.getType()))
+}
+
+// isVersionFallback returns true if the message is a StopCCN indicating
+// that the peer doesn't support our protocol version, and we have another
+// version to try.
+func (dt *dynamicTunnel) isVersionFallback(msg controlMessage) bool {
+	if len(dt.fallbackVersions) == 0 || msg.getType() != avpMsgTypeStopccn {
+		return false
+	}
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err != nil {
+		return false
+	}
+	return rc.result == avpStopCCNResultCodeChannelProtocolVersionUnsupported
+}
+
+func (dt *dynamicTunnel) fsmActFallback(args []interface{}) {
+	version := dt.fallbackVersions[0]
+	dt.fallbackVersions = dt.fallbackVersions[1:]
+
+	level.Info(dt.logger).Log(
+		"message", "peer doesn't support protocol version, falling back",
+		"version", dt.cfg.Version,
+		"fallback_version", version)
+
+	// The peer has closed the control connection, so restart it
+	// from scratch using the new protocol version.
+	dt.setTransport(nil)
+	dt.xport.close()
+	dt.xport = nil
+	dt.cp = nil
+
+	dt.cfg.Version = version
+	dt.cfg.PeerTunnelID = 0
+	dt.parent.setTunnelPeer(dt, nil, 0)
+
+	// The peer gets the full timeout to reply to the new SCCRQ
+	dt.startStateTimer(dt.fsm.current)
+
+	err := dt.openControlConnection()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to reopen control connection",
+			"error", err)
+		dt.fsmActClose(nil)
+		return
+	}
+
+	dt.fsmActSendSccrq(args)
+}
+
+// checkSccMsg determines whether an SCCRQ, SCCRP or SCCCN is acceptable,
+// returning the result code to send to the peer in the StopCCN if it is not.
+func (dt *dynamicTunnel) checkSccMsg(msg controlMessage) *resultCode {
+	// A listener only accepts an SCCRQ from an unauthorized peer if the
+	// tunnel is to reject it
+	if msg.getType() == avpMsgTypeSccrq && dt.listenerName != "" {
+		if rc := dt.checkPeerAuthorized(); rc != nil {
+			return rc
+		}
+	}
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return dt.checkV2SccMsg(m)
+	case *v3ControlMessage:
+		return dt.checkV3SccMsg(m)
+	}
+	return nil
+}
+
+// checkPeerAuthorized checks the peer of a tunnel accepted by a listener
+// against the listener's AllowedPeers and AllowedPeerHostNames, returning
+// the result code to send to the peer in the StopCCN if it isn't allowed.
+func (dt *dynamicTunnel) checkPeerAuthorized() *resultCode {
+	acl, err := newPeerACL(dt.cfg)
+	if err == nil {
+		err = acl.check(dt.sap, dt.peerHostName)
+	}
+	if err != nil {
+		return &resultCode{
+			result:  avpStopCCNResultCodeChannelNotAuthorized,
+			errCode: avpErrorCodeNoError,
+			errMsg:  err.Error(),
+		}
+	}
+	return nil
+}
+
+// checkV3SccMsg determines whether an L2TPv3 SCCRQ, SCCRP or SCCCN is
+// acceptable, returning the result code to send to the peer in the
+// StopCCN if it is not.
+func (dt *dynamicTunnel) checkV3SccMsg(msg *v3ControlMessage) *resultCode {
+	// If we have a secret the transport has already authenticated the
+	// message, but a peer may authenticate its messages when we don't.
+	if dt.auth == nil {
+		if _, err := findAvp(msg.getAvps(), vendorIDIetf, avpTypeMessageDigest); err == nil {
+			return &resultCode{
+				result:  avpStopCCNResultCodeChannelNotAuthorized,
+				errCode: avpErrorCodeNoError,
+				errMsg:  "peer authenticated its message but no secret is configured",
+			}
+		}
+	}
+	if msg.getType() == avpMsgTypeScccn {
+		return nil
+	}
+	pccid, err := tunnelMsgPeerTid(msg)
+	if err != nil || pccid == 0 {
+		return &resultCode{
+			result:  avpStopCCNResultCodeGeneralError,
+			errCode: avpErrorCodeBadValue,
+			errMsg:  "invalid assigned control connection ID",
+		}
+	}
+	return nil
+}
+
+// checkV2SccMsg determines whether an SCCRQ, SCCRP or SCCCN is acceptable,
+// returning the result code to send to the peer in the StopCCN if it is not.
+func (dt *dynamicTunnel) checkV2SccMsg(msg *v2ControlMessage) *resultCode {
+	if msg.getType() == avpMsgTypeScccn {
+		return dt.checkV2Auth(msg)
+	}
+	version, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeProtocolVersion)
+	if err != nil || !bytes.Equal(version, []byte{1, 0}) {
+		return &resultCode{
+			result:  avpStopCCNResultCodeChannelProtocolVersionUnsupported,
+			errCode: avpErrorCode(ProtocolVersion2),
+			errMsg:  fmt.Sprintf("unsupported protocol version %x", version),
+		}
+	}
+	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	if err != nil || ptid == 0 {
+		return &resultCode{
+			result:  avpStopCCNResultCodeGeneralError,
+			errCode: avpErrorCodeBadValue,
+			errMsg:  "invalid assigned tunnel ID",
+		}
+	}
+	return dt.checkV2Auth(msg)
+}
+
+// checkV2Auth authenticates the peer using the challenge handshake,
+// returning the result code to send to the peer in the StopCCN if
+// authentication fails.
+// Ref: RFC2661 section 5.1.1.
+func (dt *dynamicTunnel) checkV2Auth(msg *v2ControlMessage) *resultCode {
+	notAuthorized := func(reason string) *resultCode {
+		return &resultCode{
+			result:  avpStopCCNResultCodeChannelNotAuthorized,
+			errCode: avpErrorCodeNoError,
+			errMsg:  reason,
+		}
+	}
+
+	// The peer may challenge us in an SCCRQ or SCCRP
+	_, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallenge)
+	if err == nil && dt.cfg.Secret == "" {
+		return notAuthorized("peer sent a challenge but no secret is configured")
+	}
+
+	// The peer responds to our challenge in an SCCRP or SCCCN
+	if dt.challenge != nil && msg.getType() != avpMsgTypeSccrq {
+		rsp, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallengeResponse)
+		if err != nil {
+			return notAuthorized("peer didn't respond to our challenge")
+		}
+		var ok bool
+		for _, secret := range tunnelSecrets(dt.cfg) {
+			want := challengeResponse(msg.getType(), secret, dt.challenge)
+			if subtle.ConstantTimeCompare(rsp, want) == 1 {
+				dt.secret = secret
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return notAuthorized("incorrect challenge response")
+		}
+
+		// The challenge is answered only once
+		zeroize(dt.challenge)
+		dt.challenge = nil
+	}
+	return nil
+}
+
+// transportAuth returns the authentication for the transport to apply to
+// control messages, which is nil unless the tunnel runs L2TPv3 and has
+// a secret.
+func (dt *dynamicTunnel) transportAuth() *v3Auth {
+	if dt.cfg.Version != ProtocolVersion3 {
+		return nil
+	}
+	return dt.auth
+}
+
+// authNonce returns the Control Message Authentication Nonce to send in
+// an L2TPv3 SCCRQ or SCCRP, or nil if we don't authenticate messages.
+func (dt *dynamicTunnel) authNonce() []byte {
+	if dt.auth == nil {
+		return nil
+	}
+	return dt.auth.localNonce
+}
+
+// peerChallengeResponse returns the Challenge Response to send in a
+// message of the specified type, if the peer's message included a Challenge.
+func (dt *dynamicTunnel) peerChallengeResponse(msg *v2ControlMessage, rspType avpMsgType) []byte {
+	challenge, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallenge)
+	if err != nil {
+		return nil
+	}
+	return challengeResponse(rspType, dt.secret, challenge)
+}
+
+// onStateChange is called by the fsm when the tunnel changes state.
+func (dt *dynamicTunnel) onStateChange(from, to string) {
+	level.Debug(dt.logger).Log(
+		"message", "state change",
+		"from", from,
+		"to", to)
+	dt.setState(TunnelState(to))
+	dt.startStateTimer(to)
+	dt.parent.handleUserEvent(&TunnelStateEvent{
+		TunnelName: dt.getName(),
+		Tunnel:     dt,
+		From:       TunnelState(from),
+		To:         TunnelState(to),
+	})
+}
+
+// startStateTimer starts the timer bounding the time the tunnel may
+// spend in the specified state, stopping any timer already running.
+// No timer is started for states without a configured timeout.
+func (dt *dynamicTunnel) startStateTimer(state string) {
+	if dt.stateTimer != nil {
+		dt.stateTimer.Stop()
+		dt.stateTimer = nil
+	}
+
+	var timeout time.Duration
+	switch state {
+	case "waitctlreply":
+		timeout = dt.cfg.SccrpTimeout
+	case "waitctlconn":
+		timeout = dt.cfg.ScccnTimeout
+	}
+	if timeout > 0 {
+		dt.stateTimer = time.NewTimer(timeout)
+	}
+}
+
+// stateTimeout returns the channel the state timer fires on, or nil
+// if the timer isn't running.
+func (dt *dynamicTunnel) stateTimeout() <-chan time.Time {
+	if dt.stateTimer == nil {
+		return nil
+	}
+	return dt.stateTimer.C
+}
+
+func (dt *dynamicTunnel) onStateTimeout() {
+	dt.stateTimer = nil
+
+	var errMsg string
+	switch dt.fsm.current {
+	case "waitctlreply":
+		errMsg = "timed out waiting for SCCRP"
+	case "waitctlconn":
+		errMsg = "timed out waiting for SCCCN"
+	}
+
+	level.Error(dt.logger).Log(
+		"message", errMsg,
+		"state", dt.fsm.current)
+
+	dt.handleEvent("timeout", avpStopCCNResultCodeGeneralError, avpErrorCodeNoError, errMsg)
 }
 
 func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
@@ -351,8 +905,13 @@ func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) sendSccrq() error {
-	msg, err := newV2Sccrq(dt.cfg)
+func (dt *dynamicTunnel) sendSccrq() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Sccrq(dt.cfg, dt.tieBreaker, dt.authNonce())
+	} else {
+		msg, err = newV2Sccrq(dt.cfg, dt.tieBreaker, dt.challenge)
+	}
 	if err != nil {
 		return err
 	}
@@ -361,9 +920,13 @@ func (dt *dynamicTunnel) sendSccrq() error {
 
 func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
-	msg, from := fsmArgsToV2MsgFrom(args)
+	msg, from := fsmArgsToMsgFrom(args)
 
-	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	// The peer has accepted our tunnel, so it can no longer collide
+	// with a tunnel the peer opens to us
+	dt.setTieBreaker(nil)
+
+	ptid, err := tunnelMsgPeerTid(msg)
 	if err != nil {
 		// Shouldn't occur since tunnel ID is mandatory
 		level.Error(dt.logger).Log(
@@ -373,13 +936,21 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.peerHostName, _ = findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeHostName)
+	dt.peerPwCaps, _ = findUint16ArrayAvp(msg.getAvps(), vendorIDIetf, avpTypePseudowireCaps)
+	level.Info(dt.logger).Log(
+		"message", "peer replied to SCCRQ",
+		"peer_tunnel_id", ptid,
+		"peer_host_name", dt.peerHostName)
+
 	// Reconfigure transport and socket now we know the peer TID
 	// and the address being used for this tunnel
-	dt.xport.config.PeerControlConnID = ControlConnID(ptid)
-	dt.cfg.PeerTunnelID = ControlConnID(ptid)
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfg.PeerTunnelID = ptid
 	dt.cp.connectTo(from)
+	dt.parent.setTunnelPeer(dt, from, ptid)
 
-	err = dt.sendScccn()
+	err = dt.sendScccn(msg)
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to send SCCCN",
@@ -388,10 +959,135 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	// Record the working protocol version for future negotiation
+	dt.fallbackVersions = nil
+	dt.parent.recordPeerVersion(dt.cfg.Peer, dt.cfg.Version)
+
+	dt.establish()
+}
+
+func (dt *dynamicTunnel) setTieBreaker(tb []byte) {
+	dt.tieLock.Lock()
+	defer dt.tieLock.Unlock()
+	dt.tieBreaker = tb
+}
+
+// resolveCollision compares the Tie Breaker from an SCCRQ sent by the peer
+// with our own.  It returns tieBreakNone unless we are still waiting for the
+// peer to reply to our SCCRQ.
+func (dt *dynamicTunnel) resolveCollision(peerTieBreaker []byte) tieBreakResult {
+	dt.tieLock.Lock()
+	defer dt.tieLock.Unlock()
+	if dt.tieBreaker == nil {
+		return tieBreakNone
+	}
+	return tieBreak(dt.tieBreaker, peerTieBreaker)
+}
+
+// tieBreak resolves colliding SCCRQ messages using their Tie Breaker
+// values, which are nil if the AVP was not present.  The lower value wins.
+// If only one SCCRQ has a Tie Breaker, that SCCRQ wins.
+// Ref: RFC2661 section 4.4.3.
+func tieBreak(local, peer []byte) tieBreakResult {
+	switch {
+	case local == nil && peer == nil:
+		return tieBreakNone
+	case peer == nil:
+		return tieBreakWon
+	case local == nil:
+		return tieBreakLost
+	}
+	switch bytes.Compare(local, peer) {
+	case -1:
+		return tieBreakWon
+	case 1:
+		return tieBreakLost
+	}
+	return tieBreakDrawn
+}
+
+func newTieBreaker() ([]byte, error) {
+	tb := make([]byte, 8)
+	_, err := rand.Read(tb)
+	if err != nil {
+		return nil, err
+	}
+	return tb, nil
+}
+
+// sendScccn sends an SCCCN in reply to the peer's SCCRP.
+func (dt *dynamicTunnel) sendScccn(sccrp controlMessage) (err error) {
+	var msg controlMessage
+	switch m := sccrp.(type) {
+	case *v2ControlMessage:
+		msg, err = newV2Scccn(dt.cfg, dt.peerChallengeResponse(m, avpMsgTypeScccn))
+	case *v3ControlMessage:
+		msg, err = newV3Scccn(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	return dt.xport.send(msg)
+}
+
+// Handles the SCCRQ received by the listener which accepted the tunnel.
+// The listener has already configured the tunnel using the peer's
+// tunnel ID and address.
+func (dt *dynamicTunnel) fsmActOnSccrq(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+
+	if v3msg, ok := msg.(*v3ControlMessage); ok {
+		dt.peerPwCaps, _ = findUint16ArrayAvp(v3msg.getAvps(), vendorIDIetf, avpTypePseudowireCaps)
+		if dt.sccrpSent {
+			return
+		}
+		dt.replyToSccrq(newV3Sccrp(dt.cfg, dt.authNonce()))
+		return
+	}
+
+	if dt.cfg.Secret != "" {
+		var err error
+		dt.challenge, err = newChallenge(dt.cfg.ChallengeLength)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "failed to generate challenge",
+				"error", err)
+			dt.fsmActClose(nil)
+			return
+		}
+	}
+
+	v2msg := msg.(*v2ControlMessage)
+	dt.replyToSccrq(newV2Sccrp(dt.cfg, dt.challenge, dt.peerChallengeResponse(v2msg, avpMsgTypeSccrp)))
+}
+
+// replyToSccrq sends the SCCRP built in reply to the peer's SCCRQ,
+// closing the tunnel if the SCCRP couldn't be built or sent.
+func (dt *dynamicTunnel) replyToSccrq(msg controlMessage, err error) {
+	if err == nil {
+		err = dt.xport.send(msg)
+	}
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to send SCCRP message",
+			"error", err)
+		dt.fsmActClose(nil)
+	}
+}
+
+func (dt *dynamicTunnel) fsmActOnScccn(args []interface{}) {
+	dt.establish()
+}
+
+// establish brings up the data plane and the tunnel's sessions once
+// the control connection is established.
+func (dt *dynamicTunnel) establish() {
+	var err error
+
 	level.Info(dt.logger).Log("message", "control plane established")
 
 	// establish the data plane
-	dt.dp, err = dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
+	dt.dp, err = dt.cp.dataPlane(dt.parent.dp).NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to establish data plane",
@@ -403,8 +1099,15 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.setDataPlane(dt.dp)
+	if r, ok := dt.dp.(dataFrameReceiver); ok {
+		dt.cp.setDataHandler(r.receiveDataFrame)
+	}
+
 	level.Info(dt.logger).Log("message", "data plane established")
 
+	dt.samplePathMTU()
+
 	// inform sessions that we're up
 	for _, s := range dt.allSessions() {
 		if ds, ok := s.(*dynamicSession); ok {
@@ -419,31 +1122,221 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		Config:       dt.cfg,
 		LocalAddress: dt.sal,
 		PeerAddress:  dt.sap,
+		PeerHostName: dt.peerHostName,
 	})
+	dt.establishDone(nil)
 }
 
-func (dt *dynamicTunnel) sendScccn() error {
-	msg, err := newV2Scccn(dt.cfg)
-	if err != nil {
-		return err
+// establishDone informs the application of the outcome of establishing
+// the tunnel, if it asked to be informed.
+func (dt *dynamicTunnel) establishDone(err error) {
+	if dt.done != nil {
+		done := dt.done
+		dt.done = nil
+		done(err)
 	}
-	return dt.xport.send(msg)
 }
 
-func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
+// establishError describes why a tunnel or session failed to establish,
+// given the result reported to the application.
+func establishError(result string) error {
+	if result == "" {
+		return errors.New("closed before being established")
+	}
+	return errors.New(result)
+}
+
+func (dt *dynamicTunnel) fsmActOnBadSccMsg(args []interface{}) {
+	if len(args) != 3 {
+		panic(fmt.Sprintf("unexpected argument count (wanted 3, got %v)", len(args)))
+	}
+	rc, ok := args[2].(*resultCode)
+	if !ok {
+		panic(fmt.Sprintf("third argument %T not *resultCode", args[2]))
+	}
+	dt.setResult(stopccnResultCodeToString(rc))
+
+	// Address the StopCCN to the peer's tunnel if the SCCRP told us its ID
+	msg, from := fsmArgsToMsgFrom(args[:2])
+	if msg.getType() == avpMsgTypeSccrp {
+		ptid, err := tunnelMsgPeerTid(msg)
+		if err == nil && ptid != 0 {
+			dt.xport.config.PeerControlConnID = ptid
+			dt.cfg.PeerTunnelID = ptid
+			dt.cp.connectTo(from)
+		}
+	}
 
-	rc := fsmArgsToStopccnResult(args)
-	// Ignore tx error since we're going to close in any case
 	_ = dt.sendStopccn(rc)
 	dt.fsmActClose(args)
 }
 
-func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
-	msg, err := newV2Stopccn(rc, dt.cfg)
-	if err != nil {
-		return err
-	}
-	return dt.xport.send(msg)
+// Handles receipt of a tunnel message which isn't valid in the current
+// state.  RFC2661 section 7.2.1 requires the control connection be closed.
+func (dt *dynamicTunnel) fsmActOnUnexpectedMsg(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args[:2])
+	level.Error(dt.logger).Log(
+		"message", "unexpected control message",
+		"message_type", msg.getType())
+	dt.fsmActSendStopccn([]interface{}{
+		avpStopCCNResultCodeChannelFSMError,
+		fmt.Sprintf("unexpected %v message", msg.getType()),
+	})
+}
+
+// disconnectAllSessions closes the tunnel's sessions ahead of sending a
+// StopCCN, such that the peer receives a CDN for each session before the
+// StopCCN, and the application receives each SessionDownEvent before the
+// TunnelDownEvent.
+//
+// The sessions are closed concurrently, with the tunnel transmitting the
+// CDNs on their behalf.  We wait for up to the StopCCN timeout for the
+// CDNs to be acknowledged: CDN transmissions still pending after that
+// are failed, and complete when the transport is closed.
+func (dt *dynamicTunnel) disconnectAllSessions() {
+	var wg sync.WaitGroup
+	for _, s := range dt.allSessions() {
+		ds, ok := s.(*dynamicSession)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(ds *dynamicSession) {
+			defer wg.Done()
+			ds.Close()
+		}(ds)
+	}
+
+	done := make(chan interface{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	type sendResult struct {
+		sm  *sendMsg
+		err error
+	}
+	pending := make(map[*sendMsg]bool)
+	results := make(chan sendResult)
+	abandon := make(chan interface{})
+	defer close(abandon)
+
+	timer := time.NewTimer(dt.cfg.StopCCNTimeout)
+	defer timer.Stop()
+
+	timeout := timer.C
+	recvChan := dt.xport.recvChan
+	for {
+		select {
+		case <-done:
+			return
+		case sm, ok := <-dt.sendChan:
+			if !ok {
+				return
+			}
+			if timeout == nil {
+				sm.completeChan <- fmt.Errorf("tunnel is shutting down")
+				continue
+			}
+			pending[sm] = true
+			go func(sm *sendMsg) {
+				err := dt.xport.send(sm.msg)
+				select {
+				case results <- sendResult{sm: sm, err: err}:
+				case <-abandon:
+				}
+			}(sm)
+		case r := <-results:
+			if pending[r.sm] {
+				delete(pending, r.sm)
+				r.sm.completeChan <- r.err
+			}
+		case <-timeout:
+			level.Error(dt.logger).Log(
+				"message", "timed out waiting for sessions to disconnect",
+				"timeout", dt.cfg.StopCCNTimeout,
+				"pending", len(pending))
+			timeout = nil
+			for sm := range pending {
+				delete(pending, sm)
+				sm.completeChan <- fmt.Errorf("timed out after %v", dt.cfg.StopCCNTimeout)
+			}
+		case _, ok := <-recvChan:
+			// Received messages are discarded, but must be drained to
+			// allow the transport to process acknowledgements
+			if !ok {
+				recvChan = nil
+			}
+		}
+	}
+}
+
+// Discards a message which isn't valid in the current state, but which
+// doesn't warrant closing the control connection.
+func (dt *dynamicTunnel) fsmActDiscardMsg(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+	level.Info(dt.logger).Log(
+		"message", "discard unexpected control message",
+		"message_type", msg.getType())
+}
+
+func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
+
+	rc := fsmArgsToStopccnResult(args)
+	dt.setResult(stopccnResultCodeToString(rc))
+
+	// Tear down sessions before informing the peer, so our data plane
+	// is gone by the time the peer clears its own state
+	dt.disconnectAllSessions()
+
+	// Ignore tx error since we're going to close in any case
+	err := dt.sendStopccn(rc)
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "StopCCN not acknowledged",
+			"error", err)
+	}
+	dt.fsmActClose(args)
+}
+
+// sendStopccn sends a StopCCN to the peer and waits for it to be
+// acknowledged, for up to the StopCCN timeout.  Received messages are
+// discarded while waiting.
+func (dt *dynamicTunnel) sendStopccn(rc *resultCode) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Stopccn(rc, dt.cfg)
+	} else {
+		msg, err = newV2Stopccn(rc, dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The send will complete when the transport is closed if the
+	// peer doesn't acknowledge the message in time
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- dt.xport.send(msg)
+	}()
+
+	timeout := time.NewTimer(dt.cfg.StopCCNTimeout)
+	defer timeout.Stop()
+
+	recvChan := dt.xport.recvChan
+	for {
+		select {
+		case err = <-sendErr:
+			return err
+		case <-timeout.C:
+			return fmt.Errorf("timed out after %v", dt.cfg.StopCCNTimeout)
+		case _, ok := <-recvChan:
+			if !ok {
+				recvChan = nil
+			}
+		}
+	}
 }
 
 // Implementes stopccn pend timeout as per RFC2661 section 5.7.
@@ -452,16 +1345,29 @@ func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
 // continue to drain the transport in order to allow messages to
 // be ACKed.
 func (dt *dynamicTunnel) fsmActOnStopccn(args []interface{}) {
+	// The StopCCN may be of a different protocol version in the
+	// case of the fallback event
+	if msg, ok := args[0].(controlMessage); ok {
+		rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+		if err == nil {
+			dt.setResult(stopccnResultCodeToString(rc))
+		}
+	}
+
 	level.Debug(dt.logger).Log(
 		"message", "pending for stopccn retransmit period",
 		"timeout", dt.cfg.StopCCNTimeout)
 	timeout := time.NewTimer(dt.cfg.StopCCNTimeout)
+	recvChan := dt.xport.recvChan
 	for {
 		select {
 		case <-timeout.C:
 			dt.fsmActClose(args)
 			return
-		case <-dt.xport.recvChan:
+		case _, ok := <-recvChan:
+			if !ok {
+				recvChan = nil
+			}
 		}
 	}
 }
@@ -469,30 +1375,292 @@ func (dt *dynamicTunnel) fsmActOnStopccn(args []interface{}) {
 func (dt *dynamicTunnel) fsmActLinkSession(args []interface{}) {
 	ds := fsmArgsToSession(args)
 	dt.linkSession(ds)
+	dt.unreserveSession()
 }
 
 func (dt *dynamicTunnel) fsmActStartSession(args []interface{}) {
 	ds := fsmArgsToSession(args)
 	dt.linkSession(ds)
+	dt.unreserveSession()
 	ds.onTunnelUp()
 }
 
 func (dt *dynamicTunnel) fsmActForwardSessionMsg(args []interface{}) {
 
-	msg, _ := fsmArgsToV2MsgFrom(args)
+	msg, _ := fsmArgsToMsgFrom(args)
+	sid := sessionMsgSid(msg)
 
-	if s, ok := dt.findSessionByID(ControlConnID(msg.Sid())); ok {
+	if s, ok := dt.findSessionByID(sid); ok {
 		if ds, ok := s.(*dynamicSession); ok {
 			ds.handleCtlMsg(msg)
 		}
+	} else if msg.getType() == avpMsgTypeIcrq && sid == 0 {
+		dt.onIncomingCall(msg)
 	} else {
-		// TODO: on receipt of ICRQ we'll end up here; to handle this
-		// we'd need to be able to create an LNS-mode session instance
 		level.Error(dt.logger).Log(
 			"message", "received session message for unknown session",
 			"message_type", msg.getType(),
-			"session ID", msg.Sid())
+			"session ID", sid)
+	}
+}
+
+// onIncomingCall handles an ICRQ from the peer, asking the application's
+// SessionAcceptor whether to accept the call.
+func (dt *dynamicTunnel) onIncomingCall(msg controlMessage) {
+	avps := msg.getAvps()
+
+	psid, err := sessionMsgPeerSid(msg)
+	if err != nil || psid == 0 {
+		level.Error(dt.logger).Log(
+			"message", "discard ICRQ without valid assigned session ID")
+		return
+	}
+
+	// Only the session ID and Call Serial Number AVPs are mandatory
+	// in both L2TPv2 and L2TPv3, so the remaining AVPs may be absent
+	call := &IncomingCall{
+		TunnelName:    dt.getName(),
+		Tunnel:        dt,
+		PeerSessionID: psid,
+		Pseudowire:    PseudowireTypePPP,
+	}
+	call.CallSerialNumber, _ = findUint32Avp(avps, vendorIDIetf, avpTypeCallSerialNumber)
+	call.BearerType, _ = findUint32Avp(avps, vendorIDIetf, avpTypeBearerType)
+	call.PhysicalChannelID, _ = findUint32Avp(avps, vendorIDIetf, avpTypePhysicalChannelID)
+	call.CallingNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCallingNumber)
+	call.CalledNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCalledNumber)
+	call.SubAddress, _ = findStringAvp(avps, vendorIDIetf, avpTypeSubAddress)
+	if msg.protocolVersion() == ProtocolVersion3 {
+		if pwtype, err := findUint16Avp(avps, vendorIDIetf, avpTypePseudowireType); err == nil {
+			call.Pseudowire = PseudowireType(pwtype)
+		}
+		call.RemoteEndID, _ = findBytesAvp(avps, vendorIDIetf, avpTypeRemoteEndID)
+
+		// The peer may only request pseudowire types we advertised
+		if !pseudowireCapsInclude(v3PseudowireCaps(dt.cfg), call.Pseudowire) {
+			dt.rejectIncomingCall(call, &CallDecision{
+				Result:  CDNResultUnsupportedPseudowire,
+				Message: fmt.Sprintf("unsupported pseudowire type %v", call.Pseudowire),
+			})
+			return
+		}
+	}
+
+	// Must not exceed the session limit
+	if err = dt.reserveSession(); err != nil {
+		level.Info(dt.logger).Log(
+			"message", "reject incoming call",
+			"peer_session_id", call.PeerSessionID,
+			"error", err)
+		dt.rejectIncomingCall(call, &CallDecision{
+			Result:    CDNResultNoResources,
+			ErrorCode: ErrorCodeNoResource,
+			Message:   err.Error(),
+		})
+		return
+	}
+	defer dt.unreserveSession()
+
+	decision := dt.parent.sessionAcceptor().AcceptSession(call)
+	if decision == nil {
+		decision = &CallDecision{}
+	}
+
+	if decision.Accept {
+		err = dt.acceptIncomingCall(msg, call, decision)
+		if err == nil {
+			return
+		}
+		level.Error(dt.logger).Log(
+			"message", "failed to accept incoming call",
+			"peer_session_id", call.PeerSessionID,
+			"error", err)
+		decision = &CallDecision{
+			Result:    CDNResultGeneralError,
+			ErrorCode: ErrorCodeNoResource,
+			Message:   err.Error(),
+		}
+	}
+
+	dt.rejectIncomingCall(call, decision)
+}
+
+// peerSupportsPseudowire returns true if the peer can accept sessions
+// of the specified pseudowire type.  L2TPv2 tunnels carry PPP only, while
+// L2TPv3 peers advertise the types they accept during tunnel setup.
+func (dt *dynamicTunnel) peerSupportsPseudowire(pw PseudowireType) bool {
+	if dt.cfg.Version != ProtocolVersion3 {
+		return pw == PseudowireTypePPP
+	}
+	return pseudowireCapsInclude(dt.peerPwCaps, pw)
+}
+
+// negotiatePseudowire returns the pseudowire type a session should use
+// given its configured preferences, being the first of the session's
+// pseudowire and its fallbacks which the peer supports.
+func (dt *dynamicTunnel) negotiatePseudowire(cfg *SessionConfig) (pw PseudowireType, ok bool) {
+	for _, pw = range append([]PseudowireType{cfg.Pseudowire}, cfg.PseudowireFallback...) {
+		if dt.peerSupportsPseudowire(pw) {
+			return pw, true
+		}
+	}
+	return cfg.Pseudowire, false
+}
+
+// samplePathMTU records the path MTU to the peer, informing sessions
+// if it has changed.
+func (dt *dynamicTunnel) samplePathMTU() {
+	dt.pathMTUTimer = nil
+
+	// The path MTU is unavailable for tunnels sharing a socket
+	mtu, err := dt.cp.pathMTU()
+	if err != nil {
+		return
+	}
+	dt.pathMTUTimer = time.NewTimer(pathMTUInterval)
+
+	dt.pathMTULock.Lock()
+	prev := dt.pathMTU
+	dt.pathMTU = mtu
+	dt.pathMTULock.Unlock()
+
+	if prev == 0 || prev == mtu {
+		return
+	}
+
+	level.Info(dt.logger).Log(
+		"message", "path MTU changed",
+		"from", prev,
+		"to", mtu)
+
+	for _, s := range dt.allSessions() {
+		if ds, ok := s.(*dynamicSession); ok {
+			ds.onPathMTUChange()
+		}
+	}
+}
+
+// pathMTUTimeout returns the channel the path MTU timer fires on, or nil
+// if the timer isn't running.
+func (dt *dynamicTunnel) pathMTUTimeout() <-chan time.Time {
+	if dt.pathMTUTimer == nil {
+		return nil
+	}
+	return dt.pathMTUTimer.C
+}
+
+// sessionMTU returns the MTU suited to a session given the current path
+// MTU to the peer, or zero if the path MTU isn't known.
+func (dt *dynamicTunnel) sessionMTU(scfg *SessionConfig) uint16 {
+	dt.pathMTULock.Lock()
+	mtu := dt.pathMTU
+	dt.pathMTULock.Unlock()
+	return sessionMTU(mtu, sockaddrIsIPv4(dt.sap), dt.cfg, scfg)
+}
+
+// pseudowireCapsInclude returns true if the Pseudowire Capabilities List
+// AVP value includes the specified pseudowire type.
+func pseudowireCapsInclude(caps []uint16, pw PseudowireType) bool {
+	for _, c := range caps {
+		if c == uint16(pw) {
+			return true
+		}
 	}
+	return false
+}
+
+// acceptIncomingCall creates a session for an incoming call accepted by
+// the application, and passes it the ICRQ to reply to.
+func (dt *dynamicTunnel) acceptIncomingCall(msg controlMessage, call *IncomingCall, decision *CallDecision) (err error) {
+	var cfg SessionConfig
+	if decision.SessionConfig != nil {
+		// Duplicate the configuration so we don't modify the user's copy
+		cfg = *decision.SessionConfig
+	}
+	cfg.PeerSessionID = call.PeerSessionID
+
+	if dt.cfg.Version == ProtocolVersion3 {
+		if cfg.Pseudowire == 0 {
+			cfg.Pseudowire = call.Pseudowire
+		} else if cfg.Pseudowire != call.Pseudowire {
+			return fmt.Errorf("session pseudowire type %v doesn't match call pseudowire type %v",
+				cfg.Pseudowire, call.Pseudowire)
+		}
+	}
+
+	if err = checkSessionConfig(dt.cfg.Version, dt.getDP(), &cfg); err != nil {
+		return err
+	}
+
+	if cfg.SessionID != 0 {
+		if _, ok := dt.findSessionByID(cfg.SessionID); ok {
+			return fmt.Errorf("already have session with SID %v", cfg.SessionID)
+		}
+	} else {
+		cfg.SessionID, err = dt.allocSid()
+		if err != nil {
+			return fmt.Errorf("failed to allocate a SID: %v", err)
+		}
+		defer func() {
+			if err != nil {
+				dt.releaseSid(cfg.SessionID)
+			}
+		}()
+	}
+
+	name := decision.SessionName
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", dt.getName(), cfg.SessionID)
+	}
+	if _, ok := dt.findSessionByName(name); ok {
+		return fmt.Errorf("already have session %q", name)
+	}
+
+	ds, err := newDynamicResponderSession(name, dt, &cfg, msg)
+	if err != nil {
+		return err
+	}
+	dt.linkSession(ds)
+	return nil
+}
+
+// rejectIncomingCall sends a CDN to the peer for an incoming call
+// rejected by the application.
+func (dt *dynamicTunnel) rejectIncomingCall(call *IncomingCall, decision *CallDecision) {
+	rc := &resultCode{
+		result:  avpResultCode(decision.Result),
+		errCode: avpErrorCode(decision.ErrorCode),
+		errMsg:  decision.Message,
+	}
+	if rc.result == 0 {
+		rc.result = avpCDNResultCodeGeneralError
+	}
+
+	level.Info(dt.logger).Log(
+		"message", "reject incoming call",
+		"peer_session_id", call.PeerSessionID,
+		"result", cdnResultCodeToString(rc))
+
+	msg, err := newCdn(dt.cfg.Version, dt.cfg.PeerTunnelID, rc, &SessionConfig{PeerSessionID: call.PeerSessionID})
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to build CDN",
+			"error", err)
+		return
+	}
+
+	// Don't hold up the tunnel goroutine waiting for the peer to
+	// acknowledge the CDN
+	dt.sessionTxWg.Add(1)
+	go func() {
+		defer dt.sessionTxWg.Done()
+		err := dt.xport.send(msg)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "failed to send CDN",
+				"error", err)
+		}
+	}()
 }
 
 // Closes all tunnel resources and unlinks child sessions.
@@ -506,10 +1674,18 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 		}
 
 		dt.isClosing = true
+		dt.fsm.setState("dead")
+		dt.setTieBreaker(nil)
 
 		dt.closeAllSessions()
+		for _, ds := range dt.dequeueSessions(true) {
+			ds.kill()
+			dt.unreserveSession()
+			dt.releaseSid(ds.cfg.SessionID)
+		}
 
 		if dt.dp != nil {
+			dt.setDataPlane(nil)
 			err := dt.dp.Down()
 			if err != nil {
 				level.Error(dt.logger).Log("message", "dataplane down failed", "error", err)
@@ -517,11 +1693,18 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 		}
 		if dt.xport != nil {
 			dt.xport.close()
+			dt.setResult(fmt.Sprintf("control connection failed: %v", dt.xport.downErr))
 		}
 		if dt.cp != nil {
 			dt.cp.close()
 		}
 
+		// The transport has stopped, so no more messages are authenticated
+		if dt.auth != nil {
+			dt.auth.destroy()
+		}
+		zeroize(dt.challenge)
+
 		if dt.established {
 			dt.established = false
 			dt.parent.handleUserEvent(&TunnelDownEvent{
@@ -530,7 +1713,18 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 				Config:       dt.cfg,
 				LocalAddress: dt.sal,
 				PeerAddress:  dt.sap,
+				Result:       dt.result,
+			})
+		} else {
+			dt.parent.handleUserEvent(&TunnelEstablishFailedEvent{
+				TunnelName:   dt.getName(),
+				Tunnel:       dt,
+				Config:       dt.cfg,
+				LocalAddress: dt.sal,
+				PeerAddress:  dt.sap,
+				Result:       dt.result,
 			})
+			dt.establishDone(establishError(dt.result))
 		}
 
 		dt.parent.unlinkTunnel(dt)
@@ -539,97 +1733,291 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 }
 
 // Create a new client/LAC mode tunnel instance running the full control protocol
-func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
+func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, fallback []ProtocolVersion, done EstablishCallback) (dt *dynamicTunnel, err error) {
 
-	// Currently only handle L2TPv2
-	if cfg.Version != ProtocolVersion2 {
-		return nil, fmt.Errorf("L2TPv3 dynamic tunnels are not (yet) supported")
+	if !dynamicTunnelSupportsVersion(cfg.Version) {
+		return nil, fmt.Errorf("dynamic tunnels don't support protocol version %v", cfg.Version)
 	}
 
-	dt = &dynamicTunnel{
-		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
-			name,
-			parent,
-			cfg),
-		sal:       sal,
-		sap:       sap,
-		closeChan: make(chan bool),
-		sendChan:  make(chan *sendMsg),
-		eventChan: make(chan *eventArgs),
+	if _, err = managedSocketChecksum(cfg); err != nil {
+		return nil, err
+	}
+
+	dt = allocDynamicTunnel(name, parent, sal, sap, cfg)
+	dt.fallbackVersions = fallback
+	dt.done = done
+
+	// Always send a Tie Breaker, since we want a single tunnel with the
+	// peer if it concurrently opens a tunnel to us
+	dt.tieBreaker, err = newTieBreaker()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tie breaker: %v", err)
+	}
+
+	if cfg.Secret != "" {
+		dt.challenge, err = newChallenge(cfg.ChallengeLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate challenge: %v", err)
+		}
+		dt.auth, err = newV3Auth(tunnelSecrets(cfg), cfg.ChallengeLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
 	}
 
 	// Ref: RFC2661 section 7.2.1
 	dt.fsm = fsm{
 		current: "idle",
-		table: []eventDesc{
+		table: append([]eventDesc{
 			// No other events possible in the idle state since we handle open to
 			// kick off the FSM
 			{from: "idle", events: []string{"open"}, cb: dt.fsmActSendSccrq, to: "waitctlreply"},
 
 			// waitctlreply is for when we've sent an sccrq to the peer and are waiting on the reply
 			{from: "waitctlreply", events: []string{"sccrp"}, cb: dt.fsmActOnSccrp, to: "established"},
+			{from: "waitctlreply", events: []string{"badsccrp"}, cb: dt.fsmActOnBadSccMsg, to: "dead"},
 			{from: "waitctlreply", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlreply", events: []string{"fallback"}, cb: dt.fsmActFallback, to: "waitctlreply"},
 			{from: "waitctlreply", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlreply"},
-			// TODO: don't really expect session messages: OK to ignore?
-			{from: "waitctlreply", events: []string{"sessionmsg"}, cb: nil, to: "waitctlreply"},
+			// The peer can't have any sessions in the tunnel yet
+			{from: "waitctlreply", events: []string{"sessionmsg"}, cb: dt.fsmActDiscardMsg, to: "waitctlreply"},
 			{
 				from: "waitctlreply",
 				events: []string{
 					"sccrq",
+					"badsccrq",
 					"scccn",
-					"close",
+					"badscccn",
 				},
-				cb: dt.fsmActSendStopccn,
+				cb: dt.fsmActOnUnexpectedMsg,
 				to: "dead",
 			},
+			{from: "waitctlreply", events: []string{"close", "timeout"}, cb: dt.fsmActSendStopccn, to: "dead"},
+		}, dt.establishedFsmTable()...),
+		onTransition: dt.onStateChange,
+	}
+
+	err = dt.start()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Create a new server/LNS mode tunnel instance, running the full control protocol
+// in response to an SCCRQ received by a listener.
+func newDynamicResponderTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, listenerName string, sccrq, scccn *rawMsg, peerHostName string) (dt *dynamicTunnel, err error) {
 
-			// established is for once the tunnel three-way handshake is complete
-			{from: "established", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
-			{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
-			{from: "established", events: []string{"sessionmsg"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
+	if !dynamicTunnelSupportsVersion(cfg.Version) {
+		return nil, fmt.Errorf("dynamic tunnels don't support protocol version %v", cfg.Version)
+	}
+
+	if _, err = managedSocketChecksum(cfg); err != nil {
+		return nil, err
+	}
+
+	dt = allocDynamicTunnel(name, parent, sal, sap, cfg)
+	dt.listenerName = listenerName
+	dt.sccrq = sccrq
+	dt.scccn = scccn
+	dt.sccrpSent = scccn != nil
+	dt.peerHostName = peerHostName
+
+	if cfg.Version == ProtocolVersion3 && cfg.Secret != "" {
+		dt.auth, err = newV3Auth(tunnelSecrets(cfg), cfg.ChallengeLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
+	}
+
+	// Ref: RFC2661 section 7.2.1
+	dt.fsm = fsm{
+		current: "idle",
+		table: append([]eventDesc{
+			// The SCCRQ which caused the tunnel to be created is the first
+			// message received by the tunnel, so there is nothing to do on open
+			{from: "idle", events: []string{"open"}, cb: nil, to: "idle"},
+			{from: "idle", events: []string{"sccrq"}, cb: dt.fsmActOnSccrq, to: "waitctlconn"},
+			{from: "idle", events: []string{"badsccrq"}, cb: dt.fsmActOnBadSccMsg, to: "dead"},
+			{from: "idle", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "idle"},
+			{from: "idle", events: []string{"close"}, cb: dt.fsmActClose, to: "dead"},
+
+			// waitctlconn is for when we've sent an sccrp to the peer and are waiting on the scccn
+			{from: "waitctlconn", events: []string{"scccn"}, cb: dt.fsmActOnScccn, to: "established"},
+			{from: "waitctlconn", events: []string{"badscccn"}, cb: dt.fsmActOnBadSccMsg, to: "dead"},
+			{from: "waitctlconn", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlconn", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlconn"},
+			// The peer can't have any sessions in the tunnel yet
+			{from: "waitctlconn", events: []string{"sessionmsg"}, cb: dt.fsmActDiscardMsg, to: "waitctlconn"},
 			{
-				from: "established",
+				from: "waitctlconn",
 				events: []string{
 					"sccrq",
+					"badsccrq",
 					"sccrp",
-					"scccn",
-					"close",
+					"badsccrp",
 				},
-				cb: dt.fsmActSendStopccn,
+				cb: dt.fsmActOnUnexpectedMsg,
 				to: "dead",
 			},
-		},
+			{from: "waitctlconn", events: []string{"close", "timeout"}, cb: dt.fsmActSendStopccn, to: "dead"},
+		}, dt.establishedFsmTable()...),
+		onTransition: dt.onStateChange,
 	}
 
-	dt.cp, err = newL2tpControlPlane(sal, sap)
+	err = dt.start()
 	if err != nil {
-		dt.Close()
 		return nil, err
 	}
+	return
+}
+
+func allocDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) *dynamicTunnel {
+	if cfg.RouterID == 0 {
+		cfg.RouterID = defaultRouterID(sal)
+	}
+	return &dynamicTunnel{
+		baseTunnel: newBaseTunnel(
+			log.With(parent.logger, "tunnel_name", name, "tunnel_id", cfg.TunnelID, "peer", cfg.Peer),
+			name,
+			parent,
+			cfg),
+		sal:            sal,
+		sap:            sap,
+		secret:         cfg.Secret,
+		closeChan:      make(chan bool),
+		sendChan:       make(chan *sendMsg),
+		newSessionChan: make(chan bool, 1),
+	}
+}
+
+// defaultRouterID derives the L2TPv3 Router ID from the tunnel's local
+// address.  This is zero unless the local address is a specified IPv4
+// address.
+func defaultRouterID(sal unix.Sockaddr) uint32 {
+	ip := sockaddrIP(sal).To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
 
-	err = dt.cp.bind()
+// establishedFsmTable returns the fsm transitions for the established
+// state, which are common to the initiator and responder.
+func (dt *dynamicTunnel) establishedFsmTable() []eventDesc {
+	return []eventDesc{
+		// established is for once the tunnel three-way handshake is complete
+		{from: "established", events: []string{"stopccn", "fallback"}, cb: dt.fsmActOnStopccn, to: "dead"},
+		{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
+		{from: "established", events: []string{"sessionmsg"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
+		{
+			from: "established",
+			events: []string{
+				"sccrq",
+				"badsccrq",
+				"sccrp",
+				"badsccrp",
+				"scccn",
+				"badscccn",
+			},
+			cb: dt.fsmActOnUnexpectedMsg,
+			to: "dead",
+		},
+		{from: "established", events: []string{"close"}, cb: dt.fsmActSendStopccn, to: "dead"},
+	}
+}
+
+// start opens the control connection and runs the tunnel goroutine.
+func (dt *dynamicTunnel) start() error {
+	err := dt.openControlConnection()
 	if err != nil {
 		dt.Close()
-		return nil, err
+		return err
 	}
 
-	dt.xport, err = newTransport(dt.logger, dt.cp, transportConfig{
+	dt.wg.Add(1)
+	go dt.runTunnel()
+
+	return nil
+}
+
+// openControlConnection creates the tunnel socket and the reliable
+// transport for the control connection.
+func (dt *dynamicTunnel) openControlConnection() (err error) {
+
+	csum, err := managedSocketChecksum(dt.cfg)
+	if err != nil {
+		return err
+	}
+
+	cp, err := dt.parent.newTunnelControlPlane(dt.sal, dt.sap, dt.cfg)
+	if err != nil {
+		return err
+	}
+
+	err = cp.setUDPChecksum(csum)
+	if err == nil {
+		err = cp.setDSCP(dt.cfg.ControlDSCP, dt.cfg.DataDSCP)
+	}
+	if err == nil {
+		err = cp.setSocketOptions(dt.cfg)
+	}
+	if err == nil && dt.sccrq != nil {
+		// An accepted tunnel shares the listener's local address, but
+		// is connected to the peer such that the kernel delivers the
+		// peer's messages to the tunnel socket rather than the listener.
+		err = cp.setReuseAddress()
+	}
+	if err == nil {
+		err = cp.bind()
+	}
+	if err == nil && dt.sccrq != nil {
+		err = cp.connect()
+	}
+	if err != nil {
+		cp.close()
+		return err
+	}
+
+	// The SCCRQ received by the listener is passed to the tunnel's
+	// transport in order that it is acknowledged.
+	if dt.sccrq != nil {
+		cp.inject(dt.sccrq)
+		dt.sccrq = nil
+	}
+	if dt.scccn != nil {
+		cp.inject(dt.scccn)
+		dt.scccn = nil
+	}
+
+	// The SCCRP sent by the listener on the tunnel's behalf used the
+	// first sequence number
+	var initialNs uint16
+	if dt.sccrpSent {
+		initialNs = 1
+	}
+
+	xport, err := newTransport(dt.logger, cp, transportConfig{
 		HelloTimeout:      dt.cfg.HelloTimeout,
 		TxWindowSize:      dt.cfg.WindowSize,
+		ReorderQueueSize:  dt.cfg.ReorderQueueSize,
 		MaxRetries:        dt.cfg.MaxRetries,
 		RetryTimeout:      dt.cfg.RetryTimeout,
 		AckTimeout:        time.Millisecond * 100,
 		Version:           dt.cfg.Version,
 		PeerControlConnID: dt.cfg.PeerTunnelID,
+		InitialNs:         initialNs,
+		Stats:             &dt.stats,
+		Auth:              dt.transportAuth(),
+		ParserOptions:     newParserOptions(dt.cfg),
 	})
 	if err != nil {
-		dt.Close()
-		return nil, err
+		cp.close()
+		return err
 	}
 
-	dt.wg.Add(1)
-	go dt.runTunnel()
-
-	return
+	dt.cp = cp
+	dt.xport = xport
+	dt.setTransport(xport)
+	return nil
 }
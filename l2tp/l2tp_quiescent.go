@@ -18,6 +18,7 @@ type quiescentTunnel struct {
 	dp        TunnelDataPlane
 	closeChan chan bool
 	wg        sync.WaitGroup
+	stats     transportStats
 }
 
 func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
@@ -29,6 +30,9 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
+	if err := checkSessionConfig(qt.getCfg().Version, qt.getDP(), &myCfg); err != nil {
+		return nil, err
+	}
 
 	if _, ok := qt.findSessionByName(name); ok {
 		return nil, fmt.Errorf("already have session %q", name)
@@ -38,7 +42,13 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 		return nil, fmt.Errorf("already have session %q", cfg.SessionID)
 	}
 
-	s, err := newStaticSession(name, qt, &myCfg)
+	// Must not exceed the session limit
+	if err := qt.reserveSession(); err != nil {
+		return nil, err
+	}
+	defer qt.unreserveSession()
+
+	s, err := newStaticSession(name, qt, &myCfg, false)
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +58,15 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 	return s, nil
 }
 
+// Static sessions are established on creation.
+func (qt *quiescentTunnel) NewSessionAsync(name string, cfg *SessionConfig, done EstablishCallback) (Session, error) {
+	s, err := qt.NewSession(name, cfg)
+	if err == nil && done != nil {
+		done(nil)
+	}
+	return s, err
+}
+
 func (qt *quiescentTunnel) Close() {
 	if qt != nil {
 		close(qt.closeChan)
@@ -56,6 +75,16 @@ func (qt *quiescentTunnel) Close() {
 	}
 }
 
+func (qt *quiescentTunnel) Stats() TunnelStats {
+	ts := qt.baseStats()
+	qt.stats.fill(&ts)
+	return ts
+}
+
+func (qt *quiescentTunnel) CloseWithResult(result ResultCode, errCode ErrorCode, message string) {
+	qt.Close()
+}
+
 func (qt *quiescentTunnel) close() {
 	if qt != nil {
 		qt.baseTunnel.closeAllSessions()
@@ -67,11 +96,13 @@ func (qt *quiescentTunnel) close() {
 			qt.cp.close()
 		}
 		if qt.dp != nil {
+			qt.setDataPlane(nil)
 			err := qt.dp.Down()
 			level.Error(qt.logger).Log("message", "dataplane down failed", "error", err)
 		}
 
 		qt.parent.unlinkTunnel(qt)
+		qt.setState(TunnelStateDead)
 
 		level.Info(qt.logger).Log("message", "close")
 	}
@@ -96,9 +127,15 @@ func (qt *quiescentTunnel) xportReader() {
 }
 
 func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (qt *quiescentTunnel, err error) {
+
+	csum, err := managedSocketChecksum(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	qt = &quiescentTunnel{
 		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
+			log.With(parent.logger, "tunnel_name", name, "tunnel_id", cfg.TunnelID, "peer", cfg.Peer),
 			name,
 			parent,
 			cfg),
@@ -109,7 +146,25 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 
 	// Initialise the control plane.
 	// We bind/connect immediately since we're not runnning most of the control protocol.
-	qt.cp, err = newL2tpControlPlane(sal, sap)
+	qt.cp, err = parent.newTunnelControlPlane(sal, sap, cfg)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setUDPChecksum(csum)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setDSCP(cfg.ControlDSCP, cfg.DataDSCP)
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+
+	err = qt.cp.setSocketOptions(cfg)
 	if err != nil {
 		qt.Close()
 		return nil, err
@@ -127,25 +182,35 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 		return nil, err
 	}
 
-	qt.dp, err = parent.dp.NewTunnel(qt.cfg, qt.sal, qt.sap, qt.cp.fd)
+	qt.dp, err = qt.cp.dataPlane(parent.dp).NewTunnel(qt.cfg, qt.sal, qt.sap, qt.cp.fd)
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
+	qt.setDataPlane(qt.dp)
+	if r, ok := qt.dp.(dataFrameReceiver); ok {
+		qt.cp.setDataHandler(r.receiveDataFrame)
+	}
 
 	qt.xport, err = newTransport(qt.logger, qt.cp, transportConfig{
 		HelloTimeout:      qt.cfg.HelloTimeout,
 		TxWindowSize:      qt.cfg.WindowSize,
+		ReorderQueueSize:  qt.cfg.ReorderQueueSize,
 		MaxRetries:        qt.cfg.MaxRetries,
 		RetryTimeout:      qt.cfg.RetryTimeout,
 		AckTimeout:        time.Millisecond * 100,
 		Version:           qt.cfg.Version,
 		PeerControlConnID: qt.cfg.PeerTunnelID,
+		Stats:             &qt.stats,
+		ParserOptions:     newParserOptions(qt.cfg),
 	})
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
+	qt.setTransport(qt.xport)
+
+	qt.setState(TunnelStateEstablished)
 
 	qt.wg.Add(1)
 	go qt.xportReader()
@@ -155,8 +220,6 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 		"version", qt.cfg.Version,
 		"encap", qt.cfg.Encap,
 		"local", qt.cfg.Local,
-		"peer", qt.cfg.Peer,
-		"tunnel_id", qt.cfg.TunnelID,
 		"peer_tunnel_id", qt.cfg.PeerTunnelID)
 
 	return
@@ -17,6 +17,8 @@ type staticSession struct {
 	*baseSession
 	dp     SessionDataPlane
 	ifname string
+	// The result passed to CloseWithResult, if any
+	closeResult *resultCode
 }
 
 func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
@@ -45,7 +47,17 @@ func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, er
 
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
-	s, err := newStaticSession(name, st, &myCfg)
+	if err := checkSessionConfig(st.getCfg().Version, st.getDP(), &myCfg); err != nil {
+		return nil, err
+	}
+
+	// Must not exceed the session limit
+	if err := st.reserveSession(); err != nil {
+		return nil, err
+	}
+	defer st.unreserveSession()
+
+	s, err := newStaticSession(name, st, &myCfg, false)
 	if err != nil {
 		return nil, err
 	}
@@ -55,12 +67,41 @@ func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, er
 	return s, nil
 }
 
+// adoptSessions creates session instances for the sessions found in the
+// data plane when adopting the tunnel.  Sessions which can't be adopted
+// are left in the data plane.
+func (st *staticTunnel) adoptSessions(sessions []*SessionConfig) {
+	for _, cfg := range sessions {
+		name := fmt.Sprintf("%s-%d", st.getName(), cfg.SessionID)
+		myCfg := *cfg
+		s, err := newStaticSession(name, st, &myCfg, true)
+		if err != nil {
+			level.Error(st.logger).Log(
+				"message", "failed to adopt session",
+				"session_id", cfg.SessionID,
+				"error", err)
+			continue
+		}
+		st.linkSession(s)
+	}
+}
+
+// Static sessions are established on creation.
+func (st *staticTunnel) NewSessionAsync(name string, cfg *SessionConfig, done EstablishCallback) (Session, error) {
+	s, err := st.NewSession(name, cfg)
+	if err == nil && done != nil {
+		done(nil)
+	}
+	return s, err
+}
+
 func (st *staticTunnel) Close() {
 	if st != nil {
 
 		st.baseTunnel.closeAllSessions()
 
 		if st.dp != nil {
+			st.setDataPlane(nil)
 			err := st.dp.Down()
 			if err != nil {
 				level.Error(st.logger).Log("message", "dataplane down failed", "error", err)
@@ -68,52 +109,71 @@ func (st *staticTunnel) Close() {
 		}
 
 		st.parent.unlinkTunnel(st)
+		st.setState(TunnelStateDead)
 
 		level.Info(st.logger).Log("message", "close")
 	}
 }
 
-func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
+func (st *staticTunnel) Stats() TunnelStats {
+	return st.baseStats()
+}
+
+func (st *staticTunnel) CloseWithResult(result ResultCode, errCode ErrorCode, message string) {
+	st.Close()
+}
+
+func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, adopt bool) (st *staticTunnel, err error) {
 	st = &staticTunnel{
 		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
+			log.With(parent.logger, "tunnel_name", name, "tunnel_id", cfg.TunnelID, "peer", cfg.Peer),
 			name,
 			parent,
 			cfg),
 	}
 
-	st.dp, err = parent.dp.NewTunnel(st.cfg, sal, sap, -1)
+	if adopt {
+		st.dp, err = parent.dp.(DiscoveringDataPlane).AdoptTunnel(st.cfg)
+	} else {
+		st.dp, err = parent.dp.NewTunnel(st.cfg, sal, sap, -1)
+	}
 	if err != nil {
 		st.Close()
 		return nil, err
 	}
+	st.setDataPlane(st.dp)
+
+	st.setState(TunnelStateEstablished)
 
 	level.Info(st.logger).Log(
 		"message", "new static tunnel",
+		"adopted", adopt,
 		"version", cfg.Version,
 		"encap", cfg.Encap,
 		"local", cfg.Local,
-		"peer", cfg.Peer,
-		"tunnel_id", cfg.TunnelID,
 		"peer_tunnel_id", cfg.PeerTunnelID)
 
 	return
 }
 
-func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *staticSession, err error) {
+func newStaticSession(name string, parent tunnel, cfg *SessionConfig, adopt bool) (ss *staticSession, err error) {
 
 	tid := parent.getCfg().TunnelID
 	ptid := parent.getCfg().PeerTunnelID
 
 	ss = &staticSession{
 		baseSession: newBaseSession(
-			log.With(parent.getLogger(), "session_name", name),
+			log.With(parent.getLogger(), "session_name", name, "session_id", cfg.SessionID),
 			name,
 			parent,
 			cfg),
 	}
 
-	ss.dp, err = parent.getDP().NewSession(tid, ptid, ss.cfg)
+	if adopt {
+		ss.dp, err = parent.getDP().(DiscoveringDataPlane).AdoptSession(tid, ptid, ss.cfg)
+	} else {
+		ss.dp, err = parent.getDP().NewSession(tid, ptid, ss.cfg)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -124,12 +184,32 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 		return nil, err
 	}
 
+	// Adopted sessions' interfaces were configured when they were created
+	if !adopt {
+		err = configureInterface(ss.ifname, ss.parent.getCfg(), ss.cfg)
+		if err != nil {
+			ss.dp.Down()
+			return nil, err
+		}
+	}
+
+	ss.setDataPlane(ss.dp)
+
+	ss.setState(SessionStateEstablished)
+
 	level.Info(ss.logger).Log(
 		"message", "new static session",
-		"session_id", ss.cfg.SessionID,
+		"adopted", adopt,
 		"peer_session_id", ss.cfg.PeerSessionID,
 		"pseudowire", ss.cfg.Pseudowire)
 
+	ss.parent.handleUserEvent(&SessionDataplaneReadyEvent{
+		TunnelName:    ss.parent.getName(),
+		Tunnel:        ss.parent,
+		SessionName:   ss.getName(),
+		Session:       ss,
+		InterfaceName: ss.ifname,
+	})
 	ss.parent.handleUserEvent(&SessionUpEvent{
 		TunnelName:    ss.parent.getName(),
 		Tunnel:        ss.parent,
@@ -143,15 +223,29 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 	return
 }
 
+func (ss *staticSession) CloseWithResult(result ResultCode, errCode ErrorCode, message string) {
+	ss.closeResult = &resultCode{
+		result:  avpResultCode(result),
+		errCode: avpErrorCode(errCode),
+		errMsg:  message,
+	}
+	ss.Close()
+}
+
 func (ss *staticSession) Close() {
+	ss.setDataPlane(nil)
 	if ss.dp != nil {
-		err := ss.dp.Down()
+		err := releaseInterface(ss.ifname, ss.parent.getCfg(), ss.cfg)
+		if err != nil {
+			level.Error(ss.logger).Log("message", "failed to release session interface", "error", err)
+		}
+		err = ss.dp.Down()
 		if err != nil {
 			level.Error(ss.logger).Log("message", "dataplane down failed", "error", err)
 		}
 	}
 
-	ss.parent.handleUserEvent(&SessionDownEvent{
+	ev := &SessionDownEvent{
 		TunnelName:    ss.parent.getName(),
 		Tunnel:        ss.parent,
 		TunnelConfig:  ss.parent.getCfg(),
@@ -159,8 +253,17 @@ func (ss *staticSession) Close() {
 		Session:       ss,
 		SessionConfig: ss.cfg,
 		InterfaceName: ss.ifname,
-	})
+	}
+	if rc := ss.closeResult; rc != nil {
+		ev.Result = cdnResultCodeToString(rc)
+		ev.ResultCode = ResultCode(rc.result)
+		ev.ErrorCode = ErrorCode(rc.errCode)
+		ev.ErrorMessage = rc.errMsg
+		ss.setCloseResult(ev.Result)
+	}
+	ss.parent.handleUserEvent(ev)
 
+	ss.setState(SessionStateDead)
 	ss.parent.unlinkSession(ss)
 	level.Info(ss.logger).Log("message", "close")
 }
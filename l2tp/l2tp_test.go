@@ -3,14 +3,18 @@ package l2tp
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
 )
 
 // Must be called with root permissions
@@ -55,6 +59,21 @@ func testQuiescentTunnels(t *testing.T) {
 			// Must call out control connection IDs
 			expectFail: true,
 		},
+		{
+			name: "reject conflicting UDP checksum modes",
+			cfg: TunnelConfig{
+				Local:           "127.0.0.1:6000",
+				Peer:            "localhost:5000",
+				Version:         ProtocolVersion3,
+				TunnelID:        1,
+				PeerTunnelID:    1001,
+				Encap:           EncapTypeUDP,
+				ControlChecksum: UDPChecksumEnabled,
+				DataChecksum:    UDPChecksumDisabled,
+			},
+			// Control and data share the tunnel socket
+			expectFail: true,
+		},
 		{
 			name: "L2TPv2 UDP AF_INET",
 			cfg: TunnelConfig{
@@ -99,6 +118,18 @@ func testQuiescentTunnels(t *testing.T) {
 				Encap:        EncapTypeUDP,
 			},
 		},
+		{
+			name: "L2TPv3 UDP AF_INET6 zero checksum",
+			cfg: TunnelConfig{
+				Local:        "[::1]:6000",
+				Peer:         "[::1]:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     7,
+				PeerTunnelID: 1007,
+				Encap:        EncapTypeUDP,
+				DataChecksum: UDPChecksumDisabled,
+			},
+		},
 		{
 			name: "L2TPv3 IP AF_INET",
 			cfg: TunnelConfig{
@@ -328,6 +359,24 @@ func testStaticSessions(t *testing.T) {
 				//InterfaceName: "l2tpeth42",
 			},
 		},
+		{
+			name: "L2TPv3 Eth Session with cookies",
+			tcfg: TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "localhost:5000",
+				TunnelID:     5004,
+				PeerTunnelID: 6004,
+				Encap:        EncapTypeUDP,
+				Version:      ProtocolVersion3,
+			},
+			scfg: SessionConfig{
+				SessionID:     500003,
+				PeerSessionID: 500004,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{0x12, 0xe9, 0x54, 0x0f},
+				PeerCookie:    []byte{0x74, 0x2e, 0x28, 0xa8, 0x61, 0x07, 0xc3, 0x19},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -504,3 +553,877 @@ func checkTunnel(cfg *TunnelConfig) error {
 	}
 	return validateIPL2tpTunnelOut(out, tid, ptid, cfg.Encap)
 }
+
+func TestTunnelAddressPair(t *testing.T) {
+	cases := []struct {
+		name        string
+		local, peer string
+		encap       EncapType
+		sal, sap    unix.Sockaddr
+		expectFail  bool
+	}{
+		{
+			name:  "UDP IPv6",
+			local: "[2001:db8::1]:1701",
+			peer:  "[2001:db8::2]:1702",
+			encap: EncapTypeUDP,
+			sal: &unix.SockaddrInet6{Port: 1701,
+				Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x01}},
+			sap: &unix.SockaddrInet6{Port: 1702,
+				Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}},
+		},
+		{
+			name:  "UDP IPv6 numeric zone",
+			local: "[fe80::1%2]:1701",
+			peer:  "[fe80::2%2]:1701",
+			encap: EncapTypeUDP,
+			sal: &unix.SockaddrInet6{Port: 1701, ZoneId: 2,
+				Addr: [16]byte{0xfe, 0x80, 15: 0x01}},
+			sap: &unix.SockaddrInet6{Port: 1701, ZoneId: 2,
+				Addr: [16]byte{0xfe, 0x80, 15: 0x02}},
+		},
+		{
+			name:  "UDP IPv6 no local address",
+			peer:  "[2001:db8::2]:1701",
+			encap: EncapTypeUDP,
+			sal:   &unix.SockaddrInet6{},
+			sap: &unix.SockaddrInet6{Port: 1701,
+				Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}},
+		},
+		{
+			name:  "UDP dual-stack local, IPv4 peer",
+			local: "[::]:1701",
+			peer:  "192.0.2.1:1701",
+			encap: EncapTypeUDP,
+			sal:   &unix.SockaddrInet6{Port: 1701},
+			sap: &unix.SockaddrInet6{Port: 1701,
+				Addr: [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 0, 14: 2, 15: 1}},
+		},
+		{
+			name:       "UDP IPv4 local, IPv6 peer",
+			local:      "192.0.2.1:1701",
+			peer:       "[2001:db8::2]:1701",
+			encap:      EncapTypeUDP,
+			expectFail: true,
+		},
+		{
+			name:       "UDP IPv6 local, IPv4 peer",
+			local:      "[2001:db8::1]:1701",
+			peer:       "192.0.2.1:1701",
+			encap:      EncapTypeUDP,
+			expectFail: true,
+		},
+		{
+			name:       "UDP unknown zone",
+			local:      "[fe80::1%nosuchinterface]:1701",
+			peer:       "[fe80::2]:1701",
+			encap:      EncapTypeUDP,
+			expectFail: true,
+		},
+		{
+			name:  "IP IPv6",
+			local: "[2001:db8::1]:0",
+			peer:  "[2001:db8::2]:0",
+			encap: EncapTypeIP,
+			sal: &unix.SockaddrL2TPIP6{ConnId: 10,
+				Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x01}},
+			sap: &unix.SockaddrL2TPIP6{ConnId: 20,
+				Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}},
+		},
+		{
+			name:       "IP IPv6 local, IPv4 peer",
+			local:      "[::]:0",
+			peer:       "192.0.2.1:0",
+			encap:      EncapTypeIP,
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sal, sap unix.Sockaddr
+			var err error
+			if c.encap == EncapTypeUDP {
+				sal, sap, err = newUDPAddressPair(c.local, c.peer)
+			} else {
+				sal, sap, err = newIPAddressPair(c.local, 10, c.peer, 20)
+			}
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("expected failure, got local %v peer %v", sal, sap)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("address pair %q %q: %v", c.local, c.peer, err)
+			}
+			if !reflect.DeepEqual(sal, c.sal) {
+				t.Errorf("local address: got %#v, want %#v", sal, c.sal)
+			}
+			if !reflect.DeepEqual(sap, c.sap) {
+				t.Errorf("peer address: got %#v, want %#v", sap, c.sap)
+			}
+		})
+	}
+}
+
+func TestUnmapAddrPair(t *testing.T) {
+	cases := []struct {
+		name           string
+		la, ra         net.IP
+		wantLa, wantRa net.IP
+	}{
+		{
+			name:   "IPv6",
+			la:     net.ParseIP("2001:db8::1"),
+			ra:     net.ParseIP("2001:db8::2"),
+			wantLa: net.ParseIP("2001:db8::1"),
+			wantRa: net.ParseIP("2001:db8::2"),
+		},
+		{
+			name:   "IPv4-mapped",
+			la:     net.ParseIP("::ffff:192.0.2.1"),
+			ra:     net.ParseIP("::ffff:192.0.2.2"),
+			wantLa: net.ParseIP("192.0.2.1").To4(),
+			wantRa: net.ParseIP("192.0.2.2").To4(),
+		},
+		{
+			name:   "unspecified local, IPv4-mapped peer",
+			la:     net.IPv6unspecified,
+			ra:     net.ParseIP("::ffff:192.0.2.2"),
+			wantLa: net.IPv4zero.To4(),
+			wantRa: net.ParseIP("192.0.2.2").To4(),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			la, ra := unmapAddrPair(c.la, c.ra)
+			if !bytes.Equal(la, c.wantLa) || !bytes.Equal(ra, c.wantRa) {
+				t.Errorf("unmapAddrPair(%v, %v) = %v, %v; want %v, %v",
+					c.la, c.ra, la, ra, c.wantLa, c.wantRa)
+			}
+		})
+	}
+}
+
+func TestVersionPreference(t *testing.T) {
+	cases := []struct {
+		policy VersionPolicy
+		known  ProtocolVersion
+		want   []ProtocolVersion
+	}{
+		{
+			policy: VersionPolicyPreferV3,
+			want:   []ProtocolVersion{ProtocolVersion3, ProtocolVersion2},
+		},
+		{
+			policy: VersionPolicyPreferV2,
+			want:   []ProtocolVersion{ProtocolVersion2, ProtocolVersion3},
+		},
+		{
+			policy: VersionPolicyPreferV3,
+			known:  ProtocolVersion2,
+			want:   []ProtocolVersion{ProtocolVersion2, ProtocolVersion3},
+		},
+		{
+			policy: VersionPolicyPreferV2,
+			known:  ProtocolVersion3,
+			want:   []ProtocolVersion{ProtocolVersion3, ProtocolVersion2},
+		},
+		{
+			policy: VersionPolicyPreferV2,
+			known:  ProtocolVersion2,
+			want:   []ProtocolVersion{ProtocolVersion2, ProtocolVersion3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%v known %v", c.policy, c.known), func(t *testing.T) {
+			got := versionPreference(c.policy, c.known)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("versionPreference(%v, %v): got %v, want %v", c.policy, c.known, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNegotiableVersions(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	cases := []struct {
+		name string
+		cfg  TunnelConfig
+		want []ProtocolVersion
+	}{
+		{
+			name: "UDP",
+			cfg:  TunnelConfig{Peer: "127.0.0.1:1701", Encap: EncapTypeUDP},
+			want: []ProtocolVersion{ProtocolVersion3, ProtocolVersion2},
+		},
+		{
+			name: "IP",
+			cfg:  TunnelConfig{Peer: "127.0.0.1:1701", Encap: EncapTypeIP},
+			want: []ProtocolVersion{ProtocolVersion3},
+		},
+		{
+			name: "UDP, 32 bit tunnel ID",
+			cfg:  TunnelConfig{Peer: "127.0.0.1:1701", Encap: EncapTypeUDP, TunnelID: 90000},
+			want: []ProtocolVersion{ProtocolVersion3},
+		},
+		{
+			name: "UDP, secret",
+			cfg:  TunnelConfig{Peer: "127.0.0.1:1701", Encap: EncapTypeUDP, Secret: "s3cr3t"},
+			want: []ProtocolVersion{ProtocolVersion3, ProtocolVersion2},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ctx.negotiableVersions(&c.cfg)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("negotiableVersions(%v): got %v, want %v", c.cfg, got, c.want)
+			}
+		})
+	}
+
+	if _, ok := ctx.PeerProtocolVersion("127.0.0.1:1701"); ok {
+		t.Errorf("PeerProtocolVersion() reported version for unknown peer")
+	}
+	ctx.recordPeerVersion("127.0.0.1:1701", ProtocolVersion2)
+	if v, ok := ctx.PeerProtocolVersion("127.0.0.1:1701"); !ok || v != ProtocolVersion2 {
+		t.Errorf("PeerProtocolVersion(): got %v %v, want %v", v, ok, ProtocolVersion2)
+	}
+}
+
+func TestTunnelStats(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// A pair of quiescent tunnels exchanging HELLO messages
+	var tunnels []Tunnel
+	for i, addr := range []string{"127.0.0.1:9030", "127.0.0.1:9031"} {
+		cfg := &TunnelConfig{
+			Local:        addr,
+			Peer:         []string{"127.0.0.1:9031", "127.0.0.1:9030"}[i],
+			Version:      ProtocolVersion3,
+			Encap:        EncapTypeUDP,
+			TunnelID:     ControlConnID(100 + i),
+			PeerTunnelID: ControlConnID(101 - i),
+			HelloTimeout: 50 * time.Millisecond,
+		}
+		tunl, err := ctx.NewQuiescentTunnel(fmt.Sprintf("t%d", i), cfg)
+		if err != nil {
+			t.Fatalf("NewQuiescentTunnel(%v): %v", cfg, err)
+		}
+		tunnels = append(tunnels, tunl)
+	}
+	_, err = tunnels[0].NewSession("s1", &SessionConfig{SessionID: 1, PeerSessionID: 2, Pseudowire: PseudowireTypeEth})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	for i, tunl := range tunnels {
+		stats := tunl.Stats()
+		if stats.State != TunnelStateEstablished || stats.Uptime <= 0 {
+			t.Errorf("t%d: got state %v uptime %v, want established", i, stats.State, stats.Uptime)
+		}
+		if stats.ControlTx == 0 || stats.ControlRx == 0 {
+			t.Errorf("t%d: got %v messages sent, %v received, expected HELLO exchange", i, stats.ControlTx, stats.ControlRx)
+		}
+		if stats.HelloRTT <= 0 {
+			t.Errorf("t%d: no HELLO round trip time recorded", i)
+		}
+		if stats.LastError != "" {
+			t.Errorf("t%d: unexpected error %q", i, stats.LastError)
+		}
+	}
+	if n := tunnels[0].Stats().Sessions; n != 1 {
+		t.Errorf("t0: got %v sessions, want 1", n)
+	}
+
+	tunnels[0].Close()
+	if state := tunnels[0].Stats().State; state != TunnelStateDead {
+		t.Errorf("t0: got state %v after close, want %v", state, TunnelStateDead)
+	}
+}
+
+func TestTunnelTransmitTimelines(t *testing.T) {
+	// The peer socket swallows everything we send without acking
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9087")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:9086",
+		Peer:         "127.0.0.1:9087",
+		Version:      ProtocolVersion3,
+		Encap:        EncapTypeUDP,
+		RetryTimeout: 20 * time.Millisecond,
+		MaxRetries:   5,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	// Wait for the SCCRQ to be retransmitted
+	var pending []TransmitTimeline
+	for i := 0; i < 100; i++ {
+		time.Sleep(5 * time.Millisecond)
+		if pending = tunl.TransmitTimelines(); len(pending) == 1 && len(pending[0].Sent) > 1 {
+			break
+		}
+	}
+	if len(pending) != 1 || len(pending[0].Sent) < 2 {
+		t.Fatalf("expected a retransmitted SCCRQ to be pending, got %v", pending)
+	}
+	if pending[0].MessageType != avpMsgTypeSccrq.String() || !pending[0].Acked.IsZero() {
+		t.Errorf("expected an unacked %v, got %v", avpMsgTypeSccrq, pending[0])
+	}
+
+	st, err := ctx.NewStaticTunnel("t2", &TunnelConfig{
+		Local:        "127.0.0.1:9088",
+		Peer:         "127.0.0.1:9089",
+		Version:      ProtocolVersion3,
+		Encap:        EncapTypeUDP,
+		TunnelID:     1,
+		PeerTunnelID: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	if pending := st.TransmitTimelines(); pending != nil {
+		t.Errorf("static tunnel has transmit timelines %v", pending)
+	}
+}
+
+func TestContextTunnels(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	ctx.SetMaxTunnels(2)
+
+	newTunnel := func(i int) (Tunnel, error) {
+		return ctx.NewStaticTunnel(fmt.Sprintf("t%d", i), &TunnelConfig{
+			Local:        fmt.Sprintf("127.0.0.1:%d", 9032+i),
+			Peer:         "127.0.0.2:1701",
+			Version:      ProtocolVersion3,
+			Encap:        EncapTypeUDP,
+			TunnelID:     ControlConnID(100 + i),
+			PeerTunnelID: ControlConnID(200 + i),
+		})
+	}
+
+	var tunnels []Tunnel
+	for i := 0; i < 2; i++ {
+		tunl, err := newTunnel(i)
+		if err != nil {
+			t.Fatalf("NewStaticTunnel(t%d): %v", i, err)
+		}
+		tunnels = append(tunnels, tunl)
+	}
+	if _, err = newTunnel(2); err != ErrTunnelLimit {
+		t.Errorf("NewStaticTunnel(t2) beyond limit: got %v, want %v", err, ErrTunnelLimit)
+	}
+
+	all := ctx.Tunnels()
+	if len(all) != 2 || all["t0"] != tunnels[0] || all["t1"] != tunnels[1] {
+		t.Errorf("Tunnels(): got %v, want t0 and t1", all)
+	}
+	if tunl, ok := ctx.FindTunnel("t1"); !ok || tunl != tunnels[1] {
+		t.Errorf("FindTunnel(t1): got %v %v", tunl, ok)
+	}
+	if tunl, ok := ctx.FindTunnelByID(101); !ok || tunl != tunnels[1] {
+		t.Errorf("FindTunnelByID(101): got %v %v", tunl, ok)
+	}
+	for _, peer := range []string{"127.0.0.2", "127.0.0.2:1701"} {
+		if tunl, ok := ctx.FindTunnelByPeerID(peer, 201); !ok || tunl != tunnels[1] {
+			t.Errorf("FindTunnelByPeerID(%v, 201): got %v %v", peer, tunl, ok)
+		}
+	}
+	if _, ok := ctx.FindTunnelByPeerID("127.0.0.3", 201); ok {
+		t.Errorf("FindTunnelByPeerID() found tunnel for wrong peer address")
+	}
+
+	// Closing a tunnel makes room for another
+	tunnels[0].Close()
+	if _, ok := ctx.FindTunnelByPeerID("127.0.0.2", 200); ok {
+		t.Errorf("FindTunnelByPeerID() found closed tunnel")
+	}
+	if _, err = newTunnel(2); err != nil {
+		t.Errorf("NewStaticTunnel(t2) after close: %v", err)
+	}
+}
+
+func TestTunnelSessions(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:9054",
+		Peer:         "127.0.0.2:1701",
+		Version:      ProtocolVersion3,
+		Encap:        EncapTypeUDP,
+		TunnelID:     100,
+		PeerTunnelID: 200,
+		MaxSessions:  2,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	newSession := func(i int) (Session, error) {
+		return tunl.NewSession(fmt.Sprintf("s%d", i), &SessionConfig{
+			SessionID:     ControlConnID(300 + i),
+			PeerSessionID: ControlConnID(400 + i),
+			Pseudowire:    PseudowireTypeEth,
+		})
+	}
+
+	var sessions []Session
+	for i := 0; i < 2; i++ {
+		sess, err := newSession(i)
+		if err != nil {
+			t.Fatalf("NewSession(s%d): %v", i, err)
+		}
+		sessions = append(sessions, sess)
+	}
+	if _, err = newSession(2); err != ErrSessionLimit {
+		t.Errorf("NewSession(s2) beyond limit: got %v, want %v", err, ErrSessionLimit)
+	}
+
+	all := tunl.Sessions()
+	if len(all) != 2 || all["s0"] != sessions[0] || all["s1"] != sessions[1] {
+		t.Errorf("Sessions(): got %v, want s0 and s1", all)
+	}
+	if sess, ok := tunl.FindSession("s1"); !ok || sess != sessions[1] {
+		t.Errorf("FindSession(s1): got %v %v", sess, ok)
+	}
+	if sess, ok := tunl.FindSessionByID(301); !ok || sess != sessions[1] {
+		t.Errorf("FindSessionByID(301): got %v %v", sess, ok)
+	}
+	if sess, ok := tunl.FindSessionByPeerID(401); !ok || sess != sessions[1] {
+		t.Errorf("FindSessionByPeerID(401): got %v %v", sess, ok)
+	}
+
+	// Closing a session makes room for another
+	events := newTestEventCollector()
+	ctx.RegisterEventHandler(events)
+	sessions[0].CloseWithResult(CDNResultAdminDisconnect, ErrorCodeNoError, "maintenance")
+	down := events.next(t, &SessionDownEvent{}).(*SessionDownEvent)
+	if down.ResultCode != CDNResultAdminDisconnect || down.ErrorMessage != "maintenance" || down.Result == "" {
+		t.Errorf("session down %+v, want administrative disconnect", down)
+	}
+	if _, ok := tunl.FindSessionByPeerID(400); ok {
+		t.Errorf("FindSessionByPeerID() found closed session")
+	}
+	if _, err = newSession(2); err != nil {
+		t.Errorf("NewSession(s2) after close: %v", err)
+	}
+}
+
+func TestBundleSessions(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:9083",
+		Peer:         "127.0.0.2:1701",
+		Version:      ProtocolVersion3,
+		Encap:        EncapTypeUDP,
+		TunnelID:     100,
+		PeerTunnelID: 200,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	sessions := make(map[string]Session)
+	for i, bundleID := range []string{"b1", "", "b1", "b2"} {
+		name := fmt.Sprintf("s%d", i)
+		sess, err := tunl.NewSession(name, &SessionConfig{
+			SessionID:     ControlConnID(300 + i),
+			PeerSessionID: ControlConnID(400 + i),
+			Pseudowire:    PseudowireTypePPP,
+			BundleID:      bundleID,
+		})
+		if err != nil {
+			t.Fatalf("NewSession(%v): %v", name, err)
+		}
+		sessions[name] = sess
+	}
+
+	b1 := ctx.BundleSessions("b1")
+	if len(b1) != 2 ||
+		!((b1[0] == sessions["s0"] && b1[1] == sessions["s2"]) ||
+			(b1[0] == sessions["s2"] && b1[1] == sessions["s0"])) {
+		t.Errorf("BundleSessions(b1): got %v, want s0 and s2", b1)
+	}
+	if b2 := ctx.BundleSessions("b2"); len(b2) != 1 || b2[0] != sessions["s3"] {
+		t.Errorf("BundleSessions(b2): got %v, want s3", b2)
+	}
+	if none := ctx.BundleSessions(""); len(none) != 0 {
+		t.Errorf("BundleSessions(\"\"): got %v, want none", none)
+	}
+
+	sessions["s0"].Close()
+	if b1 = ctx.BundleSessions("b1"); len(b1) != 1 || b1[0] != sessions["s2"] {
+		t.Errorf("BundleSessions(b1) after close: got %v, want s2", b1)
+	}
+}
+
+type testDiscoveringDataPlane struct {
+	nullDataPlane
+	tunnels         []DiscoveredTunnel
+	adoptedTunnels  []ControlConnID
+	adoptedSessions []ControlConnID
+}
+
+func (dp *testDiscoveringDataPlane) DiscoverTunnels() ([]DiscoveredTunnel, error) {
+	return dp.tunnels, nil
+}
+
+func (dp *testDiscoveringDataPlane) AdoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error) {
+	dp.adoptedTunnels = append(dp.adoptedTunnels, tcfg.TunnelID)
+	return &nullTunnelDataPlane{}, nil
+}
+
+func (dp *testDiscoveringDataPlane) AdoptSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	dp.adoptedSessions = append(dp.adoptedSessions, scfg.SessionID)
+	return &nullSessionDataPlane{}, nil
+}
+
+func TestAdoptStaticTunnel(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	if _, err = ctx.DiscoverTunnels(); err == nil {
+		t.Errorf("DiscoverTunnels() with null data plane succeeded, expected failure")
+	}
+	ctx.Close()
+
+	newCfg := func(tid ControlConnID) *TunnelConfig {
+		return &TunnelConfig{
+			Local:        "127.0.0.1:9059",
+			Peer:         "127.0.0.2:1701",
+			Version:      ProtocolVersion3,
+			Encap:        EncapTypeUDP,
+			TunnelID:     tid,
+			PeerTunnelID: tid + 100,
+		}
+	}
+
+	dp := &testDiscoveringDataPlane{
+		tunnels: []DiscoveredTunnel{
+			{
+				Config: newCfg(100),
+				Sessions: []*SessionConfig{
+					{SessionID: 300, PeerSessionID: 400, Pseudowire: PseudowireTypeEth},
+					{SessionID: 301, PeerSessionID: 401, Pseudowire: PseudowireTypeEth},
+				},
+			},
+			{
+				Config: newCfg(101),
+			},
+		},
+	}
+	ctx, err = NewContext(dp, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// Tunnels the context is running aren't listed
+	_, err = ctx.NewStaticTunnel("t2", newCfg(101))
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+	found, err := ctx.DiscoverTunnels()
+	if err != nil {
+		t.Fatalf("DiscoverTunnels(): %v", err)
+	}
+	if len(found) != 1 || found[0].Config.TunnelID != 100 {
+		t.Errorf("DiscoverTunnels(): got %v, want tunnel 100", found)
+	}
+
+	if _, err = ctx.AdoptStaticTunnel("t3", newCfg(102)); err == nil {
+		t.Errorf("AdoptStaticTunnel() for unknown tunnel succeeded, expected failure")
+	}
+
+	tunl, err := ctx.AdoptStaticTunnel("t1", found[0].Config)
+	if err != nil {
+		t.Fatalf("AdoptStaticTunnel(): %v", err)
+	}
+	if len(dp.adoptedTunnels) != 1 || dp.adoptedTunnels[0] != 100 {
+		t.Errorf("adopted tunnels %v, want [100]", dp.adoptedTunnels)
+	}
+	if len(dp.adoptedSessions) != 2 {
+		t.Errorf("adopted sessions %v, want 300 and 301", dp.adoptedSessions)
+	}
+	for _, sid := range []ControlConnID{300, 301} {
+		name := fmt.Sprintf("t1-%d", sid)
+		sess, ok := tunl.FindSession(name)
+		if !ok || sess.State() != SessionStateEstablished {
+			t.Errorf("FindSession(%v): got %v %v", name, sess, ok)
+		}
+	}
+}
+
+func TestCheckSessionConfig(t *testing.T) {
+	cases := []struct {
+		name       string
+		version    ProtocolVersion
+		dp         DataPlane
+		cfg        SessionConfig
+		expectFail bool
+	}{
+		{
+			name:    "L2TPv2 default pseudowire",
+			version: ProtocolVersion2,
+		},
+		{
+			name:    "L2TPv3 Ethernet with cookies and MTU",
+			version: ProtocolVersion3,
+			cfg: SessionConfig{
+				Pseudowire:     PseudowireTypeEth,
+				Cookie:         []byte{1, 2, 3, 4},
+				PeerCookie:     []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				MTU:            1400,
+				HardwareAddr:   net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+				InterfaceAddrs: []string{"192.0.2.1/24", "2001:db8::1/64"},
+				InterfaceUp:    true,
+				Bridge:         "br0",
+			},
+		},
+		{
+			name:    "L2TPv3 tagged mode Ethernet with VLANs",
+			version: ProtocolVersion3,
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypeEthVLAN,
+				VLANs:      []uint16{1, 100, 4094},
+			},
+		},
+		{
+			name:    "L2TPv3 PPP with sequence numbers",
+			version: ProtocolVersion3,
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypePPP,
+				SeqNum:     true,
+			},
+		},
+		{
+			name:    "L2TPv3 IP on userspace data plane",
+			version: ProtocolVersion3,
+			dp:      &userspaceDataPlane{},
+			cfg:     SessionConfig{Pseudowire: PseudowireTypeIP, MTU: 1400},
+		},
+		{
+			name:       "L2TPv3 IP on kernel data plane",
+			version:    ProtocolVersion3,
+			dp:         &nlDataPlane{},
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeIP},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv3 IP fallback on kernel data plane",
+			version:    ProtocolVersion3,
+			dp:         &nlDataPlane{},
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, PseudowireFallback: []PseudowireType{PseudowireTypeIP}},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv2 IP",
+			version:    ProtocolVersion2,
+			dp:         &userspaceDataPlane{},
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeIP},
+			expectFail: true,
+		},
+		{
+			name:       "IP hardware address",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeIP, HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv2 Ethernet",
+			version:    ProtocolVersion2,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv2 pseudowire fallback",
+			version:    ProtocolVersion2,
+			cfg:        SessionConfig{PseudowireFallback: []PseudowireType{PseudowireTypePPP}},
+			expectFail: true,
+		},
+		{
+			name:    "L2TPv3 unsupported pseudowire fallback",
+			version: ProtocolVersion3,
+			cfg: SessionConfig{
+				Pseudowire:         PseudowireTypeEth,
+				PseudowireFallback: []PseudowireType{PseudowireTypePPP, 99},
+			},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv2 cookie",
+			version:    ProtocolVersion2,
+			cfg:        SessionConfig{Cookie: []byte{1, 2, 3, 4}},
+			expectFail: true,
+		},
+		{
+			name:       "L2TPv3 no pseudowire",
+			version:    ProtocolVersion3,
+			expectFail: true,
+		},
+		{
+			name:       "Bad cookie length",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, PeerCookie: []byte{1, 2, 3}},
+			expectFail: true,
+		},
+		{
+			name:       "Interface name too long",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tpeth0123456789"},
+			expectFail: true,
+		},
+		{
+			name:    "Interface name template",
+			version: ProtocolVersion3,
+			cfg:     SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tp-%d"},
+		},
+		{
+			name:       "Bad interface name template",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tp-%s"},
+			expectFail: true,
+		},
+		{
+			name:       "PPP interface configuration",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, InterfaceUp: true},
+			expectFail: true,
+		},
+		{
+			name:       "PPP bridge",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, Bridge: "br0"},
+			expectFail: true,
+		},
+		{
+			name:       "Bad bridge name",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, Bridge: "averyveryverylongbridgename"},
+			expectFail: true,
+		},
+		{
+			name:       "PPP VLANs",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, VLANs: []uint16{100}},
+			expectFail: true,
+		},
+		{
+			name:       "Bad VLAN ID",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, VLANs: []uint16{4095}},
+			expectFail: true,
+		},
+		{
+			name:       "Duplicate VLAN ID",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEthVLAN, VLANs: []uint16{100, 100}},
+			expectFail: true,
+		},
+		{
+			name:       "PPP interface namespace",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, InterfaceNetNS: "/run/netns/tenant1"},
+			expectFail: true,
+		},
+		{
+			name:       "Bad interface address",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceAddrs: []string{"192.0.2.1"}},
+			expectFail: true,
+		},
+		{
+			name:    "Bundle ID",
+			version: ProtocolVersion3,
+			cfg:     SessionConfig{Pseudowire: PseudowireTypePPP, BundleID: "subscriber1"},
+		},
+		{
+			name:       "Ethernet bundle ID",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, BundleID: "subscriber1"},
+			expectFail: true,
+		},
+		{
+			name:       "Bundle ID too long",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, BundleID: "averyveryverylongbundleid"},
+			expectFail: true,
+		},
+		{
+			name:       "PPP hardware address",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypePPP, HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+			expectFail: true,
+		},
+		{
+			name:       "Bad hardware address length",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0}},
+			expectFail: true,
+		},
+		{
+			name:       "MTU too small",
+			version:    ProtocolVersion3,
+			cfg:        SessionConfig{Pseudowire: PseudowireTypeEth, MTU: 60},
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkSessionConfig(c.version, c.dp, &c.cfg)
+			if c.expectFail {
+				if err == nil {
+					t.Errorf("checkSessionConfig(%v) succeeded, expected failure", c.cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("checkSessionConfig(%v): %v", c.cfg, err)
+			}
+			if c.version == ProtocolVersion2 && c.cfg.Pseudowire != PseudowireTypePPP {
+				t.Errorf("L2TPv2 pseudowire defaulted to %v, want PPP", c.cfg.Pseudowire)
+			}
+			if c.version == ProtocolVersion3 && c.cfg.SeqNum && c.cfg.L2SpecType != L2SpecTypeDefault {
+				t.Errorf("L2TPv3 sequenced session uses L2SpecType %v, want default", c.cfg.L2SpecType)
+			}
+		})
+	}
+}
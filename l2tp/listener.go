@@ -0,0 +1,725 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// listener accepts dynamic tunnels initiated by peers.  A responder
+// tunnel is created for each SCCRQ received on the listener socket.
+type listener struct {
+	logger log.Logger
+	name   string
+	parent *Context
+	cfg    *TunnelConfig
+	sal    unix.Sockaddr
+	cp     *controlPlane
+	// Tunnels accepted by the listener, keyed by peer address and peer
+	// tunnel ID.  This allows SCCRQ retransmissions queued on the
+	// listener socket to be discarded.
+	accepted map[string]ControlConnID
+	// Tunnels deferred until the peer's SCCCN, keyed by the tunnel ID
+	// sent in the SCCRP, and the tunnel IDs keyed as for accepted.
+	deferred      map[ControlConnID]*deferredTunnel
+	deferredByKey map[string]ControlConnID
+	acl           *peerACL
+	overrides     []peerOverride
+	parserOpts    *parserOptions
+	// Rate limits on SCCRQ processing, which are nil if unlimited
+	rateLimit     *tokenBucket
+	peerRateLimit *peerRateLimiter
+	statsLock     sync.Mutex
+	stats         ListenerStats
+	wg            sync.WaitGroup
+}
+
+func newListener(name string, parent *Context, sal unix.Sockaddr, cfg *TunnelConfig) (l *listener, err error) {
+
+	csum, err := managedSocketChecksum(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := newPeerACL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := newPeerOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// For a shared socket the listener is registered with the socket
+	// using tunnel ID zero, which is used by the peer until it learns
+	// our tunnel ID from the SCCRP.
+	cp, err := parent.newTunnelControlPlane(sal, nil, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.setUDPChecksum(csum)
+	if err == nil {
+		err = cp.setDSCP(cfg.ControlDSCP, cfg.DataDSCP)
+	}
+	if err == nil {
+		err = cp.setSocketOptions(cfg)
+	}
+	if err == nil {
+		err = cp.setReuseAddress()
+	}
+	if err == nil {
+		err = cp.bind()
+	}
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	l = &listener{
+		logger:        log.With(parent.logger, "listener_name", name),
+		name:          name,
+		parent:        parent,
+		cfg:           cfg,
+		sal:           sal,
+		cp:            cp,
+		accepted:      make(map[string]ControlConnID),
+		deferred:      make(map[ControlConnID]*deferredTunnel),
+		deferredByKey: make(map[string]ControlConnID),
+		acl:           acl,
+		overrides:     overrides,
+		parserOpts:    newParserOptions(cfg),
+	}
+	if cfg.SccrqRateLimit > 0 {
+		l.rateLimit = newTokenBucket(cfg.SccrqRateLimit, time.Now())
+	}
+	if cfg.PeerSccrqRateLimit > 0 {
+		l.peerRateLimit = newPeerRateLimiter(cfg.PeerSccrqRateLimit)
+	}
+
+	level.Info(l.logger).Log(
+		"message", "new listener",
+		"local", cfg.Local)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.run()
+	}()
+
+	return l, nil
+}
+
+func (l *listener) Close() {
+	if l != nil {
+		l.parent.unlinkListener(l)
+		l.cp.close()
+		l.wg.Wait()
+		level.Info(l.logger).Log("message", "close")
+	}
+}
+
+func (l *listener) Stats() ListenerStats {
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+	return l.stats
+}
+
+func (l *listener) run() {
+	for {
+		b := make([]byte, 4096)
+		n, from, err := l.cp.recvFrom(b)
+		if err != nil {
+			level.Debug(l.logger).Log(
+				"message", "socket read failed",
+				"error", err)
+			return
+		}
+		l.handleFrame(b[:n], from)
+	}
+}
+
+func (l *listener) handleFrame(b []byte, from unix.Sockaddr) {
+	msgs, err := parseMessageBuffer(b, l.parserOpts)
+	if err != nil {
+		level.Debug(l.logger).Log(
+			"message", "failed to parse frame",
+			"error", err)
+		return
+	}
+	if len(msgs) == 0 {
+		level.Debug(l.logger).Log(
+			"message", "discard frame too short for a control message",
+			"length", len(b))
+		return
+	}
+
+	// Only an SCCRQ from a new peer, or an SCCCN completing a deferred
+	// tunnel, is of interest: any other message belongs to a tunnel, and
+	// is delivered to the tunnel's socket.
+	msg := msgs[0]
+	l.pruneDeferred()
+	if msg.getType() == avpMsgTypeScccn && msg.protocolVersion() == ProtocolVersion3 {
+		l.handleScccn(b, msg, from)
+		return
+	}
+	if msg.getType() != avpMsgTypeSccrq || tunnelMsgTid(msg) != 0 || !l.acceptsVersion(msg.protocolVersion()) {
+		level.Debug(l.logger).Log(
+			"message", "discard unexpected control message",
+			"version", msg.protocolVersion(),
+			"message_type", msg.getType())
+		return
+	}
+
+	ptid, err := tunnelMsgPeerTid(msg)
+	if err != nil || ptid == 0 {
+		level.Debug(l.logger).Log(
+			"message", "discard SCCRQ without valid assigned tunnel ID")
+		return
+	}
+
+	l.pruneAccepted()
+
+	key := fmt.Sprintf("%s/%d", sockaddrString(from), ptid)
+	if _, ok := l.accepted[key]; ok {
+		level.Debug(l.logger).Log(
+			"message", "discard retransmitted SCCRQ",
+			"peer", sockaddrString(from),
+			"peer_tunnel_id", ptid)
+		return
+	}
+
+	// The peer retransmits its SCCRQ if it didn't receive the SCCRP
+	// of a deferred tunnel, which the listener doesn't retransmit
+	if tid, ok := l.deferredByKey[key]; ok {
+		level.Debug(l.logger).Log(
+			"message", "resend SCCRP in reply to retransmitted SCCRQ",
+			"peer", sockaddrString(from),
+			"peer_tunnel_id", ptid)
+		l.sendSccrp(l.deferred[tid])
+		return
+	}
+
+	// The Host Name AVP is mandatory, so parsing the message ensures it's present
+	hostName, _ := findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeHostName)
+
+	// An unauthorized peer is rejected by the tunnel accepted for it,
+	// which sends a StopCCN in reply to the SCCRQ
+	authorized := l.acl.check(from, hostName) == nil
+	if !authorized {
+		l.count(&l.stats.Unauthorized)
+		if !l.cfg.RejectUnauthorizedPeers {
+			level.Debug(l.logger).Log(
+				"message", "discard SCCRQ from unauthorized peer",
+				"peer", sockaddrString(from),
+				"peer_host_name", hostName)
+			return
+		}
+	}
+
+	// Limits are checked before the comparatively expensive
+	// authentication of the SCCRQ.  Discards are logged at debug level
+	// only, since they're expected in a flood.
+	if !l.withinRateLimits(from) {
+		level.Debug(l.logger).Log(
+			"message", "discard SCCRQ exceeding rate limit",
+			"peer", sockaddrString(from))
+		l.count(&l.stats.RateLimited)
+		return
+	}
+	if l.cfg.MaxPendingTunnels > 0 && l.pendingTunnels()+len(l.deferred) >= l.cfg.MaxPendingTunnels {
+		level.Debug(l.logger).Log(
+			"message", "discard SCCRQ exceeding pending tunnel limit",
+			"peer", sockaddrString(from))
+		l.count(&l.stats.PendingLimited)
+		return
+	}
+
+	// An L2TPv3 SCCRQ is authenticated before a tunnel is created for it,
+	// using the secret of the peer's configuration
+	cfg := l.peerConfig(from, hostName)
+	if err = authenticateSccrq(cfg, msg); err != nil {
+		level.Error(l.logger).Log(
+			"message", "discard unauthenticated SCCRQ",
+			"peer", sockaddrString(from),
+			"error", err)
+		l.count(&l.stats.Unauthenticated)
+		return
+	}
+
+	// The Tie Breaker AVP is optional.  Tunnels we're opening to an
+	// unauthorized peer aren't affected by its SCCRQ.
+	tb, _ := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeTiebreaker)
+	if authorized && !l.resolveCollisions(from, tb) {
+		return
+	}
+
+	if authorized && l.defers(cfg, msg.protocolVersion()) {
+		if err = l.deferAccept(cfg, b, key, from, ptid, hostName); err != nil {
+			level.Error(l.logger).Log(
+				"message", "failed to reply to SCCRQ",
+				"peer", sockaddrString(from),
+				"peer_host_name", hostName,
+				"error", err)
+			l.count(&l.stats.Failed)
+			return
+		}
+		l.count(&l.stats.Deferred)
+		return
+	}
+
+	tid, err := l.accept(cfg, b, from, msg.protocolVersion(), ptid, hostName)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to accept tunnel",
+			"peer", sockaddrString(from),
+			"peer_host_name", hostName,
+			"error", err)
+		l.count(&l.stats.Failed)
+		return
+	}
+	l.accepted[key] = tid
+	l.count(&l.stats.Accepted)
+}
+
+// count increments one of the listener's statistics counters.
+func (l *listener) count(counter *uint64) {
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+	*counter++
+}
+
+// withinRateLimits returns true if an SCCRQ from the peer is within the
+// listener's rate limits.  The per-peer limit is checked first so that a
+// single peer exceeding its limit doesn't consume the global allowance.
+func (l *listener) withinRateLimits(from unix.Sockaddr) bool {
+	now := time.Now()
+	if l.peerRateLimit != nil && !l.peerRateLimit.allow(sockaddrIP(from).String(), now) {
+		return false
+	}
+	return l.rateLimit == nil || l.rateLimit.allow(now)
+}
+
+// pendingTunnels returns the number of tunnels accepted by the listener
+// which are awaiting establishment of the control connection.
+func (l *listener) pendingTunnels() (n int) {
+	for _, tid := range l.accepted {
+		tunl, ok := l.parent.findTunnelByID(tid)
+		if !ok {
+			continue
+		}
+		if dt, ok := tunl.(*dynamicTunnel); ok && dt.baseStats().State != TunnelStateEstablished {
+			n++
+		}
+	}
+	return
+}
+
+// acceptsVersion returns true if the listener accepts tunnels using the
+// specified protocol version.
+func (l *listener) acceptsVersion(version ProtocolVersion) bool {
+	if l.cfg.Version != 0 {
+		return version == l.cfg.Version
+	}
+	return version == ProtocolVersion2 || version == ProtocolVersion3
+}
+
+// authenticateSccrq checks the Message Digest of an L2TPv3 SCCRQ if the
+// configuration of the tunnel to be accepted for it has a secret.
+func authenticateSccrq(cfg *TunnelConfig, msg controlMessage) error {
+	v3msg, ok := msg.(*v3ControlMessage)
+	if !ok || cfg.Secret == "" {
+		return nil
+	}
+	auth, err := newV3Auth(tunnelSecrets(cfg), cfg.ChallengeLength)
+	if err != nil {
+		return err
+	}
+	defer auth.destroy()
+	return auth.verify(v3msg)
+}
+
+// peerACL restricts the peers a listener accepts tunnels from.
+type peerACL struct {
+	prefixes  []*net.IPNet
+	hostNames []string
+}
+
+// newPeerACL parses the AllowedPeers and AllowedPeerHostNames of the
+// listener configuration.
+func newPeerACL(cfg *TunnelConfig) (*peerACL, error) {
+	acl := &peerACL{hostNames: cfg.AllowedPeerHostNames}
+	for _, peer := range cfg.AllowedPeers {
+		prefix, err := parsePeerPrefix(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed peer %q: expected an address or prefix", peer)
+		}
+		acl.prefixes = append(acl.prefixes, prefix)
+	}
+	return acl, nil
+}
+
+// parsePeerPrefix parses a peer address or prefix in CIDR notation, an
+// address being treated as a prefix matching that address only.
+func parsePeerPrefix(peer string) (*net.IPNet, error) {
+	if ip := net.ParseIP(peer); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(peer)
+	return prefix, err
+}
+
+// peerOverride is a parsed PeerConfig of a listener configuration.
+type peerOverride struct {
+	prefix   *net.IPNet
+	hostName string
+	cfg      *TunnelConfig
+}
+
+// newPeerOverrides parses the PeerConfigs of the listener configuration.
+// Each peer configuration is duplicated, taking the parameters which apply
+// to the listener as a whole from the listener configuration, and the
+// defaults the listener was given for parameters it leaves unset.
+func newPeerOverrides(cfg *TunnelConfig) ([]peerOverride, error) {
+	var out []peerOverride
+	for _, pc := range cfg.PeerConfigs {
+		if pc.Peer == "" && pc.HostName == "" {
+			return nil, fmt.Errorf("peer config must specify a peer address or host name")
+		}
+		if pc.Config == nil {
+			return nil, fmt.Errorf("peer config for %q: invalid nil config", pc.Peer+pc.HostName)
+		}
+		o := peerOverride{hostName: pc.HostName}
+		if pc.Peer != "" {
+			prefix, err := parsePeerPrefix(pc.Peer)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer config peer %q: expected an address or prefix", pc.Peer)
+			}
+			o.prefix = prefix
+		}
+
+		myCfg := *pc.Config
+		if myCfg.TunnelID != 0 || myCfg.PeerTunnelID != 0 || myCfg.Peer != "" || len(myCfg.PeerConfigs) > 0 {
+			return nil, fmt.Errorf("peer config for %q: tunnel IDs, peer address and peer configs cannot be specified", pc.Peer+pc.HostName)
+		}
+		myCfg.Local = cfg.Local
+		myCfg.Encap = cfg.Encap
+		myCfg.SharedSocket = cfg.SharedSocket
+		myCfg.NetNS = cfg.NetNS
+		myCfg.SccrqRateLimit = cfg.SccrqRateLimit
+		myCfg.PeerSccrqRateLimit = cfg.PeerSccrqRateLimit
+		myCfg.MaxPendingTunnels = cfg.MaxPendingTunnels
+		myCfg.AllowedPeers = cfg.AllowedPeers
+		myCfg.AllowedPeerHostNames = cfg.AllowedPeerHostNames
+		myCfg.RejectUnauthorizedPeers = cfg.RejectUnauthorizedPeers
+		if myCfg.HostName == "" {
+			myCfg.HostName = cfg.HostName
+		}
+		if myCfg.StopCCNTimeout == 0 {
+			myCfg.StopCCNTimeout = cfg.StopCCNTimeout
+		}
+		if err := checkChallengeLength(myCfg.ChallengeLength); err != nil {
+			return nil, fmt.Errorf("peer config for %q: %v", pc.Peer+pc.HostName, err)
+		}
+		if myCfg.AlternateSecret != "" && myCfg.Secret == "" {
+			return nil, fmt.Errorf("peer config for %q: alternate secret requires a secret", pc.Peer+pc.HostName)
+		}
+		if myCfg.ChallengeLength == 0 {
+			myCfg.ChallengeLength = defaultChallengeLen
+		}
+		if err := validateExtraAVPs(myCfg.ExtraAVPs, MessageTypeSCCRP); err != nil {
+			return nil, fmt.Errorf("peer config for %q: %v", pc.Peer+pc.HostName, err)
+		}
+		if _, err := managedSocketChecksum(&myCfg); err != nil {
+			return nil, fmt.Errorf("peer config for %q: %v", pc.Peer+pc.HostName, err)
+		}
+		o.cfg = &myCfg
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// matches returns true if the override applies to the peer.
+func (o *peerOverride) matches(peer unix.Sockaddr, hostName string) bool {
+	if o.prefix != nil && !o.prefix.Contains(sockaddrIP(peer)) {
+		return false
+	}
+	return o.hostName == "" || strings.EqualFold(o.hostName, hostName)
+}
+
+// peerConfig returns the configuration of the tunnel to be accepted for
+// the peer: that of the first of the listener's PeerConfigs matching the
+// peer, or otherwise the listener's configuration.
+func (l *listener) peerConfig(peer unix.Sockaddr, hostName string) *TunnelConfig {
+	for i := range l.overrides {
+		if l.overrides[i].matches(peer, hostName) {
+			return l.overrides[i].cfg
+		}
+	}
+	return l.cfg
+}
+
+// check returns nil if the peer is allowed to open tunnels, or an error
+// describing why it isn't.
+func (acl *peerACL) check(peer unix.Sockaddr, hostName string) error {
+	if len(acl.prefixes) > 0 {
+		ip := sockaddrIP(peer)
+		allowed := false
+		for _, prefix := range acl.prefixes {
+			if prefix.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("peer address %v not allowed", ip)
+		}
+	}
+	if len(acl.hostNames) > 0 {
+		for _, name := range acl.hostNames {
+			if strings.EqualFold(name, hostName) {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer host name %q not allowed", hostName)
+	}
+	return nil
+}
+
+// pruneAccepted forgets tunnels which have since been closed.
+func (l *listener) pruneAccepted() {
+	for key, tid := range l.accepted {
+		if _, ok := l.parent.findTunnelByID(tid); !ok {
+			delete(l.accepted, key)
+		}
+	}
+}
+
+// resolveCollisions checks whether an SCCRQ from the peer collides with
+// tunnels we are concurrently opening to the same peer, discarding the
+// tunnels which lose the tie break.  It returns false if the SCCRQ should
+// be discarded.
+// Ref: RFC2661 section 4.4.3.
+func (l *listener) resolveCollisions(from unix.Sockaddr, tieBreaker []byte) bool {
+	accept := true
+	for _, tunl := range l.parent.allTunnels() {
+		dt, ok := tunl.(*dynamicTunnel)
+		if !ok || !sockaddrIP(dt.sap).Equal(sockaddrIP(from)) {
+			continue
+		}
+
+		result := dt.resolveCollision(tieBreaker)
+		if result == tieBreakNone {
+			continue
+		}
+
+		level.Info(l.logger).Log(
+			"message", "SCCRQ collides with tunnel opening to peer",
+			"peer", sockaddrString(from),
+			"tunnel_name", dt.getName(),
+			"tunnel_retained", result == tieBreakWon)
+
+		if result == tieBreakWon || result == tieBreakDrawn {
+			accept = false
+		}
+		if result == tieBreakLost || result == tieBreakDrawn {
+			l.wg.Add(1)
+			go func() {
+				defer l.wg.Done()
+				dt.discard()
+			}()
+		}
+	}
+	return accept
+}
+
+// accept creates a responder tunnel for an SCCRQ received from the peer,
+// using the peer's configuration.
+func (l *listener) accept(peerCfg *TunnelConfig, b []byte, from unix.Sockaddr, version ProtocolVersion, ptid ControlConnID, peerHostName string) (tid ControlConnID, err error) {
+
+	// Duplicate the configuration so each tunnel has its own copy
+	cfg := *peerCfg
+	cfg.PeerConfigs = nil
+	cfg.Version = version
+	cfg.Peer = sockaddrString(from)
+	cfg.PeerTunnelID = ptid
+
+	cfg.TunnelID, err = l.parent.allocTid(cfg.Version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate a TID: %v", err)
+	}
+
+	err = l.createTunnel(&cfg, &rawMsg{b: b, sa: from}, nil, peerHostName)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.TunnelID, nil
+}
+
+// createTunnel creates a responder tunnel for the peer's SCCRQ, along
+// with its SCCCN if the listener deferred creating the tunnel.
+func (l *listener) createTunnel(cfg *TunnelConfig, sccrq, scccn *rawMsg, peerHostName string) (err error) {
+
+	// Must not exceed the tunnel limit
+	if err = l.parent.reserveTunnel(); err != nil {
+		return err
+	}
+	defer l.parent.unreserveTunnel()
+
+	name := fmt.Sprintf("%s-%d", l.name, cfg.TunnelID)
+	if _, ok := l.parent.findTunnelByName(name); ok {
+		return fmt.Errorf("already have tunnel %q", name)
+	}
+
+	t, err := newDynamicResponderTunnel(name, l.parent, l.sal, sccrq.sa, cfg, l.name, sccrq, scccn, peerHostName)
+	if err != nil {
+		return err
+	}
+
+	l.parent.linkTunnel(t, sccrq.sa, cfg.PeerTunnelID)
+	return nil
+}
+
+// deferredTunnel records the SCCRP sent by a listener deferring creation
+// of the tunnel until the peer's SCCCN.
+type deferredTunnel struct {
+	key          string
+	cfg          *TunnelConfig
+	sccrq        *rawMsg
+	sccrp        []byte
+	peerHostName string
+	expires      time.Time
+}
+
+// The time a deferred tunnel waits for the SCCCN if ScccnTimeout isn't set.
+const defaultDeferredTunnelTimeout = 30 * time.Second
+
+// defers returns true if the listener defers creating the tunnel for an
+// SCCRQ, which requires the tunnel to hold no authentication state, and
+// the peer's SCCCN to be received on the listener socket.
+func (l *listener) defers(cfg *TunnelConfig, version ProtocolVersion) bool {
+	if !l.cfg.DeferTunnelCreation || version != ProtocolVersion3 || cfg.Secret != "" {
+		return false
+	}
+	return l.cp.mux == nil && l.cfg.Encap == EncapTypeUDP
+}
+
+// deferAccept replies to an SCCRQ from the peer with an SCCRP on behalf
+// of the tunnel to be created once the peer sends its SCCCN.
+func (l *listener) deferAccept(peerCfg *TunnelConfig, b []byte, key string, from unix.Sockaddr, ptid ControlConnID, peerHostName string) (err error) {
+
+	// Duplicate the configuration so each tunnel has its own copy
+	cfg := *peerCfg
+	cfg.PeerConfigs = nil
+	cfg.Version = ProtocolVersion3
+	cfg.Peer = sockaddrString(from)
+	cfg.PeerTunnelID = ptid
+
+	// The tunnel ID must not clash with other deferred tunnels either
+	for {
+		cfg.TunnelID, err = l.parent.allocTid(cfg.Version)
+		if err != nil {
+			return fmt.Errorf("failed to allocate a TID: %v", err)
+		}
+		if _, ok := l.deferred[cfg.TunnelID]; !ok {
+			break
+		}
+	}
+
+	// The SCCRP acknowledges the SCCRQ, which has sequence number zero
+	sccrp, err := newV3Sccrp(&cfg, nil)
+	if err != nil {
+		return err
+	}
+	sccrp.setTransportSeqNum(0, 1)
+	rb, err := sccrp.toBytes()
+	if err != nil {
+		return err
+	}
+
+	timeout := cfg.ScccnTimeout
+	if timeout == 0 {
+		timeout = defaultDeferredTunnelTimeout
+	}
+	d := &deferredTunnel{
+		key:          key,
+		cfg:          &cfg,
+		sccrq:        &rawMsg{b: b, sa: from},
+		sccrp:        rb,
+		peerHostName: peerHostName,
+		expires:      time.Now().Add(timeout),
+	}
+	if err = l.sendSccrp(d); err != nil {
+		return err
+	}
+	l.deferred[cfg.TunnelID] = d
+	l.deferredByKey[key] = cfg.TunnelID
+	return nil
+}
+
+// sendSccrp sends the SCCRP of a deferred tunnel to the peer.
+func (l *listener) sendSccrp(d *deferredTunnel) error {
+	_, err := l.cp.writeTo(d.sccrp, d.sccrq.sa)
+	if err != nil {
+		return fmt.Errorf("failed to send SCCRP: %v", err)
+	}
+	return nil
+}
+
+// handleScccn creates the deferred tunnel the peer's SCCCN is addressed
+// to, which replies to the SCCRP the listener sent.
+func (l *listener) handleScccn(b []byte, msg controlMessage, from unix.Sockaddr) {
+	tid := tunnelMsgTid(msg)
+	d, ok := l.deferred[tid]
+	if !ok || sockaddrString(d.sccrq.sa) != sockaddrString(from) || msg.ns() != 1 || msg.nr() != 1 {
+		level.Debug(l.logger).Log(
+			"message", "discard SCCCN for unknown tunnel",
+			"peer", sockaddrString(from),
+			"tunnel_id", tid)
+		return
+	}
+	delete(l.deferred, tid)
+	delete(l.deferredByKey, d.key)
+
+	// The tunnel ID was free when the SCCRP was sent, but another tunnel
+	// may have been allocated it since
+	err := fmt.Errorf("tunnel ID %v already in use", tid)
+	if _, ok := l.parent.findTunnelByID(tid); !ok {
+		err = l.createTunnel(d.cfg, d.sccrq, &rawMsg{b: b, sa: from}, d.peerHostName)
+	}
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to accept tunnel",
+			"peer", sockaddrString(from),
+			"peer_host_name", d.peerHostName,
+			"error", err)
+		l.count(&l.stats.Failed)
+		return
+	}
+	l.accepted[d.key] = tid
+	l.count(&l.stats.Accepted)
+}
+
+// pruneDeferred forgets deferred tunnels whose peer hasn't sent an SCCCN
+// in time.
+func (l *listener) pruneDeferred() {
+	now := time.Now()
+	for tid, d := range l.deferred {
+		if now.After(d.expires) {
+			delete(l.deferred, tid)
+			delete(l.deferredByKey, d.key)
+			l.count(&l.stats.Expired)
+		}
+	}
+}
@@ -0,0 +1,1947 @@
+package l2tp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type testEventCollector struct {
+	events chan interface{}
+}
+
+func newTestEventCollector() *testEventCollector {
+	return &testEventCollector{events: make(chan interface{}, 32)}
+}
+
+func (tec *testEventCollector) HandleEvent(event interface{}) {
+	switch event.(type) {
+	case *TunnelAcceptEvent, *TunnelUpEvent, *TunnelDownEvent, *TunnelStateEvent,
+		*TunnelEstablishFailedEvent, *SessionUpEvent, *SessionDownEvent:
+		tec.events <- event
+	}
+}
+
+// next returns the next event of the same type as want
+func (tec *testEventCollector) next(t *testing.T, want interface{}) interface{} {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev := <-tec.events:
+			if fmt.Sprintf("%T", ev) == fmt.Sprintf("%T", want) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %T", want)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	cases := []struct {
+		name       string
+		lnsAddress string
+		lacAddress []string
+		shared     bool
+	}{
+		{
+			name:       "UDP AF_INET",
+			lnsAddress: "127.0.0.1:9020",
+			lacAddress: []string{"127.0.0.1:9021", "127.0.0.1:9022"},
+		},
+		{
+			name:       "UDP AF_INET6",
+			lnsAddress: "[::1]:9020",
+			lacAddress: []string{"[::1]:9021", "[::1]:9022"},
+		},
+		{
+			name:       "UDP AF_INET (shared socket)",
+			lnsAddress: "127.0.0.1:9020",
+			lacAddress: []string{"127.0.0.1:9021", "127.0.0.1:9022"},
+			shared:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			lcfg := &TunnelConfig{
+				Local:          c.lnsAddress,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				SharedSocket:   c.shared,
+				HostName:       "lns.local",
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			lacTids := make(map[ControlConnID]bool)
+			for _, local := range c.lacAddress {
+				cfg := &TunnelConfig{
+					Local:          local,
+					Peer:           c.lnsAddress,
+					Version:        ProtocolVersion2,
+					Encap:          EncapTypeUDP,
+					StopCCNTimeout: 250 * time.Millisecond,
+					HostName:       "lac.local",
+				}
+				_, err = lacCtx.NewDynamicTunnel(local, cfg)
+				if err != nil {
+					t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+				}
+				ev := lacEvents.next(t, &TunnelUpEvent{}).(*TunnelUpEvent)
+				if ev.PeerHostName != "lns.local" {
+					t.Errorf("TunnelUpEvent: got peer host name %q, want %q", ev.PeerHostName, "lns.local")
+				}
+				lacTids[ev.Config.TunnelID] = true
+			}
+
+			for range c.lacAddress {
+				accept := lnsEvents.next(t, &TunnelAcceptEvent{}).(*TunnelAcceptEvent)
+				if accept.ListenerName != "lns" {
+					t.Errorf("TunnelAcceptEvent: got listener %q, want %q", accept.ListenerName, "lns")
+				}
+				if accept.PeerHostName != "lac.local" {
+					t.Errorf("TunnelAcceptEvent: got peer host name %q, want %q", accept.PeerHostName, "lac.local")
+				}
+				if !lacTids[accept.Config.PeerTunnelID] {
+					t.Errorf("TunnelAcceptEvent: unexpected peer tunnel ID %v", accept.Config.PeerTunnelID)
+				}
+				delete(lacTids, accept.Config.PeerTunnelID)
+				up := lnsEvents.next(t, &TunnelUpEvent{}).(*TunnelUpEvent)
+				if up.Tunnel != accept.Tunnel {
+					t.Errorf("TunnelUpEvent for %v, expected %v", up.TunnelName, accept.TunnelName)
+				}
+				// SCCRQ and SCCCN received, SCCRP sent
+				stats := up.Tunnel.Stats()
+				if stats.State != TunnelStateEstablished || stats.ControlRx < 2 || stats.ControlTx < 1 {
+					t.Errorf("%v stats: got %+v, want established with control messages counted", up.TunnelName, stats)
+				}
+			}
+
+			// Closing the LAC tunnels should close the accepted tunnels
+			lacCtx.Close()
+			for range c.lacAddress {
+				down := lnsEvents.next(t, &TunnelDownEvent{}).(*TunnelDownEvent)
+				if !strings.HasPrefix(down.Result, "result 1 ") {
+					t.Errorf("TunnelDownEvent: got result %q, want StopCCN result 1", down.Result)
+				}
+			}
+
+			lnsCtx.Close()
+			if len(lnsCtx.muxes) != 0 {
+				t.Errorf("shared socket not closed")
+			}
+		})
+	}
+}
+
+func TestListenerTieBreak(t *testing.T) {
+	cases := []struct {
+		name       string
+		tieBreaker []byte
+		peerWins   bool
+	}{
+		{
+			name:       "Local tunnel wins",
+			tieBreaker: bytes.Repeat([]byte{0xff}, 8),
+		},
+		{
+			name:       "Peer tunnel wins",
+			tieBreaker: bytes.Repeat([]byte{0x00}, 8),
+			peerWins:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			// The peer sends its own SCCRQ to our listener from a separate
+			// socket on receipt of our SCCRQ, and replies to ours only if
+			// it loses the tie break.  The peer knows our tunnel ID up front
+			// so it can acknowledge our SCCRQ without replying to it.
+			sal, sap, err := newUDPAddressPair("127.0.0.1:9025", "127.0.0.1:9023")
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(): %v", err)
+			}
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Fatalf("newL2tpControlPlane(): %v", err)
+			}
+			if err = cp.bind(); err != nil {
+				t.Fatalf("cp.bind(): %v", err)
+			}
+			xcfg := defaulttransportConfig()
+			xcfg.Version = ProtocolVersion2
+			xport, err := newTransport(logger, cp, xcfg)
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer xport.close()
+
+			lns, err := newTestLNS(logger, &TunnelConfig{
+				Local:          "127.0.0.1:9024",
+				Peer:           "127.0.0.1:9023",
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				PeerTunnelID:   1234,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			lns.onSccrq = func() bool {
+				sccrq, err := newV2Sccrq(&TunnelConfig{TunnelID: 7654}, c.tieBreaker, nil)
+				if err != nil {
+					panic(fmt.Sprintf("newV2Sccrq(): %v", err))
+				}
+				// Our listener won't acknowledge the SCCRQ if it discards it
+				go xport.send(sccrq)
+				time.Sleep(20 * time.Millisecond)
+				return !c.peerWins
+			}
+
+			var lnsWg sync.WaitGroup
+			lnsWg.Add(1)
+			go func() {
+				lns.run(2 * time.Second)
+				lnsWg.Done()
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+			events := newTestEventCollector()
+			ctx.RegisterEventHandler(events)
+
+			// The peer doesn't acknowledge messages sent by a tunnel the
+			// listener accepts, so give up on them quickly
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9023",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				SharedSocket:   true,
+				MaxRetries:     1,
+				RetryTimeout:   100 * time.Millisecond,
+			}
+			_, err = ctx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9023",
+				Peer:           "127.0.0.1:9024",
+				Version:        ProtocolVersion2,
+				TunnelID:       1234,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				SharedSocket:   true,
+			}
+			_, err = ctx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			if c.peerWins {
+				accept := events.next(t, &TunnelAcceptEvent{}).(*TunnelAcceptEvent)
+				if accept.Config.PeerTunnelID != 7654 {
+					t.Errorf("TunnelAcceptEvent: got peer tunnel ID %v, want %v", accept.Config.PeerTunnelID, 7654)
+				}
+				for {
+					ev := events.next(t, &TunnelStateEvent{}).(*TunnelStateEvent)
+					if ev.TunnelName == "t1" && ev.To == TunnelStateDead {
+						break
+					}
+				}
+				lnsWg.Wait()
+				if lns.stopccnResult != nil {
+					t.Errorf("discarded tunnel sent StopCCN %v", lns.stopccnResult)
+				}
+			} else {
+				up := events.next(t, &TunnelUpEvent{}).(*TunnelUpEvent)
+				if up.TunnelName != "t1" {
+					t.Errorf("TunnelUpEvent for %v, expected %v", up.TunnelName, "t1")
+				}
+				if n := len(ctx.allTunnels()); n != 1 {
+					t.Errorf("got %v tunnels, want 1", n)
+				}
+				ctx.Close()
+				lnsWg.Wait()
+				if !lns.tunnelEstablished {
+					t.Errorf("LNS didn't establish")
+				}
+			}
+		})
+	}
+}
+
+func TestListenerAuth(t *testing.T) {
+	cases := []struct {
+		name                 string
+		lnsSecret, lacSecret string
+		expectUp             bool
+	}{
+		{
+			name:      "Matching secrets",
+			lnsSecret: "secret",
+			lacSecret: "secret",
+			expectUp:  true,
+		},
+		{
+			name:      "Mismatched secrets",
+			lnsSecret: "secret",
+			lacSecret: "wrong",
+		},
+		{
+			name:      "No LAC secret",
+			lnsSecret: "secret",
+		},
+		{
+			name:      "No LNS secret",
+			lacSecret: "secret",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9026",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.lnsSecret,
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9027",
+				Peer:           "127.0.0.1:9026",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.lacSecret,
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			if c.expectUp {
+				lacEvents.next(t, &TunnelUpEvent{})
+				lnsEvents.next(t, &TunnelUpEvent{})
+				return
+			}
+
+			// The LAC tunnel should fail without coming up, as should the
+			// tunnel accepted by the LNS
+			for _, events := range []*testEventCollector{lacEvents, lnsEvents} {
+				timeout := time.After(3 * time.Second)
+			wait:
+				for {
+					select {
+					case ev := <-events.events:
+						switch ev := ev.(type) {
+						case *TunnelUpEvent:
+							t.Fatalf("tunnel %v came up", ev.TunnelName)
+						case *TunnelEstablishFailedEvent:
+							if !strings.HasPrefix(ev.Result, "result 4 ") {
+								t.Errorf("tunnel %v failed with result %q, want StopCCN result 4",
+									ev.TunnelName, ev.Result)
+							}
+							break wait
+						}
+					case <-timeout:
+						t.Fatalf("timed out waiting for tunnel to fail")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestV3ListenerAuth(t *testing.T) {
+	cases := []struct {
+		name                 string
+		lnsSecret, lacSecret string
+		expectUp             bool
+		lnsResult            string
+	}{
+		{
+			name:      "Matching secrets",
+			lnsSecret: "secret",
+			lacSecret: "secret",
+			expectUp:  true,
+		},
+		{
+			name:      "Mismatched secrets",
+			lnsSecret: "secret",
+			lacSecret: "wrong",
+		},
+		{
+			name:      "No LAC secret",
+			lnsSecret: "secret",
+		},
+		{
+			name:      "No LNS secret",
+			lacSecret: "secret",
+			lnsResult: "result 4 ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9062",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.lnsSecret,
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			// Unauthenticated messages are discarded, so the LAC only
+			// learns of a failure when its SCCRQ isn't acknowledged
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9063",
+				Peer:           "127.0.0.1:9062",
+				Version:        ProtocolVersion3,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				RetryTimeout:   250 * time.Millisecond,
+				MaxRetries:     2,
+				Secret:         c.lacSecret,
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			if c.expectUp {
+				lacEvents.next(t, &TunnelUpEvent{})
+				lnsEvents.next(t, &TunnelUpEvent{})
+				return
+			}
+
+			lacEvents.next(t, &TunnelEstablishFailedEvent{})
+			if c.lnsResult != "" {
+				ev := lnsEvents.next(t, &TunnelEstablishFailedEvent{}).(*TunnelEstablishFailedEvent)
+				if !strings.HasPrefix(ev.Result, c.lnsResult) {
+					t.Errorf("LNS tunnel failed with result %q, want %q", ev.Result, c.lnsResult)
+				}
+				return
+			}
+
+			// The LNS discards an unauthenticated SCCRQ without accepting a tunnel
+			for len(lnsEvents.events) > 0 {
+				if ev, ok := (<-lnsEvents.events).(*TunnelAcceptEvent); ok {
+					t.Errorf("LNS accepted tunnel %v", ev.TunnelName)
+				}
+			}
+		})
+	}
+}
+
+func TestListenerRateLimit(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lcfg := &TunnelConfig{
+		Local:              "127.0.0.1:9068",
+		Encap:              EncapTypeUDP,
+		StopCCNTimeout:     250 * time.Millisecond,
+		PeerSccrqRateLimit: 1,
+	}
+	l, err := lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	// The second tunnel's SCCRQ exceeds the peer's rate limit, so the
+	// tunnel is accepted only once its SCCRQ is retransmitted
+	lacAddress := []string{"127.0.0.1:9069", "127.0.0.1:9070"}
+	for _, local := range lacAddress {
+		cfg := &TunnelConfig{
+			Local:          local,
+			Peer:           lcfg.Local,
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}
+		_, err = lacCtx.NewDynamicTunnel(local, cfg)
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+		}
+	}
+	for range lacAddress {
+		lacEvents.next(t, &TunnelUpEvent{})
+	}
+
+	stats := l.Stats()
+	if stats.Accepted != 2 || stats.RateLimited == 0 {
+		t.Errorf("listener stats: got %+v, want 2 accepted and SCCRQs rate limited", stats)
+	}
+}
+
+func TestListenerDeferTunnelCreation(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lcfg := &TunnelConfig{
+		Local:               "127.0.0.1:9092",
+		Encap:               EncapTypeUDP,
+		StopCCNTimeout:      250 * time.Millisecond,
+		ScccnTimeout:        200 * time.Millisecond,
+		DeferTunnelCreation: true,
+	}
+	l, err := lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9093")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer func() { peer.Close() }()
+	lns, err := net.ResolveUDPAddr("udp", lcfg.Local)
+	if err != nil {
+		t.Fatalf("net.ResolveUDPAddr(): %v", err)
+	}
+
+	send := func(msg *v3ControlMessage, ns, nr uint16) {
+		msg.setTransportSeqNum(ns, nr)
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("toBytes(): %v", err)
+		}
+		if _, err = peer.WriteTo(b, lns); err != nil {
+			t.Fatalf("WriteTo(): %v", err)
+		}
+	}
+	recv := func() ([]byte, controlMessage) {
+		b := make([]byte, 4096)
+		peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := peer.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("ReadFrom(): %v", err)
+		}
+		msgs, err := parseMessageBuffer(b[:n], nil)
+		if err != nil {
+			t.Fatalf("parseMessageBuffer(): %v", err)
+		}
+		return b[:n], msgs[0]
+	}
+
+	lacCfg := &TunnelConfig{HostName: "lac", TunnelID: 42, Version: ProtocolVersion3}
+	sccrq, err := newV3Sccrq(lacCfg, nil, nil)
+	if err != nil {
+		t.Fatalf("newV3Sccrq(): %v", err)
+	}
+
+	// The listener replies to the SCCRQ without creating a tunnel, and
+	// resends the same SCCRP if the SCCRQ is retransmitted
+	send(sccrq, 0, 0)
+	sccrp, msg := recv()
+	if msg.getType() != avpMsgTypeSccrp || msg.ns() != 0 || msg.nr() != 1 || tunnelMsgTid(msg) != 42 {
+		t.Fatalf("expected SCCRP ns 0 nr 1 for tunnel 42, got %v ns %v nr %v for tunnel %v",
+			msg.getType(), msg.ns(), msg.nr(), tunnelMsgTid(msg))
+	}
+	tid, err := tunnelMsgPeerTid(msg)
+	if err != nil {
+		t.Fatalf("SCCRP has no assigned control connection ID: %v", err)
+	}
+	if n := len(lnsCtx.Tunnels()); n != 0 {
+		t.Errorf("listener created %d tunnels before the SCCCN", n)
+	}
+	send(sccrq, 0, 0)
+	if again, _ := recv(); !bytes.Equal(again, sccrp) {
+		t.Errorf("retransmitted SCCRQ: got SCCRP %v, want %v", again, sccrp)
+	}
+
+	// The SCCCN creates the tunnel, whose first message is numbered
+	// after the listener's SCCRP
+	scccn, err := newV3Scccn(&TunnelConfig{PeerTunnelID: tid})
+	if err != nil {
+		t.Fatalf("newV3Scccn(): %v", err)
+	}
+	send(scccn, 1, 1)
+	lnsEvents.next(t, &TunnelUpEvent{})
+	if _, msg = recv(); msg.getType() != avpMsgTypeAck || msg.ns() != 1 || msg.nr() != 2 {
+		t.Errorf("expected ACK ns 1 nr 2, got %v ns %v nr %v", msg.getType(), msg.ns(), msg.nr())
+	}
+	if _, ok := lnsCtx.FindTunnelByID(tid); !ok {
+		t.Errorf("no tunnel with ID %v", tid)
+	}
+
+	// An SCCCN for an unknown tunnel is discarded
+	scccn, err = newV3Scccn(&TunnelConfig{PeerTunnelID: tid + 1})
+	if err != nil {
+		t.Fatalf("newV3Scccn(): %v", err)
+	}
+	send(scccn, 1, 1)
+
+	// A deferred tunnel expires if the peer doesn't send an SCCCN.  The
+	// established tunnel's socket is connected to the first peer, so
+	// another peer address is used.
+	peer.Close()
+	peer, err = net.ListenPacket("udp", "127.0.0.1:9095")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	lacCfg.TunnelID = 43
+	if sccrq, err = newV3Sccrq(lacCfg, nil, nil); err != nil {
+		t.Fatalf("newV3Sccrq(): %v", err)
+	}
+	send(sccrq, 0, 0)
+	recv()
+	time.Sleep(2 * lcfg.ScccnTimeout)
+
+	// A real peer establishes a tunnel through the listener too
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+	_, err = lacCtx.NewDynamicTunnel("lac", &TunnelConfig{
+		Local:          "127.0.0.1:9094",
+		Peer:           lcfg.Local,
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+	lacEvents.next(t, &TunnelUpEvent{})
+	lnsEvents.next(t, &TunnelUpEvent{})
+
+	stats := l.Stats()
+	if stats.Deferred != 3 || stats.Accepted != 2 || stats.Expired != 1 {
+		t.Errorf("listener stats: got %+v, want 3 deferred, 2 accepted and 1 expired", stats)
+	}
+}
+
+func TestListenerShortFrame(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9099",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	// Frames too short to hold a control message header are discarded
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9100")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+	lns, err := net.ResolveUDPAddr("udp", lcfg.Local)
+	if err != nil {
+		t.Fatalf("net.ResolveUDPAddr(): %v", err)
+	}
+	for _, b := range [][]byte{{0xc8}, {0xc8, 0x02}, {0xc8, 0x02, 0x00, 0x0c, 0x00, 0x00}} {
+		if _, err = peer.WriteTo(b, lns); err != nil {
+			t.Fatalf("WriteTo(): %v", err)
+		}
+	}
+
+	// The listener still accepts tunnels afterwards
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9101",
+		Peer:           lcfg.Local,
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lacCtx.NewDynamicTunnel("lac", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+	lacEvents.next(t, &TunnelUpEvent{})
+}
+
+func TestListenerACL(t *testing.T) {
+	cases := []struct {
+		name         string
+		allowedPeers []string
+		allowedHosts []string
+		reject       bool
+		expectUp     bool
+	}{
+		{
+			name:         "Allowed address",
+			allowedPeers: []string{"192.168.0.1", "127.0.0.1"},
+			expectUp:     true,
+		},
+		{
+			name:         "Allowed prefix and host name",
+			allowedPeers: []string{"127.0.0.0/8"},
+			allowedHosts: []string{"LAC.local"},
+			expectUp:     true,
+		},
+		{
+			name:         "Disallowed prefix",
+			allowedPeers: []string{"10.0.0.0/8"},
+		},
+		{
+			name:         "Disallowed host name (rejected)",
+			allowedHosts: []string{"lac2.local"},
+			reject:       true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lcfg := &TunnelConfig{
+				Local:                   "127.0.0.1:9071",
+				Encap:                   EncapTypeUDP,
+				StopCCNTimeout:          250 * time.Millisecond,
+				AllowedPeers:            c.allowedPeers,
+				AllowedPeerHostNames:    c.allowedHosts,
+				RejectUnauthorizedPeers: c.reject,
+			}
+			l, err := lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9072",
+				Peer:           lcfg.Local,
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				RetryTimeout:   100 * time.Millisecond,
+				MaxRetries:     2,
+				HostName:       "lac.local",
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			if c.expectUp {
+				lacEvents.next(t, &TunnelUpEvent{})
+				if stats := l.Stats(); stats.Accepted != 1 || stats.Unauthorized != 0 {
+					t.Errorf("listener stats: got %+v, want 1 accepted", stats)
+				}
+				return
+			}
+
+			// A discarded SCCRQ leaves the LAC to give up retransmitting
+			// it, whereas a rejected one is answered with a StopCCN
+			ev := lacEvents.next(t, &TunnelEstablishFailedEvent{}).(*TunnelEstablishFailedEvent)
+			if c.reject && !strings.HasPrefix(ev.Result, "result 4 ") {
+				t.Errorf("TunnelEstablishFailedEvent: got result %q, want StopCCN result 4", ev.Result)
+			}
+			stats := l.Stats()
+			if stats.Unauthorized == 0 {
+				t.Errorf("listener stats: got %+v, want unauthorized SCCRQs counted", stats)
+			}
+			if !c.reject && stats.Accepted != 0 {
+				t.Errorf("listener stats: got %+v, want no tunnels accepted", stats)
+			}
+		})
+	}
+}
+
+func TestListenerPeerConfigs(t *testing.T) {
+	cases := []struct {
+		name     string
+		peer     PeerConfig
+		expectUp bool
+	}{
+		{
+			name:     "Peer prefix",
+			peer:     PeerConfig{Peer: "127.0.0.0/8"},
+			expectUp: true,
+		},
+		{
+			name: "Other peer",
+			peer: PeerConfig{Peer: "192.0.2.1"},
+		},
+		{
+			name:     "Host name",
+			peer:     PeerConfig{HostName: "LAC.example.com"},
+			expectUp: true,
+		},
+		{
+			name: "Other host name",
+			peer: PeerConfig{Peer: "127.0.0.1", HostName: "other.example.com"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			// Only the peer's configuration has the LAC's secret
+			c.peer.Config = &TunnelConfig{Secret: "secret"}
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9084",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				PeerConfigs:    []PeerConfig{c.peer},
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9085",
+				Peer:           "127.0.0.1:9084",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				HostName:       "lac.example.com",
+				Secret:         "secret",
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			if c.expectUp {
+				lacEvents.next(t, &TunnelUpEvent{})
+				lnsEvents.next(t, &TunnelUpEvent{})
+				return
+			}
+
+			// Without the peer's configuration the LNS has no secret,
+			// so the LAC should fail to authenticate it
+			timeout := time.After(3 * time.Second)
+			for {
+				select {
+				case ev := <-lacEvents.events:
+					switch ev := ev.(type) {
+					case *TunnelUpEvent:
+						t.Fatalf("tunnel %v came up", ev.TunnelName)
+					case *TunnelEstablishFailedEvent:
+						return
+					}
+				case <-timeout:
+					t.Fatalf("timed out waiting for tunnel to fail")
+				}
+			}
+		})
+	}
+}
+
+func TestListenerConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  *TunnelConfig
+	}{
+		{
+			name: "nil config",
+		},
+		{
+			name: "IP encapsulation",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", Encap: EncapTypeIP},
+		},
+		{
+			name: "No local address",
+			cfg:  &TunnelConfig{},
+		},
+		{
+			name: "Peer address",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", Peer: "127.0.0.1:9021"},
+		},
+		{
+			name: "Tunnel ID",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", TunnelID: 42},
+		},
+		{
+			name: "Extra AVP for SCCRQ",
+			cfg: &TunnelConfig{
+				Local:     "127.0.0.1:9020",
+				ExtraAVPs: []ExtraAVP{{VendorID: 9, Type: 1, Messages: []MessageType{MessageTypeSCCRQ}}},
+			},
+		},
+		{
+			name: "Negative rate limit",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", PeerSccrqRateLimit: -1},
+		},
+		{
+			name: "Bad allowed peer",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", AllowedPeers: []string{"127.0.0.1:9021"}},
+		},
+		{
+			name: "Alternate secret without secret",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", AlternateSecret: "hunter2"},
+		},
+		{
+			name: "Peer config without peer",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", PeerConfigs: []PeerConfig{{Config: &TunnelConfig{}}}},
+		},
+		{
+			name: "Peer config without config",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", PeerConfigs: []PeerConfig{{Peer: "127.0.0.1"}}},
+		},
+		{
+			name: "Bad peer config peer",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", PeerConfigs: []PeerConfig{{Peer: "banana", Config: &TunnelConfig{}}}},
+		},
+		{
+			name: "Peer config tunnel ID",
+			cfg:  &TunnelConfig{Local: "127.0.0.1:9020", PeerConfigs: []PeerConfig{{Peer: "127.0.0.1", Config: &TunnelConfig{TunnelID: 42}}}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(nil, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+			_, err = ctx.NewListener("lns", c.cfg)
+			if err == nil {
+				t.Errorf("NewListener(%v) succeeded, expected failure", c.cfg)
+			}
+		})
+	}
+}
+
+type testSessionAcceptor struct {
+	calls    chan *IncomingCall
+	decision *CallDecision
+}
+
+func (tsa *testSessionAcceptor) AcceptSession(call *IncomingCall) *CallDecision {
+	tsa.calls <- call
+	return tsa.decision
+}
+
+func TestSessionAcceptor(t *testing.T) {
+	cases := []struct {
+		name       string
+		decision   *CallDecision
+		useDefault bool
+		seqNum     bool
+		expectUp   bool
+		result     string
+	}{
+		{
+			name:     "Accept",
+			decision: &CallDecision{Accept: true, SessionName: "s1"},
+			expectUp: true,
+		},
+		{
+			name:     "Accept with sequencing required",
+			decision: &CallDecision{Accept: true, SessionName: "s1"},
+			seqNum:   true,
+			expectUp: true,
+		},
+		{
+			name:     "Reject",
+			decision: &CallDecision{Result: CDNResultBusy, Message: "busy"},
+			result:   "result 8 ",
+		},
+		{
+			name:   "Reject with nil decision",
+			result: "result 2 ",
+		},
+		{
+			name:       "Default acceptor",
+			useDefault: true,
+			result:     "result 5 ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+			lnsStates := &testSessionStateRecorder{}
+			lnsCtx.RegisterEventHandler(lnsStates)
+
+			acceptor := &testSessionAcceptor{
+				calls:    make(chan *IncomingCall, 1),
+				decision: c.decision,
+			}
+			if !c.useDefault {
+				lnsCtx.SetSessionAcceptor(acceptor)
+			}
+
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9042",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9043",
+				Peer:           "127.0.0.1:9042",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			doneChan := make(chan error, 1)
+			_, err = tunl.NewSessionAsync("s1", &SessionConfig{Pseudowire: PseudowireTypePPP, SeqNum: c.seqNum},
+				func(err error) { doneChan <- err })
+			if err != nil {
+				t.Fatalf("NewSessionAsync(): %v", err)
+			}
+
+			if !c.useDefault {
+				select {
+				case call := <-acceptor.calls:
+					if call.PeerSessionID == 0 || call.Pseudowire != PseudowireTypePPP {
+						t.Errorf("unexpected incoming call %+v", call)
+					}
+				case <-time.After(3 * time.Second):
+					t.Fatalf("timed out waiting for incoming call")
+				}
+			}
+
+			var result error
+			select {
+			case result = <-doneChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for session")
+			}
+
+			if c.expectUp {
+				if result != nil {
+					t.Fatalf("session failed: %v", result)
+				}
+				ev := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+				if ev.SessionName != c.decision.SessionName {
+					t.Errorf("LNS session named %q, want %q", ev.SessionName, c.decision.SessionName)
+				}
+				if ev.SessionConfig.SeqNum != c.seqNum {
+					t.Errorf("LNS session sequence numbers %v, want %v", ev.SessionConfig.SeqNum, c.seqNum)
+				}
+				if state := ev.Session.State(); state != SessionStateEstablished {
+					t.Errorf("LNS session state %v, want %v", state, SessionStateEstablished)
+				}
+				expect := []SessionState{
+					SessionStateIdle,
+					SessionStateWaitConnect,
+					SessionStateEstablished,
+				}
+				if got := lnsStates.get(); !reflect.DeepEqual(got, expect) {
+					t.Errorf("LNS session states: got %v, want %v", got, expect)
+				}
+				return
+			}
+
+			if result == nil {
+				t.Fatalf("session established, expected rejection")
+			}
+			if !strings.HasPrefix(result.Error(), c.result) {
+				t.Errorf("session failed with %q, want %q", result, c.result)
+			}
+		})
+	}
+}
+
+func TestSessionDownResult(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetSessionAcceptor(&testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 1),
+		decision: &CallDecision{Accept: true},
+	})
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9046",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9047",
+		Peer:           "127.0.0.1:9046",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:     PseudowireTypePPP,
+		TxConnectSpeed: 10000000,
+		RxConnectSpeed: 2000000,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lacEvents.next(t, &SessionUpEvent{})
+	lnsSess := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent).Session
+
+	// The LAC sends ICRQ and ICCN and receives ICRP, and vice versa.
+	// Only the LAC reports connect speeds, in the ICCN.
+	for _, c := range []struct {
+		name           string
+		sess           Session
+		ctlTx, ctlRx   uint64
+		peerTx, peerRx uint64
+	}{
+		{name: "LAC", sess: sess, ctlTx: 2, ctlRx: 1},
+		{name: "LNS", sess: lnsSess, ctlTx: 1, ctlRx: 2, peerTx: 10000000, peerRx: 2000000},
+	} {
+		stats := c.sess.Stats()
+		if stats.State != SessionStateEstablished || stats.Result != "" {
+			t.Errorf("%v: unexpected session stats %+v", c.name, stats)
+		}
+		if stats.ControlTx != c.ctlTx || stats.ControlRx != c.ctlRx {
+			t.Errorf("%v: control messages tx %v rx %v, want tx %v rx %v", c.name,
+				stats.ControlTx, stats.ControlRx, c.ctlTx, c.ctlRx)
+		}
+		if stats.PeerTxConnectSpeed != c.peerTx || stats.PeerRxConnectSpeed != c.peerRx {
+			t.Errorf("%v: peer connect speed tx %v rx %v, want tx %v rx %v", c.name,
+				stats.PeerTxConnectSpeed, stats.PeerRxConnectSpeed, c.peerTx, c.peerRx)
+		}
+	}
+
+	// Closing the session sends a CDN to the LNS carrying the result
+	sess.CloseWithResult(CDNResultGeneralError, ErrorCodeNoError, "pppd exited")
+
+	cases := []struct {
+		name         string
+		events       *testEventCollector
+		closedByPeer bool
+	}{
+		{name: "LAC", events: lacEvents},
+		{name: "LNS", events: lnsEvents, closedByPeer: true},
+	}
+	for _, c := range cases {
+		ev := c.events.next(t, &SessionDownEvent{}).(*SessionDownEvent)
+		if ev.ClosedByPeer != c.closedByPeer {
+			t.Errorf("%v: ClosedByPeer %v, want %v", c.name, ev.ClosedByPeer, c.closedByPeer)
+		}
+		if ev.ResultCode != CDNResultGeneralError || ev.ErrorCode != ErrorCodeNoError || ev.ErrorMessage != "pppd exited" {
+			t.Errorf("%v: result %v error %v %q, want %v error %v %q", c.name,
+				ev.ResultCode, ev.ErrorCode, ev.ErrorMessage, CDNResultGeneralError, ErrorCodeNoError, "pppd exited")
+		}
+		if stats := ev.Session.Stats(); stats.State != SessionStateDead || stats.Result != ev.Result {
+			t.Errorf("%v: session stats %+v, want dead with result %q", c.name, stats, ev.Result)
+		}
+	}
+}
+
+func TestSessionPersist(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	acceptor := &testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 2),
+		decision: &CallDecision{Accept: true},
+	}
+	lnsCtx.SetSessionAcceptor(acceptor)
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9048",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9049",
+		Peer:           "127.0.0.1:9048",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:     PseudowireTypePPP,
+		Persist:        true,
+		PersistBackoff: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lacEvents.next(t, &SessionUpEvent{})
+	lnsUp := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+
+	// Closing the session at the LNS sends a CDN to the LAC, which
+	// should re-establish the session
+	lnsUp.Session.Close()
+
+	down := lacEvents.next(t, &SessionDownEvent{}).(*SessionDownEvent)
+	if !down.ClosedByPeer {
+		t.Errorf("session down not reported as closed by peer")
+	}
+	up := lacEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+	if up.Session != sess {
+		t.Errorf("re-established session differs from the original")
+	}
+	lnsEvents.next(t, &SessionUpEvent{})
+
+	if n := len(acceptor.calls); n != 2 {
+		t.Errorf("LNS received %v calls, want 2", n)
+	}
+	if state := sess.State(); state != SessionStateEstablished {
+		t.Errorf("session state %v, want %v", state, SessionStateEstablished)
+	}
+}
+
+func TestSessionOnDemand(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	acceptor := &testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 3),
+		decision: &CallDecision{Accept: true},
+	}
+	lnsCtx.SetSessionAcceptor(acceptor)
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9064",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9065",
+		Peer:           "127.0.0.1:9064",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+
+	badCfgs := []*SessionConfig{
+		{Pseudowire: PseudowireTypePPP, OnDemand: true, Persist: true},
+		{Pseudowire: PseudowireTypePPP, IdleTimeout: time.Second},
+		{Pseudowire: PseudowireTypePPP, OnDemand: true, IdleTimeout: -1},
+	}
+	for _, scfg := range badCfgs {
+		if _, err := tunl.NewSession("bad", scfg); err == nil {
+			t.Errorf("NewSession(%+v): expected error", scfg)
+		}
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:  PseudowireTypePPP,
+		OnDemand:    true,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// The session isn't signalled until it is triggered
+	lacEvents.next(t, &TunnelUpEvent{})
+	time.Sleep(100 * time.Millisecond)
+	if n := len(acceptor.calls); n != 0 {
+		t.Fatalf("LNS received %v calls before trigger, want 0", n)
+	}
+	if state := sess.State(); state != SessionStateWaitTrigger {
+		t.Errorf("session state %v, want %v", state, SessionStateWaitTrigger)
+	}
+
+	sess.Trigger()
+	lacEvents.next(t, &SessionUpEvent{})
+	lnsEvents.next(t, &SessionUpEvent{})
+
+	// The null data plane passes no traffic, so the session should be
+	// disconnected once the idle timeout expires
+	down := lacEvents.next(t, &SessionDownEvent{}).(*SessionDownEvent)
+	if down.ClosedByPeer || down.ResultCode != CDNResultAdminDisconnect || down.ErrorMessage != "idle timeout" {
+		t.Errorf("session down %+v, want idle timeout disconnect", down)
+	}
+	if !lnsEvents.next(t, &SessionDownEvent{}).(*SessionDownEvent).ClosedByPeer {
+		t.Errorf("LNS session down not reported as closed by peer")
+	}
+	if state := sess.State(); state != SessionStateWaitTrigger {
+		t.Errorf("session state %v, want %v", state, SessionStateWaitTrigger)
+	}
+
+	// A further trigger re-establishes the session, and the session
+	// waits for the next trigger if the peer closes it
+	sess.Trigger()
+	lacEvents.next(t, &SessionUpEvent{})
+	lnsUp := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+	lnsUp.Session.Close()
+
+	down = lacEvents.next(t, &SessionDownEvent{}).(*SessionDownEvent)
+	if !down.ClosedByPeer {
+		t.Errorf("session down not reported as closed by peer")
+	}
+	if state := sess.State(); state != SessionStateWaitTrigger {
+		t.Errorf("session state %v, want %v", state, SessionStateWaitTrigger)
+	}
+	if n := len(acceptor.calls); n != 2 {
+		t.Errorf("LNS received %v calls, want 2", n)
+	}
+}
+
+func TestStaticSessionInDynamicTunnel(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	acceptor := &testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 1),
+		decision: &CallDecision{Accept: true},
+	}
+	lnsCtx.SetSessionAcceptor(acceptor)
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9066",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9067",
+		Peer:           "127.0.0.1:9066",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+
+	badCfgs := []*SessionConfig{
+		{Static: true, PeerSessionID: 200},
+		{Static: true, SessionID: 100},
+		{Static: true, SessionID: 100, PeerSessionID: 200, Persist: true},
+	}
+	for _, scfg := range badCfgs {
+		if _, err := tunl.NewSession("bad", scfg); err == nil {
+			t.Errorf("NewSession(%+v): expected error", scfg)
+		}
+	}
+
+	// Each end provisions the session locally
+	lacSess, err := tunl.NewSession("s1", &SessionConfig{
+		Static:        true,
+		SessionID:     100,
+		PeerSessionID: 200,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lacUp := lacEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+	if lacUp.Session != lacSess {
+		t.Errorf("LAC session up for unexpected session %v", lacUp.Session)
+	}
+
+	lnsTunl := lnsEvents.next(t, &TunnelUpEvent{}).(*TunnelUpEvent).Tunnel
+	lnsSess, err := lnsTunl.NewSession("s1", &SessionConfig{
+		Static:        true,
+		SessionID:     200,
+		PeerSessionID: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lnsEvents.next(t, &SessionUpEvent{})
+
+	if n := len(acceptor.calls); n != 0 {
+		t.Errorf("LNS received %v calls, want 0", n)
+	}
+	if sess, ok := tunl.FindSessionByPeerID(200); !ok || sess != lacSess {
+		t.Errorf("LAC FindSessionByPeerID(200): got %v %v", sess, ok)
+	}
+
+	// Closing a static session doesn't signal the peer
+	lacSess.Close()
+	if down := lacEvents.next(t, &SessionDownEvent{}).(*SessionDownEvent); down.ClosedByPeer {
+		t.Errorf("LAC session down reported as closed by peer")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if state := lnsSess.State(); state != SessionStateEstablished {
+		t.Errorf("LNS session state %v, want %v", state, SessionStateEstablished)
+	}
+	if stats := lnsSess.Stats(); stats.ControlRx != 0 || stats.ControlTx != 0 {
+		t.Errorf("LNS session control counters %+v, want zero", stats)
+	}
+}
+
+func TestTunnelCloseOrdering(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetSessionAcceptor(&testSessionAcceptor{
+		calls:    make(chan *IncomingCall, 3),
+		decision: &CallDecision{Accept: true},
+	})
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9052",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestEventCollector()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9053",
+		Peer:           "127.0.0.1:9052",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+
+	const nsessions = 3
+	for i := 0; i < nsessions; i++ {
+		name := fmt.Sprintf("s%d", i)
+		_, err = tunl.NewSession(name, &SessionConfig{Pseudowire: PseudowireTypePPP})
+		if err != nil {
+			t.Fatalf("NewSession(%v): %v", name, err)
+		}
+	}
+	for i := 0; i < nsessions; i++ {
+		lacEvents.next(t, &SessionUpEvent{})
+		lnsEvents.next(t, &SessionUpEvent{})
+	}
+
+	// Closing the tunnel sends a CDN for each session before the StopCCN
+	tunl.Close()
+
+	cases := []struct {
+		name         string
+		events       *testEventCollector
+		closedByPeer bool
+	}{
+		{name: "LAC", events: lacEvents},
+		{name: "LNS", events: lnsEvents, closedByPeer: true},
+	}
+	for _, c := range cases {
+		ndown := 0
+		timeout := time.After(3 * time.Second)
+	loop:
+		for {
+			select {
+			case ev := <-c.events.events:
+				switch ev := ev.(type) {
+				case *SessionDownEvent:
+					ndown++
+					if ev.ClosedByPeer != c.closedByPeer || ev.ResultCode != CDNResultAdminDisconnect {
+						t.Errorf("%v: session %v closed by peer %v with result %v, want %v with result %v",
+							c.name, ev.SessionName, ev.ClosedByPeer, ev.ResultCode,
+							c.closedByPeer, CDNResultAdminDisconnect)
+					}
+				case *TunnelDownEvent:
+					break loop
+				}
+			case <-timeout:
+				t.Fatalf("%v: timed out waiting for TunnelDownEvent", c.name)
+			}
+		}
+		if ndown != nsessions {
+			t.Errorf("%v: got %v SessionDownEvents before TunnelDownEvent, want %v", c.name, ndown, nsessions)
+		}
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestEventCollector()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetSessionAcceptor(&testSessionAcceptor{
+		calls: make(chan *IncomingCall, 2),
+		decision: &CallDecision{
+			Accept:        true,
+			SessionConfig: &SessionConfig{SessionID: 20},
+		},
+	})
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:9055",
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		MaxSessions:    1,
+	}
+	_, err = lnsCtx.NewListener("lns", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%v): %v", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:9056",
+		Peer:           "127.0.0.1:9055",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+	}
+
+	results := make(chan error, 2)
+	done := func(err error) {
+		results <- err
+	}
+	var sessions []Session
+	for i, sid := range []ControlConnID{10, 11} {
+		name := fmt.Sprintf("s%d", i)
+		sess, err := tunl.NewSessionAsync(name, &SessionConfig{SessionID: sid}, done)
+		if err != nil {
+			t.Fatalf("NewSessionAsync(%v): %v", name, err)
+		}
+		sessions = append(sessions, sess)
+		select {
+		case err = <-results:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session %v", name)
+		}
+		// The LNS accepts the first session only
+		if (i == 0) != (err == nil) {
+			t.Errorf("session %v: unexpected establish result %v", name, err)
+		}
+	}
+
+	lnsTunl := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent).Tunnel
+	if n := len(lnsTunl.Sessions()); n != 1 {
+		t.Errorf("LNS has %v sessions, want 1", n)
+	}
+	if sess, ok := lnsTunl.FindSessionByPeerID(10); !ok || sess.State() != SessionStateEstablished {
+		t.Errorf("LNS FindSessionByPeerID(10): got %v %v", sess, ok)
+	}
+	if sess, ok := tunl.FindSessionByPeerID(20); !ok || sess != sessions[0] {
+		t.Errorf("LAC FindSessionByPeerID(20): got %v %v", sess, ok)
+	}
+	if _, ok := tunl.FindSession("s1"); ok {
+		t.Errorf("LAC FindSession() found rejected session")
+	}
+}
+
+func TestV3EthernetSession(t *testing.T) {
+	cases := []struct {
+		name       string
+		lnsCaps    []PseudowireType
+		lnsCookie  []byte
+		l2Spec     L2SpecType
+		fallback   []PseudowireType
+		pseudowire PseudowireType
+		expectUp   bool
+		result     string
+	}{
+		{
+			name:      "Accept",
+			lnsCookie: []byte{0xa, 0xb, 0xc, 0xd},
+			expectUp:  true,
+		},
+		{
+			name:     "LNS assigns no cookie",
+			expectUp: true,
+		},
+		{
+			name:     "Default L2-Specific Sublayer",
+			l2Spec:   L2SpecTypeDefault,
+			expectUp: true,
+		},
+		{
+			name:    "LNS doesn't support Ethernet",
+			lnsCaps: []PseudowireType{PseudowireTypePPP},
+			result:  "result 14 ",
+		},
+		{
+			name:       "Fall back to PPP",
+			lnsCaps:    []PseudowireType{PseudowireTypePPP},
+			fallback:   []PseudowireType{PseudowireTypePPP},
+			pseudowire: PseudowireTypePPP,
+			expectUp:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+			lnsEvents := newTestEventCollector()
+			lnsCtx.RegisterEventHandler(lnsEvents)
+			acceptor := &testSessionAcceptor{
+				calls: make(chan *IncomingCall, 1),
+				decision: &CallDecision{
+					Accept:        true,
+					SessionConfig: &SessionConfig{Cookie: c.lnsCookie},
+				},
+			}
+			lnsCtx.SetSessionAcceptor(acceptor)
+
+			lcfg := &TunnelConfig{
+				Local:          "127.0.0.1:9060",
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				PseudowireCaps: c.lnsCaps,
+			}
+			_, err = lnsCtx.NewListener("lns", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%v): %v", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestEventCollector()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			cfg := &TunnelConfig{
+				Local:          "127.0.0.1:9061",
+				Peer:           "127.0.0.1:9060",
+				Version:        ProtocolVersion3,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			tunl, err := lacCtx.NewDynamicTunnel("t1", cfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%v): %v", cfg, err)
+			}
+
+			scfg := &SessionConfig{
+				Pseudowire:         PseudowireTypeEth,
+				Cookie:             []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				PeerCookie:         []byte{9, 9, 9, 9},
+				RemoteEndID:        []byte("circuit1"),
+				L2SpecType:         c.l2Spec,
+				PseudowireFallback: c.fallback,
+			}
+			doneChan := make(chan error, 1)
+			_, err = tunl.NewSessionAsync("s1", scfg, func(err error) { doneChan <- err })
+			if err != nil {
+				t.Fatalf("NewSessionAsync(): %v", err)
+			}
+
+			var result error
+			select {
+			case result = <-doneChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for session")
+			}
+
+			if !c.expectUp {
+				if result == nil {
+					t.Fatalf("session established, expected failure")
+				}
+				if !strings.HasPrefix(result.Error(), c.result) {
+					t.Errorf("session failed with %q, want %q", result, c.result)
+				}
+				if n := len(acceptor.calls); n != 0 {
+					t.Errorf("LNS received %v calls, want 0", n)
+				}
+				return
+			}
+
+			if result != nil {
+				t.Fatalf("session failed: %v", result)
+			}
+			pw := c.pseudowire
+			if pw == 0 {
+				pw = PseudowireTypeEth
+			}
+			call := <-acceptor.calls
+			if call.Pseudowire != pw || !bytes.Equal(call.RemoteEndID, scfg.RemoteEndID) {
+				t.Errorf("unexpected incoming call %+v", call)
+			}
+
+			lacUp := lacEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+			lnsUp := lnsEvents.next(t, &SessionUpEvent{}).(*SessionUpEvent)
+			if v := lnsUp.TunnelConfig.Version; v != ProtocolVersion3 {
+				t.Errorf("LNS tunnel version %v, want %v", v, ProtocolVersion3)
+			}
+			for _, ev := range []*SessionUpEvent{lacUp, lnsUp} {
+				if ev.SessionConfig.Pseudowire != pw {
+					t.Errorf("%v: pseudowire %v, want %v", ev.SessionName,
+						ev.SessionConfig.Pseudowire, pw)
+				}
+				if ev.SessionConfig.L2SpecType != c.l2Spec {
+					t.Errorf("%v: L2SpecType %v, want %v", ev.SessionName,
+						ev.SessionConfig.L2SpecType, c.l2Spec)
+				}
+			}
+			// The LAC's tunnel socket is connected, so the session MTU is
+			// derived from the path MTU
+			if lacUp.SessionConfig.MTU == 0 {
+				t.Errorf("LAC session MTU unset")
+			}
+			if !bytes.Equal(lacUp.SessionConfig.PeerCookie, acceptor.decision.SessionConfig.Cookie) {
+				t.Errorf("LAC peer cookie %x, want %x", lacUp.SessionConfig.PeerCookie,
+					acceptor.decision.SessionConfig.Cookie)
+			}
+			if !bytes.Equal(lnsUp.SessionConfig.PeerCookie, scfg.Cookie) {
+				t.Errorf("LNS peer cookie %x, want %x", lnsUp.SessionConfig.PeerCookie, scfg.Cookie)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is the struct mmsghdr of the message vectors passed to the
+// recvmmsg and sendmmsg system calls.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// recvBatch holds the buffers into which a batch of packets is received
+// by a single call to recvmmsg.
+type recvBatch struct {
+	msgs []mmsghdr
+	iovs []unix.Iovec
+	bufs [][]byte
+}
+
+func newRecvBatch(count, size int) *recvBatch {
+	rb := &recvBatch{
+		msgs: make([]mmsghdr, count),
+		iovs: make([]unix.Iovec, count),
+		bufs: make([][]byte, count),
+	}
+	for i := range rb.msgs {
+		rb.bufs[i] = make([]byte, size)
+		rb.iovs[i].Base = &rb.bufs[i][0]
+		rb.iovs[i].SetLen(size)
+		rb.msgs[i].hdr.Iov = &rb.iovs[i]
+		rb.msgs[i].hdr.SetIovlen(1)
+	}
+	return rb
+}
+
+// packet returns the i'th packet received by the most recent call to
+// recvmmsg.
+func (rb *recvBatch) packet(i int) []byte {
+	return rb.bufs[i][:rb.msgs[i].len]
+}
+
+// recvmmsg receives a batch of packets from the control plane's socket,
+// blocking until at least one is available, and returns the number of
+// packets received.  The source addresses of the packets aren't
+// reported, so recvmmsg is only used with connected sockets.
+func (cp *controlPlane) recvmmsg(rb *recvBatch) (n int, err error) {
+	cerr := cp.rc.Read(func(fd uintptr) bool {
+		n, err = recvmmsg(int(fd), rb.msgs, 0)
+		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, cerr
+}
+
+func recvmmsg(fd int, msgs []mmsghdr, flags int) (int, error) {
+	n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd),
+		uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// sendmmsg sends a batch of packets using a single system call, each
+// packet being gathered from the buffers of an element of pkts.  If oobs
+// is non-nil each packet is sent with the ancillary data of the matching
+// element of oobs.  The packets are addressed to the peer if to is
+// non-nil.  It returns the number of packets sent, which is less than the
+// number passed if sending a packet failed: an error is returned only if
+// the first packet couldn't be sent.
+func sendmmsg(fd int, pkts [][][]byte, oobs [][]byte, to unix.Sockaddr, flags int) (int, error) {
+	var name *byte
+	var namelen uint32
+	if to != nil {
+		var err error
+		if name, namelen, err = rawSockaddr(to); err != nil {
+			return 0, err
+		}
+	}
+
+	msgs := make([]mmsghdr, len(pkts))
+	for i, pkt := range pkts {
+		iovs := make([]unix.Iovec, 0, len(pkt))
+		for _, b := range pkt {
+			if len(b) > 0 {
+				iov := unix.Iovec{Base: &b[0]}
+				iov.SetLen(len(b))
+				iovs = append(iovs, iov)
+			}
+		}
+		if len(iovs) > 0 {
+			msgs[i].hdr.Iov = &iovs[0]
+			msgs[i].hdr.SetIovlen(len(iovs))
+		}
+		msgs[i].hdr.Name = name
+		msgs[i].hdr.Namelen = namelen
+		if oobs != nil && len(oobs[i]) > 0 {
+			msgs[i].hdr.Control = &oobs[i][0]
+			msgs[i].hdr.SetControllen(len(oobs[i]))
+		}
+	}
+
+	n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd),
+		uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// rawSockaddr converts an IP socket address into the struct sockaddr
+// passed to the kernel.
+func rawSockaddr(sa unix.Sockaddr) (*byte, uint32, error) {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		raw := &unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: sa.Addr}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&raw.Port))[:], uint16(sa.Port))
+		return (*byte)(unsafe.Pointer(raw)), unix.SizeofSockaddrInet4, nil
+	case *unix.SockaddrInet6:
+		raw := &unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: sa.Addr, Scope_id: sa.ZoneId}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&raw.Port))[:], uint16(sa.Port))
+		return (*byte)(unsafe.Pointer(raw)), unix.SizeofSockaddrInet6, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported socket address %T", sa)
+}
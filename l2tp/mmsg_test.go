@@ -0,0 +1,74 @@
+package l2tp
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMmsg(t *testing.T) {
+	cases := []struct {
+		name     string
+		family   int
+		sal, sap unix.Sockaddr
+	}{
+		{
+			name:   "IPv4",
+			family: unix.AF_INET,
+			sal:    &unix.SockaddrInet4{Port: 9077, Addr: [4]byte{127, 0, 0, 1}},
+			sap:    &unix.SockaddrInet4{Port: 9078, Addr: [4]byte{127, 0, 0, 1}},
+		},
+		{
+			name:   "IPv6",
+			family: unix.AF_INET6,
+			sal:    &unix.SockaddrInet6{Port: 9077, Addr: [16]byte{15: 1}},
+			sap:    &unix.SockaddrInet6{Port: 9078, Addr: [16]byte{15: 1}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var fds []int
+			for _, sa := range []unix.Sockaddr{c.sal, c.sap} {
+				fd, err := unix.Socket(c.family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+				if err != nil {
+					t.Fatalf("socket(): %v", err)
+				}
+				defer unix.Close(fd)
+				if err = unix.Bind(fd, sa); err != nil {
+					t.Skipf("skipping test because bind() failed: %v", err)
+				}
+				fds = append(fds, fd)
+			}
+
+			var pkts [][][]byte
+			for i := 0; i < 3; i++ {
+				pkts = append(pkts, [][]byte{{0, byte(i)}, bytes.Repeat([]byte{byte(i)}, 10*i)})
+			}
+			n, err := sendmmsg(fds[0], pkts, nil, c.sap, 0)
+			if err != nil || n != len(pkts) {
+				t.Fatalf("sendmmsg(): got %v, %v, want %v", n, err, len(pkts))
+			}
+
+			rb := newRecvBatch(userspaceBatchLen, 64)
+			got := 0
+			for got < len(pkts) {
+				n, err = recvmmsg(fds[1], rb.msgs, unix.MSG_WAITFORONE)
+				if err != nil {
+					t.Fatalf("recvmmsg(): %v", err)
+				}
+				for i := 0; i < n; i++ {
+					want := append(append([]byte{}, pkts[got][0]...), pkts[got][1]...)
+					if !bytes.Equal(rb.packet(i), want) {
+						t.Errorf("packet %v: got %x, want %x", got, rb.packet(i), want)
+					}
+					got++
+				}
+			}
+		})
+	}
+
+	if _, _, err := rawSockaddr(&unix.SockaddrUnix{Name: "/tmp/l2tp"}); err == nil {
+		t.Errorf("rawSockaddr(): expected error for unix socket address")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
 // L2TPv2 and L2TPv3 headers have these fields in common
@@ -203,10 +204,148 @@ func v3HelloMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v3SccrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.1 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeTiebreaker] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3SccrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.2 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3ScccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.3 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
+func v3StopccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.4 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedConnID] = mayExist
+	return &spec
+}
+
+func v3IcrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.6 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypePseudowireType] = mustExist
+	spec.m[avpTypeRemoteEndID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IcrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.7 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.8 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypeCircuitStatus] = mayExist
+	return &spec
+}
+
+func v3CdnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.11 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
 func getV3MsgSpec(t avpMsgType) (*msgSpec, error) {
 	switch t {
+	case avpMsgTypeSccrq:
+		return v3SccrqMsgSpec(), nil
+	case avpMsgTypeSccrp:
+		return v3SccrpMsgSpec(), nil
+	case avpMsgTypeScccn:
+		return v3ScccnMsgSpec(), nil
+	case avpMsgTypeStopccn:
+		return v3StopccnMsgSpec(), nil
 	case avpMsgTypeHello:
 		return v3HelloMsgSpec(), nil
+	case avpMsgTypeIcrq:
+		return v3IcrqMsgSpec(), nil
+	case avpMsgTypeIcrp:
+		return v3IcrpMsgSpec(), nil
+	case avpMsgTypeIccn:
+		return v3IccnMsgSpec(), nil
+	case avpMsgTypeCdn:
+		return v3CdnMsgSpec(), nil
 	}
 	return nil, fmt.Errorf("no specification for v3 message %v", t)
 }
@@ -231,6 +370,10 @@ func validateAvps(avps []avp, spec *msgSpec) error {
 	}
 
 	for _, avp := range avps {
+		// Duplicates ignored by the duplicate AVP policy aren't validated
+		if avp.superseded {
+			continue
+		}
 		as, ok := spec.hasAvp(avp.getType())
 		if !ok {
 			// RFC2661 section 4.1 says we MUST tear down the tunnel on receipt of
@@ -285,7 +428,7 @@ func newL2tpV3MessageHeader(ccid uint32, ns, nr uint16, payloadBytes int) *l2tpV
 	}
 }
 
-func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
+func bytesToV2CtlMsg(b []byte, opts *parserOptions) (msg *v2ControlMessage, err error) {
 	var hdr l2tpV2Header
 	var avps []avp
 
@@ -297,7 +440,7 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 	// Messages with no AVP payload are treated as ZLB (zero-length-body) ack messages,
 	// so they're valid L2TPv2 messages.  Don't try to parse the AVP payload in this case.
 	if hdr.Common.Len > v2HeaderLen {
-		if avps, err = parseAVPBuffer(b[v2HeaderLen:hdr.Common.Len]); err != nil {
+		if avps, err = parseAVPBuffer(b[v2HeaderLen:hdr.Common.Len], opts); err != nil {
 			return nil, err
 		}
 		// RFC2661 says the first AVP in the message MUST be the Message Type AVP,
@@ -305,6 +448,9 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 		if avps[0].getType() != avpTypeMessage {
 			return nil, errors.New("invalid L2TPv2 message: first AVP is not Message Type AVP")
 		}
+		if _, err = avps[0].decodeMsgType(); err != nil {
+			return nil, fmt.Errorf("invalid L2TPv2 message: bad Message Type AVP: %v", err)
+		}
 	}
 
 	return &v2ControlMessage{
@@ -313,7 +459,7 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 	}, nil
 }
 
-func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
+func bytesToV3CtlMsg(b []byte, opts *parserOptions) (msg *v3ControlMessage, err error) {
 	var hdr l2tpV3Header
 	var avps []avp
 
@@ -322,7 +468,7 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 		return nil, err
 	}
 
-	if avps, err = parseAVPBuffer(b[v3HeaderLen:hdr.Common.Len]); err != nil {
+	if avps, err = parseAVPBuffer(b[v3HeaderLen:hdr.Common.Len], opts); err != nil {
 		return nil, err
 	}
 
@@ -331,6 +477,9 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 	if avps[0].getType() != avpTypeMessage {
 		return nil, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
 	}
+	if _, err = avps[0].decodeMsgType(); err != nil {
+		return nil, fmt.Errorf("invalid L2TPv3 message: bad Message Type AVP: %v", err)
+	}
 
 	return &v3ControlMessage{
 		header: hdr,
@@ -544,15 +693,80 @@ func (m *v3ControlMessage) validate() error {
 	return validateAvps(m.avps, spec)
 }
 
+// Default parser limits, which apply if the tunnel configuration doesn't
+// set them.  An AVP's payload can't exceed the length the AVP header
+// is able to express, so its size is unlimited by default.
+const (
+	defaultMaxMessagesPerDatagram = 32
+	defaultMaxAVPsPerMessage      = 256
+	defaultMaxAVPLen              = 0x3ff - avpHeaderLen
+)
+
+// ParserLimitError is returned when a datagram received from the peer
+// exceeds one of the parser limits set by the tunnel configuration.  The
+// datagram is discarded.
+type ParserLimitError struct {
+	// Limit describes the limit which was exceeded.
+	Limit string
+	// Max is the value of the limit.
+	Max int
+}
+
+func (e *ParserLimitError) Error() string {
+	return fmt.Sprintf("parser limit exceeded: more than %d %s", e.Max, e.Limit)
+}
+
+// parserOptions bounds the work the parser does for a received datagram,
+// and determines how duplicate AVPs are interpreted.
+type parserOptions struct {
+	maxMessages int
+	maxAVPs     int
+	maxAVPLen   int
+	duplicates  DuplicateAVPPolicy
+}
+
+// defaultParserOptions are used when parsing messages for which there is
+// no tunnel configuration.
+var defaultParserOptions = parserOptions{
+	maxMessages: defaultMaxMessagesPerDatagram,
+	maxAVPs:     defaultMaxAVPsPerMessage,
+	maxAVPLen:   defaultMaxAVPLen,
+}
+
+// newParserOptions returns the parser options set by the tunnel
+// configuration, using the defaults for limits which aren't set.
+func newParserOptions(cfg *TunnelConfig) *parserOptions {
+	opts := defaultParserOptions
+	opts.duplicates = cfg.DuplicateAVPs
+	if cfg.MaxMessagesPerDatagram > 0 {
+		opts.maxMessages = cfg.MaxMessagesPerDatagram
+	}
+	if cfg.MaxAVPsPerMessage > 0 {
+		opts.maxAVPs = cfg.MaxAVPsPerMessage
+	}
+	if cfg.MaxAVPLen > 0 {
+		opts.maxAVPLen = cfg.MaxAVPLen
+	}
+	return &opts
+}
+
 // parseMessageBuffer takes a byte slice of L2TP control message data and
 // parses it into an array of controlMessage instances.
-func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
+// If opts is nil the default parser options apply.
+func parseMessageBuffer(b []byte, opts *parserOptions) (messages []controlMessage, err error) {
+	if opts == nil {
+		opts = &defaultParserOptions
+	}
 	r := bytes.NewReader(b)
 	for r.Len() >= controlMessageMinLen {
 		var ver ProtocolVersion
 		var h l2tpCommonHeader
 		var cursor int64
 
+		if len(messages) == opts.maxMessages {
+			return nil, &ParserLimitError{Limit: "messages per datagram", Max: opts.maxMessages}
+		}
+
 		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
 			return nil, errors.New("malformed message buffer: unable to determine current offset")
 		}
@@ -575,13 +789,13 @@ func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
 
 		if ver == ProtocolVersion2 {
 			var msg *v2ControlMessage
-			if msg, err = bytesToV2CtlMsg(b[cursor : cursor+int64(h.Len)]); err != nil {
+			if msg, err = bytesToV2CtlMsg(b[cursor:cursor+int64(h.Len)], opts); err != nil {
 				return nil, err
 			}
 			messages = append(messages, msg)
 		} else if ver == ProtocolVersion3 {
 			var msg *v3ControlMessage
-			if msg, err = bytesToV3CtlMsg(b[cursor : cursor+int64(+h.Len)]); err != nil {
+			if msg, err = bytesToV3CtlMsg(b[cursor:cursor+int64(+h.Len)], opts); err != nil {
 				return nil, err
 			}
 			messages = append(messages, msg)
@@ -590,7 +804,7 @@ func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
 		}
 
 		// Step on to the next message in the buffer, if any
-		if _, err := r.Seek(int64(h.Len), io.SeekCurrent); err != nil {
+		if _, err := r.Seek(cursor+int64(h.Len), io.SeekStart); err != nil {
 			return nil, errors.New("malformed message buffer: invalid length for current message")
 		}
 	}
@@ -631,8 +845,28 @@ func buildV2Msg(ptid ControlConnID, psid ControlConnID, in []avpIn) (msg *v2Cont
 	return
 }
 
-// newV2Sccrq builds a new SCCRQ message
-func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+// appendExtraAvps appends any application-supplied AVPs for the
+// specified message type.
+func appendExtraAvps(msg controlMessage, extra []ExtraAVP, mt MessageType) error {
+	for i := range extra {
+		for _, t := range extra[i].Messages {
+			if t != mt {
+				continue
+			}
+			avp, err := newExtraAvp(&extra[i])
+			if err != nil {
+				return fmt.Errorf("failed to create extra AVP %v:%v: %v",
+					extra[i].VendorID, extra[i].Type, err)
+			}
+			msg.appendAvp(avp)
+		}
+	}
+	return nil
+}
+
+// newV2Sccrq builds a new SCCRQ message.  The Tie Breaker and Challenge
+// AVPs are included if tieBreaker and challenge respectively are non-nil.
+func newV2Sccrq(cfg *TunnelConfig, tieBreaker, challenge []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -657,11 +891,26 @@ func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeFramingCap, uint32(cfg.FramingCaps)},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
-	return buildV2Msg(0, 0, in)
+	if tieBreaker != nil {
+		in = append(in, avpIn{avpTypeTiebreaker, tieBreaker})
+	}
+	if challenge != nil {
+		in = append(in, avpIn{avpTypeChallenge, challenge})
+	}
+	msg, err = buildV2Msg(0, 0, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, cfg.ExtraAVPs, MessageTypeSCCRQ); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-// newV2Sccrp builds a new SCCRP message
-func newV2Sccrp(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+// newV2Sccrp builds a new SCCRP message.  The Challenge and Challenge
+// Response AVPs are included if challenge and response respectively
+// are non-nil.
+func newV2Sccrp(cfg *TunnelConfig, challenge, response []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -686,11 +935,25 @@ func newV2Sccrp(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeHostName, cfg.HostName},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
-	return buildV2Msg(cfg.PeerTunnelID, 0, in)
+	if challenge != nil {
+		in = append(in, avpIn{avpTypeChallenge, challenge})
+	}
+	if response != nil {
+		in = append(in, avpIn{avpTypeChallengeResponse, response})
+	}
+	msg, err = buildV2Msg(cfg.PeerTunnelID, 0, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, cfg.ExtraAVPs, MessageTypeSCCRP); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-// newV2Scccn builds a new SCCCN message
-func newV2Scccn(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+// newV2Scccn builds a new SCCCN message.  The Challenge Response AVP
+// is included if response is non-nil.
+func newV2Scccn(cfg *TunnelConfig, response []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -703,6 +966,9 @@ func newV2Scccn(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 	in := []avpIn{
 		{avpTypeMessage, avpMsgTypeScccn},
 	}
+	if response != nil {
+		in = append(in, avpIn{avpTypeChallengeResponse, response})
+	}
 	return buildV2Msg(cfg.PeerTunnelID, 0, in)
 }
 
@@ -758,7 +1024,14 @@ func newV2Icrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg
 		{avpTypeSessionID, uint16(scfg.SessionID)},
 		{avpTypeCallSerialNumber, callSerial},
 	}
-	return buildV2Msg(ptid, 0, in)
+	msg, err = buildV2Msg(ptid, 0, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, scfg.ExtraAVPs, MessageTypeICRQ); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
 // newV2Icrp builds a new ICRP message
@@ -799,10 +1072,32 @@ func newV2Iccn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage,
 	*/
 	in := []avpIn{
 		{avpTypeMessage, avpMsgTypeIccn},
-		{avpTypeConnectSpeed, uint32(0)},                               // TODO: config field?
+		{avpTypeConnectSpeed, v2ConnectSpeed(scfg.TxConnectSpeed)},
 		{avpTypeFramingType, uint32(FramingCapSync | FramingCapAsync)}, // TODO: config field?
 	}
-	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+	if scfg.RxConnectSpeed > 0 {
+		in = append(in, avpIn{avpTypeRxConnectSpeed, v2ConnectSpeed(scfg.RxConnectSpeed)})
+	}
+	if scfg.SeqNum {
+		in = append(in, avpIn{avpTypeSequencingRequired, nil})
+	}
+	msg, err = buildV2Msg(ptid, scfg.PeerSessionID, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, scfg.ExtraAVPs, MessageTypeICCN); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// v2ConnectSpeed limits a connect speed to the 32 bit range of the L2TPv2
+// Connect Speed AVPs.
+func v2ConnectSpeed(bps uint64) uint32 {
+	if bps > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(bps)
 }
 
 // newV2Cdn builds a new CDN message
@@ -832,3 +1127,422 @@ func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage,
 		avps:   avps,
 	}, nil
 }
+
+func buildV3Msg(pccid ControlConnID, in []avpIn) (msg *v3ControlMessage, err error) {
+	msg, err = newV3ControlMessage(pccid, []avp{})
+	if err != nil {
+		return
+	}
+	for _, i := range in {
+		avp, err := newAvp(vendorIDIetf, i.typ, i.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AVP %v: %v", i.typ, err)
+		}
+		msg.appendAvp(avp)
+	}
+	return
+}
+
+// v3PseudowireCaps returns the Pseudowire Capabilities List AVP value
+// for a tunnel configuration.
+func v3PseudowireCaps(cfg *TunnelConfig) []uint16 {
+	if len(cfg.PseudowireCaps) == 0 {
+		return []uint16{uint16(PseudowireTypePPP), uint16(PseudowireTypeEth), uint16(PseudowireTypeEthVLAN)}
+	}
+	caps := make([]uint16, len(cfg.PseudowireCaps))
+	for i, pw := range cfg.PseudowireCaps {
+		caps[i] = uint16(pw)
+	}
+	return caps
+}
+
+// newV3Sccrq builds a new L2TPv3 SCCRQ message.  The Control Connection
+// Tie Breaker and Control Message Authentication Nonce AVPs are included
+// if tieBreaker and nonce respectively are non-nil.
+func newV3Sccrq(cfg *TunnelConfig, tieBreaker, nonce []byte) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Control Connection Tie Breaker
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrq},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, cfg.RouterID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps(cfg)},
+	}
+	if tieBreaker != nil {
+		in = append(in, avpIn{avpTypeTiebreaker, tieBreaker})
+	}
+	if nonce != nil {
+		in = append(in, avpIn{avpTypeControlAuthNonce, nonce})
+	}
+	msg, err = buildV3Msg(0, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, cfg.ExtraAVPs, MessageTypeSCCRQ); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newV3Sccrp builds a new L2TPv3 SCCRP message.  The Control Message
+// Authentication Nonce AVP is included if nonce is non-nil.
+func newV3Sccrp(cfg *TunnelConfig, nonce []byte) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrp},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, cfg.RouterID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps(cfg)},
+	}
+	if nonce != nil {
+		in = append(in, avpIn{avpTypeControlAuthNonce, nonce})
+	}
+	msg, err = buildV3Msg(cfg.PeerTunnelID, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, cfg.ExtraAVPs, MessageTypeSCCRP); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newV3Scccn builds a new L2TPv3 SCCCN message
+func newV3Scccn(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeScccn},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Stopccn builds a new L2TPv3 StopCCN message
+func newV3Stopccn(rc *resultCode, cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Control Connection ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeStopccn},
+		{avpTypeResultCode, rc},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Hello builds a new L2TPv3 HELLO message
+func newV3Hello(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeHello},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// Flags carried by the Circuit Status AVP.
+const (
+	v3CircuitStatusActive = uint16(0x1)
+	v3CircuitStatusNew    = uint16(0x2)
+)
+
+// Values of the Data Sequencing AVP.
+const (
+	v3DataSequencingNone = uint16(0)
+	v3DataSequencingAll  = uint16(2)
+)
+
+// Values of the L2-Specific Sublayer AVP.
+const (
+	v3L2SpecSublayerNone    = uint16(0)
+	v3L2SpecSublayerDefault = uint16(1)
+)
+
+// v3SessionAvps returns the optional AVPs describing the local session
+// parameters which are common to the ICRQ, ICRP and ICCN messages.
+func v3SessionAvps(scfg *SessionConfig, withCookie bool) (in []avpIn) {
+	if withCookie && len(scfg.Cookie) > 0 {
+		in = append(in, avpIn{avpTypeAssignedCookie, scfg.Cookie})
+	}
+	if scfg.L2SpecType == L2SpecTypeDefault {
+		in = append(in, avpIn{avpTypeL2specificSublayer, v3L2SpecSublayerDefault})
+	}
+	if scfg.SeqNum {
+		in = append(in, avpIn{avpTypeDataSequencing, v3DataSequencingAll})
+	}
+	if scfg.TxConnectSpeed > 0 {
+		in = append(in, avpIn{avpTypeTxConnectSpeedBps, scfg.TxConnectSpeed})
+	}
+	if scfg.RxConnectSpeed > 0 {
+		in = append(in, avpIn{avpTypeRxConnectSpeedBps, scfg.RxConnectSpeed})
+	}
+	return
+}
+
+// newV3Icrq builds a new L2TPv3 ICRQ message
+func newV3Icrq(callSerial uint32, pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Serial Number
+	- Pseudowire Type
+	- Remote End ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- Session Tie Breaker
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrq},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(0)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypePseudowireType, uint16(scfg.Pseudowire)},
+		{avpTypeRemoteEndID, scfg.RemoteEndID},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	in = append(in, v3SessionAvps(scfg, true)...)
+	msg, err = buildV3Msg(pccid, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, scfg.ExtraAVPs, MessageTypeICRQ); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newV3Icrp builds a new L2TPv3 ICRP message
+func newV3Icrp(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrp},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	in = append(in, v3SessionAvps(scfg, true)...)
+	return buildV3Msg(pccid, in)
+}
+
+// newV3Iccn builds a new L2TPv3 ICCN message
+func newV3Iccn(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Circuit Status
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIccn},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	in = append(in, v3SessionAvps(scfg, false)...)
+	msg, err = buildV3Msg(pccid, in)
+	if err != nil {
+		return nil, err
+	}
+	if err = appendExtraAvps(msg, scfg.ExtraAVPs, MessageTypeICCN); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newV3Cdn builds a new L2TPv3 CDN message
+func newV3Cdn(pccid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeCdn},
+		{avpTypeResultCode, rc},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	return buildV3Msg(pccid, in)
+}
+
+// newIcrq, newIcrp, newIccn and newCdn build session messages of the
+// specified protocol version.
+func newIcrq(version ProtocolVersion, callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (controlMessage, error) {
+	if version == ProtocolVersion3 {
+		return newV3Icrq(callSerial, ptid, scfg)
+	}
+	return newV2Icrq(callSerial, ptid, scfg)
+}
+
+func newIcrp(version ProtocolVersion, ptid ControlConnID, scfg *SessionConfig) (controlMessage, error) {
+	if version == ProtocolVersion3 {
+		return newV3Icrp(ptid, scfg)
+	}
+	return newV2Icrp(ptid, scfg)
+}
+
+func newIccn(version ProtocolVersion, ptid ControlConnID, scfg *SessionConfig) (controlMessage, error) {
+	if version == ProtocolVersion3 {
+		return newV3Iccn(ptid, scfg)
+	}
+	return newV2Iccn(ptid, scfg)
+}
+
+func newCdn(version ProtocolVersion, ptid ControlConnID, rc *resultCode, scfg *SessionConfig) (controlMessage, error) {
+	if version == ProtocolVersion3 {
+		return newV3Cdn(ptid, rc, scfg)
+	}
+	return newV2Cdn(ptid, rc, scfg)
+}
+
+// sessionMsgSid returns the local session ID a session message is
+// addressed to.  L2TPv2 carries this in the message header, whereas
+// L2TPv3 uses the Remote Session ID AVP.
+func sessionMsgSid(msg controlMessage) ControlConnID {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Sid())
+	case *v3ControlMessage:
+		sid, _ := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeRemoteSessionID)
+		return ControlConnID(sid)
+	}
+	return 0
+}
+
+// sessionMsgPeerSid returns the peer's session ID from a session message.
+// L2TPv2 carries this in the Assigned Session ID AVP, and L2TPv3 in the
+// Local Session ID AVP.
+func sessionMsgPeerSid(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		psid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeLocalSessionID)
+		return ControlConnID(psid), err
+	}
+	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	return ControlConnID(psid), err
+}
+
+// tunnelMsgTid returns the local tunnel ID a control message is addressed
+// to, being the Tunnel ID for L2TPv2 and the Control Connection ID for
+// L2TPv3.
+func tunnelMsgTid(msg controlMessage) ControlConnID {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Tid())
+	case *v3ControlMessage:
+		return ControlConnID(m.ControlConnectionID())
+	}
+	return 0
+}
+
+// tunnelMsgPeerTid returns the peer's tunnel ID from a tunnel message.
+// L2TPv2 carries this in the Assigned Tunnel ID AVP, and L2TPv3 in the
+// Assigned Control Connection ID AVP.
+func tunnelMsgPeerTid(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		ptid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeAssignedConnID)
+		return ControlConnID(ptid), err
+	}
+	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	return ControlConnID(ptid), err
+}
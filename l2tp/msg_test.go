@@ -2,6 +2,13 @@ package l2tp
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -62,7 +69,7 @@ func TestParseMessageBuffer(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseMessageBuffer(c.in)
+		got, err := parseMessageBuffer(c.in, nil)
 		if err == nil {
 			for i, g := range got {
 				// common checks
@@ -123,6 +130,74 @@ type msgTestAvpMetadata struct {
 	data                  interface{}
 }
 
+func TestParserLimits(t *testing.T) {
+	tcfg := &TunnelConfig{HostName: "lac", TunnelID: 42}
+	sccrq, err := newV3Sccrq(tcfg, nil, bytes.Repeat([]byte{0xaa}, 16))
+	if err != nil {
+		t.Fatalf("newV3Sccrq(): %v", err)
+	}
+	b, err := sccrq.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+	navps := len(sccrq.getAvps())
+
+	cases := []struct {
+		name  string
+		in    []byte
+		cfg   *TunnelConfig
+		limit string
+	}{
+		{
+			name: "Defaults",
+			in:   b,
+			cfg:  &TunnelConfig{},
+		},
+		{
+			name: "Within limits",
+			in:   append(append([]byte{}, b...), b...),
+			cfg: &TunnelConfig{
+				MaxMessagesPerDatagram: 2,
+				MaxAVPsPerMessage:      navps,
+				MaxAVPLen:              16,
+			},
+		},
+		{
+			name:  "Too many messages",
+			in:    append(append([]byte{}, b...), b...),
+			cfg:   &TunnelConfig{MaxMessagesPerDatagram: 1},
+			limit: "messages per datagram",
+		},
+		{
+			name:  "Too many AVPs",
+			in:    b,
+			cfg:   &TunnelConfig{MaxAVPsPerMessage: navps - 1},
+			limit: "AVPs per message",
+		},
+		{
+			name:  "AVP too long",
+			in:    b,
+			cfg:   &TunnelConfig{MaxAVPLen: 15},
+			limit: "bytes of AVP payload",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseMessageBuffer(c.in, newParserOptions(c.cfg))
+			if c.limit == "" {
+				if err != nil {
+					t.Errorf("parseMessageBuffer(): %v", err)
+				}
+				return
+			}
+			lerr, ok := err.(*ParserLimitError)
+			if !ok || lerr.Limit != c.limit {
+				t.Errorf("parseMessageBuffer(): got %v, want %q limit exceeded", err, c.limit)
+			}
+		})
+	}
+}
+
 func TestV2MessageBuild(t *testing.T) {
 	cases := []struct {
 		tid  ControlConnID
@@ -200,7 +275,7 @@ func TestParseEncode(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got, err := parseMessageBuffer(c.in)
+		got, err := parseMessageBuffer(c.in, nil)
 		if err != nil {
 			t.Fatalf("parseMessageBuffer(%v) failed: %v", c.in, err)
 		}
@@ -231,13 +306,22 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 			rc:   resultCode{},
 			buildersGood: []func(*TunnelConfig, *resultCode) (*v2ControlMessage, error){
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Sccrq(tcfg)
+					return newV2Sccrq(tcfg, nil, nil)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
+					return newV2Sccrq(tcfg, []byte{1, 2, 3, 4, 5, 6, 7, 8}, bytes.Repeat([]byte{0xaa}, 16))
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
+					return newV2Sccrp(tcfg, nil, nil)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
+					return newV2Sccrp(tcfg, bytes.Repeat([]byte{0xaa}, 16), bytes.Repeat([]byte{0x55}, 16))
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Sccrp(tcfg)
+					return newV2Scccn(tcfg, nil)
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Scccn(tcfg)
+					return newV2Scccn(tcfg, bytes.Repeat([]byte{0x55}, 16))
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
 					return newV2Stopccn(rc, tcfg)
@@ -261,3 +345,526 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestV3TunnelBuildValidate(t *testing.T) {
+	tcfg := &TunnelConfig{
+		HostName:     "lac.example.com",
+		TunnelID:     90210,
+		PeerTunnelID: 42,
+		RouterID:     0x0a000001,
+	}
+	rc := &resultCode{result: avpStopCCNResultCodeClearConnection}
+	tieBreaker := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	nonce := bytes.Repeat([]byte{0xaa}, 16)
+
+	cases := []struct {
+		build   func() (*v3ControlMessage, error)
+		ccid    uint32
+		avpType avpType
+		want    interface{}
+	}{
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Sccrq(tcfg, nil, nil)
+			},
+			avpType: avpTypePseudowireCaps,
+			want:    []uint16{uint16(PseudowireTypePPP), uint16(PseudowireTypeEth), uint16(PseudowireTypeEthVLAN)},
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Sccrq(tcfg, tieBreaker, nonce)
+			},
+			avpType: avpTypeControlAuthNonce,
+			want:    nonce,
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Sccrp(&TunnelConfig{
+					HostName:       tcfg.HostName,
+					TunnelID:       tcfg.TunnelID,
+					PeerTunnelID:   tcfg.PeerTunnelID,
+					PseudowireCaps: []PseudowireType{PseudowireTypeEth},
+				}, nil)
+			},
+			ccid:    42,
+			avpType: avpTypePseudowireCaps,
+			want:    []uint16{uint16(PseudowireTypeEth)},
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Sccrp(tcfg, nonce)
+			},
+			ccid:    42,
+			avpType: avpTypeRouterID,
+			want:    tcfg.RouterID,
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Scccn(tcfg)
+			},
+			ccid:    42,
+			avpType: avpTypeMessage,
+			want:    avpMsgTypeScccn,
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Stopccn(rc, tcfg)
+			},
+			ccid:    42,
+			avpType: avpTypeAssignedConnID,
+			want:    uint32(tcfg.TunnelID),
+		},
+		{
+			build: func() (*v3ControlMessage, error) {
+				return newV3Hello(tcfg)
+			},
+			ccid:    42,
+			avpType: avpTypeMessage,
+			want:    avpMsgTypeHello,
+		},
+	}
+	for i, c := range cases {
+		built, err := c.build()
+		if err != nil {
+			t.Fatalf("builder %v: %v", i, err)
+		}
+		b, err := built.toBytes()
+		if err != nil {
+			t.Fatalf("builder %v: toBytes(): %v", i, err)
+		}
+		msgs, err := parseMessageBuffer(b, nil)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("builder %v: parseMessageBuffer(): got %v messages, %v", i, len(msgs), err)
+		}
+		msg, ok := msgs[0].(*v3ControlMessage)
+		if !ok {
+			t.Fatalf("builder %v: parsed %T, want *v3ControlMessage", i, msgs[0])
+		}
+		if err = msg.validate(); err != nil {
+			t.Fatalf("builder %v: validate(): %v", i, err)
+		}
+		if msg.ControlConnectionID() != c.ccid {
+			t.Errorf("builder %v: control connection ID %v, want %v", i, msg.ControlConnectionID(), c.ccid)
+		}
+		a, err := findAvp(msg.getAvps(), vendorIDIetf, c.avpType)
+		if err != nil {
+			t.Fatalf("builder %v: %v", i, err)
+		}
+		got, err := a.decode()
+		if err != nil {
+			t.Fatalf("builder %v: decode %v: %v", i, c.avpType, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("builder %v: %v: got %v, want %v", i, c.avpType, got, c.want)
+		}
+	}
+}
+
+func TestV3SessionBuildValidate(t *testing.T) {
+	scfg := &SessionConfig{
+		SessionID:     0x10203040,
+		PeerSessionID: 0x50607080,
+		Pseudowire:    PseudowireTypeEth,
+		Cookie:        []byte{1, 2, 3, 4},
+		RemoteEndID:   []byte("circuit-1"),
+		SeqNum:        true,
+	}
+	rc := &resultCode{result: avpCDNResultCodeAdminDisconnect}
+
+	cases := []struct {
+		build      func() (controlMessage, error)
+		msgType    avpMsgType
+		sid        ControlConnID
+		wantCookie bool
+	}{
+		{
+			build: func() (controlMessage, error) {
+				return newIcrq(ProtocolVersion3, 1, 90210, scfg)
+			},
+			msgType:    avpMsgTypeIcrq,
+			sid:        0,
+			wantCookie: true,
+		},
+		{
+			build: func() (controlMessage, error) {
+				return newIcrp(ProtocolVersion3, 90210, scfg)
+			},
+			msgType:    avpMsgTypeIcrp,
+			sid:        scfg.PeerSessionID,
+			wantCookie: true,
+		},
+		{
+			build: func() (controlMessage, error) {
+				return newIccn(ProtocolVersion3, 90210, scfg)
+			},
+			msgType: avpMsgTypeIccn,
+			sid:     scfg.PeerSessionID,
+		},
+		{
+			build: func() (controlMessage, error) {
+				return newCdn(ProtocolVersion3, 90210, rc, scfg)
+			},
+			msgType: avpMsgTypeCdn,
+			sid:     scfg.PeerSessionID,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.msgType.String(), func(t *testing.T) {
+			built, err := c.build()
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			b, err := built.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			msgs, err := parseMessageBuffer(b, nil)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(msgs))
+			}
+			msg := msgs[0]
+			if msg.protocolVersion() != ProtocolVersion3 || msg.getType() != c.msgType {
+				t.Fatalf("got v%v %v, want v3 %v", msg.protocolVersion(), msg.getType(), c.msgType)
+			}
+			if err = msg.validate(); err != nil {
+				t.Fatalf("validate(): %v", err)
+			}
+			if sid := sessionMsgSid(msg); sid != c.sid {
+				t.Errorf("sessionMsgSid(): got %v, want %v", sid, c.sid)
+			}
+			if psid, err := sessionMsgPeerSid(msg); err != nil || psid != scfg.SessionID {
+				t.Errorf("sessionMsgPeerSid(): got %v, %v, want %v", psid, err, scfg.SessionID)
+			}
+			cookie, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeAssignedCookie)
+			if c.wantCookie && (err != nil || !bytes.Equal(cookie, scfg.Cookie)) {
+				t.Errorf("Assigned Cookie: got %v, %v, want %v", cookie, err, scfg.Cookie)
+			} else if !c.wantCookie && err == nil {
+				t.Errorf("unexpected Assigned Cookie AVP")
+			}
+		})
+	}
+
+	// The ICRQ carries the parameters of the requested circuit
+	msg, err := newV3Icrq(1, 90210, scfg)
+	if err != nil {
+		t.Fatalf("newV3Icrq(): %v", err)
+	}
+	avps := msg.getAvps()
+	if pw, err := findUint16Avp(avps, vendorIDIetf, avpTypePseudowireType); err != nil || PseudowireType(pw) != scfg.Pseudowire {
+		t.Errorf("Pseudowire Type: got %v, %v, want %v", pw, err, scfg.Pseudowire)
+	}
+	if id, err := findBytesAvp(avps, vendorIDIetf, avpTypeRemoteEndID); err != nil || !bytes.Equal(id, scfg.RemoteEndID) {
+		t.Errorf("Remote End ID: got %v, %v, want %v", id, err, scfg.RemoteEndID)
+	}
+	if seq, err := findUint16Avp(avps, vendorIDIetf, avpTypeDataSequencing); err != nil || seq != v3DataSequencingAll {
+		t.Errorf("Data Sequencing: got %v, %v, want %v", seq, err, v3DataSequencingAll)
+	}
+	if _, err := findUint16Avp(avps, vendorIDIetf, avpTypeL2specificSublayer); err == nil {
+		t.Errorf("unexpected L2-Specific Sublayer AVP")
+	}
+	sublayer := &SessionConfig{Pseudowire: PseudowireTypeEth, L2SpecType: L2SpecTypeDefault}
+	msg, err = newV3Icrq(1, 90210, sublayer)
+	if err != nil {
+		t.Fatalf("newV3Icrq(): %v", err)
+	}
+	if l2ss, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeL2specificSublayer); err != nil || l2ss != v3L2SpecSublayerDefault {
+		t.Errorf("L2-Specific Sublayer: got %v, %v, want %v", l2ss, err, v3L2SpecSublayerDefault)
+	}
+	if cs, err := findUint16Avp(avps, vendorIDIetf, avpTypeCircuitStatus); err != nil || cs&v3CircuitStatusActive == 0 {
+		t.Errorf("Circuit Status: got %v, %v, want active", cs, err)
+	}
+
+	// Connect speeds are carried as 64 bit values for L2TPv3, and limited
+	// to 32 bits for L2TPv2
+	speeds := &SessionConfig{TxConnectSpeed: 10000000000, RxConnectSpeed: 1000000}
+	msg, err = newV3Iccn(90210, speeds)
+	if err != nil {
+		t.Fatalf("newV3Iccn(): %v", err)
+	}
+	if tx, err := findUint64Avp(msg.getAvps(), vendorIDIetf, avpTypeTxConnectSpeedBps); err != nil || tx != speeds.TxConnectSpeed {
+		t.Errorf("Tx Connect Speed: got %v, %v, want %v", tx, err, speeds.TxConnectSpeed)
+	}
+	if rx, err := findUint64Avp(msg.getAvps(), vendorIDIetf, avpTypeRxConnectSpeedBps); err != nil || rx != speeds.RxConnectSpeed {
+		t.Errorf("Rx Connect Speed: got %v, %v, want %v", rx, err, speeds.RxConnectSpeed)
+	}
+	v2iccn, err := newV2Iccn(42, speeds)
+	if err != nil {
+		t.Fatalf("newV2Iccn(): %v", err)
+	}
+	if tx, err := findUint32Avp(v2iccn.getAvps(), vendorIDIetf, avpTypeConnectSpeed); err != nil || tx != 0xffffffff {
+		t.Errorf("v2 Connect Speed: got %v, %v, want %v", tx, err, uint32(0xffffffff))
+	}
+	if rx, err := findUint32Avp(v2iccn.getAvps(), vendorIDIetf, avpTypeRxConnectSpeed); err != nil || rx != 1000000 {
+		t.Errorf("v2 Rx Connect Speed: got %v, %v, want 1000000", rx, err)
+	}
+
+	// L2TPv2 session messages are addressed using the header
+	v2msg, err := newIcrp(ProtocolVersion2, 42, &SessionConfig{SessionID: 1, PeerSessionID: 2})
+	if err != nil {
+		t.Fatalf("newIcrp(v2): %v", err)
+	}
+	if sid := sessionMsgSid(v2msg); sid != 2 {
+		t.Errorf("v2 sessionMsgSid(): got %v, want 2", sid)
+	}
+	if psid, err := sessionMsgPeerSid(v2msg); err != nil || psid != 1 {
+		t.Errorf("v2 sessionMsgPeerSid(): got %v, %v, want 1", psid, err)
+	}
+}
+
+type parserCorpusEntry struct {
+	in        []byte
+	expectErr bool
+	navps     int
+}
+
+// Parser corpus files are hex dumps of a message buffer, with comment lines
+// starting with '#'.  The comment "# expect: ok" or "# expect: error" states
+// whether parsing should succeed, and "# avps: N" optionally states the total
+// number of AVPs the parser should find.
+func loadParserCorpusEntry(path string) (*parserCorpusEntry, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &parserCorpusEntry{navps: -1}
+	haveExpect := false
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			kv := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			val := strings.TrimSpace(kv[1])
+			switch strings.TrimSpace(kv[0]) {
+			case "expect":
+				if val != "ok" && val != "error" {
+					return nil, fmt.Errorf("expect 'ok' or 'error', got %q", val)
+				}
+				entry.expectErr = val == "error"
+				haveExpect = true
+			case "avps":
+				if entry.navps, err = strconv.Atoi(val); err != nil {
+					return nil, fmt.Errorf("bad AVP count %q: %v", val, err)
+				}
+			}
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			b, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("bad hex %q: %v", field, err)
+			}
+			entry.in = append(entry.in, b...)
+		}
+	}
+	if !haveExpect {
+		return nil, fmt.Errorf("missing expect comment")
+	}
+	return entry, nil
+}
+
+// exerciseMessages calls the accessors which consumers of parsed messages
+// rely on, to flush out any latent panics for malformed input.
+func exerciseMessages(msgs []controlMessage) (navps int) {
+	for _, msg := range msgs {
+		_ = msg.getType()
+		_ = msg.validate()
+		for _, a := range msg.getAvps() {
+			_, _ = a.decode()
+			_ = a.String()
+			navps++
+		}
+	}
+	return
+}
+
+func TestParserCorpus(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "parser-corpus", "*.txt"))
+	if err != nil {
+		t.Fatalf("failed to list parser corpus: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("parser corpus is empty")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			entry, err := loadParserCorpusEntry(path)
+			if err != nil {
+				t.Fatalf("failed to load %v: %v", path, err)
+			}
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("parsing %v panicked: %v", entry.in, r)
+				}
+			}()
+
+			msgs, err := parseMessageBuffer(entry.in, nil)
+			if entry.expectErr {
+				if err == nil {
+					t.Fatalf("parseMessageBuffer(%v) succeeded, expected failure", entry.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(%v): %v", entry.in, err)
+			}
+			navps := exerciseMessages(msgs)
+			if entry.navps >= 0 && navps != entry.navps {
+				t.Errorf("parseMessageBuffer(%v): got %d AVPs, want %d", entry.in, navps, entry.navps)
+			}
+		})
+	}
+}
+
+func TestExtraAVPs(t *testing.T) {
+	extra := []ExtraAVP{
+		{VendorID: 9, Type: 1, Value: "vendor string", Messages: []MessageType{MessageTypeSCCRQ, MessageTypeICRQ}},
+		{VendorID: 9, Type: 2, Value: uint32(0x01020304), Messages: []MessageType{MessageTypeICCN}},
+		{VendorID: 9, Type: 3, Mandatory: true, Value: []byte{0xde, 0xad}, Messages: []MessageType{MessageTypeICRQ}},
+		{VendorID: 9, Type: 4, Messages: []MessageType{MessageTypeICRQ}},
+	}
+
+	cases := []struct {
+		name  string
+		build func() (*v2ControlMessage, error)
+		want  []avp
+	}{
+		{
+			name: "SCCRQ",
+			build: func() (*v2ControlMessage, error) {
+				return newV2Sccrq(&TunnelConfig{ExtraAVPs: extra}, nil, nil)
+			},
+			want: []avp{
+				{
+					header:  *newAvpHeader(false, false, 13, 9, 1),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte("vendor string")},
+				},
+			},
+		},
+		{
+			name: "ICRQ",
+			build: func() (*v2ControlMessage, error) {
+				return newV2Icrq(1, 42, &SessionConfig{ExtraAVPs: extra})
+			},
+			want: []avp{
+				{
+					header:  *newAvpHeader(false, false, 13, 9, 1),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte("vendor string")},
+				},
+				{
+					header:  *newAvpHeader(true, false, 2, 9, 3),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{0xde, 0xad}},
+				},
+				{
+					header:  *newAvpHeader(false, false, 0, 9, 4),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{}},
+				},
+			},
+		},
+		{
+			name: "ICCN",
+			build: func() (*v2ControlMessage, error) {
+				return newV2Iccn(42, &SessionConfig{ExtraAVPs: extra})
+			},
+			want: []avp{
+				{
+					header:  *newAvpHeader(false, false, 4, 9, 2),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{0x01, 0x02, 0x03, 0x04}},
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := c.build()
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			avps := msg.getAvps()
+			if len(avps) < len(c.want) {
+				t.Fatalf("expected at least %d AVPs, got %d", len(c.want), len(avps))
+			}
+			got := avps[len(avps)-len(c.want):]
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("extra AVPs: got %v, want %v", got, c.want)
+			}
+			// The message must still be well formed on the wire.
+			// Unrecognised mandatory AVPs are rejected by the parser.
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			hasMandatory := false
+			for _, a := range c.want {
+				hasMandatory = hasMandatory || a.isMandatory()
+			}
+			_, err = parseMessageBuffer(b, nil)
+			if hasMandatory && err == nil {
+				t.Errorf("parseMessageBuffer() accepted unrecognised mandatory AVP")
+			} else if !hasMandatory && err != nil {
+				t.Errorf("parseMessageBuffer(): %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateExtraAVPs(t *testing.T) {
+	cases := []struct {
+		name       string
+		extra      []ExtraAVP
+		allowed    []MessageType
+		expectFail bool
+	}{
+		{
+			name:    "allowed",
+			extra:   []ExtraAVP{{VendorID: 9, Type: 1, Value: uint16(1), Messages: []MessageType{MessageTypeICRQ}}},
+			allowed: []MessageType{MessageTypeICRQ, MessageTypeICCN},
+		},
+		{
+			name:       "disallowed message type",
+			extra:      []ExtraAVP{{VendorID: 9, Type: 1, Value: uint16(1), Messages: []MessageType{MessageTypeICRQ}}},
+			allowed:    []MessageType{MessageTypeSCCRQ},
+			expectFail: true,
+		},
+		{
+			name:       "no message types",
+			extra:      []ExtraAVP{{VendorID: 9, Type: 1, Value: uint16(1)}},
+			allowed:    []MessageType{MessageTypeSCCRQ},
+			expectFail: true,
+		},
+		{
+			name:       "unsupported value type",
+			extra:      []ExtraAVP{{VendorID: 9, Type: 1, Value: 42, Messages: []MessageType{MessageTypeSCCRQ}}},
+			allowed:    []MessageType{MessageTypeSCCRQ},
+			expectFail: true,
+		},
+		{
+			name:       "value too long",
+			extra:      []ExtraAVP{{VendorID: 9, Type: 1, Value: make([]byte, 1024), Messages: []MessageType{MessageTypeSCCRQ}}},
+			allowed:    []MessageType{MessageTypeSCCRQ},
+			expectFail: true,
+		},
+		{
+			name:       "Message Type AVP",
+			extra:      []ExtraAVP{{VendorID: 0, Type: 0, Value: uint16(1), Messages: []MessageType{MessageTypeSCCRQ}}},
+			allowed:    []MessageType{MessageTypeSCCRQ},
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateExtraAVPs(c.extra, c.allowed...)
+			if c.expectFail && err == nil {
+				t.Errorf("validateExtraAVPs(%v) succeeded, expected failure", c.extra)
+			} else if !c.expectFail && err != nil {
+				t.Errorf("validateExtraAVPs(%v): %v", c.extra, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package l2tp
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Header lengths contributing to the overhead of carrying a session's
+// frames over the tunnel path.
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	// Flags and version, tunnel ID and session ID (RFC2661 section 3.1)
+	l2tpV2DataHeaderLen = 6
+	// Ns and Nr, if the session uses sequence numbers
+	l2tpV2SeqLen = 4
+	// Flags, version and reserved field, which only UDP encapsulated
+	// data packets carry (RFC3931 section 4.1.2.1)
+	l2tpV3UDPHeaderLen = 4
+	// Session ID (RFC3931 section 4.1)
+	l2tpV3SessionIDLen = 4
+	// The default L2-Specific Sublayer (RFC4719 section 4.6)
+	l2tpV3DefaultL2SpecLen = 4
+	// Ethernet header, excluding the FCS which isn't carried (RFC4719)
+	ethPseudowireOverhead = 14
+	// PPP address, control and protocol fields (RFC2661 section 1.1)
+	pppPseudowireOverhead = 4
+)
+
+// How often dynamic tunnels sample the path MTU to the peer.  The kernel
+// lowers the path MTU on receipt of an ICMP "fragmentation needed" message
+// for the tunnel socket, and restores it once the entry expires.
+const pathMTUInterval = 30 * time.Second
+
+// sessionMTU returns the MTU of a session's network interface which allows
+// the session's frames to be carried over the tunnel path without
+// fragmentation, or zero if the path MTU isn't known.
+func sessionMTU(pathMTU int, ipv4 bool, tcfg *TunnelConfig, scfg *SessionConfig) uint16 {
+	if pathMTU <= 0 {
+		return 0
+	}
+
+	overhead := ipv6HeaderLen
+	if ipv4 {
+		overhead = ipv4HeaderLen
+	}
+	if tcfg.Encap == EncapTypeUDP {
+		overhead += udpHeaderLen
+	}
+
+	if tcfg.Version == ProtocolVersion2 {
+		overhead += l2tpV2DataHeaderLen
+		if scfg.SeqNum {
+			overhead += l2tpV2SeqLen
+		}
+	} else {
+		if tcfg.Encap == EncapTypeUDP {
+			overhead += l2tpV3UDPHeaderLen
+		}
+		overhead += l2tpV3SessionIDLen + len(scfg.PeerCookie)
+		if scfg.L2SpecType == L2SpecTypeDefault {
+			overhead += l2tpV3DefaultL2SpecLen
+		}
+	}
+
+	if isEthPseudowire(scfg.Pseudowire) {
+		overhead += ethPseudowireOverhead
+	} else {
+		overhead += pppPseudowireOverhead
+	}
+
+	mtu := pathMTU - overhead
+	if mtu < minSessionMTU {
+		return minSessionMTU
+	}
+	if mtu > 0xffff {
+		return 0xffff
+	}
+	return uint16(mtu)
+}
+
+// sockaddrIsIPv4 returns true if packets sent to the address carry an
+// IPv4 header, including IPv4-mapped addresses used by dual-stack sockets.
+func sockaddrIsIPv4(sa unix.Sockaddr) bool {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrL2TPIP:
+		return true
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:]).To4() != nil
+	}
+	return false
+}
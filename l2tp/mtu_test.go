@@ -0,0 +1,111 @@
+package l2tp
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSessionMTU(t *testing.T) {
+	v2udp := &TunnelConfig{Version: ProtocolVersion2, Encap: EncapTypeUDP}
+	v3udp := &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP}
+	v3ip := &TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeIP}
+	cases := []struct {
+		name    string
+		pathMTU int
+		ipv4    bool
+		tcfg    *TunnelConfig
+		scfg    *SessionConfig
+		want    uint16
+	}{
+		{
+			name:    "L2TPv2 PPP",
+			pathMTU: 1500,
+			ipv4:    true,
+			tcfg:    v2udp,
+			scfg:    &SessionConfig{Pseudowire: PseudowireTypePPP},
+			want:    1462,
+		},
+		{
+			name:    "L2TPv2 PPP with sequence numbers",
+			pathMTU: 1500,
+			ipv4:    true,
+			tcfg:    v2udp,
+			scfg:    &SessionConfig{Pseudowire: PseudowireTypePPP, SeqNum: true},
+			want:    1458,
+		},
+		{
+			name:    "L2TPv3 UDP/IPv6 Ethernet with cookie and sublayer",
+			pathMTU: 1500,
+			tcfg:    v3udp,
+			scfg: &SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				PeerCookie: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				L2SpecType: L2SpecTypeDefault,
+			},
+			want: 1418,
+		},
+		{
+			name:    "L2TPv3 IP Ethernet",
+			pathMTU: 1500,
+			ipv4:    true,
+			tcfg:    v3ip,
+			scfg:    &SessionConfig{Pseudowire: PseudowireTypeEth},
+			want:    1462,
+		},
+		{
+			name: "Path MTU unknown",
+			tcfg: v2udp,
+			scfg: &SessionConfig{Pseudowire: PseudowireTypePPP},
+			want: 0,
+		},
+		{
+			name:    "Path MTU too small",
+			pathMTU: 100,
+			ipv4:    true,
+			tcfg:    v3udp,
+			scfg:    &SessionConfig{Pseudowire: PseudowireTypeEth},
+			want:    minSessionMTU,
+		},
+		{
+			name:    "Path MTU too large",
+			pathMTU: 100000,
+			ipv4:    true,
+			tcfg:    v2udp,
+			scfg:    &SessionConfig{Pseudowire: PseudowireTypePPP},
+			want:    0xffff,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := sessionMTU(c.pathMTU, c.ipv4, c.tcfg, c.scfg)
+			if got != c.want {
+				t.Errorf("sessionMTU(): got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSockaddrIsIPv4(t *testing.T) {
+	mapped := &unix.SockaddrInet6{}
+	copy(mapped.Addr[:], net.ParseIP("192.168.1.1").To16())
+	native := &unix.SockaddrInet6{}
+	copy(native.Addr[:], net.ParseIP("2001:db8::1").To16())
+
+	cases := []struct {
+		sa   unix.Sockaddr
+		want bool
+	}{
+		{&unix.SockaddrInet4{}, true},
+		{&unix.SockaddrL2TPIP{}, true},
+		{mapped, true},
+		{native, false},
+		{&unix.SockaddrL2TPIP6{}, false},
+	}
+	for _, c := range cases {
+		if got := sockaddrIsIPv4(c.sa); got != c.want {
+			t.Errorf("sockaddrIsIPv4(%+v): got %v, want %v", c.sa, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// socketMux shares a single UDP socket between the control planes of
+// many tunnels.  Received control messages are demultiplexed to tunnels
+// using the tunnel ID (L2TPv2) or control connection ID (L2TPv3) in the
+// message header.
+type socketMux struct {
+	logger    log.Logger
+	parent    *Context
+	key       string
+	cp        *controlPlane
+	lock      sync.Mutex
+	endpoints map[ControlConnID]*controlPlane
+	wg        sync.WaitGroup
+}
+
+// The number of received frames to buffer for each tunnel sharing
+// the socket.  Further frames are dropped, as they would be if the
+// tunnel's own socket receive buffer overflowed.
+const muxEndpointQueueLen = 32
+
+var errControlPlaneClosed = errors.New("control plane closed")
+
+// muxControlConnID extracts the tunnel ID or control connection ID from
+// the header of an L2TP control message received on a UDP socket.
+// Data messages are rejected.
+func muxControlConnID(b []byte) (ControlConnID, error) {
+	if len(b) < commonHeaderLen {
+		return 0, fmt.Errorf("frame too short")
+	}
+	flagsVer := binary.BigEndian.Uint16(b[0:2])
+	if flagsVer&0x8000 == 0 {
+		return 0, fmt.Errorf("not a control message")
+	}
+	switch ProtocolVersion(flagsVer & 0xf) {
+	case ProtocolVersion2:
+		// Control messages always include the length field
+		if len(b) < v2HeaderLen {
+			return 0, fmt.Errorf("frame too short")
+		}
+		return ControlConnID(binary.BigEndian.Uint16(b[4:6])), nil
+	case ProtocolVersion3:
+		if len(b) < v3HeaderLen {
+			return 0, fmt.Errorf("frame too short")
+		}
+		return ControlConnID(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+	return 0, fmt.Errorf("unsupported protocol version %v", flagsVer&0xf)
+}
+
+func newSocketMux(parent *Context, key string, sal unix.Sockaddr, cfg *TunnelConfig) (mux *socketMux, err error) {
+	if _, ok := sal.(*unix.SockaddrInet4); !ok {
+		if _, ok := sal.(*unix.SockaddrInet6); !ok {
+			return nil, fmt.Errorf("shared sockets are supported for UDP encapsulation only")
+		}
+	}
+
+	csum, err := managedSocketChecksum(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := newNetNSControlPlane(cfg.NetNS, sal, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.setUDPChecksum(csum)
+	if err == nil {
+		err = cp.setDSCP(cfg.ControlDSCP, cfg.DataDSCP)
+	}
+	if err == nil {
+		err = cp.setSocketOptions(cfg)
+	}
+	if err == nil {
+		err = cp.bind()
+	}
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	mux = &socketMux{
+		logger:    log.With(parent.logger, "function", "mux", "local_address", key),
+		parent:    parent,
+		key:       key,
+		cp:        cp,
+		endpoints: make(map[ControlConnID]*controlPlane),
+	}
+
+	mux.wg.Add(1)
+	go func() {
+		defer mux.wg.Done()
+		mux.run()
+	}()
+
+	level.Debug(mux.logger).Log("message", "new shared socket")
+
+	return mux, nil
+}
+
+func (mux *socketMux) run() {
+	for {
+		b := make([]byte, 4096)
+		n, from, err := mux.cp.recvFrom(b)
+		if err != nil {
+			level.Debug(mux.logger).Log(
+				"message", "socket read failed",
+				"error", err)
+			return
+		}
+		mux.dispatch(&rawMsg{b: b[:n], sa: from})
+	}
+}
+
+func (mux *socketMux) dispatch(m *rawMsg) {
+	id, err := muxControlConnID(m.b)
+	if err != nil {
+		level.Debug(mux.logger).Log(
+			"message", "discard frame",
+			"error", err)
+		return
+	}
+
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	ep, ok := mux.endpoints[id]
+	if !ok {
+		level.Debug(mux.logger).Log(
+			"message", "discard frame for unknown tunnel",
+			"tunnel_id", id)
+		return
+	}
+
+	// Each tunnel replies to its peer from the address the peer sent to
+	ep.setReplySource(m.sa, mux.cp.getReplySource(m.sa))
+
+	select {
+	case ep.rxChan <- m:
+	default:
+		level.Debug(mux.logger).Log(
+			"message", "discard frame: tunnel receive queue full",
+			"tunnel_id", id)
+	}
+}
+
+// newControlPlane creates a control plane for the tunnel with the specified
+// ID, which sends and receives using the shared socket.
+func (mux *socketMux) newControlPlane(tid ControlConnID, sap unix.Sockaddr) (*controlPlane, error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	if _, ok := mux.endpoints[tid]; ok {
+		return nil, fmt.Errorf("shared socket already has tunnel with ID %v", tid)
+	}
+
+	cp := &controlPlane{
+		local:  mux.cp.local,
+		remote: sap,
+		fd:     mux.cp.fd,
+		mux:    mux,
+		muxID:  tid,
+		rxChan: make(chan *rawMsg, muxEndpointQueueLen),
+	}
+	// A tunnel accepted by a listener sharing the socket replies to the
+	// SCCRQ the listener received
+	if l, ok := mux.endpoints[0]; ok {
+		cp.setReplySource(sap, l.getReplySource(sap))
+	}
+	mux.endpoints[tid] = cp
+	return cp, nil
+}
+
+// release removes a control plane from the mux.  When the last control
+// plane is removed the shared socket is closed.
+func (mux *socketMux) release(cp *controlPlane) {
+	mux.lock.Lock()
+	if ep, ok := mux.endpoints[cp.muxID]; ok && ep == cp {
+		delete(mux.endpoints, cp.muxID)
+		close(cp.rxChan)
+	}
+	mux.lock.Unlock()
+
+	if mux.parent.releaseSocketMux(mux) {
+		mux.cp.close()
+		mux.wg.Wait()
+		level.Debug(mux.logger).Log("message", "shared socket closed")
+	}
+}
+
+// sockaddrIP returns the IP address of a UDP or L2TP/IP address.
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrL2TPIP:
+		return net.IP(sa.Addr[:])
+	case *unix.SockaddrL2TPIP6:
+		return net.IP(sa.Addr[:])
+	}
+	return nil
+}
+
+// sockaddrString returns a UDP address in host:port form.
+func sockaddrString(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrInet6:
+		host := net.IP(sa.Addr[:]).String()
+		if sa.ZoneId != 0 {
+			host += "%" + strconv.Itoa(int(sa.ZoneId))
+		}
+		return net.JoinHostPort(host, strconv.Itoa(sa.Port))
+	}
+	return fmt.Sprintf("%T", sa)
+}
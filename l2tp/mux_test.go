@@ -0,0 +1,336 @@
+package l2tp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestMuxControlConnID(t *testing.T) {
+	cases := []struct {
+		name   string
+		in     []byte
+		want   ControlConnID
+		expErr bool
+	}{
+		{
+			name: "L2TPv2 control",
+			in:   []byte{0xc8, 0x02, 0x00, 0x0c, 0x12, 0x34, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			want: 0x1234,
+		},
+		{
+			name: "L2TPv3 control",
+			in:   []byte{0xc8, 0x03, 0x00, 0x0c, 0x12, 0x34, 0x56, 0x78, 0x00, 0x00, 0x00, 0x00},
+			want: 0x12345678,
+		},
+		{
+			name:   "L2TPv2 data",
+			in:     []byte{0x40, 0x02, 0x00, 0x0c, 0x12, 0x34, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+			expErr: true,
+		},
+		{
+			name:   "L2TPv2 control (short)",
+			in:     []byte{0xc8, 0x02, 0x00, 0x0c, 0x12, 0x34},
+			expErr: true,
+		},
+		{
+			name:   "L2TPv3 control (short)",
+			in:     []byte{0xc8, 0x03, 0x00, 0x0c, 0x12, 0x34, 0x56, 0x78},
+			expErr: true,
+		},
+		{
+			name:   "Bad version",
+			in:     []byte{0xc8, 0x01, 0x00, 0x0c, 0x12, 0x34, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			expErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := muxControlConnID(c.in)
+			if c.expErr {
+				if err == nil {
+					t.Errorf("muxControlConnID(%x) succeeded, expected failure", c.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("muxControlConnID(%x): %v", c.in, err)
+			}
+			if got != c.want {
+				t.Errorf("muxControlConnID(%x): got %v, want %v", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+// v2 control message header with no AVPs, for the specified tunnel ID
+func newTestV2ControlFrame(tid ControlConnID) []byte {
+	return []byte{0xc8, 0x02, 0x00, 0x0c, byte(tid >> 8), byte(tid), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+}
+
+func TestSocketMux(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9016", "127.0.0.1:9017")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	peer, err := newL2tpControlPlane(sap, sal)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	defer peer.close()
+	if err = peer.bind(); err != nil {
+		t.Fatalf("peer.bind(): %v", err)
+	}
+	if err = peer.connect(); err != nil {
+		t.Fatalf("peer.connect(): %v", err)
+	}
+
+	var cps [2]*controlPlane
+	for i := range cps {
+		cfg := &TunnelConfig{
+			TunnelID:     ControlConnID(100 + i),
+			SharedSocket: true,
+		}
+		cps[i], err = ctx.newTunnelControlPlane(sal, sap, cfg)
+		if err != nil {
+			t.Fatalf("newTunnelControlPlane(%v): %v", cfg, err)
+		}
+		if err = cps[i].bind(); err != nil {
+			t.Fatalf("bind(): %v", err)
+		}
+		if err = cps[i].connect(); err != nil {
+			t.Fatalf("connect(): %v", err)
+		}
+	}
+	if cps[0].fd != cps[1].fd {
+		t.Errorf("control planes have different sockets %v and %v", cps[0].fd, cps[1].fd)
+	}
+
+	_, err = ctx.newTunnelControlPlane(sal, sap, &TunnelConfig{TunnelID: 100, SharedSocket: true})
+	if err == nil {
+		t.Errorf("newTunnelControlPlane() with duplicate tunnel ID succeeded, expected failure")
+	}
+
+	// Frames for an unknown tunnel are discarded, frames for each tunnel
+	// are passed to its control plane
+	for _, tid := range []ControlConnID{99, 101, 100} {
+		if _, err = peer.write(newTestV2ControlFrame(tid)); err != nil {
+			t.Fatalf("peer.write(): %v", err)
+		}
+	}
+	for i, cp := range cps {
+		b := make([]byte, 4096)
+		n, _, err := cp.recvFrom(b)
+		if err != nil {
+			t.Fatalf("recvFrom(): %v", err)
+		}
+		want := newTestV2ControlFrame(ControlConnID(100 + i))
+		if !bytes.Equal(b[:n], want) {
+			t.Errorf("control plane %d: got %x, want %x", i, b[:n], want)
+		}
+	}
+
+	// Each control plane sends to its peer using the shared socket
+	want := newTestV2ControlFrame(1)
+	if _, err = cps[1].write(want); err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+	b := make([]byte, 4096)
+	n, _, err := peer.recvFrom(b)
+	if err != nil {
+		t.Fatalf("peer.recvFrom(): %v", err)
+	}
+	if !bytes.Equal(b[:n], want) {
+		t.Errorf("peer: got %x, want %x", b[:n], want)
+	}
+
+	// The socket is closed along with the last control plane using it
+	cps[0].close()
+	cps[0].close()
+	if _, _, err = cps[0].recvFrom(b); err != errControlPlaneClosed {
+		t.Errorf("recvFrom() on closed control plane: got %v, want %v", err, errControlPlaneClosed)
+	}
+	if len(ctx.muxes) != 1 {
+		t.Errorf("shared socket closed while in use")
+	}
+	cps[1].close()
+	if len(ctx.muxes) != 0 {
+		t.Errorf("shared socket not closed after last use")
+	}
+}
+
+func TestSocketMuxPacketInfo(t *testing.T) {
+	ctx, err := NewContext(nil, nil)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// Each peer contacts its tunnel on a different local address of the
+	// shared socket, and each tunnel replies from that address
+	cases := []struct {
+		peer, dst string
+	}{
+		{"127.0.0.1:9097", "127.0.0.2:9096"},
+		{"127.0.0.1:9098", "127.0.0.3:9096"},
+	}
+	var cps []*controlPlane
+	var peers []net.PacketConn
+	for i, c := range cases {
+		sal, sap, err := newUDPAddressPair("0.0.0.0:9096", c.peer)
+		if err != nil {
+			t.Fatalf("newUDPAddressPair(): %v", err)
+		}
+		cfg := &TunnelConfig{
+			TunnelID:     ControlConnID(100 + i),
+			SharedSocket: true,
+			PacketInfo:   true,
+		}
+		cp, err := ctx.newTunnelControlPlane(sal, sap, cfg)
+		if err != nil {
+			t.Fatalf("newTunnelControlPlane(%v): %v", cfg, err)
+		}
+		defer cp.close()
+		if err = cp.bind(); err != nil {
+			t.Fatalf("bind(): %v", err)
+		}
+		if err = cp.connect(); err != nil {
+			t.Fatalf("connect(): %v", err)
+		}
+		cps = append(cps, cp)
+
+		peer, err := net.ListenPacket("udp", c.peer)
+		if err != nil {
+			t.Fatalf("net.ListenPacket(): %v", err)
+		}
+		defer peer.Close()
+		peers = append(peers, peer)
+	}
+
+	b := make([]byte, 4096)
+	for i, c := range cases {
+		dst, err := net.ResolveUDPAddr("udp", c.dst)
+		if err != nil {
+			t.Fatalf("net.ResolveUDPAddr(): %v", err)
+		}
+		if _, err = peers[i].WriteTo(newTestV2ControlFrame(ControlConnID(100+i)), dst); err != nil {
+			t.Fatalf("WriteTo(): %v", err)
+		}
+		if _, _, err = cps[i].recvFrom(b); err != nil {
+			t.Fatalf("recvFrom(): %v", err)
+		}
+	}
+	for i, c := range cases {
+		if _, err = cps[i].write(newTestV2ControlFrame(1)); err != nil {
+			t.Fatalf("write(): %v", err)
+		}
+		if err = peers[i].SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("SetReadDeadline(): %v", err)
+		}
+		_, from, err := peers[i].ReadFrom(b)
+		if err != nil {
+			t.Fatalf("ReadFrom(): %v", err)
+		}
+		want, _, _ := net.SplitHostPort(c.dst)
+		if src := from.(*net.UDPAddr).IP; !src.Equal(net.ParseIP(want)) {
+			t.Errorf("tunnel %d reply source: got %v, want %v", 100+i, src, want)
+		}
+	}
+}
+
+type testSharedSocketEventHandler struct {
+	lock     sync.Mutex
+	tunnelUp int
+	wg       sync.WaitGroup
+}
+
+func (h *testSharedSocketEventHandler) HandleEvent(event interface{}) {
+	if ev, ok := event.(*TunnelUpEvent); ok {
+		h.lock.Lock()
+		h.tunnelUp++
+		h.lock.Unlock()
+		t := ev.Tunnel
+		h.wg.Add(1)
+		go func() {
+			t.Close()
+			h.wg.Done()
+		}()
+	}
+}
+
+func TestSharedSocketDynamicTunnels(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	handler := &testSharedSocketEventHandler{}
+	ctx.RegisterEventHandler(handler)
+
+	var lnsWg sync.WaitGroup
+	var lnss []*testLNS
+	for i, peer := range []string{"127.0.0.1:9018", "127.0.0.1:9019"} {
+		lns, err := newTestLNS(logger,
+			&TunnelConfig{
+				Local:          peer,
+				Peer:           "127.0.0.1:9016",
+				Version:        ProtocolVersion2,
+				TunnelID:       ControlConnID(200 + i),
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}, nil)
+		if err != nil {
+			t.Fatalf("newTestLNS: %v", err)
+		}
+		lnss = append(lnss, lns)
+		lnsWg.Add(1)
+		go func() {
+			lns.run(3 * time.Second)
+			lnsWg.Done()
+		}()
+
+		cfg := &TunnelConfig{
+			Local:          "127.0.0.1:9016",
+			Peer:           peer,
+			Version:        ProtocolVersion2,
+			TunnelID:       ControlConnID(100 + i),
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+			SharedSocket:   true,
+		}
+		_, err = ctx.NewDynamicTunnel(peer, cfg)
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(%q, %v): %v", peer, cfg, err)
+		}
+	}
+
+	lnsWg.Wait()
+	ctx.Close()
+	handler.wg.Wait()
+
+	if handler.tunnelUp != len(lnss) {
+		t.Errorf("got %v tunnel up events, want %v", handler.tunnelUp, len(lnss))
+	}
+	for i, lns := range lnss {
+		if !lns.tunnelEstablished {
+			t.Errorf("LNS %d didn't establish", i)
+		}
+	}
+	if len(ctx.muxes) != 0 {
+		t.Errorf("shared socket not closed")
+	}
+}
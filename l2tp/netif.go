@@ -0,0 +1,248 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Link info attributes, as declared in linux/if_link.h
+const (
+	iflaInfoData = 2
+	iflaVlanID   = 1
+)
+
+// needsInterfaceConfig returns true if the session configuration asks for
+// the session's network interface to be configured once created.
+func needsInterfaceConfig(cfg *SessionConfig) bool {
+	return cfg.InterfaceUp || len(cfg.InterfaceAddrs) > 0 || cfg.Bridge != "" ||
+		len(cfg.VLANs) > 0 || cfg.InterfaceNetNS != ""
+}
+
+// configureInterface moves the session's network interface from the
+// tunnel's network namespace to the session's namespace, applies the
+// session's MTU to the interface, assigns the session's interface
+// addresses, attaches the interface to the session's bridge, creates the
+// session's VLAN sub-interfaces and brings the interfaces up if the
+// session configuration asks for it.
+//
+// The MTU is applied even though the data plane is passed it, since
+// recent Linux kernels ignore the MTU requested when an L2TP session is
+// created.
+func configureInterface(ifname string, tcfg *TunnelConfig, cfg *SessionConfig) error {
+	if ifname == "" {
+		if needsInterfaceConfig(cfg) {
+			return fmt.Errorf("session has no network interface")
+		}
+		return nil
+	}
+
+	if cfg.InterfaceNetNS != "" {
+		err := withNetNS(tcfg.NetNS, func() error {
+			return moveInterface(ifname, cfg.InterfaceNetNS)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return withNetNS(sessionInterfaceNetNS(tcfg.NetNS, cfg), func() error {
+		return setupInterface(ifname, cfg)
+	})
+}
+
+func setupInterface(ifname string, cfg *SessionConfig) error {
+	if cfg.MTU != 0 {
+		if err := setInterfaceMTU(ifname, cfg.MTU); err != nil {
+			return err
+		}
+	}
+	if !needsInterfaceConfig(cfg) {
+		return nil
+	}
+
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, addr := range cfg.InterfaceAddrs {
+		if err = addInterfaceAddr(c, ifi.Index, addr); err != nil {
+			return fmt.Errorf("failed to add address %v to %q: %v", addr, ifname, err)
+		}
+	}
+	if cfg.Bridge != "" {
+		br, err := net.InterfaceByName(cfg.Bridge)
+		if err != nil {
+			return fmt.Errorf("failed to find bridge %q: %v", cfg.Bridge, err)
+		}
+		if err = setInterfaceMaster(c, ifi.Index, br.Index); err != nil {
+			return fmt.Errorf("failed to attach %q to bridge %q: %v", ifname, cfg.Bridge, err)
+		}
+	}
+	vlanIndices := make([]int, len(cfg.VLANs))
+	for i, vid := range cfg.VLANs {
+		name := vlanInterfaceName(ifname, vid)
+		if err = addVLANInterface(c, ifi.Index, name, vid); err != nil {
+			return fmt.Errorf("failed to create VLAN interface %q: %v", name, err)
+		}
+		vlan, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		vlanIndices[i] = vlan.Index
+	}
+	if cfg.InterfaceUp {
+		if err = setInterfaceUp(c, ifi.Index); err != nil {
+			return fmt.Errorf("failed to bring up %q: %v", ifname, err)
+		}
+		for i, index := range vlanIndices {
+			if err = setInterfaceUp(c, index); err != nil {
+				return fmt.Errorf("failed to bring up %q: %v",
+					vlanInterfaceName(ifname, cfg.VLANs[i]), err)
+			}
+		}
+	}
+	return nil
+}
+
+// vlanInterfaceName returns the name of the VLAN sub-interface of a
+// session's network interface, following the vconfig naming convention.
+func vlanInterfaceName(ifname string, vid uint16) string {
+	return ifname + "." + strconv.Itoa(int(vid))
+}
+
+// releaseInterface detaches the session's network interface from the
+// session's bridge, if any, before the interface is torn down.
+func releaseInterface(ifname string, tcfg *TunnelConfig, cfg *SessionConfig) error {
+	if ifname == "" || cfg.Bridge == "" {
+		return nil
+	}
+
+	return withNetNS(sessionInterfaceNetNS(tcfg.NetNS, cfg), func() error {
+		ifi, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return err
+		}
+
+		c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if err = setInterfaceMaster(c, ifi.Index, 0); err != nil {
+			return fmt.Errorf("failed to detach %q from bridge %q: %v", ifname, cfg.Bridge, err)
+		}
+		return nil
+	})
+}
+
+// addInterfaceAddr assigns an address in CIDR notation to a network
+// interface using an RTM_NEWADDR message, which carries a struct ifaddrmsg.
+func addInterfaceAddr(c *netlink.Conn, ifindex int, cidr string) error {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	family := unix.AF_INET6
+	if ip4 := ip.To4(); ip4 != nil {
+		family = unix.AF_INET
+		ip = ip4
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFA_LOCAL, Data: ip},
+		{Type: unix.IFA_ADDRESS, Data: ip},
+	})
+	if err != nil {
+		return err
+	}
+
+	ifa := make([]byte, unix.SizeofIfAddrmsg)
+	ifa[0] = byte(family)
+	ifa[1] = byte(prefixLen)
+	nlenc.PutUint32(ifa[4:8], uint32(ifindex))
+	return executeRoute(c, unix.RTM_NEWADDR, netlink.Create|netlink.Replace, append(ifa, attrs...))
+}
+
+// setInterfaceUp brings a network interface up using an RTM_NEWLINK
+// message, which carries a struct ifinfomsg.
+func setInterfaceUp(c *netlink.Conn, ifindex int) error {
+	ifi := make([]byte, unix.SizeofIfInfomsg)
+	nlenc.PutInt32(ifi[4:8], int32(ifindex))
+	nlenc.PutUint32(ifi[8:12], unix.IFF_UP)
+	nlenc.PutUint32(ifi[12:16], unix.IFF_UP)
+	return executeRoute(c, unix.RTM_NEWLINK, 0, ifi)
+}
+
+// setInterfaceMaster enslaves a network interface to a master device such
+// as a bridge, or releases it if the master's index is zero, using an
+// RTM_NEWLINK message carrying the IFLA_MASTER attribute.
+func setInterfaceMaster(c *netlink.Conn, ifindex, master int) error {
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFLA_MASTER, Data: nlenc.Uint32Bytes(uint32(master))},
+	})
+	if err != nil {
+		return err
+	}
+
+	ifi := make([]byte, unix.SizeofIfInfomsg)
+	nlenc.PutInt32(ifi[4:8], int32(ifindex))
+	return executeRoute(c, unix.RTM_NEWLINK, 0, append(ifi, attrs...))
+}
+
+// addVLANInterface creates an 802.1Q VLAN sub-interface of a network
+// interface using an RTM_NEWLINK message carrying the link info of the
+// kernel's vlan driver.  The kernel removes the sub-interface along with
+// its parent interface.
+func addVLANInterface(c *netlink.Conn, parent int, name string, vid uint16) error {
+	if len(name) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name is too long")
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: iflaVlanID, Data: nlenc.Uint16Bytes(vid)},
+	})
+	if err != nil {
+		return err
+	}
+	info, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFLA_INFO_KIND, Data: nlenc.Bytes("vlan")},
+		{Type: iflaInfoData | unix.NLA_F_NESTED, Data: data},
+	})
+	if err != nil {
+		return err
+	}
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFLA_IFNAME, Data: nlenc.Bytes(name)},
+		{Type: unix.IFLA_LINK, Data: nlenc.Uint32Bytes(uint32(parent))},
+		{Type: unix.IFLA_LINKINFO | unix.NLA_F_NESTED, Data: info},
+	})
+	if err != nil {
+		return err
+	}
+
+	ifi := make([]byte, unix.SizeofIfInfomsg)
+	return executeRoute(c, unix.RTM_NEWLINK, netlink.Create|netlink.Excl, append(ifi, attrs...))
+}
+
+func executeRoute(c *netlink.Conn, msgType netlink.HeaderType, flags netlink.HeaderFlags, data []byte) error {
+	_, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  msgType,
+			Flags: netlink.Request | netlink.Acknowledge | flags,
+		},
+		Data: data,
+	})
+	return err
+}
@@ -0,0 +1,176 @@
+package l2tp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConfigureInterface(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	port, ifName, err := OpenTAPPort(1, &SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tpcfg%d"})
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+	defer port.Close()
+
+	cfg := &SessionConfig{
+		Pseudowire:     PseudowireTypeEth,
+		MTU:            1300,
+		InterfaceAddrs: []string{"192.0.2.1/24", "2001:db8::1/64"},
+		InterfaceUp:    true,
+	}
+	if err = configureInterface(ifName, &TunnelConfig{}, cfg); err != nil {
+		t.Fatalf("configureInterface(%q): %v", ifName, err)
+	}
+
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		t.Fatalf("InterfaceByName(%q): %v", ifName, err)
+	}
+	if ifi.MTU != int(cfg.MTU) {
+		t.Errorf("MTU: got %v, want %v", ifi.MTU, cfg.MTU)
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		t.Errorf("interface %q is not up", ifName)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		t.Fatalf("Addrs(): %v", err)
+	}
+	for _, want := range cfg.InterfaceAddrs {
+		found := false
+		for _, addr := range addrs {
+			if addr.String() == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("address %v not assigned: got %v", want, addrs)
+		}
+	}
+
+	if err = configureInterface("", &TunnelConfig{}, cfg); err == nil {
+		t.Errorf("configureInterface(\"\"): expected error for session without interface")
+	}
+}
+
+// bridgeIoctl adds or deletes a bridge using the SIOCBRADDBR and
+// SIOCBRDELBR ioctls, which take the bridge name.
+func bridgeIoctl(req uintptr, name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	b, err := unix.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(b)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestBridgeInterface(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	const bridge = "l2tpbr0"
+	if err := bridgeIoctl(unix.SIOCBRADDBR, bridge); err != nil {
+		t.Skipf("skipping test because bridges are unavailable: %v", err)
+	}
+	defer bridgeIoctl(unix.SIOCBRDELBR, bridge)
+
+	port, ifName, err := OpenTAPPort(1, &SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tpbrport%d"})
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+	defer port.Close()
+
+	master := filepath.Join("/sys/class/net", ifName, "master")
+	cfg := &SessionConfig{Pseudowire: PseudowireTypeEth, Bridge: bridge}
+	if err = configureInterface(ifName, &TunnelConfig{}, cfg); err != nil {
+		t.Fatalf("configureInterface(%q): %v", ifName, err)
+	}
+	if link, err := os.Readlink(master); err != nil || filepath.Base(link) != bridge {
+		t.Errorf("interface %q not attached to bridge %q: %v %v", ifName, bridge, link, err)
+	}
+
+	if err = releaseInterface(ifName, &TunnelConfig{}, cfg); err != nil {
+		t.Fatalf("releaseInterface(%q): %v", ifName, err)
+	}
+	if _, err := os.Readlink(master); err == nil {
+		t.Errorf("interface %q still attached to bridge %q", ifName, bridge)
+	}
+
+	cfg.Bridge = "l2tpnobr0"
+	if err = configureInterface(ifName, &TunnelConfig{}, cfg); err == nil {
+		t.Errorf("configureInterface(%q): expected error for missing bridge", ifName)
+	}
+}
+
+func TestVLANInterface(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	port, ifName, err := OpenTAPPort(1, &SessionConfig{Pseudowire: PseudowireTypeEthVLAN, InterfaceName: "l2tpvlan%d"})
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+
+	cfg := &SessionConfig{
+		Pseudowire:  PseudowireTypeEthVLAN,
+		InterfaceUp: true,
+		VLANs:       []uint16{100, 4094},
+	}
+	if err = configureInterface(ifName, &TunnelConfig{}, cfg); err != nil {
+		port.Close()
+		if strings.Contains(err.Error(), unix.EOPNOTSUPP.Error()) {
+			t.Skipf("skipping test because VLANs are unavailable: %v", err)
+		}
+		t.Fatalf("configureInterface(%q): %v", ifName, err)
+	}
+
+	for _, vid := range cfg.VLANs {
+		name := vlanInterfaceName(ifName, vid)
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			t.Errorf("InterfaceByName(%q): %v", name, err)
+			continue
+		}
+		if ifi.Flags&net.FlagUp == 0 {
+			t.Errorf("interface %q is not up", name)
+		}
+	}
+
+	port.Close()
+	for _, vid := range cfg.VLANs {
+		name := vlanInterfaceName(ifName, vid)
+		if _, err := net.InterfaceByName(name); err == nil {
+			t.Errorf("interface %q not removed along with %q", name, ifName)
+		}
+	}
+}
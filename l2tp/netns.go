@@ -0,0 +1,114 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// withNetNS calls fn on an operating system thread in the network
+// namespace at path, or in the calling thread's namespace if path is
+// empty.  Sockets created by fn, including netlink sockets, belong to the
+// namespace for their lifetime.
+func withNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %v", err)
+	}
+	defer ns.Close()
+
+	errC := make(chan error, 1)
+	go func() {
+		// The thread is only unlocked once it is back in its original
+		// namespace: otherwise it exits along with the goroutine.
+		runtime.LockOSThread()
+
+		orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errC <- fmt.Errorf("failed to open current network namespace: %v", err)
+			return
+		}
+		defer orig.Close()
+
+		if err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errC <- fmt.Errorf("failed to enter network namespace %q: %v", path, err)
+			return
+		}
+		err = fn()
+		if unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errC <- err
+	}()
+	return <-errC
+}
+
+// newNetNSControlPlane creates a control plane whose socket belongs to
+// the network namespace at path, or to the current namespace if path is
+// empty.
+func newNetNSControlPlane(path string, localAddr, remoteAddr unix.Sockaddr) (cp *controlPlane, err error) {
+	err = withNetNS(path, func() error {
+		cp, err = newL2tpControlPlane(localAddr, remoteAddr)
+		return err
+	})
+	return
+}
+
+// sessionInterfaceNetNS returns the network namespace the session's
+// network interface is configured in: the interface is created in the
+// namespace of the tunnel, and may then be moved to a namespace of
+// its own.
+func sessionInterfaceNetNS(tunnelNetNS string, scfg *SessionConfig) string {
+	if scfg.InterfaceNetNS != "" {
+		return scfg.InterfaceNetNS
+	}
+	return tunnelNetNS
+}
+
+// moveInterface moves a network interface to the network namespace at
+// path using an RTM_NEWLINK message carrying the IFLA_NET_NS_FD attribute.
+// The interface keeps its name, which must not be in use in the
+// namespace.
+func moveInterface(ifname, path string) error {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %v", err)
+	}
+	defer ns.Close()
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFLA_NET_NS_FD, Data: nlenc.Uint32Bytes(uint32(ns.Fd()))},
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	nlenc.PutInt32(msg[4:8], int32(ifi.Index))
+	if err = executeRoute(c, unix.RTM_NEWLINK, 0, append(msg, attrs...)); err != nil {
+		return fmt.Errorf("failed to move %q to network namespace %q: %v", ifname, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestNetNS creates a network namespace, returning a path by which it
+// may be opened and a function which releases it.
+func newTestNetNS(t *testing.T) (string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+
+	type result struct {
+		ns  *os.File
+		err error
+	}
+	rc := make(chan result)
+	go func() {
+		// The thread is left in the new namespace, so it exits along
+		// with the goroutine.
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			rc <- result{err: err}
+			return
+		}
+		ns, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		rc <- result{ns: ns, err: err}
+	}()
+	r := <-rc
+	if r.err != nil {
+		t.Skipf("skipping test because network namespaces are unavailable: %v", r.err)
+	}
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), r.ns.Fd()), func() { r.ns.Close() }
+}
+
+func TestWithNetNS(t *testing.T) {
+	path, release := newTestNetNS(t)
+	defer release()
+
+	if err := withNetNS("/nonexistent", func() error { return nil }); err == nil {
+		t.Errorf("withNetNS(): expected error for missing namespace")
+	}
+
+	var inside []net.Interface
+	err := withNetNS(path, func() (err error) {
+		inside, err = net.Interfaces()
+		return
+	})
+	if err != nil {
+		t.Fatalf("withNetNS(): %v", err)
+	}
+	if len(inside) != 1 || inside[0].Flags&net.FlagLoopback == 0 {
+		t.Errorf("expected loopback interface only in new namespace, got %v", inside)
+	}
+
+	// The socket of a control plane in the new namespace may be bound to
+	// an address already in use in the original namespace.
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9030", "127.0.0.1:9031")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	for _, ns := range []string{"", path} {
+		cp, err := newNetNSControlPlane(ns, sal, sap)
+		if err != nil {
+			t.Fatalf("newNetNSControlPlane(%q): %v", ns, err)
+		}
+		defer cp.close()
+		if err = cp.bind(); err != nil {
+			t.Errorf("bind() in namespace %q: %v", ns, err)
+		}
+	}
+}
+
+func TestInterfaceNetNS(t *testing.T) {
+	path, release := newTestNetNS(t)
+	defer release()
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	port, ifName, err := OpenTAPPort(1, &SessionConfig{Pseudowire: PseudowireTypeEth, InterfaceName: "l2tpns%d"})
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+	defer port.Close()
+
+	cfg := &SessionConfig{
+		Pseudowire:     PseudowireTypeEth,
+		MTU:            1300,
+		InterfaceAddrs: []string{"192.0.2.1/24"},
+		InterfaceUp:    true,
+		InterfaceNetNS: path,
+	}
+	if err = configureInterface(ifName, &TunnelConfig{}, cfg); err != nil {
+		t.Fatalf("configureInterface(%q): %v", ifName, err)
+	}
+
+	if _, err = net.InterfaceByName(ifName); err == nil {
+		t.Errorf("interface %q still present in original namespace", ifName)
+	}
+
+	var ifi *net.Interface
+	err = withNetNS(path, func() (err error) {
+		ifi, err = net.InterfaceByName(ifName)
+		return
+	})
+	if err != nil {
+		t.Fatalf("InterfaceByName(%q) in namespace: %v", ifName, err)
+	}
+	if ifi.MTU != int(cfg.MTU) {
+		t.Errorf("MTU: got %v, want %v", ifi.MTU, cfg.MTU)
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		t.Errorf("interface %q is not up", ifName)
+	}
+}
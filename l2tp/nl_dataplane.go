@@ -1,28 +1,43 @@
 package l2tp
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
 )
 
-var _ DataPlane = (*nlDataPlane)(nil)
-var _ TunnelDataPlane = (*nlTunnelDataPlane)(nil)
-var _ SessionDataPlane = (*nlSessionDataPlane)(nil)
+var _ DiscoveringDataPlane = (*nlDataPlane)(nil)
+var _ StatisticsTunnelDataPlane = (*nlTunnelDataPlane)(nil)
+var _ MTUSessionDataPlane = (*nlSessionDataPlane)(nil)
 
 type nlDataPlane struct {
 	nlconn *nll2tp.Conn
+	// Tunnels in other network namespaces are managed using a netlink
+	// connection in their namespace, since the kernel instantiates
+	// tunnels in the namespace of the netlink socket.
+	lock    sync.Mutex
+	tunnels map[ControlConnID]*nlTunnelDataPlane
 }
 
 type nlTunnelDataPlane struct {
-	f   *nlDataPlane
-	cfg *nll2tp.TunnelConfig
+	f      *nlDataPlane
+	cfg    *nll2tp.TunnelConfig
+	nlconn *nll2tp.Conn
+	netns  string
 }
 
 type nlSessionDataPlane struct {
 	f             *nlDataPlane
 	cfg           *nll2tp.SessionConfig
+	nlconn        *nll2tp.Conn
+	netns         string
 	interfaceName string
 }
 
@@ -37,29 +52,49 @@ func sockaddrAddrPort(sa unix.Sockaddr) (addr []byte, port uint16, err error) {
 	case *unix.SockaddrL2TPIP6:
 		return sa.Addr[:], 0, nil
 	}
-	return []byte{}, 0, fmt.Errorf("unexpected address type %T", addr)
+	return []byte{}, 0, fmt.Errorf("unexpected address type %T", sa)
+}
+
+// The kernel creates the socket for static tunnels based on the length
+// of the addresses passed to it.  An IPv4 peer represented using an
+// IPv4-mapped address is converted back to IPv4 so the kernel creates an
+// AF_INET socket for the tunnel.
+func unmapAddrPair(la, ra []byte) ([]byte, []byte) {
+	peer := net.IP(ra)
+	if len(peer) != net.IPv6len || peer.To4() == nil {
+		return la, ra
+	}
+	local := net.IP(la)
+	if local.IsUnspecified() {
+		return net.IPv4zero.To4(), peer.To4()
+	}
+	if local.To4() != nil {
+		return local.To4(), peer.To4()
+	}
+	return la, ra
 }
 
 func tunnelCfgToNl(cfg *TunnelConfig) (*nll2tp.TunnelConfig, error) {
 	// TODO: facilitate kernel level debug
+	// The checksum attributes only apply to tunnels whose socket is created
+	// by the kernel.  Managed tunnels inherit checksum behaviour from their
+	// socket, which is configured by the control plane.
 	return &nll2tp.TunnelConfig{
-		Tid:        nll2tp.L2tpTunnelID(cfg.TunnelID),
-		Ptid:       nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
-		Version:    nll2tp.L2tpProtocolVersion(cfg.Version),
-		Encap:      nll2tp.L2tpEncapType(cfg.Encap),
-		DebugFlags: nll2tp.L2tpDebugFlags(0)}, nil
+		Tid:                nll2tp.L2tpTunnelID(cfg.TunnelID),
+		Ptid:               nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
+		Version:            nll2tp.L2tpProtocolVersion(cfg.Version),
+		Encap:              nll2tp.L2tpEncapType(cfg.Encap),
+		DebugFlags:         nll2tp.L2tpDebugFlags(0),
+		UDPChecksum:        cfg.DataChecksum == UDPChecksumEnabled,
+		UDPZeroChecksum6Tx: cfg.DataChecksum == UDPChecksumDisabled,
+		UDPZeroChecksum6Rx: cfg.DataChecksum == UDPChecksumDisabled}, nil
 }
 
 func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.SessionConfig, error) {
-	reorderTimeout := uint64(0)
-
-	if cfg.ReorderTimeout != 0 {
-		// TODO: I initially thought sysconf SC_CLK_TCK would allow us to perform
-		// translation from milliseconds to HZ.  But sadly that's not the case since
-		// SC_CLK_TCK reports USER_HZ.
-		// It may be necessary to add a netlink attribute to allow this to be addressed.
-		return nil, fmt.Errorf("currently cannot convert reorder timeout to HZ")
+	if cfg.ReorderTimeout < 0 {
+		return nil, fmt.Errorf("reorder timeout may not be negative")
 	}
+	reorderTimeout := uint64(cfg.ReorderTimeout / time.Millisecond)
 
 	// TODO: facilitate kernel level debug
 	// TODO: IsLNS defaulting to false allows the peer to decide,
@@ -78,85 +113,273 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		PeerCookie:     cfg.PeerCookie,
 		IfName:         cfg.InterfaceName,
 		L2SpecType:     nll2tp.L2tpL2specType(cfg.L2SpecType),
+		MTU:            cfg.MTU,
 		DebugFlags:     nll2tp.L2tpDebugFlags(0)}, nil
 }
 
 func (dpf *nlDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	// The kernel marks data packets using the socket's TOS or traffic
+	// class only
+	if tcfg.InheritDataDSCP {
+		return nil, fmt.Errorf("the Linux kernel data plane doesn't support inheriting the data DSCP")
+	}
 
-	nlcfg, err := tunnelCfgToNl(tcfg)
+	tdp, err := dpf.newTunnelDataPlane(tcfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert tunnel config for netlink use: %v", err)
+		return nil, err
 	}
+	nlcfg := tdp.cfg
 
 	// If the tunnel has a socket FD, create a managed tunnel dataplane.
 	// Otherwise, create a static dataplane.
 	if fd >= 0 {
-		err = dpf.nlconn.CreateManagedTunnel(fd, nlcfg)
+		err = tdp.nlconn.CreateManagedTunnel(fd, nlcfg)
+		// The kernel associates a single tunnel with each socket
+		if errors.Is(err, unix.EBUSY) && tcfg.SharedSocket {
+			return nil, fmt.Errorf("the Linux kernel data plane doesn't support tunnels sharing a socket: %v", err)
+		}
 	} else {
 		var la, ra []byte
+
+		// Kernel-created sockets have no means of setting the DSCP
+		if tcfg.DataDSCP != 0 {
+			err = fmt.Errorf("data DSCP marking is not supported for static tunnels")
+		} else if tcfg.RecvBufferSize != 0 || tcfg.SendBufferSize != 0 || tcfg.BindDevice != "" {
+			err = fmt.Errorf("socket options are not supported for static tunnels")
+		}
+		if err != nil {
+			tdp.release()
+			return nil, err
+		}
 		var lp, rp uint16
 
 		la, lp, err = sockaddrAddrPort(sal)
 		if err != nil {
+			tdp.release()
 			return nil, fmt.Errorf("invalid local address %v: %v", sal, err)
 		}
 
 		ra, rp, err = sockaddrAddrPort(sap)
 		if err != nil {
+			tdp.release()
 			return nil, fmt.Errorf("invalid remote address %v: %v", sap, err)
 		}
 
-		err = dpf.nlconn.CreateStaticTunnel(la, lp, ra, rp, nlcfg)
+		la, ra = unmapAddrPair(la, ra)
+		err = tdp.nlconn.CreateStaticTunnel(la, lp, ra, rp, nlcfg)
 	}
 	if err != nil {
+		tdp.release()
 		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %v", err)
 	}
-	return &nlTunnelDataPlane{f: dpf, cfg: nlcfg}, nil
+	return tdp, nil
 }
 
-func (dpf *nlDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+// newTunnelDataPlane returns the data plane for a tunnel, which is
+// registered with the data plane if the tunnel is in another network
+// namespace so that the tunnel's sessions use the same netlink connection.
+func (dpf *nlDataPlane) newTunnelDataPlane(tcfg *TunnelConfig) (*nlTunnelDataPlane, error) {
+	nlcfg, err := tunnelCfgToNl(tcfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tunnel config for netlink use: %v", err)
+	}
 
+	tdp := &nlTunnelDataPlane{f: dpf, cfg: nlcfg, nlconn: dpf.nlconn}
+	if tcfg.NetNS == "" {
+		return tdp, nil
+	}
+
+	err = withNetNS(tcfg.NetNS, func() (err error) {
+		tdp.nlconn, err = nll2tp.Dial()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish a netlink/L2TP connection in network namespace %q: %v", tcfg.NetNS, err)
+	}
+	tdp.netns = tcfg.NetNS
+
+	dpf.lock.Lock()
+	defer dpf.lock.Unlock()
+	if _, ok := dpf.tunnels[tcfg.TunnelID]; ok {
+		tdp.nlconn.Close()
+		return nil, fmt.Errorf("already have a data plane for tunnel %v", tcfg.TunnelID)
+	}
+	dpf.tunnels[tcfg.TunnelID] = tdp
+	return tdp, nil
+}
+
+// release releases the tunnel's netlink connection if the tunnel is in
+// another network namespace.
+func (tdp *nlTunnelDataPlane) release() {
+	if tdp.netns == "" {
+		return
+	}
+	tdp.f.lock.Lock()
+	delete(tdp.f.tunnels, ControlConnID(tdp.cfg.Tid))
+	tdp.f.lock.Unlock()
+	tdp.nlconn.Close()
+}
+
+// newSessionDataPlane returns the data plane for a session of the tunnel
+// with the given ID.
+func (dpf *nlDataPlane) newSessionDataPlane(tid, ptid ControlConnID, scfg *SessionConfig) (*nlSessionDataPlane, error) {
 	nlcfg, err := sessionCfgToNl(tid, ptid, scfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert session config for netlink use: %v", err)
 	}
 
-	err = dpf.nlconn.CreateSession(nlcfg)
+	sdp := &nlSessionDataPlane{f: dpf, cfg: nlcfg, nlconn: dpf.nlconn, netns: scfg.InterfaceNetNS}
+	dpf.lock.Lock()
+	if tdp, ok := dpf.tunnels[tid]; ok {
+		sdp.nlconn = tdp.nlconn
+		sdp.netns = sessionInterfaceNetNS(tdp.netns, scfg)
+	}
+	dpf.lock.Unlock()
+	return sdp, nil
+}
+
+func (dpf *nlDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+
+	sdp, err := dpf.newSessionDataPlane(tid, ptid, scfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sdp.nlconn.CreateSession(sdp.cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate session via. netlink: %v", err)
 	}
-	return &nlSessionDataPlane{f: dpf, cfg: nlcfg}, nil
+	return sdp, nil
+}
+
+// nlAddrString renders an address and port reported by the kernel in
+// the host:port form used by TunnelConfig, or returns an empty string if
+// the kernel didn't report the address.
+func nlAddrString(addr []byte, port uint16) string {
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return ""
+	}
+	return net.JoinHostPort(net.IP(addr).String(), strconv.Itoa(int(port)))
+}
+
+func tunnelInfoToCfg(info *nll2tp.TunnelInfo) *TunnelConfig {
+	cfg := &TunnelConfig{
+		Local:        nlAddrString(info.LocalAddr, info.LocalPort),
+		Peer:         nlAddrString(info.PeerAddr, info.PeerPort),
+		Encap:        EncapType(info.Encap),
+		Version:      ProtocolVersion(info.Version),
+		TunnelID:     ControlConnID(info.Tid),
+		PeerTunnelID: ControlConnID(info.Ptid),
+	}
+	if info.UDPChecksum {
+		cfg.DataChecksum = UDPChecksumEnabled
+	} else if info.UDPZeroChecksum6Tx {
+		cfg.DataChecksum = UDPChecksumDisabled
+	}
+	return cfg
+}
+
+func sessionInfoToCfg(info *nll2tp.SessionInfo) *SessionConfig {
+	return &SessionConfig{
+		SessionID:      ControlConnID(info.Sid),
+		PeerSessionID:  ControlConnID(info.Psid),
+		Pseudowire:     PseudowireType(info.PseudowireType),
+		SeqNum:         info.SendSeq,
+		ReorderTimeout: time.Duration(info.ReorderTimeout) * time.Millisecond,
+		Cookie:         info.LocalCookie,
+		PeerCookie:     info.PeerCookie,
+		InterfaceName:  info.IfName,
+		L2SpecType:     L2SpecType(info.L2SpecType),
+	}
+}
+
+func (dpf *nlDataPlane) DiscoverTunnels() ([]DiscoveredTunnel, error) {
+	tunnels, err := dpf.nlconn.DumpTunnels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels via. netlink: %v", err)
+	}
+	sessions, err := dpf.nlconn.DumpSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions via. netlink: %v", err)
+	}
+
+	found := make([]DiscoveredTunnel, len(tunnels))
+	byTid := make(map[nll2tp.L2tpTunnelID]*DiscoveredTunnel)
+	for i := range tunnels {
+		found[i].Config = tunnelInfoToCfg(&tunnels[i])
+		byTid[tunnels[i].Tid] = &found[i]
+	}
+	for i := range sessions {
+		if t, ok := byTid[sessions[i].Tid]; ok {
+			t.Sessions = append(t.Sessions, sessionInfoToCfg(&sessions[i]))
+		}
+	}
+	return found, nil
+}
+
+func (dpf *nlDataPlane) AdoptTunnel(tcfg *TunnelConfig) (TunnelDataPlane, error) {
+	return dpf.newTunnelDataPlane(tcfg)
+}
+
+func (dpf *nlDataPlane) AdoptSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return dpf.newSessionDataPlane(tid, ptid, scfg)
 }
 
 func (dpf *nlDataPlane) Close() {
 
+	dpf.lock.Lock()
+	for _, tdp := range dpf.tunnels {
+		tdp.nlconn.Close()
+	}
+	dpf.tunnels = nil
+	dpf.lock.Unlock()
+
 	if dpf.nlconn != nil {
 		dpf.nlconn.Close()
 	}
 }
 
 func (tdp *nlTunnelDataPlane) Down() error {
-	return tdp.f.nlconn.DeleteTunnel(tdp.cfg)
+	err := tdp.nlconn.DeleteTunnel(tdp.cfg)
+	tdp.release()
+	return err
+}
+
+func (tdp *nlTunnelDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	info, err := tdp.nlconn.GetTunnelInfo(tdp.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return statisticsFromNl(&info.Statistics), nil
 }
 
 func (sdp *nlSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
-	info, err := sdp.f.nlconn.GetSessionInfo(sdp.cfg)
+	info, err := sdp.nlconn.GetSessionInfo(sdp.cfg)
 	if err != nil {
 		return nil, err
 	}
+	return statisticsFromNl(&info.Statistics), nil
+}
+
+func statisticsFromNl(stats *nll2tp.SessionStatistics) *SessionDataPlaneStatistics {
 	return &SessionDataPlaneStatistics{
-		TxPackets: info.Statistics.TxPacketCount,
-		TxBytes:   info.Statistics.TxBytes,
-		TxErrors:  info.Statistics.TxErrorCount,
-		RxPackets: info.Statistics.RxPacketCount,
-		RxBytes:   info.Statistics.RxBytes,
-		RxErrors:  info.Statistics.RxErrorCount,
-	}, nil
+		TxPackets: stats.TxPacketCount,
+		TxBytes:   stats.TxBytes,
+		TxErrors:  stats.TxErrorCount,
+		RxPackets: stats.RxPacketCount,
+		RxBytes:   stats.RxBytes,
+		RxErrors:  stats.RxErrorCount,
+
+		RxSeqDiscards:   stats.RxSeqDiscardCount,
+		RxOutOfSequence: stats.RxOOSCount,
+
+		RxCookieDiscards: stats.RxCookieDiscardCount,
+	}
 }
 
 func (sdp *nlSessionDataPlane) GetInterfaceName() (string, error) {
 	if sdp.interfaceName == "" {
-		info, err := sdp.f.nlconn.GetSessionInfo(sdp.cfg)
+		info, err := sdp.nlconn.GetSessionInfo(sdp.cfg)
 		if err != nil {
 			return "", err
 		}
@@ -165,8 +388,49 @@ func (sdp *nlSessionDataPlane) GetInterfaceName() (string, error) {
 	return sdp.interfaceName, nil
 }
 
+func (sdp *nlSessionDataPlane) SetMTU(mtu uint16) error {
+	ifname, err := sdp.GetInterfaceName()
+	if err != nil {
+		return err
+	}
+	if ifname == "" {
+		return fmt.Errorf("session has no network interface")
+	}
+	return withNetNS(sdp.netns, func() error {
+		return setInterfaceMTU(ifname, mtu)
+	})
+}
+
+// setInterfaceMTU sets the MTU of a network interface using the
+// SIOCSIFMTU ioctl, which takes a struct ifreq.
+func setInterfaceMTU(ifname string, mtu uint16) error {
+	if len(ifname) >= unix.IFNAMSIZ {
+		return fmt.Errorf("interface name %q is too long", ifname)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifr struct {
+		name [unix.IFNAMSIZ]byte
+		mtu  int32
+		_    [20]byte
+	}
+	copy(ifr.name[:], ifname)
+	ifr.mtu = int32(mtu)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFMTU, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("ioctl(SIOCSIFMTU, %q): %v", ifname, errno)
+	}
+	return nil
+}
+
 func (sdp *nlSessionDataPlane) Down() error {
-	return sdp.f.nlconn.DeleteSession(sdp.cfg)
+	return sdp.nlconn.DeleteSession(sdp.cfg)
 }
 
 func newNetlinkDataPlane() (DataPlane, error) {
@@ -177,6 +441,7 @@ func newNetlinkDataPlane() (DataPlane, error) {
 	}
 
 	return &nlDataPlane{
-		nlconn: nlconn,
+		nlconn:  nlconn,
+		tunnels: make(map[ControlConnID]*nlTunnelDataPlane),
 	}, nil
 }
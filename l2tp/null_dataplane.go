@@ -1,12 +1,15 @@
 package l2tp
 
 import (
+	"errors"
+
 	"golang.org/x/sys/unix"
 )
 
 var _ DataPlane = (*nullDataPlane)(nil)
 var _ TunnelDataPlane = (*nullTunnelDataPlane)(nil)
 var _ SessionDataPlane = (*nullSessionDataPlane)(nil)
+var _ DataPlane = (*rawSocketDataPlane)(nil)
 
 type nullDataPlane struct {
 }
@@ -43,3 +46,28 @@ func (sdp *nullSessionDataPlane) GetInterfaceName() (string, error) {
 func (tdp *nullSessionDataPlane) Down() error {
 	return nil
 }
+
+// rawSocketDataPlane is the data plane of tunnels whose control plane
+// falls back to a raw IP socket for L2TPv3 IP encapsulation.  Neither the
+// Linux kernel data plane nor the userspace data plane can carry the data
+// packets of sessions received on a raw socket, so the tunnel carries
+// control messages only and sessions are rejected.
+type rawSocketDataPlane struct {
+}
+
+type rawSocketTunnelDataPlane struct {
+	nullTunnelDataPlane
+}
+
+var errRawSocketSession = errors.New("sessions are not supported by tunnels using a raw IP socket for IP encapsulation")
+
+func (rdp *rawSocketDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	return &rawSocketTunnelDataPlane{}, nil
+}
+
+func (rdp *rawSocketDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return nil, errRawSocketSession
+}
+
+func (rdp *rawSocketDataPlane) Close() {
+}
@@ -0,0 +1,984 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TunnelOption sets a parameter of a TunnelConfig built by NewTunnelConfig.
+// Options validate their arguments, returning an error for values the
+// tunnel would reject.
+type TunnelOption func(cfg *TunnelConfig) error
+
+// SessionOption sets a parameter of a SessionConfig built by
+// NewSessionConfig.  Options validate their arguments, returning an error
+// for values the session would reject.
+type SessionOption func(cfg *SessionConfig) error
+
+// NewTunnelConfig builds a tunnel configuration from a list of options,
+// as an alternative to populating TunnelConfig directly.
+// The configuration advertises both sync and async framing capabilities,
+// and parameters not set by an option take the defaults documented by
+// TunnelConfig.  Once the options have been applied the combination of
+// parameters is checked, e.g. that IP encapsulation is used with L2TPv3
+// only.  Checks depending on the tunnel type are made on tunnel creation.
+func NewTunnelConfig(opts ...TunnelOption) (*TunnelConfig, error) {
+	cfg := &TunnelConfig{
+		FramingCaps: FramingCapSync | FramingCapAsync,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Encap == EncapTypeIP && cfg.Version == ProtocolVersion2 {
+		return nil, fmt.Errorf("L2TPv2 supports UDP encapsulation only")
+	}
+	if cfg.Version == ProtocolVersion2 {
+		if cfg.TunnelID > v2TidSidMax || cfg.PeerTunnelID > v2TidSidMax {
+			return nil, fmt.Errorf("L2TPv2 tunnel IDs must be 16 bit values")
+		}
+	}
+	if cfg.AlternateSecret != "" && cfg.Secret == "" {
+		return nil, fmt.Errorf("alternate secret requires a secret")
+	}
+	if cfg.ChallengeLength != 0 && cfg.Secret == "" {
+		return nil, fmt.Errorf("challenge length requires a secret")
+	}
+	if cfg.SharedSocket && cfg.Encap == EncapTypeIP {
+		return nil, fmt.Errorf("shared sockets support UDP encapsulation only")
+	}
+	return cfg, nil
+}
+
+// NewSessionConfig builds a session configuration from a list of options,
+// as an alternative to populating SessionConfig directly.
+// The configuration uses a PPP pseudowire unless WithPseudowire is given,
+// and parameters not set by an option take the defaults documented by
+// SessionConfig.  Once the options have been applied the combination of
+// parameters is checked, e.g. that a bundle ID is used with a PPP
+// pseudowire only.  Checks depending on the tunnel's protocol version are
+// made on session creation.
+func NewSessionConfig(opts ...SessionOption) (*SessionConfig, error) {
+	cfg := &SessionConfig{
+		Pseudowire: PseudowireTypePPP,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSessionConfig(0, nil, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.OnDemand && cfg.Persist {
+		return nil, fmt.Errorf("on-demand sessions may not be persistent")
+	}
+	if cfg.Static {
+		if cfg.Persist || cfg.OnDemand {
+			return nil, fmt.Errorf("static sessions may not be persistent or on-demand")
+		}
+		if cfg.SessionID == 0 || cfg.PeerSessionID == 0 {
+			return nil, fmt.Errorf("static sessions require session IDs")
+		}
+	}
+	return cfg, nil
+}
+
+func checkHostPort(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	return nil
+}
+
+func checkPositive(what string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%v must be positive", what)
+	}
+	return nil
+}
+
+func checkIfName(what, name string) error {
+	if name == "" {
+		return fmt.Errorf("%v may not be empty", what)
+	}
+	if len(name) >= unix.IFNAMSIZ {
+		return fmt.Errorf("%v %q is too long", what, name)
+	}
+	return nil
+}
+
+func checkDSCP(dscp uint8) error {
+	if dscp > 63 {
+		return fmt.Errorf("DSCP %v out of range 0-63", dscp)
+	}
+	return nil
+}
+
+func checkChecksumMode(mode UDPChecksumMode) error {
+	switch mode {
+	case UDPChecksumDefault, UDPChecksumEnabled, UDPChecksumDisabled:
+		return nil
+	}
+	return fmt.Errorf("unrecognised UDP checksum mode %v", int(mode))
+}
+
+func checkPseudowire(pw PseudowireType) error {
+	if pw != PseudowireTypePPP && pw != PseudowireTypeIP && !isEthPseudowire(pw) {
+		return fmt.Errorf("unsupported pseudowire type %v", pw)
+	}
+	return nil
+}
+
+// WithLocal sets the local address, in host:port form, of the tunnel.
+func WithLocal(addr string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkHostPort(addr); err != nil {
+			return err
+		}
+		cfg.Local = addr
+		return nil
+	}
+}
+
+// WithPeer sets the address, in host:port form, of the tunnel's peer.
+func WithPeer(addr string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkHostPort(addr); err != nil {
+			return err
+		}
+		cfg.Peer = addr
+		return nil
+	}
+}
+
+// WithEncap sets the encapsulation type of the tunnel.
+func WithEncap(encap EncapType) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if encap != EncapTypeUDP && encap != EncapTypeIP {
+			return fmt.Errorf("unrecognised encapsulation type %v", int(encap))
+		}
+		cfg.Encap = encap
+		return nil
+	}
+}
+
+// WithVersion sets the L2TP protocol version of the tunnel.
+func WithVersion(version ProtocolVersion) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if version != ProtocolVersion2 && version != ProtocolVersion3 {
+			return fmt.Errorf("unsupported protocol version %v", int(version))
+		}
+		cfg.Version = version
+		return nil
+	}
+}
+
+// WithVersionPolicy sets the order in which protocol versions are
+// attempted by a dynamic tunnel which doesn't specify a version.
+func WithVersionPolicy(policy VersionPolicy) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if policy != VersionPolicyPreferV3 && policy != VersionPolicyPreferV2 {
+			return fmt.Errorf("unrecognised version policy %v", int(policy))
+		}
+		cfg.VersionPolicy = policy
+		return nil
+	}
+}
+
+// WithTunnelID sets the local tunnel ID of the tunnel.
+func WithTunnelID(id ControlConnID) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if id == 0 {
+			return fmt.Errorf("tunnel ID must be non-zero")
+		}
+		cfg.TunnelID = id
+		return nil
+	}
+}
+
+// WithPeerTunnelID sets the peer's tunnel ID for the tunnel.
+func WithPeerTunnelID(id ControlConnID) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if id == 0 {
+			return fmt.Errorf("peer tunnel ID must be non-zero")
+		}
+		cfg.PeerTunnelID = id
+		return nil
+	}
+}
+
+// WithWindowSize sets the initial window size of the reliable transport.
+func WithWindowSize(size uint16) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if size == 0 {
+			return fmt.Errorf("window size must be non-zero")
+		}
+		cfg.WindowSize = size
+		return nil
+	}
+}
+
+// WithReorderQueueSize sets the number of out-of-order control messages
+// buffered by the tunnel.
+func WithReorderQueueSize(size uint16) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if size == 0 {
+			return fmt.Errorf("reorder queue size must be non-zero")
+		}
+		cfg.ReorderQueueSize = size
+		return nil
+	}
+}
+
+// WithStopCCNTimeout sets the time the tunnel waits for StopCCN
+// retransmissions to be acknowledged.
+func WithStopCCNTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("StopCCN timeout", timeout); err != nil {
+			return err
+		}
+		cfg.StopCCNTimeout = timeout
+		return nil
+	}
+}
+
+// WithSccrpTimeout bounds the time a dynamic tunnel waits for an SCCRP.
+func WithSccrpTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("SCCRP timeout", timeout); err != nil {
+			return err
+		}
+		cfg.SccrpTimeout = timeout
+		return nil
+	}
+}
+
+// WithScccnTimeout bounds the time a tunnel accepted by a listener waits
+// for an SCCCN.
+func WithScccnTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("SCCCN timeout", timeout); err != nil {
+			return err
+		}
+		cfg.ScccnTimeout = timeout
+		return nil
+	}
+}
+
+// WithSessionReplyTimeout bounds the time the tunnel's dynamic sessions
+// wait for a reply to their ICRQ.
+func WithSessionReplyTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("session reply timeout", timeout); err != nil {
+			return err
+		}
+		cfg.SessionReplyTimeout = timeout
+		return nil
+	}
+}
+
+// WithHelloTimeout enables keep-alive messages with the given timeout.
+func WithHelloTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("hello timeout", timeout); err != nil {
+			return err
+		}
+		cfg.HelloTimeout = timeout
+		return nil
+	}
+}
+
+// WithRetryTimeout sets the starting retry timeout of the reliable
+// transport.
+func WithRetryTimeout(timeout time.Duration) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkPositive("retry timeout", timeout); err != nil {
+			return err
+		}
+		cfg.RetryTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxRetries sets how many times a control message may be retried.
+func WithMaxRetries(retries uint) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if retries == 0 {
+			return fmt.Errorf("max retries must be non-zero")
+		}
+		cfg.MaxRetries = retries
+		return nil
+	}
+}
+
+// WithHostName sets the host name advertised by the tunnel.
+func WithHostName(name string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if name == "" {
+			return fmt.Errorf("host name may not be empty")
+		}
+		cfg.HostName = name
+		return nil
+	}
+}
+
+// WithSecret sets the shared secret used to authenticate the peer.
+func WithSecret(secret string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if secret == "" {
+			return fmt.Errorf("secret may not be empty")
+		}
+		cfg.Secret = secret
+		return nil
+	}
+}
+
+// WithAlternateSecret sets a second shared secret the peer may
+// authenticate itself with.  It requires WithSecret.
+func WithAlternateSecret(secret string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if secret == "" {
+			return fmt.Errorf("alternate secret may not be empty")
+		}
+		cfg.AlternateSecret = secret
+		return nil
+	}
+}
+
+// WithChallengeLength sets the length of the challenge sent to the peer.
+// It requires WithSecret.
+func WithChallengeLength(length int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if length == 0 {
+			return fmt.Errorf("challenge length must be non-zero")
+		}
+		if err := checkChallengeLength(length); err != nil {
+			return err
+		}
+		cfg.ChallengeLength = length
+		return nil
+	}
+}
+
+// WithFramingCaps sets the framing capabilities advertised by the tunnel.
+func WithFramingCaps(caps FramingCapability) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if caps&^(FramingCapSync|FramingCapAsync) != 0 {
+			return fmt.Errorf("unrecognised framing capabilities %#x", uint32(caps))
+		}
+		cfg.FramingCaps = caps
+		return nil
+	}
+}
+
+// WithRouterID sets the Router ID advertised by an L2TPv3 tunnel.
+func WithRouterID(id uint32) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if id == 0 {
+			return fmt.Errorf("router ID must be non-zero")
+		}
+		cfg.RouterID = id
+		return nil
+	}
+}
+
+// WithPseudowireCaps sets the pseudowire types advertised by an L2TPv3
+// tunnel.
+func WithPseudowireCaps(caps ...PseudowireType) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if len(caps) == 0 {
+			return fmt.Errorf("pseudowire capabilities may not be empty")
+		}
+		for _, pw := range caps {
+			if err := checkPseudowire(pw); err != nil {
+				return err
+			}
+		}
+		cfg.PseudowireCaps = append([]PseudowireType(nil), caps...)
+		return nil
+	}
+}
+
+// WithControlChecksum sets UDP checksum behaviour for control messages.
+func WithControlChecksum(mode UDPChecksumMode) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkChecksumMode(mode); err != nil {
+			return err
+		}
+		cfg.ControlChecksum = mode
+		return nil
+	}
+}
+
+// WithDataChecksum sets UDP checksum behaviour for data packets.
+func WithDataChecksum(mode UDPChecksumMode) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkChecksumMode(mode); err != nil {
+			return err
+		}
+		cfg.DataChecksum = mode
+		return nil
+	}
+}
+
+// WithControlDSCP sets the DSCP of control messages sent by the tunnel.
+func WithControlDSCP(dscp uint8) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkDSCP(dscp); err != nil {
+			return err
+		}
+		cfg.ControlDSCP = dscp
+		return nil
+	}
+}
+
+// WithDataDSCP sets the DSCP of data packets sent by the tunnel.
+func WithDataDSCP(dscp uint8) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkDSCP(dscp); err != nil {
+			return err
+		}
+		cfg.DataDSCP = dscp
+		return nil
+	}
+}
+
+// WithInheritDataDSCP sets data packets sent by the tunnel to inherit the
+// DSCP of the packets they carry, translated by dscpMap if it's non-nil.
+func WithInheritDataDSCP(dscpMap map[uint8]uint8) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		for inner, outer := range dscpMap {
+			if err := checkDSCP(inner); err != nil {
+				return err
+			}
+			if err := checkDSCP(outer); err != nil {
+				return err
+			}
+		}
+		cfg.InheritDataDSCP = true
+		cfg.DataDSCPMap = dscpMap
+		return nil
+	}
+}
+
+// WithRecvBufferSize sets the size of the tunnel socket receive buffer.
+func WithRecvBufferSize(size uint32) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if size == 0 {
+			return fmt.Errorf("receive buffer size must be non-zero")
+		}
+		cfg.RecvBufferSize = size
+		return nil
+	}
+}
+
+// WithSendBufferSize sets the size of the tunnel socket send buffer.
+func WithSendBufferSize(size uint32) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if size == 0 {
+			return fmt.Errorf("send buffer size must be non-zero")
+		}
+		cfg.SendBufferSize = size
+		return nil
+	}
+}
+
+// WithBindDevice binds the tunnel socket to the named network interface.
+func WithBindDevice(name string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := checkIfName("bind device", name); err != nil {
+			return err
+		}
+		cfg.BindDevice = name
+		return nil
+	}
+}
+
+// WithPacketInfo enables the use of IP_PKTINFO on the tunnel socket.
+func WithPacketInfo() TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		cfg.PacketInfo = true
+		return nil
+	}
+}
+
+// WithSharedSocket shares the tunnel socket with other tunnels having the
+// same local address.
+func WithSharedSocket() TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		cfg.SharedSocket = true
+		return nil
+	}
+}
+
+// WithNetNS sets the path of the network namespace the tunnel socket is
+// created in.
+func WithNetNS(path string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if path == "" {
+			return fmt.Errorf("network namespace path may not be empty")
+		}
+		cfg.NetNS = path
+		return nil
+	}
+}
+
+// WithMaxSessions limits the number of sessions the tunnel may run.
+func WithMaxSessions(max int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if max <= 0 {
+			return fmt.Errorf("max sessions must be positive")
+		}
+		cfg.MaxSessions = max
+		return nil
+	}
+}
+
+// WithSccrqRateLimit limits the rate at which a listener processes SCCRQs
+// from all peers, in messages per second.
+func WithSccrqRateLimit(rate int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if rate <= 0 {
+			return fmt.Errorf("SCCRQ rate limit must be positive")
+		}
+		cfg.SccrqRateLimit = rate
+		return nil
+	}
+}
+
+// WithPeerSccrqRateLimit limits the rate at which a listener processes
+// SCCRQs from each peer address, in messages per second.
+func WithPeerSccrqRateLimit(rate int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if rate <= 0 {
+			return fmt.Errorf("peer SCCRQ rate limit must be positive")
+		}
+		cfg.PeerSccrqRateLimit = rate
+		return nil
+	}
+}
+
+// WithMaxPendingTunnels limits the number of tunnels a listener may have
+// awaiting establishment.
+func WithMaxPendingTunnels(max int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if max <= 0 {
+			return fmt.Errorf("max pending tunnels must be positive")
+		}
+		cfg.MaxPendingTunnels = max
+		return nil
+	}
+}
+
+// WithDeferTunnelCreation causes a listener to defer creating the tunnels
+// of L2TPv3 peers until they reply to its SCCRP.
+func WithDeferTunnelCreation() TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		cfg.DeferTunnelCreation = true
+		return nil
+	}
+}
+
+// WithAllowedPeers sets the addresses or CIDR prefixes of the peers a
+// listener accepts tunnels from.
+func WithAllowedPeers(peers ...string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		_, err := newPeerACL(&TunnelConfig{AllowedPeers: peers})
+		if err != nil {
+			return err
+		}
+		cfg.AllowedPeers = append([]string(nil), peers...)
+		return nil
+	}
+}
+
+// WithAllowedPeerHostNames sets the host names the peers of a listener
+// may advertise.
+func WithAllowedPeerHostNames(names ...string) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		for _, name := range names {
+			if name == "" {
+				return fmt.Errorf("allowed peer host names may not be empty")
+			}
+		}
+		cfg.AllowedPeerHostNames = append([]string(nil), names...)
+		return nil
+	}
+}
+
+// WithRejectUnauthorizedPeers causes a listener to reject unauthorized
+// peers with a StopCCN rather than discarding their SCCRQs.
+func WithRejectUnauthorizedPeers() TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		cfg.RejectUnauthorizedPeers = true
+		return nil
+	}
+}
+
+// WithPeerConfigs sets the configurations of the tunnels a listener accepts
+// from particular peers.
+func WithPeerConfigs(pcs ...PeerConfig) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		for _, pc := range pcs {
+			if pc.Peer == "" && pc.HostName == "" {
+				return fmt.Errorf("peer config must specify a peer address or host name")
+			}
+			if pc.Config == nil {
+				return fmt.Errorf("peer config for %q: invalid nil config", pc.Peer+pc.HostName)
+			}
+		}
+		cfg.PeerConfigs = append([]PeerConfig(nil), pcs...)
+		return nil
+	}
+}
+
+// WithMaxMessagesPerDatagram limits the number of control messages parsed
+// from a datagram.
+func WithMaxMessagesPerDatagram(max int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if max <= 0 {
+			return fmt.Errorf("max messages per datagram must be positive")
+		}
+		cfg.MaxMessagesPerDatagram = max
+		return nil
+	}
+}
+
+// WithMaxAVPsPerMessage limits the number of AVPs parsed from a control
+// message.
+func WithMaxAVPsPerMessage(max int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if max <= 0 {
+			return fmt.Errorf("max AVPs per message must be positive")
+		}
+		cfg.MaxAVPsPerMessage = max
+		return nil
+	}
+}
+
+// WithMaxAVPLen limits the size of the AVP payloads parsed from a control
+// message.
+func WithMaxAVPLen(max int) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if max <= 0 {
+			return fmt.Errorf("max AVP length must be positive")
+		}
+		cfg.MaxAVPLen = max
+		return nil
+	}
+}
+
+// WithDuplicateAVPs sets how control messages with duplicated AVPs are
+// handled.
+func WithDuplicateAVPs(policy DuplicateAVPPolicy) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		switch policy {
+		case DuplicateAVPFirst, DuplicateAVPLast, DuplicateAVPReject:
+		default:
+			return fmt.Errorf("unrecognised duplicate AVP policy %v", int(policy))
+		}
+		cfg.DuplicateAVPs = policy
+		return nil
+	}
+}
+
+// WithTunnelExtraAVPs adds application-supplied AVPs to the SCCRQ or SCCRP
+// messages sent by the tunnel.
+func WithTunnelExtraAVPs(avps ...ExtraAVP) TunnelOption {
+	return func(cfg *TunnelConfig) error {
+		if err := validateExtraAVPs(avps, MessageTypeSCCRQ, MessageTypeSCCRP); err != nil {
+			return err
+		}
+		cfg.ExtraAVPs = append(cfg.ExtraAVPs, avps...)
+		return nil
+	}
+}
+
+// WithSessionID sets the local session ID of the session.
+func WithSessionID(id ControlConnID) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if id == 0 {
+			return fmt.Errorf("session ID must be non-zero")
+		}
+		cfg.SessionID = id
+		return nil
+	}
+}
+
+// WithPeerSessionID sets the peer's session ID for the session.
+func WithPeerSessionID(id ControlConnID) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if id == 0 {
+			return fmt.Errorf("peer session ID must be non-zero")
+		}
+		cfg.PeerSessionID = id
+		return nil
+	}
+}
+
+// WithPseudowire sets the pseudowire type of the session.
+func WithPseudowire(pw PseudowireType) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkPseudowire(pw); err != nil {
+			return err
+		}
+		cfg.Pseudowire = pw
+		return nil
+	}
+}
+
+// WithPseudowireFallback sets the pseudowire types a dynamic L2TPv3
+// session falls back to if the peer doesn't support its pseudowire.
+func WithPseudowireFallback(pws ...PseudowireType) SessionOption {
+	return func(cfg *SessionConfig) error {
+		for _, pw := range pws {
+			if err := checkPseudowire(pw); err != nil {
+				return err
+			}
+		}
+		cfg.PseudowireFallback = append([]PseudowireType(nil), pws...)
+		return nil
+	}
+}
+
+// WithSeqNum enables sequence numbers for the session's data packets.
+func WithSeqNum() SessionOption {
+	return func(cfg *SessionConfig) error {
+		cfg.SeqNum = true
+		return nil
+	}
+}
+
+// WithReorderTimeout sets the time out of sequence data packets are
+// queued for.
+func WithReorderTimeout(timeout time.Duration) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkPositive("reorder timeout", timeout); err != nil {
+			return err
+		}
+		cfg.ReorderTimeout = timeout
+		return nil
+	}
+}
+
+func checkCookie(cookie []byte) error {
+	if l := len(cookie); l != 4 && l != 8 {
+		return fmt.Errorf("cookie length must be 4 or 8 bytes, not %v", l)
+	}
+	return nil
+}
+
+// WithCookie sets the local L2TPv3 cookie of the session.
+func WithCookie(cookie []byte) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkCookie(cookie); err != nil {
+			return err
+		}
+		cfg.Cookie = append([]byte(nil), cookie...)
+		return nil
+	}
+}
+
+// WithPeerCookie sets the L2TPv3 cookie the peer sends in its data
+// packets.
+func WithPeerCookie(cookie []byte) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkCookie(cookie); err != nil {
+			return err
+		}
+		cfg.PeerCookie = append([]byte(nil), cookie...)
+		return nil
+	}
+}
+
+// WithRemoteEndID sets the identifier of the circuit the session is
+// connected to at the peer.
+func WithRemoteEndID(id []byte) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if len(id) == 0 {
+			return fmt.Errorf("remote end ID may not be empty")
+		}
+		cfg.RemoteEndID = append([]byte(nil), id...)
+		return nil
+	}
+}
+
+// WithConnectSpeed sets the transmit and receive speeds of the session's
+// circuit in bits per second.  A receive speed of zero isn't reported.
+func WithConnectSpeed(tx, rx uint64) SessionOption {
+	return func(cfg *SessionConfig) error {
+		cfg.TxConnectSpeed = tx
+		cfg.RxConnectSpeed = rx
+		return nil
+	}
+}
+
+// WithBundleID tags a PPP pseudowire session as a member of the named
+// Multilink PPP bundle.
+func WithBundleID(id string) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if id == "" {
+			return fmt.Errorf("bundle ID may not be empty")
+		}
+		if len(id) > maxBundleIDLen {
+			return fmt.Errorf("bundle ID %q is longer than %v bytes", id, maxBundleIDLen)
+		}
+		cfg.BundleID = id
+		return nil
+	}
+}
+
+// WithInterfaceName sets the name, or name template, of the session's
+// network interface.
+func WithInterfaceName(name string) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkIfName("interface name", name); err != nil {
+			return err
+		}
+		cfg.InterfaceName = name
+		return nil
+	}
+}
+
+// WithHardwareAddr sets the MAC address of an Ethernet pseudowire
+// session's network interface.
+func WithHardwareAddr(addr net.HardwareAddr) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if len(addr) != 6 {
+			return fmt.Errorf("hardware address %v is not an Ethernet address", addr)
+		}
+		cfg.HardwareAddr = append(net.HardwareAddr(nil), addr...)
+		return nil
+	}
+}
+
+// WithL2SpecType sets the L2TPv3 Layer 2 specific sublayer of the session.
+func WithL2SpecType(l2spec L2SpecType) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if l2spec != L2SpecTypeNone && l2spec != L2SpecTypeDefault {
+			return fmt.Errorf("unsupported layer 2 specific sublayer type %v", l2spec)
+		}
+		cfg.L2SpecType = l2spec
+		return nil
+	}
+}
+
+// WithMTU sets the MTU of the session's network interface.
+func WithMTU(mtu uint16) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if mtu < minSessionMTU {
+			return fmt.Errorf("MTU %v is less than the minimum of %v", mtu, minSessionMTU)
+		}
+		cfg.MTU = mtu
+		return nil
+	}
+}
+
+// WithInterfaceAddrs sets the addresses, in CIDR notation, assigned to an
+// Ethernet pseudowire session's network interface.
+func WithInterfaceAddrs(addrs ...string) SessionOption {
+	return func(cfg *SessionConfig) error {
+		for _, addr := range addrs {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return fmt.Errorf("invalid interface address %q: %v", addr, err)
+			}
+		}
+		cfg.InterfaceAddrs = append([]string(nil), addrs...)
+		return nil
+	}
+}
+
+// WithInterfaceUp brings up an Ethernet pseudowire session's network
+// interface once its data plane has been created.
+func WithInterfaceUp() SessionOption {
+	return func(cfg *SessionConfig) error {
+		cfg.InterfaceUp = true
+		return nil
+	}
+}
+
+// WithBridge attaches an Ethernet pseudowire session's network interface
+// to the named Linux bridge.
+func WithBridge(name string) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := checkIfName("bridge name", name); err != nil {
+			return err
+		}
+		cfg.Bridge = name
+		return nil
+	}
+}
+
+// WithVLANs creates VLAN sub-interfaces on an Ethernet pseudowire
+// session's network interface.
+func WithVLANs(vids ...uint16) SessionOption {
+	return func(cfg *SessionConfig) error {
+		cfg.VLANs = append([]uint16(nil), vids...)
+		return nil
+	}
+}
+
+// WithInterfaceNetNS moves an Ethernet pseudowire session's network
+// interface to the network namespace at path.
+func WithInterfaceNetNS(path string) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if path == "" {
+			return fmt.Errorf("network namespace path may not be empty")
+		}
+		cfg.InterfaceNetNS = path
+		return nil
+	}
+}
+
+// WithSessionExtraAVPs adds application-supplied AVPs to the ICRQ or ICCN
+// messages sent by the session.
+func WithSessionExtraAVPs(avps ...ExtraAVP) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if err := validateExtraAVPs(avps, MessageTypeICRQ, MessageTypeICCN); err != nil {
+			return err
+		}
+		cfg.ExtraAVPs = append(cfg.ExtraAVPs, avps...)
+		return nil
+	}
+}
+
+// WithPersist re-establishes a dynamic session if the peer closes it,
+// initially after the given backoff, or after the default backoff if zero.
+func WithPersist(backoff time.Duration) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if backoff < 0 {
+			return fmt.Errorf("persist backoff may not be negative")
+		}
+		cfg.Persist = true
+		cfg.PersistBackoff = backoff
+		return nil
+	}
+}
+
+// WithOnDemand establishes a dynamic session when triggered by the
+// application, disconnecting it after the given idle timeout, or never if
+// zero.
+func WithOnDemand(idleTimeout time.Duration) SessionOption {
+	return func(cfg *SessionConfig) error {
+		if idleTimeout < 0 {
+			return fmt.Errorf("idle timeout may not be negative")
+		}
+		cfg.OnDemand = true
+		cfg.IdleTimeout = idleTimeout
+		return nil
+	}
+}
+
+// WithStatic provisions a session in a dynamic tunnel without an incoming
+// call exchange.  It requires WithSessionID and WithPeerSessionID.
+func WithStatic() SessionOption {
+	return func(cfg *SessionConfig) error {
+		cfg.Static = true
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package l2tp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTunnelConfig(t *testing.T) {
+	_, err := NewTunnelConfig(
+		WithPeer("192.0.2.1:1701"),
+		WithVersion(ProtocolVersion3),
+		WithEncap(EncapTypeIP),
+		WithTunnelID(42),
+		WithHelloTimeout(5*time.Second),
+		WithSecret("hunter2"),
+		WithChallengeLength(32),
+		WithPseudowireCaps(PseudowireTypeEth),
+		WithSharedSocket(),
+	)
+	if err == nil {
+		t.Fatalf("NewTunnelConfig() succeeded with a shared IP socket")
+	}
+
+	cfg, err := NewTunnelConfig(
+		WithPeer("192.0.2.1:1701"),
+		WithVersion(ProtocolVersion3),
+		WithEncap(EncapTypeIP),
+		WithTunnelID(42),
+		WithHelloTimeout(5*time.Second),
+		WithSecret("hunter2"),
+		WithChallengeLength(32),
+		WithPseudowireCaps(PseudowireTypeEth),
+	)
+	if err != nil {
+		t.Fatalf("NewTunnelConfig(): %v", err)
+	}
+	want := &TunnelConfig{
+		Peer:            "192.0.2.1:1701",
+		Version:         ProtocolVersion3,
+		Encap:           EncapTypeIP,
+		TunnelID:        42,
+		HelloTimeout:    5 * time.Second,
+		Secret:          "hunter2",
+		ChallengeLength: 32,
+		FramingCaps:     FramingCapSync | FramingCapAsync,
+		PseudowireCaps:  []PseudowireType{PseudowireTypeEth},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("NewTunnelConfig(): got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestNewSessionConfig(t *testing.T) {
+	cfg, err := NewSessionConfig()
+	if err != nil {
+		t.Fatalf("NewSessionConfig(): %v", err)
+	}
+	if cfg.Pseudowire != PseudowireTypePPP {
+		t.Errorf("NewSessionConfig(): got pseudowire %v, want PPP", cfg.Pseudowire)
+	}
+
+	cfg, err = NewSessionConfig(
+		WithPseudowire(PseudowireTypeEth),
+		WithSessionID(1),
+		WithPeerSessionID(2),
+		WithCookie([]byte{1, 2, 3, 4}),
+		WithInterfaceName("l2tpeth%d"),
+		WithMTU(1450),
+		WithStatic(),
+	)
+	if err != nil {
+		t.Fatalf("NewSessionConfig(): %v", err)
+	}
+	want := &SessionConfig{
+		Pseudowire:    PseudowireTypeEth,
+		SessionID:     1,
+		PeerSessionID: 2,
+		Cookie:        []byte{1, 2, 3, 4},
+		InterfaceName: "l2tpeth%d",
+		MTU:           1450,
+		Static:        true,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("NewSessionConfig(): got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestBadOptions(t *testing.T) {
+	tunnelCases := []struct {
+		name string
+		opts []TunnelOption
+		estr string
+	}{
+		{"Bad peer", []TunnelOption{WithPeer("192.0.2.1")}, "invalid address"},
+		{"Zero tunnel ID", []TunnelOption{WithTunnelID(0)}, "must be non-zero"},
+		{"Bad version", []TunnelOption{WithVersion(4)}, "unsupported protocol version"},
+		{"Negative timeout", []TunnelOption{WithHelloTimeout(-time.Second)}, "must be positive"},
+		{"Bad DSCP", []TunnelOption{WithControlDSCP(64)}, "out of range"},
+		{"Bad DSCP map", []TunnelOption{WithInheritDataDSCP(map[uint8]uint8{10: 64})}, "out of range"},
+		{"Bad challenge length", []TunnelOption{WithSecret("s"), WithChallengeLength(8)}, "out of range"},
+		{"Bad allowed peer", []TunnelOption{WithAllowedPeers("banana")}, "invalid allowed peer"},
+		{"Bad extra AVP", []TunnelOption{WithTunnelExtraAVPs(ExtraAVP{Type: 1, Messages: []MessageType{MessageTypeICRQ}})}, "cannot be added"},
+		{"IP encap for L2TPv2", []TunnelOption{WithVersion(ProtocolVersion2), WithEncap(EncapTypeIP)}, "UDP encapsulation only"},
+		{"L2TPv2 tunnel ID", []TunnelOption{WithVersion(ProtocolVersion2), WithTunnelID(70000)}, "16 bit"},
+		{"Alternate secret only", []TunnelOption{WithAlternateSecret("old")}, "requires a secret"},
+	}
+	for _, tt := range tunnelCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTunnelConfig(tt.opts...)
+			if err == nil {
+				t.Fatalf("NewTunnelConfig() succeeded when we expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("NewTunnelConfig(): error %q doesn't contain expected substring %q", err, tt.estr)
+			}
+		})
+	}
+
+	sessionCases := []struct {
+		name string
+		opts []SessionOption
+		estr string
+	}{
+		{"Bad pseudowire", []SessionOption{WithPseudowire(99)}, "unsupported pseudowire"},
+		{"Bad cookie", []SessionOption{WithCookie([]byte{1, 2})}, "cookie length"},
+		{"Small MTU", []SessionOption{WithMTU(40)}, "less than the minimum"},
+		{"Long interface name", []SessionOption{WithInterfaceName("averyverylongname")}, "too long"},
+		{"Bundle ID for Ethernet", []SessionOption{WithPseudowire(PseudowireTypeEth), WithBundleID("mp")}, "PPP pseudowires only"},
+		{"Interface config for PPP", []SessionOption{WithInterfaceUp()}, "Ethernet pseudowires only"},
+		{"Persistent on-demand", []SessionOption{WithPersist(0), WithOnDemand(0)}, "may not be persistent"},
+		{"Static without IDs", []SessionOption{WithStatic()}, "require session IDs"},
+	}
+	for _, tt := range sessionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSessionConfig(tt.opts...)
+			if err == nil {
+				t.Fatalf("NewSessionConfig() succeeded when we expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.estr) {
+				t.Fatalf("NewSessionConfig(): error %q doesn't contain expected substring %q", err, tt.estr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package l2tp
+
+import (
+	"time"
+)
+
+// tokenBucket limits the rate of an event, permitting bursts of up to a
+// second's worth of events.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+// allow returns true if the event is within the rate limit, consuming a
+// token if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full returns true if the bucket has refilled, such that it no longer
+// constrains the event rate.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.rate
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// peerRateLimiter applies a rate limit to each peer address individually.
+// Peers are forgotten once their bucket has refilled, so the number of
+// peers tracked is bounded by the number sending within the last second.
+type peerRateLimiter struct {
+	rate      int
+	peers     map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newPeerRateLimiter(rate int) *peerRateLimiter {
+	return &peerRateLimiter{
+		rate:  rate,
+		peers: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *peerRateLimiter) allow(peer string, now time.Time) bool {
+	if now.Sub(l.lastPrune) >= time.Second {
+		for key, b := range l.peers {
+			if b.full(now) {
+				delete(l.peers, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.peers[peer]
+	if !ok {
+		b = newTokenBucket(l.rate, now)
+		l.peers[peer] = b
+	}
+	return b.allow(now)
+}
@@ -0,0 +1,63 @@
+package l2tp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, now)
+
+	// A second's worth of events may be sent in a burst
+	for i := 0; i < 2; i++ {
+		if !b.allow(now) {
+			t.Fatalf("allow(): event %v rate limited", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatalf("allow(): burst exceeded rate")
+	}
+
+	// Tokens are replenished at the configured rate
+	now = now.Add(500 * time.Millisecond)
+	if !b.allow(now) {
+		t.Errorf("allow(): event rate limited after refill")
+	}
+	if b.allow(now) {
+		t.Errorf("allow(): refill exceeded rate")
+	}
+
+	// The bucket doesn't accumulate more than a second's worth of tokens
+	now = now.Add(time.Minute)
+	if !b.full(now) {
+		t.Errorf("full(): bucket not refilled")
+	}
+	for i := 0; i < 2; i++ {
+		b.allow(now)
+	}
+	if b.allow(now) {
+		t.Errorf("allow(): bucket overfilled")
+	}
+}
+
+func TestPeerRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newPeerRateLimiter(1)
+
+	if !l.allow("192.168.0.1", now) || !l.allow("192.168.0.2", now) {
+		t.Fatalf("allow(): first events rate limited")
+	}
+	if l.allow("192.168.0.1", now) {
+		t.Fatalf("allow(): peer exceeded rate")
+	}
+
+	// Peers are forgotten once their bucket has refilled
+	now = now.Add(2 * time.Second)
+	if !l.allow("192.168.0.1", now) {
+		t.Fatalf("allow(): event rate limited after refill")
+	}
+	if len(l.peers) != 1 {
+		t.Errorf("got %v peers tracked, want 1", len(l.peers))
+	}
+}
@@ -0,0 +1,55 @@
+package l2tp
+
+// The range of sequence numbers behind the next expected Ns within which a
+// received message may be a retransmission.  A peer can only have as many
+// unacknowledged messages outstanding as its transmit window allows, which
+// defaults to 4 (RFC2661 section 5.8, RFC3931 section 4.2).  The window is
+// generous to allow for peers using large transmit windows.
+const replayWindowLen = 64
+
+// The number of times a message may be retransmitted before further copies
+// are considered replays.  This is twice the number of retransmissions
+// RFC2661 section 5.8 recommends, allowing for peers which retry for longer.
+const replayMaxRetransmits = 10
+
+// replayWindow tracks the Ns values of recently received control messages
+// so that replayed messages can be told apart from retransmissions.
+// The zero value is ready to use.
+type replayWindow struct {
+	seen map[uint16]int
+}
+
+// isReplay records receipt of a message with sequence number ns, given the
+// next expected sequence number nr, and returns true if the message is a
+// replay: either it is too old to be a retransmission, or it has been
+// received more often than a peer would retransmit it.
+func (w *replayWindow) isReplay(ns, nr uint16) bool {
+	if w.seen == nil {
+		w.seen = make(map[uint16]int)
+	}
+	w.prune(nr)
+
+	// Messages at or ahead of the next expected sequence number are
+	// tracked if they may be queued pending receipt of earlier messages
+	if seqCompare(ns, nr) >= 0 {
+		if ns-nr < replayWindowLen {
+			w.seen[ns]++
+		}
+		return false
+	}
+
+	if nr-ns > replayWindowLen {
+		return true
+	}
+	w.seen[ns]++
+	return w.seen[ns] > 1+replayMaxRetransmits
+}
+
+// prune forgets sequence numbers which have fallen out of the window.
+func (w *replayWindow) prune(nr uint16) {
+	for ns := range w.seen {
+		if seqCompare(ns, nr) < 0 && nr-ns > replayWindowLen {
+			delete(w.seen, ns)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package l2tp
+
+import (
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	// In-sequence and out-of-order messages aren't replays
+	for _, ns := range []uint16{0, 2, 1} {
+		if w.isReplay(ns, 0) {
+			t.Fatalf("isReplay(%v, 0): new message considered a replay", ns)
+		}
+	}
+
+	// Retransmissions of received messages are permitted up to a limit
+	for i := 0; i < replayMaxRetransmits; i++ {
+		if w.isReplay(1, 3) {
+			t.Fatalf("isReplay(1, 3): retransmission %v considered a replay", i)
+		}
+	}
+	if !w.isReplay(1, 3) {
+		t.Errorf("isReplay(1, 3): excess retransmission not considered a replay")
+	}
+
+	// Messages too old to be retransmissions are replays
+	if !w.isReplay(1, replayWindowLen+2) {
+		t.Errorf("isReplay(1, %v): message outside window not considered a replay", replayWindowLen+2)
+	}
+	if _, ok := w.seen[1]; ok {
+		t.Errorf("message outside window not pruned")
+	}
+
+	// The window tracks sequence numbers across wrap-around
+	if w.isReplay(0xffff, 1) {
+		t.Errorf("isReplay(0xffff, 1): retransmission considered a replay")
+	}
+	if !w.isReplay(0xffff-replayWindowLen, 1) {
+		t.Errorf("isReplay(%v, 1): message outside window not considered a replay", 0xffff-replayWindowLen)
+	}
+}
@@ -0,0 +1,132 @@
+package l2tp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// SessionEvent is an event describing a change in the lifecycle of a
+// session, as delivered by the channel returned by Context.SessionEvents.
+//
+// The concrete type of a SessionEvent is one of *SessionDataplaneReadyEvent,
+// *SessionUpEvent, *SessionDownEvent, *SessionStateEvent,
+// *SessionIPCPUpEvent or *SessionIPCPDownEvent.
+type SessionEvent interface {
+	isSessionEvent()
+}
+
+func (*SessionDataplaneReadyEvent) isSessionEvent() {}
+func (*SessionUpEvent) isSessionEvent()             {}
+func (*SessionDownEvent) isSessionEvent()           {}
+func (*SessionStateEvent) isSessionEvent()          {}
+func (*SessionIPCPUpEvent) isSessionEvent()         {}
+func (*SessionIPCPDownEvent) isSessionEvent()       {}
+
+// sessionEventChannel is an EventHandler forwarding session events
+// to a buffered channel.
+type sessionEventChannel struct {
+	ctx     *Context
+	events  chan SessionEvent
+	dropped uint64
+}
+
+func (sec *sessionEventChannel) HandleEvent(event interface{}) {
+	ev, ok := event.(SessionEvent)
+	if !ok {
+		return
+	}
+	select {
+	case sec.events <- ev:
+	default:
+		n := atomic.AddUint64(&sec.dropped, 1)
+		level.Error(sec.ctx.logger).Log(
+			"message", "session event channel full, dropping event",
+			"event", fmt.Sprintf("%T", ev),
+			"dropped", n)
+	}
+}
+
+// SessionEvents returns a channel on which the context delivers events for
+// all the sessions it manages, as an alternative to registering an
+// EventHandler.  This suits applications which run an event loop selecting
+// on several channels.
+//
+// The channel buffers up to size events.  Events are delivered without
+// blocking the session which generated them, so any event arriving while
+// the buffer is full is dropped and an error logged: the buffer should be
+// large enough to absorb bursts of activity.
+//
+// Calling the returned cancel function stops the delivery of events and
+// closes the channel.  Like UnregisterEventHandler, cancel must not be
+// called from the context of an event handler callback.
+func (ctx *Context) SessionEvents(size int) (events <-chan SessionEvent, cancel func()) {
+	sec := &sessionEventChannel{
+		ctx:    ctx,
+		events: make(chan SessionEvent, size),
+	}
+	ctx.RegisterEventHandler(sec)
+
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() {
+			ctx.UnregisterEventHandler(sec)
+			close(sec.events)
+		})
+	}
+	return sec.events, cancel
+}
+
+// reportIPCP passes a SessionIPCPUpEvent or SessionIPCPDownEvent for
+// session s to the registered event handlers, if the session is
+// established.
+func (bs *baseSession) reportIPCP(s Session, up bool, info IPCPInfo) {
+	if bs.State() != SessionStateEstablished {
+		return
+	}
+	message := "IPCP down"
+	if up {
+		message = "IPCP up"
+	}
+	level.Info(bs.logger).Log(
+		"message", message,
+		"interface_name", info.InterfaceName,
+		"local_addr", info.LocalAddr,
+		"peer_addr", info.PeerAddr,
+		"dns", fmt.Sprintf("%v", info.DNS))
+	if up {
+		bs.parent.handleUserEvent(&SessionIPCPUpEvent{
+			TunnelName:  bs.parent.getName(),
+			Tunnel:      bs.parent,
+			SessionName: bs.name,
+			Session:     s,
+			IPCP:        info,
+		})
+	} else {
+		bs.parent.handleUserEvent(&SessionIPCPDownEvent{
+			TunnelName:  bs.parent.getName(),
+			Tunnel:      bs.parent,
+			SessionName: bs.name,
+			Session:     s,
+			IPCP:        info,
+		})
+	}
+}
+
+func (ss *staticSession) ReportIPCPUp(info IPCPInfo) {
+	ss.reportIPCP(ss, true, info)
+}
+
+func (ss *staticSession) ReportIPCPDown(info IPCPInfo) {
+	ss.reportIPCP(ss, false, info)
+}
+
+func (ds *dynamicSession) ReportIPCPUp(info IPCPInfo) {
+	ds.reportIPCP(ds, true, info)
+}
+
+func (ds *dynamicSession) ReportIPCPDown(info IPCPInfo) {
+	ds.reportIPCP(ds, false, info)
+}
@@ -0,0 +1,102 @@
+package l2tp
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func nextSessionEvent(t *testing.T, events <-chan SessionEvent) SessionEvent {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatalf("session event channel closed")
+		}
+		return ev
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for session event")
+	}
+	return nil
+}
+
+func TestSessionEvents(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	events, cancel := ctx.SessionEvents(8)
+	defer cancel()
+
+	// A second channel too small to hold all the events mustn't
+	// block the session
+	_, cancelSmall := ctx.SessionEvents(1)
+	defer cancelSmall()
+
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:9050",
+		Peer:         "127.0.0.1:9051",
+		Version:      ProtocolVersion3,
+		Encap:        EncapTypeUDP,
+		TunnelID:     100,
+		PeerTunnelID: 200,
+	}
+	tunl, err := ctx.NewStaticTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+	}
+
+	scfg := &SessionConfig{
+		SessionID:     300,
+		PeerSessionID: 400,
+		Pseudowire:    PseudowireTypeEth,
+	}
+	sess, err := tunl.NewSession("s1", scfg)
+	if err != nil {
+		t.Fatalf("NewSession(%v): %v", scfg, err)
+	}
+
+	if ev, ok := nextSessionEvent(t, events).(*SessionDataplaneReadyEvent); !ok || ev.Session != sess {
+		t.Errorf("expected SessionDataplaneReadyEvent for session, got %#v", ev)
+	}
+	if ev, ok := nextSessionEvent(t, events).(*SessionUpEvent); !ok || ev.SessionName != "s1" {
+		t.Errorf("expected SessionUpEvent for s1, got %#v", ev)
+	}
+
+	info := IPCPInfo{
+		InterfaceName: "ppp0",
+		LocalAddr:     net.IPv4(10, 0, 0, 2),
+		PeerAddr:      net.IPv4(10, 0, 0, 1),
+		DNS:           []net.IP{net.IPv4(10, 0, 0, 53)},
+	}
+	sess.ReportIPCPUp(info)
+	if ev, ok := nextSessionEvent(t, events).(*SessionIPCPUpEvent); !ok || ev.Session != sess || !reflect.DeepEqual(ev.IPCP, info) {
+		t.Errorf("expected SessionIPCPUpEvent for session with %v, got %#v", info, ev)
+	}
+	sess.ReportIPCPDown(info)
+	if ev, ok := nextSessionEvent(t, events).(*SessionIPCPDownEvent); !ok || ev.Session != sess || !reflect.DeepEqual(ev.IPCP, info) {
+		t.Errorf("expected SessionIPCPDownEvent for session with %v, got %#v", info, ev)
+	}
+
+	sess.Close()
+	if ev, ok := nextSessionEvent(t, events).(*SessionDownEvent); !ok || ev.SessionName != "s1" {
+		t.Errorf("expected SessionDownEvent for s1, got %#v", ev)
+	}
+
+	// The session is no longer established, so mustn't report IPCP
+	sess.ReportIPCPUp(info)
+	sess.ReportIPCPDown(info)
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("session event channel not closed on cancel")
+	}
+}
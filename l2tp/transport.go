@@ -3,6 +3,7 @@ package l2tp
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -39,6 +40,200 @@ type xmitMsg struct {
 	// Timer for retransmission if the peer doesn't ack the message.
 	retryTimer *time.Timer
 	onComplete func(m *xmitMsg, err error)
+	// Transmit priority of the message, which determines its place
+	// in the transmit queue.
+	priority txPriority
+	// The local and peer session IDs of the session the message
+	// relates to, if any, which keep the messages of a session in order.
+	sid, psid ControlConnID
+	// Order in which the message was queued for transmission.
+	queueSeq uint64
+	// Transmission history, protected by the transport timelineLock.
+	timeline TransmitTimeline
+}
+
+// TransmitTimeline records the transmission history of a control message
+// sent using the reliable transport.  It allows the cause of a transmission
+// failure to be diagnosed: for example, to tell a peer which never responded
+// from a peer which responded too slowly.
+type TransmitTimeline struct {
+	// MessageType is the name of the control message type, e.g. "SCCRQ".
+	MessageType string
+	// Ns is the transport sequence number of the message.
+	Ns uint16
+	// Sent holds the time of the initial transmission of the message,
+	// followed by the time of each retransmission.
+	Sent []time.Time
+	// Acked is the time the message was acknowledged by the peer.
+	// It is the zero time if the message has not been acknowledged.
+	Acked time.Time
+}
+
+func (tl TransmitTimeline) String() string {
+	if len(tl.Sent) == 0 {
+		return fmt.Sprintf("%s not sent", tl.MessageType)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s ns %d sent at %s", tl.MessageType, tl.Ns, tl.Sent[0].Format("15:04:05.000"))
+	for _, t := range tl.Sent[1:] {
+		fmt.Fprintf(&b, ", retransmitted at +%v", t.Sub(tl.Sent[0]))
+	}
+	if tl.Acked.IsZero() {
+		b.WriteString(", not acked")
+	} else {
+		fmt.Fprintf(&b, ", acked at +%v", tl.Acked.Sub(tl.Sent[0]))
+	}
+	return b.String()
+}
+
+func (tl TransmitTimeline) copy() TransmitTimeline {
+	tl.Sent = append([]time.Time(nil), tl.Sent...)
+	return tl
+}
+
+// TransmitTimeoutError is returned when a control message has not been
+// acknowledged by the peer after the maximum number of retransmissions.
+type TransmitTimeoutError struct {
+	// Retries is the retry limit which was reached.
+	Retries uint
+	// Timeline is the transmission history of the message.
+	Timeline TransmitTimeline
+	// Expired is the time at which the transport gave up waiting
+	// for an acknowledgement.
+	Expired time.Time
+}
+
+func (e *TransmitTimeoutError) Error() string {
+	s := fmt.Sprintf("transmit of %s failed after %d retry attempts: %v",
+		e.Timeline.MessageType, e.Retries, e.Timeline)
+	if len(e.Timeline.Sent) > 0 {
+		s += fmt.Sprintf(", gave up at +%v", e.Expired.Sub(e.Timeline.Sent[0]))
+	}
+	return s
+}
+
+// txPriority determines the order in which queued messages are transmitted.
+type txPriority int
+
+const (
+	// Messages which tear down or maintain the control connection or
+	// a session.  Urgent messages may be sent while the congestion window
+	// is closed, so that they aren't held up by a retransmit backlog.
+	txPriorityUrgent txPriority = iota
+	// Other control protocol messages.
+	txPriorityControl
+	// Informational messages which don't affect the state of the control
+	// connection or its sessions, e.g. link status reports.
+	txPriorityBulk
+	txPriorityMax
+)
+
+func (p txPriority) String() string {
+	switch p {
+	case txPriorityUrgent:
+		return "urgent"
+	case txPriorityControl:
+		return "control"
+	case txPriorityBulk:
+		return "bulk"
+	}
+	panic("unhandled transmit priority")
+}
+
+func messagePriority(msg controlMessage) txPriority {
+	switch msg.getType() {
+	case avpMsgTypeStopccn, avpMsgTypeCdn, avpMsgTypeHello, avpMsgTypeAck:
+		return txPriorityUrgent
+	case avpMsgTypeWen, avpMsgTypeSli:
+		return txPriorityBulk
+	}
+	return txPriorityControl
+}
+
+// messageSession returns the IDs of the session a control message relates
+// to: the session ID assigned by the sender, and that assigned by the
+// recipient.  Either is zero if the message doesn't carry it, and both are
+// zero for messages which don't relate to a session.
+func messageSession(msg controlMessage) (sid, psid ControlConnID) {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		id, _ := findUint16Avp(m.getAvps(), vendorIDIetf, avpTypeSessionID)
+		return ControlConnID(id), ControlConnID(m.Sid())
+	case *v3ControlMessage:
+		id, _ := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeLocalSessionID)
+		pid, _ := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeRemoteSessionID)
+		return ControlConnID(id), ControlConnID(pid)
+	}
+	return 0, 0
+}
+
+// sameSession returns true if two messages relate to the same session.
+func (m *xmitMsg) sameSession(other *xmitMsg) bool {
+	return (m.sid != 0 && m.sid == other.sid) || (m.psid != 0 && m.psid == other.psid)
+}
+
+// priorityQueue holds messages awaiting transmission.  Messages are
+// dequeued in priority order, and in FIFO order within a priority.
+// Since sequence numbers are assigned on first transmission it is
+// safe to reorder messages which haven't been sent yet, other than
+// the messages of a session, which are always sent in order.
+type priorityQueue struct {
+	queues [txPriorityMax][]*xmitMsg
+	seq    uint64
+}
+
+// push queues a message.  Messages for the same session which are queued
+// at a lower priority are promoted ahead of it, so that e.g. a CDN can't
+// overtake the ICCN for its session and reach the peer first.
+func (q *priorityQueue) push(msg *xmitMsg) {
+	var promoted []*xmitMsg
+	for p := msg.priority + 1; p < txPriorityMax; p++ {
+		kept := q.queues[p][:0]
+		for _, m := range q.queues[p] {
+			if m.sameSession(msg) {
+				m.priority = msg.priority
+				promoted = append(promoted, m)
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		q.queues[p] = kept
+	}
+	sort.Slice(promoted, func(i, j int) bool {
+		return promoted[i].queueSeq < promoted[j].queueSeq
+	})
+	q.seq++
+	msg.queueSeq = q.seq
+	q.queues[msg.priority] = append(q.queues[msg.priority], promoted...)
+	q.queues[msg.priority] = append(q.queues[msg.priority], msg)
+}
+
+// peek returns the message which pop would dequeue next.
+func (q *priorityQueue) peek() *xmitMsg {
+	for i := range q.queues {
+		if len(q.queues[i]) > 0 {
+			return q.queues[i][0]
+		}
+	}
+	return nil
+}
+
+func (q *priorityQueue) pop() *xmitMsg {
+	for i := range q.queues {
+		if len(q.queues[i]) > 0 {
+			msg := q.queues[i][0]
+			q.queues[i] = append(q.queues[i][:0], q.queues[i][1:]...)
+			return msg
+		}
+	}
+	return nil
+}
+
+func (q *priorityQueue) len() (n int) {
+	for i := range q.queues {
+		n += len(q.queues[i])
+	}
+	return
 }
 
 // rawMsg represents a raw frame read from the transport socket.
@@ -69,6 +264,9 @@ type transportConfig struct {
 	// Maximum number of messages we will send to the peer without having
 	// received an acknowledgement.
 	TxWindowSize uint16
+	// Maximum number of out-of-order messages to buffer pending receipt
+	// of earlier messages.  Further out-of-order messages are discarded.
+	ReorderQueueSize uint16
 	// Maximum number of retransmits of an unacknowledged control packet.
 	MaxRetries uint
 	// Duration to wait before first packet retransmit.
@@ -84,6 +282,79 @@ type transportConfig struct {
 	Version ProtocolVersion
 	// Peer control connection ID to use for transport-generated messages
 	PeerControlConnID ControlConnID
+	// Sequence number of the first message the transport sends, which is
+	// non-zero if messages were sent on the transport's behalf before it
+	// was created.
+	InitialNs uint16
+	// Counters for the transport to update.  If nil the transport
+	// allocates its own.  Tunnels pass the same counters to each
+	// transport they create so that the counts accumulate.
+	Stats *transportStats
+	// Authentication of L2TPv3 control messages.  If set, the transport
+	// adds a Message Digest AVP to each message it sends, and discards
+	// received messages which fail the digest check.
+	Auth *v3Auth
+	// Limits on parsing received datagrams.  If nil the default
+	// limits apply.
+	ParserOptions *parserOptions
+}
+
+// transportStats counts the activity of the reliable transport.
+type transportStats struct {
+	lock        sync.Mutex
+	controlTx   uint64
+	controlRx   uint64
+	retransmits uint64
+	replays     uint64
+	helloRTT    time.Duration
+	lastError   error
+}
+
+func (s *transportStats) onTx(isRetransmit bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.controlTx++
+	if isRetransmit {
+		s.retransmits++
+	}
+}
+
+func (s *transportStats) onRx() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.controlRx++
+}
+
+func (s *transportStats) onReplay() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.replays++
+}
+
+func (s *transportStats) onHelloAcked(rtt time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.helloRTT = rtt
+}
+
+func (s *transportStats) onError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastError = err
+}
+
+// fill copies the counters into the tunnel statistics.
+func (s *transportStats) fill(ts *TunnelStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ts.ControlTx = s.controlTx
+	ts.ControlRx = s.controlRx
+	ts.Retransmits = s.retransmits
+	ts.Replays = s.replays
+	ts.HelloRTT = s.helloRTT
+	if s.lastError != nil {
+		ts.LastError = s.lastError.Error()
+	}
 }
 
 // transport represents the RFC2661/RFC3931
@@ -91,6 +362,7 @@ type transportConfig struct {
 type transport struct {
 	logger               log.Logger
 	slowStart            slowStartState
+	replayWindow         replayWindow
 	config               transportConfig
 	cp                   *controlPlane
 	helloTimer, ackTimer *time.Timer
@@ -100,9 +372,15 @@ type transport struct {
 	recvChan             chan *recvMsg
 	nrChan               chan []nrInd
 	rxQueue              []*recvMsg
-	txQueue, ackQueue    []*xmitMsg
+	txQueue              priorityQueue
+	ackQueue             []*xmitMsg
+	timelineLock         sync.Mutex
+	inFlight             []*xmitMsg
 	senderWg             sync.WaitGroup
 	receiverWg           sync.WaitGroup
+	// The reason the transport went down.  This may only be accessed
+	// once close() has returned.
+	downErr error
 }
 
 // Increment transport sequence number by one avoiding overflow
@@ -135,6 +413,15 @@ func (s *slowStartState) canSend() bool {
 	return s.ntx < s.cwnd
 }
 
+// canSendUrgent returns true if an urgent message may be sent: urgent
+// messages disregard the congestion window, but not the peer's receive
+// window.
+func (s *slowStartState) canSendUrgent(maxTxWindow uint16) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ntx < maxTxWindow
+}
+
 func (s *slowStartState) onSend() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -204,9 +491,15 @@ func (s *slowStartState) getSequenceNumbers() (ns, nr uint16) {
 func (m *xmitMsg) txComplete(err error) {
 	if !m.isComplete {
 
+		m.xport.timelineLock.Lock()
+		m.xport.removeInFlight(m)
+		timeline := m.timeline
+		m.xport.timelineLock.Unlock()
+
 		level.Debug(m.xport.logger).Log(
 			"message", "send complete",
 			"message_type", m.msg.getType(),
+			"timeline", timeline,
 			"error", err)
 
 		m.isComplete = true
@@ -230,6 +523,9 @@ func sanitiseConfig(cfg *transportConfig) {
 	if cfg.TxWindowSize == 0 || cfg.TxWindowSize > 65535 {
 		cfg.TxWindowSize = defaulttransportConfig().TxWindowSize
 	}
+	if cfg.ReorderQueueSize == 0 {
+		cfg.ReorderQueueSize = defaulttransportConfig().ReorderQueueSize
+	}
 	if cfg.RetryTimeout == 0 {
 		cfg.RetryTimeout = defaulttransportConfig().RetryTimeout
 	}
@@ -277,6 +573,7 @@ func (xport *transport) receiver() {
 			level.Error(xport.logger).Log(
 				"message", "frame receive failed",
 				"error", err)
+			xport.config.Stats.onError(err)
 			if strings.Contains("failed to parse mandatory AVP", err.Error()) {
 				close(xport.nrChan)
 				return
@@ -289,8 +586,9 @@ func (xport *transport) receiver() {
 		rxNr := []nrInd{}
 
 		for _, msg := range messages {
-			xport.rxQueue = append(xport.rxQueue, &recvMsg{msg: msg, from: from})
+			xport.config.Stats.onRx()
 			rxNr = append(rxNr, nrInd{msgType: msg.getType(), nr: msg.nr()})
+			xport.enqueueRxMessage(&recvMsg{msg: msg, from: from})
 		}
 
 		xport.nrChan <- rxNr
@@ -310,9 +608,10 @@ func (xport *transport) sender() {
 
 			level.Debug(xport.logger).Log(
 				"message", "send",
-				"message_type", xmitMsg.msg.getType())
+				"message_type", xmitMsg.msg.getType(),
+				"priority", xmitMsg.priority)
 
-			xport.txQueue = append(xport.txQueue, xmitMsg)
+			xport.txQueue.push(xmitMsg)
 			err := xport.processTxQueue()
 			if err != nil {
 				xport.down(err)
@@ -397,7 +696,7 @@ func (xport *transport) sender() {
 }
 
 func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, err error) {
-	messages, err = parseMessageBuffer(rawMsg.b)
+	messages, err = parseMessageBuffer(rawMsg.b, xport.config.ParserOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -409,15 +708,72 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 			return nil, fmt.Errorf("dropping invalid packet %s ns %d nr %d (transport ns %d nr %d)",
 				msg.getType(), msg.ns(), msg.nr(), ns, nr)
 		}
+		// Messages failing authentication are discarded before they
+		// can affect the transport state.  Ref: RFC3931 section 4.3.
+		if v3msg, ok := msg.(*v3ControlMessage); ok && xport.config.Auth != nil {
+			if err := xport.config.Auth.verify(v3msg); err != nil {
+				return nil, fmt.Errorf("dropping unauthenticated packet %s ns %d nr %d: %v",
+					msg.getType(), msg.ns(), msg.nr(), err)
+			}
+		}
+		// Acks don't consume a sequence number, so may share the Ns
+		// of other messages.
+		if msg.getType() != avpMsgTypeAck && xport.replayWindow.isReplay(msg.ns(), nr) {
+			xport.config.Stats.onReplay()
+			return nil, fmt.Errorf("dropping replayed packet %s ns %d nr %d (transport ns %d nr %d)",
+				msg.getType(), msg.ns(), msg.nr(), ns, nr)
+		}
 	}
 
 	return messages, nil
 }
 
+// Add a received message to the rx queue.  Messages which are ahead of
+// the next expected sequence number are held in the queue until the gap
+// is filled, up to the limit set by the ReorderQueueSize parameter.
+func (xport *transport) enqueueRxMessage(m *recvMsg) {
+
+	// Acks don't consume a sequence number: they have already served
+	// their purpose in updating the ack queue.
+	if m.msg.getType() == avpMsgTypeAck {
+		return
+	}
+
+	if !xport.slowStart.msgIsInSequence(m.msg) && !xport.slowStart.msgIsStale(m.msg) {
+		// In the steady state only out-of-order messages remain in the
+		// queue, since in-sequence and stale messages are dequeued
+		// immediately.
+		var reason string
+		if len(xport.rxQueue) >= int(xport.config.ReorderQueueSize) {
+			reason = "reorder queue full"
+		}
+		for _, q := range xport.rxQueue {
+			if q.msg.ns() == m.msg.ns() {
+				reason = "duplicate of queued message"
+				break
+			}
+		}
+		if reason != "" {
+			level.Debug(xport.logger).Log(
+				"message", "discard out-of-order message",
+				"message_type", m.msg.getType(),
+				"ns", m.msg.ns(),
+				"reason", reason)
+			return
+		}
+		level.Debug(xport.logger).Log(
+			"message", "queue out-of-order message",
+			"message_type", m.msg.getType(),
+			"ns", m.msg.ns())
+	}
+
+	xport.rxQueue = append(xport.rxQueue, m)
+}
+
 // Find the next message which can be handled (either stale or in-sequence)
 func (xport *transport) dequeueRxMessage() *recvMsg {
 	for i := 0; i < len(xport.rxQueue); i++ {
-		m := xport.rxQueue[0]
+		m := xport.rxQueue[i]
 		if xport.slowStart.msgIsInSequence(m.msg) || xport.slowStart.msgIsStale(m.msg) {
 			xport.rxQueue = append(xport.rxQueue[:i], xport.rxQueue[i+1:]...)
 			return m
@@ -470,11 +826,22 @@ func (xport *transport) sendMessage1(msg controlMessage, isRetransmit bool) erro
 		"nr", msg.nr(),
 		"isRetransmit", isRetransmit)
 
+	// The digest covers the sequence numbers, so is computed afresh
+	// for each transmission.
+	if v3msg, ok := msg.(*v3ControlMessage); ok && xport.config.Auth != nil {
+		if err := xport.config.Auth.sign(v3msg); err != nil {
+			return fmt.Errorf("failed to sign %v message: %v", msg.getType(), err)
+		}
+	}
+
 	// Render as a byte slice and send.
 	b, err := msg.toBytes()
 	if err == nil {
 		_, err = xport.cp.write(b)
 	}
+	if err == nil {
+		xport.config.Stats.onTx(isRetransmit)
+	}
 	return err
 }
 
@@ -487,6 +854,7 @@ func (xport *transport) sendMessage(msg *xmitMsg) error {
 
 	err := xport.sendMessage1(msg.msg, msg.nretries > 0)
 	if err == nil {
+		xport.recordSend(msg)
 		xport.toggleAckTimer(false) // we have just sent an implicit ack
 		xport.resetHelloTimer()
 		if msg.msg.getType() != avpMsgTypeAck && msg.nretries == 0 {
@@ -502,8 +870,13 @@ func (xport *transport) sendMessage(msg *xmitMsg) error {
 func (xport *transport) retransmitMessage(msg *xmitMsg) error {
 	msg.nretries++
 	if msg.nretries >= xport.config.MaxRetries {
-		return fmt.Errorf("transmit of %s failed after %d retry attempts",
-			msg.msg.getType(), xport.config.MaxRetries)
+		xport.timelineLock.Lock()
+		defer xport.timelineLock.Unlock()
+		return &TransmitTimeoutError{
+			Retries:  xport.config.MaxRetries,
+			Timeline: msg.timeline.copy(),
+			Expired:  time.Now(),
+		}
 	}
 	err := xport.sendMessage(msg)
 	if err == nil {
@@ -512,19 +885,52 @@ func (xport *transport) retransmitMessage(msg *xmitMsg) error {
 	return err
 }
 
+// recordSend updates the message timeline on (re)transmission.
+// Messages are tracked as in-flight from their first transmission
+// until transmission is complete.
+func (xport *transport) recordSend(msg *xmitMsg) {
+	xport.timelineLock.Lock()
+	defer xport.timelineLock.Unlock()
+	if len(msg.timeline.Sent) == 0 {
+		msg.timeline.MessageType = msg.msg.getType().String()
+		msg.timeline.Ns = msg.msg.ns()
+		xport.inFlight = append(xport.inFlight, msg)
+	}
+	msg.timeline.Sent = append(msg.timeline.Sent, time.Now())
+}
+
+func (xport *transport) recordAck(msg *xmitMsg) {
+	xport.timelineLock.Lock()
+	defer xport.timelineLock.Unlock()
+	msg.timeline.Acked = time.Now()
+}
+
+// Called with timelineLock held
+func (xport *transport) removeInFlight(msg *xmitMsg) {
+	for i, m := range xport.inFlight {
+		if m == msg {
+			xport.inFlight = append(xport.inFlight[:i], xport.inFlight[i+1:]...)
+			return
+		}
+	}
+}
+
 func (xport *transport) processTxQueue() error {
 	// Loop the transmit queue sending messages in order while
 	// the transmit window is open.
-	for len(xport.txQueue) > 0 {
-		if !xport.slowStart.canSend() {
+	for xport.txQueue.len() > 0 {
+		canSend := xport.slowStart.canSend()
+		if xport.txQueue.peek().priority == txPriorityUrgent {
+			canSend = xport.slowStart.canSendUrgent(xport.config.TxWindowSize)
+		}
+		if !canSend {
 			// We've sent all we can for the time being.  This is not
 			// an error condition, so return successfully.
 			return nil
 		}
 
 		// Pop from the tx queue, send, add to the ack queue
-		msg := xport.txQueue[0]
-		xport.txQueue = append(xport.txQueue[:0], xport.txQueue[1:]...)
+		msg := xport.txQueue.pop()
 		err := xport.sendMessage(msg)
 		if err == nil {
 			xport.ackQueue = append(xport.ackQueue, msg)
@@ -541,6 +947,7 @@ func (xport *transport) processAckQueue(nr uint16) (found bool) {
 	for i := 0; i < len(xport.ackQueue); i++ {
 		msg := xport.ackQueue[0]
 		if seqCompare(nr, msg.msg.ns()) > 0 {
+			xport.recordAck(msg)
 			xport.slowStart.onAck(xport.config.TxWindowSize)
 			xport.ackQueue = append(xport.ackQueue[:i], xport.ackQueue[i+1:]...)
 			i--
@@ -578,6 +985,9 @@ func (xport *transport) closeReceiver() {
 
 func (xport *transport) down(err error) {
 
+	xport.downErr = err
+	xport.config.Stats.onError(err)
+
 	// Shut down the receiver
 	xport.closeReceiver()
 
@@ -586,10 +996,8 @@ func (xport *transport) down(err error) {
 	// Note the rx queue is flushed by the receiver go routine *after*
 	// xport.receiver() has terminated.  We don't do it here since
 	// doing so would represent a data race.
-	for len(xport.txQueue) > 0 {
-		msg := xport.txQueue[0]
-		xport.txQueue = append(xport.txQueue[:0], xport.txQueue[1:]...)
-		msg.txComplete(err)
+	for xport.txQueue.len() > 0 {
+		xport.txQueue.pop().txComplete(err)
 	}
 
 	for len(xport.ackQueue) > 0 {
@@ -643,15 +1051,25 @@ func (xport *transport) sendHelloMessage() error {
 		return fmt.Errorf("failed to build hello message: %v", err)
 	}
 
-	return xport.sendMessage(&xmitMsg{
+	// Queue the message so that it is tracked for acknowledgement
+	// along with any other messages in flight.
+	xport.txQueue.push(&xmitMsg{
 		xport:      xport,
 		msg:        msg,
 		onComplete: helloSendComplete,
+		priority:   txPriorityUrgent,
 	})
+	return xport.processTxQueue()
 }
 
 func helloSendComplete(m *xmitMsg, err error) {
 	m.xport.helloInFlight = false
+	if err == nil {
+		m.xport.timelineLock.Lock()
+		rtt := m.timeline.Acked.Sub(m.timeline.Sent[len(m.timeline.Sent)-1])
+		m.xport.timelineLock.Unlock()
+		m.xport.config.Stats.onHelloAcked(rtt)
+	}
 }
 
 func (xport *transport) sendExplicitAck() (err error) {
@@ -678,12 +1096,13 @@ func (xport *transport) sendExplicitAck() (err error) {
 // defaulttransportConfig returns a default configuration for the transport.
 func defaulttransportConfig() transportConfig {
 	return transportConfig{
-		HelloTimeout: 0 * time.Second,
-		TxWindowSize: 4,
-		MaxRetries:   3,
-		RetryTimeout: 1 * time.Second,
-		AckTimeout:   100 * time.Millisecond,
-		Version:      ProtocolVersion3,
+		HelloTimeout:     0 * time.Second,
+		TxWindowSize:     4,
+		ReorderQueueSize: 4,
+		MaxRetries:       3,
+		RetryTimeout:     1 * time.Second,
+		AckTimeout:       100 * time.Millisecond,
+		Version:          ProtocolVersion3,
 	}
 }
 
@@ -698,6 +1117,9 @@ func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xpo
 
 	// Make sure the config is sane
 	sanitiseConfig(&cfg)
+	if cfg.Stats == nil {
+		cfg.Stats = &transportStats{}
+	}
 
 	// We always create timer instances even if they're not going to be used.
 	// This makes the logic for the transport go routine select easier to manage.
@@ -709,6 +1131,7 @@ func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xpo
 		slowStart: slowStartState{
 			thresh: cfg.TxWindowSize,
 			cwnd:   1,
+			ns:     cfg.InitialNs,
 		},
 		config:     cfg,
 		cp:         cp,
@@ -719,7 +1142,6 @@ func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xpo
 		recvChan:   make(chan *recvMsg),
 		nrChan:     make(chan []nrInd),
 		rxQueue:    []*recvMsg{},
-		txQueue:    []*xmitMsg{},
 		ackQueue:   []*xmitMsg{},
 	}
 
@@ -763,7 +1185,9 @@ func (xport *transport) send(msg controlMessage) error {
 		msg:          msg,
 		completeChan: make(chan error),
 		onComplete:   sendComplete,
+		priority:     messagePriority(msg),
 	}
+	cm.sid, cm.psid = messageSession(msg)
 	xport.sendChan <- &cm
 	err = <-cm.completeChan
 	return err
@@ -773,6 +1197,18 @@ func sendComplete(m *xmitMsg, err error) {
 	m.completeChan <- err
 }
 
+// pendingTimelines returns the transmission history of each message
+// which has been sent but for which transmission is not yet complete.
+// Messages are listed in the order they were first transmitted.
+func (xport *transport) pendingTimelines() (timelines []TransmitTimeline) {
+	xport.timelineLock.Lock()
+	defer xport.timelineLock.Unlock()
+	for _, m := range xport.inFlight {
+		timelines = append(timelines, m.timeline.copy())
+	}
+	return
+}
+
 // recv receives a control message using the reliable transport.
 // The caller will block until a message has been received from the peer.
 // Failure indicates that the transport has failed and the parent tunnel
@@ -1,7 +1,9 @@
 package l2tp
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -386,3 +388,496 @@ func TestBasicSendReceive(t *testing.T) {
 			})
 	}
 }
+
+func TestTransmitTimeline(t *testing.T) {
+	// The peer socket swallows everything we send without acking
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9003")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	c := transportSendRecvTestInfo{
+		local: "127.0.0.1:9002",
+		peer:  "127.0.0.1:9003",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion3,
+			RetryTimeout:      20 * time.Millisecond,
+			MaxRetries:        3,
+			PeerControlConnID: 90,
+		},
+	}
+	xport, err := transportTestnewTransport(&c)
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(%v) said: %v", c, err)
+	}
+	defer xport.close()
+
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&c.xcfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+
+	completion := make(chan error)
+	go func() {
+		completion <- xport.send(msg)
+	}()
+
+	// Wait for the message to be in flight
+	var pending []TransmitTimeline
+	for i := 0; i < 100 && len(pending) == 0; i++ {
+		time.Sleep(1 * time.Millisecond)
+		pending = xport.pendingTimelines()
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending message, got %v", pending)
+	}
+	if pending[0].MessageType != avpMsgTypeHello.String() {
+		t.Errorf("expected pending %v message, got %v", avpMsgTypeHello, pending[0].MessageType)
+	}
+	if !pending[0].Acked.IsZero() {
+		t.Errorf("pending message unexpectedly acked: %v", pending[0])
+	}
+
+	err = <-completion
+	var timeoutErr *TransmitTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TransmitTimeoutError, got %v", err)
+	}
+	if len(timeoutErr.Timeline.Sent) != int(c.xcfg.MaxRetries) {
+		t.Errorf("expected %d transmissions, got %v", c.xcfg.MaxRetries, timeoutErr.Timeline.Sent)
+	}
+	for i := 1; i < len(timeoutErr.Timeline.Sent); i++ {
+		if !timeoutErr.Timeline.Sent[i].After(timeoutErr.Timeline.Sent[i-1]) {
+			t.Errorf("transmission times out of order: %v", timeoutErr.Timeline.Sent)
+		}
+	}
+	if timeoutErr.Expired.Before(timeoutErr.Timeline.Sent[len(timeoutErr.Timeline.Sent)-1]) {
+		t.Errorf("expiry %v precedes last transmission", timeoutErr.Expired)
+	}
+	if len(xport.pendingTimelines()) != 0 {
+		t.Errorf("expected no pending messages after failure, got %v", xport.pendingTimelines())
+	}
+}
+
+func TestDualStackTransport(t *testing.T) {
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:9005")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	c := transportSendRecvTestInfo{
+		local: "[::]:9004",
+		peer:  "127.0.0.1:9005",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion3,
+			PeerControlConnID: 90,
+			RetryTimeout:      20 * time.Millisecond,
+			MaxRetries:        1,
+		},
+	}
+	xport, err := transportTestnewTransport(&c)
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(%v) said: %v", c, err)
+	}
+	defer xport.close()
+
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&c.xcfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+
+	// The peer doesn't ack the Hello, so send times out after a single
+	// transmission, leaving it queued on the peer's socket
+	var timeoutErr *TransmitTimeoutError
+	if err = xport.send(msg); !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected TransmitTimeoutError, got %v", err)
+	}
+
+	b := make([]byte, 4096)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := peer.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("IPv4 peer failed to receive from dual-stack transport: %v", err)
+	}
+	msgs, err := parseMessageBuffer(b[:n], nil)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].getType() != avpMsgTypeHello {
+		t.Errorf("expected a single %v message, got %v", avpMsgTypeHello, msgs)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	var q priorityQueue
+	in := []*xmitMsg{
+		{priority: txPriorityControl},
+		{priority: txPriorityBulk},
+		{priority: txPriorityUrgent},
+		{priority: txPriorityControl},
+		{priority: txPriorityUrgent},
+		{priority: txPriorityBulk},
+	}
+	want := []*xmitMsg{in[2], in[4], in[0], in[3], in[1], in[5]}
+
+	for _, m := range in {
+		q.push(m)
+	}
+	if q.len() != len(in) {
+		t.Fatalf("expected queue length %v, got %v", len(in), q.len())
+	}
+	for i, w := range want {
+		if got := q.pop(); got != w {
+			t.Errorf("pop %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if q.len() != 0 || q.pop() != nil {
+		t.Errorf("expected empty queue")
+	}
+}
+
+func TestPriorityQueueSessionOrder(t *testing.T) {
+	var q priorityQueue
+	in := []*xmitMsg{
+		{priority: txPriorityBulk, sid: 1},
+		{priority: txPriorityControl, sid: 2},
+		{priority: txPriorityControl, sid: 1, psid: 11},
+		{priority: txPriorityBulk, psid: 12},
+		{priority: txPriorityControl},
+		// A CDN for session 1 is preceded by the session's queued messages
+		{priority: txPriorityUrgent, sid: 1, psid: 11},
+		// A CDN for session 2 which only carries the peer's ID is
+		// preceded by the session's bulk message
+		{priority: txPriorityUrgent, psid: 12},
+	}
+	want := []*xmitMsg{in[0], in[2], in[5], in[3], in[6], in[1], in[4]}
+
+	for _, m := range in {
+		q.push(m)
+	}
+	for i, w := range want {
+		if got := q.pop(); got != w {
+			t.Errorf("pop %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if q.len() != 0 {
+		t.Errorf("expected empty queue")
+	}
+}
+
+func TestMessageSession(t *testing.T) {
+	v2Icrq, err := newV2Icrq(1, 90, &SessionConfig{SessionID: 5})
+	if err != nil {
+		t.Fatalf("newV2Icrq(): %v", err)
+	}
+	v3Cdn, err := newV3Cdn(90, &resultCode{result: avpCDNResultCodeAdminDisconnect},
+		&SessionConfig{SessionID: 5, PeerSessionID: 6})
+	if err != nil {
+		t.Fatalf("newV3Cdn(): %v", err)
+	}
+	v2Hello, err := newV2ControlMessage(90, 0, []avp{})
+	if err != nil {
+		t.Fatalf("newV2ControlMessage(): %v", err)
+	}
+	cases := []struct {
+		msg       controlMessage
+		sid, psid ControlConnID
+	}{
+		{v2Icrq, 5, 0},
+		{v3Cdn, 5, 6},
+		{v2Hello, 0, 0},
+	}
+	for _, c := range cases {
+		if sid, psid := messageSession(c.msg); sid != c.sid || psid != c.psid {
+			t.Errorf("messageSession(%v): got %v %v, want %v %v", c.msg.getType(), sid, psid, c.sid, c.psid)
+		}
+	}
+}
+
+func TestUrgentOvertakesRetransmitBacklog(t *testing.T) {
+	// The peer socket swallows everything we send without acking
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9091")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	c := transportSendRecvTestInfo{
+		local: "127.0.0.1:9090",
+		peer:  "127.0.0.1:9091",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			TxWindowSize:      4,
+			RetryTimeout:      20 * time.Millisecond,
+			MaxRetries:        10,
+			PeerControlConnID: 90,
+		},
+	}
+	xport, err := transportTestnewTransport(&c)
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(%v) said: %v", c, err)
+	}
+	completion := make(chan error, 3)
+	defer func() {
+		xport.close()
+		for i := 0; i < cap(completion); i++ {
+			<-completion
+		}
+	}()
+
+	send := func(msg controlMessage, err error) {
+		if err != nil {
+			t.Fatalf("failed to build message: %v", err)
+		}
+		go func() {
+			completion <- xport.send(msg)
+		}()
+	}
+	b := make([]byte, 4096)
+	recv := func() avpMsgType {
+		if err := peer.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatalf("SetReadDeadline(): %v", err)
+		}
+		n, _, err := peer.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("peer ReadFrom(): %v", err)
+		}
+		msgs, err := parseMessageBuffer(b[:n], nil)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("parseMessageBuffer(): %v, %v", msgs, err)
+		}
+		return msgs[0].getType()
+	}
+
+	// Fill the congestion window with an ICRQ which is being retransmitted,
+	// and queue another ICRQ behind it
+	send(newV2Icrq(1, 90, &SessionConfig{SessionID: 1}))
+	for i := 0; i < 2; i++ {
+		if got := recv(); got != avpMsgTypeIcrq {
+			t.Fatalf("expected %v, got %v", avpMsgTypeIcrq, got)
+		}
+	}
+	send(newV2Icrq(2, 90, &SessionConfig{SessionID: 2}))
+	time.Sleep(5 * time.Millisecond)
+
+	// The StopCCN is sent without waiting for the backlog to be acked
+	send(newV2Stopccn(&resultCode{result: avpStopCCNResultCodeClearConnection},
+		&TunnelConfig{TunnelID: 1, PeerTunnelID: 90}))
+	for {
+		got := recv()
+		if got == avpMsgTypeStopccn {
+			break
+		}
+		if got != avpMsgTypeIcrq {
+			t.Fatalf("expected %v or %v, got %v", avpMsgTypeIcrq, avpMsgTypeStopccn, got)
+		}
+	}
+	if pending := xport.pendingTimelines(); len(pending) != 2 {
+		t.Errorf("expected the first ICRQ and the StopCCN in flight, got %v", pending)
+	}
+}
+
+func TestTeardownUnderLoad(t *testing.T) {
+	peer, err := net.ListenPacket("udp", "127.0.0.1:9007")
+	if err != nil {
+		t.Fatalf("net.ListenPacket(): %v", err)
+	}
+	defer peer.Close()
+
+	c := transportSendRecvTestInfo{
+		local: "127.0.0.1:9006",
+		peer:  "127.0.0.1:9007",
+		encap: EncapTypeUDP,
+		xcfg: transportConfig{
+			Version:           ProtocolVersion2,
+			TxWindowSize:      4,
+			RetryTimeout:      5 * time.Second,
+			MaxRetries:        3,
+			PeerControlConnID: 90,
+		},
+	}
+	xport, err := transportTestnewTransport(&c)
+	if err != nil {
+		t.Fatalf("transportTestnewTransport(%v) said: %v", c, err)
+	}
+	defer xport.close()
+
+	// Queue a backlog of session establishment messages followed by a
+	// StopCCN.  The transport starts with a window of one message, so the
+	// first message is sent immediately and the rest are queued.
+	const nIcrq = 8
+	completion := make(chan error, nIcrq+1)
+	for i := 0; i < nIcrq; i++ {
+		msg, err := newV2Icrq(uint32(i), 90, &SessionConfig{SessionID: ControlConnID(i + 1)})
+		if err != nil {
+			t.Fatalf("newV2Icrq(): %v", err)
+		}
+		go func() {
+			completion <- xport.send(msg)
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	msg, err := newV2Stopccn(&resultCode{result: avpStopCCNResultCodeClearConnection},
+		&TunnelConfig{TunnelID: 1, PeerTunnelID: 90})
+	if err != nil {
+		t.Fatalf("newV2Stopccn(): %v", err)
+	}
+	go func() {
+		completion <- xport.send(msg)
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	// Act as the peer, acking each message as it arrives
+	var got []avpMsgType
+	b := make([]byte, 4096)
+	for len(got) < nIcrq+1 {
+		err = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err != nil {
+			t.Fatalf("SetReadDeadline(): %v", err)
+		}
+		n, from, err := peer.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("peer ReadFrom(): %v (received %v)", err, got)
+		}
+		msgs, err := parseMessageBuffer(b[:n], nil)
+		if err != nil {
+			t.Fatalf("parseMessageBuffer(): %v", err)
+		}
+		for _, m := range msgs {
+			got = append(got, m.getType())
+
+			ack, err := newV2ControlMessage(1, 0, []avp{})
+			if err != nil {
+				t.Fatalf("newV2ControlMessage(): %v", err)
+			}
+			ack.setTransportSeqNum(0, seqIncrement(m.ns()))
+			ab, err := ack.toBytes()
+			if err != nil {
+				t.Fatalf("ack.toBytes(): %v", err)
+			}
+			_, err = peer.WriteTo(ab, from)
+			if err != nil {
+				t.Fatalf("peer WriteTo(): %v", err)
+			}
+		}
+	}
+
+	// The StopCCN should overtake the queued backlog
+	if got[0] != avpMsgTypeIcrq || got[1] != avpMsgTypeStopccn {
+		t.Errorf("expected StopCCN to be sent second, got %v", got)
+	}
+	for i := 0; i < nIcrq+1; i++ {
+		if err = <-completion; err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+	}
+}
+
+func TestReorderQueue(t *testing.T) {
+	cases := []struct {
+		name      string
+		queueSize uint16
+		sendNs    []uint16
+		wantNs    []uint16
+	}{
+		{
+			name:      "in order",
+			queueSize: 4,
+			sendNs:    []uint16{0, 1, 2},
+			wantNs:    []uint16{0, 1, 2},
+		},
+		{
+			name:      "reordered",
+			queueSize: 4,
+			sendNs:    []uint16{2, 1, 0, 3},
+			wantNs:    []uint16{0, 1, 2, 3},
+		},
+		{
+			name:      "duplicates",
+			queueSize: 4,
+			sendNs:    []uint16{1, 1, 0, 0, 2},
+			wantNs:    []uint16{0, 1, 2},
+		},
+		{
+			name:      "queue full",
+			queueSize: 1,
+			sendNs:    []uint16{2, 1, 0, 1},
+			wantNs:    []uint16{0, 1, 2},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			peer, err := net.ListenPacket("udp", "127.0.0.1:9009")
+			if err != nil {
+				t.Fatalf("net.ListenPacket(): %v", err)
+			}
+			defer peer.Close()
+
+			tc := transportSendRecvTestInfo{
+				local: "127.0.0.1:9008",
+				peer:  "127.0.0.1:9009",
+				encap: EncapTypeUDP,
+				xcfg: transportConfig{
+					Version:           ProtocolVersion2,
+					ReorderQueueSize:  c.queueSize,
+					PeerControlConnID: 90,
+				},
+			}
+			xport, err := transportTestnewTransport(&tc)
+			if err != nil {
+				t.Fatalf("transportTestnewTransport(%v) said: %v", tc, err)
+			}
+			defer xport.close()
+
+			to, err := net.ResolveUDPAddr("udp", tc.local)
+			if err != nil {
+				t.Fatalf("net.ResolveUDPAddr(): %v", err)
+			}
+			for _, ns := range c.sendNs {
+				msg, err := newV2Hello(&TunnelConfig{PeerTunnelID: 1})
+				if err != nil {
+					t.Fatalf("newV2Hello(): %v", err)
+				}
+				msg.setTransportSeqNum(ns, 0)
+				b, err := msg.toBytes()
+				if err != nil {
+					t.Fatalf("toBytes(): %v", err)
+				}
+				if _, err = peer.WriteTo(b, to); err != nil {
+					t.Fatalf("WriteTo(): %v", err)
+				}
+				// Give the transport a chance to process each message
+				// so that the delivery order is deterministic.
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			var gotNs []uint16
+			for len(gotNs) < len(c.wantNs) {
+				select {
+				case m, ok := <-xport.recvChan:
+					if !ok {
+						t.Fatalf("transport closed, received %v", gotNs)
+					}
+					gotNs = append(gotNs, m.msg.ns())
+				case <-time.After(500 * time.Millisecond):
+					t.Fatalf("timed out waiting for messages, received %v, want %v", gotNs, c.wantNs)
+				}
+			}
+			for i := range c.wantNs {
+				if gotNs[i] != c.wantNs[i] {
+					t.Fatalf("received out of order: got %v, want %v", gotNs, c.wantNs)
+				}
+			}
+			select {
+			case m := <-xport.recvChan:
+				t.Errorf("unexpected extra message ns %v", m.msg.ns())
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,1100 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ DataPlane = (*userspaceDataPlane)(nil)
+var _ StatisticsTunnelDataPlane = (*userspaceTunnelDataPlane)(nil)
+var _ MTUSessionDataPlane = (*userspaceSessionDataPlane)(nil)
+var _ FrameSessionDataPlane = (*userspaceSessionDataPlane)(nil)
+
+// SessionPortFunc opens the port through which a session of the userspace
+// data plane exchanges frames with the local network.
+//
+// Each call to the port's Read method should return a single frame to be
+// sent to the peer, blocking until one is available.  Each frame received
+// from the peer is passed to a single call to the port's Write method.
+// Write is called from the goroutine receiving the tunnel's packets, which
+// for tunnels running the control protocol also receives control messages,
+// so it should not block.  The port is closed when the session goes down,
+// which should cause any blocked Read to return.
+//
+// Frames are Ethernet frames for Ethernet pseudowires, PPP frames
+// including the address and control fields for PPP pseudowires, or IPv4
+// and IPv6 packets for IP pseudowires.
+//
+// ifName is the name of the port's network interface, if it has one, as
+// reported by the session's GetInterfaceName method.
+type SessionPortFunc func(tunnelID ControlConnID, cfg *SessionConfig) (port io.ReadWriteCloser, ifName string, err error)
+
+// NewUserspaceDataPlane returns a data plane which encapsulates and
+// decapsulates data packets in userspace, rather than using the Linux
+// kernel L2TP subsystem.  This allows sessions to carry data on systems
+// where the kernel L2TP modules aren't available or can't be loaded.
+//
+// The frames of each session are exchanged with the port opened by
+// openPort when the session is created.  OpenTAPPort may be used to
+// exchange the frames of Ethernet pseudowires with a TAP interface,
+// OpenTUNPort to exchange the packets of IP pseudowires with a TUN
+// interface, and OpenFramePort to exchange the frames of any session with
+// the application using Session.ReadFrame and Session.WriteFrame.
+//
+// Where packets are queued, the userspace data plane sends them and
+// receives them on the sockets it opens itself using a single system
+// call per batch of packets.
+//
+// Tunnels with InheritDataDSCP set mark each data packet carrying an IP
+// packet with the DSCP of that packet, as translated by DataDSCPMap.
+//
+// The userspace data plane supports UDP encapsulation only.  Sessions
+// using sequence numbers hold packets received ahead of sequence for up
+// to their ReorderTimeout, and discard packets received behind sequence.
+// Dynamic tunnels sharing a listener's socket can't use the userspace
+// data plane.
+func NewUserspaceDataPlane(openPort SessionPortFunc) (DataPlane, error) {
+	if openPort == nil {
+		return nil, errors.New("invalid nil session port function")
+	}
+	return &userspaceDataPlane{
+		openPort: openPort,
+		tunnels:  make(map[ControlConnID]*userspaceTunnelDataPlane),
+	}, nil
+}
+
+type userspaceDataPlane struct {
+	openPort SessionPortFunc
+	lock     sync.Mutex
+	tunnels  map[ControlConnID]*userspaceTunnelDataPlane
+}
+
+type userspaceTunnelDataPlane struct {
+	dp        *userspaceDataPlane
+	version   ProtocolVersion
+	tid, ptid ControlConnID
+	fd        int
+	peer      unix.Sockaddr
+	connected bool
+	// The network namespace session ports are opened in
+	netns string
+	// cp is set if the data plane opened its own socket for the
+	// tunnel, as it does for static tunnels.
+	cp *controlPlane
+	// The ancillary data marking a data packet with the DSCP it inherits,
+	// indexed by the DSCP of the encapsulated packet.  It's nil unless the
+	// tunnel inherits the data DSCP.
+	dscpOob  [][]byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+	lock     sync.Mutex
+	sessions map[ControlConnID]*userspaceSessionDataPlane
+	// The counters of the tunnel's sessions which have been torn down
+	downStats SessionDataPlaneStatistics
+}
+
+type userspaceSessionDataPlane struct {
+	tunnel *userspaceTunnelDataPlane
+	cfg    *SessionConfig
+	port   io.ReadWriteCloser
+	ifName string
+	wg     sync.WaitGroup
+	// The transmit sequence number is only accessed from the session's
+	// transmit goroutine.  The receive sequence number and the packets
+	// held for reordering are accessed from the tunnel's receive path and
+	// the reorder timer, under rxLock.
+	txSeq        uint32
+	rxLock       sync.Mutex
+	rxSeq        uint32
+	rxSeqValid   bool
+	reorderQ     []*reorderPacket
+	reorderTimer *time.Timer
+	statsLock    sync.Mutex
+	stats        SessionDataPlaneStatistics
+}
+
+// reorderPacket is a data packet received ahead of sequence, which is
+// held until the packets before it arrive or its reorder timeout expires.
+type reorderPacket struct {
+	ns      uint32
+	frame   []byte
+	expires time.Time
+}
+
+// dataFrameReceiver is implemented by tunnel data planes which handle
+// data packets received on a tunnel socket managed by the control plane.
+type dataFrameReceiver interface {
+	receiveDataFrame(b []byte)
+}
+
+// The maximum size of a data packet the userspace data plane will send
+// or receive.
+const userspaceMaxFrameLen = 65535
+
+// The maximum number of data packets the userspace data plane sends or
+// receives in a single system call.
+const userspaceBatchLen = 16
+
+// The maximum number of out of sequence data packets the userspace data
+// plane holds for each session.  Once the limit is reached the packets
+// before the earliest held packet are treated as lost.
+const userspaceReorderQueueLen = 64
+
+// Flags in the L2TP header of data packets.
+// Ref: RFC2661 section 3.1, RFC3931 section 4.1.2.1.
+const (
+	dataFlagType   = 0x8000
+	dataFlagLength = 0x4000
+	dataFlagSeq    = 0x0800
+	dataFlagOffset = 0x0200
+	dataFlagVerMsk = 0x000f
+)
+
+// The S bit of the default L2-Specific Sublayer, which is followed by a
+// 24 bit sequence number.
+// Ref: RFC4719 section 4.6.
+const (
+	l2SpecSeqFlag = 0x40000000
+	l2SpecSeqMask = 0x00ffffff
+)
+
+func (dp *userspaceDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	if tcfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("userspace data plane doesn't support %v encapsulation", tcfg.Encap)
+	}
+
+	dscpOob, err := newDSCPOob(tcfg, sap)
+	if err != nil {
+		return nil, err
+	}
+
+	tdp := &userspaceTunnelDataPlane{
+		dp:       dp,
+		dscpOob:  dscpOob,
+		version:  tcfg.Version,
+		tid:      tcfg.TunnelID,
+		ptid:     tcfg.PeerTunnelID,
+		fd:       fd,
+		peer:     sap,
+		netns:    tcfg.NetNS,
+		sessions: make(map[ControlConnID]*userspaceSessionDataPlane),
+	}
+
+	// Tunnels without a control plane don't have a socket, so the data
+	// plane opens one of its own
+	if fd < 0 {
+		cp, err := newNetNSControlPlane(tcfg.NetNS, sal, sap)
+		if err != nil {
+			return nil, err
+		}
+		if err = cp.bind(); err != nil {
+			cp.close()
+			return nil, err
+		}
+		if err = cp.connect(); err != nil {
+			cp.close()
+			return nil, err
+		}
+		if tcfg.DataDSCP != 0 {
+			if err = cp.setDSCP(tcfg.DataDSCP, tcfg.DataDSCP); err != nil {
+				cp.close()
+				return nil, err
+			}
+		}
+		tdp.cp = cp
+		tdp.fd = cp.fd
+		tdp.done = make(chan struct{})
+		tdp.wg.Add(1)
+		go func() {
+			defer tdp.wg.Done()
+			tdp.receiver()
+		}()
+	}
+
+	// The socket of a dynamic tunnel may not be connected, in which
+	// case packets are addressed to the peer explicitly
+	if _, err := unix.Getpeername(tdp.fd); err == nil {
+		tdp.connected = true
+	}
+
+	dp.lock.Lock()
+	dp.tunnels[tdp.tid] = tdp
+	dp.lock.Unlock()
+
+	return tdp, nil
+}
+
+// newDSCPOob builds the ancillary data marking the data packets of a
+// tunnel inheriting the data DSCP, indexed by the DSCP of the
+// encapsulated packet.
+func newDSCPOob(tcfg *TunnelConfig, sap unix.Sockaddr) ([][]byte, error) {
+	if !tcfg.InheritDataDSCP {
+		return nil, nil
+	}
+	for inner, outer := range tcfg.DataDSCPMap {
+		if inner > maxDSCP || outer > maxDSCP {
+			return nil, fmt.Errorf("DSCP value out of range (max %v)", maxDSCP)
+		}
+	}
+
+	// IPv4 packets sent on an AF_INET6 socket to an IPv4-mapped address
+	// take the IPv4 option
+	level, opt := unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	switch sa := sap.(type) {
+	case *unix.SockaddrInet4:
+		level, opt = unix.IPPROTO_IP, unix.IP_TOS
+	case *unix.SockaddrInet6:
+		if net.IP(sa.Addr[:]).To4() != nil {
+			level, opt = unix.IPPROTO_IP, unix.IP_TOS
+		}
+	}
+
+	oobs := make([][]byte, maxDSCP+1)
+	for inner := range oobs {
+		outer, ok := tcfg.DataDSCPMap[uint8(inner)]
+		if !ok {
+			outer = uint8(inner)
+		}
+		oobs[inner] = dscpCmsg(level, opt, outer)
+	}
+	return oobs, nil
+}
+
+func (dp *userspaceDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	dp.lock.Lock()
+	tdp, ok := dp.tunnels[tid]
+	dp.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no data plane for tunnel %v", tid)
+	}
+
+	var port io.ReadWriteCloser
+	var ifName string
+	err := withNetNS(tdp.netns, func() (err error) {
+		port, ifName, err = dp.openPort(tid, scfg)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session port: %v", err)
+	}
+
+	sdp := &userspaceSessionDataPlane{
+		tunnel: tdp,
+		cfg:    scfg,
+		port:   port,
+		ifName: ifName,
+	}
+
+	tdp.lock.Lock()
+	if _, ok := tdp.sessions[scfg.SessionID]; ok {
+		tdp.lock.Unlock()
+		port.Close()
+		return nil, fmt.Errorf("already have a data plane for session %v", scfg.SessionID)
+	}
+	tdp.sessions[scfg.SessionID] = sdp
+	tdp.lock.Unlock()
+
+	txq := make(chan []byte, userspaceBatchLen)
+	sdp.wg.Add(2)
+	go func() {
+		defer sdp.wg.Done()
+		sdp.reader(txq)
+	}()
+	go func() {
+		defer sdp.wg.Done()
+		sdp.transmitter(txq)
+	}()
+
+	return sdp, nil
+}
+
+func (dp *userspaceDataPlane) Close() {
+}
+
+// hasTunnel returns true if the data plane has an instance for the tunnel.
+func (dp *userspaceDataPlane) hasTunnel(tid ControlConnID) bool {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	_, ok := dp.tunnels[tid]
+	return ok
+}
+
+// receiver reads data packets from a socket opened by the data plane,
+// receiving as many as are available with each system call.
+func (tdp *userspaceTunnelDataPlane) receiver() {
+	rb := newRecvBatch(userspaceBatchLen, userspaceMaxFrameLen)
+	for {
+		n, err := tdp.cp.recvmmsg(rb)
+		if err != nil {
+			// Errors such as ECONNREFUSED are transient
+			select {
+			case <-tdp.done:
+				return
+			default:
+				continue
+			}
+		}
+		for i := 0; i < n; i++ {
+			tdp.receiveDataFrame(rb.packet(i))
+		}
+	}
+}
+
+// receiveDataFrame decapsulates a data packet received from the peer,
+// passing the frame it carries to the session's port.
+func (tdp *userspaceTunnelDataPlane) receiveDataFrame(b []byte) {
+	var sid ControlConnID
+	var payload []byte
+	var err error
+
+	if tdp.version == ProtocolVersion2 {
+		sid, payload, err = tdp.decapV2(b)
+	} else {
+		sid, payload, err = decapV3Header(b)
+	}
+	if err != nil {
+		return
+	}
+
+	tdp.lock.Lock()
+	sdp, ok := tdp.sessions[sid]
+	tdp.lock.Unlock()
+	if !ok {
+		return
+	}
+	sdp.receive(b, payload)
+}
+
+// decapV2 parses the header of an L2TPv2 data packet.  The returned
+// payload includes any sequence numbers, which are parsed by the session.
+func (tdp *userspaceTunnelDataPlane) decapV2(b []byte) (sid ControlConnID, payload []byte, err error) {
+	if len(b) < 6 {
+		return 0, nil, errors.New("short data packet")
+	}
+	flags := binary.BigEndian.Uint16(b)
+	if flags&dataFlagType != 0 || flags&dataFlagVerMsk != 2 {
+		return 0, nil, errors.New("not an L2TPv2 data packet")
+	}
+	off := 2
+	if flags&dataFlagLength != 0 {
+		// Discard any padding following the packet
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < off+6 || length > len(b) {
+			return 0, nil, errors.New("bad data packet length")
+		}
+		b = b[:length]
+		off += 2
+	}
+	if len(b) < off+4 {
+		return 0, nil, errors.New("short data packet")
+	}
+	if ControlConnID(binary.BigEndian.Uint16(b[off:])) != tdp.tid {
+		return 0, nil, errors.New("data packet for another tunnel")
+	}
+	sid = ControlConnID(binary.BigEndian.Uint16(b[off+2:]))
+	return sid, b[off+4:], nil
+}
+
+// decapV3Header parses the session ID of an L2TPv3 data packet received
+// over UDP.  The returned payload starts with the cookie, if any.
+func decapV3Header(b []byte) (sid ControlConnID, payload []byte, err error) {
+	if len(b) < 8 {
+		return 0, nil, errors.New("short data packet")
+	}
+	flags := binary.BigEndian.Uint16(b)
+	if flags&dataFlagType != 0 || flags&dataFlagVerMsk != 3 {
+		return 0, nil, errors.New("not an L2TPv3 data packet")
+	}
+	return ControlConnID(binary.BigEndian.Uint32(b[4:])), b[8:], nil
+}
+
+// send transmits data packets to the peer, each gathered from the
+// buffers of an element of pkts and sent with the ancillary data of the
+// matching element of oobs.  It returns the number of packets sent, as
+// sendmmsg does.
+func (tdp *userspaceTunnelDataPlane) send(pkts [][][]byte, oobs [][]byte) (int, error) {
+	var to unix.Sockaddr
+	if !tdp.connected {
+		to = tdp.peer
+	}
+	return sendmmsg(tdp.fd, pkts, oobs, to, unix.MSG_NOSIGNAL)
+}
+
+// oob returns the ancillary data marking the data packet carrying a frame
+// with the DSCP it inherits, or nil if the packet is marked with the
+// socket's default DSCP.
+func (tdp *userspaceTunnelDataPlane) oob(pw PseudowireType, frame []byte) []byte {
+	if tdp.dscpOob == nil {
+		return nil
+	}
+	if dscp, ok := innerDSCP(pw, frame); ok {
+		return tdp.dscpOob[dscp]
+	}
+	return nil
+}
+
+func (tdp *userspaceTunnelDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	tdp.lock.Lock()
+	defer tdp.lock.Unlock()
+	stats := tdp.downStats
+	for _, sdp := range tdp.sessions {
+		ss, _ := sdp.GetStatistics()
+		addStatistics(&stats, ss)
+	}
+	return &stats, nil
+}
+
+func (tdp *userspaceTunnelDataPlane) Down() error {
+	tdp.dp.lock.Lock()
+	delete(tdp.dp.tunnels, tdp.tid)
+	tdp.dp.lock.Unlock()
+
+	if tdp.cp != nil {
+		close(tdp.done)
+		tdp.cp.close()
+		tdp.wg.Wait()
+	}
+	return nil
+}
+
+// reader queues the frames read from the session's port for the
+// transmitter, closing the queue once the port is closed.
+func (sdp *userspaceSessionDataPlane) reader(txq chan<- []byte) {
+	defer close(txq)
+	b := make([]byte, userspaceMaxFrameLen)
+	for {
+		n, err := sdp.port.Read(b)
+		if err != nil {
+			return
+		}
+		txq <- append([]byte(nil), b[:n]...)
+	}
+}
+
+// transmitter encapsulates the frames queued by the reader and sends them
+// to the peer.  Frames queued while a batch is being sent are sent
+// together in the next batch.
+func (sdp *userspaceSessionDataPlane) transmitter(txq <-chan []byte) {
+	pkts := make([][][]byte, 0, userspaceBatchLen)
+	var oobs [][]byte
+	if sdp.tunnel.dscpOob != nil {
+		oobs = make([][]byte, 0, userspaceBatchLen)
+	}
+	for frame := range txq {
+		pkts = append(pkts[:0], [][]byte{sdp.header(), frame})
+		if oobs != nil {
+			oobs = append(oobs[:0], sdp.tunnel.oob(sdp.cfg.Pseudowire, frame))
+		}
+	batch:
+		for len(pkts) < userspaceBatchLen {
+			select {
+			case frame, ok := <-txq:
+				if !ok {
+					break batch
+				}
+				pkts = append(pkts, [][]byte{sdp.header(), frame})
+				if oobs != nil {
+					oobs = append(oobs, sdp.tunnel.oob(sdp.cfg.Pseudowire, frame))
+				}
+			default:
+				break batch
+			}
+		}
+		sdp.transmit(pkts, oobs)
+	}
+}
+
+// transmit sends a batch of data packets to the peer, skipping any packet
+// which can't be sent.
+func (sdp *userspaceSessionDataPlane) transmit(pkts [][][]byte, oobs [][]byte) {
+	for len(pkts) > 0 {
+		n, err := sdp.tunnel.send(pkts, oobs)
+		for _, pkt := range pkts[:n] {
+			sdp.onPacket(true, len(pkt[1]))
+		}
+		if err != nil || n == 0 {
+			sdp.onError(true)
+			n++
+		}
+		pkts = pkts[n:]
+		if oobs != nil {
+			oobs = oobs[n:]
+		}
+	}
+}
+
+// innerDSCP returns the DSCP of the IPv4 or IPv6 packet carried by a
+// frame of the pseudowire type, and false if the frame doesn't carry one.
+func innerDSCP(pw PseudowireType, b []byte) (dscp uint8, ok bool) {
+	switch {
+	case pw == PseudowireTypeIP:
+	case isEthPseudowire(pw):
+		// Skip the MAC addresses and any 802.1Q or 802.1ad tags
+		if len(b) < 14 {
+			return 0, false
+		}
+		etype := binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for (etype == 0x8100 || etype == 0x88a8) && len(b) >= 4 {
+			etype = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+		if etype != 0x0800 && etype != 0x86dd {
+			return 0, false
+		}
+	case pw == PseudowireTypePPP:
+		// The address and control fields may be omitted, and the
+		// protocol field compressed to a single odd byte
+		if len(b) >= 2 && b[0] == 0xff && b[1] == 0x03 {
+			b = b[2:]
+		}
+		var proto uint16
+		if len(b) >= 1 && b[0]&1 != 0 {
+			proto, b = uint16(b[0]), b[1:]
+		} else if len(b) >= 2 {
+			proto, b = binary.BigEndian.Uint16(b), b[2:]
+		}
+		if proto != 0x0021 && proto != 0x0057 {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	// The DSCP is the upper six bits of the IPv4 TOS or IPv6 traffic class
+	if len(b) < 2 {
+		return 0, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return b[1] >> 2, true
+	case 6:
+		return (b[0]&0x0f)<<2 | b[1]>>6, true
+	}
+	return 0, false
+}
+
+// header returns the L2TP header for the next data packet sent to the peer.
+func (sdp *userspaceSessionDataPlane) header() []byte {
+	var b []byte
+	if sdp.tunnel.version == ProtocolVersion2 {
+		flags := uint16(2)
+		if sdp.cfg.SeqNum {
+			flags |= dataFlagSeq
+		}
+		b = make([]byte, 6, 10)
+		binary.BigEndian.PutUint16(b[0:], flags)
+		binary.BigEndian.PutUint16(b[2:], uint16(sdp.tunnel.ptid))
+		binary.BigEndian.PutUint16(b[4:], uint16(sdp.cfg.PeerSessionID))
+		if sdp.cfg.SeqNum {
+			// Nr is unused for data packets
+			b = append(b, byte(sdp.txSeq>>8), byte(sdp.txSeq), 0, 0)
+			sdp.txSeq = uint32(seqIncrement(uint16(sdp.txSeq)))
+		}
+		return b
+	}
+
+	b = make([]byte, 8, 20)
+	binary.BigEndian.PutUint16(b[0:], 3)
+	binary.BigEndian.PutUint32(b[4:], uint32(sdp.cfg.PeerSessionID))
+	b = append(b, sdp.cfg.Cookie...)
+	if sdp.cfg.L2SpecType == L2SpecTypeDefault {
+		var l2spec uint32
+		if sdp.cfg.SeqNum {
+			l2spec = l2SpecSeqFlag | sdp.txSeq
+			sdp.txSeq = (sdp.txSeq + 1) & l2SpecSeqMask
+		}
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], l2spec)
+	}
+	return b
+}
+
+// receive parses the session-specific part of a data packet's header, and
+// passes the frame it carries to the session's port.
+func (sdp *userspaceSessionDataPlane) receive(pkt, b []byte) {
+	var ns uint32
+	var hasSeq bool
+	var seqMask uint32
+
+	if sdp.tunnel.version == ProtocolVersion2 {
+		flags := binary.BigEndian.Uint16(pkt)
+		if flags&dataFlagSeq != 0 {
+			if len(b) < 4 {
+				sdp.onError(false)
+				return
+			}
+			ns, hasSeq, seqMask = uint32(binary.BigEndian.Uint16(b)), true, 0xffff
+			b = b[4:]
+		}
+		if flags&dataFlagOffset != 0 {
+			if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+				sdp.onError(false)
+				return
+			}
+			b = b[2+int(binary.BigEndian.Uint16(b)):]
+		}
+	} else {
+		cookie := sdp.cfg.PeerCookie
+		if len(b) < len(cookie) || !bytes.Equal(b[:len(cookie)], cookie) {
+			sdp.statsLock.Lock()
+			sdp.stats.RxCookieDiscards++
+			sdp.statsLock.Unlock()
+			sdp.onError(false)
+			return
+		}
+		b = b[len(cookie):]
+		if sdp.cfg.L2SpecType == L2SpecTypeDefault {
+			if len(b) < 4 {
+				sdp.onError(false)
+				return
+			}
+			l2spec := binary.BigEndian.Uint32(b)
+			if l2spec&l2SpecSeqFlag != 0 {
+				ns, hasSeq, seqMask = l2spec&l2SpecSeqMask, true, l2SpecSeqMask
+			}
+			b = b[4:]
+		}
+	}
+
+	if hasSeq && sdp.cfg.SeqNum {
+		sdp.receiveSeq(ns, seqMask, b)
+		return
+	}
+	sdp.deliver(b)
+}
+
+// deliver passes a received frame to the session's port.
+func (sdp *userspaceSessionDataPlane) deliver(b []byte) {
+	if _, err := sdp.port.Write(b); err != nil {
+		sdp.onError(false)
+		return
+	}
+	sdp.onPacket(false, len(b))
+}
+
+// receiveSeq delivers a received frame carrying a sequence number.  If the
+// session has a ReorderTimeout, frames received ahead of sequence are held
+// until the frames before them arrive.
+func (sdp *userspaceSessionDataPlane) receiveSeq(ns, mask uint32, b []byte) {
+	sdp.rxLock.Lock()
+	defer sdp.rxLock.Unlock()
+
+	if sdp.cfg.ReorderTimeout == 0 || !sdp.rxSeqValid {
+		if sdp.checkSeq(ns, mask) {
+			sdp.deliver(b)
+		}
+		return
+	}
+
+	delta := (ns - sdp.rxSeq) & mask
+	if delta == 0 || delta >= (mask+1)/2 {
+		if sdp.checkSeq(ns, mask) {
+			sdp.deliver(b)
+			sdp.deliverReordered(mask)
+		}
+		return
+	}
+
+	// Hold the frame, which may be a duplicate of one already held, in
+	// sequence order
+	i := 0
+	for ; i < len(sdp.reorderQ); i++ {
+		d := (sdp.reorderQ[i].ns - sdp.rxSeq) & mask
+		if d == delta {
+			sdp.statsLock.Lock()
+			sdp.stats.RxSeqDiscards++
+			sdp.statsLock.Unlock()
+			return
+		}
+		if d > delta {
+			break
+		}
+	}
+	pkt := &reorderPacket{
+		ns:      ns,
+		frame:   append([]byte(nil), b...),
+		expires: time.Now().Add(sdp.cfg.ReorderTimeout),
+	}
+	sdp.reorderQ = append(sdp.reorderQ, nil)
+	copy(sdp.reorderQ[i+1:], sdp.reorderQ[i:])
+	sdp.reorderQ[i] = pkt
+	sdp.statsLock.Lock()
+	sdp.stats.RxOutOfSequence++
+	sdp.statsLock.Unlock()
+
+	if len(sdp.reorderQ) > userspaceReorderQueueLen {
+		sdp.skipReordered(0, mask)
+	}
+	if sdp.reorderTimer == nil {
+		sdp.reorderTimer = time.AfterFunc(sdp.cfg.ReorderTimeout, func() {
+			sdp.onReorderTimeout(mask)
+		})
+	}
+}
+
+// deliverReordered delivers the held frames which are now in sequence.
+func (sdp *userspaceSessionDataPlane) deliverReordered(mask uint32) {
+	for len(sdp.reorderQ) > 0 && sdp.reorderQ[0].ns == sdp.rxSeq {
+		sdp.deliver(sdp.reorderQ[0].frame)
+		sdp.rxSeq = (sdp.rxSeq + 1) & mask
+		sdp.reorderQ = sdp.reorderQ[1:]
+	}
+}
+
+// skipReordered treats the frames missing before the held frame at index
+// i as lost, delivering the held frames up to and including it.
+func (sdp *userspaceSessionDataPlane) skipReordered(i int, mask uint32) {
+	for _, pkt := range sdp.reorderQ[:i+1] {
+		sdp.deliver(pkt.frame)
+	}
+	sdp.rxSeq = (sdp.reorderQ[i].ns + 1) & mask
+	sdp.reorderQ = sdp.reorderQ[i+1:]
+	sdp.deliverReordered(mask)
+}
+
+// onReorderTimeout skips the frames missing before held frames whose
+// reorder timeout has expired, and restarts the timer for the next frame
+// to expire.
+func (sdp *userspaceSessionDataPlane) onReorderTimeout(mask uint32) {
+	sdp.rxLock.Lock()
+	defer sdp.rxLock.Unlock()
+
+	if sdp.reorderTimer == nil {
+		return
+	}
+	now := time.Now()
+	for i := len(sdp.reorderQ) - 1; i >= 0; i-- {
+		if !now.Before(sdp.reorderQ[i].expires) {
+			sdp.skipReordered(i, mask)
+			break
+		}
+	}
+	if len(sdp.reorderQ) == 0 {
+		sdp.reorderTimer = nil
+		return
+	}
+	next := sdp.reorderQ[0].expires
+	for _, pkt := range sdp.reorderQ[1:] {
+		if pkt.expires.Before(next) {
+			next = pkt.expires
+		}
+	}
+	sdp.reorderTimer.Reset(next.Sub(now))
+}
+
+// checkSeq checks the sequence number of a received data packet, returning
+// false if it should be discarded.  Packets behind the next expected
+// sequence number are discarded, while packets ahead of it are accepted
+// following loss of the packets in between.
+func (sdp *userspaceSessionDataPlane) checkSeq(ns, mask uint32) bool {
+	if sdp.rxSeqValid {
+		// Compare sequence numbers in the space of the field, such that
+		// the difference is negative if ns is behind
+		half := (mask + 1) / 2
+		delta := (ns - sdp.rxSeq) & mask
+		if delta >= half {
+			sdp.statsLock.Lock()
+			sdp.stats.RxSeqDiscards++
+			sdp.statsLock.Unlock()
+			return false
+		}
+		if delta != 0 {
+			sdp.statsLock.Lock()
+			sdp.stats.RxOutOfSequence++
+			sdp.statsLock.Unlock()
+		}
+	}
+	sdp.rxSeq = (ns + 1) & mask
+	sdp.rxSeqValid = true
+	return true
+}
+
+func (sdp *userspaceSessionDataPlane) onPacket(tx bool, n int) {
+	sdp.statsLock.Lock()
+	defer sdp.statsLock.Unlock()
+	if tx {
+		sdp.stats.TxPackets++
+		sdp.stats.TxBytes += uint64(n)
+	} else {
+		sdp.stats.RxPackets++
+		sdp.stats.RxBytes += uint64(n)
+	}
+}
+
+func (sdp *userspaceSessionDataPlane) onError(tx bool) {
+	sdp.statsLock.Lock()
+	defer sdp.statsLock.Unlock()
+	if tx {
+		sdp.stats.TxErrors++
+	} else {
+		sdp.stats.RxErrors++
+	}
+}
+
+func (sdp *userspaceSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, error) {
+	sdp.statsLock.Lock()
+	defer sdp.statsLock.Unlock()
+	stats := sdp.stats
+	return &stats, nil
+}
+
+func (sdp *userspaceSessionDataPlane) GetInterfaceName() (string, error) {
+	return sdp.ifName, nil
+}
+
+func (sdp *userspaceSessionDataPlane) SetMTU(mtu uint16) error {
+	if sdp.ifName == "" {
+		return fmt.Errorf("session has no network interface")
+	}
+	return withNetNS(sessionInterfaceNetNS(sdp.tunnel.netns, sdp.cfg), func() error {
+		return setInterfaceMTU(sdp.ifName, mtu)
+	})
+}
+
+func (sdp *userspaceSessionDataPlane) ReadFrame(b []byte) (int, error) {
+	if fp, ok := sdp.port.(*framePort); ok {
+		return fp.readFrame(b)
+	}
+	return 0, ErrNoFrameAccess
+}
+
+func (sdp *userspaceSessionDataPlane) WriteFrame(b []byte) (int, error) {
+	if fp, ok := sdp.port.(*framePort); ok {
+		return fp.writeFrame(b)
+	}
+	return 0, ErrNoFrameAccess
+}
+
+func (sdp *userspaceSessionDataPlane) Down() error {
+	tdp := sdp.tunnel
+	tdp.lock.Lock()
+	delete(tdp.sessions, sdp.cfg.SessionID)
+	tdp.lock.Unlock()
+
+	sdp.rxLock.Lock()
+	if sdp.reorderTimer != nil {
+		sdp.reorderTimer.Stop()
+		sdp.reorderTimer = nil
+	}
+	sdp.reorderQ = nil
+	sdp.rxLock.Unlock()
+
+	err := sdp.port.Close()
+	sdp.wg.Wait()
+
+	ss, _ := sdp.GetStatistics()
+	tdp.lock.Lock()
+	addStatistics(&tdp.downStats, ss)
+	tdp.lock.Unlock()
+	return err
+}
+
+func addStatistics(dst, src *SessionDataPlaneStatistics) {
+	dst.TxPackets += src.TxPackets
+	dst.TxBytes += src.TxBytes
+	dst.TxErrors += src.TxErrors
+	dst.RxPackets += src.RxPackets
+	dst.RxBytes += src.RxBytes
+	dst.RxErrors += src.RxErrors
+	dst.RxSeqDiscards += src.RxSeqDiscards
+	dst.RxOutOfSequence += src.RxOutOfSequence
+	dst.RxCookieDiscards += src.RxCookieDiscards
+}
+
+// OpenTAPPort is a SessionPortFunc which exchanges the frames of an
+// Ethernet pseudowire session with a TAP interface.  The interface is
+// named by the session's InterfaceName, or named by the kernel if unset.
+// Its MAC address and MTU are set if the session's HardwareAddr and MTU
+// are set.  The interface is not brought up.
+func OpenTAPPort(tunnelID ControlConnID, cfg *SessionConfig) (port io.ReadWriteCloser, ifName string, err error) {
+	if !isEthPseudowire(cfg.Pseudowire) {
+		return nil, "", fmt.Errorf("TAP ports don't support %v pseudowires", cfg.Pseudowire)
+	}
+	fd, ifName, err := openTUNDevice(cfg.InterfaceName, unix.IFF_TAP)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(cfg.HardwareAddr) > 0 {
+		if err = setTAPHardwareAddr(fd, ifName, cfg.HardwareAddr); err != nil {
+			unix.Close(fd)
+			return nil, "", err
+		}
+	}
+
+	if cfg.MTU != 0 {
+		if err = setInterfaceMTU(ifName, cfg.MTU); err != nil {
+			unix.Close(fd)
+			return nil, "", err
+		}
+	}
+
+	// The nonblocking file is registered with the runtime poller, so
+	// that closing it unblocks the session's pending Read
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifName, nil
+}
+
+// OpenTUNPort is a SessionPortFunc which exchanges the packets of an IP
+// pseudowire session with a TUN interface.  The interface is named by the
+// session's InterfaceName, or named by the kernel if unset.  Its MTU is
+// set if the session's MTU is set.  The interface is not brought up.
+func OpenTUNPort(tunnelID ControlConnID, cfg *SessionConfig) (port io.ReadWriteCloser, ifName string, err error) {
+	if cfg.Pseudowire != PseudowireTypeIP {
+		return nil, "", fmt.Errorf("TUN ports don't support %v pseudowires", cfg.Pseudowire)
+	}
+	fd, ifName, err := openTUNDevice(cfg.InterfaceName, unix.IFF_TUN)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cfg.MTU != 0 {
+		if err = setInterfaceMTU(ifName, cfg.MTU); err != nil {
+			unix.Close(fd)
+			return nil, "", err
+		}
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifName, nil
+}
+
+// openTUNDevice creates a TUN or TAP interface, as selected by flags,
+// returning the nonblocking file descriptor through which its packets
+// are exchanged and the name of the interface.  Packets are exchanged
+// without the packet information header.
+func openTUNDevice(name string, flags uint16) (fd int, ifName string, err error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return -1, "", fmt.Errorf("interface name %q is too long", name)
+	}
+
+	fd, err = unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+
+	var ifr struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = flags | unix.IFF_NO_PI
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		unix.Close(fd)
+		return -1, "", fmt.Errorf("ioctl(TUNSETIFF): %v", errno)
+	}
+	return fd, string(bytes.TrimRight(ifr.name[:], "\x00")), nil
+}
+
+// setTAPHardwareAddr sets the MAC address of a TAP interface using the
+// SIOCSIFHWADDR ioctl, which takes a struct ifreq containing a struct
+// sockaddr.
+func setTAPHardwareAddr(fd int, ifName string, addr net.HardwareAddr) error {
+	var ifr struct {
+		name   [unix.IFNAMSIZ]byte
+		family uint16
+		data   [14]byte
+		_      [8]byte
+	}
+	copy(ifr.name[:], ifName)
+	ifr.family = unix.ARPHRD_ETHER
+	copy(ifr.data[:], addr)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFHWADDR, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("ioctl(SIOCSIFHWADDR, %q): %v", ifName, errno)
+	}
+	return nil
+}
+
+// The number of received frames a frame port queues for the application
+const framePortQueueLen = 64
+
+// OpenFramePort is a SessionPortFunc which exchanges the frames of a
+// session with the application, which reads and writes them using the
+// session's ReadFrame and WriteFrame methods.  The session has no network
+// interface.
+//
+// Up to 64 frames received from the peer are queued for ReadFrame: frames
+// received while the queue is full are discarded and counted as receive
+// errors.  WriteFrame blocks until the frame has been passed to the
+// session's transmit goroutine.
+func OpenFramePort(tunnelID ControlConnID, cfg *SessionConfig) (port io.ReadWriteCloser, ifName string, err error) {
+	return &framePort{
+		rx:   make(chan []byte, framePortQueueLen),
+		tx:   make(chan []byte),
+		done: make(chan struct{}),
+	}, "", nil
+}
+
+// framePort is the port opened by OpenFramePort.  Its Read and Write
+// methods are called by the data plane, and its readFrame and writeFrame
+// methods by the application.
+type framePort struct {
+	rx, tx    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (fp *framePort) Read(b []byte) (int, error) {
+	select {
+	case frame := <-fp.tx:
+		return copy(b, frame), nil
+	case <-fp.done:
+		return 0, io.EOF
+	}
+}
+
+func (fp *framePort) Write(b []byte) (int, error) {
+	select {
+	case <-fp.done:
+		return 0, io.EOF
+	default:
+	}
+	select {
+	case fp.rx <- append([]byte(nil), b...):
+		return len(b), nil
+	default:
+		return 0, errors.New("frame queue full")
+	}
+}
+
+func (fp *framePort) Close() error {
+	fp.closeOnce.Do(func() { close(fp.done) })
+	return nil
+}
+
+func (fp *framePort) readFrame(b []byte) (int, error) {
+	select {
+	case frame := <-fp.rx:
+		if len(frame) > len(b) {
+			return copy(b, frame), io.ErrShortBuffer
+		}
+		return copy(b, frame), nil
+	case <-fp.done:
+		return 0, io.EOF
+	}
+}
+
+func (fp *framePort) writeFrame(b []byte) (int, error) {
+	if len(b) > userspaceMaxFrameLen {
+		return 0, fmt.Errorf("frame length %v exceeds maximum %v", len(b), userspaceMaxFrameLen)
+	}
+	select {
+	case fp.tx <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-fp.done:
+		return 0, io.EOF
+	}
+}
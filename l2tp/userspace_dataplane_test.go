@@ -0,0 +1,561 @@
+package l2tp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// chanPort is a session port exchanging frames over channels.
+type chanPort struct {
+	tx, rx chan []byte
+	done   chan struct{}
+}
+
+func newChanPort() *chanPort {
+	return &chanPort{
+		tx:   make(chan []byte),
+		rx:   make(chan []byte, 8),
+		done: make(chan struct{}),
+	}
+}
+
+func (p *chanPort) Read(b []byte) (int, error) {
+	select {
+	case frame := <-p.tx:
+		return copy(b, frame), nil
+	case <-p.done:
+		return 0, errors.New("port closed")
+	}
+}
+
+func (p *chanPort) Write(b []byte) (int, error) {
+	p.rx <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (p *chanPort) Close() error {
+	close(p.done)
+	return nil
+}
+
+func TestUserspaceDataPlane(t *testing.T) {
+	cases := []struct {
+		name       string
+		version    ProtocolVersion
+		lac, lns   *SessionConfig
+		frame      []byte
+		cookieDrop bool
+	}{
+		{
+			name:    "L2TPv2 with sequence numbers",
+			version: ProtocolVersion2,
+			lac:     &SessionConfig{SessionID: 10, PeerSessionID: 20, Pseudowire: PseudowireTypePPP, SeqNum: true},
+			lns:     &SessionConfig{SessionID: 20, PeerSessionID: 10, Pseudowire: PseudowireTypePPP, SeqNum: true},
+			frame:   []byte{0xff, 0x03, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04},
+		},
+		{
+			name:    "L2TPv3 with cookies and sublayer",
+			version: ProtocolVersion3,
+			lac: &SessionConfig{
+				SessionID:     0x1000,
+				PeerSessionID: 0x2000,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{1, 2, 3, 4},
+				PeerCookie:    []byte{5, 6, 7, 8, 9, 10, 11, 12},
+				L2SpecType:    L2SpecTypeDefault,
+				SeqNum:        true,
+			},
+			lns: &SessionConfig{
+				SessionID:     0x2000,
+				PeerSessionID: 0x1000,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{5, 6, 7, 8, 9, 10, 11, 12},
+				PeerCookie:    []byte{1, 2, 3, 4},
+				L2SpecType:    L2SpecTypeDefault,
+				SeqNum:        true,
+			},
+			frame: bytes.Repeat([]byte{0xaa}, 64),
+		},
+		{
+			name:    "L2TPv3 IP pseudowire",
+			version: ProtocolVersion3,
+			lac:     &SessionConfig{SessionID: 0x1000, PeerSessionID: 0x2000, Pseudowire: PseudowireTypeIP},
+			lns:     &SessionConfig{SessionID: 0x2000, PeerSessionID: 0x1000, Pseudowire: PseudowireTypeIP},
+			// An ICMP echo request from 192.0.2.1 to 192.0.2.2
+			frame: []byte{
+				0x45, 0x00, 0x00, 0x1c, 0x00, 0x01, 0x00, 0x00, 0x40, 0x01, 0xf7, 0x8d,
+				0xc0, 0x00, 0x02, 0x01, 0xc0, 0x00, 0x02, 0x02,
+				0x08, 0x00, 0xf7, 0xfe, 0x00, 0x01, 0x00, 0x00,
+			},
+		},
+		{
+			name:    "L2TPv3 with wrong cookie",
+			version: ProtocolVersion3,
+			lac: &SessionConfig{
+				SessionID:     0x1000,
+				PeerSessionID: 0x2000,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{1, 2, 3, 4},
+			},
+			lns: &SessionConfig{
+				SessionID:     0x2000,
+				PeerSessionID: 0x1000,
+				Pseudowire:    PseudowireTypeEth,
+				PeerCookie:    []byte{4, 3, 2, 1},
+			},
+			frame:      bytes.Repeat([]byte{0xaa}, 64),
+			cookieDrop: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ports := make(map[ControlConnID]*chanPort)
+			openPort := func(tid ControlConnID, cfg *SessionConfig) (port io.ReadWriteCloser, ifName string, err error) {
+				ports[cfg.SessionID] = newChanPort()
+				return ports[cfg.SessionID], "", nil
+			}
+
+			dp, err := NewUserspaceDataPlane(openPort)
+			if err != nil {
+				t.Fatalf("NewUserspaceDataPlane(): %v", err)
+			}
+			defer dp.Close()
+
+			lacAddr := &unix.SockaddrInet4{Port: 9073, Addr: [4]byte{127, 0, 0, 1}}
+			lnsAddr := &unix.SockaddrInet4{Port: 9074, Addr: [4]byte{127, 0, 0, 1}}
+			endpoints := []struct {
+				tcfg     *TunnelConfig
+				sal, sap unix.Sockaddr
+				scfg     *SessionConfig
+			}{
+				{&TunnelConfig{Version: c.version, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2}, lacAddr, lnsAddr, c.lac},
+				{&TunnelConfig{Version: c.version, Encap: EncapTypeUDP, TunnelID: 2, PeerTunnelID: 1}, lnsAddr, lacAddr, c.lns},
+			}
+			var tunnels []TunnelDataPlane
+			var sessions []SessionDataPlane
+			defer func() {
+				for _, sdp := range sessions {
+					sdp.Down()
+				}
+			}()
+			for _, ep := range endpoints {
+				tdp, err := dp.NewTunnel(ep.tcfg, ep.sal, ep.sap, -1)
+				if err != nil {
+					t.Fatalf("NewTunnel(): %v", err)
+				}
+				defer tdp.Down()
+				tunnels = append(tunnels, tdp)
+				sdp, err := dp.NewSession(ep.tcfg.TunnelID, ep.tcfg.PeerTunnelID, ep.scfg)
+				if err != nil {
+					t.Fatalf("NewSession(): %v", err)
+				}
+				sessions = append(sessions, sdp)
+			}
+
+			for i := 0; i < 3; i++ {
+				ports[c.lac.SessionID].tx <- c.frame
+				select {
+				case got := <-ports[c.lns.SessionID].rx:
+					if c.cookieDrop {
+						t.Fatalf("frame received with wrong cookie")
+					}
+					if !bytes.Equal(got, c.frame) {
+						t.Fatalf("received frame %x, want %x", got, c.frame)
+					}
+				case <-time.After(250 * time.Millisecond):
+					if !c.cookieDrop {
+						t.Fatalf("timed out waiting for frame")
+					}
+				}
+			}
+
+			stats, err := sessions[1].GetStatistics()
+			if err != nil {
+				t.Fatalf("GetStatistics(): %v", err)
+			}
+			if c.cookieDrop {
+				if stats.RxCookieDiscards != 3 {
+					t.Errorf("RxCookieDiscards: got %v, want 3", stats.RxCookieDiscards)
+				}
+			} else if stats.RxPackets != 3 || stats.RxBytes != uint64(3*len(c.frame)) || stats.RxSeqDiscards != 0 {
+				t.Errorf("unexpected statistics %+v", stats)
+			}
+
+			// The tunnel's counters include those of torn down sessions
+			sessions[1].Down()
+			sessions = sessions[:1]
+			tstats, err := tunnels[1].(StatisticsTunnelDataPlane).GetStatistics()
+			if err != nil {
+				t.Fatalf("GetStatistics(): %v", err)
+			}
+			if *tstats != *stats {
+				t.Errorf("tunnel statistics %+v, want %+v", tstats, stats)
+			}
+		})
+	}
+}
+
+func TestFramePort(t *testing.T) {
+	dp, err := NewUserspaceDataPlane(OpenFramePort)
+	if err != nil {
+		t.Fatalf("NewUserspaceDataPlane(): %v", err)
+	}
+	defer dp.Close()
+
+	lacAddr := &unix.SockaddrInet4{Port: 9075, Addr: [4]byte{127, 0, 0, 1}}
+	lnsAddr := &unix.SockaddrInet4{Port: 9076, Addr: [4]byte{127, 0, 0, 1}}
+	endpoints := []struct {
+		tcfg     *TunnelConfig
+		sal, sap unix.Sockaddr
+		scfg     *SessionConfig
+	}{
+		{&TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 1, PeerTunnelID: 2}, lacAddr, lnsAddr,
+			&SessionConfig{SessionID: 10, PeerSessionID: 20, Pseudowire: PseudowireTypeEth}},
+		{&TunnelConfig{Version: ProtocolVersion3, Encap: EncapTypeUDP, TunnelID: 2, PeerTunnelID: 1}, lnsAddr, lacAddr,
+			&SessionConfig{SessionID: 20, PeerSessionID: 10, Pseudowire: PseudowireTypeEth}},
+	}
+	var sessions []FrameSessionDataPlane
+	for _, ep := range endpoints {
+		tdp, err := dp.NewTunnel(ep.tcfg, ep.sal, ep.sap, -1)
+		if err != nil {
+			t.Fatalf("NewTunnel(): %v", err)
+		}
+		defer tdp.Down()
+		sdp, err := dp.NewSession(ep.tcfg.TunnelID, ep.tcfg.PeerTunnelID, ep.scfg)
+		if err != nil {
+			t.Fatalf("NewSession(): %v", err)
+		}
+		if ifName, _ := sdp.GetInterfaceName(); ifName != "" {
+			t.Errorf("GetInterfaceName(): got %q, want no interface", ifName)
+		}
+		sessions = append(sessions, sdp.(FrameSessionDataPlane))
+	}
+
+	// Sessions access their data plane's frames
+	bs := &baseSession{}
+	if _, err := bs.WriteFrame([]byte{0}); err != ErrNoFrameAccess {
+		t.Errorf("WriteFrame() without data plane: got %v, want %v", err, ErrNoFrameAccess)
+	}
+	bs.setDataPlane(sessions[0])
+
+	frame := bytes.Repeat([]byte{0x55}, 64)
+	b := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		if _, err := bs.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame(): %v", err)
+		}
+		n, err := sessions[1].ReadFrame(b)
+		if err != nil {
+			t.Fatalf("ReadFrame(): %v", err)
+		}
+		if !bytes.Equal(b[:n], frame) {
+			t.Fatalf("received frame %x, want %x", b[:n], frame)
+		}
+	}
+
+	if _, err := sessions[1].WriteFrame(frame); err != nil {
+		t.Fatalf("WriteFrame(): %v", err)
+	}
+	if n, err := bs.ReadFrame(b[:16]); err != io.ErrShortBuffer || n != 16 {
+		t.Errorf("ReadFrame() into short buffer: got %v, %v", n, err)
+	}
+
+	// Blocked readers are released when the session goes down
+	errC := make(chan error)
+	go func() {
+		_, err := sessions[1].ReadFrame(b)
+		errC <- err
+	}()
+	sessions[1].Down()
+	select {
+	case err := <-errC:
+		if err != io.EOF {
+			t.Errorf("ReadFrame() after Down(): got %v, want %v", err, io.EOF)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ReadFrame() not released by Down()")
+	}
+	sessions[0].Down()
+
+	// Other ports don't give access to the session's frames
+	sdp := &userspaceSessionDataPlane{port: newChanPort()}
+	if _, err := sdp.ReadFrame(b); err != ErrNoFrameAccess {
+		t.Errorf("ReadFrame() with channel port: got %v, want %v", err, ErrNoFrameAccess)
+	}
+}
+
+func TestOpenTAPPort(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	cfg := &SessionConfig{
+		Pseudowire:    PseudowireTypeEth,
+		InterfaceName: "l2tptap0",
+		HardwareAddr:  net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x20, 0x30},
+		MTU:           1400,
+	}
+	port, ifName, err := OpenTAPPort(1, cfg)
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+	defer port.Close()
+
+	if ifName != cfg.InterfaceName {
+		t.Errorf("OpenTAPPort(): got interface %q, want %q", ifName, cfg.InterfaceName)
+	}
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		t.Fatalf("InterfaceByName(%q): %v", ifName, err)
+	}
+	if !bytes.Equal(ifi.HardwareAddr, cfg.HardwareAddr) {
+		t.Errorf("hardware address: got %v, want %v", ifi.HardwareAddr, cfg.HardwareAddr)
+	}
+	if ifi.MTU != int(cfg.MTU) {
+		t.Errorf("MTU: got %v, want %v", ifi.MTU, cfg.MTU)
+	}
+	// The kernel expands interface name templates
+	port2, ifName, err := OpenTAPPort(1, &SessionConfig{
+		Pseudowire:    PseudowireTypeEth,
+		InterfaceName: "l2tptap%d",
+	})
+	if err != nil {
+		t.Fatalf("OpenTAPPort(): %v", err)
+	}
+	defer port2.Close()
+	if ifName != "l2tptap1" {
+		t.Errorf("OpenTAPPort(): got interface %q, want %q", ifName, "l2tptap1")
+	}
+}
+
+func TestOpenTUNPort(t *testing.T) {
+	if _, _, err := OpenTUNPort(1, &SessionConfig{Pseudowire: PseudowireTypeEth}); err == nil {
+		t.Errorf("OpenTUNPort() succeeded for an Ethernet pseudowire, expected failure")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("skipping test because TUN/TAP is unavailable: %v", err)
+	}
+
+	cfg := &SessionConfig{
+		Pseudowire:    PseudowireTypeIP,
+		InterfaceName: "l2tptun0",
+		MTU:           1400,
+	}
+	port, ifName, err := OpenTUNPort(1, cfg)
+	if err != nil {
+		t.Fatalf("OpenTUNPort(): %v", err)
+	}
+	defer port.Close()
+
+	if ifName != cfg.InterfaceName {
+		t.Errorf("OpenTUNPort(): got interface %q, want %q", ifName, cfg.InterfaceName)
+	}
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		t.Fatalf("InterfaceByName(%q): %v", ifName, err)
+	}
+	if ifi.MTU != int(cfg.MTU) {
+		t.Errorf("MTU: got %v, want %v", ifi.MTU, cfg.MTU)
+	}
+	if len(ifi.HardwareAddr) != 0 {
+		t.Errorf("TUN interface has hardware address %v", ifi.HardwareAddr)
+	}
+}
+
+func TestInnerDSCP(t *testing.T) {
+	// IPv4 with DSCP 46 (EF), and IPv6 with DSCP 26 (AF31)
+	ipv4 := []byte{0x45, 0xb8, 0x00, 0x14}
+	ipv6 := []byte{0x66, 0x80, 0x00, 0x00}
+	eth := func(etype ...byte) []byte {
+		return append(bytes.Repeat([]byte{0x02}, 12), etype...)
+	}
+	cases := []struct {
+		name  string
+		pw    PseudowireType
+		frame []byte
+		dscp  uint8
+		ok    bool
+	}{
+		{"IP IPv4", PseudowireTypeIP, ipv4, 46, true},
+		{"IP IPv6", PseudowireTypeIP, ipv6, 26, true},
+		{"IP bad version", PseudowireTypeIP, []byte{0x10, 0xb8}, 0, false},
+		{"Ethernet IPv4", PseudowireTypeEth, append(eth(0x08, 0x00), ipv4...), 46, true},
+		{"Ethernet IPv6", PseudowireTypeEth, append(eth(0x86, 0xdd), ipv6...), 26, true},
+		{"Ethernet 802.1Q", PseudowireTypeEthVLAN, append(eth(0x81, 0x00, 0x00, 0x64, 0x08, 0x00), ipv4...), 46, true},
+		{"Ethernet QinQ", PseudowireTypeEthVLAN, append(eth(0x88, 0xa8, 0x00, 0x64, 0x81, 0x00, 0x00, 0xc8, 0x86, 0xdd), ipv6...), 26, true},
+		{"Ethernet ARP", PseudowireTypeEth, append(eth(0x08, 0x06), ipv4...), 0, false},
+		{"Ethernet short", PseudowireTypeEth, eth(0x08), 0, false},
+		{"PPP IPv4", PseudowireTypePPP, append([]byte{0xff, 0x03, 0x00, 0x21}, ipv4...), 46, true},
+		{"PPP compressed IPv6", PseudowireTypePPP, append([]byte{0x57}, ipv6...), 26, true},
+		{"PPP LCP", PseudowireTypePPP, []byte{0xff, 0x03, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04}, 0, false},
+	}
+	for _, c := range cases {
+		dscp, ok := innerDSCP(c.pw, c.frame)
+		if dscp != c.dscp || ok != c.ok {
+			t.Errorf("%s: innerDSCP(): got %v, %v, want %v, %v", c.name, dscp, ok, c.dscp, c.ok)
+		}
+	}
+}
+
+func TestUserspaceInheritDataDSCP(t *testing.T) {
+	port := newChanPort()
+	dp, err := NewUserspaceDataPlane(func(tid ControlConnID, cfg *SessionConfig) (io.ReadWriteCloser, string, error) {
+		return port, "", nil
+	})
+	if err != nil {
+		t.Fatalf("NewUserspaceDataPlane(): %v", err)
+	}
+	defer dp.Close()
+
+	// The peer reports the TOS of each data packet it receives
+	peerAddr := &unix.SockaddrInet4{Port: 9103, Addr: [4]byte{127, 0, 0, 1}}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socket(): %v", err)
+	}
+	defer unix.Close(fd)
+	if err = unix.Bind(fd, peerAddr); err != nil {
+		t.Fatalf("bind(): %v", err)
+	}
+	if err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1); err != nil {
+		t.Fatalf("setsockopt(IP_RECVTOS): %v", err)
+	}
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		t.Fatalf("setsockopt(SO_RCVTIMEO): %v", err)
+	}
+
+	tcfg := &TunnelConfig{
+		Version:         ProtocolVersion3,
+		Encap:           EncapTypeUDP,
+		TunnelID:        1,
+		PeerTunnelID:    2,
+		DataDSCP:        8,
+		InheritDataDSCP: true,
+		DataDSCPMap:     map[uint8]uint8{46: 34},
+	}
+	tdp, err := dp.NewTunnel(tcfg, &unix.SockaddrInet4{Port: 9102, Addr: [4]byte{127, 0, 0, 1}}, peerAddr, -1)
+	if err != nil {
+		t.Fatalf("NewTunnel(): %v", err)
+	}
+	defer tdp.Down()
+	sdp, err := dp.NewSession(1, 2, &SessionConfig{SessionID: 10, PeerSessionID: 20, Pseudowire: PseudowireTypeEthVLAN})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	defer sdp.Down()
+
+	eth := bytes.Repeat([]byte{0x02}, 12)
+	cases := []struct {
+		name  string
+		frame []byte
+		tos   byte
+	}{
+		{"Mapped DSCP", append(append(eth, 0x08, 0x00), 0x45, 0xb8, 0x00, 0x14), 34 << 2},
+		{"Inherited DSCP", append(append(eth, 0x81, 0x00, 0x00, 0x64, 0x86, 0xdd), 0x66, 0x80, 0x00, 0x00), 26 << 2},
+		{"Not IP", append(append(eth, 0x08, 0x06), 0x00, 0x01, 0x08, 0x00), 8 << 2},
+	}
+	b := make([]byte, 1500)
+	oob := make([]byte, unix.CmsgSpace(4))
+	for _, c := range cases {
+		port.tx <- c.frame
+		_, oobn, _, _, err := unix.Recvmsg(fd, b, oob, 0)
+		if err != nil {
+			t.Fatalf("%s: recvmsg(): %v", c.name, err)
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 || msgs[0].Header.Type != unix.IP_TOS {
+			t.Fatalf("%s: got control messages %v, %v, want IP_TOS", c.name, msgs, err)
+		}
+		if tos := msgs[0].Data[0]; tos != c.tos {
+			t.Errorf("%s: got TOS %#x, want %#x", c.name, tos, c.tos)
+		}
+	}
+}
+
+func TestUserspaceCheckSeq(t *testing.T) {
+	sdp := &userspaceSessionDataPlane{}
+	cases := []struct {
+		ns   uint32
+		want bool
+	}{
+		{0xfffe, true},
+		{0xffff, true},
+		// Wrap-around
+		{0, true},
+		// Packets lost
+		{5, true},
+		// Stale
+		{3, false},
+		{5, false},
+		{6, true},
+	}
+	for _, c := range cases {
+		if got := sdp.checkSeq(c.ns, 0xffff); got != c.want {
+			t.Errorf("checkSeq(%v): got %v, want %v", c.ns, got, c.want)
+		}
+	}
+	if sdp.stats.RxSeqDiscards != 2 || sdp.stats.RxOutOfSequence != 1 {
+		t.Errorf("unexpected statistics %+v", sdp.stats)
+	}
+}
+
+func TestUserspaceReorder(t *testing.T) {
+	port := newChanPort()
+	sdp := &userspaceSessionDataPlane{
+		cfg:  &SessionConfig{SeqNum: true, ReorderTimeout: 50 * time.Millisecond},
+		port: port,
+	}
+	expect := func(want ...string) {
+		for _, w := range want {
+			select {
+			case frame := <-port.rx:
+				if string(frame) != w {
+					t.Fatalf("got frame %q, want %q", frame, w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for frame %q", w)
+			}
+		}
+		select {
+		case frame := <-port.rx:
+			t.Fatalf("got unexpected frame %q", frame)
+		default:
+		}
+	}
+
+	// Frames received ahead of sequence are held until the gap is filled
+	for _, ns := range []uint32{0xffffff, 1, 2, 0} {
+		sdp.receiveSeq(ns, l2SpecSeqMask, []byte(fmt.Sprint(ns)))
+	}
+	expect("16777215", "0", "1", "2")
+
+	// Stale and duplicate frames are discarded
+	for _, ns := range []uint32{1, 4, 4} {
+		sdp.receiveSeq(ns, l2SpecSeqMask, []byte(fmt.Sprint(ns)))
+	}
+	expect()
+
+	// Missing frames are skipped once the timeout expires
+	time.Sleep(2 * sdp.cfg.ReorderTimeout)
+	expect("4")
+	sdp.receiveSeq(5, l2SpecSeqMask, []byte("5"))
+	expect("5")
+
+	if sdp.stats.RxOutOfSequence != 3 || sdp.stats.RxSeqDiscards != 2 {
+		t.Errorf("unexpected statistics %+v", sdp.stats)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Package logging defines the structured logging interface used by the packages
+and commands of go-l2tp, along with adapters for logging backends and a filter
+controlling the level of logging of each subsystem.
+
+Logs are written as a list of alternating keys and values, which carry the
+context of each log line: package l2tp adds the tunnel name and ID and the
+peer's address to each line logged for a tunnel, the session name and ID to
+each line logged for a session, and logs control messages along with their
+message type.  The conventional keys are:
+
+	level            the log level, as set by go-kit's level package
+	message          a description of what is being logged
+	function         the subsystem logging, e.g. "transport" or "ppp"
+	tunnel_name      the name of the tunnel
+	tunnel_id        the local tunnel ID
+	session_name     the name of the session
+	session_id       the local session ID
+	listener_name    the name of the listener
+	peer             the address of the peer
+	message_type     the type of a control message
+
+The Logger interface is that of the go-kit logger, so that go-kit loggers,
+including those with context added using go-kit's log.With, may be used
+wherever a Logger is expected and vice versa.  NewSlogLogger adapts a log/slog
+logger instead, for applications using the standard library's structured
+logging.
+
+Logs are filtered by level using NewFilter, which may set the level of each
+subsystem separately:
+
+	levels, _ := logging.ParseLevels("info,transport=debug,ppp=warn")
+	logger := logging.NewFilter(logging.NewLogfmtLogger(os.Stderr), levels)
+	ctx, _ := l2tp.NewContext(l2tp.LinuxNetlinkDataPlane, logger)
+
+The subsystem of a log line is named by its function key.  Lines without one
+are attributed to the "session", "tunnel" or "listener" subsystem if they have
+a session_name, tunnel_name or listener_name key respectively.
+*/
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Logger is the interface implemented by structured loggers.  Log logs
+// a list of alternating keys and values.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// Level is the level of a log line.
+type Level int
+
+const (
+	// LevelDebug is the level of verbose logging, useful for debugging.
+	LevelDebug Level = iota
+	// LevelInfo is the level of normal informational logging.
+	LevelInfo
+	// LevelWarn is the level of logging warning of possible problems.
+	LevelWarn
+	// LevelError is the level of logging reporting errors.
+	LevelError
+	// LevelNone disables logging when used as a filter level.
+	LevelNone
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "none"}
+
+// String represents the level as a string.
+func (l Level) String() string {
+	if l >= LevelDebug && l <= LevelNone {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel parses a level name: "debug", "info", "warn", "error"
+// or "none".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognised log level %q", s)
+}
+
+// Levels sets the level of logging of each subsystem.
+type Levels struct {
+	// Default is the level of subsystems not listed in Subsystems.
+	Default Level
+	// Subsystems maps subsystem names to their level.
+	Subsystems map[string]Level
+}
+
+// ParseLevels parses a comma-separated list of levels.  Each entry is either
+// a level, setting the default level, or a subsystem name and level joined by
+// '=', e.g. "info,transport=debug".  The default level is LevelInfo unless set.
+func ParseLevels(s string) (Levels, error) {
+	levels := Levels{Default: LevelInfo}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		l, err := ParseLevel(strings.TrimSpace(parts[len(parts)-1]))
+		if err != nil {
+			return Levels{}, err
+		}
+		if len(parts) == 1 {
+			levels.Default = l
+			continue
+		}
+		subsystem := strings.TrimSpace(parts[0])
+		if subsystem == "" {
+			return Levels{}, fmt.Errorf("missing subsystem name in %q", entry)
+		}
+		if levels.Subsystems == nil {
+			levels.Subsystems = make(map[string]Level)
+		}
+		levels.Subsystems[subsystem] = l
+	}
+	return levels, nil
+}
+
+// String represents the levels in the form parsed by ParseLevels.
+func (levels Levels) String() string {
+	out := []string{levels.Default.String()}
+	var subsystems []string
+	for s := range levels.Subsystems {
+		subsystems = append(subsystems, s)
+	}
+	sort.Strings(subsystems)
+	for _, s := range subsystems {
+		out = append(out, s+"="+levels.Subsystems[s].String())
+	}
+	return strings.Join(out, ",")
+}
+
+// Enabled returns true if logging at the level is enabled for the subsystem.
+func (levels Levels) Enabled(subsystem string, l Level) bool {
+	threshold, ok := levels.Subsystems[subsystem]
+	if !ok {
+		threshold = levels.Default
+	}
+	return l >= threshold && l < LevelNone
+}
+
+type filter struct {
+	next   Logger
+	levels Levels
+}
+
+// NewFilter returns a Logger passing the log lines enabled by levels to
+// next, and discarding the rest.  Lines without a level are treated as
+// being logged at LevelInfo.
+func NewFilter(next Logger, levels Levels) Logger {
+	return &filter{next: next, levels: levels}
+}
+
+func (f *filter) Log(keyvals ...interface{}) error {
+	l, _ := levelOf(keyvals)
+	if !f.levels.Enabled(Subsystem(keyvals), l) {
+		return nil
+	}
+	return f.next.Log(keyvals...)
+}
+
+// levelOf returns the level of a log line, which is LevelInfo if it has
+// none.
+func levelOf(keyvals []interface{}) (Level, bool) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != level.Key() {
+			continue
+		}
+		switch fmt.Sprint(keyvals[i+1]) {
+		case "debug":
+			return LevelDebug, true
+		case "warn":
+			return LevelWarn, true
+		case "error":
+			return LevelError, true
+		}
+		return LevelInfo, true
+	}
+	return LevelInfo, false
+}
+
+// Subsystem returns the subsystem a log line is attributed to, or the empty
+// string if it can't be attributed to one.
+func Subsystem(keyvals []interface{}) string {
+	var subsystem string
+	var rank int
+	// Later values of a key take precedence, as they're added by more
+	// specific context
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, _ := keyvals[i].(string)
+		switch key {
+		case "function":
+			subsystem, rank = fmt.Sprint(keyvals[i+1]), 4
+		case "session_name":
+			if rank <= 3 {
+				subsystem, rank = "session", 3
+			}
+		case "tunnel_name":
+			if rank <= 2 {
+				subsystem, rank = "tunnel", 2
+			}
+		case "listener_name":
+			if rank <= 1 {
+				subsystem, rank = "listener", 1
+			}
+		}
+	}
+	return subsystem
+}
+
+// NewGoKitLogger returns a Logger writing to a go-kit logger.  Since the
+// interfaces are the same, the go-kit logger is used as is.
+func NewGoKitLogger(logger log.Logger) Logger {
+	return logger
+}
+
+// NewLogfmtLogger returns a Logger writing logfmt encoded lines to w, which
+// may be used by several goroutines at once.
+func NewLogfmtLogger(w io.Writer) Logger {
+	return log.NewLogfmtLogger(log.NewSyncWriter(w))
+}
+
+// NewJSONLogger returns a Logger writing JSON encoded lines to w, which may
+// be used by several goroutines at once.
+func NewJSONLogger(w io.Writer) Logger {
+	return log.NewJSONLogger(log.NewSyncWriter(w))
+}
+
+// With returns a Logger adding keyvals to the context of each line logged.
+func With(logger Logger, keyvals ...interface{}) Logger {
+	return log.With(logger, keyvals...)
+}
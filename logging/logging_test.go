@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestParseLevels(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Levels
+	}{
+		{
+			in:   "",
+			want: Levels{Default: LevelInfo},
+		},
+		{
+			in:   "debug",
+			want: Levels{Default: LevelDebug},
+		},
+		{
+			in: "warn, transport=debug,ppp = none",
+			want: Levels{
+				Default:    LevelWarn,
+				Subsystems: map[string]Level{"transport": LevelDebug, "ppp": LevelNone},
+			},
+		},
+	}
+	for _, c := range cases {
+		got, err := ParseLevels(c.in)
+		if err != nil {
+			t.Fatalf("ParseLevels(%q): %v", c.in, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseLevels(%q): got %+v, want %+v", c.in, got, c.want)
+		}
+		again, err := ParseLevels(got.String())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseLevels(%q): got %+v, %v, want %+v", got.String(), again, err, got)
+		}
+	}
+
+	for _, in := range []string{"verbose", "transport=", "=debug", "transport=loud"} {
+		if _, err := ParseLevels(in); err == nil {
+			t.Errorf("ParseLevels(%q) succeeded when we expected an error", in)
+		}
+	}
+}
+
+func TestSubsystem(t *testing.T) {
+	cases := []struct {
+		keyvals []interface{}
+		want    string
+	}{
+		{[]interface{}{"message", "hello"}, ""},
+		{[]interface{}{"listener_name", "l1"}, "listener"},
+		{[]interface{}{"tunnel_name", "t1", "tunnel_id", 1}, "tunnel"},
+		{[]interface{}{"tunnel_name", "t1", "session_name", "s1"}, "session"},
+		{[]interface{}{"session_name", "s1", "tunnel_name", "t1"}, "session"},
+		{[]interface{}{"tunnel_name", "t1", "function", "transport"}, "transport"},
+		{[]interface{}{"function", "mux", "function", "transport"}, "transport"},
+	}
+	for _, c := range cases {
+		if got := Subsystem(c.keyvals); got != c.want {
+			t.Errorf("Subsystem(%v): got %q, want %q", c.keyvals, got, c.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var b bytes.Buffer
+	levels, err := ParseLevels("info,transport=debug,session=error")
+	if err != nil {
+		t.Fatalf("ParseLevels(): %v", err)
+	}
+	logger := NewFilter(NewLogfmtLogger(&b), levels)
+	tunnel := log.With(logger, "tunnel_name", "t1")
+	transport := log.With(tunnel, "function", "transport")
+	session := log.With(tunnel, "session_name", "s1")
+
+	level.Debug(tunnel).Log("message", "tunnel debug")
+	level.Info(tunnel).Log("message", "tunnel info")
+	level.Debug(transport).Log("message", "transport debug")
+	level.Warn(session).Log("message", "session warn")
+	level.Error(session).Log("message", "session error")
+	logger.Log("message", "no level")
+
+	got := b.String()
+	for _, want := range []string{"tunnel info", "transport debug", "session error", "no level"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("filter dropped %q:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"tunnel debug", "session warn"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("filter passed %q:\n%s", unwanted, got)
+		}
+	}
+}
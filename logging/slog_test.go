@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+	handler := slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := log.With(NewSlogLogger(slog.New(handler)), "tunnel_name", "t1", "tunnel_id", 42)
+
+	level.Warn(logger).Log("message", "retransmitting", "message_type", "SCCRQ")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", b.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":        "WARN",
+		"msg":          "retransmitting",
+		"tunnel_name":  "t1",
+		"tunnel_id":    float64(42),
+		"message_type": "SCCRQ",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("slog record %v: got %v, want %v", k, got[k], v)
+		}
+	}
+
+	b.Reset()
+	level.Debug(NewFilter(NewSlogLogger(slog.New(handler)), Levels{Default: LevelInfo})).Log("message", "dropped")
+	if b.Len() != 0 {
+		t.Errorf("filtered slog logger logged %s", b.String())
+	}
+}
@@ -0,0 +1,155 @@
+package ppp
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Async framing special characters.
+// Ref: RFC1662 section 4.2.
+const (
+	asyncFlag   = 0x7e
+	asyncEscape = 0x7d
+	asyncXor    = 0x20
+)
+
+// The initial value of the FCS, and its value once computed over a frame
+// including a good FCS.
+// Ref: RFC1662 appendix C.2.
+const (
+	fcsInit = 0xffff
+	fcsGood = 0xf0b8
+)
+
+var fcsTable [256]uint16
+
+func init() {
+	for b := range fcsTable {
+		v := uint16(b)
+		for i := 0; i < 8; i++ {
+			if v&1 != 0 {
+				v = v>>1 ^ 0x8408
+			} else {
+				v >>= 1
+			}
+		}
+		fcsTable[b] = v
+	}
+}
+
+func fcs16(fcs uint16, b []byte) uint16 {
+	for _, c := range b {
+		fcs = fcs>>8 ^ fcsTable[(fcs^uint16(c))&0xff]
+	}
+	return fcs
+}
+
+// The largest frame AsyncConn will receive, allowing for the largest MRU
+// which may be negotiated and the FCS
+const maxAsyncFrameLen = 65535 + 4
+
+// AsyncConn exchanges PPP frames over a byte stream, such as a serial line
+// or the master side of a pty, using the asynchronous HDLC-like framing
+// described by RFC1662 section 4.  AsyncConn implements FrameReadWriter,
+// and the frames it reads and writes include the address and control
+// fields if they are present, but not the FCS.
+//
+// This allows the frames of an L2TP session using the userspace data plane
+// to be handed to pppd(8) over a pty, on systems lacking the pppol2tp
+// kernel module.
+type AsyncConn struct {
+	rw    io.ReadWriter
+	accm  uint32
+	r     *bufio.Reader
+	wlock sync.Mutex
+}
+
+// NewAsyncConn returns an AsyncConn carrying frames over rw.
+//
+// Control characters are escaped in the frames written if their bits are
+// set in the Async-Control-Character-Map accm.  The default map of
+// 0xffffffff, escaping all control characters, is always safe, while a
+// smaller map may be used once it has been negotiated by the PPP
+// implementations at either end of rw.  Received frames are unescaped
+// regardless of the map, and unescaped control characters are accepted.
+func NewAsyncConn(rw io.ReadWriter, accm uint32) *AsyncConn {
+	return &AsyncConn{
+		rw:   rw,
+		accm: accm,
+		r:    bufio.NewReader(rw),
+	}
+}
+
+// ReadFrame reads the next frame received into b, blocking until one is
+// available.  Frames with a bad FCS are discarded.  It returns
+// io.ErrShortBuffer if the frame was truncated, and the error returned by
+// the underlying reader, such as io.EOF, once it fails.
+//
+// ReadFrame is not safe to call concurrently with itself.
+func (c *AsyncConn) ReadFrame(b []byte) (int, error) {
+	var frame []byte
+	escaped := false
+	for {
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case ch == asyncFlag:
+			if !escaped && len(frame) >= 4 && fcs16(fcsInit, frame) == fcsGood {
+				frame = frame[:len(frame)-2]
+				n := copy(b, frame)
+				if n < len(frame) {
+					return n, io.ErrShortBuffer
+				}
+				return n, nil
+			}
+			// Discard the frame, which is empty, aborted by an
+			// escaped flag or has a bad FCS
+			frame = frame[:0]
+			escaped = false
+		case ch == asyncEscape:
+			escaped = true
+		case len(frame) >= maxAsyncFrameLen:
+			// Discard the remainder of an overlong frame
+		case escaped:
+			frame = append(frame, ch^asyncXor)
+			escaped = false
+		default:
+			frame = append(frame, ch)
+		}
+	}
+}
+
+// WriteFrame writes a frame, computing its FCS.  WriteFrame is safe to call
+// concurrently with ReadFrame and with itself.
+func (c *AsyncConn) WriteFrame(b []byte) (int, error) {
+	fcs := ^fcs16(fcsInit, b)
+
+	out := make([]byte, 0, 2*len(b)+6)
+	out = append(out, asyncFlag)
+	out = c.appendEscaped(out, b)
+	out = c.appendEscaped(out, []byte{uint8(fcs), uint8(fcs >> 8)})
+	out = append(out, asyncFlag)
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if _, err := c.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// appendEscaped appends b to out, escaping the characters which may not
+// appear in a frame.
+func (c *AsyncConn) appendEscaped(out, b []byte) []byte {
+	for _, ch := range b {
+		if ch == asyncFlag || ch == asyncEscape || (ch < 0x20 && c.accm&(1<<ch) != 0) {
+			out = append(out, asyncEscape, ch^asyncXor)
+		} else {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package ppp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestAsyncConn(t *testing.T) {
+	cases := []struct {
+		name  string
+		frame []byte
+		accm  uint32
+		want  []byte
+	}{
+		{
+			name:  "LCP Configure-Request",
+			frame: []byte{0xff, 0x03, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04},
+			accm:  0xffffffff,
+			// The FCS of the frame is 0xb5d1, sent LSB first
+			want: []byte{0x7e, 0xff, 0x7d, 0x23, 0xc0, 0x21, 0x7d, 0x21, 0x7d, 0x21, 0x7d, 0x20, 0x7d, 0x24, 0xd1, 0xb5, 0x7e},
+		},
+		{
+			name:  "Zero ACCM",
+			frame: []byte{0xff, 0x03, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04},
+			want:  []byte{0x7e, 0xff, 0x03, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04, 0xd1, 0xb5, 0x7e},
+		},
+		{
+			name:  "Flag and escape characters",
+			frame: []byte{0x00, 0x21, 0x7e, 0x7d, 0x20},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ac := NewAsyncConn(&buf, c.accm)
+			if n, err := ac.WriteFrame(c.frame); err != nil || n != len(c.frame) {
+				t.Fatalf("WriteFrame(): got %v, %v", n, err)
+			}
+			if c.want != nil && !bytes.Equal(buf.Bytes(), c.want) {
+				t.Errorf("WriteFrame(): wrote %x, want %x", buf.Bytes(), c.want)
+			}
+			if bytes.Count(buf.Bytes(), []byte{asyncFlag}) != 2 {
+				t.Errorf("WriteFrame(): wrote %x, with flags within the frame", buf.Bytes())
+			}
+
+			b := make([]byte, 1500)
+			n, err := ac.ReadFrame(b)
+			if err != nil || !bytes.Equal(b[:n], c.frame) {
+				t.Errorf("ReadFrame(): got %x, %v, want %x", b[:n], err, c.frame)
+			}
+			if _, err = ac.ReadFrame(b); err != io.EOF {
+				t.Errorf("ReadFrame(): got %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestAsyncConnDiscard(t *testing.T) {
+	var good bytes.Buffer
+	NewAsyncConn(&good, 0xffffffff).WriteFrame([]byte{0xff, 0x03, 0x00, 0x21, 0x45})
+
+	var buf bytes.Buffer
+	// A frame with a bad FCS
+	buf.Write([]byte{0x7e, 0xff, 0x03, 0x00, 0x21, 0x45, 0x00, 0x00, 0x7e})
+	// An aborted frame
+	buf.Write([]byte{0xff, 0x03, 0x7d, 0x7e})
+	// Empty frames between flags
+	buf.Write([]byte{0x7e, 0x7e})
+	buf.Write(good.Bytes())
+
+	ac := NewAsyncConn(&buf, 0)
+	b := make([]byte, 1500)
+	n, err := ac.ReadFrame(b)
+	if want := []byte{0xff, 0x03, 0x00, 0x21, 0x45}; err != nil || !bytes.Equal(b[:n], want) {
+		t.Errorf("ReadFrame(): got %x, %v, want %x", b[:n], err, want)
+	}
+
+	NewAsyncConn(&buf, 0).WriteFrame(bytes.Repeat([]byte{0x45}, 16))
+	if _, err = ac.ReadFrame(b[:8]); err != io.ErrShortBuffer {
+		t.Errorf("ReadFrame(): got %v, want %v", err, io.ErrShortBuffer)
+	}
+}
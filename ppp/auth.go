@@ -0,0 +1,67 @@
+package ppp
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+)
+
+// PAP packet codes.
+// Ref: RFC1334 section 2.2.
+const (
+	papAuthenticateRequest = 1
+	papAuthenticateAck     = 2
+	papAuthenticateNak     = 3
+)
+
+// CHAP packet codes, and the algorithm identifying CHAP with MD5.
+// Ref: RFC1994 section 4.
+const (
+	chapChallenge = 1
+	chapResponse  = 2
+	chapSuccess   = 3
+	chapFailure   = 4
+	chapMD5       = 5
+)
+
+// papRequest builds the data of a PAP Authenticate-Request.
+func papRequest(username, password string) []byte {
+	b := append([]byte{uint8(len(username))}, username...)
+	b = append(b, uint8(len(password)))
+	return append(b, password...)
+}
+
+// papMessage returns the message of a PAP Authenticate-Ack or
+// Authenticate-Nak.
+func papMessage(data []byte) string {
+	if len(data) < 1 || int(data[0]) > len(data)-1 {
+		return ""
+	}
+	return string(data[1 : 1+data[0]])
+}
+
+// chapResponseData builds the data of a CHAP Response to a Challenge with
+// the given identifier and data.
+func chapResponseData(id uint8, challenge []byte, username, secret string) ([]byte, error) {
+	if len(challenge) < 1 || int(challenge[0]) > len(challenge)-1 || challenge[0] == 0 {
+		return nil, errors.New("malformed CHAP challenge")
+	}
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge[1 : 1+challenge[0]])
+	b := append([]byte{md5.Size}, h.Sum(nil)...)
+	return append(b, username...), nil
+}
+
+// authError describes the rejection of our credentials by the peer.
+func authError(proto uint16, message string) error {
+	name := "PAP"
+	if proto == protoCHAP {
+		name = "CHAP"
+	}
+	if message == "" {
+		return fmt.Errorf("%s authentication failed", name)
+	}
+	return fmt.Errorf("%s authentication failed: %s", name, message)
+}
@@ -0,0 +1,154 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PPP protocol numbers.
+// Ref: RFC1661 section 2, RFC1332 section 2, RFC1334 section 3.
+const (
+	protoIPv4 = 0x0021
+	protoIPCP = 0x8021
+	protoLCP  = 0xc021
+	protoPAP  = 0xc023
+	protoCHAP = 0xc223
+)
+
+// LCP and IPCP packet codes.
+// Ref: RFC1661 section 5.
+const (
+	codeConfigureRequest = 1
+	codeConfigureAck     = 2
+	codeConfigureNak     = 3
+	codeConfigureReject  = 4
+	codeTerminateRequest = 5
+	codeTerminateAck     = 6
+	codeCodeReject       = 7
+	codeProtocolReject   = 8
+	codeEchoRequest      = 9
+	codeEchoReply        = 10
+	codeDiscardRequest   = 11
+)
+
+// LCP configuration options.
+// Ref: RFC1661 section 6.
+const (
+	lcpOptMRU   = 1
+	lcpOptACCM  = 2
+	lcpOptAuth  = 3
+	lcpOptMagic = 5
+	lcpOptPFC   = 7
+	lcpOptACFC  = 8
+)
+
+// IPCP configuration options.
+// Ref: RFC1332 section 3, RFC1877 section 1.
+const (
+	ipcpOptAddress      = 3
+	ipcpOptPrimaryDNS   = 129
+	ipcpOptSecondaryDNS = 131
+)
+
+// The HDLC address and control fields which may prefix a frame.
+// Ref: RFC1662 section 3.1.
+var hdlcHeader = []byte{0xff, 0x03}
+
+// The MRU assumed until a different one is negotiated.
+// Ref: RFC1661 section 6.1.
+const defaultMRU = 1500
+
+// encodeFrame returns a frame carrying a packet of the given protocol,
+// including the address and control fields.
+func encodeFrame(proto uint16, payload []byte) []byte {
+	b := make([]byte, 4, 4+len(payload))
+	copy(b, hdlcHeader)
+	binary.BigEndian.PutUint16(b[2:], proto)
+	return append(b, payload...)
+}
+
+// decodeFrame returns the protocol and payload of a received frame.  The
+// address and control fields and the high byte of the protocol field may
+// have been omitted by the peer.
+// Ref: RFC1661 sections 6.5 and 6.6.
+func decodeFrame(b []byte) (proto uint16, payload []byte, err error) {
+	if len(b) >= 2 && b[0] == hdlcHeader[0] && b[1] == hdlcHeader[1] {
+		b = b[2:]
+	}
+	if len(b) < 1 {
+		return 0, nil, errors.New("short frame")
+	}
+	if b[0]&1 != 0 {
+		return uint16(b[0]), b[1:], nil
+	}
+	if len(b) < 2 {
+		return 0, nil, errors.New("short frame")
+	}
+	return binary.BigEndian.Uint16(b), b[2:], nil
+}
+
+// packet is a control protocol packet as used by LCP, IPCP, PAP and CHAP.
+type packet struct {
+	code, id uint8
+	data     []byte
+}
+
+func (p *packet) encode() []byte {
+	b := make([]byte, 4, 4+len(p.data))
+	b[0] = p.code
+	b[1] = p.id
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(p.data)))
+	return append(b, p.data...)
+}
+
+// decodePacket parses a control protocol packet, discarding any padding
+// following it.
+func decodePacket(b []byte) (*packet, error) {
+	if len(b) < 4 {
+		return nil, errors.New("short packet")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < 4 || length > len(b) {
+		return nil, errors.New("bad packet length")
+	}
+	return &packet{code: b[0], id: b[1], data: b[4:length]}, nil
+}
+
+// option is a configuration option of a Configure packet.
+type option struct {
+	typ  uint8
+	data []byte
+}
+
+func encodeOptions(opts []option) []byte {
+	var b []byte
+	for _, o := range opts {
+		b = append(b, o.typ, uint8(2+len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
+
+func decodeOptions(b []byte) ([]option, error) {
+	var opts []option
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return nil, errors.New("malformed configuration option")
+		}
+		opts = append(opts, option{typ: b[0], data: b[2:b[1]]})
+		b = b[b[1]:]
+	}
+	return opts, nil
+}
+
+func uint16Option(typ uint8, v uint16) option {
+	o := option{typ: typ, data: make([]byte, 2)}
+	binary.BigEndian.PutUint16(o.data, v)
+	return o
+}
+
+func uint32Option(typ uint8, v uint32) option {
+	o := option{typ: typ, data: make([]byte, 4)}
+	binary.BigEndian.PutUint32(o.data, v)
+	return o
+}
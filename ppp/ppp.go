@@ -0,0 +1,929 @@
+/*
+Package ppp is a minimal PPP client for running IPv4 over the data channel of
+an L2TP session without pppd(8).
+
+Package ppp negotiates the link with LCP, authenticates to the peer using PAP
+or CHAP with MD5, whichever the peer asks for, and obtains an IPv4 address
+for the link using IPCP, optionally along with the addresses of the peer's DNS
+servers as per RFC1877.  The application then exchanges the IPv4 packets
+carried by the link directly, using the ReadPacket and WritePacket methods of
+the established Link.  There is no network interface, so the application is
+responsible for routing, or for terminating the traffic itself, e.g. in a
+protocol gateway or test harness.
+
+Package ppp supports only what a client of an L2TP network server needs:
+it doesn't authenticate the peer, assign the peer an address, or support
+compression, multilink or IPv6.  Options the peer requests which package ppp
+doesn't support are rejected as described by RFC1661, which most servers
+tolerate.  If the peer renegotiates LCP or IPCP once the link is up, the link
+is brought down.
+
+The session's frames must be accessible to the application, which means the
+session must use the userspace data plane with l2tp.OpenFramePort as its
+session port function.  When the link is opened over an l2tp.Session, the
+negotiated addresses are reported to the session using
+Session.ReportIPCPUp and Session.ReportIPCPDown as the link comes up and goes
+down, so that the application's l2tp.EventHandler instances are passed an
+l2tp.SessionIPCPUpEvent and l2tp.SessionIPCPDownEvent.
+
+Package ppp also provides AsyncConn, which carries PPP frames over a byte
+stream using the asynchronous HDLC-like framing of RFC1662, e.g. to hand the
+frames of a session to pppd(8) over a pty.
+
+Usage
+
+	import (
+		"github.com/katalix/go-l2tp/l2tp"
+		"github.com/katalix/go-l2tp/ppp"
+	)
+
+	# Note we're ignoring errors for brevity.
+
+	dp, _ := l2tp.NewUserspaceDataPlane(l2tp.OpenFramePort)
+	l2tpctx, _ := l2tp.NewContext(dp, logger)
+
+	# Once the session is established...
+
+	link, _ := ppp.Open(sess, &ppp.Config{
+		Username: "alice",
+		Password: "secret",
+	})
+	defer link.Close()
+
+	fmt.Printf("link up: %v -> %v\n", link.LocalAddr(), link.PeerAddr())
+	n, _ := link.ReadPacket(b)
+*/
+package ppp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// FrameReadWriter exchanges PPP frames with the peer.  l2tp.Session
+// implements FrameReadWriter.
+//
+// ReadFrame should block until a frame is received, and return an error
+// once no more frames will be received.  WriteFrame must be safe to call
+// concurrently with ReadFrame and with itself.
+type FrameReadWriter interface {
+	ReadFrame(b []byte) (int, error)
+	WriteFrame(b []byte) (int, error)
+}
+
+// Config describes the PPP link to establish.
+type Config struct {
+	// Username and Password are sent to the peer if it asks us to
+	// authenticate.  Password is the CHAP secret if the peer uses CHAP.
+	Username, Password string
+	// LocalAddr is the IPv4 address to ask the peer to use for our end
+	// of the link.  If unset, the peer is asked to assign an address.
+	LocalAddr net.IP
+	// RequestDNS asks the peer for the addresses of its primary and
+	// secondary DNS servers.  The peer may decline to give either.
+	RequestDNS bool
+	// MRU is the maximum receive unit to negotiate, or zero for the
+	// default of 1500 bytes.
+	MRU uint16
+	// RestartTimeout is the interval between retransmissions of requests
+	// the peer hasn't answered.  The default is 3 seconds.
+	RestartTimeout time.Duration
+	// MaxRequests limits the number of times each request is sent before
+	// giving up on the peer.  The default is 10.
+	MaxRequests int
+	// Logger receives log messages about the link.  If nil, logging is
+	// disabled.
+	Logger log.Logger
+}
+
+// phase is a phase of the link, as per RFC1661 section 3.2.
+type phase int
+
+const (
+	phaseEstablish phase = iota
+	phaseAuthenticate
+	phaseNetwork
+	phaseOpen
+	phaseTerminate
+	phaseDead
+)
+
+// negotiation tracks the exchange of Configure packets of LCP or IPCP.
+type negotiation struct {
+	reqID            uint8
+	ackRcvd, ackSent bool
+}
+
+// Link is an established PPP link.
+type Link struct {
+	rw     FrameReadWriter
+	cfg    Config
+	logger log.Logger
+
+	rxChan    chan []byte
+	pktChan   chan []byte
+	upChan    chan error
+	closeChan chan struct{}
+	closeOnce sync.Once
+	doneChan  chan struct{}
+
+	// The negotiated link parameters, which are set before Open returns
+	localAddr, peerAddr net.IP
+	dns                 []net.IP
+	peerMRU             uint16
+
+	// The remaining fields are only accessed by the link's goroutine
+	phase       phase
+	up          bool
+	nextID      uint8
+	timerC      <-chan time.Time
+	retries     int
+	err         error
+	lcp, ipcp   negotiation
+	mru         uint16
+	magic       uint32
+	sendMRU     bool
+	sendMagic   bool
+	authProto   uint16
+	authID      uint8
+	reqAddr     net.IP
+	sendAddr    bool
+	reqDNS      [2]net.IP
+	sendDNS     [2]bool
+	pendingIPCP *packet
+}
+
+// The number of received IPv4 packets queued for ReadPacket
+const packetQueueLen = 64
+
+// Open establishes a PPP link over rw, blocking until the link is up or
+// fails to come up.  For an L2TP session, Open should be called once the
+// session is established.
+func Open(rw FrameReadWriter, cfg *Config) (*Link, error) {
+	if rw == nil {
+		return nil, errors.New("invalid nil frame read/writer")
+	}
+
+	l := &Link{
+		rw:        rw,
+		rxChan:    make(chan []byte),
+		pktChan:   make(chan []byte, packetQueueLen),
+		upChan:    make(chan error, 1),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+		peerMRU:   defaultMRU,
+		sendMagic: true,
+		sendAddr:  true,
+		reqAddr:   net.IPv4zero.To4(),
+	}
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	if l.cfg.LocalAddr != nil {
+		if l.cfg.LocalAddr.To4() == nil {
+			return nil, fmt.Errorf("local address %v is not an IPv4 address", l.cfg.LocalAddr)
+		}
+		l.reqAddr = l.cfg.LocalAddr.To4()
+	}
+	if l.cfg.RestartTimeout == 0 {
+		l.cfg.RestartTimeout = 3 * time.Second
+	}
+	if l.cfg.MaxRequests == 0 {
+		l.cfg.MaxRequests = 10
+	}
+	l.mru = l.cfg.MRU
+	if l.mru == 0 {
+		l.mru = defaultMRU
+	}
+	l.sendMRU = l.mru != defaultMRU
+	for i := range l.reqDNS {
+		l.reqDNS[i] = net.IPv4zero.To4()
+		l.sendDNS[i] = l.cfg.RequestDNS
+	}
+	l.magic = newMagic()
+
+	l.logger = l.cfg.Logger
+	if l.logger == nil {
+		l.logger = log.NewNopLogger()
+	}
+	l.logger = log.With(l.logger, "function", "ppp")
+
+	upChan := l.upChan
+	go l.reader()
+	go l.run()
+
+	if err := <-upChan; err != nil {
+		<-l.doneChan
+		return nil, err
+	}
+	return l, nil
+}
+
+// LocalAddr returns the IPv4 address of our end of the link.
+func (l *Link) LocalAddr() net.IP {
+	return l.localAddr
+}
+
+// PeerAddr returns the IPv4 address of the peer's end of the link, or nil
+// if the peer didn't specify one.
+func (l *Link) PeerAddr() net.IP {
+	return l.peerAddr
+}
+
+// DNS returns the addresses of the peer's DNS servers, primary first, if
+// they were requested and the peer gave them.
+func (l *Link) DNS() []net.IP {
+	return l.dns
+}
+
+// MTU returns the largest packet which may be sent on the link, which is
+// the MRU of the peer.
+func (l *Link) MTU() int {
+	return int(l.peerMRU)
+}
+
+// ReadPacket reads the next IPv4 packet received from the peer into b,
+// blocking until one is available.  It returns io.ErrShortBuffer if the
+// packet was truncated, and io.EOF once the link is down.
+//
+// Up to 64 received packets are queued: packets received while the queue
+// is full are discarded.
+func (l *Link) ReadPacket(b []byte) (int, error) {
+	select {
+	case pkt := <-l.pktChan:
+		if len(pkt) > len(b) {
+			return copy(b, pkt), io.ErrShortBuffer
+		}
+		return copy(b, pkt), nil
+	case <-l.doneChan:
+		return 0, io.EOF
+	}
+}
+
+// WritePacket sends an IPv4 packet to the peer.  It returns io.EOF once
+// the link is down.
+func (l *Link) WritePacket(b []byte) (int, error) {
+	select {
+	case <-l.doneChan:
+		return 0, io.EOF
+	default:
+	}
+	if len(b) > int(l.peerMRU) {
+		return 0, fmt.Errorf("packet length %v exceeds the peer's MRU of %v", len(b), l.peerMRU)
+	}
+	if _, err := l.rw.WriteFrame(encodeFrame(protoIPv4, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close brings the link down, informing the peer.  The frame read/writer
+// isn't closed: an L2TP session should be closed once its link is down.
+func (l *Link) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+	})
+	<-l.doneChan
+}
+
+// reader passes the frames read from the frame read/writer to the link's
+// goroutine.
+func (l *Link) reader() {
+	defer close(l.rxChan)
+	b := make([]byte, 65536)
+	for {
+		n, err := l.rw.ReadFrame(b)
+		if err == io.ErrShortBuffer {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case l.rxChan <- append([]byte(nil), b[:n]...):
+		case <-l.doneChan:
+			return
+		}
+	}
+}
+
+func (l *Link) run() {
+	defer close(l.doneChan)
+
+	l.retries = l.cfg.MaxRequests
+	l.sendConfigureRequest(protoLCP, &l.lcp, l.lcpRequest())
+
+	closeChan := l.closeChan
+	for l.phase != phaseDead {
+		select {
+		case b, ok := <-l.rxChan:
+			if !ok {
+				l.down(errors.New("data channel closed"))
+				break
+			}
+			l.handleFrame(b)
+		case <-l.timerC:
+			l.timerC = nil
+			l.onTimeout()
+		case <-closeChan:
+			closeChan = nil
+			l.terminate(errors.New("link closed"))
+		}
+	}
+}
+
+// down brings the link down immediately.
+func (l *Link) down(err error) {
+	if l.upChan != nil {
+		l.failed(err)
+	} else if l.up {
+		level.Info(l.logger).Log("message", "link down", "error", err)
+		if s, ok := l.rw.(l2tp.Session); ok {
+			s.ReportIPCPDown(l.ipcpInfo())
+		}
+	}
+	l.timerC = nil
+	l.phase = phaseDead
+}
+
+// failed reports the failure of the link to come up to Open.
+func (l *Link) failed(err error) {
+	level.Error(l.logger).Log("message", "link failed to come up", "error", err)
+	l.upChan <- err
+	l.upChan = nil
+}
+
+// terminate brings the link down gracefully, by sending an LCP
+// Terminate-Request and awaiting the Terminate-Ack.
+// Ref: RFC1661 section 5.5.
+func (l *Link) terminate(err error) {
+	if l.phase == phaseTerminate || l.phase == phaseDead {
+		return
+	}
+	if l.upChan != nil {
+		l.failed(err)
+	}
+	l.phase = phaseTerminate
+	l.err = err
+	l.retries = 2
+	l.sendTerminateRequest()
+}
+
+func (l *Link) sendTerminateRequest() {
+	l.nextID++
+	l.send(protoLCP, &packet{code: codeTerminateRequest, id: l.nextID})
+	l.startTimer()
+}
+
+func (l *Link) onTimeout() {
+	if l.retries <= 1 {
+		if l.phase == phaseTerminate {
+			l.down(l.err)
+		} else {
+			l.terminate(errors.New("no response from peer"))
+		}
+		return
+	}
+	l.retries--
+
+	switch l.phase {
+	case phaseEstablish:
+		l.sendConfigureRequest(protoLCP, &l.lcp, l.lcpRequest())
+	case phaseAuthenticate:
+		if l.authProto == protoPAP {
+			l.sendPAPRequest()
+		} else {
+			// The peer sends CHAP challenges: wait for another
+			l.startTimer()
+		}
+	case phaseNetwork:
+		l.sendConfigureRequest(protoIPCP, &l.ipcp, l.ipcpRequest())
+	case phaseTerminate:
+		l.sendTerminateRequest()
+	}
+}
+
+func (l *Link) startTimer() {
+	l.timerC = time.After(l.cfg.RestartTimeout)
+}
+
+func (l *Link) send(proto uint16, p *packet) {
+	if _, err := l.rw.WriteFrame(encodeFrame(proto, p.encode())); err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to send frame",
+			"protocol", fmt.Sprintf("%#04x", proto),
+			"error", err)
+	}
+}
+
+func (l *Link) sendConfigureRequest(proto uint16, n *negotiation, options []byte) {
+	l.nextID++
+	n.reqID = l.nextID
+	n.ackRcvd = false
+	l.send(proto, &packet{code: codeConfigureRequest, id: n.reqID, data: options})
+	l.startTimer()
+}
+
+func (l *Link) handleFrame(b []byte) {
+	proto, payload, err := decodeFrame(b)
+	if err != nil {
+		return
+	}
+
+	switch proto {
+	case protoLCP:
+		l.handleLCP(payload)
+	case protoPAP:
+		l.handlePAP(payload)
+	case protoCHAP:
+		l.handleCHAP(payload)
+	case protoIPCP:
+		l.handleIPCP(payload)
+	case protoIPv4:
+		if l.phase == phaseOpen {
+			select {
+			case l.pktChan <- payload:
+			default:
+			}
+		}
+	default:
+		// Other protocols may only be rejected once LCP is open.
+		// Ref: RFC1661 section 5.7.
+		if l.phase >= phaseAuthenticate && l.phase <= phaseOpen {
+			data := make([]byte, 2, 2+len(payload))
+			binary.BigEndian.PutUint16(data, proto)
+			data = append(data, payload...)
+			l.sendReject(codeProtocolReject, data)
+		}
+	}
+}
+
+// sendReject sends an LCP Protocol-Reject or Code-Reject, truncating the
+// rejected packet to fit the peer's MRU.
+func (l *Link) sendReject(code uint8, data []byte) {
+	if max := int(l.peerMRU) - 4; len(data) > max {
+		data = data[:max]
+	}
+	l.nextID++
+	l.send(protoLCP, &packet{code: code, id: l.nextID, data: data})
+}
+
+func (l *Link) handleLCP(b []byte) {
+	p, err := decodePacket(b)
+	if err != nil || l.phase == phaseDead {
+		return
+	}
+
+	switch p.code {
+	case codeConfigureRequest:
+		switch l.phase {
+		case phaseTerminate:
+			return
+		case phaseOpen:
+			l.terminate(errors.New("peer renegotiated LCP"))
+			return
+		case phaseAuthenticate, phaseNetwork:
+			// The peer has restarted negotiation before the link
+			// came up, so start again
+			level.Debug(l.logger).Log("message", "peer restarted LCP negotiation")
+			l.phase = phaseEstablish
+			l.lcp, l.ipcp = negotiation{}, negotiation{}
+			l.retries = l.cfg.MaxRequests
+			l.sendConfigureRequest(protoLCP, &l.lcp, l.lcpRequest())
+		}
+		reply := l.checkLCPRequest(p)
+		if reply == nil {
+			return
+		}
+		l.send(protoLCP, reply)
+		l.lcp.ackSent = reply.code == codeConfigureAck
+		l.checkLCPOpen()
+
+	case codeConfigureAck:
+		if l.phase == phaseEstablish && p.id == l.lcp.reqID {
+			l.lcp.ackRcvd = true
+			l.checkLCPOpen()
+		}
+
+	case codeConfigureNak, codeConfigureReject:
+		if l.phase == phaseEstablish && p.id == l.lcp.reqID {
+			l.onLCPNak(p)
+		}
+
+	case codeTerminateRequest:
+		l.send(protoLCP, &packet{code: codeTerminateAck, id: p.id})
+		if l.phase == phaseTerminate {
+			l.down(l.err)
+		} else {
+			l.down(errors.New("link terminated by peer"))
+		}
+
+	case codeTerminateAck:
+		if l.phase == phaseTerminate {
+			l.down(l.err)
+		}
+
+	case codeEchoRequest:
+		if l.phase >= phaseAuthenticate && l.phase <= phaseOpen && len(p.data) >= 4 {
+			data := make([]byte, 4, len(p.data))
+			binary.BigEndian.PutUint32(data, l.magic)
+			data = append(data, p.data[4:]...)
+			l.send(protoLCP, &packet{code: codeEchoReply, id: p.id, data: data})
+		}
+
+	case codeProtocolReject:
+		if len(p.data) >= 2 && binary.BigEndian.Uint16(p.data) == protoIPCP {
+			l.terminate(errors.New("peer rejected IPCP"))
+		}
+
+	case codeCodeReject, codeEchoReply, codeDiscardRequest:
+
+	default:
+		l.sendReject(codeCodeReject, b)
+	}
+}
+
+// lcpRequest returns the options of our LCP Configure-Request.
+func (l *Link) lcpRequest() []byte {
+	var opts []option
+	if l.sendMRU {
+		opts = append(opts, uint16Option(lcpOptMRU, l.mru))
+	}
+	if l.sendMagic {
+		opts = append(opts, uint32Option(lcpOptMagic, l.magic))
+	}
+	return encodeOptions(opts)
+}
+
+// checkLCPRequest checks the options of the peer's LCP Configure-Request,
+// returning the reply to send, or nil if the request should be discarded.
+func (l *Link) checkLCPRequest(p *packet) *packet {
+	opts, err := decodeOptions(p.data)
+	if err != nil {
+		return nil
+	}
+
+	var nak, rej []option
+	mru := uint16(defaultMRU)
+	var authProto uint16
+	for _, o := range opts {
+		switch o.typ {
+		case lcpOptMRU:
+			if len(o.data) != 2 {
+				rej = append(rej, o)
+				continue
+			}
+			mru = binary.BigEndian.Uint16(o.data)
+		case lcpOptACCM, lcpOptMagic:
+			// Frames exchanged over L2TP need no character escaping
+			if len(o.data) != 4 {
+				rej = append(rej, o)
+			}
+		case lcpOptPFC, lcpOptACFC:
+			// Received frames are decoded with or without compression
+			if len(o.data) != 0 {
+				rej = append(rej, o)
+			}
+		case lcpOptAuth:
+			switch {
+			case len(o.data) == 2 && binary.BigEndian.Uint16(o.data) == protoPAP:
+				authProto = protoPAP
+			case len(o.data) == 3 && binary.BigEndian.Uint16(o.data) == protoCHAP && o.data[2] == chapMD5:
+				authProto = protoCHAP
+			default:
+				nak = append(nak, option{typ: lcpOptAuth, data: []byte{0xc2, 0x23, chapMD5}})
+			}
+		default:
+			rej = append(rej, o)
+		}
+	}
+
+	switch {
+	case len(rej) > 0:
+		return &packet{code: codeConfigureReject, id: p.id, data: encodeOptions(rej)}
+	case len(nak) > 0:
+		return &packet{code: codeConfigureNak, id: p.id, data: encodeOptions(nak)}
+	}
+	l.peerMRU = mru
+	l.authProto = authProto
+	return &packet{code: codeConfigureAck, id: p.id, data: p.data}
+}
+
+// onLCPNak adjusts our LCP Configure-Request following a Configure-Nak or
+// Configure-Reject from the peer, and sends it again.
+func (l *Link) onLCPNak(p *packet) {
+	opts, err := decodeOptions(p.data)
+	if err != nil {
+		return
+	}
+	if l.retries--; l.retries <= 0 {
+		l.terminate(errors.New("LCP negotiation failed"))
+		return
+	}
+
+	for _, o := range opts {
+		switch o.typ {
+		case lcpOptMRU:
+			if p.code == codeConfigureReject {
+				l.sendMRU = false
+			} else if len(o.data) == 2 {
+				l.mru = binary.BigEndian.Uint16(o.data)
+			}
+		case lcpOptMagic:
+			if p.code == codeConfigureReject {
+				l.sendMagic = false
+			} else {
+				l.magic = newMagic()
+			}
+		}
+	}
+	l.sendConfigureRequest(protoLCP, &l.lcp, l.lcpRequest())
+}
+
+// checkLCPOpen moves on to authentication or the network phase once both
+// LCP Configure-Requests have been acknowledged.
+func (l *Link) checkLCPOpen() {
+	if l.phase != phaseEstablish || !l.lcp.ackRcvd || !l.lcp.ackSent {
+		return
+	}
+	level.Debug(l.logger).Log("message", "LCP open")
+
+	l.retries = l.cfg.MaxRequests
+	switch l.authProto {
+	case protoPAP:
+		l.phase = phaseAuthenticate
+		l.sendPAPRequest()
+	case protoCHAP:
+		l.phase = phaseAuthenticate
+		l.startTimer()
+	default:
+		l.enterNetworkPhase()
+	}
+}
+
+func (l *Link) sendPAPRequest() {
+	l.nextID++
+	l.authID = l.nextID
+	l.send(protoPAP, &packet{
+		code: papAuthenticateRequest,
+		id:   l.authID,
+		data: papRequest(l.cfg.Username, l.cfg.Password),
+	})
+	l.startTimer()
+}
+
+func (l *Link) handlePAP(b []byte) {
+	p, err := decodePacket(b)
+	if err != nil || l.phase != phaseAuthenticate || l.authProto != protoPAP || p.id != l.authID {
+		return
+	}
+	switch p.code {
+	case papAuthenticateAck:
+		l.enterNetworkPhase()
+	case papAuthenticateNak:
+		l.terminate(authError(protoPAP, papMessage(p.data)))
+	}
+}
+
+func (l *Link) handleCHAP(b []byte) {
+	p, err := decodePacket(b)
+	if err != nil || l.authProto != protoCHAP {
+		return
+	}
+
+	// The peer may challenge us again once the link is up.
+	// Ref: RFC1994 section 2.
+	switch p.code {
+	case chapChallenge:
+		if l.phase != phaseAuthenticate && l.phase != phaseOpen {
+			return
+		}
+		data, err := chapResponseData(p.id, p.data, l.cfg.Username, l.cfg.Password)
+		if err != nil {
+			return
+		}
+		l.send(protoCHAP, &packet{code: chapResponse, id: p.id, data: data})
+		if l.phase == phaseAuthenticate {
+			l.startTimer()
+		}
+	case chapSuccess:
+		if l.phase == phaseAuthenticate {
+			l.enterNetworkPhase()
+		}
+	case chapFailure:
+		l.terminate(authError(protoCHAP, string(p.data)))
+	}
+}
+
+func (l *Link) enterNetworkPhase() {
+	level.Debug(l.logger).Log("message", "entering network phase")
+	l.phase = phaseNetwork
+	l.retries = l.cfg.MaxRequests
+	l.sendConfigureRequest(protoIPCP, &l.ipcp, l.ipcpRequest())
+	if p := l.pendingIPCP; p != nil {
+		l.pendingIPCP = nil
+		l.handleIPCP(p.encode())
+	}
+}
+
+func (l *Link) handleIPCP(b []byte) {
+	p, err := decodePacket(b)
+	if err != nil {
+		return
+	}
+	if l.phase < phaseNetwork {
+		// The peer may be in the network phase before we are, so
+		// keep its request until we get there
+		if p.code == codeConfigureRequest {
+			l.pendingIPCP = p
+		}
+		return
+	}
+	if l.phase > phaseOpen {
+		return
+	}
+
+	switch p.code {
+	case codeConfigureRequest:
+		if l.phase == phaseOpen {
+			l.terminate(errors.New("peer renegotiated IPCP"))
+			return
+		}
+		reply := l.checkIPCPRequest(p)
+		if reply == nil {
+			return
+		}
+		l.send(protoIPCP, reply)
+		l.ipcp.ackSent = reply.code == codeConfigureAck
+		l.checkIPCPOpen()
+
+	case codeConfigureAck:
+		if l.phase == phaseNetwork && p.id == l.ipcp.reqID {
+			l.ipcp.ackRcvd = true
+			l.localAddr = l.reqAddr
+			l.checkIPCPOpen()
+		}
+
+	case codeConfigureNak, codeConfigureReject:
+		if l.phase == phaseNetwork && p.id == l.ipcp.reqID {
+			l.onIPCPNak(p)
+		}
+
+	case codeTerminateRequest:
+		l.send(protoIPCP, &packet{code: codeTerminateAck, id: p.id})
+		l.terminate(errors.New("IPCP terminated by peer"))
+
+	case codeTerminateAck, codeCodeReject:
+
+	default:
+		l.nextID++
+		l.send(protoIPCP, &packet{code: codeCodeReject, id: l.nextID, data: b})
+	}
+}
+
+// ipcpRequest returns the options of our IPCP Configure-Request.
+func (l *Link) ipcpRequest() []byte {
+	var opts []option
+	if l.sendAddr {
+		opts = append(opts, option{typ: ipcpOptAddress, data: l.reqAddr})
+	}
+	for i, typ := range []uint8{ipcpOptPrimaryDNS, ipcpOptSecondaryDNS} {
+		if l.sendDNS[i] {
+			opts = append(opts, option{typ: typ, data: l.reqDNS[i]})
+		}
+	}
+	return encodeOptions(opts)
+}
+
+// checkIPCPRequest checks the options of the peer's IPCP
+// Configure-Request, returning the reply to send, or nil if the request
+// should be discarded.
+func (l *Link) checkIPCPRequest(p *packet) *packet {
+	opts, err := decodeOptions(p.data)
+	if err != nil {
+		return nil
+	}
+
+	var rej []option
+	var peerAddr net.IP
+	for _, o := range opts {
+		// We have no address to assign the peer
+		if o.typ == ipcpOptAddress && len(o.data) == 4 && !net.IP(o.data).Equal(net.IPv4zero) {
+			peerAddr = net.IP(append([]byte(nil), o.data...))
+			continue
+		}
+		rej = append(rej, o)
+	}
+
+	if len(rej) > 0 {
+		return &packet{code: codeConfigureReject, id: p.id, data: encodeOptions(rej)}
+	}
+	l.peerAddr = peerAddr
+	return &packet{code: codeConfigureAck, id: p.id, data: p.data}
+}
+
+// onIPCPNak adjusts our IPCP Configure-Request following a Configure-Nak
+// or Configure-Reject from the peer, and sends it again.
+func (l *Link) onIPCPNak(p *packet) {
+	opts, err := decodeOptions(p.data)
+	if err != nil {
+		return
+	}
+	if l.retries--; l.retries <= 0 {
+		l.terminate(errors.New("IPCP negotiation failed"))
+		return
+	}
+
+	for _, o := range opts {
+		if o.typ == ipcpOptPrimaryDNS || o.typ == ipcpOptSecondaryDNS {
+			i := 0
+			if o.typ == ipcpOptSecondaryDNS {
+				i = 1
+			}
+			switch {
+			case p.code == codeConfigureNak && len(o.data) == 4:
+				l.reqDNS[i] = net.IP(append([]byte(nil), o.data...))
+			case p.code == codeConfigureReject:
+				l.sendDNS[i] = false
+			}
+			continue
+		}
+		if o.typ != ipcpOptAddress {
+			continue
+		}
+		switch {
+		case p.code == codeConfigureNak && len(o.data) == 4:
+			// The peer has assigned us an address
+			l.reqAddr = net.IP(append([]byte(nil), o.data...))
+		case p.code == codeConfigureReject && l.reqAddr.Equal(net.IPv4zero):
+			l.terminate(errors.New("peer refused to assign an IP address"))
+			return
+		case p.code == codeConfigureReject:
+			l.sendAddr = false
+		}
+	}
+	l.sendConfigureRequest(protoIPCP, &l.ipcp, l.ipcpRequest())
+}
+
+// checkIPCPOpen brings the link up once both IPCP Configure-Requests have
+// been acknowledged.
+func (l *Link) checkIPCPOpen() {
+	if l.phase != phaseNetwork || !l.ipcp.ackRcvd || !l.ipcp.ackSent {
+		return
+	}
+	if !l.sendAddr {
+		l.localAddr = l.reqAddr
+	}
+	for i := range l.reqDNS {
+		if l.sendDNS[i] && !l.reqDNS[i].Equal(net.IPv4zero) {
+			l.dns = append(l.dns, l.reqDNS[i])
+		}
+	}
+	l.phase = phaseOpen
+	l.up = true
+	l.timerC = nil
+	level.Info(l.logger).Log(
+		"message", "link up",
+		"local_addr", l.localAddr,
+		"peer_addr", l.peerAddr,
+		"dns", fmt.Sprintf("%v", l.dns))
+	if s, ok := l.rw.(l2tp.Session); ok {
+		s.ReportIPCPUp(l.ipcpInfo())
+	}
+	l.upChan <- nil
+	l.upChan = nil
+}
+
+// ipcpInfo describes the link to the application's l2tp.EventHandler
+// instances.
+func (l *Link) ipcpInfo() l2tp.IPCPInfo {
+	return l2tp.IPCPInfo{
+		LocalAddr: l.localAddr,
+		PeerAddr:  l.peerAddr,
+		DNS:       l.dns,
+	}
+}
+
+// newMagic returns a random, non-zero magic number.
+// Ref: RFC1661 section 6.4.
+func newMagic() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return uint32(time.Now().UnixNano()) | 1
+		}
+		if magic := binary.BigEndian.Uint32(b[:]); magic != 0 {
+			return magic
+		}
+	}
+}
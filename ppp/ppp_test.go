@@ -0,0 +1,372 @@
+package ppp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// pipe is a FrameReadWriter exchanging frames with a test peer over
+// channels.  It records the addresses reported using ReportIPCPUp and
+// ReportIPCPDown, as an l2tp.Session would.
+type pipe struct {
+	l2tp.Session
+	rx, tx chan []byte
+	done   chan struct{}
+	ipcp   []l2tp.IPCPInfo
+	down   []l2tp.IPCPInfo
+}
+
+func newPipe() *pipe {
+	return &pipe{
+		rx:   make(chan []byte, 8),
+		tx:   make(chan []byte, 8),
+		done: make(chan struct{}),
+	}
+}
+
+func (p *pipe) ReadFrame(b []byte) (int, error) {
+	select {
+	case frame := <-p.rx:
+		return copy(b, frame), nil
+	case <-p.done:
+		return 0, io.EOF
+	}
+}
+
+func (p *pipe) ReportIPCPUp(info l2tp.IPCPInfo) {
+	p.ipcp = append(p.ipcp, info)
+}
+
+func (p *pipe) ReportIPCPDown(info l2tp.IPCPInfo) {
+	p.down = append(p.down, info)
+}
+
+func (p *pipe) WriteFrame(b []byte) (int, error) {
+	select {
+	case p.tx <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-p.done:
+		return 0, io.EOF
+	}
+}
+
+// testPeer plays the part of an L2TP network server's PPP implementation.
+// Frames it doesn't handle itself are passed to the test on frames.
+type testPeer struct {
+	p                  *pipe
+	auth               uint16
+	username, password string
+	frames             chan []byte
+	id                 uint8
+}
+
+var (
+	testPeerAddr  = net.IPv4(192, 0, 2, 1).To4()
+	testLocalAddr = net.IPv4(192, 0, 2, 2).To4()
+	testDNSAddr   = net.IPv4(192, 0, 2, 53).To4()
+)
+
+func (tp *testPeer) send(proto uint16, code, id uint8, data []byte) {
+	tp.p.rx <- encodeFrame(proto, (&packet{code: code, id: id, data: data}).encode())
+}
+
+func (tp *testPeer) sendRequest(proto uint16, opts []option) {
+	tp.id++
+	tp.send(proto, codeConfigureRequest, tp.id, encodeOptions(opts))
+}
+
+func (tp *testPeer) sendLCPRequest(unsupported bool) {
+	var opts []option
+	if unsupported {
+		// Callback isn't supported by package ppp
+		opts = append(opts, option{typ: 13, data: []byte{6}})
+	}
+	opts = append(opts, uint16Option(lcpOptMRU, 1400), uint32Option(lcpOptMagic, 0x12345678))
+	switch tp.auth {
+	case protoPAP:
+		opts = append(opts, uint16Option(lcpOptAuth, protoPAP))
+	case protoCHAP:
+		opts = append(opts, option{typ: lcpOptAuth, data: []byte{0xc2, 0x23, chapMD5}})
+	}
+	tp.sendRequest(protoLCP, opts)
+}
+
+func (tp *testPeer) sendIPCPRequest(unsupported bool) {
+	opts := []option{{typ: ipcpOptAddress, data: testPeerAddr}}
+	if unsupported {
+		// Van Jacobson compression isn't supported by package ppp
+		opts = append(opts, option{typ: 2, data: []byte{0x00, 0x2d, 0x0f, 0x01}})
+	}
+	tp.sendRequest(protoIPCP, opts)
+}
+
+func (tp *testPeer) run() {
+	tp.sendLCPRequest(true)
+	for {
+		var frame []byte
+		select {
+		case frame = <-tp.p.tx:
+		case <-tp.p.done:
+			return
+		}
+		proto, payload, err := decodeFrame(frame)
+		if err != nil {
+			continue
+		}
+		p, err := decodePacket(payload)
+		if err != nil {
+			tp.frames <- frame
+			continue
+		}
+
+		switch {
+		case proto == protoLCP && p.code == codeConfigureRequest:
+			tp.send(protoLCP, codeConfigureAck, p.id, p.data)
+		case proto == protoLCP && p.code == codeConfigureReject:
+			tp.sendLCPRequest(false)
+		case proto == protoLCP && p.code == codeConfigureAck:
+			switch tp.auth {
+			case protoCHAP:
+				tp.send(protoCHAP, chapChallenge, 42, []byte{4, 1, 2, 3, 4})
+			case 0:
+				tp.sendIPCPRequest(true)
+			}
+		case proto == protoLCP && p.code == codeTerminateRequest:
+			tp.send(protoLCP, codeTerminateAck, p.id, nil)
+
+		case proto == protoPAP && p.code == papAuthenticateRequest:
+			if bytes.Equal(p.data, papRequest(tp.username, tp.password)) {
+				tp.send(protoPAP, papAuthenticateAck, p.id, []byte{0})
+				tp.sendIPCPRequest(true)
+			} else {
+				tp.send(protoPAP, papAuthenticateNak, p.id, append([]byte{3}, "bad"...))
+			}
+		case proto == protoCHAP && p.code == chapResponse:
+			want := md5.Sum(append(append([]byte{42}, tp.password...), 1, 2, 3, 4))
+			if bytes.Equal(p.data, append(append([]byte{16}, want[:]...), tp.username...)) {
+				tp.send(protoCHAP, chapSuccess, p.id, nil)
+				tp.sendIPCPRequest(true)
+			} else {
+				tp.send(protoCHAP, chapFailure, p.id, []byte("bad"))
+			}
+
+		case proto == protoIPCP && p.code == codeConfigureRequest:
+			// Assign an address and primary DNS server if the link
+			// asks for them, but decline to give a secondary DNS
+			// server
+			opts, _ := decodeOptions(p.data)
+			var nak, rej []option
+			for _, o := range opts {
+				switch {
+				case o.typ == ipcpOptSecondaryDNS:
+					rej = append(rej, o)
+				case o.typ == ipcpOptAddress && bytes.Equal(o.data, net.IPv4zero.To4()):
+					nak = append(nak, option{typ: o.typ, data: testLocalAddr})
+				case o.typ == ipcpOptPrimaryDNS && bytes.Equal(o.data, net.IPv4zero.To4()):
+					nak = append(nak, option{typ: o.typ, data: testDNSAddr})
+				}
+			}
+			switch {
+			case len(rej) > 0:
+				tp.send(protoIPCP, codeConfigureReject, p.id, encodeOptions(rej))
+			case len(nak) > 0:
+				tp.send(protoIPCP, codeConfigureNak, p.id, encodeOptions(nak))
+			default:
+				tp.send(protoIPCP, codeConfigureAck, p.id, p.data)
+			}
+		case proto == protoIPCP && p.code == codeConfigureReject:
+			tp.sendIPCPRequest(false)
+		case proto == protoIPCP && p.code == codeConfigureAck:
+
+		default:
+			tp.frames <- frame
+		}
+	}
+}
+
+// nextFrame returns the next frame the test peer didn't handle.
+func (tp *testPeer) nextFrame(t *testing.T) (uint16, []byte) {
+	select {
+	case frame := <-tp.frames:
+		proto, payload, err := decodeFrame(frame)
+		if err != nil {
+			t.Fatalf("decodeFrame(%x): %v", frame, err)
+		}
+		return proto, payload
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for frame")
+	}
+	return 0, nil
+}
+
+func TestLink(t *testing.T) {
+	cases := []struct {
+		name     string
+		auth     uint16
+		password string
+		dns      bool
+		estr     string
+	}{
+		{name: "No authentication"},
+		{name: "DNS", dns: true},
+		{name: "PAP", auth: protoPAP, password: "secret"},
+		{name: "CHAP", auth: protoCHAP, password: "secret"},
+		{name: "PAP failure", auth: protoPAP, password: "wrong", estr: "PAP authentication failed: bad"},
+		{name: "CHAP failure", auth: protoCHAP, password: "wrong", estr: "CHAP authentication failed: bad"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newPipe()
+			defer close(p.done)
+			tp := &testPeer{
+				p:        p,
+				auth:     c.auth,
+				username: "alice",
+				password: "secret",
+				frames:   make(chan []byte, 8),
+			}
+			go tp.run()
+
+			link, err := Open(p, &Config{
+				Username:       "alice",
+				Password:       c.password,
+				RequestDNS:     c.dns,
+				RestartTimeout: 100 * time.Millisecond,
+			})
+			if c.estr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.estr) {
+					t.Fatalf("Open(): got error %v, want %q", err, c.estr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open(): %v", err)
+			}
+
+			if !link.LocalAddr().Equal(testLocalAddr) || !link.PeerAddr().Equal(testPeerAddr) {
+				t.Errorf("addresses: got %v -> %v, want %v -> %v",
+					link.LocalAddr(), link.PeerAddr(), testLocalAddr, testPeerAddr)
+			}
+			var wantDNS []net.IP
+			if c.dns {
+				wantDNS = []net.IP{testDNSAddr}
+			}
+			if !reflect.DeepEqual(link.DNS(), wantDNS) {
+				t.Errorf("DNS(): got %v, want %v", link.DNS(), wantDNS)
+			}
+			want := []l2tp.IPCPInfo{{LocalAddr: testLocalAddr, PeerAddr: testPeerAddr, DNS: wantDNS}}
+			if !reflect.DeepEqual(p.ipcp, want) {
+				t.Errorf("ReportIPCPUp(): got %v, want %v", p.ipcp, want)
+			}
+			if len(p.down) != 0 {
+				t.Errorf("ReportIPCPDown(): got %v before Close()", p.down)
+			}
+			if link.MTU() != 1400 {
+				t.Errorf("MTU(): got %v, want 1400", link.MTU())
+			}
+
+			// LCP Echo-Requests are answered
+			tp.send(protoLCP, codeEchoRequest, 7, append([]byte{0x12, 0x34, 0x56, 0x78}, "ping"...))
+			proto, payload := tp.nextFrame(t)
+			if rsp, err := decodePacket(payload); proto != protoLCP || err != nil ||
+				rsp.code != codeEchoReply || rsp.id != 7 || string(rsp.data[4:]) != "ping" {
+				t.Errorf("expected LCP Echo-Reply, got protocol %#x payload %x", proto, payload)
+			}
+
+			// IPv4 packets are exchanged with the application
+			pkt := bytes.Repeat([]byte{0x45}, 40)
+			tp.p.rx <- encodeFrame(protoIPv4, pkt)
+			b := make([]byte, 1500)
+			n, err := link.ReadPacket(b)
+			if err != nil || !bytes.Equal(b[:n], pkt) {
+				t.Errorf("ReadPacket(): got %x, %v, want %x", b[:n], err, pkt)
+			}
+			if _, err = link.WritePacket(pkt); err != nil {
+				t.Fatalf("WritePacket(): %v", err)
+			}
+			if proto, payload = tp.nextFrame(t); proto != protoIPv4 || !bytes.Equal(payload, pkt) {
+				t.Errorf("expected IPv4 packet, got protocol %#x payload %x", proto, payload)
+			}
+			if _, err = link.WritePacket(make([]byte, 1401)); err == nil {
+				t.Errorf("WritePacket(): expected error for packet exceeding MTU")
+			}
+
+			// Other protocols are rejected
+			tp.p.rx <- encodeFrame(0x0057, []byte{0x60})
+			proto, payload = tp.nextFrame(t)
+			if rej, err := decodePacket(payload); proto != protoLCP || err != nil ||
+				rej.code != codeProtocolReject || binary.BigEndian.Uint16(rej.data) != 0x0057 {
+				t.Errorf("expected LCP Protocol-Reject, got protocol %#x payload %x", proto, payload)
+			}
+
+			link.Close()
+			if _, err = link.ReadPacket(b); err != io.EOF {
+				t.Errorf("ReadPacket() after Close(): got %v, want %v", err, io.EOF)
+			}
+			if !reflect.DeepEqual(p.down, want) {
+				t.Errorf("ReportIPCPDown(): got %v, want %v", p.down, want)
+			}
+		})
+	}
+}
+
+func TestLinkNoResponse(t *testing.T) {
+	p := newPipe()
+	defer close(p.done)
+	go func() {
+		for {
+			select {
+			case <-p.tx:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	_, err := Open(p, &Config{RestartTimeout: 10 * time.Millisecond, MaxRequests: 3})
+	if err == nil || err.Error() != "no response from peer" {
+		t.Errorf("Open(): got error %v, want no response from peer", err)
+	}
+	if _, err = Open(p, &Config{LocalAddr: net.ParseIP("2001:db8::1")}); err == nil {
+		t.Errorf("Open(): expected error for IPv6 local address")
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	cases := []struct {
+		frame   []byte
+		proto   uint16
+		payload []byte
+		isErr   bool
+	}{
+		{frame: []byte{0xff, 0x03, 0xc0, 0x21, 0x01}, proto: protoLCP, payload: []byte{0x01}},
+		// Address and control field compression
+		{frame: []byte{0x80, 0x21, 0x01}, proto: protoIPCP, payload: []byte{0x01}},
+		// Protocol field compression
+		{frame: []byte{0xff, 0x03, 0x21, 0x45}, proto: protoIPv4, payload: []byte{0x45}},
+		{frame: []byte{0x21, 0x45}, proto: protoIPv4, payload: []byte{0x45}},
+		{frame: []byte{0xff, 0x03}, isErr: true},
+		{frame: []byte{0xc0}, isErr: true},
+	}
+	for _, c := range cases {
+		proto, payload, err := decodeFrame(c.frame)
+		if c.isErr {
+			if err == nil {
+				t.Errorf("decodeFrame(%x): expected error", c.frame)
+			}
+			continue
+		}
+		if err != nil || proto != c.proto || !bytes.Equal(payload, c.payload) {
+			t.Errorf("decodeFrame(%x): got %#x %x %v, want %#x %x", c.frame, proto, payload, err, c.proto, c.payload)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package pppoe
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Ethernet types of PPPoE discovery and session stage frames.
+// Ref: RFC2516 section 4.
+const (
+	ethTypeDiscovery = 0x8863
+	ethTypeSession   = 0x8864
+)
+
+// PPPoE packet codes.
+// Ref: RFC2516 section 5.
+const (
+	codeSession = 0x00
+	codePADO    = 0x07
+	codePADI    = 0x09
+	codePADR    = 0x19
+	codePADS    = 0x65
+	codePADT    = 0xa7
+)
+
+// PPPoE discovery tags.
+// Ref: RFC2516 appendix A.
+const (
+	tagEndOfList      = 0x0000
+	tagServiceName    = 0x0101
+	tagACName         = 0x0102
+	tagHostUniq       = 0x0103
+	tagACCookie       = 0x0104
+	tagVendorSpecific = 0x0105
+	tagRelaySessionID = 0x0110
+	tagServiceNameErr = 0x0201
+	tagACSystemErr    = 0x0202
+	tagGenericErr     = 0x0203
+)
+
+// The vendor ID of the Vendor-Specific tag added by a PPPoE Intermediate
+// Agent, being the SMI Private Enterprise Code of the Broadband Forum, and
+// the sub-options of the tag identifying the subscriber's access line.
+// Ref: TR-101 section 3.9.3.
+const (
+	vendorIDBBF     = 3561
+	subOptCircuitID = 0x01
+	subOptRemoteID  = 0x02
+)
+
+// The version and type fields of the PPPoE header, and the header length.
+// Ref: RFC2516 section 4.
+const (
+	pppoeVerType   = 0x11
+	pppoeHeaderLen = 6
+)
+
+// The HDLC address and control fields which prefix the PPP frames carried
+// by L2TP, but which aren't carried by PPPoE.
+// Ref: RFC2661 section 2, RFC2516 section 7.
+var hdlcHeader = []byte{0xff, 0x03}
+
+// packet is a PPPoE packet, excluding the Ethernet header.
+type packet struct {
+	code    uint8
+	sid     uint16
+	payload []byte
+}
+
+func (p *packet) encode() []byte {
+	b := make([]byte, pppoeHeaderLen, pppoeHeaderLen+len(p.payload))
+	b[0] = pppoeVerType
+	b[1] = p.code
+	binary.BigEndian.PutUint16(b[2:], p.sid)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(p.payload)))
+	return append(b, p.payload...)
+}
+
+// decodePacket parses a PPPoE packet, discarding any Ethernet padding
+// following it.
+func decodePacket(b []byte) (*packet, error) {
+	if len(b) < pppoeHeaderLen {
+		return nil, errors.New("short packet")
+	}
+	if b[0] != pppoeVerType {
+		return nil, errors.New("unsupported version or type")
+	}
+	length := int(binary.BigEndian.Uint16(b[4:]))
+	if length > len(b)-pppoeHeaderLen {
+		return nil, errors.New("bad packet length")
+	}
+	return &packet{
+		code:    b[1],
+		sid:     binary.BigEndian.Uint16(b[2:]),
+		payload: b[pppoeHeaderLen : pppoeHeaderLen+length],
+	}, nil
+}
+
+// tag is a discovery packet tag.
+type tag struct {
+	typ  uint16
+	data []byte
+}
+
+func encodeTags(tags []tag) []byte {
+	var b []byte
+	for _, t := range tags {
+		var hdr [4]byte
+		binary.BigEndian.PutUint16(hdr[0:], t.typ)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(t.data)))
+		b = append(b, hdr[:]...)
+		b = append(b, t.data...)
+	}
+	return b
+}
+
+// decodeTags parses the tags of a discovery packet, stopping at the
+// End-Of-List tag if present.
+func decodeTags(b []byte) ([]tag, error) {
+	var tags []tag
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("malformed tag")
+		}
+		typ := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length > len(b)-4 {
+			return nil, errors.New("malformed tag")
+		}
+		if typ == tagEndOfList {
+			break
+		}
+		tags = append(tags, tag{typ: typ, data: b[4 : 4+length]})
+		b = b[4+length:]
+	}
+	return tags, nil
+}
+
+// findTag returns the first tag of a given type.
+func findTag(tags []tag, typ uint16) ([]byte, bool) {
+	for _, t := range tags {
+		if t.typ == typ {
+			return t.data, true
+		}
+	}
+	return nil, false
+}
+
+// accessLineIDs returns the Agent-Circuit-ID and Agent-Remote-ID added to
+// a discovery packet by a PPPoE Intermediate Agent, if any.
+func accessLineIDs(tags []tag) (circuitID, remoteID string) {
+	for _, t := range tags {
+		if t.typ != tagVendorSpecific || len(t.data) < 4 ||
+			binary.BigEndian.Uint32(t.data) != vendorIDBBF {
+			continue
+		}
+		b := t.data[4:]
+		for len(b) >= 2 && int(b[1]) <= len(b)-2 {
+			switch b[0] {
+			case subOptCircuitID:
+				circuitID = string(b[2 : 2+b[1]])
+			case subOptRemoteID:
+				remoteID = string(b[2 : 2+b[1]])
+			}
+			b = b[2+b[1]:]
+		}
+	}
+	return circuitID, remoteID
+}
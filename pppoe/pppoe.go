@@ -0,0 +1,780 @@
+/*
+Package pppoe implements an L2TP access concentrator (LAC) which relays PPPoE
+sessions into L2TP sessions toward an L2TP network server (LNS).
+
+A Relay acts as a PPPoE access concentrator on an access interface, answering
+the PPPoE discovery stage as described by RFC2516.  When a host requests a
+PPPoE session, the Relay creates a dynamic PPP session in an L2TP tunnel to
+the LNS, and confirms the PPPoE session once the L2TP session is established.
+PPP frames are then relayed unchanged between the two sessions, so that LCP,
+authentication and the network control protocols run between the host and
+the LNS.
+
+The lifecycles of the two sessions are tied together.  A PADR from the host
+causes an ICRQ to be sent to the LNS, and the PADS is sent once the L2TP
+session is established, or with an AC-System-Error tag if it fails to
+establish.  A PADT from the host closes the L2TP session, sending a CDN to the
+LNS, while a CDN from the LNS, or the tunnel going down, causes a PADT to be
+sent to the host.
+
+The ICRQ carries the host's MAC address in the Calling Number AVP.  If a
+PPPoE Intermediate Agent has added the subscriber's Agent-Circuit-ID and
+Agent-Remote-ID to the discovery packets, as described by the Broadband
+Forum's TR-101, they are relayed to the LNS in vendor-specific AVPs using the
+Broadband Forum's vendor ID of 3561 and the attribute types of the equivalent
+RADIUS attributes: 1 for the Agent-Circuit-ID and 2 for the Agent-Remote-ID.
+
+Optionally, the Relay may act as a proxy for the LNS during LCP negotiation
+and authentication, as described by RFC2661 section 4.4.5.  The PADS is then
+sent immediately, and the Relay negotiates LCP with the host itself, asking
+the host to authenticate using CHAP with MD5, or PAP if the host prefers.
+Once the host has responded to authentication, the Relay creates the L2TP
+session, passing the LCP Configure-Requests exchanged with the host and the
+host's authentication response to the LNS in the Proxy LCP and Proxy
+Authentication AVPs of the ICCN.  The LNS may then verify the response and
+complete authentication without renegotiating LCP.  The Relay doesn't check
+the host's credentials itself.
+
+A host may use Multilink PPP, as described by RFC1990, to bundle several PPPoE
+sessions.  If Multilink is set the L2TP sessions of each host are tagged with
+a bundle ID derived from the host's MAC address, so that the application may
+find the members of a host's bundle using l2tp.Context.BundleSessions.  When
+proxying LCP for a session with a bundle ID, the Relay requests the
+Multilink MRRU and an Endpoint Discriminator holding the bundle ID, and
+accepts the host's Multilink options, so that the Proxy LCP AVPs describe a
+link which the LNS may join to the host's bundle.  Otherwise the Relay
+rejects the host's Multilink options.
+
+The Relay must be able to access the frames of its L2TP sessions, which means
+the tunnel's context must use the userspace data plane with
+l2tp.OpenFramePort as its session port function.  The Relay uses AF_PACKET
+sockets on the access interface, which requires CAP_NET_RAW.
+
+Usage
+
+	import (
+		"github.com/katalix/go-l2tp/l2tp"
+		"github.com/katalix/go-l2tp/pppoe"
+	)
+
+	# Note we're ignoring errors for brevity.
+
+	dp, _ := l2tp.NewUserspaceDataPlane(l2tp.OpenFramePort)
+	l2tpctx, _ := l2tp.NewContext(dp, logger)
+	tunl, _ := l2tpctx.NewDynamicTunnel("t1", &l2tp.TunnelConfig{
+		Peer:    "lns.example.com:1701",
+		Version: l2tp.ProtocolVersion2,
+		Encap:   l2tp.EncapTypeUDP,
+	})
+
+	relay, _ := pppoe.NewRelay(&pppoe.Config{
+		Interface: "eth1",
+		ACName:    "lac1",
+		Tunnel:    tunl,
+		Logger:    logger,
+	})
+	defer relay.Close()
+*/
+package pppoe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// Config describes a Relay.
+type Config struct {
+	// Interface is the name of the access interface on which PPPoE
+	// sessions are accepted.
+	Interface string
+	// ACName is the name of the access concentrator sent to hosts in
+	// the AC-Name tag.  If unset, the host name of the system is used.
+	ACName string
+	// ServiceNames lists the services offered to hosts.  Hosts requesting
+	// any other service are refused.  If unset, any service is accepted.
+	ServiceNames []string
+	// Tunnel is the L2TP tunnel to the LNS in which sessions are created.
+	Tunnel l2tp.Tunnel
+	// SessionConfig is the template for the configuration of the L2TP
+	// sessions, which are always PPP sessions.  The relay AVPs are
+	// appended to its ExtraAVPs.  If nil, the default configuration is
+	// used.
+	SessionConfig *l2tp.SessionConfig
+	// ProxyLCP has the relay negotiate LCP with hosts and collect their
+	// responses to authentication before creating L2TP sessions, so that
+	// the results are passed to the LNS in the ICCN.
+	ProxyLCP bool
+	// Multilink sets the bundle ID of the L2TP sessions of each host to
+	// the host's MAC address, overriding any BundleID set by
+	// SessionConfig, so that the PPPoE sessions a host bundles using
+	// Multilink PPP are members of the same bundle.
+	Multilink bool
+	// MaxSessions limits the number of PPPoE sessions.  Hosts are
+	// refused further sessions once the limit is reached.  If unset, the
+	// number of sessions is limited only by the PPPoE session ID space.
+	MaxSessions int
+	// Logger receives log messages about the relay and its sessions.  If
+	// nil, logging is disabled.
+	Logger log.Logger
+}
+
+// AVP types of the relay AVPs sent in the ICRQ.
+// Ref: RFC2661 section 4.4.5.
+const (
+	avpTypeCallingNumber = 22
+	avpTypeCircuitID     = 1
+	avpTypeRemoteID      = 2
+)
+
+// The PPPoE session ID reserved for the discovery stage, and the largest
+// session ID which may be allocated.
+// Ref: RFC2516 section 4.
+const (
+	discoverySessionID = 0
+	maxSessionID       = 0xfffe
+)
+
+// The largest frame the relay will receive from the access network
+const maxFrameLen = 1500
+
+// The largest PPP frame the relay will receive from the LNS
+const maxPPPFrameLen = 65536
+
+// Relay relays PPPoE sessions on an access interface into L2TP sessions.
+type Relay struct {
+	cfg    Config
+	logger log.Logger
+	disc   packetConn
+	sess   packetConn
+	secret []byte
+	wg     sync.WaitGroup
+
+	lock      sync.Mutex
+	closed    bool
+	nextSid   uint16
+	sessions  map[uint16]*session
+	closeOnce sync.Once
+}
+
+// session is a PPPoE session and the L2TP session it is relayed into.
+type session struct {
+	sid      uint16
+	name     string
+	addr     net.HardwareAddr
+	hostUniq []byte
+	relayID  []byte
+	service  string
+	scfg     *l2tp.SessionConfig
+	l2tp     l2tp.Session
+	// proxy is set while the relay negotiates LCP with the host
+	proxy *lcpProxy
+	// up is set once the PADS confirming the session has been sent, and
+	// forwarding is set once frames are relayed to the LNS
+	up         bool
+	forwarding bool
+}
+
+// NewRelay starts relaying PPPoE sessions on the access interface.
+func NewRelay(cfg *Config) (*Relay, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid nil config")
+	}
+	ifi, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find access interface: %v", err)
+	}
+
+	disc, err := openLinkConn(ifi, ethTypeDiscovery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open discovery socket: %v", err)
+	}
+	sess, err := openLinkConn(ifi, ethTypeSession)
+	if err != nil {
+		disc.close()
+		return nil, fmt.Errorf("failed to open session socket: %v", err)
+	}
+
+	r, err := newRelay(cfg, disc, sess)
+	if err != nil {
+		disc.close()
+		sess.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newRelay(cfg *Config, disc, sess packetConn) (*Relay, error) {
+	if cfg.Tunnel == nil {
+		return nil, errors.New("invalid nil tunnel")
+	}
+
+	r := &Relay{
+		cfg:      *cfg,
+		disc:     disc,
+		sess:     sess,
+		secret:   make([]byte, sha256.Size),
+		nextSid:  1,
+		sessions: make(map[uint16]*session),
+	}
+	if _, err := rand.Read(r.secret); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie secret: %v", err)
+	}
+	if r.cfg.ACName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up host name: %v", err)
+		}
+		r.cfg.ACName = name
+	}
+
+	r.logger = r.cfg.Logger
+	if r.logger == nil {
+		r.logger = log.NewNopLogger()
+	}
+	r.logger = log.With(r.logger, "function", "pppoe", "interface", r.cfg.Interface)
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.discoveryReceiver()
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.sessionReceiver()
+	}()
+	return r, nil
+}
+
+// Close stops the relay, terminating its PPPoE sessions and closing their
+// L2TP sessions.
+func (r *Relay) Close() {
+	r.closeOnce.Do(func() {
+		r.lock.Lock()
+		r.closed = true
+		sessions := r.sessions
+		r.sessions = make(map[uint16]*session)
+		for _, s := range sessions {
+			if s.up {
+				r.sendPADT(s)
+			}
+		}
+		r.lock.Unlock()
+
+		for _, s := range sessions {
+			s.close(l2tp.CDNResultAdminDisconnect, "LAC shutting down")
+		}
+		r.disc.close()
+		r.sess.close()
+		r.wg.Wait()
+	})
+}
+
+// discoveryReceiver handles the discovery stage packets sent by hosts.
+func (r *Relay) discoveryReceiver() {
+	b := make([]byte, maxFrameLen)
+	for {
+		n, from, err := r.disc.readFrom(b)
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			level.Error(r.logger).Log(
+				"message", "failed to read discovery packet",
+				"error", err)
+			continue
+		}
+		p, err := decodePacket(b[:n])
+		if err != nil {
+			level.Debug(r.logger).Log(
+				"message", "discarding malformed discovery packet",
+				"host", from,
+				"error", err)
+			continue
+		}
+		tags, err := decodeTags(p.payload)
+		if err != nil {
+			level.Debug(r.logger).Log(
+				"message", "discarding malformed discovery packet",
+				"host", from,
+				"error", err)
+			continue
+		}
+
+		switch p.code {
+		case codePADI:
+			r.handlePADI(p, tags, from)
+		case codePADR:
+			r.handlePADR(p, tags, from)
+		case codePADT:
+			r.handlePADT(p, from)
+		}
+	}
+}
+
+// sessionReceiver relays the PPP frames hosts send in their PPPoE sessions
+// to the LNS.
+func (r *Relay) sessionReceiver() {
+	b := make([]byte, maxFrameLen)
+	frame := make([]byte, len(hdlcHeader)+maxFrameLen)
+	copy(frame, hdlcHeader)
+	for {
+		n, from, err := r.sess.readFrom(b)
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			continue
+		}
+		p, err := decodePacket(b[:n])
+		if err != nil || p.code != codeSession {
+			continue
+		}
+
+		r.lock.Lock()
+		s, ok := r.sessions[p.sid]
+		var proxy *lcpProxy
+		var forwarding bool
+		if ok {
+			proxy, forwarding = s.proxy, s.forwarding
+		}
+		r.lock.Unlock()
+		if !ok || !bytes.Equal(s.addr, from) {
+			continue
+		}
+		if proxy != nil {
+			proxy.deliver(p.payload)
+			continue
+		}
+		if !forwarding {
+			continue
+		}
+
+		n = copy(frame[len(hdlcHeader):], p.payload)
+		s.l2tp.WriteFrame(frame[:len(hdlcHeader)+n])
+	}
+}
+
+// forwarder relays the PPP frames the LNS sends in an L2TP session to the
+// host, until the L2TP session goes down.
+func (r *Relay) forwarder(s *session) {
+	b := make([]byte, maxPPPFrameLen)
+	for {
+		n, err := s.l2tp.ReadFrame(b)
+		if err != nil {
+			r.l2tpSessionDown(s, err)
+			return
+		}
+		frame := bytes.TrimPrefix(b[:n], hdlcHeader)
+		pkt := &packet{code: codeSession, sid: s.sid, payload: frame}
+		r.sess.writeTo(pkt.encode(), s.addr)
+	}
+}
+
+func (r *Relay) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// handlePADI answers a host's PADI with a PADO if the requested service
+// is offered.
+// Ref: RFC2516 section 5.1.
+func (r *Relay) handlePADI(p *packet, tags []tag, from net.HardwareAddr) {
+	service, ok := findTag(tags, tagServiceName)
+	if p.sid != discoverySessionID || !ok {
+		return
+	}
+	if !r.offersService(string(service)) {
+		level.Debug(r.logger).Log(
+			"message", "ignoring PADI for service not offered",
+			"host", from,
+			"service", string(service))
+		return
+	}
+
+	reply := []tag{
+		{typ: tagACName, data: []byte(r.cfg.ACName)},
+		{typ: tagServiceName, data: service},
+	}
+	for _, name := range r.cfg.ServiceNames {
+		if name != string(service) {
+			reply = append(reply, tag{typ: tagServiceName, data: []byte(name)})
+		}
+	}
+	reply = append(reply, tag{typ: tagACCookie, data: r.cookie(from)})
+	reply = append(reply, echoTags(tags)...)
+	r.sendDiscovery(codePADO, discoverySessionID, reply, from)
+}
+
+// handlePADR creates an L2TP session for a host's PADR.  The PADS is sent
+// once the L2TP session is established.
+// Ref: RFC2516 section 5.3.
+func (r *Relay) handlePADR(p *packet, tags []tag, from net.HardwareAddr) {
+	service, ok := findTag(tags, tagServiceName)
+	if p.sid != discoverySessionID || !ok {
+		return
+	}
+	cookie, _ := findTag(tags, tagACCookie)
+	if !hmac.Equal(cookie, r.cookie(from)) {
+		level.Debug(r.logger).Log(
+			"message", "ignoring PADR with invalid AC-Cookie",
+			"host", from)
+		return
+	}
+	hostUniq, _ := findTag(tags, tagHostUniq)
+	relayID, _ := findTag(tags, tagRelaySessionID)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	// A retransmitted PADR is answered by the existing session
+	for _, s := range r.sessions {
+		if bytes.Equal(s.addr, from) && bytes.Equal(s.hostUniq, hostUniq) {
+			if s.up {
+				r.sendPADS(s)
+			}
+			return
+		}
+	}
+
+	refuse := func(typ uint16, message string) {
+		level.Info(r.logger).Log(
+			"message", "refusing PPPoE session",
+			"host", from,
+			"error", message)
+		reply := []tag{
+			{typ: tagServiceName, data: service},
+			{typ: typ, data: []byte(message)},
+		}
+		r.sendDiscovery(codePADS, discoverySessionID, append(reply, echoTags(tags)...), from)
+	}
+
+	if !r.offersService(string(service)) {
+		refuse(tagServiceNameErr, "service not offered")
+		return
+	}
+	if r.cfg.MaxSessions > 0 && len(r.sessions) >= r.cfg.MaxSessions {
+		refuse(tagACSystemErr, "session limit reached")
+		return
+	}
+	sid, ok := r.allocSid()
+	if !ok {
+		refuse(tagACSystemErr, "no free session IDs")
+		return
+	}
+
+	s := &session{
+		sid:      sid,
+		name:     fmt.Sprintf("pppoe-%s-%d", r.cfg.Interface, sid),
+		addr:     from,
+		hostUniq: append([]byte(nil), hostUniq...),
+		relayID:  append([]byte(nil), relayID...),
+		service:  string(service),
+		scfg:     r.sessionConfig(from, tags),
+	}
+
+	if r.cfg.ProxyLCP {
+		// The L2TP session is created once LCP is negotiated
+		s.proxy = newLCPProxy(r, s)
+		s.up = true
+		r.sendPADS(s)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.proxyDone(s, s.proxy.run())
+		}()
+	} else if err := r.newL2TPSession(s); err != nil {
+		refuse(tagACSystemErr, "failed to create L2TP session")
+		return
+	}
+	r.sessions[sid] = s
+
+	level.Info(r.logger).Log(
+		"message", "new PPPoE session",
+		"host", from,
+		"session_id", sid,
+		"service", s.service,
+		"session_name", s.name)
+}
+
+// newL2TPSession creates the L2TP session for a PPPoE session.
+func (r *Relay) newL2TPSession(s *session) error {
+	ls, err := r.cfg.Tunnel.NewSessionAsync(s.name, s.scfg, func(err error) {
+		// The callback mustn't block the L2TP session's goroutine
+		go r.l2tpSessionEstablished(s, err)
+	})
+	if err != nil {
+		level.Error(r.logger).Log(
+			"message", "failed to create L2TP session",
+			"host", s.addr,
+			"error", err)
+		return err
+	}
+	s.l2tp = ls
+	return nil
+}
+
+// proxyDone creates the L2TP session for a PPPoE session once LCP has been
+// negotiated with the host, passing the results to the LNS, or terminates
+// the PPPoE session if negotiation failed.
+func (r *Relay) proxyDone(s *session, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed || r.sessions[s.sid] != s {
+		return
+	}
+	proxy := s.proxy
+	s.proxy = nil
+
+	if err == nil {
+		scfg := *s.scfg
+		scfg.ExtraAVPs = append(append([]l2tp.ExtraAVP(nil), scfg.ExtraAVPs...), proxy.avps()...)
+		s.scfg = &scfg
+		err = r.newL2TPSession(s)
+	}
+	if err != nil {
+		level.Error(r.logger).Log(
+			"message", "failed to proxy LCP",
+			"host", s.addr,
+			"session_id", s.sid,
+			"error", err)
+		delete(r.sessions, s.sid)
+		r.sendPADT(s)
+	}
+}
+
+// handlePADT closes the L2TP session of a PPPoE session the host has
+// terminated.
+// Ref: RFC2516 section 5.5.
+func (r *Relay) handlePADT(p *packet, from net.HardwareAddr) {
+	r.lock.Lock()
+	s, ok := r.sessions[p.sid]
+	if !ok || !bytes.Equal(s.addr, from) {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.sessions, p.sid)
+	r.lock.Unlock()
+
+	level.Info(r.logger).Log(
+		"message", "PPPoE session terminated by host",
+		"host", from,
+		"session_id", s.sid)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		s.close(l2tp.CDNResultAdminDisconnect, "PPPoE session terminated by host")
+	}()
+}
+
+// l2tpSessionEstablished confirms or refuses a PPPoE session once its L2TP
+// session is established or fails to establish.
+func (r *Relay) l2tpSessionEstablished(s *session, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// The session may have been terminated while we waited
+	if r.closed || r.sessions[s.sid] != s {
+		return
+	}
+
+	if err != nil {
+		level.Error(r.logger).Log(
+			"message", "L2TP session failed to establish",
+			"host", s.addr,
+			"session_id", s.sid,
+			"error", err)
+		delete(r.sessions, s.sid)
+		if s.up {
+			r.sendPADT(s)
+			return
+		}
+		reply := []tag{
+			{typ: tagServiceName, data: []byte(s.service)},
+			{typ: tagACSystemErr, data: []byte("L2TP session failed to establish")},
+		}
+		r.sendDiscovery(codePADS, discoverySessionID, append(reply, s.echoTags()...), s.addr)
+		return
+	}
+
+	level.Info(r.logger).Log(
+		"message", "PPPoE session up",
+		"host", s.addr,
+		"session_id", s.sid)
+	if !s.up {
+		s.up = true
+		r.sendPADS(s)
+	}
+	s.forwarding = true
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.forwarder(s)
+	}()
+}
+
+// l2tpSessionDown terminates a PPPoE session whose L2TP session has gone
+// down.
+func (r *Relay) l2tpSessionDown(s *session, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.sessions[s.sid] != s {
+		return
+	}
+	delete(r.sessions, s.sid)
+
+	level.Info(r.logger).Log(
+		"message", "L2TP session down, terminating PPPoE session",
+		"host", s.addr,
+		"session_id", s.sid,
+		"error", err)
+	r.sendPADT(s)
+}
+
+func (r *Relay) sendPADS(s *session) {
+	reply := []tag{{typ: tagServiceName, data: []byte(s.service)}}
+	r.sendDiscovery(codePADS, s.sid, append(reply, s.echoTags()...), s.addr)
+}
+
+func (r *Relay) sendPADT(s *session) {
+	r.sendDiscovery(codePADT, s.sid, s.echoTags(), s.addr)
+}
+
+func (r *Relay) sendDiscovery(code uint8, sid uint16, tags []tag, to net.HardwareAddr) {
+	p := &packet{code: code, sid: sid, payload: encodeTags(tags)}
+	if err := r.disc.writeTo(p.encode(), to); err != nil {
+		level.Error(r.logger).Log(
+			"message", "failed to send discovery packet",
+			"host", to,
+			"error", err)
+	}
+}
+
+// sessionConfig builds the configuration of the L2TP session for a host's
+// PPPoE session, adding the relay AVPs to the ICRQ.
+func (r *Relay) sessionConfig(from net.HardwareAddr, tags []tag) *l2tp.SessionConfig {
+	var scfg l2tp.SessionConfig
+	if r.cfg.SessionConfig != nil {
+		scfg = *r.cfg.SessionConfig
+	}
+	scfg.Pseudowire = l2tp.PseudowireTypePPP
+	if r.cfg.Multilink {
+		scfg.BundleID = from.String()
+	}
+
+	avps := append([]l2tp.ExtraAVP(nil), scfg.ExtraAVPs...)
+	avps = append(avps, l2tp.ExtraAVP{
+		Type:      avpTypeCallingNumber,
+		Mandatory: true,
+		Value:     from.String(),
+		Messages:  []l2tp.MessageType{l2tp.MessageTypeICRQ},
+	})
+	circuitID, remoteID := accessLineIDs(tags)
+	if circuitID != "" {
+		avps = append(avps, l2tp.ExtraAVP{
+			VendorID: vendorIDBBF,
+			Type:     avpTypeCircuitID,
+			Value:    circuitID,
+			Messages: []l2tp.MessageType{l2tp.MessageTypeICRQ},
+		})
+	}
+	if remoteID != "" {
+		avps = append(avps, l2tp.ExtraAVP{
+			VendorID: vendorIDBBF,
+			Type:     avpTypeRemoteID,
+			Value:    remoteID,
+			Messages: []l2tp.MessageType{l2tp.MessageTypeICRQ},
+		})
+	}
+	scfg.ExtraAVPs = avps
+	return &scfg
+}
+
+// allocSid allocates an unused PPPoE session ID.
+func (r *Relay) allocSid() (uint16, bool) {
+	for i := 0; i < maxSessionID; i++ {
+		sid := r.nextSid
+		r.nextSid++
+		if r.nextSid > maxSessionID {
+			r.nextSid = 1
+		}
+		if _, ok := r.sessions[sid]; !ok {
+			return sid, true
+		}
+	}
+	return 0, false
+}
+
+func (r *Relay) offersService(name string) bool {
+	if len(r.cfg.ServiceNames) == 0 {
+		return true
+	}
+	for _, offered := range r.cfg.ServiceNames {
+		if name == offered {
+			return true
+		}
+	}
+	return false
+}
+
+// cookie returns the AC-Cookie for a host, which allows the PADR to be
+// checked without keeping state for the PADO.
+// Ref: RFC2516 appendix A.
+func (r *Relay) cookie(addr net.HardwareAddr) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(addr)
+	return mac.Sum(nil)[:16]
+}
+
+// echoTags returns the tags of a host's discovery packet which must be
+// echoed in our reply.
+func echoTags(tags []tag) []tag {
+	var out []tag
+	for _, t := range tags {
+		if t.typ == tagHostUniq || t.typ == tagRelaySessionID {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// close closes the L2TP session of a PPPoE session, or stops negotiating
+// LCP with the host if it has no L2TP session yet.
+func (s *session) close(result l2tp.ResultCode, message string) {
+	if s.proxy != nil {
+		s.proxy.abort()
+	}
+	if s.l2tp != nil {
+		s.l2tp.CloseWithResult(result, l2tp.ErrorCodeNoError, message)
+	}
+}
+
+func (s *session) echoTags() []tag {
+	var out []tag
+	if s.hostUniq != nil {
+		out = append(out, tag{typ: tagHostUniq, data: s.hostUniq})
+	}
+	if s.relayID != nil {
+		out = append(out, tag{typ: tagRelaySessionID, data: s.relayID})
+	}
+	return out
+}
@@ -0,0 +1,635 @@
+package pppoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// frame is an Ethernet frame payload exchanged with a testConn.
+type frame struct {
+	b    []byte
+	addr net.HardwareAddr
+}
+
+// testConn is a packetConn exchanging frames with the test over channels.
+type testConn struct {
+	rx, tx chan frame
+	done   chan struct{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		rx:   make(chan frame, 8),
+		tx:   make(chan frame, 8),
+		done: make(chan struct{}),
+	}
+}
+
+func (tc *testConn) readFrom(b []byte) (int, net.HardwareAddr, error) {
+	select {
+	case f := <-tc.rx:
+		return copy(b, f.b), f.addr, nil
+	case <-tc.done:
+		return 0, nil, io.EOF
+	}
+}
+
+func (tc *testConn) writeTo(b []byte, dst net.HardwareAddr) error {
+	select {
+	case tc.tx <- frame{b: append([]byte(nil), b...), addr: dst}:
+		return nil
+	case <-tc.done:
+		return io.EOF
+	}
+}
+
+func (tc *testConn) close() error {
+	close(tc.done)
+	return nil
+}
+
+// next returns the next packet sent by the relay.
+func (tc *testConn) next(t *testing.T, wantCode uint8, wantAddr net.HardwareAddr) (*packet, []tag) {
+	select {
+	case f := <-tc.tx:
+		p, err := decodePacket(f.b)
+		if err != nil {
+			t.Fatalf("decodePacket(%x): %v", f.b, err)
+		}
+		if p.code != wantCode || !bytes.Equal(f.addr, wantAddr) {
+			t.Fatalf("got code %#x to %v, want %#x to %v", p.code, f.addr, wantCode, wantAddr)
+		}
+		tags, err := decodeTags(p.payload)
+		if err != nil && p.code != codeSession {
+			t.Fatalf("decodeTags(%x): %v", p.payload, err)
+		}
+		return p, tags
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for code %#x", wantCode)
+	}
+	return nil, nil
+}
+
+type testEventCollector struct {
+	events chan interface{}
+}
+
+func (tec *testEventCollector) HandleEvent(event interface{}) {
+	switch event.(type) {
+	case *l2tp.SessionUpEvent, *l2tp.SessionDownEvent:
+		tec.events <- event
+	}
+}
+
+// next returns the next event of the same type as want
+func (tec *testEventCollector) next(t *testing.T, want interface{}) interface{} {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev := <-tec.events:
+			if fmt.Sprintf("%T", ev) == fmt.Sprintf("%T", want) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %T", want)
+		}
+	}
+}
+
+type testSessionAcceptor struct {
+	calls chan *l2tp.IncomingCall
+}
+
+func (tsa *testSessionAcceptor) AcceptSession(call *l2tp.IncomingCall) *l2tp.CallDecision {
+	tsa.calls <- call
+	return &l2tp.CallDecision{Accept: true}
+}
+
+func newTestContext(t *testing.T, logger log.Logger) *l2tp.Context {
+	dp, err := l2tp.NewUserspaceDataPlane(l2tp.OpenFramePort)
+	if err != nil {
+		t.Fatalf("NewUserspaceDataPlane(): %v", err)
+	}
+	ctx, err := l2tp.NewContext(dp, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	return ctx
+}
+
+// vendorSpecificTag builds the tag a PPPoE Intermediate Agent adds to
+// discovery packets.
+func vendorSpecificTag(circuitID, remoteID string) tag {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, vendorIDBBF)
+	b = append(b, subOptCircuitID, uint8(len(circuitID)))
+	b = append(b, circuitID...)
+	b = append(b, subOptRemoteID, uint8(len(remoteID)))
+	b = append(b, remoteID...)
+	return tag{typ: tagVendorSpecific, data: b}
+}
+
+func TestRelay(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx := newTestContext(t, logger)
+	defer lnsCtx.Close()
+	lnsEvents := &testEventCollector{events: make(chan interface{}, 32)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	acceptor := &testSessionAcceptor{calls: make(chan *l2tp.IncomingCall, 4)}
+	lnsCtx.SetSessionAcceptor(acceptor)
+	_, err := lnsCtx.NewListener("lns", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:9079",
+		Encap:          l2tp.EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewListener(): %v", err)
+	}
+
+	lacCtx := newTestContext(t, logger)
+	defer lacCtx.Close()
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:9080",
+		Peer:           "127.0.0.1:9079",
+		Version:        l2tp.ProtocolVersion2,
+		Encap:          l2tp.EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	disc, sess := newTestConn(), newTestConn()
+	relay, err := newRelay(&Config{
+		Interface:    "eth1",
+		ACName:       "lac1",
+		ServiceNames: []string{"internet"},
+		Tunnel:       tunl,
+		Logger:       logger,
+	}, disc, sess)
+	if err != nil {
+		t.Fatalf("newRelay(): %v", err)
+	}
+	defer relay.Close()
+
+	host := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	send := func(c *testConn, code uint8, sid uint16, payload []byte) {
+		p := &packet{code: code, sid: sid, payload: payload}
+		c.rx <- frame{b: p.encode(), addr: host}
+	}
+
+	// Discovery offers the configured service only
+	send(disc, codePADI, 0, encodeTags([]tag{
+		{typ: tagServiceName, data: []byte("other")},
+	}))
+	send(disc, codePADI, 0, encodeTags([]tag{
+		{typ: tagServiceName, data: []byte("internet")},
+		{typ: tagHostUniq, data: []byte("abc")},
+		vendorSpecificTag("eth 1/1/1:100", "sub1"),
+	}))
+	_, tags := disc.next(t, codePADO, host)
+	if name, _ := findTag(tags, tagACName); string(name) != "lac1" {
+		t.Errorf("PADO AC-Name: got %q, want lac1", name)
+	}
+	if uniq, _ := findTag(tags, tagHostUniq); string(uniq) != "abc" {
+		t.Errorf("PADO Host-Uniq: got %q, want abc", uniq)
+	}
+	cookie, ok := findTag(tags, tagACCookie)
+	if !ok {
+		t.Fatalf("PADO has no AC-Cookie")
+	}
+
+	// A PADR for another service is refused
+	send(disc, codePADR, 0, encodeTags([]tag{
+		{typ: tagServiceName, data: []byte("other")},
+		{typ: tagACCookie, data: cookie},
+	}))
+	p, tags := disc.next(t, codePADS, host)
+	if _, ok := findTag(tags, tagServiceNameErr); p.sid != 0 || !ok {
+		t.Errorf("expected PADS refusing service, got session %v tags %v", p.sid, tags)
+	}
+
+	// A PADR creates an L2TP session carrying the relay AVPs
+	padr := encodeTags([]tag{
+		{typ: tagServiceName, data: []byte("internet")},
+		{typ: tagHostUniq, data: []byte("abc")},
+		{typ: tagACCookie, data: cookie},
+		vendorSpecificTag("eth 1/1/1:100", "sub1"),
+	})
+	send(disc, codePADR, 0, padr)
+	select {
+	case call := <-acceptor.calls:
+		if call.CallingNumber != host.String() {
+			t.Errorf("ICRQ Calling Number: got %q, want %q", call.CallingNumber, host)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for ICRQ")
+	}
+	lnsSess := lnsEvents.next(t, &l2tp.SessionUpEvent{}).(*l2tp.SessionUpEvent).Session
+	p, tags = disc.next(t, codePADS, host)
+	if uniq, _ := findTag(tags, tagHostUniq); p.sid == 0 || string(uniq) != "abc" {
+		t.Fatalf("expected PADS confirming session, got session %v tags %v", p.sid, tags)
+	}
+	sid := p.sid
+
+	// A retransmitted PADR is answered with the same session
+	send(disc, codePADR, 0, padr)
+	if p, _ = disc.next(t, codePADS, host); p.sid != sid {
+		t.Errorf("retransmitted PADR: got session %v, want %v", p.sid, sid)
+	}
+
+	// PPP frames are relayed in both directions
+	lcp := []byte{0xc0, 0x21, 0x01, 0x01, 0x00, 0x04}
+	send(sess, codeSession, sid, lcp)
+	b := make([]byte, 1500)
+	n, err := lnsSess.ReadFrame(b)
+	if err != nil || !bytes.Equal(b[:n], append([]byte{0xff, 0x03}, lcp...)) {
+		t.Errorf("LNS ReadFrame(): got %x, %v, want ff03%x", b[:n], err, lcp)
+	}
+	lcp[2] = 0x02
+	if _, err = lnsSess.WriteFrame(append([]byte{0xff, 0x03}, lcp...)); err != nil {
+		t.Fatalf("LNS WriteFrame(): %v", err)
+	}
+	if p, _ = sess.next(t, codeSession, host); p.sid != sid || !bytes.Equal(p.payload, lcp) {
+		t.Errorf("session frame: got session %v payload %x, want %v %x", p.sid, p.payload, sid, lcp)
+	}
+
+	// A CDN from the LNS terminates the PPPoE session
+	lnsSess.CloseWithResult(l2tp.CDNResultAdminDisconnect, l2tp.ErrorCodeNoError, "")
+	if p, _ = disc.next(t, codePADT, host); p.sid != sid {
+		t.Errorf("PADT: got session %v, want %v", p.sid, sid)
+	}
+
+	// A PADT from the host sends a CDN to the LNS
+	padr = encodeTags([]tag{
+		{typ: tagServiceName, data: []byte("internet")},
+		{typ: tagHostUniq, data: []byte("def")},
+		{typ: tagACCookie, data: cookie},
+	})
+	send(disc, codePADR, 0, padr)
+	<-acceptor.calls
+	lnsEvents.next(t, &l2tp.SessionUpEvent{})
+	p, _ = disc.next(t, codePADS, host)
+	send(disc, codePADT, p.sid, nil)
+	down := lnsEvents.next(t, &l2tp.SessionDownEvent{}).(*l2tp.SessionDownEvent)
+	for down.Session == lnsSess {
+		down = lnsEvents.next(t, &l2tp.SessionDownEvent{}).(*l2tp.SessionDownEvent)
+	}
+	if !down.ClosedByPeer || down.ErrorMessage != "PPPoE session terminated by host" {
+		t.Errorf("LNS session down: closed by peer %v, error message %q", down.ClosedByPeer, down.ErrorMessage)
+	}
+}
+
+func TestSessionConfig(t *testing.T) {
+	r := &Relay{cfg: Config{
+		SessionConfig: &l2tp.SessionConfig{
+			ExtraAVPs: []l2tp.ExtraAVP{{VendorID: 9, Type: 1, Value: "x"}},
+		},
+	}}
+	host := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+
+	cases := []struct {
+		name string
+		tags []tag
+		want []l2tp.ExtraAVP
+	}{
+		{
+			name: "No Intermediate Agent",
+			want: []l2tp.ExtraAVP{
+				{VendorID: 9, Type: 1, Value: "x"},
+				{Type: avpTypeCallingNumber, Mandatory: true, Value: "02:00:00:00:00:01"},
+			},
+		},
+		{
+			name: "Intermediate Agent",
+			tags: []tag{
+				{typ: tagVendorSpecific, data: []byte{0, 0, 0, 9, 1, 1, 'x'}},
+				vendorSpecificTag("eth 1/1/1:100", "sub1"),
+			},
+			want: []l2tp.ExtraAVP{
+				{VendorID: 9, Type: 1, Value: "x"},
+				{Type: avpTypeCallingNumber, Mandatory: true, Value: "02:00:00:00:00:01"},
+				{VendorID: vendorIDBBF, Type: avpTypeCircuitID, Value: "eth 1/1/1:100"},
+				{VendorID: vendorIDBBF, Type: avpTypeRemoteID, Value: "sub1"},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scfg := r.sessionConfig(host, c.tags)
+			if scfg.Pseudowire != l2tp.PseudowireTypePPP || len(scfg.ExtraAVPs) != len(c.want) {
+				t.Fatalf("sessionConfig(): got %+v", scfg)
+			}
+			for i, want := range c.want {
+				got := scfg.ExtraAVPs[i]
+				if got.VendorID != want.VendorID || got.Type != want.Type ||
+					got.Mandatory != want.Mandatory || got.Value != want.Value {
+					t.Errorf("AVP %v: got %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+
+	if scfg := r.sessionConfig(host, nil); scfg.BundleID != "" {
+		t.Errorf("sessionConfig(): got bundle ID %q without Multilink", scfg.BundleID)
+	}
+	r.cfg.Multilink = true
+	if scfg := r.sessionConfig(host, nil); scfg.BundleID != "02:00:00:00:00:01" {
+		t.Errorf("sessionConfig(): got bundle ID %q, want host address", scfg.BundleID)
+	}
+
+	// The template isn't modified
+	if len(r.cfg.SessionConfig.ExtraAVPs) != 1 || r.cfg.SessionConfig.Pseudowire != 0 ||
+		r.cfg.SessionConfig.BundleID != "" {
+		t.Errorf("session config template modified: %+v", r.cfg.SessionConfig)
+	}
+}
+
+func TestDecodeTags(t *testing.T) {
+	cases := []struct {
+		b     []byte
+		want  []tag
+		isErr bool
+	}{
+		{
+			b:    []byte{0x01, 0x01, 0x00, 0x00, 0x01, 0x03, 0x00, 0x02, 'a', 'b'},
+			want: []tag{{typ: tagServiceName, data: []byte{}}, {typ: tagHostUniq, data: []byte("ab")}},
+		},
+		// Tags following End-Of-List are ignored
+		{
+			b:    []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff},
+			want: []tag{{typ: tagServiceName, data: []byte{}}},
+		},
+		{b: []byte{0x01, 0x01, 0x00}, isErr: true},
+		{b: []byte{0x01, 0x01, 0x00, 0x01}, isErr: true},
+	}
+	for _, c := range cases {
+		tags, err := decodeTags(c.b)
+		if c.isErr {
+			if err == nil {
+				t.Errorf("decodeTags(%x): expected error", c.b)
+			}
+			continue
+		}
+		if err != nil || len(tags) != len(c.want) {
+			t.Errorf("decodeTags(%x): got %v, %v, want %v", c.b, tags, err, c.want)
+			continue
+		}
+		for i := range tags {
+			if tags[i].typ != c.want[i].typ || !bytes.Equal(tags[i].data, c.want[i].data) {
+				t.Errorf("decodeTags(%x): got %v, want %v", c.b, tags, c.want)
+			}
+		}
+	}
+}
+
+// pppFrame builds the payload of a PPPoE session frame carrying a PPP
+// packet.
+func pppFrame(proto uint16, code, id uint8, data []byte) []byte {
+	b := []byte{uint8(proto >> 8), uint8(proto), code, id, 0, uint8(4 + len(data))}
+	return append(b, data...)
+}
+
+// nextPPP returns the next PPP packet the relay sent in a PPPoE session.
+func nextPPP(t *testing.T, c *testConn, host net.HardwareAddr) (proto uint16, code, id uint8, data []byte) {
+	p, _ := c.next(t, codeSession, host)
+	if len(p.payload) < 6 {
+		t.Fatalf("malformed PPP frame %x", p.payload)
+	}
+	return binary.BigEndian.Uint16(p.payload), p.payload[2], p.payload[3], p.payload[6:]
+}
+
+func TestLCPProxy(t *testing.T) {
+	host := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	hostReq := []byte{lcpOptMRU, 4, 0x05, 0xd4, lcpOptMagic, 6, 1, 2, 3, 4}
+	authReq := []byte{lcpOptAuth, 4, 0xc0, 0x23}
+	mrruReq := []byte{lcpOptMRRU, 4, 0x05, 0xd4}
+
+	cases := []struct {
+		name     string
+		pap      bool
+		bundleID string
+		wantAVPs []l2tp.ExtraAVP
+	}{
+		{
+			name: "CHAP",
+			wantAVPs: []l2tp.ExtraAVP{
+				{Type: avpTypeProxyAuthType, Value: uint16(proxyAuthTypeCHAP)},
+				{Type: avpTypeProxyAuthName, Value: "alice"},
+				{Type: avpTypeProxyAuthResponse, Value: []byte("0123456789abcdef")},
+			},
+		},
+		{
+			name: "PAP",
+			pap:  true,
+			wantAVPs: []l2tp.ExtraAVP{
+				{Type: avpTypeProxyAuthType, Value: uint16(proxyAuthTypePAP)},
+				{Type: avpTypeProxyAuthName, Value: "alice"},
+				{Type: avpTypeProxyAuthID, Value: uint16(7)},
+				{Type: avpTypeProxyAuthResponse, Value: []byte("secret")},
+			},
+		},
+		{
+			name:     "Multilink",
+			bundleID: "b1",
+			wantAVPs: []l2tp.ExtraAVP{
+				{Type: avpTypeProxyAuthType, Value: uint16(proxyAuthTypeCHAP)},
+				{Type: avpTypeProxyAuthName, Value: "alice"},
+				{Type: avpTypeProxyAuthResponse, Value: []byte("0123456789abcdef")},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sess := newTestConn()
+			defer sess.close()
+			r := &Relay{cfg: Config{ACName: "lac1"}, sess: sess, logger: log.NewNopLogger()}
+			s := &session{sid: 1, addr: host, scfg: &l2tp.SessionConfig{BundleID: c.bundleID}}
+			proxy := newLCPProxy(r, s)
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- proxy.run()
+			}()
+
+			// The host asks us to authenticate, which is refused, and
+			// to use Multilink, which is refused unless the session is
+			// a member of a bundle
+			initialReq := append(append(append([]byte{}, authReq...), mrruReq...), hostReq...)
+			wantRej, lastReq := append(append([]byte{}, authReq...), mrruReq...), hostReq
+			if c.bundleID != "" {
+				wantRej, lastReq = authReq, append(append([]byte{}, mrruReq...), hostReq...)
+			}
+			proxy.deliver(pppFrame(protoLCP, codeConfigureRequest, 1, initialReq))
+			proto, code, reqID, req := nextPPP(t, sess, host)
+			if proto != protoLCP || code != codeConfigureRequest {
+				t.Fatalf("expected LCP Configure-Request, got %#x code %v", proto, code)
+			}
+			if c.bundleID != "" {
+				// We ask to use Multilink too
+				disc := append([]byte{lcpOptEndpointDisc, uint8(3 + len(c.bundleID)), endpointDiscClassLocal}, c.bundleID...)
+				if !bytes.Contains(req, []byte{lcpOptMRRU, 4, proxyMRU >> 8, proxyMRU & 0xff}) || !bytes.Contains(req, disc) {
+					t.Errorf("expected MRRU and Endpoint Discriminator in LCP Configure-Request, got %x", req)
+				}
+			}
+			proto, code, _, rej := nextPPP(t, sess, host)
+			if proto != protoLCP || code != codeConfigureReject || !bytes.Equal(rej, wantRej) {
+				t.Fatalf("expected LCP Configure-Reject of %x, got %#x code %v %x", wantRej, proto, code, rej)
+			}
+			proxy.deliver(pppFrame(protoLCP, codeConfigureRequest, 2, lastReq))
+			if proto, code, _, _ = nextPPP(t, sess, host); proto != protoLCP || code != codeConfigureAck {
+				t.Fatalf("expected LCP Configure-Ack, got %#x code %v", proto, code)
+			}
+
+			if c.pap {
+				// The host prefers PAP to CHAP
+				proxy.deliver(pppFrame(protoLCP, codeConfigureNak, reqID, []byte{lcpOptAuth, 4, 0xc0, 0x23}))
+				proto, code, reqID, req = nextPPP(t, sess, host)
+				if proto != protoLCP || code != codeConfigureRequest || !bytes.Contains(req, []byte{lcpOptAuth, 4, 0xc0, 0x23}) {
+					t.Fatalf("expected LCP Configure-Request for PAP, got %#x code %v %x", proto, code, req)
+				}
+				proxy.deliver(pppFrame(protoLCP, codeConfigureAck, reqID, req))
+				proxy.deliver(pppFrame(protoPAP, papAuthenticateRequest, 7,
+					append(append([]byte{5}, "alice"...), append([]byte{6}, "secret"...)...)))
+			} else {
+				proxy.deliver(pppFrame(protoLCP, codeConfigureAck, reqID, req))
+				proto, code, id, data := nextPPP(t, sess, host)
+				if proto != protoCHAP || code != chapChallenge || len(data) != 1+16+len("lac1") || string(data[17:]) != "lac1" {
+					t.Fatalf("expected CHAP Challenge, got %#x code %v %x", proto, code, data)
+				}
+				c.wantAVPs = append(c.wantAVPs,
+					l2tp.ExtraAVP{Type: avpTypeProxyAuthChallenge, Value: data[1:17]},
+					l2tp.ExtraAVP{Type: avpTypeProxyAuthID, Value: uint16(id)})
+				proxy.deliver(pppFrame(protoCHAP, chapResponse, id,
+					append(append([]byte{16}, "0123456789abcdef"...), "alice"...)))
+			}
+
+			select {
+			case err := <-errChan:
+				if err != nil {
+					t.Fatalf("run(): %v", err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for negotiation")
+			}
+
+			c.wantAVPs = append(c.wantAVPs,
+				l2tp.ExtraAVP{Type: avpTypeInitialRcvdLCPConfreq, Value: initialReq},
+				l2tp.ExtraAVP{Type: avpTypeLastRcvdLCPConfreq, Value: lastReq},
+				l2tp.ExtraAVP{Type: avpTypeLastSentLCPConfreq, Value: req})
+			avps := proxy.avps()
+			for _, want := range c.wantAVPs {
+				found := false
+				for _, got := range avps {
+					if got.Type == want.Type {
+						found = fmt.Sprintf("%v", got.Value) == fmt.Sprintf("%v", want.Value) &&
+							len(got.Messages) == 1 && got.Messages[0] == l2tp.MessageTypeICCN
+					}
+				}
+				if !found {
+					t.Errorf("expected AVP %+v in %+v", want, avps)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayProxyLCP(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx := newTestContext(t, logger)
+	defer lnsCtx.Close()
+	lnsEvents := &testEventCollector{events: make(chan interface{}, 32)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetSessionAcceptor(&testSessionAcceptor{calls: make(chan *l2tp.IncomingCall, 4)})
+	_, err := lnsCtx.NewListener("lns", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:9081",
+		Encap:          l2tp.EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewListener(): %v", err)
+	}
+
+	lacCtx := newTestContext(t, logger)
+	defer lacCtx.Close()
+	lacEvents := &testEventCollector{events: make(chan interface{}, 32)}
+	lacCtx.RegisterEventHandler(lacEvents)
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:9082",
+		Peer:           "127.0.0.1:9081",
+		Version:        l2tp.ProtocolVersion2,
+		Encap:          l2tp.EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	disc, sess := newTestConn(), newTestConn()
+	relay, err := newRelay(&Config{
+		Interface: "eth1",
+		ACName:    "lac1",
+		Tunnel:    tunl,
+		ProxyLCP:  true,
+		Logger:    logger,
+	}, disc, sess)
+	if err != nil {
+		t.Fatalf("newRelay(): %v", err)
+	}
+	defer relay.Close()
+
+	host := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	send := func(c *testConn, code uint8, sid uint16, payload []byte) {
+		p := &packet{code: code, sid: sid, payload: payload}
+		c.rx <- frame{b: p.encode(), addr: host}
+	}
+
+	// The PPPoE session is confirmed before LCP is negotiated
+	send(disc, codePADI, 0, encodeTags([]tag{{typ: tagServiceName}}))
+	_, tags := disc.next(t, codePADO, host)
+	cookie, _ := findTag(tags, tagACCookie)
+	send(disc, codePADR, 0, encodeTags([]tag{
+		{typ: tagServiceName},
+		{typ: tagACCookie, data: cookie},
+	}))
+	p, _ := disc.next(t, codePADS, host)
+	sid := p.sid
+
+	// The L2TP session is created once the host responds to the CHAP
+	// challenge
+	_, _, reqID, req := nextPPP(t, sess, host)
+	send(sess, codeSession, sid, pppFrame(protoLCP, codeConfigureRequest, 1, []byte{lcpOptMRU, 4, 0x05, 0xd4}))
+	nextPPP(t, sess, host)
+	send(sess, codeSession, sid, pppFrame(protoLCP, codeConfigureAck, reqID, req))
+	_, _, id, _ := nextPPP(t, sess, host)
+	response := pppFrame(protoCHAP, chapResponse, id, append(append([]byte{16}, "0123456789abcdef"...), "alice"...))
+	send(sess, codeSession, sid, response)
+	lnsSess := lnsEvents.next(t, &l2tp.SessionUpEvent{}).(*l2tp.SessionUpEvent).Session
+	lacEvents.next(t, &l2tp.SessionUpEvent{})
+
+	// The LNS completes authentication
+	success := pppFrame(protoCHAP, 3, id, nil)
+	if _, err = lnsSess.WriteFrame(append([]byte{0xff, 0x03}, success...)); err != nil {
+		t.Fatalf("LNS WriteFrame(): %v", err)
+	}
+	if p, _ = sess.next(t, codeSession, host); p.sid != sid || !bytes.Equal(p.payload, success) {
+		t.Errorf("session frame: got session %v payload %x, want %v %x", p.sid, p.payload, sid, success)
+	}
+
+	// A CDN from the LNS terminates the PPPoE session
+	lnsSess.CloseWithResult(l2tp.CDNResultAdminDisconnect, l2tp.ErrorCodeNoError, "")
+	if p, _ = disc.next(t, codePADT, host); p.sid != sid {
+		t.Errorf("PADT: got session %v, want %v", p.sid, sid)
+	}
+}
@@ -0,0 +1,469 @@
+package pppoe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// PPP protocol numbers.
+// Ref: RFC1661 section 2, RFC1334 section 2.2, RFC1994 section 3.
+const (
+	protoLCP  = 0xc021
+	protoPAP  = 0xc023
+	protoCHAP = 0xc223
+)
+
+// LCP packet codes.
+// Ref: RFC1661 section 5.
+const (
+	codeConfigureRequest = 1
+	codeConfigureAck     = 2
+	codeConfigureNak     = 3
+	codeConfigureReject  = 4
+	codeTerminateRequest = 5
+	codeTerminateAck     = 6
+	codeEchoRequest      = 9
+	codeEchoReply        = 10
+)
+
+// LCP configuration options.
+// Ref: RFC1661 section 6.
+const (
+	lcpOptMRU   = 1
+	lcpOptAuth  = 3
+	lcpOptMagic = 5
+)
+
+// Multilink LCP configuration options, and the Endpoint Discriminator class
+// of a locally assigned address.
+// Ref: RFC1990 section 5.1.
+const (
+	lcpOptMRRU             = 17
+	lcpOptShortSeq         = 18
+	lcpOptEndpointDisc     = 19
+	endpointDiscClassLocal = 1
+)
+
+// PAP and CHAP packet codes, and the CHAP algorithm we use.
+// Ref: RFC1334 section 2.2, RFC1994 section 4.
+const (
+	papAuthenticateRequest = 1
+	chapChallenge          = 1
+	chapResponse           = 2
+	chapMD5                = 5
+)
+
+// The Proxy LCP and Proxy Authentication AVPs sent in the ICCN.
+// Ref: RFC2661 section 4.4.5.
+const (
+	avpTypeInitialRcvdLCPConfreq = 26
+	avpTypeLastSentLCPConfreq    = 27
+	avpTypeLastRcvdLCPConfreq    = 28
+	avpTypeProxyAuthType         = 29
+	avpTypeProxyAuthName         = 30
+	avpTypeProxyAuthChallenge    = 31
+	avpTypeProxyAuthID           = 32
+	avpTypeProxyAuthResponse     = 33
+)
+
+// Proxy Authen Type AVP values.
+// Ref: RFC2661 section 4.4.5.
+const (
+	proxyAuthTypeCHAP = 2
+	proxyAuthTypePAP  = 3
+)
+
+// The MRU requested of hosts, being the largest PPP frame carried by a
+// PPPoE session on Ethernet.
+// Ref: RFC2516 section 7.
+const proxyMRU = maxFrameLen - 8
+
+// The interval between retransmissions of requests the host hasn't
+// answered, and the number of times each request is sent before giving up
+// on the host.
+const (
+	proxyRestartTimeout = 3 * time.Second
+	proxyMaxRequests    = 10
+)
+
+// errProxyAborted is returned by lcpProxy.run if the PPPoE session is
+// terminated while negotiating with the host.
+var errProxyAborted = errors.New("PPPoE session terminated")
+
+// lcpProxy negotiates LCP with a host and collects its response to
+// authentication, so that the LNS may take over the established PPP link
+// rather than negotiating LCP again.
+type lcpProxy struct {
+	r        *Relay
+	s        *session
+	rxChan   chan []byte
+	doneChan chan struct{}
+	bundleID string
+
+	// The remaining fields are only accessed by the proxy's goroutine
+	nextID    uint8
+	reqID     uint8
+	retries   int
+	timerC    <-chan time.Time
+	ackRcvd   bool
+	ackSent   bool
+	sendMRU   bool
+	sendMagic bool
+	sendMRRU  bool
+	sendDisc  bool
+	magic     uint32
+	authProto uint16
+	challenge []byte
+
+	// The negotiation to be reported to the LNS
+	initialRcvd, lastRcvd, lastSent []byte
+	authID                          uint8
+	authName                        string
+	authResponse                    []byte
+}
+
+func newLCPProxy(r *Relay, s *session) *lcpProxy {
+	return &lcpProxy{
+		r:         r,
+		s:         s,
+		rxChan:    make(chan []byte, 8),
+		doneChan:  make(chan struct{}),
+		bundleID:  s.scfg.BundleID,
+		sendMRU:   true,
+		sendMagic: true,
+		sendMRRU:  s.scfg.BundleID != "",
+		sendDisc:  s.scfg.BundleID != "",
+		authProto: protoCHAP,
+	}
+}
+
+// deliver passes a PPP frame received from the host to the proxy, without
+// blocking the relay's receiver.
+func (p *lcpProxy) deliver(frame []byte) {
+	select {
+	case p.rxChan <- append([]byte(nil), frame...):
+	default:
+	}
+}
+
+// abort stops the negotiation.
+func (p *lcpProxy) abort() {
+	close(p.doneChan)
+}
+
+// run negotiates with the host until it has responded to authentication,
+// or the negotiation fails.
+func (p *lcpProxy) run() error {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	p.magic = binary.BigEndian.Uint32(b[:]) | 1
+
+	p.retries = proxyMaxRequests
+	p.sendConfigureRequest()
+	for {
+		select {
+		case frame := <-p.rxChan:
+			done, err := p.handleFrame(frame)
+			if done || err != nil {
+				return err
+			}
+		case <-p.timerC:
+			if p.retries--; p.retries <= 0 {
+				return errors.New("host not responding")
+			}
+			switch {
+			case !p.isOpen():
+				p.sendConfigureRequest()
+			case p.authProto == protoCHAP:
+				p.sendChallenge()
+			default:
+				p.timerC = time.After(proxyRestartTimeout)
+			}
+		case <-p.doneChan:
+			return errProxyAborted
+		}
+	}
+}
+
+func (p *lcpProxy) isOpen() bool {
+	return p.ackRcvd && p.ackSent
+}
+
+func (p *lcpProxy) send(proto uint16, code, id uint8, data []byte) {
+	b := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint16(b[0:], proto)
+	b[2], b[3] = code, id
+	binary.BigEndian.PutUint16(b[4:], uint16(4+len(data)))
+	b = append(b, data...)
+	pkt := &packet{code: codeSession, sid: p.s.sid, payload: b}
+	p.r.sess.writeTo(pkt.encode(), p.s.addr)
+}
+
+// lcpRequest returns the options of our LCP Configure-Request.
+func (p *lcpProxy) lcpRequest() []byte {
+	var b []byte
+	if p.sendMRU {
+		b = append(b, lcpOptMRU, 4, proxyMRU>>8, proxyMRU&0xff)
+	}
+	if p.authProto == protoCHAP {
+		b = append(b, lcpOptAuth, 5, protoCHAP>>8, protoCHAP&0xff, chapMD5)
+	} else {
+		b = append(b, lcpOptAuth, 4, protoPAP>>8, protoPAP&0xff)
+	}
+	if p.sendMagic {
+		b = append(b, lcpOptMagic, 6, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], p.magic)
+	}
+	if p.sendMRRU {
+		b = append(b, lcpOptMRRU, 4, proxyMRU>>8, proxyMRU&0xff)
+	}
+	if p.sendDisc {
+		b = append(b, lcpOptEndpointDisc, uint8(3+len(p.bundleID)), endpointDiscClassLocal)
+		b = append(b, p.bundleID...)
+	}
+	return b
+}
+
+func (p *lcpProxy) sendConfigureRequest() {
+	p.nextID++
+	p.reqID = p.nextID
+	p.send(protoLCP, codeConfigureRequest, p.reqID, p.lcpRequest())
+	p.timerC = time.After(proxyRestartTimeout)
+}
+
+func (p *lcpProxy) sendChallenge() {
+	p.send(protoCHAP, chapChallenge, p.reqID,
+		append(append([]byte{uint8(len(p.challenge))}, p.challenge...), p.r.cfg.ACName...))
+	p.timerC = time.After(proxyRestartTimeout)
+}
+
+// handleFrame handles a PPP frame from the host, returning true once the
+// host has responded to authentication.
+func (p *lcpProxy) handleFrame(frame []byte) (bool, error) {
+	if len(frame) < 6 {
+		return false, nil
+	}
+	proto := binary.BigEndian.Uint16(frame)
+	code, id := frame[2], frame[3]
+	length := int(binary.BigEndian.Uint16(frame[4:]))
+	if length < 4 || length > len(frame)-2 {
+		return false, nil
+	}
+	data := frame[6 : 2+length]
+
+	switch proto {
+	case protoLCP:
+		return false, p.handleLCP(code, id, data)
+	case protoCHAP:
+		if p.isOpen() && p.authProto == protoCHAP && code == chapResponse && id == p.reqID {
+			return p.onCHAPResponse(data)
+		}
+	case protoPAP:
+		if p.isOpen() && p.authProto == protoPAP && code == papAuthenticateRequest {
+			return p.onPAPRequest(id, data)
+		}
+	}
+	return false, nil
+}
+
+func (p *lcpProxy) handleLCP(code, id uint8, data []byte) error {
+	switch code {
+	case codeConfigureRequest:
+		opts, ok := decodeLCPOptions(data)
+		if !ok {
+			return nil
+		}
+		if p.initialRcvd == nil {
+			p.initialRcvd = append([]byte{}, data...)
+		}
+		// We don't authenticate ourselves to the host, nor let it
+		// use Multilink unless the session is a member of a bundle,
+		// but accept anything else it asks for: the LNS may
+		// renegotiate LCP if it disagrees
+		var rej []byte
+		for _, o := range opts {
+			switch o[0] {
+			case lcpOptAuth:
+				rej = append(rej, o...)
+			case lcpOptMRRU, lcpOptShortSeq:
+				if p.bundleID == "" {
+					rej = append(rej, o...)
+				}
+			}
+		}
+		if len(rej) > 0 {
+			p.send(protoLCP, codeConfigureReject, id, rej)
+			return nil
+		}
+		wasOpen := p.isOpen()
+		p.lastRcvd = append([]byte{}, data...)
+		p.send(protoLCP, codeConfigureAck, id, data)
+		p.ackSent = true
+		if wasOpen {
+			// The host has restarted negotiation
+			p.ackRcvd = false
+			p.retries = proxyMaxRequests
+			p.sendConfigureRequest()
+			return nil
+		}
+		p.checkOpen()
+
+	case codeConfigureAck:
+		if !p.ackRcvd && id == p.reqID {
+			p.ackRcvd = true
+			p.lastSent = p.lcpRequest()
+			p.checkOpen()
+		}
+
+	case codeConfigureNak, codeConfigureReject:
+		if p.ackRcvd || id != p.reqID {
+			return nil
+		}
+		opts, ok := decodeLCPOptions(data)
+		if !ok {
+			return nil
+		}
+		for _, o := range opts {
+			switch o[0] {
+			case lcpOptAuth:
+				// The host may ask to use PAP rather than CHAP
+				if code == codeConfigureNak && p.authProto == protoCHAP &&
+					len(o) >= 4 && binary.BigEndian.Uint16(o[2:]) == protoPAP {
+					p.authProto = protoPAP
+					continue
+				}
+				return errors.New("host refused to authenticate")
+			case lcpOptMRU:
+				p.sendMRU = false
+			case lcpOptMagic:
+				if code == codeConfigureReject {
+					p.sendMagic = false
+				} else {
+					p.magic++
+				}
+			case lcpOptMRRU:
+				p.sendMRRU = false
+			case lcpOptEndpointDisc:
+				p.sendDisc = false
+			}
+		}
+		if p.retries--; p.retries <= 0 {
+			return errors.New("LCP negotiation failed")
+		}
+		p.sendConfigureRequest()
+
+	case codeTerminateRequest:
+		p.send(protoLCP, codeTerminateAck, id, nil)
+		return errors.New("host terminated LCP")
+
+	case codeEchoRequest:
+		if p.isOpen() {
+			var magic [4]byte
+			if p.sendMagic {
+				binary.BigEndian.PutUint32(magic[:], p.magic)
+			}
+			reply := magic[:]
+			if len(data) > 4 {
+				reply = append(reply, data[4:]...)
+			}
+			p.send(protoLCP, codeEchoReply, id, reply)
+		}
+	}
+	return nil
+}
+
+// checkOpen starts authentication once LCP is open.
+func (p *lcpProxy) checkOpen() {
+	if !p.isOpen() {
+		return
+	}
+	level.Debug(p.r.logger).Log(
+		"message", "LCP open, authenticating host",
+		"host", p.s.addr,
+		"session_id", p.s.sid,
+		"protocol", fmt.Sprintf("%#04x", p.authProto))
+	p.retries = proxyMaxRequests
+	if p.authProto == protoPAP {
+		p.timerC = time.After(proxyRestartTimeout)
+		return
+	}
+	p.challenge = make([]byte, 16)
+	if _, err := rand.Read(p.challenge); err != nil {
+		p.challenge = make([]byte, 16)
+	}
+	p.nextID++
+	p.reqID = p.nextID
+	p.sendChallenge()
+}
+
+func (p *lcpProxy) onCHAPResponse(data []byte) (bool, error) {
+	if len(data) < 1 || int(data[0]) > len(data)-1 {
+		return false, nil
+	}
+	n := int(data[0])
+	p.authID = p.reqID
+	p.authResponse = append([]byte{}, data[1:1+n]...)
+	p.authName = string(data[1+n:])
+	return true, nil
+}
+
+func (p *lcpProxy) onPAPRequest(id uint8, data []byte) (bool, error) {
+	if len(data) < 1 || int(data[0]) > len(data)-2 {
+		return false, nil
+	}
+	n := int(data[0])
+	m := int(data[1+n])
+	if m > len(data)-2-n {
+		return false, nil
+	}
+	p.authID = id
+	p.authName = string(data[1 : 1+n])
+	p.authResponse = append([]byte{}, data[2+n:2+n+m]...)
+	return true, nil
+}
+
+// avps returns the Proxy LCP and Proxy Authentication AVPs describing the
+// negotiation with the host.
+func (p *lcpProxy) avps() []l2tp.ExtraAVP {
+	iccn := []l2tp.MessageType{l2tp.MessageTypeICCN}
+	avps := []l2tp.ExtraAVP{
+		{Type: avpTypeInitialRcvdLCPConfreq, Value: p.initialRcvd, Messages: iccn},
+		{Type: avpTypeLastSentLCPConfreq, Value: p.lastSent, Messages: iccn},
+		{Type: avpTypeLastRcvdLCPConfreq, Value: p.lastRcvd, Messages: iccn},
+	}
+	if p.authProto == protoCHAP {
+		avps = append(avps,
+			l2tp.ExtraAVP{Type: avpTypeProxyAuthType, Value: uint16(proxyAuthTypeCHAP), Messages: iccn},
+			l2tp.ExtraAVP{Type: avpTypeProxyAuthName, Value: p.authName, Messages: iccn},
+			l2tp.ExtraAVP{Type: avpTypeProxyAuthChallenge, Value: p.challenge, Messages: iccn})
+	} else {
+		avps = append(avps,
+			l2tp.ExtraAVP{Type: avpTypeProxyAuthType, Value: uint16(proxyAuthTypePAP), Messages: iccn},
+			l2tp.ExtraAVP{Type: avpTypeProxyAuthName, Value: p.authName, Messages: iccn})
+	}
+	return append(avps,
+		l2tp.ExtraAVP{Type: avpTypeProxyAuthID, Value: uint16(p.authID), Messages: iccn},
+		l2tp.ExtraAVP{Type: avpTypeProxyAuthResponse, Value: p.authResponse, Messages: iccn})
+}
+
+// decodeLCPOptions splits the options of an LCP Configure packet, returning
+// false if they are malformed.
+func decodeLCPOptions(b []byte) ([][]byte, bool) {
+	var opts [][]byte
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return nil, false
+		}
+		opts = append(opts, b[:b[1]])
+		b = b[b[1]:]
+	}
+	return opts, true
+}
@@ -0,0 +1,105 @@
+package pppoe
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetConn exchanges the payloads of Ethernet frames of a single Ethernet
+// type with the hosts on the access network.
+type packetConn interface {
+	// readFrom reads the payload of the next frame received, returning
+	// its length and the source address of the frame.
+	readFrom(b []byte) (int, net.HardwareAddr, error)
+	// writeTo sends a frame to the host with the given address.
+	writeTo(b []byte, dst net.HardwareAddr) error
+	// close closes the connection, causing blocked calls to readFrom
+	// to return an error.
+	close() error
+}
+
+// linkConn is a packetConn using an AF_PACKET socket bound to an interface.
+type linkConn struct {
+	ifindex  int
+	protocol uint16
+	file     *os.File
+	rc       syscall.RawConn
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openLinkConn(ifi *net.Interface, ethType uint16) (*linkConn, error) {
+	protocol := htons(ethType)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, int(protocol))
+	if err != nil {
+		return nil, fmt.Errorf("socket(AF_PACKET): %v", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: protocol, Ifindex: ifi.Index})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bind(%v): %v", ifi.Name, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "pppoe")
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &linkConn{
+		ifindex:  ifi.Index,
+		protocol: protocol,
+		file:     file,
+		rc:       rc,
+	}, nil
+}
+
+func (lc *linkConn) readFrom(b []byte) (n int, from net.HardwareAddr, err error) {
+	for {
+		var sa unix.Sockaddr
+		cerr := lc.rc.Read(func(fd uintptr) bool {
+			n, sa, err = unix.Recvfrom(int(fd), b, 0)
+			return err != unix.EAGAIN && err != unix.EWOULDBLOCK
+		})
+		if cerr != nil {
+			return 0, nil, cerr
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		// The socket sees the frames we send as well as those we
+		// receive
+		sll, ok := sa.(*unix.SockaddrLinklayer)
+		if !ok || sll.Pkttype == unix.PACKET_OUTGOING || sll.Halen != 6 {
+			continue
+		}
+		return n, net.HardwareAddr(append([]byte(nil), sll.Addr[:6]...)), nil
+	}
+}
+
+func (lc *linkConn) writeTo(b []byte, dst net.HardwareAddr) (err error) {
+	sll := &unix.SockaddrLinklayer{
+		Protocol: lc.protocol,
+		Ifindex:  lc.ifindex,
+		Halen:    uint8(len(dst)),
+	}
+	copy(sll.Addr[:], dst)
+	cerr := lc.rc.Write(func(fd uintptr) bool {
+		err = unix.Sendto(int(fd), b, 0, sll)
+		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (lc *linkConn) close() error {
+	return lc.file.Close()
+}
@@ -0,0 +1,185 @@
+package xdp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BPF instruction encoding, as declared in linux/bpf_common.h and
+// linux/bpf.h
+const (
+	// Instruction classes
+	bpfLd    = 0x00
+	bpfLdx   = 0x01
+	bpfStx   = 0x03
+	bpfJmp   = 0x05
+	bpfAlu64 = 0x07
+
+	// Load and store sizes and modes
+	bpfW    = 0x00
+	bpfH    = 0x08
+	bpfB    = 0x10
+	bpfDW   = 0x18
+	bpfImm  = 0x00
+	bpfMem  = 0x60
+	bpfXadd = 0xc0
+
+	// ALU and jump operations
+	bpfAdd  = 0x00
+	bpfSub  = 0x10
+	bpfLsh  = 0x60
+	bpfAnd  = 0x50
+	bpfMov  = 0xb0
+	bpfJa   = 0x00
+	bpfJeq  = 0x10
+	bpfJgt  = 0x20
+	bpfJset = 0x40
+	bpfJne  = 0x50
+	bpfJlt  = 0xa0
+	bpfCall = 0x80
+	bpfExit = 0x90
+
+	// Operand sources
+	bpfK = 0x00
+	bpfX = 0x08
+
+	// The source register of a 64 bit immediate load which refers to a
+	// map by file descriptor
+	bpfPseudoMapFD = 1
+)
+
+// BPF registers
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// BPF helper functions, as declared in linux/bpf.h
+const (
+	fnMapLookupElem = 1
+	fnRedirect      = 23
+	fnXdpAdjustHead = 44
+)
+
+// insn is a BPF instruction.  Jumps refer to their target by label, which
+// is resolved when the program is assembled.
+type insn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	label    string
+	target   string
+}
+
+// asm builds a BPF program.
+type asm struct {
+	insns []insn
+}
+
+func (a *asm) emit(i insn) {
+	a.insns = append(a.insns, i)
+}
+
+// label marks the position of the next instruction as a jump target.
+func (a *asm) label(name string) {
+	a.emit(insn{label: name})
+}
+
+func (a *asm) movImm(dst uint8, imm int32) {
+	a.emit(insn{op: bpfAlu64 | bpfMov | bpfK, dst: dst, imm: imm})
+}
+
+func (a *asm) movReg(dst, src uint8) {
+	a.emit(insn{op: bpfAlu64 | bpfMov | bpfX, dst: dst, src: src})
+}
+
+func (a *asm) aluImm(op, dst uint8, imm int32) {
+	a.emit(insn{op: bpfAlu64 | op | bpfK, dst: dst, imm: imm})
+}
+
+func (a *asm) aluReg(op, dst, src uint8) {
+	a.emit(insn{op: bpfAlu64 | op | bpfX, dst: dst, src: src})
+}
+
+// load loads dst from the memory at src+off.
+func (a *asm) load(size, dst, src uint8, off int16) {
+	a.emit(insn{op: bpfLdx | bpfMem | size, dst: dst, src: src, off: off})
+}
+
+// store stores src to the memory at dst+off.
+func (a *asm) store(size, dst, src uint8, off int16) {
+	a.emit(insn{op: bpfStx | bpfMem | size, dst: dst, src: src, off: off})
+}
+
+// atomicAdd atomically adds src to the 64 bit value at dst+off.
+func (a *asm) atomicAdd(dst, src uint8, off int16) {
+	a.emit(insn{op: bpfStx | bpfXadd | bpfDW, dst: dst, src: src, off: off})
+}
+
+// loadMapFD loads a reference to a map, which takes two instructions.
+func (a *asm) loadMapFD(dst uint8, fd int) {
+	a.emit(insn{op: bpfLd | bpfImm | bpfDW, dst: dst, src: bpfPseudoMapFD, imm: int32(fd)})
+	a.emit(insn{})
+}
+
+func (a *asm) jmpImm(op, dst uint8, imm int32, target string) {
+	a.emit(insn{op: bpfJmp | op | bpfK, dst: dst, imm: imm, target: target})
+}
+
+func (a *asm) jmpReg(op, dst, src uint8, target string) {
+	a.emit(insn{op: bpfJmp | op | bpfX, dst: dst, src: src, target: target})
+}
+
+func (a *asm) jmp(target string) {
+	a.emit(insn{op: bpfJmp | bpfJa, target: target})
+}
+
+func (a *asm) call(fn int32) {
+	a.emit(insn{op: bpfJmp | bpfCall, imm: fn})
+}
+
+func (a *asm) exit() {
+	a.emit(insn{op: bpfJmp | bpfExit})
+}
+
+// assemble resolves jump targets and encodes the program.
+func (a *asm) assemble() ([]byte, error) {
+	labels := make(map[string]int)
+	var code []insn
+	for _, i := range a.insns {
+		if i.label != "" {
+			if _, ok := labels[i.label]; ok {
+				return nil, fmt.Errorf("duplicate label %q", i.label)
+			}
+			labels[i.label] = len(code)
+			continue
+		}
+		code = append(code, i)
+	}
+
+	b := make([]byte, 8*len(code))
+	for pc, i := range code {
+		if i.target != "" {
+			target, ok := labels[i.target]
+			if !ok {
+				return nil, fmt.Errorf("undefined label %q", i.target)
+			}
+			i.off = int16(target - pc - 1)
+		}
+		b[8*pc] = i.op
+		b[8*pc+1] = i.src<<4 | i.dst
+		binary.LittleEndian.PutUint16(b[8*pc+2:], uint16(i.off))
+		binary.LittleEndian.PutUint32(b[8*pc+4:], uint32(i.imm))
+	}
+	return b, nil
+}
@@ -0,0 +1,99 @@
+package xdp
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// bpf makes a bpf(2) system call with the attributes in attr.
+func bpf(cmd uintptr, attr []byte) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(unsafe.Pointer(&attr[0])), uintptr(len(attr)))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func pointer(b []byte) uint64 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+// createMap creates a hash map, returning its file descriptor.
+func createMap(keyLen, valueLen, maxEntries uint32) (int, error) {
+	attr := make([]byte, 20)
+	nlenc.PutUint32(attr[0:4], unix.BPF_MAP_TYPE_HASH)
+	nlenc.PutUint32(attr[4:8], keyLen)
+	nlenc.PutUint32(attr[8:12], valueLen)
+	nlenc.PutUint32(attr[12:16], maxEntries)
+	return bpf(unix.BPF_MAP_CREATE, attr)
+}
+
+// mapOp performs a map operation on the element with the given key.
+func mapOp(cmd uintptr, fd int, key, value []byte) error {
+	attr := make([]byte, 32)
+	nlenc.PutUint32(attr[0:4], uint32(fd))
+	nlenc.PutUint64(attr[8:16], pointer(key))
+	nlenc.PutUint64(attr[16:24], pointer(value))
+	_, err := bpf(cmd, attr)
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// loadProgram loads an XDP program, returning its file descriptor.
+// If the verifier rejects the program its log is included in the error.
+func loadProgram(insns []byte) (int, error) {
+	license := []byte("GPL\x00")
+	attr := make([]byte, 48)
+	nlenc.PutUint32(attr[0:4], unix.BPF_PROG_TYPE_XDP)
+	nlenc.PutUint32(attr[4:8], uint32(len(insns)/8))
+	nlenc.PutUint64(attr[8:16], pointer(insns))
+	nlenc.PutUint64(attr[16:24], pointer(license))
+	fd, err := bpf(unix.BPF_PROG_LOAD, attr)
+	if err == nil {
+		return fd, nil
+	}
+
+	log := make([]byte, 64*1024)
+	nlenc.PutUint32(attr[24:28], 1)
+	nlenc.PutUint32(attr[28:32], uint32(len(log)))
+	nlenc.PutUint64(attr[32:40], pointer(log))
+	fd, err = bpf(unix.BPF_PROG_LOAD, attr)
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			log = log[:n]
+		}
+		return -1, fmt.Errorf("%v: %s", err, bytes.TrimSpace(log))
+	}
+	return fd, nil
+}
+
+// testRun runs a program against a packet, returning the program's return
+// value and the packet it produced.
+func testRun(fd int, data []byte) (retval uint32, out []byte, err error) {
+	out = make([]byte, len(data)+256)
+	attr := make([]byte, 40)
+	nlenc.PutUint32(attr[0:4], uint32(fd))
+	nlenc.PutUint32(attr[8:12], uint32(len(data)))
+	nlenc.PutUint32(attr[12:16], uint32(len(out)))
+	nlenc.PutUint64(attr[16:24], pointer(data))
+	nlenc.PutUint64(attr[24:32], pointer(out))
+	nlenc.PutUint32(attr[32:36], 1)
+	_, err = bpf(unix.BPF_PROG_TEST_RUN, attr)
+	runtime.KeepAlive(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	retval = nlenc.Uint32(attr[4:8])
+	return retval, out[:nlenc.Uint32(attr[12:16])], nil
+}
@@ -0,0 +1,208 @@
+package xdp
+
+// XDP actions, as declared in linux/bpf.h
+const (
+	xdpPass     = 2
+	xdpRedirect = 4
+)
+
+// The session map is keyed by the session ID and local UDP port of an
+// L2TPv3 session, in network byte order as they appear in the packet.
+// The port is zero for IP encapsulation.
+const (
+	keyLen       = 8
+	keySessionID = 0
+	keyPort      = 4
+	keyPad       = 6
+)
+
+// The session map value describes how to decapsulate and forward the
+// session's data packets, and counts the packets forwarded.
+const (
+	valueLen       = 32
+	valueIfindex   = 0
+	valueCookieLen = 4
+	valueL2SpecLen = 5
+	valueCookie    = 8
+	valueRxPackets = 16
+	valueRxBytes   = 24
+)
+
+// Header lengths parsed by the program.
+const (
+	ethHeaderLen     = 14
+	ipv4HeaderLen    = 20
+	ipv6HeaderLen    = 40
+	udpHeaderLen     = 8
+	l2tpUDPHeaderLen = 8
+	l2tpIPHeaderLen  = 4
+)
+
+// IP protocol numbers, and Ethernet types and IPv4 fragment flags as
+// loaded from the packet by a little endian host.
+const (
+	protoUDP      = 17
+	protoL2TP     = 115
+	etherTypeIPv4 = 0x0008
+	etherTypeIPv6 = 0xdd86
+	ipv4FragMask  = 0xff3f
+)
+
+// fastPath returns the XDP program which decapsulates the data packets of
+// the L2TPv3 sessions in the session map and redirects the frames they
+// carry.  Anything else, including packets which fail the cookie check,
+// is passed to the kernel network stack.
+//
+// Registers r6-r9 are preserved across helper calls, and are used for the
+// context, the offset of the next header, the IP protocol and the session
+// map value respectively.
+func fastPath(mapFD int) *asm {
+	a := &asm{}
+
+	a.movReg(r6, r1)
+	a.load(bpfW, r2, r6, 0)
+	a.load(bpfW, r3, r6, 4)
+
+	// Ethernet header
+	a.movReg(r4, r2)
+	a.aluImm(bpfAdd, r4, ethHeaderLen)
+	a.jmpReg(bpfJgt, r4, r3, "pass")
+	a.load(bpfH, r5, r2, 12)
+	a.jmpImm(bpfJeq, r5, etherTypeIPv4, "ipv4")
+	a.jmpImm(bpfJeq, r5, etherTypeIPv6, "ipv6")
+	a.jmp("pass")
+
+	// IPv4 header, which may include options.  Fragments are passed to
+	// the kernel for reassembly.
+	a.label("ipv4")
+	a.movReg(r4, r2)
+	a.aluImm(bpfAdd, r4, ethHeaderLen+ipv4HeaderLen)
+	a.jmpReg(bpfJgt, r4, r3, "pass")
+	a.load(bpfH, r5, r2, ethHeaderLen+6)
+	a.jmpImm(bpfJset, r5, ipv4FragMask, "pass")
+	a.load(bpfB, r8, r2, ethHeaderLen+9)
+	a.load(bpfB, r7, r2, ethHeaderLen)
+	a.aluImm(bpfAnd, r7, 0x0f)
+	a.aluImm(bpfLsh, r7, 2)
+	a.jmpImm(bpfJlt, r7, ipv4HeaderLen, "pass")
+	a.aluImm(bpfAdd, r7, ethHeaderLen)
+	a.jmp("l4")
+
+	// IPv6 header.  Packets with extension headers are passed.
+	a.label("ipv6")
+	a.movReg(r4, r2)
+	a.aluImm(bpfAdd, r4, ethHeaderLen+ipv6HeaderLen)
+	a.jmpReg(bpfJgt, r4, r3, "pass")
+	a.load(bpfB, r8, r2, ethHeaderLen+6)
+	a.movImm(r7, ethHeaderLen+ipv6HeaderLen)
+
+	a.label("l4")
+	a.jmpImm(bpfJeq, r8, protoUDP, "udp")
+	a.jmpImm(bpfJeq, r8, protoL2TP, "ip")
+	a.jmp("pass")
+
+	// UDP encapsulation: the L2TPv3 header must be that of a data
+	// packet (RFC3931 section 4.1.2.1)
+	a.label("udp")
+	a.movReg(r9, r2)
+	a.aluReg(bpfAdd, r9, r7)
+	a.movReg(r4, r9)
+	a.aluImm(bpfAdd, r4, udpHeaderLen+l2tpUDPHeaderLen)
+	a.jmpReg(bpfJgt, r4, r3, "pass")
+	a.load(bpfB, r5, r9, udpHeaderLen)
+	a.jmpImm(bpfJset, r5, 0x80, "pass")
+	a.load(bpfB, r5, r9, udpHeaderLen+1)
+	a.aluImm(bpfAnd, r5, 0x0f)
+	a.jmpImm(bpfJne, r5, 3, "pass")
+	a.load(bpfH, r5, r9, 2)
+	a.store(bpfH, r10, r5, -keyLen+keyPort)
+	a.load(bpfW, r5, r9, udpHeaderLen+4)
+	a.store(bpfW, r10, r5, -keyLen+keySessionID)
+	a.aluImm(bpfAdd, r7, udpHeaderLen+l2tpUDPHeaderLen)
+	a.jmp("lookup")
+
+	// IP encapsulation: a zero session ID indicates a control message
+	// (RFC3931 section 4.1.1.2)
+	a.label("ip")
+	a.movReg(r9, r2)
+	a.aluReg(bpfAdd, r9, r7)
+	a.movReg(r4, r9)
+	a.aluImm(bpfAdd, r4, l2tpIPHeaderLen)
+	a.jmpReg(bpfJgt, r4, r3, "pass")
+	a.load(bpfW, r5, r9, 0)
+	a.jmpImm(bpfJeq, r5, 0, "pass")
+	a.store(bpfW, r10, r5, -keyLen+keySessionID)
+	a.movImm(r5, 0)
+	a.store(bpfH, r10, r5, -keyLen+keyPort)
+	a.aluImm(bpfAdd, r7, l2tpIPHeaderLen)
+
+	a.label("lookup")
+	a.movImm(r5, 0)
+	a.store(bpfH, r10, r5, -keyLen+keyPad)
+	a.loadMapFD(r1, mapFD)
+	a.movReg(r2, r10)
+	a.aluImm(bpfAdd, r2, -keyLen)
+	a.call(fnMapLookupElem)
+	a.jmpImm(bpfJeq, r0, 0, "pass")
+	a.movReg(r9, r0)
+
+	// The packet pointers must be reloaded following the helper call
+	a.load(bpfW, r2, r6, 0)
+	a.load(bpfW, r3, r6, 4)
+
+	// The cookie, if any, follows the session ID
+	a.load(bpfB, r4, r9, valueCookieLen)
+	a.movReg(r5, r2)
+	a.aluReg(bpfAdd, r5, r7)
+	a.jmpImm(bpfJeq, r4, 0, "l2spec")
+	a.jmpImm(bpfJeq, r4, 4, "cookie4")
+	a.jmpImm(bpfJne, r4, 8, "pass")
+
+	a.movReg(r8, r5)
+	a.aluImm(bpfAdd, r8, 8)
+	a.jmpReg(bpfJgt, r8, r3, "pass")
+	a.load(bpfW, r8, r5, 4)
+	a.load(bpfW, r0, r9, valueCookie+4)
+	a.jmpReg(bpfJne, r8, r0, "pass")
+	a.aluImm(bpfAdd, r7, 4)
+
+	a.label("cookie4")
+	a.movReg(r8, r5)
+	a.aluImm(bpfAdd, r8, 4)
+	a.jmpReg(bpfJgt, r8, r3, "pass")
+	a.load(bpfW, r8, r5, 0)
+	a.load(bpfW, r0, r9, valueCookie)
+	a.jmpReg(bpfJne, r8, r0, "pass")
+	a.aluImm(bpfAdd, r7, 4)
+
+	// The L2-Specific Sublayer, if any, follows the cookie.  Its
+	// content is ignored, since sessions using sequence numbers aren't
+	// accelerated.
+	a.label("l2spec")
+	a.load(bpfB, r4, r9, valueL2SpecLen)
+	a.aluReg(bpfAdd, r7, r4)
+
+	// Strip the headers, which fails if no Ethernet frame remains
+	a.movReg(r1, r6)
+	a.movReg(r2, r7)
+	a.call(fnXdpAdjustHead)
+	a.jmpImm(bpfJne, r0, 0, "pass")
+
+	a.load(bpfW, r2, r6, 0)
+	a.load(bpfW, r3, r6, 4)
+	a.aluReg(bpfSub, r3, r2)
+	a.movImm(r4, 1)
+	a.atomicAdd(r9, r4, valueRxPackets)
+	a.atomicAdd(r9, r3, valueRxBytes)
+
+	a.load(bpfW, r1, r9, valueIfindex)
+	a.movImm(r2, 0)
+	a.call(fnRedirect)
+	a.exit()
+
+	a.label("pass")
+	a.movImm(r0, xdpPass)
+	a.exit()
+
+	return a
+}
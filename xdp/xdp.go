@@ -0,0 +1,326 @@
+/*
+Package xdp accelerates the data plane of L2TPv3 Ethernet pseudowires on
+Linux systems using an eXpress Data Path program.
+
+The Linux kernel L2TP data plane handles each data packet in the kernel
+network stack, which limits the throughput of a pseudowire.  Package xdp
+loads an XDP program which matches the data packets of L2TPv3 sessions as
+they are received by a network interface, checks their cookies, strips the
+encapsulation and redirects the Ethernet frames they carry straight to a
+target interface, which would usually be the session's pseudowire
+interface.
+
+Any packet the program doesn't forward is passed to the kernel network
+stack as normal: control messages, the packets of sessions which haven't
+been added to the program, fragments, IPv6 packets with extension headers
+and packets failing the cookie check all take the usual path.  Sessions
+using sequence numbers aren't accelerated, since sequence number checks
+are the business of the kernel data plane.
+
+The program only accelerates the receive path: frames sent on the target
+interface are encapsulated by the kernel data plane as usual.
+
+Usage
+
+	import (
+		"github.com/katalix/go-l2tp/l2tp"
+		"github.com/katalix/go-l2tp/xdp"
+	)
+
+	# Note we're ignoring errors for brevity.
+
+	prog, _ := xdp.Load(1024)
+	defer prog.Close()
+
+	_ = prog.Attach(uplink.Index, xdp.ModeDriver)
+	defer prog.Detach()
+
+	sess, _ := xdp.SessionForConfig(tcfg, scfg, pw.Index)
+	_ = prog.AddSession(sess)
+	defer prog.RemoveSession(sess)
+
+Using package xdp requires the CAP_BPF and CAP_NET_ADMIN capabilities, or
+CAP_SYS_ADMIN on older kernels.
+*/
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/katalix/go-l2tp/l2tp"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// XDP attributes, as declared in linux/if_link.h
+const (
+	iflaXdpFD    = 1
+	iflaXdpFlags = 3
+)
+
+// Mode specifies how an XDP program is attached to a network interface.
+type Mode uint32
+
+const (
+	// ModeDriver runs the program in the network interface driver,
+	// which requires driver support.
+	ModeDriver Mode = unix.XDP_FLAGS_DRV_MODE
+	// ModeGeneric runs the program in the kernel network stack, which
+	// works with any network interface but is slower.
+	ModeGeneric Mode = unix.XDP_FLAGS_SKB_MODE
+	// ModeOffload runs the program on the network interface hardware,
+	// which requires hardware support.
+	ModeOffload Mode = unix.XDP_FLAGS_HW_MODE
+)
+
+// Session describes an L2TPv3 session whose data packets are forwarded by
+// the XDP program.
+type Session struct {
+	// SessionID is the session ID carried by the session's data packets.
+	SessionID l2tp.ControlConnID
+
+	// Port is the local UDP port of the session's tunnel, or zero for IP
+	// encapsulation.
+	Port uint16
+
+	// Cookie is the cookie carried by the session's data packets, which
+	// is zero, four or eight bytes long.  Packets with any other cookie
+	// are passed to the kernel network stack.
+	Cookie []byte
+
+	// L2SpecType is the Layer 2 specific sublayer carried by the
+	// session's data packets.
+	L2SpecType l2tp.L2SpecType
+
+	// Ifindex is the index of the interface frames are redirected to.
+	Ifindex int
+}
+
+// SessionForConfig returns the session forwarding the data packets of
+// the session described by the tunnel and session configurations to the
+// target interface.
+// Only L2TPv3 Ethernet pseudowires without sequence numbers can be
+// accelerated.
+func SessionForConfig(tcfg *l2tp.TunnelConfig, scfg *l2tp.SessionConfig, ifindex int) (*Session, error) {
+	if tcfg == nil || scfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+	if tcfg.Version != l2tp.ProtocolVersion3 {
+		return nil, fmt.Errorf("only L2TPv3 sessions can be accelerated")
+	}
+	if scfg.Pseudowire != l2tp.PseudowireTypeEth && scfg.Pseudowire != l2tp.PseudowireTypeEthVLAN {
+		return nil, fmt.Errorf("only Ethernet pseudowires can be accelerated")
+	}
+	if scfg.SeqNum {
+		return nil, fmt.Errorf("sessions using sequence numbers cannot be accelerated")
+	}
+
+	s := &Session{
+		SessionID:  scfg.SessionID,
+		Cookie:     scfg.PeerCookie,
+		L2SpecType: scfg.L2SpecType,
+		Ifindex:    ifindex,
+	}
+	switch tcfg.Encap {
+	case l2tp.EncapTypeUDP:
+		port, err := localPort(tcfg.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address %q: %v", tcfg.Local, err)
+		}
+		s.Port = port
+	case l2tp.EncapTypeIP:
+	default:
+		return nil, fmt.Errorf("unrecognised encapsulation type %v", tcfg.Encap)
+	}
+	return s, nil
+}
+
+func localPort(addr string) (uint16, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return uint16(port), nil
+}
+
+func (s *Session) key() []byte {
+	key := make([]byte, keyLen)
+	binary.BigEndian.PutUint32(key[keySessionID:], uint32(s.SessionID))
+	binary.BigEndian.PutUint16(key[keyPort:], s.Port)
+	return key
+}
+
+func (s *Session) value() ([]byte, error) {
+	if s.SessionID == 0 {
+		return nil, fmt.Errorf("session ID must be non-zero")
+	}
+	if s.Ifindex <= 0 {
+		return nil, fmt.Errorf("invalid target interface index %v", s.Ifindex)
+	}
+	value := make([]byte, valueLen)
+	nlenc.PutUint32(value[valueIfindex:valueIfindex+4], uint32(s.Ifindex))
+	switch len(s.Cookie) {
+	case 0, 4, 8:
+		value[valueCookieLen] = byte(len(s.Cookie))
+		copy(value[valueCookie:], s.Cookie)
+	default:
+		return nil, fmt.Errorf("cookie length must be 0, 4 or 8 bytes")
+	}
+	switch s.L2SpecType {
+	case l2tp.L2SpecTypeNone:
+	case l2tp.L2SpecTypeDefault:
+		value[valueL2SpecLen] = 4
+	default:
+		return nil, fmt.Errorf("unrecognised L2SpecType %v", s.L2SpecType)
+	}
+	return value, nil
+}
+
+// Stats contains the statistics of a session's forwarded packets.
+type Stats struct {
+	// RxPackets is the number of data packets forwarded.
+	RxPackets uint64
+	// RxBytes is the number of bytes of the frames forwarded.
+	RxBytes uint64
+}
+
+// Program is an XDP program forwarding the data packets of L2TPv3
+// sessions.
+type Program struct {
+	progFD, mapFD int
+	ifindex       int
+}
+
+// Load loads the XDP program into the kernel.  maxSessions limits the
+// number of sessions which may be added to the program.
+func Load(maxSessions int) (*Program, error) {
+	if maxSessions <= 0 {
+		return nil, fmt.Errorf("maxSessions must be positive")
+	}
+	mapFD, err := createMap(keyLen, valueLen, uint32(maxSessions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session map: %v", err)
+	}
+	insns, err := fastPath(mapFD).assemble()
+	if err != nil {
+		unix.Close(mapFD)
+		return nil, err
+	}
+	progFD, err := loadProgram(insns)
+	if err != nil {
+		unix.Close(mapFD)
+		return nil, fmt.Errorf("failed to load program: %v", err)
+	}
+	return &Program{progFD: progFD, mapFD: mapFD}, nil
+}
+
+// Close detaches the program if it is attached and releases its
+// resources.
+func (p *Program) Close() error {
+	var err error
+	if p.ifindex != 0 {
+		err = p.Detach()
+	}
+	unix.Close(p.progFD)
+	unix.Close(p.mapFD)
+	return err
+}
+
+// AddSession adds a session to the program, or updates an existing
+// session.  The session's statistics are reset.
+func (p *Program) AddSession(s *Session) error {
+	value, err := s.value()
+	if err != nil {
+		return err
+	}
+	return mapOp(unix.BPF_MAP_UPDATE_ELEM, p.mapFD, s.key(), value)
+}
+
+// RemoveSession removes a session from the program.
+func (p *Program) RemoveSession(s *Session) error {
+	return mapOp(unix.BPF_MAP_DELETE_ELEM, p.mapFD, s.key(), nil)
+}
+
+// Stats returns the statistics of a session.
+func (p *Program) Stats(s *Session) (*Stats, error) {
+	value := make([]byte, valueLen)
+	err := mapOp(unix.BPF_MAP_LOOKUP_ELEM, p.mapFD, s.key(), value)
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{
+		RxPackets: nlenc.Uint64(value[valueRxPackets : valueRxPackets+8]),
+		RxBytes:   nlenc.Uint64(value[valueRxBytes : valueRxBytes+8]),
+	}, nil
+}
+
+// Attach attaches the program to the network interface receiving the
+// sessions' data packets.  A program may only be attached to one
+// interface at a time.
+func (p *Program) Attach(ifindex int, mode Mode) error {
+	if p.ifindex != 0 {
+		return fmt.Errorf("program is already attached to interface %v", p.ifindex)
+	}
+	if err := setLinkXdp(ifindex, p.progFD, uint32(mode)); err != nil {
+		return fmt.Errorf("failed to attach program: %v", err)
+	}
+	p.ifindex = ifindex
+	return nil
+}
+
+// Detach detaches the program from its network interface.
+func (p *Program) Detach() error {
+	if p.ifindex == 0 {
+		return errors.New("program is not attached")
+	}
+	if err := setLinkXdp(p.ifindex, -1, 0); err != nil {
+		return fmt.Errorf("failed to detach program: %v", err)
+	}
+	p.ifindex = 0
+	return nil
+}
+
+// setLinkXdp sets the XDP program of a network interface, where a file
+// descriptor of -1 removes the interface's program.
+func setLinkXdp(ifindex, fd int, flags uint32) error {
+	xdp, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: iflaXdpFD, Data: nlenc.Uint32Bytes(uint32(fd))},
+		{Type: iflaXdpFlags, Data: nlenc.Uint32Bytes(flags)},
+	})
+	if err != nil {
+		return err
+	}
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFLA_XDP | unix.NLA_F_NESTED, Data: xdp},
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ifinfo := make([]byte, unix.SizeofIfInfomsg)
+	ifinfo[0] = unix.AF_UNSPEC
+	nlenc.PutUint32(ifinfo[4:8], uint32(ifindex))
+	_, err = c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_SETLINK,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(ifinfo, attrs...),
+	})
+	return err
+}
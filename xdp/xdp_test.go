@@ -0,0 +1,257 @@
+package xdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/katalix/go-l2tp/l2tp"
+	"golang.org/x/sys/unix"
+)
+
+func TestAssemble(t *testing.T) {
+	a := &asm{}
+	a.jmpImm(bpfJeq, r1, 0, "out")
+	a.movImm(r0, 1)
+	a.exit()
+	a.label("out")
+	a.movImm(r0, 2)
+	a.exit()
+	b, err := a.assemble()
+	if err != nil {
+		t.Fatalf("assemble(): %v", err)
+	}
+	want := []byte{
+		0x15, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xb7, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x95, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xb7, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0x95, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("assemble(): got %x, want %x", b, want)
+	}
+
+	a.jmp("missing")
+	if _, err := a.assemble(); err == nil {
+		t.Errorf("assemble(): expected error for undefined label")
+	}
+}
+
+func TestSessionForConfig(t *testing.T) {
+	cases := []struct {
+		name  string
+		tcfg  *l2tp.TunnelConfig
+		scfg  *l2tp.SessionConfig
+		want  *Session
+		isErr bool
+	}{
+		{
+			name: "UDP",
+			tcfg: &l2tp.TunnelConfig{Version: l2tp.ProtocolVersion3, Encap: l2tp.EncapTypeUDP, Local: "10.0.0.1:1701"},
+			scfg: &l2tp.SessionConfig{
+				SessionID:  42,
+				Pseudowire: l2tp.PseudowireTypeEth,
+				PeerCookie: []byte{1, 2, 3, 4},
+				L2SpecType: l2tp.L2SpecTypeDefault,
+			},
+			want: &Session{SessionID: 42, Port: 1701, Cookie: []byte{1, 2, 3, 4}, L2SpecType: l2tp.L2SpecTypeDefault, Ifindex: 3},
+		},
+		{
+			name: "IP",
+			tcfg: &l2tp.TunnelConfig{Version: l2tp.ProtocolVersion3, Encap: l2tp.EncapTypeIP, Local: "10.0.0.1:0"},
+			scfg: &l2tp.SessionConfig{SessionID: 42, Pseudowire: l2tp.PseudowireTypeEth},
+			want: &Session{SessionID: 42, Ifindex: 3},
+		},
+		{
+			name:  "L2TPv2",
+			tcfg:  &l2tp.TunnelConfig{Version: l2tp.ProtocolVersion2, Encap: l2tp.EncapTypeUDP, Local: "10.0.0.1:1701"},
+			scfg:  &l2tp.SessionConfig{SessionID: 42, Pseudowire: l2tp.PseudowireTypePPP},
+			isErr: true,
+		},
+		{
+			name:  "Sequence numbers",
+			tcfg:  &l2tp.TunnelConfig{Version: l2tp.ProtocolVersion3, Encap: l2tp.EncapTypeUDP, Local: "10.0.0.1:1701"},
+			scfg:  &l2tp.SessionConfig{SessionID: 42, Pseudowire: l2tp.PseudowireTypeEth, SeqNum: true},
+			isErr: true,
+		},
+		{
+			name:  "No local port",
+			tcfg:  &l2tp.TunnelConfig{Version: l2tp.ProtocolVersion3, Encap: l2tp.EncapTypeUDP},
+			scfg:  &l2tp.SessionConfig{SessionID: 42, Pseudowire: l2tp.PseudowireTypeEth},
+			isErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := SessionForConfig(c.tcfg, c.scfg, 3)
+			if c.isErr {
+				if err == nil {
+					t.Fatalf("SessionForConfig(): expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SessionForConfig(): %v", err)
+			}
+			if s.SessionID != c.want.SessionID || s.Port != c.want.Port ||
+				!bytes.Equal(s.Cookie, c.want.Cookie) || s.L2SpecType != c.want.L2SpecType ||
+				s.Ifindex != c.want.Ifindex {
+				t.Errorf("SessionForConfig(): got %+v, want %+v", s, c.want)
+			}
+		})
+	}
+}
+
+// encapUDP returns an Ethernet frame carrying an L2TPv3 data packet over
+// IPv4 and UDP.
+func encapUDP(sid uint32, port uint16, cookie, l2spec, frame []byte) []byte {
+	var b []byte
+	b = append(b, make([]byte, 12)...)
+	b = append(b, 0x08, 0x00)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:], []byte{10, 0, 0, 2, 10, 0, 0, 1})
+	b = append(b, ip...)
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 1701)
+	binary.BigEndian.PutUint16(udp[2:], port)
+	b = append(b, udp...)
+
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:], 0x0003)
+	binary.BigEndian.PutUint32(hdr[4:], sid)
+	b = append(b, hdr...)
+	b = append(b, cookie...)
+	b = append(b, l2spec...)
+	return append(b, frame...)
+}
+
+// encapIP returns an Ethernet frame carrying an L2TPv3 data packet over
+// IPv6.
+func encapIP(sid uint32, cookie, frame []byte) []byte {
+	var b []byte
+	b = append(b, make([]byte, 12)...)
+	b = append(b, 0x86, 0xdd)
+
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 115
+	ip[7] = 64
+	b = append(b, ip...)
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, sid)
+	b = append(b, hdr...)
+	b = append(b, cookie...)
+	return append(b, frame...)
+}
+
+func TestProgram(t *testing.T) {
+	fd, err := createMap(keyLen, valueLen, 1)
+	if err == unix.EPERM || err == unix.ENOSYS {
+		t.Skipf("BPF unavailable: %v", err)
+	}
+	if err == nil {
+		unix.Close(fd)
+	}
+
+	prog, err := Load(16)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	defer prog.Close()
+
+	sessions := []*Session{
+		{SessionID: 42, Port: 1701, Cookie: []byte{1, 2, 3, 4}, L2SpecType: l2tp.L2SpecTypeDefault, Ifindex: 1},
+		{SessionID: 43, Port: 1701, Cookie: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Ifindex: 1},
+		{SessionID: 44, Ifindex: 1},
+	}
+	for _, s := range sessions {
+		if err := prog.AddSession(s); err != nil {
+			t.Fatalf("AddSession(%+v): %v", s, err)
+		}
+	}
+
+	frame := bytes.Repeat([]byte{0xaa}, 64)
+	cases := []struct {
+		name    string
+		packet  []byte
+		forward bool
+	}{
+		{
+			name:    "UDP with cookie and sublayer",
+			packet:  encapUDP(42, 1701, []byte{1, 2, 3, 4}, []byte{0x40, 0, 0, 0}, frame),
+			forward: true,
+		},
+		{
+			name:    "UDP with 64 bit cookie",
+			packet:  encapUDP(43, 1701, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil, frame),
+			forward: true,
+		},
+		{
+			name:    "IP",
+			packet:  encapIP(44, nil, frame),
+			forward: true,
+		},
+		{
+			name:   "Wrong cookie",
+			packet: encapUDP(43, 1701, []byte{1, 2, 3, 4, 8, 7, 6, 5}, nil, frame),
+		},
+		{
+			name:   "Wrong port",
+			packet: encapUDP(42, 1702, []byte{1, 2, 3, 4}, []byte{0x40, 0, 0, 0}, frame),
+		},
+		{
+			name:   "Unknown session",
+			packet: encapIP(45, nil, frame),
+		},
+		{
+			name:   "Control message",
+			packet: encapIP(0, nil, frame),
+		},
+		{
+			name:   "Truncated",
+			packet: encapUDP(42, 1701, []byte{1, 2, 3, 4}, nil, nil),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			retval, out, err := testRun(prog.progFD, c.packet)
+			if err != nil {
+				t.Fatalf("testRun(): %v", err)
+			}
+			if !c.forward {
+				if retval != xdpPass {
+					t.Errorf("testRun(): got %v, want XDP_PASS", retval)
+				}
+				return
+			}
+			if retval != xdpRedirect {
+				t.Fatalf("testRun(): got %v, want XDP_REDIRECT", retval)
+			}
+			if !bytes.Equal(out, frame) {
+				t.Errorf("testRun(): got frame %x, want %x", out, frame)
+			}
+		})
+	}
+
+	stats, err := prog.Stats(sessions[0])
+	if err != nil {
+		t.Fatalf("Stats(): %v", err)
+	}
+	if stats.RxPackets != 1 || stats.RxBytes != uint64(len(frame)) {
+		t.Errorf("Stats(): unexpected statistics %+v", stats)
+	}
+
+	if err := prog.RemoveSession(sessions[0]); err != nil {
+		t.Fatalf("RemoveSession(): %v", err)
+	}
+	if _, err := prog.Stats(sessions[0]); err == nil {
+		t.Errorf("Stats(): expected error for removed session")
+	}
+}